@@ -0,0 +1,40 @@
+// Code generated by cmd/lexgen (see Makefile's lexgen); DO NOT EDIT.
+
+package atproto
+
+// schema: com.atproto.sync.listReposByCollection
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+// SyncListReposByCollection_Output is the output of a com.atproto.sync.listReposByCollection call.
+type SyncListReposByCollection_Output struct {
+	Cursor *string                           `json:"cursor,omitempty" cborgen:"cursor,omitempty"`
+	Repos  []*SyncListReposByCollection_Repo `json:"repos" cborgen:"repos"`
+}
+
+// SyncListReposByCollection_Repo is a "repo" in the com.atproto.sync.listReposByCollection schema.
+type SyncListReposByCollection_Repo struct {
+	Did string `json:"did" cborgen:"did"`
+}
+
+// SyncListReposByCollection calls the XRPC method "com.atproto.sync.listReposByCollection".
+//
+// limit: Maximum size of response set. Recommend setting a large maximum (1000+) when enumerating large DID lists.
+func SyncListReposByCollection(ctx context.Context, c *xrpc.Client, collection string, cursor string, limit int64) (*SyncListReposByCollection_Output, error) {
+	var out SyncListReposByCollection_Output
+
+	params := map[string]interface{}{
+		"collection": collection,
+		"cursor":     cursor,
+		"limit":      limit,
+	}
+	if err := c.Do(ctx, xrpc.Query, "", "com.atproto.sync.listReposByCollection", params, nil, &out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
@@ -0,0 +1,222 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/did"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	otel "go.opentelemetry.io/otel"
+)
+
+// DelegatedHandleResolver resolves handles by asking a handle resolution
+// service, so that a fleet of relays can share one resolver and its cache.
+// The service is called as
+//
+//	GET <url>?handle=<handle>
+//
+// and answers 200 with {"did": "did:..."}, or 404 if the handle doesn't
+// resolve. A 404 is final; any other response, or no response, counts as the
+// service failing, and the handle is resolved with the fallback resolver
+// instead. After enough failures in a row the resolver stops calling the
+// service for a while and goes straight to the fallback, then lets a single
+// request through to see if it has recovered.
+type DelegatedHandleResolver struct {
+	url      string
+	token    string
+	client   *http.Client
+	fallback HandleResolver
+
+	failureThreshold int
+	cooldown         time.Duration
+
+	lk sync.Mutex
+	// failures in a row, and when the breaker lets a request through again
+	// once it has tripped
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+type DelegatedHandleResolverOptions struct {
+	// bearer token sent to the service, if set
+	Token   string
+	Timeout time.Duration
+	// failures in a row before the service is skipped, and for how long
+	FailureThreshold int
+	Cooldown         time.Duration
+}
+
+func DefaultDelegatedHandleResolverOptions() *DelegatedHandleResolverOptions {
+	return &DelegatedHandleResolverOptions{
+		Timeout:          5 * time.Second,
+		FailureThreshold: 5,
+		Cooldown:         30 * time.Second,
+	}
+}
+
+// NewDelegatedHandleResolver returns a resolver calling the service at
+// serviceURL, and fallback when it can't. With a nil fallback, resolution
+// fails while the service is unavailable.
+func NewDelegatedHandleResolver(serviceURL string, fallback HandleResolver, opts *DelegatedHandleResolverOptions) (*DelegatedHandleResolver, error) {
+	if opts == nil {
+		opts = DefaultDelegatedHandleResolverOptions()
+	}
+
+	u, err := url.Parse(serviceURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid handle resolver URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("handle resolver URL %q must be an http(s) URL", serviceURL)
+	}
+
+	return &DelegatedHandleResolver{
+		url:   serviceURL,
+		token: opts.Token,
+		client: &http.Client{
+			Transport: otelhttp.NewTransport(http.DefaultTransport),
+			Timeout:   opts.Timeout,
+		},
+		fallback:         fallback,
+		failureThreshold: max(opts.FailureThreshold, 1),
+		cooldown:         opts.Cooldown,
+	}, nil
+}
+
+// errDelegatedNotFound is the service's answer that a handle doesn't resolve
+var errDelegatedNotFound = errors.New("handle not found by resolution service")
+
+func (dr *DelegatedHandleResolver) ResolveHandleToDid(ctx context.Context, handle string) (string, error) {
+	ctx, span := otel.Tracer("resolver").Start(ctx, "DelegatedResolveHandleToDid")
+	defer span.End()
+
+	if !dr.allow() {
+		delegatedLookups.WithLabelValues("skipped").Inc()
+		return dr.resolveFallback(ctx, handle, errors.New("handle resolution service circuit open"))
+	}
+
+	start := time.Now()
+	res, err := dr.resolveService(ctx, handle)
+	delegatedLookupDuration.Observe(time.Since(start).Seconds())
+
+	switch {
+	case err == nil:
+		delegatedLookups.WithLabelValues("ok").Inc()
+		dr.record(true)
+		return res, nil
+	case errors.Is(err, errDelegatedNotFound):
+		delegatedLookups.WithLabelValues("not_found").Inc()
+		dr.record(true)
+		return "", fmt.Errorf("no did record found for handle %q: %w", handle, ErrHandleNotFound)
+	case ctx.Err() != nil:
+		// the caller gave up, which says nothing about the service
+		dr.abandon()
+		return "", err
+	}
+
+	delegatedLookups.WithLabelValues("error").Inc()
+	dr.record(false)
+	return dr.resolveFallback(ctx, handle, err)
+}
+
+func (dr *DelegatedHandleResolver) resolveFallback(ctx context.Context, handle string, serr error) (string, error) {
+	if dr.fallback == nil {
+		return "", fmt.Errorf("resolving handle %q: %w", handle, serr)
+	}
+	delegatedFallbacks.Inc()
+	return dr.fallback.ResolveHandleToDid(ctx, handle)
+}
+
+// allow reports whether the service should be called: always while the
+// breaker is closed, and once it has tripped, by one request at a time after
+// the cooldown until one succeeds
+func (dr *DelegatedHandleResolver) allow() bool {
+	dr.lk.Lock()
+	defer dr.lk.Unlock()
+
+	if dr.failures < dr.failureThreshold {
+		return true
+	}
+	if dr.probing || time.Now().Before(dr.openUntil) {
+		return false
+	}
+	dr.probing = true
+	return true
+}
+
+func (dr *DelegatedHandleResolver) record(ok bool) {
+	dr.lk.Lock()
+	defer dr.lk.Unlock()
+
+	dr.probing = false
+	if ok {
+		dr.failures = 0
+		delegatedBreakerOpen.Set(0)
+		return
+	}
+
+	dr.failures++
+	if dr.failures >= dr.failureThreshold {
+		dr.openUntil = time.Now().Add(dr.cooldown)
+		delegatedBreakerOpen.Set(1)
+	}
+}
+
+// abandon ends a request without counting it for or against the service
+func (dr *DelegatedHandleResolver) abandon() {
+	dr.lk.Lock()
+	dr.probing = false
+	dr.lk.Unlock()
+}
+
+type delegatedResponse struct {
+	Did string `json:"did"`
+}
+
+func (dr *DelegatedHandleResolver) resolveService(ctx context.Context, handle string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", dr.url, nil)
+	if err != nil {
+		return "", err
+	}
+	q := req.URL.Query()
+	q.Set("handle", handle)
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("Accept", "application/json")
+	if dr.token != "" {
+		req.Header.Set("Authorization", "Bearer "+dr.token)
+	}
+
+	resp, err := dr.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("handle resolution service request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", errDelegatedNotFound
+	default:
+		return "", fmt.Errorf("handle resolution service request: status=%d", resp.StatusCode)
+	}
+
+	var out delegatedResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 2048)).Decode(&out); err != nil {
+		return "", fmt.Errorf("decoding handle resolution service response: %w", err)
+	}
+
+	parsed, err := did.ParseDID(out.Did)
+	if err != nil {
+		return "", fmt.Errorf("handle resolution service returned invalid did: %w", err)
+	}
+
+	return parsed.String(), nil
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type staticHandleResolver map[string]string
+
+func (r staticHandleResolver) ResolveHandleToDid(ctx context.Context, handle string) (string, error) {
+	if d, ok := r[handle]; ok {
+		return d, nil
+	}
+	return "", fmt.Errorf("no did record found for handle %q", handle)
+}
+
+func TestDelegatedHandleResolver(t *testing.T) {
+	ctx := context.Background()
+
+	var calls atomic.Int64
+	var failing atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Header.Get("Authorization") != "Bearer sekrit" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if r.URL.Query().Get("handle") != "alice.test" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"did": "did:plc:ewvi7nxzyoun6zhxrhs64oiz"})
+	}))
+	defer srv.Close()
+
+	fallback := staticHandleResolver{
+		"alice.test": "did:plc:fallbackfallbackfallback",
+		"bob.test":   "did:plc:bobbobbobbobbobbobbobbob",
+	}
+	opts := DefaultDelegatedHandleResolverOptions()
+	opts.Token = "sekrit"
+	opts.FailureThreshold = 2
+	opts.Cooldown = 50 * time.Millisecond
+	hr, err := NewDelegatedHandleResolver(srv.URL+"/resolve", fallback, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := hr.ResolveHandleToDid(ctx, "alice.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != "did:plc:ewvi7nxzyoun6zhxrhs64oiz" {
+		t.Fatalf("expected did from service, got %s", d)
+	}
+
+	// the service saying a handle doesn't resolve is final
+	if _, err := hr.ResolveHandleToDid(ctx, "bob.test"); !errors.Is(err, ErrHandleNotFound) {
+		t.Fatalf("expected handle not found by service, got %v", err)
+	}
+
+	// failures fall back, and trip the breaker after the threshold
+	failing.Store(true)
+	for i := 0; i < 2; i++ {
+		d, err := hr.ResolveHandleToDid(ctx, "alice.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d != "did:plc:fallbackfallbackfallback" {
+			t.Fatalf("expected did from fallback, got %s", d)
+		}
+	}
+	before := calls.Load()
+	if _, err := hr.ResolveHandleToDid(ctx, "alice.test"); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != before {
+		t.Fatal("expected service to be skipped while the breaker is open")
+	}
+
+	// once the cooldown is up, a successful request closes the breaker
+	failing.Store(false)
+	time.Sleep(60 * time.Millisecond)
+	d, err = hr.ResolveHandleToDid(ctx, "alice.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != "did:plc:ewvi7nxzyoun6zhxrhs64oiz" || calls.Load() != before+1 {
+		t.Fatalf("expected service to be tried again after the cooldown, got %s", d)
+	}
+	if hr.failures != 0 {
+		t.Fatalf("expected breaker to close, have %d failures", hr.failures)
+	}
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// txtResolver looks up TXT records through one upstream. A lookup that gets
+// an authoritative answer that the name or record doesn't exist returns a
+// *net.DNSError with IsNotFound set.
+type txtResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+type dnsUpstream struct {
+	// "dns" or "doh", for metrics
+	method string
+	// the server address or URL, for errors
+	addr     string
+	resolver txtResolver
+}
+
+// dohResolver resolves names with DNS-over-HTTPS (RFC 8484), for when plain
+// DNS egress is blocked
+type dohResolver struct {
+	url    string
+	client *http.Client
+}
+
+func newDoHResolver(url string) *dohResolver {
+	return &dohResolver{
+		url: url,
+		client: &http.Client{
+			Transport: otelhttp.NewTransport(http.DefaultTransport),
+			Timeout:   time.Second * 10,
+		},
+	}
+}
+
+// largest response accepted; the same as the largest DNS message
+const maxDoHResponse = 64 << 10
+
+func (r *dohResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, &net.DNSError{Err: "invalid name", Name: name, Server: r.url, IsNotFound: true}
+	}
+
+	// ID zero, as RFC 8484 suggests, so that HTTP caches can share responses
+	q := dnsmessage.Message{
+		Header: dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  qname,
+			Type:  dnsmessage.TypeTXT,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	body, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", r.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("doh request to %s: %w", r.url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh request to %s: status=%d", r.url, resp.StatusCode)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxDoHResponse))
+	if err != nil {
+		return nil, fmt.Errorf("reading doh response from %s: %w", r.url, err)
+	}
+
+	return parseTXTResponse(b, name, r.url)
+}
+
+func parseTXTResponse(b []byte, name, server string) ([]string, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing dns response from %s: %w", server, err)
+	}
+
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, &net.DNSError{Err: "no such host", Name: name, Server: server, IsNotFound: true}
+	default:
+		return nil, &net.DNSError{Err: fmt.Sprintf("server responded %s", h.RCode), Name: name, Server: server}
+	}
+
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, fmt.Errorf("parsing dns response from %s: %w", server, err)
+	}
+
+	var txts []string
+	for {
+		ah, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing dns response from %s: %w", server, err)
+		}
+
+		if ah.Type != dnsmessage.TypeTXT || ah.Class != dnsmessage.ClassINET {
+			if err := p.SkipAnswer(); err != nil {
+				return nil, fmt.Errorf("parsing dns response from %s: %w", server, err)
+			}
+			continue
+		}
+
+		rr, err := p.TXTResource()
+		if err != nil {
+			return nil, fmt.Errorf("parsing dns response from %s: %w", server, err)
+		}
+
+		// like net.Resolver, join the strings of a record into one
+		var txt string
+		for _, s := range rr.TXT {
+			txt += s
+		}
+		txts = append(txts, txt)
+	}
+
+	if len(txts) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: name, Server: server, IsNotFound: true}
+	}
+	return txts, nil
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dohServer answers TXT queries from records, and NXDOMAIN for anything else
+func dohServer(t *testing.T, records map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/dns-message" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var q dnsmessage.Message
+		if err := q.Unpack(b); err != nil {
+			t.Fatal(err)
+		}
+
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{Response: true, RecursionAvailable: true},
+			Questions: q.Questions,
+		}
+		qname := q.Questions[0].Name
+		txt, ok := records[strings.TrimSuffix(qname.String(), ".")]
+		if ok {
+			resp.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: qname, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: 60},
+				// long records are split into several strings
+				Body: &dnsmessage.TXTResource{TXT: []string{txt[:8], txt[8:]}},
+			}}
+		} else {
+			resp.Header.RCode = dnsmessage.RCodeNameError
+		}
+
+		out, err := resp.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(out)
+	}))
+}
+
+func TestHandleResolverDoH(t *testing.T) {
+	ctx := context.Background()
+
+	srv := dohServer(t, map[string]string{
+		"_atproto.alice.test": "did=did:plc:ewvi7nxzyoun6zhxrhs64oiz",
+	})
+	defer srv.Close()
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer broken.Close()
+
+	// falls back from the broken upstream
+	hr, err := NewProdHandleResolver(10, "", false, broken.URL, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	did, err := hr.resolveDNS(ctx, "alice.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if did != "did:plc:ewvi7nxzyoun6zhxrhs64oiz" {
+		t.Fatalf("unexpected did: %s", did)
+	}
+
+	// a missing record is a final answer; the plain DNS upstream after it
+	// (which can't be reached here) isn't tried
+	hr, err = NewProdHandleResolver(10, "127.0.0.1:1", false, srv.URL, "dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = hr.resolveDNS(ctx, "bob.test")
+	if err == nil {
+		t.Fatal("expected lookup of missing record to fail")
+	}
+	if strings.Contains(err.Error(), "127.0.0.1:1") {
+		t.Fatalf("expected no fallback after not found, got: %s", err)
+	}
+	if !errors.Is(err, errNoDIDRecord) {
+		t.Fatalf("expected a missing record to count as no DID, got: %s", err)
+	}
+
+	// every upstream failing reports each of them
+	hr, err = NewProdHandleResolver(10, "", false, broken.URL, broken.URL+"/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = hr.resolveDNS(ctx, "alice.test")
+	if err == nil || !strings.Contains(err.Error(), "/other") {
+		t.Fatalf("expected errors from both upstreams, got: %v", err)
+	}
+	if errors.Is(err, errNoDIDRecord) {
+		t.Fatalf("expected broken upstreams not to count as no DID, got: %s", err)
+	}
+
+	if _, err := NewProdHandleResolver(10, "", false, "8.8.8.8"); err == nil {
+		t.Fatal("expected an error for an unrecognized upstream")
+	}
+}
@@ -69,6 +69,16 @@ type HandleResolver interface {
 	ResolveHandleToDid(ctx context.Context, handle string) (string, error)
 }
 
+// ErrHandleNotFound is wrapped by handle resolution errors when every
+// resolution method got an answer, and none of them named a DID: the handle
+// doesn't resolve, as opposed to not being resolved because of a network or
+// server problem.
+var ErrHandleNotFound = errors.New("handle does not resolve to a DID")
+
+// errNoDIDRecord marks a single resolution method's answer that the handle
+// has no DID
+var errNoDIDRecord = errors.New("no did record")
+
 type failCacheItem struct {
 	err       error
 	count     int
@@ -77,12 +87,18 @@ type failCacheItem struct {
 
 type ProdHandleResolver struct {
 	client    *http.Client
-	resolver  *net.Resolver
+	dns       []dnsUpstream
 	ReqMod    func(*http.Request, string) error
 	FailCache *arc.ARCCache[string, *failCacheItem]
 }
 
-func NewProdHandleResolver(failureCacheSize int, resolveAddr string, forceUDP bool) (*ProdHandleResolver, error) {
+// NewProdHandleResolver returns a resolver that checks both a handle's
+// well-known route and its DNS TXT record. DNS lookups go to the upstreams in
+// dnsUpstreams, tried in order: "dns" is the plain DNS server at resolveAddr,
+// and an http(s) URL is a DNS-over-HTTPS server. A lookup only falls back to
+// the next upstream if it fails to get an answer; an answer that the record
+// doesn't exist is final. With no upstreams, only plain DNS is used.
+func NewProdHandleResolver(failureCacheSize int, resolveAddr string, forceUDP bool, dnsUpstreams ...string) (*ProdHandleResolver, error) {
 	failureCache, err := arc.NewARC[string, *failCacheItem](failureCacheSize)
 	if err != nil {
 		return nil, err
@@ -97,7 +113,39 @@ func NewProdHandleResolver(failureCacheSize int, resolveAddr string, forceUDP bo
 		Timeout:   time.Second * 10,
 	}
 
-	r := &net.Resolver{
+	if len(dnsUpstreams) == 0 {
+		dnsUpstreams = []string{"dns"}
+	}
+
+	var upstreams []dnsUpstream
+	for _, u := range dnsUpstreams {
+		switch {
+		case u == "dns":
+			upstreams = append(upstreams, dnsUpstream{
+				method:   "dns",
+				addr:     resolveAddr,
+				resolver: plainDNSResolver(resolveAddr, forceUDP),
+			})
+		case strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "http://"):
+			upstreams = append(upstreams, dnsUpstream{
+				method:   "doh",
+				addr:     u,
+				resolver: newDoHResolver(u),
+			})
+		default:
+			return nil, fmt.Errorf("unrecognized dns upstream %q: must be \"dns\" or a DNS-over-HTTPS URL", u)
+		}
+	}
+
+	return &ProdHandleResolver{
+		FailCache: failureCache,
+		client:    &c,
+		dns:       upstreams,
+	}, nil
+}
+
+func plainDNSResolver(resolveAddr string, forceUDP bool) *net.Resolver {
+	return &net.Resolver{
 		PreferGo: true,
 		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
 			d := net.Dialer{
@@ -109,12 +157,6 @@ func NewProdHandleResolver(failureCacheSize int, resolveAddr string, forceUDP bo
 			return d.DialContext(ctx, network, resolveAddr)
 		},
 	}
-
-	return &ProdHandleResolver{
-		FailCache: failureCache,
-		client:    &c,
-		resolver:  r,
-	}, nil
 }
 
 func (dr *ProdHandleResolver) ResolveHandleToDid(ctx context.Context, handle string) (string, error) {
@@ -168,6 +210,9 @@ func (dr *ProdHandleResolver) ResolveHandleToDid(ctx context.Context, handle str
 	}
 
 	err := errors.Join(fmt.Errorf("no did record found for handle %q", handle), dnserr, wkerr)
+	if errors.Is(dnserr, errNoDIDRecord) && errors.Is(wkerr, errNoDIDRecord) {
+		err = errors.Join(ErrHandleNotFound, err)
+	}
 
 	if dr.FailCache != nil {
 		cachedFailureCount++
@@ -207,7 +252,15 @@ func (dr *ProdHandleResolver) resolveWellKnown(ctx context.Context, handle strin
 
 	resp, err := dr.client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to resolve handle (%s) through HTTP well-known route: %s", handle, err)
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			err = errors.Join(errNoDIDRecord, err)
+		}
+		return "", fmt.Errorf("failed to resolve handle (%s) through HTTP well-known route: %w", handle, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return "", fmt.Errorf("failed to resolve handle (%s) through HTTP well-known route: status=%d: %w", handle, resp.StatusCode, errNoDIDRecord)
 	}
 	if resp.StatusCode != 200 {
 		return "", fmt.Errorf("failed to resolve handle (%s) through HTTP well-known route: status=%d", handle, resp.StatusCode)
@@ -224,15 +277,19 @@ func (dr *ProdHandleResolver) resolveWellKnown(ctx context.Context, handle strin
 
 	parsed, err := did.ParseDID(string(b))
 	if err != nil {
-		return "", err
+		return "", errors.Join(errNoDIDRecord, err)
 	}
 
 	return parsed.String(), nil
 }
 
 func (dr *ProdHandleResolver) resolveDNS(ctx context.Context, handle string) (string, error) {
-	res, err := dr.resolver.LookupTXT(ctx, "_atproto."+handle)
+	res, err := dr.lookupTXT(ctx, "_atproto."+handle)
 	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			err = errors.Join(errNoDIDRecord, err)
+		}
 		return "", fmt.Errorf("handle lookup failed: %w", err)
 	}
 
@@ -241,14 +298,42 @@ func (dr *ProdHandleResolver) resolveDNS(ctx context.Context, handle string) (st
 			parts := strings.Split(s, "=")
 			pdid, err := did.ParseDID(parts[1])
 			if err != nil {
-				return "", fmt.Errorf("invalid did in record: %w", err)
+				return "", fmt.Errorf("invalid did in record: %w", errors.Join(errNoDIDRecord, err))
 			}
 
 			return pdid.String(), nil
 		}
 	}
 
-	return "", fmt.Errorf("no did record found")
+	return "", fmt.Errorf("no did record found: %w", errNoDIDRecord)
+}
+
+// lookupTXT tries each DNS upstream in turn until one gets an answer
+func (dr *ProdHandleResolver) lookupTXT(ctx context.Context, name string) ([]string, error) {
+	var errs []error
+	for _, u := range dr.dns {
+		start := time.Now()
+		res, err := u.resolver.LookupTXT(ctx, name)
+		dnsLookupDuration.WithLabelValues(u.method).Observe(time.Since(start).Seconds())
+
+		var dnsErr *net.DNSError
+		switch {
+		case err == nil:
+			dnsLookups.WithLabelValues(u.method, "ok").Inc()
+			return res, nil
+		case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+			dnsLookups.WithLabelValues(u.method, "not_found").Inc()
+			return nil, err
+		case ctx.Err() != nil:
+			// the lookup was called off, eg because the well-known route
+			// answered first; that's no reason to try the next upstream
+			return nil, err
+		}
+
+		dnsLookups.WithLabelValues(u.method, "error").Inc()
+		errs = append(errs, fmt.Errorf("%s %s: %w", u.method, u.addr, err))
+	}
+	return nil, errors.Join(errs...)
 }
 
 type TestHandleResolver struct {
@@ -258,6 +343,8 @@ type TestHandleResolver struct {
 func (tr *TestHandleResolver) ResolveHandleToDid(ctx context.Context, handle string) (string, error) {
 	c := http.DefaultClient
 
+	// whether every host answered without naming a DID
+	notFound := true
 	for _, h := range tr.TrialHosts {
 		req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/.well-known/atproto-did", h), nil)
 		if err != nil {
@@ -269,10 +356,14 @@ func (tr *TestHandleResolver) ResolveHandleToDid(ctx context.Context, handle str
 		resp, err := c.Do(req)
 		if err != nil {
 			slog.Warn("failed to resolve handle to DID", "handle", handle, "err", err)
+			notFound = false
 			continue
 		}
 
 		if resp.StatusCode != 200 {
+			if resp.StatusCode != http.StatusNotFound {
+				notFound = false
+			}
 			slog.Warn("got non-200 status code while resolving handle", "handle", handle, "statusCode", resp.StatusCode)
 			continue
 		}
@@ -290,5 +381,8 @@ func (tr *TestHandleResolver) ResolveHandleToDid(ctx context.Context, handle str
 		return parsed.String(), nil
 	}
 
+	if notFound {
+		return "", fmt.Errorf("no did record found for handle %q: %w", handle, ErrHandleNotFound)
+	}
 	return "", fmt.Errorf("no did record found for handle %q", handle)
 }
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var dnsLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "handle_resolver_dns_lookups_total",
+	Help: "Number of handle DNS lookups by method (dns or doh) and result",
+}, []string{"method", "result"})
+
+var dnsLookupDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "handle_resolver_dns_lookup_duration_seconds",
+	Help:    "Time taken by handle DNS lookups, by method (dns or doh)",
+	Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+}, []string{"method"})
+
+var delegatedLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "handle_resolver_delegated_lookups_total",
+	Help: "Number of handle lookups sent to the handle resolution service by result, or skipped while its circuit was open",
+}, []string{"result"})
+
+var delegatedLookupDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "handle_resolver_delegated_lookup_duration_seconds",
+	Help:    "Time taken by handle resolution service requests",
+	Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+})
+
+var delegatedFallbacks = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "handle_resolver_delegated_fallbacks_total",
+	Help: "Number of handle lookups that fell back to the built-in resolver",
+})
+
+var delegatedBreakerOpen = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "handle_resolver_delegated_circuit_open",
+	Help: "Whether the handle resolution service's circuit breaker has tripped",
+})
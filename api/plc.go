@@ -12,14 +12,30 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
+	didres "github.com/bluesky-social/indigo/did"
+	"github.com/bluesky-social/indigo/util/retry"
 	did "github.com/whyrusleeping/go-did"
 	otel "go.opentelemetry.io/otel"
 )
 
+var plcRetryPolicy = retry.Policy{
+	Backoff:     retry.Backoff{Initial: time.Millisecond * 200, Max: time.Second * 2},
+	MaxAttempts: 3,
+}
+
 type PLCServer struct {
 	Host string
 	C    *http.Client
+
+	// Path of a batch lookup endpoint on Host, for PLC mirrors that have
+	// one. It's POSTed {"dids": [...]}, and answers with an object mapping
+	// the DIDs it knows to their documents. plc.directory has none, so
+	// without it ResolveDIDs looks DIDs up one at a time.
+	BatchPath string
+	// Most DIDs in each batch request; 100 if zero
+	BatchSize int
 }
 
 func (s *PLCServer) GetDocument(ctx context.Context, didstr string) (*did.Document, error) {
@@ -30,32 +46,127 @@ func (s *PLCServer) GetDocument(ctx context.Context, didstr string) (*did.Docume
 		s.C = http.DefaultClient
 	}
 
-	req, err := http.NewRequest("GET", s.Host+"/"+didstr, nil)
-	if err != nil {
-		return nil, err
-	}
+	return retry.DoValue(ctx, plcRetryPolicy, func(ctx context.Context) (*did.Document, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", s.Host+"/"+didstr, nil)
+		if err != nil {
+			return nil, retry.MarkPermanent(err)
+		}
+
+		resp, err := s.C.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			err := fmt.Errorf("get did request failed (code %d): %s", resp.StatusCode, resp.Status)
+			if retry.ClassifyHTTPStatus(resp.StatusCode) == retry.Permanent {
+				return nil, retry.MarkPermanent(err)
+			}
+			return nil, err
+		}
+
+		var doc did.Document
+		if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+			return nil, retry.MarkPermanent(err)
+		}
+
+		return &doc, nil
+	})
+}
 
-	resp, err := s.C.Do(req.WithContext(ctx))
-	if err != nil {
-		return nil, err
+func (s *PLCServer) FlushCacheFor(did string) {
+	return
+}
+
+type plcBatchRequest struct {
+	Dids []string `json:"dids"`
+}
+
+// ResolveDIDs resolves dids with the batch endpoint if there is one. DIDs it
+// doesn't return, or all of a batch if the request fails, are looked up one
+// at a time instead.
+func (s *PLCServer) ResolveDIDs(ctx context.Context, dids []string) map[string]didres.DIDResult {
+	if s.BatchPath == "" {
+		return didres.ResolveEach(ctx, s, dids)
 	}
 
-	defer resp.Body.Close()
+	ctx, span := otel.Tracer("gosky").Start(ctx, "plcResolveDids")
+	defer span.End()
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("get did request failed (code %d): %s", resp.StatusCode, resp.Status)
+	size := s.BatchSize
+	if size <= 0 {
+		size = 100
 	}
 
-	var doc did.Document
-	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
-		return nil, err
+	uniq := didres.Dedupe(dids)
+	out := make(map[string]didres.DIDResult, len(uniq))
+	var missing []string
+	for len(uniq) > 0 {
+		n := min(size, len(uniq))
+		batch := uniq[:n]
+		uniq = uniq[n:]
+
+		docs, err := s.getDocuments(ctx, batch)
+		if err != nil {
+			missing = append(missing, batch...)
+			continue
+		}
+		for _, d := range batch {
+			if doc, ok := docs[d]; ok && doc != nil {
+				out[d] = didres.DIDResult{Doc: doc}
+			} else {
+				missing = append(missing, d)
+			}
+		}
 	}
 
-	return &doc, nil
+	for d, res := range didres.ResolveEach(ctx, s, missing) {
+		out[d] = res
+	}
+	return out
 }
 
-func (s *PLCServer) FlushCacheFor(did string) {
-	return
+func (s *PLCServer) getDocuments(ctx context.Context, dids []string) (map[string]*did.Document, error) {
+	if s.C == nil {
+		s.C = http.DefaultClient
+	}
+
+	body, err := json.Marshal(plcBatchRequest{Dids: dids})
+	if err != nil {
+		return nil, err
+	}
+
+	return retry.DoValue(ctx, plcRetryPolicy, func(ctx context.Context) (map[string]*did.Document, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", s.Host+s.BatchPath, bytes.NewReader(body))
+		if err != nil {
+			return nil, retry.MarkPermanent(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := s.C.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			err := fmt.Errorf("batch get dids request failed (code %d): %s", resp.StatusCode, resp.Status)
+			if retry.ClassifyHTTPStatus(resp.StatusCode) == retry.Permanent {
+				return nil, retry.MarkPermanent(err)
+			}
+			return nil, err
+		}
+
+		var docs map[string]*did.Document
+		if err := json.NewDecoder(resp.Body).Decode(&docs); err != nil {
+			return nil, retry.MarkPermanent(err)
+		}
+
+		return docs, nil
+	})
 }
 
 type CreateOp struct {
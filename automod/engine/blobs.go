@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -9,10 +10,17 @@ import (
 
 	"github.com/bluesky-social/indigo/atproto/data"
 	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/util/retry"
 
 	"github.com/carlmjohnson/versioninfo"
 )
 
+var blobRetryPolicy = retry.Policy{
+	Backoff:     retry.Backoff{Initial: time.Millisecond * 500, Max: time.Second * 5},
+	MaxAttempts: 3,
+	MaxElapsed:  time.Second * 30,
+}
+
 // Parses out any blobs from the enclosed record.
 //
 // NOTE: for consistency with other RecordContext methods, which don't usually return errors, maybe the error-returning version of this function should be a helper function, or defined on RecordOp, and the RecordContext version should return an empty array on error?
@@ -49,46 +57,45 @@ func (c *RecordContext) fetchBlob(blob lexutil.LexBlob) ([]byte, error) {
 		blobDownloadDuration.Observe(duration.Seconds())
 	}()
 
-	var blobBytes []byte
-
 	// TODO: potential security issue here with malformed or "localhost" PDS endpoint
 	pdsEndpoint := c.Account.Identity.PDSEndpoint()
 	xrpcURL := fmt.Sprintf("%s/xrpc/com.atproto.sync.getBlob?did=%s&cid=%s", pdsEndpoint, c.Account.Identity.DID, blob.Ref)
 
-	req, err := http.NewRequest("GET", xrpcURL, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("User-Agent", "indigo-automod/"+versioninfo.Short())
-	// TODO: more robust PDS hostname check (eg, future trailing slash or partial path)
-	if c.engine.BskyClient.Headers != nil && strings.HasSuffix(pdsEndpoint, ".bsky.network") {
-		val, ok := c.engine.BskyClient.Headers["x-ratelimit-bypass"]
-		if ok {
-			req.Header.Set("x-ratelimit-bypass", val)
-		}
-	}
-
 	client := c.engine.BlobClient
 	if client == nil {
 		client = http.DefaultClient
 	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+	return retry.DoValue(c.Ctx, blobRetryPolicy, func(ctx context.Context) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", xrpcURL, nil)
+		if err != nil {
+			return nil, retry.MarkPermanent(err)
+		}
 
-	blobDownloadCount.WithLabelValues(fmt.Sprint(resp.StatusCode)).Inc()
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("failed to fetch blob from PDS. did=%s cid=%s statusCode=%d", c.Account.Identity.DID, blob.Ref, resp.StatusCode)
-	}
+		req.Header.Set("User-Agent", "indigo-automod/"+versioninfo.Short())
+		// TODO: more robust PDS hostname check (eg, future trailing slash or partial path)
+		if c.engine.BskyClient.Headers != nil && strings.HasSuffix(pdsEndpoint, ".bsky.network") {
+			val, ok := c.engine.BskyClient.Headers["x-ratelimit-bypass"]
+			if ok {
+				req.Header.Set("x-ratelimit-bypass", val)
+			}
+		}
 
-	blobBytes, err = io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		blobDownloadCount.WithLabelValues(fmt.Sprint(resp.StatusCode)).Inc()
+		if resp.StatusCode != 200 {
+			err := fmt.Errorf("failed to fetch blob from PDS. did=%s cid=%s statusCode=%d", c.Account.Identity.DID, blob.Ref, resp.StatusCode)
+			if retry.ClassifyHTTPStatus(resp.StatusCode) == retry.Permanent {
+				return nil, retry.MarkPermanent(err)
+			}
+			return nil, err
+		}
 
-	return blobBytes, nil
+		return io.ReadAll(resp.Body)
+	})
 }
@@ -2,6 +2,7 @@ package engine
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 
@@ -21,6 +22,8 @@ type BaseContext struct {
 
 	engine  *Engine // NOTE: pointer, but expected never to be nil
 	effects *Effects
+	// graph store queries remaining for this event; created on first use
+	graph *graphBudget
 }
 
 // Both a useful context on it's own (eg, for identity events), and extended by other context types.
@@ -223,6 +226,64 @@ func (c *AccountContext) GetAccountRelationship(other syntax.DID) AccountRelatio
 	return *rel
 }
 
+func (c *BaseContext) graphQueryBudget() *graphBudget {
+	if c.graph == nil {
+		c.graph = c.engine.newGraphBudget()
+	}
+	return c.graph
+}
+
+// records a graph signal error. Running out of query budget is expected under load, so it is logged rather than failing the event.
+func (c *BaseContext) graphErr(err error) {
+	if errors.Is(err, ErrGraphBudgetExhausted) {
+		c.Logger.Warn("skipping graph signal", "err", err)
+		return
+	}
+	if nil == c.Err {
+		c.Err = err
+	}
+}
+
+// fetch follower and following counts for this account from the graph store
+func (c *AccountContext) GetGraphStats() GraphStats {
+	gs, err := c.engine.GetGraphStats(c.Ctx, c.Account.Identity.DID, c.graphQueryBudget())
+	if err != nil {
+		c.graphErr(err)
+		return GraphStats{DID: c.Account.Identity.DID}
+	}
+	return *gs
+}
+
+// of a sample of accounts this account follows, how many follow it back
+func (c *AccountContext) GetFollowBack() GraphOverlap {
+	fb, err := c.engine.GetFollowBack(c.Ctx, c.Account.Identity.DID, c.graphQueryBudget())
+	if err != nil {
+		c.graphErr(err)
+		return GraphOverlap{}
+	}
+	return *fb
+}
+
+// of a sample of this account's followers, how many are in the named set (eg, known members of a spam cluster)
+func (c *AccountContext) GetFollowerOverlap(setName string) GraphOverlap {
+	ov, err := c.engine.GetGraphSetOverlap(c.Ctx, c.Account.Identity.DID, setName, false, c.graphQueryBudget())
+	if err != nil {
+		c.graphErr(err)
+		return GraphOverlap{}
+	}
+	return *ov
+}
+
+// of a sample of the accounts this account follows, how many are in the named set
+func (c *AccountContext) GetFollowingOverlap(setName string) GraphOverlap {
+	ov, err := c.engine.GetGraphSetOverlap(c.Ctx, c.Account.Identity.DID, setName, true, c.graphQueryBudget())
+	if err != nil {
+		c.graphErr(err)
+		return GraphOverlap{}
+	}
+	return *ov
+}
+
 // fetch account metadata for the given DID. if there is any problem with lookup, returns nil.
 //
 // TODO: should this take an AtIdentifier instead?
@@ -13,6 +13,7 @@ import (
 	"github.com/bluesky-social/indigo/automod/cachestore"
 	"github.com/bluesky-social/indigo/automod/countstore"
 	"github.com/bluesky-social/indigo/automod/flagstore"
+	"github.com/bluesky-social/indigo/automod/graphstore"
 	"github.com/bluesky-social/indigo/automod/setstore"
 	"github.com/bluesky-social/indigo/xrpc"
 )
@@ -44,6 +45,8 @@ type Engine struct {
 	AdminClient *xrpc.Client
 	// used to fetch blobs from upstream PDS instances
 	BlobClient *http.Client
+	// follow-graph queries for graph-based signals; optional
+	Graph graphstore.GraphStore
 
 	// internal configuration
 	Config EngineConfig
@@ -52,6 +55,10 @@ type Engine struct {
 type EngineConfig struct {
 	// if enabled, account metadata is not hydrated for every event by default
 	SkipAccountMeta bool
+	// maximum number of graph store queries made while processing a single event; zero for the default
+	GraphQueryBudget int
+	// number of followers or follows sampled for graph overlap signals; zero for the default
+	GraphSampleSize int
 }
 
 // Entrypoint for external code pushing #identity events in to the engine.
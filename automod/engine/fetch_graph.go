@@ -0,0 +1,194 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+const (
+	defaultGraphQueryBudget = 10
+	defaultGraphSampleSize  = 100
+)
+
+// Returned when an event has used up its graph store query budget
+var ErrGraphBudgetExhausted = errors.New("graph query budget exhausted")
+
+// Follow-graph counts for an account
+type GraphStats struct {
+	DID            syntax.DID
+	FollowerCount  int64
+	FollowingCount int64
+}
+
+// How many of a sample of an account's followers (or follows) matched some criteria
+type GraphOverlap struct {
+	Sampled int
+	Matched int
+}
+
+// Fraction of the sample which matched, or zero for an empty sample
+func (o GraphOverlap) Ratio() float64 {
+	if o.Sampled == 0 {
+		return 0
+	}
+	return float64(o.Matched) / float64(o.Sampled)
+}
+
+// Limits the number of graph store queries made while processing a single
+// event. A nil budget is unlimited.
+type graphBudget struct {
+	remaining int
+}
+
+func (eng *Engine) newGraphBudget() *graphBudget {
+	n := eng.Config.GraphQueryBudget
+	if n <= 0 {
+		n = defaultGraphQueryBudget
+	}
+	return &graphBudget{remaining: n}
+}
+
+func (b *graphBudget) take(n int) error {
+	if b == nil {
+		return nil
+	}
+	if b.remaining < n {
+		graphBudgetExhausted.Inc()
+		return ErrGraphBudgetExhausted
+	}
+	b.remaining -= n
+	return nil
+}
+
+func (eng *Engine) graphSampleSize() int {
+	if eng.Config.GraphSampleSize > 0 {
+		return eng.Config.GraphSampleSize
+	}
+	return defaultGraphSampleSize
+}
+
+// helper for the cache-or-fetch pattern used by all the graph signals
+func graphCached[T any](ctx context.Context, eng *Engine, name, key string, fetch func() (*T, error)) (*T, error) {
+	existing, err := eng.Cache.Get(ctx, name, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed checking graph signal cache: %w", err)
+	}
+	if existing != "" {
+		var out T
+		if err := json.Unmarshal([]byte(existing), &out); err != nil {
+			return nil, fmt.Errorf("parsing %s from cache: %w", name, err)
+		}
+		return &out, nil
+	}
+
+	out, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(out)
+	if err != nil {
+		return nil, err
+	}
+	if err := eng.Cache.Set(ctx, name, key, string(b)); err != nil {
+		eng.Logger.Error("writing graph signal to cache", "name", name, "key", key, "err", err)
+	}
+	return out, nil
+}
+
+// Helper to fetch follower and following counts from the graph store
+func (eng *Engine) GetGraphStats(ctx context.Context, did syntax.DID, budget *graphBudget) (*GraphStats, error) {
+	if eng.Graph == nil {
+		return &GraphStats{DID: did}, nil
+	}
+
+	return graphCached(ctx, eng, "graph-stats", did.String(), func() (*GraphStats, error) {
+		if err := budget.take(2); err != nil {
+			return nil, err
+		}
+		graphQueries.WithLabelValues("stats").Inc()
+
+		followers, err := eng.Graph.FollowerCount(ctx, did)
+		if err != nil {
+			return nil, fmt.Errorf("fetching follower count: %w", err)
+		}
+		following, err := eng.Graph.FollowingCount(ctx, did)
+		if err != nil {
+			return nil, fmt.Errorf("fetching following count: %w", err)
+		}
+		return &GraphStats{DID: did, FollowerCount: followers, FollowingCount: following}, nil
+	})
+}
+
+// Helper to compute how many of a sample of the accounts followed by did follow it back
+func (eng *Engine) GetFollowBack(ctx context.Context, did syntax.DID, budget *graphBudget) (*GraphOverlap, error) {
+	if eng.Graph == nil {
+		return &GraphOverlap{}, nil
+	}
+
+	return graphCached(ctx, eng, "graph-followback", did.String(), func() (*GraphOverlap, error) {
+		if err := budget.take(2); err != nil {
+			return nil, err
+		}
+		graphQueries.WithLabelValues("followback").Inc()
+
+		sample, err := eng.Graph.Following(ctx, did, eng.graphSampleSize())
+		if err != nil {
+			return nil, fmt.Errorf("fetching follows: %w", err)
+		}
+		if len(sample) == 0 {
+			return &GraphOverlap{}, nil
+		}
+		n, err := eng.Graph.CountFollowersAmong(ctx, did, sample)
+		if err != nil {
+			return nil, fmt.Errorf("counting follow-backs: %w", err)
+		}
+		return &GraphOverlap{Sampled: len(sample), Matched: int(n)}, nil
+	})
+}
+
+// Helper to compute how many of a sample of an account's followers (or, if
+// following is set, the accounts it follows) are members of the named set
+func (eng *Engine) GetGraphSetOverlap(ctx context.Context, did syntax.DID, setName string, following bool, budget *graphBudget) (*GraphOverlap, error) {
+	if eng.Graph == nil {
+		return &GraphOverlap{}, nil
+	}
+
+	name := "graph-overlap-followers"
+	if following {
+		name = "graph-overlap-following"
+	}
+	return graphCached(ctx, eng, name, did.String()+"/"+setName, func() (*GraphOverlap, error) {
+		if err := budget.take(1); err != nil {
+			return nil, err
+		}
+		graphQueries.WithLabelValues("overlap").Inc()
+
+		var sample []syntax.DID
+		var err error
+		if following {
+			sample, err = eng.Graph.Following(ctx, did, eng.graphSampleSize())
+		} else {
+			sample, err = eng.Graph.Followers(ctx, did, eng.graphSampleSize())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("fetching graph sample: %w", err)
+		}
+
+		out := GraphOverlap{Sampled: len(sample)}
+		for _, other := range sample {
+			ok, err := eng.Sets.InSet(ctx, setName, other.String())
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				out.Matched++
+			}
+		}
+		return &out, nil
+	})
+}
@@ -0,0 +1,61 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/automod/graphstore"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGraphSignals(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	eng := EngineTestFixture()
+	eng.Config.GraphQueryBudget = 3
+
+	did := syntax.DID("did:plc:abc111")
+	graph := graphstore.NewMemGraphStore()
+	for i := 0; i < 10; i++ {
+		other := syntax.DID(fmt.Sprintf("did:web:other%d.example.com", i))
+		graph.AddFollow(did, other)
+		if i%5 == 0 {
+			graph.AddFollow(other, did)
+		}
+	}
+	graph.AddFollow(syntax.DID("did:web:hardr.example.com"), did)
+	eng.Graph = graph
+
+	budget := eng.newGraphBudget()
+
+	gs, err := eng.GetGraphStats(ctx, did, budget)
+	assert.NoError(err)
+	assert.Equal(int64(3), gs.FollowerCount)
+	assert.Equal(int64(10), gs.FollowingCount)
+
+	// cached, so doesn't use any more budget
+	_, err = eng.GetGraphStats(ctx, did, budget)
+	assert.NoError(err)
+
+	_, err = eng.GetFollowBack(ctx, did, budget)
+	assert.ErrorIs(err, ErrGraphBudgetExhausted)
+
+	ov, err := eng.GetGraphSetOverlap(ctx, did, "bad-words", false, budget)
+	assert.NoError(err)
+	assert.Equal(GraphOverlap{Sampled: 3, Matched: 0}, *ov)
+
+	fb, err := eng.GetFollowBack(ctx, did, eng.newGraphBudget())
+	assert.NoError(err)
+	assert.Equal(GraphOverlap{Sampled: 10, Matched: 2}, *fb)
+	assert.InDelta(0.2, fb.Ratio(), 0.001)
+
+	// no graph store configured
+	eng.Graph = nil
+	gs, err = eng.GetGraphStats(ctx, syntax.DID("did:plc:other"), nil)
+	assert.NoError(err)
+	assert.Equal(int64(0), gs.FollowerCount)
+}
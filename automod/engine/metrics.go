@@ -65,6 +65,16 @@ var accountRelationshipFetches = promauto.NewCounter(prometheus.CounterOpts{
 	Help: "Number of account relationship reads (API calls)",
 })
 
+var graphQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "automod_graph_queries",
+	Help: "Number of graph signal reads from the graph store (excluding cache hits)",
+}, []string{"type"})
+
+var graphBudgetExhausted = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "automod_graph_budget_exhausted",
+	Help: "Number of graph signal reads skipped because the event's query budget was used up",
+})
+
 var blobDownloadCount = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "automod_blob_downloads",
 	Help: "Number of blobs downloaded, by HTTP status code",
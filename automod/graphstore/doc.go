@@ -0,0 +1,2 @@
+// Interface for follow-graph queries (counts, follower and following lists, and follow checks), with an in-process memory implementation and an HTTP client for an external graph service.
+package graphstore
@@ -0,0 +1,105 @@
+package graphstore
+
+import (
+	"context"
+	"sync"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+type GraphStore interface {
+	// Number of accounts following the given account
+	FollowerCount(ctx context.Context, did syntax.DID) (int64, error)
+	// Number of accounts the given account follows
+	FollowingCount(ctx context.Context, did syntax.DID) (int64, error)
+	// Up to limit accounts following the given account
+	Followers(ctx context.Context, did syntax.DID, limit int) ([]syntax.DID, error)
+	// Up to limit accounts the given account follows
+	Following(ctx context.Context, did syntax.DID, limit int) ([]syntax.DID, error)
+	// How many of the actors follow subject
+	CountFollowersAmong(ctx context.Context, subject syntax.DID, actors []syntax.DID) (int64, error)
+}
+
+// In-process graph, intended for tests and small deployments
+type MemGraphStore struct {
+	lk        sync.RWMutex
+	followers map[syntax.DID]map[syntax.DID]bool
+	following map[syntax.DID]map[syntax.DID]bool
+}
+
+func NewMemGraphStore() *MemGraphStore {
+	return &MemGraphStore{
+		followers: make(map[syntax.DID]map[syntax.DID]bool),
+		following: make(map[syntax.DID]map[syntax.DID]bool),
+	}
+}
+
+func (s *MemGraphStore) AddFollow(actor, subject syntax.DID) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if s.following[actor] == nil {
+		s.following[actor] = make(map[syntax.DID]bool)
+	}
+	s.following[actor][subject] = true
+	if s.followers[subject] == nil {
+		s.followers[subject] = make(map[syntax.DID]bool)
+	}
+	s.followers[subject][actor] = true
+}
+
+func (s *MemGraphStore) RemoveFollow(actor, subject syntax.DID) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	delete(s.following[actor], subject)
+	delete(s.followers[subject], actor)
+}
+
+func (s *MemGraphStore) FollowerCount(ctx context.Context, did syntax.DID) (int64, error) {
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+	return int64(len(s.followers[did])), nil
+}
+
+func (s *MemGraphStore) FollowingCount(ctx context.Context, did syntax.DID) (int64, error) {
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+	return int64(len(s.following[did])), nil
+}
+
+func (s *MemGraphStore) Followers(ctx context.Context, did syntax.DID, limit int) ([]syntax.DID, error) {
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+	return firstN(s.followers[did], limit), nil
+}
+
+func (s *MemGraphStore) Following(ctx context.Context, did syntax.DID, limit int) ([]syntax.DID, error) {
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+	return firstN(s.following[did], limit), nil
+}
+
+func (s *MemGraphStore) CountFollowersAmong(ctx context.Context, subject syntax.DID, actors []syntax.DID) (int64, error) {
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+
+	var n int64
+	for _, a := range actors {
+		if s.followers[subject][a] {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func firstN(set map[syntax.DID]bool, limit int) []syntax.DID {
+	out := make([]syntax.DID, 0, min(len(set), limit))
+	for d := range set {
+		if len(out) >= limit {
+			break
+		}
+		out = append(out, d)
+	}
+	return out
+}
@@ -0,0 +1,151 @@
+package graphstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+// Client for an external follow-graph service. Endpoints, relative to Host:
+//
+//	GET  /followers/count?did=    -> {"count": int}
+//	GET  /following/count?did=    -> {"count": int}
+//	GET  /followers?did=&limit=   -> {"dids": [string]}
+//	GET  /following?did=&limit=   -> {"dids": [string]}
+//	POST /followers/among         {"subject": string, "actors": [string]} -> {"count": int}
+type HTTPGraphStore struct {
+	Host string
+
+	c *http.Client
+}
+
+func NewHTTPGraphStore(host string) *HTTPGraphStore {
+	return &HTTPGraphStore{
+		Host: host,
+		c: &http.Client{
+			Timeout: time.Second * 5,
+		},
+	}
+}
+
+type countResp struct {
+	Count int64 `json:"count"`
+}
+
+type didsResp struct {
+	DIDs []string `json:"dids"`
+}
+
+type amongReq struct {
+	Subject string   `json:"subject"`
+	Actors  []string `json:"actors"`
+}
+
+func (s *HTTPGraphStore) do(ctx context.Context, method, path string, params url.Values, body, out any) error {
+	u := s.Host + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+
+	var rdr io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rdr = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, rdr)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.c.Do(req)
+	if err != nil {
+		return fmt.Errorf("graph service request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("graph service request %s failed: status %d", path, resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding graph service response: %w", err)
+	}
+	return nil
+}
+
+func (s *HTTPGraphStore) count(ctx context.Context, path string, did syntax.DID) (int64, error) {
+	var out countResp
+	if err := s.do(ctx, http.MethodGet, path, url.Values{"did": {did.String()}}, nil, &out); err != nil {
+		return 0, err
+	}
+	return out.Count, nil
+}
+
+func (s *HTTPGraphStore) list(ctx context.Context, path string, did syntax.DID, limit int) ([]syntax.DID, error) {
+	var out didsResp
+	params := url.Values{
+		"did":   {did.String()},
+		"limit": {strconv.Itoa(limit)},
+	}
+	if err := s.do(ctx, http.MethodGet, path, params, nil, &out); err != nil {
+		return nil, err
+	}
+
+	dids := make([]syntax.DID, 0, len(out.DIDs))
+	for _, raw := range out.DIDs {
+		d, err := syntax.ParseDID(raw)
+		if err != nil {
+			return nil, fmt.Errorf("graph service returned invalid DID %q: %w", raw, err)
+		}
+		dids = append(dids, d)
+	}
+	return dids, nil
+}
+
+func (s *HTTPGraphStore) FollowerCount(ctx context.Context, did syntax.DID) (int64, error) {
+	return s.count(ctx, "/followers/count", did)
+}
+
+func (s *HTTPGraphStore) FollowingCount(ctx context.Context, did syntax.DID) (int64, error) {
+	return s.count(ctx, "/following/count", did)
+}
+
+func (s *HTTPGraphStore) Followers(ctx context.Context, did syntax.DID, limit int) ([]syntax.DID, error) {
+	return s.list(ctx, "/followers", did, limit)
+}
+
+func (s *HTTPGraphStore) Following(ctx context.Context, did syntax.DID, limit int) ([]syntax.DID, error) {
+	return s.list(ctx, "/following", did, limit)
+}
+
+func (s *HTTPGraphStore) CountFollowersAmong(ctx context.Context, subject syntax.DID, actors []syntax.DID) (int64, error) {
+	req := amongReq{
+		Subject: subject.String(),
+		Actors:  make([]string, len(actors)),
+	}
+	for i, a := range actors {
+		req.Actors[i] = a.String()
+	}
+
+	var out countResp
+	if err := s.do(ctx, http.MethodPost, "/followers/among", nil, &req, &out); err != nil {
+		return 0, err
+	}
+	return out.Count, nil
+}
@@ -11,6 +11,8 @@ type AccountMeta = engine.AccountMeta
 type ProfileSummary = engine.ProfileSummary
 type AccountPrivate = engine.AccountPrivate
 type RuleSet = engine.RuleSet
+type GraphStats = engine.GraphStats
+type GraphOverlap = engine.GraphOverlap
 
 type Notifier = engine.Notifier
 type SlackNotifier = engine.SlackNotifier
@@ -39,6 +39,7 @@ func DefaultRules() automod.RuleSet {
 		},
 		RecordRules: []automod.RecordRuleFunc{
 			InteractionChurnRule,
+			FollowSpamRingRule,
 			BadWordRecordKeyRule,
 			BadWordOtherRecordRule,
 			TooManyRepostRule,
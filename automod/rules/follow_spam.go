@@ -0,0 +1,51 @@
+package rules
+
+import (
+	"fmt"
+
+	"github.com/bluesky-social/indigo/automod"
+	"github.com/bluesky-social/indigo/automod/countstore"
+)
+
+// graph signals are only checked every this many follows in a day, to keep graph store load down
+var followSpamCheckInterval = 50
+var followSpamMinFollowing int64 = 200
+
+var _ automod.RecordRuleFunc = FollowSpamRingRule
+
+// looks for accounts doing mass follows into a known follow-spam cluster, or which follow many accounts and almost never get followed back
+func FollowSpamRingRule(c *automod.RecordContext) error {
+	if c.RecordOp.Collection != "app.bsky.graph.follow" {
+		return nil
+	}
+
+	did := c.Account.Identity.DID.String()
+	created := c.GetCount("follow", did, countstore.PeriodDay) + 1
+	if created < followSpamCheckInterval || created%followSpamCheckInterval != 0 {
+		return nil
+	}
+
+	stats := c.GetGraphStats()
+	if stats.FollowingCount < followSpamMinFollowing {
+		return nil
+	}
+
+	ring := c.GetFollowingOverlap("follow-spam-ring-dids")
+	if ring.Sampled >= 20 && ring.Ratio() > 0.3 {
+		c.Logger.Info("follow-spam-ring", "sampled", ring.Sampled, "matched", ring.Matched)
+		c.AddAccountFlag("follow-spam-ring")
+		c.ReportAccount(automod.ReportReasonSpam, fmt.Sprintf("follow spam ring: %d of %d sampled follows are known ring accounts", ring.Matched, ring.Sampled))
+		c.Notify("slack")
+		return nil
+	}
+
+	fb := c.GetFollowBack()
+	if fb.Sampled >= 50 && fb.Ratio() < 0.02 && stats.FollowerCount*20 < stats.FollowingCount {
+		c.Logger.Info("low-follow-back", "sampled", fb.Sampled, "followed-back", fb.Matched, "followers", stats.FollowerCount, "following", stats.FollowingCount)
+		c.AddAccountFlag("low-follow-back")
+		c.ReportAccount(automod.ReportReasonSpam, fmt.Sprintf("mass following with little follow-back: %d of %d sampled follows followed back (%d followers, %d following)", fb.Matched, fb.Sampled, stats.FollowerCount, stats.FollowingCount))
+		c.Notify("slack")
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/automod"
+	"github.com/bluesky-social/indigo/automod/engine"
+	"github.com/bluesky-social/indigo/automod/graphstore"
+	"github.com/bluesky-social/indigo/automod/setstore"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFollowSpamRingRule(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	eng := engine.EngineTestFixture()
+	eng.Rules = automod.RuleSet{
+		RecordRules: []automod.RecordRuleFunc{
+			FollowSpamRingRule,
+		},
+	}
+
+	did := syntax.DID("did:plc:abc111")
+	graph := graphstore.NewMemGraphStore()
+	sets := eng.Sets.(setstore.MemSetStore)
+	sets.Sets["follow-spam-ring-dids"] = make(map[string]bool)
+	for i := 0; i < 250; i++ {
+		other := syntax.DID(fmt.Sprintf("did:web:ring%d.example.com", i))
+		graph.AddFollow(did, other)
+		if i < 200 {
+			sets.Sets["follow-spam-ring-dids"][other.String()] = true
+		}
+	}
+	eng.Graph = graph
+
+	follow := appbsky.GraphFollow{
+		Subject:   "did:web:target.example.com",
+		CreatedAt: syntax.DatetimeNow().String(),
+	}
+	buf := new(bytes.Buffer)
+	assert.NoError(follow.MarshalCBOR(buf))
+	cid1 := syntax.CID("cid123")
+	op := automod.RecordOp{
+		Action:     automod.CreateOp,
+		DID:        did,
+		Collection: syntax.NSID("app.bsky.graph.follow"),
+		RecordKey:  syntax.RecordKey("abc123"),
+		CID:        &cid1,
+		RecordCBOR: buf.Bytes(),
+	}
+
+	// not yet at a check interval
+	assert.NoError(eng.ProcessRecordOp(ctx, op))
+	f, err := eng.Flags.Get(ctx, did.String())
+	assert.NoError(err)
+	assert.Empty(f)
+
+	for i := 0; i < followSpamCheckInterval-1; i++ {
+		assert.NoError(eng.Counters.Increment(ctx, "follow", did.String()))
+	}
+	assert.NoError(eng.ProcessRecordOp(ctx, op))
+	f, err = eng.Flags.Get(ctx, did.String())
+	assert.NoError(err)
+	assert.Equal([]string{"follow-spam-ring"}, f)
+}
@@ -1,17 +1,21 @@
 package bgs
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
 	"net/http"
-	"net/url"
 	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/bluesky-social/indigo/carstore"
+	"github.com/bluesky-social/indigo/indexer"
 	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/repomgr"
+	"github.com/ipfs/go-cid"
 	"github.com/labstack/echo/v4"
 	dto "github.com/prometheus/client_model/go"
 	"go.opentelemetry.io/otel"
@@ -120,6 +124,40 @@ func (bgs *BGS) handleAdminGetUpstreamConns(e echo.Context) error {
 	return e.JSON(200, bgs.slurper.GetActiveList())
 }
 
+func (bgs *BGS) handleAdminGetUpstreamHealth(e echo.Context) error {
+	health := bgs.slurper.ConnectionHealth()
+
+	switch e.QueryParam("sort") {
+	case "", "host":
+	case "reconnects":
+		slices.SortStableFunc(health, func(a, b HostConnHealth) int {
+			return cmp.Compare(b.Reconnects+b.DialFailures, a.Reconnects+a.DialFailures)
+		})
+	case "rtt":
+		slices.SortStableFunc(health, func(a, b HostConnHealth) int {
+			return cmp.Compare(b.PingRTTMillis, a.PingRTTMillis)
+		})
+	case "bytes":
+		slices.SortStableFunc(health, func(a, b HostConnHealth) int {
+			return cmp.Compare(b.BytesPerSec, a.BytesPerSec)
+		})
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "sort must be one of host, reconnects, rtt or bytes")
+	}
+
+	if v := e.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid limit")
+		}
+		if len(health) > l {
+			health = health[:l]
+		}
+	}
+
+	return e.JSON(200, health)
+}
+
 type rateLimit struct {
 	Max           float64 `json:"Max"`
 	WindowSeconds float64 `json:"Window"`
@@ -200,6 +238,12 @@ type consumer struct {
 	UserAgent      string    `json:"user_agent"`
 	EventsConsumed uint64    `json:"events_consumed"`
 	ConnectedAt    time.Time `json:"connected_at"`
+	Transport      string    `json:"transport"`
+	StreamVersion  int       `json:"stream_version"`
+	BytesSent      int64     `json:"bytes_sent"`
+	Identity       string    `json:"identity,omitempty"`
+	// the consumer's latest replay, if it's had one
+	Replay *ConsumerReplay `json:"replay,omitempty"`
 }
 
 func (bgs *BGS) handleAdminListConsumers(e echo.Context) error {
@@ -218,12 +262,104 @@ func (bgs *BGS) handleAdminListConsumers(e echo.Context) error {
 			UserAgent:      c.UserAgent,
 			EventsConsumed: uint64(m.Counter.GetValue()),
 			ConnectedAt:    c.ConnectedAt,
+			Transport:      c.Transport,
+			StreamVersion:  c.StreamVersion,
+			BytesSent:      c.BytesSent.Load(),
+			Identity:       c.Identity,
+			Replay:         c.replayStatus(),
 		})
 	}
 
 	return e.JSON(200, consumers)
 }
 
+type ReplayEventsRequest struct {
+	// The connected consumer to send the events to, from
+	// /admin/consumers/list. If unset, a ticket is returned for the consumer
+	// to open a replay connection with instead.
+	ConsumerID *uint64 `json:"consumer_id,omitempty"`
+	// The events after Since, up to and including Until, are sent
+	Since int64 `json:"since"`
+	Until int64 `json:"until"`
+}
+
+type replayEventsResponse struct {
+	// set if replaying to a connected consumer
+	Replay *ConsumerReplay `json:"replay,omitempty"`
+
+	// otherwise, the ticket and the path to open a replay connection at
+	Ticket  string     `json:"ticket,omitempty"`
+	Path    string     `json:"path,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func (bgs *BGS) handleAdminReplayEvents(e echo.Context) error {
+	var body ReplayEventsRequest
+	if err := e.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid body: %s", err))
+	}
+	if err := bgs.checkReplayRange(body.Since, body.Until); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if body.ConsumerID != nil {
+		r, err := bgs.replayToConsumer(*body.ConsumerID, body.Since, body.Until)
+		if err != nil {
+			return err
+		}
+		return e.JSON(200, replayEventsResponse{Replay: r})
+	}
+
+	ticket, expires := bgs.newReplayTicket(body.Since, body.Until)
+	return e.JSON(200, replayEventsResponse{
+		Ticket:  ticket,
+		Path:    replayStreamPath + "?ticket=" + ticket,
+		Expires: &expires,
+	})
+}
+
+// orderings for the consumer history listing, all descending
+var consumerHistorySorts = map[string]string{
+	"last_seen":         "last_seen",
+	"bytes":             "bytes_sent",
+	"events":            "events_sent",
+	"connections":       "connections",
+	"short_connections": "short_connections",
+}
+
+func (bgs *BGS) handleAdminListConsumerHistory(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	sort := "last_seen"
+	if v := e.QueryParam("sort"); v != "" {
+		sort = v
+	}
+	col, ok := consumerHistorySorts[sort]
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid sort %q", sort))
+	}
+
+	limit := 100
+	if v := e.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > 1000 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit must be between 1 and 1000")
+		}
+		limit = l
+	}
+
+	q := bgs.db.WithContext(ctx).Order(col + " desc").Limit(limit)
+	if host := e.QueryParam("host"); host != "" {
+		q = q.Where("remote_host = ?", host)
+	}
+
+	var out []FirehoseConsumer
+	if err := q.Find(&out).Error; err != nil {
+		return err
+	}
+	return e.JSON(200, out)
+}
+
 func (bgs *BGS) handleAdminKillUpstreamConn(e echo.Context) error {
 	host := strings.TrimSpace(e.QueryParam("host"))
 	if host == "" {
@@ -259,8 +395,12 @@ func (bgs *BGS) handleBlockPDS(e echo.Context) error {
 		}
 	}
 
-	// Set the block flag to true in the DB
-	if err := bgs.db.Model(&models.PDS{}).Where("host = ?", host).Update("blocked", true).Error; err != nil {
+	// Set the block flag to true in the DB; the block also restarts the clean
+	// history the host needs for tier promotion
+	if err := bgs.db.Model(&models.PDS{}).Where("host = ?", host).Updates(map[string]any{
+		"blocked":          true,
+		"last_incident_at": time.Now(),
+	}).Error; err != nil {
 		return err
 	}
 
@@ -399,251 +539,1518 @@ func (bgs *BGS) handleAdminChangePDSRateLimits(e echo.Context) error {
 	})
 }
 
-func (bgs *BGS) handleAdminCompactRepo(e echo.Context) error {
-	ctx, span := otel.Tracer("bgs").Start(context.Background(), "adminCompactRepo")
-	defer span.End()
-
-	did := e.QueryParam("did")
-	if did == "" {
-		return fmt.Errorf("must pass a did")
+func (bgs *BGS) crawler() (*indexer.CrawlDispatcher, error) {
+	if bgs.Index.Crawler == nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "crawling is not enabled on this relay")
 	}
+	return bgs.Index.Crawler, nil
+}
 
-	var fast bool
-	if strings.ToLower(e.QueryParam("fast")) == "true" {
-		fast = true
+func (bgs *BGS) handleAdminGetCrawlPriorities(e echo.Context) error {
+	c, err := bgs.crawler()
+	if err != nil {
+		return err
 	}
 
-	u, err := bgs.lookupUserByDid(ctx, did)
+	return e.JSON(200, c.PriorityConfig())
+}
+
+type CrawlPriorityChangeRequest struct {
+	// Exactly one of Host or Did must be set
+	Host string `json:"host"`
+	Did  string `json:"did"`
+	// One of live, backfill or retry; empty or "default" clears the override
+	Priority string `json:"priority"`
+}
+
+func (bgs *BGS) handleAdminSetCrawlPriority(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	c, err := bgs.crawler()
 	if err != nil {
-		return fmt.Errorf("no such user: %w", err)
+		return err
 	}
 
-	stats, err := bgs.repoman.CarStore().CompactUserShards(ctx, u.ID, fast)
-	if err != nil {
-		return fmt.Errorf("compaction failed: %w", err)
+	var body CrawlPriorityChangeRequest
+	if err := e.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid body: %s", err))
+	}
+
+	if (body.Host == "") == (body.Did == "") {
+		return echo.NewHTTPError(http.StatusBadRequest, "must specify exactly one of host or did")
+	}
+
+	var prio *indexer.CrawlPriority
+	if body.Priority != "" && body.Priority != "default" {
+		p, err := indexer.ParseCrawlPriority(body.Priority)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		prio = &p
+	}
+
+	if body.Host != "" {
+		var pds models.PDS
+		if err := bgs.db.Where("host = ?", body.Host).First(&pds).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return echo.NewHTTPError(http.StatusNotFound, "pds not found")
+			}
+			return err
+		}
+		c.SetHostPriority(pds.ID, prio)
+	} else {
+		u, err := bgs.lookupUserByDid(ctx, body.Did)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return echo.NewHTTPError(http.StatusNotFound, "repo not found")
+			}
+			return err
+		}
+		c.SetRepoPriority(u.ID, prio)
 	}
 
 	return e.JSON(200, map[string]any{
 		"success": "true",
-		"stats":   stats,
 	})
 }
 
-func (bgs *BGS) handleAdminCompactAllRepos(e echo.Context) error {
-	ctx, span := otel.Tracer("bgs").Start(context.Background(), "adminCompactAllRepos")
-	defer span.End()
+func (bgs *BGS) handleAdminSetCrawlWeights(e echo.Context) error {
+	c, err := bgs.crawler()
+	if err != nil {
+		return err
+	}
 
-	var fast bool
-	if strings.ToLower(e.QueryParam("fast")) == "true" {
-		fast = true
+	var body map[string]int
+	if err := e.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid body: %s", err))
 	}
 
-	lim := 50
-	if limstr := e.QueryParam("limit"); limstr != "" {
-		v, err := strconv.Atoi(limstr)
+	weights := make(map[indexer.CrawlPriority]int)
+	for k, w := range body {
+		p, err := indexer.ParseCrawlPriority(k)
 		if err != nil {
-			return err
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 		}
+		if w < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("weight for %s must be positive", k))
+		}
+		weights[p] = w
+	}
 
-		lim = v
+	c.SetPriorityWeights(weights)
+
+	return e.JSON(200, c.PriorityConfig())
+}
+
+type crawlHostBudgetsResponse struct {
+	Hosts []indexer.HostCrawlBudget `json:"hosts"`
+}
+
+func (bgs *BGS) handleAdminGetCrawlHostBudgets(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	c, err := bgs.crawler()
+	if err != nil {
+		return err
 	}
 
-	shardThresh := 20
-	if threshstr := e.QueryParam("threshold"); threshstr != "" {
-		v, err := strconv.Atoi(threshstr)
-		if err != nil {
+	budgets := c.HostBudgets()
+	ids := make([]uint, len(budgets))
+	for i, b := range budgets {
+		ids[i] = b.PDS
+	}
+
+	var hosts []models.PDS
+	if len(ids) > 0 {
+		if err := bgs.db.WithContext(ctx).Select("id", "host").Find(&hosts, "id in ?", ids).Error; err != nil {
 			return err
 		}
-
-		shardThresh = v
 	}
-
-	err := bgs.compactor.EnqueueAllRepos(ctx, bgs, lim, shardThresh, fast)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("failed to enqueue all repos: %w", err))
+	names := make(map[uint]string, len(hosts))
+	for _, h := range hosts {
+		names[h.ID] = h.Host
+	}
+	for i := range budgets {
+		budgets[i].Host = names[budgets[i].PDS]
 	}
 
-	return e.JSON(200, map[string]any{
-		"success": "true",
-	})
+	return e.JSON(200, crawlHostBudgetsResponse{Hosts: budgets})
 }
 
-func (bgs *BGS) handleAdminPostResyncPDS(e echo.Context) error {
-	host := strings.TrimSpace(e.QueryParam("host"))
-	if host == "" {
-		return fmt.Errorf("must pass a host")
-	}
+type CrawlHostWeightRequest struct {
+	Host string `json:"host"`
+	// Share of the fetch workers relative to other hosts; 0 restores the
+	// default
+	Weight int `json:"weight"`
+}
 
-	// Get the PDS from the DB
-	var pds models.PDS
-	if err := bgs.db.Where("host = ?", host).First(&pds).Error; err != nil {
+func (bgs *BGS) handleAdminSetCrawlHostWeight(e echo.Context) error {
+	c, err := bgs.crawler()
+	if err != nil {
 		return err
 	}
 
-	go func() {
-		ctx := context.Background()
-		err := bgs.ResyncPDS(ctx, pds)
-		if err != nil {
-			log.Errorw("failed to resync PDS", "err", err, "pds", pds.Host)
+	var body CrawlHostWeightRequest
+	if err := e.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid body: %s", err))
+	}
+	if body.Host == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "must specify host")
+	}
+	if body.Weight < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "weight must not be negative")
+	}
+
+	var pds models.PDS
+	if err := bgs.db.Where("host = ?", body.Host).First(&pds).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "pds not found")
 		}
-	}()
+		return err
+	}
+	c.SetHostWeight(pds.ID, body.Weight)
 
 	return e.JSON(200, map[string]any{
-		"message": "resync started...",
+		"success": "true",
 	})
 }
 
-func (bgs *BGS) handleAdminGetResyncPDS(e echo.Context) error {
-	host := strings.TrimSpace(e.QueryParam("host"))
-	if host == "" {
-		return fmt.Errorf("must pass a host")
+type fetchFailuresResponse struct {
+	Failures []indexer.RepoFetchFailure `json:"failures"`
+	Cursor   uint                       `json:"cursor,omitempty"`
+}
+
+func (bgs *BGS) handleAdminListFetchFailures(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	dead := true
+	if v := e.QueryParam("dead"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid value for dead: %s", err))
+		}
+		dead = b
 	}
 
-	// Get the PDS from the DB
-	var pds models.PDS
-	if err := bgs.db.Where("host = ?", host).First(&pds).Error; err != nil {
-		return err
+	var cursor uint64
+	if v := e.QueryParam("cursor"); v != "" {
+		c, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid cursor: %s", err))
+		}
+		cursor = c
 	}
 
-	resync, found := bgs.GetResync(pds)
-	if !found {
-		return &echo.HTTPError{
-			Code:    404,
-			Message: "no resync found for given PDS",
+	limit := 100
+	if v := e.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > 1000 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit must be between 1 and 1000")
 		}
+		limit = l
 	}
 
-	return e.JSON(200, map[string]any{
-		"resync": resync,
-	})
+	failures, err := bgs.repoFetcher.ListFetchFailures(ctx, dead, uint(cursor), limit)
+	if err != nil {
+		return err
+	}
+
+	out := fetchFailuresResponse{Failures: failures}
+	if len(failures) == limit {
+		out.Cursor = failures[len(failures)-1].ID
+	}
+	return e.JSON(200, out)
 }
 
-func (bgs *BGS) handleAdminResetRepo(e echo.Context) error {
+func (bgs *BGS) handleAdminRetryFetch(e echo.Context) error {
 	ctx := e.Request().Context()
 
+	if e.QueryParam("all") == "true" {
+		n, err := bgs.repoFetcher.RetryAllDeadFetches(ctx)
+		if err != nil {
+			return err
+		}
+		return e.JSON(200, map[string]any{
+			"success": "true",
+			"count":   n,
+		})
+	}
+
 	did := e.QueryParam("did")
 	if did == "" {
-		return fmt.Errorf("must pass a did")
+		return echo.NewHTTPError(http.StatusBadRequest, "must pass a did, or all=true")
 	}
 
-	ai, err := bgs.Index.LookupUserByDid(ctx, did)
+	u, err := bgs.lookupUserByDid(ctx, did)
 	if err != nil {
-		return fmt.Errorf("no such user: %w", err)
-	}
-
-	if err := bgs.repoman.ResetRepo(ctx, ai.Uid); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "repo not found")
+		}
 		return err
 	}
 
-	if err := bgs.Index.Crawler.Crawl(ctx, ai); err != nil {
+	found, err := bgs.repoFetcher.RetryFetchFailure(ctx, u.ID)
+	if err != nil {
 		return err
 	}
+	if !found {
+		return echo.NewHTTPError(http.StatusNotFound, "repo has no recorded fetch failures")
+	}
 
 	return e.JSON(200, map[string]any{
-		"success": true,
+		"success": "true",
 	})
 }
 
-func (bgs *BGS) handleAdminVerifyRepo(e echo.Context) error {
+func (bgs *BGS) handleAdminAuditRepo(e echo.Context) error {
 	ctx := e.Request().Context()
 
 	did := e.QueryParam("did")
 	if did == "" {
-		return fmt.Errorf("must pass a did")
+		return echo.NewHTTPError(http.StatusBadRequest, "must pass a did")
 	}
+	repair := e.QueryParam("repair") == "true"
 
 	ai, err := bgs.Index.LookupUserByDid(ctx, did)
 	if err != nil {
-		return fmt.Errorf("no such user: %w", err)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "repo not found")
+		}
+		return err
 	}
 
-	if err := bgs.repoman.VerifyRepo(ctx, ai.Uid); err != nil {
+	audit, err := bgs.repoFetcher.AuditRepo(ctx, ai, repair)
+	if err != nil {
 		return err
 	}
-
-	return e.JSON(200, map[string]any{
-		"success": true,
-	})
+	return e.JSON(200, audit)
 }
 
-func (bgs *BGS) handleAdminAddTrustedDomain(e echo.Context) error {
-	domain := e.QueryParam("domain")
-	if domain == "" {
-		return fmt.Errorf("must specify domain in query parameter")
+func (bgs *BGS) handleAdminAuditPDS(e echo.Context) error {
+	host := strings.TrimSpace(e.QueryParam("host"))
+	if host == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "must pass a host")
 	}
+	repair := e.QueryParam("repair") == "true"
 
-	// Check if the domain is already trusted
-	trustedDomains := bgs.slurper.GetTrustedDomains()
-	if slices.Contains(trustedDomains, domain) {
-		return &echo.HTTPError{
-			Code:    400,
-			Message: "domain is already trusted",
+	limit := 0
+	if v := e.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid limit")
 		}
+		limit = l
 	}
 
-	if err := bgs.slurper.AddTrustedDomain(domain); err != nil {
+	var pds models.PDS
+	if err := bgs.db.Where("host = ?", host).First(&pds).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "pds not found")
+		}
 		return err
 	}
 
+	// audits fetch every repo in full, so this can take a long time; results
+	// are listed by /admin/repo/audits as they complete
+	log := ctxLog(e.Request().Context())
+	go func() {
+		audited, bad, err := bgs.repoFetcher.AuditPDSRepos(context.Background(), pds.ID, limit, repair)
+		if err != nil {
+			log.Errorw("pds audit failed", "host", host, "audited", audited, "err", err)
+			return
+		}
+		log.Infow("pds audit complete", "host", host, "audited", audited, "out_of_sync", bad)
+	}()
+
 	return e.JSON(200, map[string]any{
-		"success": true,
+		"success": "true",
 	})
 }
 
-type AdminRequestCrawlRequest struct {
-	Hostname string `json:"hostname"`
+type repoAuditsResponse struct {
+	Audits []indexer.RepoAudit `json:"audits"`
+	Cursor uint                `json:"cursor,omitempty"`
 }
 
-func (bgs *BGS) handleAdminRequestCrawl(e echo.Context) error {
+func (bgs *BGS) handleAdminListRepoAudits(e echo.Context) error {
 	ctx := e.Request().Context()
 
-	var body AdminRequestCrawlRequest
-	if err := e.Bind(&body); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid body: %s", err))
+	var cursor uint64
+	if v := e.QueryParam("cursor"); v != "" {
+		c, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid cursor: %s", err))
+		}
+		cursor = c
+	}
+
+	limit := 100
+	if v := e.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > 1000 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit must be between 1 and 1000")
+		}
+		limit = l
+	}
+
+	audits, err := bgs.repoFetcher.ListRepoAudits(ctx, e.QueryParam("did"), e.QueryParam("status"), uint(cursor), limit)
+	if err != nil {
+		return err
+	}
+
+	out := repoAuditsResponse{Audits: audits}
+	if len(audits) == limit {
+		out.Cursor = audits[len(audits)-1].ID
+	}
+	return e.JSON(200, out)
+}
+
+func (bgs *BGS) handleAdminCompactRepo(e echo.Context) error {
+	ctx, span := otel.Tracer("bgs").Start(context.Background(), "adminCompactRepo")
+	defer span.End()
+
+	did := e.QueryParam("did")
+	if did == "" {
+		return fmt.Errorf("must pass a did")
+	}
+
+	var fast bool
+	if strings.ToLower(e.QueryParam("fast")) == "true" {
+		fast = true
+	}
+
+	u, err := bgs.lookupUserByDid(ctx, did)
+	if err != nil {
+		return fmt.Errorf("no such user: %w", err)
+	}
+
+	stats, err := bgs.repoman.CarStore().CompactUserShards(ctx, u.ID, fast)
+	if err != nil {
+		return fmt.Errorf("compaction failed: %w", err)
+	}
+
+	return e.JSON(200, map[string]any{
+		"success": "true",
+		"stats":   stats,
+	})
+}
+
+func (bgs *BGS) handleAdminCompactAllRepos(e echo.Context) error {
+	ctx, span := otel.Tracer("bgs").Start(context.Background(), "adminCompactAllRepos")
+	defer span.End()
+
+	var fast bool
+	if strings.ToLower(e.QueryParam("fast")) == "true" {
+		fast = true
+	}
+
+	lim := 50
+	if limstr := e.QueryParam("limit"); limstr != "" {
+		v, err := strconv.Atoi(limstr)
+		if err != nil {
+			return err
+		}
+
+		lim = v
+	}
+
+	shardThresh := 20
+	if threshstr := e.QueryParam("threshold"); threshstr != "" {
+		v, err := strconv.Atoi(threshstr)
+		if err != nil {
+			return err
+		}
+
+		shardThresh = v
+	}
+
+	err := bgs.compactor.EnqueueAllRepos(ctx, bgs, lim, shardThresh, fast)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Errorf("failed to enqueue all repos: %w", err))
+	}
+
+	return e.JSON(200, map[string]any{
+		"success": "true",
+	})
+}
+
+func (bgs *BGS) handleAdminPostResyncPDS(e echo.Context) error {
+	host := strings.TrimSpace(e.QueryParam("host"))
+	if host == "" {
+		return fmt.Errorf("must pass a host")
+	}
+
+	// Get the PDS from the DB
+	var pds models.PDS
+	if err := bgs.db.Where("host = ?", host).First(&pds).Error; err != nil {
+		return err
+	}
+
+	log := ctxLog(e.Request().Context())
+	go func() {
+		ctx := context.Background()
+		err := bgs.ResyncPDS(ctx, pds)
+		if err != nil {
+			log.Errorw("failed to resync PDS", "err", err, "pds", pds.Host)
+		}
+	}()
+
+	return e.JSON(200, map[string]any{
+		"message": "resync started...",
+	})
+}
+
+func (bgs *BGS) handleAdminGetResyncPDS(e echo.Context) error {
+	host := strings.TrimSpace(e.QueryParam("host"))
+	if host == "" {
+		return fmt.Errorf("must pass a host")
+	}
+
+	// Get the PDS from the DB
+	var pds models.PDS
+	if err := bgs.db.Where("host = ?", host).First(&pds).Error; err != nil {
+		return err
+	}
+
+	resync, found := bgs.GetResync(pds)
+	if !found {
+		return &echo.HTTPError{
+			Code:    404,
+			Message: "no resync found for given PDS",
+		}
+	}
+
+	return e.JSON(200, map[string]any{
+		"resync": resync,
+	})
+}
+
+func (bgs *BGS) handleAdminResetRepo(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	did := e.QueryParam("did")
+	if did == "" {
+		return fmt.Errorf("must pass a did")
+	}
+
+	ai, err := bgs.Index.LookupUserByDid(ctx, did)
+	if err != nil {
+		return fmt.Errorf("no such user: %w", err)
+	}
+
+	if err := bgs.repoman.ResetRepo(ctx, ai.Uid); err != nil {
+		return err
+	}
+
+	if err := bgs.Index.Crawler.Crawl(ctx, ai); err != nil {
+		return err
+	}
+
+	return e.JSON(200, map[string]any{
+		"success": true,
+	})
+}
+
+type RepoImportResponse struct {
+	Did string `json:"did"`
+	Rev string `json:"rev"`
+}
+
+// handleAdminImportRepo replaces a repo's data with a CAR archive of the whole
+// repo, creating the repo if the relay hasn't seen it yet
+func (bgs *BGS) handleAdminImportRepo(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	did := e.QueryParam("did")
+	if did == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "must pass a did")
+	}
+
+	var force bool
+	if v := e.QueryParam("force"); v != "" {
+		f, err := strconv.ParseBool(v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid force value")
+		}
+		force = f
+	}
+
+	var uid models.Uid
+	u, err := bgs.lookupUserByDid(ctx, did)
+	switch {
+	case err == nil:
+		if u.TakenDown || u.Tombstoned {
+			return echo.NewHTTPError(http.StatusConflict, "repo is taken down or deleted")
+		}
+		uid = u.ID
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		ai, err := bgs.createExternalUser(ctx, did)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("failed to create repo: %s", err))
+		}
+		uid = ai.Uid
+	default:
+		return err
+	}
+
+	rev, err := bgs.repoman.ImportRepoArchive(ctx, uid, did, e.Request().Body, force)
+	if err != nil {
+		if errors.Is(err, repomgr.ErrRepoNotNewer) {
+			return echo.NewHTTPError(http.StatusConflict, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("failed to import repo: %s", err))
+	}
+
+	ctxLog(ctx).Infow("imported repo archive", "did", did, "rev", rev, "force", force)
+
+	return e.JSON(200, RepoImportResponse{Did: did, Rev: rev})
+}
+
+type trashedRepo struct {
+	ID        string     `json:"id"`
+	Did       string     `json:"did"`
+	Uid       models.Uid `json:"uid"`
+	Reason    string     `json:"reason"`
+	TrashedAt time.Time  `json:"trashedAt"`
+	Bytes     int64      `json:"bytes"`
+	Shards    int        `json:"shards"`
+}
+
+type repoTrashResponse struct {
+	Entries []trashedRepo `json:"entries"`
+}
+
+func (bgs *BGS) handleAdminListRepoTrash(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	var uid models.Uid
+	if did := e.QueryParam("did"); did != "" {
+		u, err := bgs.lookupUserByDid(ctx, did)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return echo.NewHTTPError(http.StatusNotFound, "repo not found")
+			}
+			return err
+		}
+		uid = u.ID
+	}
+
+	entries, err := bgs.repoman.ListTrash(ctx, uid)
+	if err != nil {
+		return err
+	}
+
+	uids := make([]models.Uid, 0, len(entries))
+	for _, ent := range entries {
+		uids = append(uids, ent.Usr)
+	}
+	var users []User
+	if len(uids) > 0 {
+		if err := bgs.db.WithContext(ctx).Unscoped().Select("id, did").Where("id IN ?", uids).Find(&users).Error; err != nil {
+			return err
+		}
+	}
+	dids := make(map[models.Uid]string, len(users))
+	for _, u := range users {
+		dids[u.ID] = u.Did
+	}
+
+	out := repoTrashResponse{Entries: make([]trashedRepo, 0, len(entries))}
+	for _, ent := range entries {
+		out.Entries = append(out.Entries, trashedRepo{
+			ID:        ent.ID,
+			Did:       dids[ent.Usr],
+			Uid:       ent.Usr,
+			Reason:    ent.Reason,
+			TrashedAt: ent.TrashedAt,
+			Bytes:     ent.Bytes,
+			Shards:    len(ent.Shards),
+		})
+	}
+	return e.JSON(200, out)
+}
+
+func (bgs *BGS) handleAdminRestoreRepo(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	did := e.QueryParam("did")
+	if did == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "must pass a did")
+	}
+
+	u, err := bgs.lookupUserByDid(ctx, did)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "repo not found")
+		}
+		return err
+	}
+
+	// default to the most recent entry
+	id := e.QueryParam("id")
+	if id == "" {
+		entries, err := bgs.repoman.ListTrash(ctx, u.ID)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "repo has no data in the trash")
+		}
+		id = entries[len(entries)-1].ID
+	}
+
+	if err := bgs.repoman.RestoreRepo(ctx, u.ID, id); err != nil {
+		switch {
+		case errors.Is(err, carstore.ErrTrashNotFound):
+			return echo.NewHTTPError(http.StatusNotFound, "trash entry not found")
+		case errors.Is(err, carstore.ErrRepoHasData):
+			return echo.NewHTTPError(http.StatusConflict, "repo has been written to since it was trashed")
+		}
+		return err
+	}
+
+	ctxLog(ctx).Infow("restored repo data from trash", "did", did, "id", id)
+	return e.JSON(200, map[string]any{
+		"success": true,
+		"id":      id,
+	})
+}
+
+func (bgs *BGS) handleAdminVerifyRepo(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	did := e.QueryParam("did")
+	if did == "" {
+		return fmt.Errorf("must pass a did")
+	}
+
+	ai, err := bgs.Index.LookupUserByDid(ctx, did)
+	if err != nil {
+		return fmt.Errorf("no such user: %w", err)
+	}
+
+	if err := bgs.repoman.VerifyRepo(ctx, ai.Uid); err != nil {
+		return err
+	}
+
+	return e.JSON(200, map[string]any{
+		"success": true,
+	})
+}
+
+func (bgs *BGS) handleAdminReverifyHandle(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	did := e.QueryParam("did")
+	if did == "" {
+		return &echo.HTTPError{
+			Code:    400,
+			Message: "must pass a did",
+		}
+	}
+
+	u, err := bgs.lookupUserByDid(ctx, did)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &echo.HTTPError{
+				Code:    http.StatusNotFound,
+				Message: "repo not found",
+			}
+		}
+		return err
+	}
+
+	changed, err := bgs.reverifyHandle(ctx, u)
+	if err != nil {
+		return &echo.HTTPError{
+			Code:    http.StatusBadGateway,
+			Message: err.Error(),
+		}
+	}
+
+	return e.JSON(200, map[string]any{
+		"changed": changed,
+		"handle":  u.Handle.String,
+		"valid":   u.ValidHandle,
+	})
+}
+
+func (bgs *BGS) handleAdminReverifyAllHandles(e echo.Context) error {
+	if err := bgs.handleVerifier.Trigger(bgs); err != nil {
+		if errors.Is(err, errHandlePassRunning) {
+			return &echo.HTTPError{
+				Code:    http.StatusConflict,
+				Message: err.Error(),
+			}
+		}
+		return err
+	}
+
+	return e.JSON(200, map[string]any{
+		"success": true,
+	})
+}
+
+func (bgs *BGS) handleAdminAddTrustedDomain(e echo.Context) error {
+	domain := e.QueryParam("domain")
+	if domain == "" {
+		return fmt.Errorf("must specify domain in query parameter")
+	}
+
+	// Check if the domain is already trusted
+	trustedDomains := bgs.slurper.GetTrustedDomains()
+	if slices.Contains(trustedDomains, domain) {
+		return &echo.HTTPError{
+			Code:    400,
+			Message: "domain is already trusted",
+		}
+	}
+
+	if err := bgs.slurper.AddTrustedDomain(domain); err != nil {
+		return err
+	}
+
+	return e.JSON(200, map[string]any{
+		"success": true,
+	})
+}
+
+type AdminRequestCrawlRequest struct {
+	Hostname string `json:"hostname"`
+}
+
+func (bgs *BGS) handleAdminRequestCrawl(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	var body AdminRequestCrawlRequest
+	if err := e.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid body: %s", err))
+	}
+
+	u, err := bgs.parseCrawlHost(body.Hostname)
+	if err != nil {
+		return err
+	}
+
+	host := u.Host // potentially hostname:port
+
+	banned, err := bgs.domainIsBanned(ctx, host)
+	if banned {
+		return echo.NewHTTPError(http.StatusUnauthorized, "domain is banned")
+	}
+
+	// Skip checking if the server is online for now
+
+	return bgs.slurper.SubscribeToPds(ctx, host, true, true) // Override Trusted Domain Check
+}
+
+type repoStorage struct {
+	Did    string     `json:"did"`
+	Uid    models.Uid `json:"uid"`
+	Bytes  int64      `json:"bytes"`
+	Shards int64      `json:"shards"`
+}
+
+func (bgs *BGS) handleAdminGetRepoStorage(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	did := e.QueryParam("did")
+	if did == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "must pass a did")
+	}
+
+	u, err := bgs.lookupUserByDid(ctx, did)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "repo not found")
+		}
+		return err
+	}
+
+	us, err := bgs.repoman.CarStore().UserStorage(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+
+	return e.JSON(200, repoStorage{
+		Did:    u.Did,
+		Uid:    u.ID,
+		Bytes:  us.Bytes,
+		Shards: us.Shards,
+	})
+}
+
+func (bgs *BGS) handleAdminListRepoStorage(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	limit := 100
+	if v := e.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > 1000 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit must be between 1 and 1000")
+		}
+		limit = l
+	}
+
+	top, err := bgs.repoman.CarStore().TopUserStorage(ctx, limit)
+	if err != nil {
+		return err
+	}
+
+	uids := make([]models.Uid, len(top))
+	for i, us := range top {
+		uids[i] = us.Usr
+	}
+	var users []User
+	if err := bgs.db.WithContext(ctx).Select("id", "did").Find(&users, "id in ?", uids).Error; err != nil {
+		return err
+	}
+	dids := make(map[models.Uid]string, len(users))
+	for _, u := range users {
+		dids[u.ID] = u.Did
+	}
+
+	out := make([]repoStorage, len(top))
+	for i, us := range top {
+		out[i] = repoStorage{
+			Did:    dids[us.Usr],
+			Uid:    us.Usr,
+			Bytes:  us.Bytes,
+			Shards: us.Shards,
+		}
+	}
+	return e.JSON(200, out)
+}
+
+type pdsStorage struct {
+	Host           string `json:"host"`
+	StorageBytes   int64  `json:"storage_bytes"`
+	StorageQuota   int64  `json:"storage_quota"`
+	OverQuota      bool   `json:"over_quota"`
+	HasActiveConns bool   `json:"has_active_connection"`
+}
+
+func (bgs *BGS) handleAdminListPDSStorage(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	limit := 100
+	if v := e.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > 1000 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit must be between 1 and 1000")
+		}
+		limit = l
+	}
+
+	q := bgs.db.WithContext(ctx).Order("storage_bytes desc").Limit(limit)
+	if e.QueryParam("overQuota") == "true" {
+		q = q.Where("storage_quota > 0 AND storage_bytes >= storage_quota")
+	}
+	var hosts []models.PDS
+	if err := q.Find(&hosts).Error; err != nil {
+		return err
+	}
+
+	active := make(map[string]bool)
+	for _, host := range bgs.slurper.GetActiveList() {
+		active[strings.ToLower(host)] = true
+	}
+
+	out := make([]pdsStorage, len(hosts))
+	for i, pds := range hosts {
+		out[i] = pdsStorage{
+			Host:           pds.Host,
+			StorageBytes:   pds.StorageBytes,
+			StorageQuota:   pds.StorageQuota,
+			OverQuota:      pds.OverStorageQuota(),
+			HasActiveConns: active[strings.ToLower(pds.Host)],
+		}
+	}
+	return e.JSON(200, out)
+}
+
+type StorageQuotaChangeRequest struct {
+	Host string `json:"host"`
+	// Quota in bytes, zero for no limit
+	Quota int64 `json:"quota"`
+}
+
+func (bgs *BGS) handleAdminSetPDSStorageQuota(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	var body StorageQuotaChangeRequest
+	if err := e.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid body: %s", err))
+	}
+	if body.Quota < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "quota must not be negative")
+	}
+
+	var pds models.PDS
+	if err := bgs.db.Where("host = ?", body.Host).First(&pds).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "pds not found")
+		}
+		return err
+	}
+
+	if err := bgs.db.Model(&models.PDS{}).Where("id = ?", pds.ID).UpdateColumn("storage_quota", body.Quota).Error; err != nil {
+		return fmt.Errorf("failed to save storage quota: %w", err)
+	}
+	pds.StorageQuota = body.Quota
+
+	if err := bgs.applyStorageQuota(ctx, &pds); err != nil {
+		return err
+	}
+
+	return e.JSON(200, map[string]any{
+		"success": "true",
+	})
+}
+
+func (bgs *BGS) handleAdminRecountPDSStorage(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	host := strings.TrimSpace(e.QueryParam("host"))
+	if host == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "must pass a host")
+	}
+
+	var pds models.PDS
+	if err := bgs.db.Where("host = ?", host).First(&pds).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "pds not found")
+		}
+		return err
+	}
+
+	before := pds.StorageBytes
+	if _, err := bgs.storage.RecountPDS(ctx, bgs, &pds); err != nil {
+		return err
+	}
+	if err := bgs.applyStorageQuota(ctx, &pds); err != nil {
+		return err
+	}
+
+	return e.JSON(200, map[string]any{
+		"host":          pds.Host,
+		"previous":      before,
+		"storage_bytes": pds.StorageBytes,
+	})
+}
+
+// applyStorageQuota disconnects the host if it is over quota, or resumes
+// consuming from a registered host that was paused and no longer is
+func (bgs *BGS) applyStorageQuota(ctx context.Context, pds *models.PDS) error {
+	if pds.OverStorageQuota() {
+		bgs.enforceStorageQuota(pds)
+		return nil
+	}
+	if !pds.Registered || pds.Blocked {
+		return nil
+	}
+	return bgs.slurper.SubscribeToPds(ctx, pds.Host, true, true)
+}
+
+type ingestStagesResponse struct {
+	Stages []IngestStageStatus `json:"stages"`
+}
+
+func (bgs *BGS) handleAdminListIngestStages(e echo.Context) error {
+	return e.JSON(200, ingestStagesResponse{
+		Stages: bgs.ingest.Stages(),
+	})
+}
+
+func (bgs *BGS) handleAdminSetIngestStage(e echo.Context) error {
+	name := e.QueryParam("name")
+	if name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "must pass stage name")
+	}
+
+	enabled, err := strconv.ParseBool(e.QueryParam("enabled"))
+	if err != nil {
+		return &echo.HTTPError{
+			Code:    400,
+			Message: err.Error(),
+		}
+	}
+
+	if err := bgs.ingest.SetEnabled(name, enabled); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	return e.JSON(200, map[string]any{
+		"success": "true",
+	})
+}
+
+type revReportResponse struct {
+	// when counting started; counts don't survive a restart
+	Since time.Time           `json:"since"`
+	Hosts []HostRevOrderStats `json:"hosts"`
+}
+
+func (bgs *BGS) handleAdminRevReport(e echo.Context) error {
+	hosts := bgs.revStats.report(e.QueryParam("host"))
+
+	slices.SortFunc(hosts, func(a, b HostRevOrderStats) int {
+		return cmp.Compare(a.Host, b.Host)
+	})
+	switch e.QueryParam("sort") {
+	case "", "violations":
+		slices.SortStableFunc(hosts, func(a, b HostRevOrderStats) int {
+			return cmp.Compare(b.violations(), a.violations())
+		})
+	case "rate":
+		slices.SortStableFunc(hosts, func(a, b HostRevOrderStats) int {
+			return cmp.Compare(b.ViolationRate, a.ViolationRate)
+		})
+	case "host":
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "sort must be one of violations, rate or host")
+	}
+
+	if v := e.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid limit")
+		}
+		if len(hosts) > l {
+			hosts = hosts[:l]
+		}
+	}
+
+	return e.JSON(200, revReportResponse{
+		Since: bgs.revStats.since,
+		Hosts: hosts,
+	})
+}
+
+type repoLimitTiersResponse struct {
+	Tiers      []RepoLimitTier `json:"tiers"`
+	Promotions []TierPromotion `json:"promotions"`
+}
+
+func (bgs *BGS) handleAdminListTiers(e echo.Context) error {
+	tiers, err := bgs.tiers.Tiers(e.Request().Context(), bgs.db)
+	if err != nil {
+		return err
+	}
+
+	return e.JSON(200, repoLimitTiersResponse{
+		Tiers:      tiers,
+		Promotions: bgs.tiers.promotions,
+	})
+}
+
+type TierChangeRequest struct {
+	Host string `json:"host"`
+	Tier string `json:"tier"`
+	// Leave the host to automatic promotion from this tier, rather than
+	// keeping it here until an admin moves it
+	Unpinned bool `json:"unpinned,omitempty"`
+}
+
+func (bgs *BGS) handleAdminSetPDSTier(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	var body TierChangeRequest
+	if err := e.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid body: %s", err))
+	}
+	if _, ok := bgs.tiers.Limit(body.Tier); !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unknown tier %q", body.Tier))
+	}
+
+	var pds models.PDS
+	if err := bgs.db.Where("host = ?", body.Host).First(&pds).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "pds not found")
+		}
+		return err
+	}
+
+	if err := bgs.tiers.AssignTier(ctx, bgs.db, &pds, body.Tier, !body.Unpinned); err != nil {
+		return err
+	}
+
+	return e.JSON(200, map[string]any{
+		"host":       pds.Host,
+		"tier":       pds.Tier,
+		"pinned":     pds.TierPinned,
+		"repo_limit": pds.RepoLimit,
+	})
+}
+
+type pdsGrowthResponse struct {
+	Window time.Duration `json:"window"`
+	Hosts  []HostGrowth  `json:"hosts"`
+}
+
+func (bgs *BGS) handleAdminGetPDSGrowth(e echo.Context) error {
+	limit := 100
+	if v := e.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > 1000 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit must be between 1 and 1000")
+		}
+		limit = l
 	}
 
-	host := body.Hostname
+	return e.JSON(200, pdsGrowthResponse{
+		Window: bgs.growth.opts.Window,
+		Hosts:  bgs.growth.Growth(limit),
+	})
+}
+
+type pdsStatsHistoryResponse struct {
+	Host       string           `json:"host"`
+	Resolution string           `json:"resolution"`
+	Points     []HostStatsPoint `json:"points"`
+}
+
+func (bgs *BGS) handleAdminGetPDSStatsHistory(e echo.Context) error {
+	if !bgs.hostStats.enabled() {
+		return echo.NewHTTPError(http.StatusNotFound, "host stats history is not enabled")
+	}
+
+	host := e.QueryParam("host")
 	if host == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "must pass hostname")
+		return echo.NewHTTPError(http.StatusBadRequest, "must specify host")
+	}
+
+	now := time.Now()
+	parseTime := func(name string, def time.Time) (time.Time, error) {
+		v := e.QueryParam(name)
+		if v == "" {
+			return def, nil
+		}
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t, nil
+		}
+		ago, err := time.ParseDuration(v)
+		if err != nil || ago < 0 {
+			return time.Time{}, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid %s: %q", name, v))
+		}
+		return now.Add(-ago), nil
+	}
+	since, err := parseTime("since", now.Add(-24*time.Hour))
+	if err != nil {
+		return err
+	}
+	until, err := parseTime("until", now)
+	if err != nil {
+		return err
+	}
+
+	resolution := e.QueryParam("resolution")
+	switch resolution {
+	case "", HostStatsResolutionSample, HostStatsResolutionHourly:
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "resolution must be sample or hourly")
+	}
+
+	var pds models.PDS
+	if err := bgs.db.Where("host = ?", host).First(&pds).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "pds not found")
+		}
+		return err
+	}
+
+	points, resolution, err := bgs.hostStats.History(e.Request().Context(), bgs.db, pds.ID, since, until, resolution)
+	if err != nil {
+		return err
+	}
+
+	return e.JSON(200, pdsStatsHistoryResponse{
+		Host:       pds.Host,
+		Resolution: resolution,
+		Points:     points,
+	})
+}
+
+type collectionRegistryResponse struct {
+	Quarantine  bool                   `json:"quarantine"`
+	Collections []RegisteredCollection `json:"collections"`
+}
+
+func (bgs *BGS) handleAdminListCollectionRegistry(e echo.Context) error {
+	if !bgs.collRegistry.enabled() {
+		return echo.NewHTTPError(http.StatusNotFound, "collection registry is not enabled")
+	}
+
+	status := e.QueryParam("status")
+	switch status {
+	case "", CollectionApproved, CollectionPending, CollectionRejected:
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "status must be approved, pending or rejected")
 	}
 
-	if !strings.HasPrefix(host, "http://") && !strings.HasPrefix(host, "https://") {
-		if bgs.ssl {
-			host = "https://" + host
-		} else {
-			host = "http://" + host
+	limit := 100
+	if v := e.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > 1000 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit must be between 1 and 1000")
 		}
+		limit = l
 	}
 
-	u, err := url.Parse(host)
+	cols, err := bgs.collRegistry.List(e.Request().Context(), status, limit)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to parse hostname")
+		return err
 	}
 
-	if u.Scheme == "http" && bgs.ssl {
-		return echo.NewHTTPError(http.StatusBadRequest, "this server requires https")
+	return e.JSON(200, collectionRegistryResponse{
+		Quarantine:  bgs.collRegistry.quarantining(),
+		Collections: cols,
+	})
+}
+
+type CollectionReviewRequest struct {
+	Collection string `json:"collection"`
+}
+
+func (bgs *BGS) handleAdminApproveCollection(e echo.Context) error {
+	return bgs.reviewCollection(e, CollectionApproved)
+}
+
+func (bgs *BGS) handleAdminRejectCollection(e echo.Context) error {
+	return bgs.reviewCollection(e, CollectionRejected)
+}
+
+func (bgs *BGS) reviewCollection(e echo.Context, status string) error {
+	if !bgs.collRegistry.enabled() {
+		return echo.NewHTTPError(http.StatusNotFound, "collection registry is not enabled")
 	}
 
-	if u.Scheme == "https" && !bgs.ssl {
-		return echo.NewHTTPError(http.StatusBadRequest, "this server does not support https")
+	var body CollectionReviewRequest
+	if err := e.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid body: %s", err))
+	}
+	if body.Collection == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "must specify collection")
 	}
 
-	if u.Path != "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "must pass hostname without path")
+	reviewer, _ := e.Get(adminIdentityKey).(string)
+	col, err := bgs.collRegistry.Review(e.Request().Context(), body.Collection, status, reviewer)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "collection not in registry")
+		}
+		return err
 	}
 
-	if u.Query().Encode() != "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "must pass hostname without query")
+	log.Infow("collection reviewed", "collection", col.NSID, "status", col.Status, "reviewer", reviewer)
+	return e.JSON(200, col)
+}
+
+type policyResponse struct {
+	Interval time.Duration  `json:"interval"`
+	Rules    []PolicyRule   `json:"rules"`
+	Actions  []PolicyAction `json:"actions"`
+}
+
+func (bgs *BGS) handleAdminGetPolicy(e echo.Context) error {
+	return e.JSON(200, policyResponse{
+		Interval: bgs.policy.opts.Interval,
+		Rules:    bgs.policy.Rules(),
+		Actions:  bgs.policy.Actions(),
+	})
+}
+
+type PolicyOverrideRequest struct {
+	Host string `json:"host"`
+	// If set, exempts the host from the policy, or clears its exemption
+	Exempt *bool `json:"exempt,omitempty"`
+}
+
+func (bgs *BGS) handleAdminPolicyOverride(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	var body PolicyOverrideRequest
+	if err := e.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid body: %s", err))
 	}
 
-	host = u.Host // potentially hostname:port
+	var pds models.PDS
+	if err := bgs.db.Where("host = ?", body.Host).First(&pds).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "pds not found")
+		}
+		return err
+	}
 
-	banned, err := bgs.domainIsBanned(ctx, host)
-	if banned {
-		return echo.NewHTTPError(http.StatusUnauthorized, "domain is banned")
+	if err := bgs.policy.Override(ctx, bgs, &pds, body.Exempt); err != nil {
+		return err
 	}
 
-	// Skip checking if the server is online for now
+	return e.JSON(200, map[string]any{
+		"host":    pds.Host,
+		"exempt":  pds.PolicyExempt,
+		"blocked": pds.Blocked,
+	})
+}
 
-	return bgs.slurper.SubscribeToPds(ctx, host, true, true) // Override Trusted Domain Check
+type gossipPeersResponse struct {
+	Peers []GossipPeerStatus `json:"peers"`
+}
+
+func (bgs *BGS) handleAdminGetGossipPeers(e echo.Context) error {
+	return e.JSON(200, gossipPeersResponse{
+		Peers: bgs.gossip.Peers(),
+	})
+}
+
+func (bgs *BGS) handleAdminRunGossip(e echo.Context) error {
+	bgs.gossip.RunPass(e.Request().Context(), bgs)
+	return e.JSON(200, gossipPeersResponse{
+		Peers: bgs.gossip.Peers(),
+	})
+}
+
+func (bgs *BGS) handleAdminRunTierPromotions(e echo.Context) error {
+	n, err := bgs.tiers.RunPromotions(e.Request().Context(), bgs)
+	if err != nil {
+		return err
+	}
+
+	return e.JSON(200, map[string]any{
+		"promoted": n,
+	})
+}
+
+type blobRefsResponse struct {
+	Refs   []blobRef `json:"refs"`
+	Cursor uint      `json:"cursor,omitempty"`
+}
+
+func (bgs *BGS) handleAdminListBlobRefs(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	if bgs.blobRefs == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "the blob reference index is not enabled on this relay")
+	}
+
+	blob, did := e.QueryParam("cid"), e.QueryParam("did")
+	if (blob == "") == (did == "") {
+		return echo.NewHTTPError(http.StatusBadRequest, "must pass exactly one of cid or did")
+	}
+
+	var cursor uint64
+	if v := e.QueryParam("cursor"); v != "" {
+		c, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid cursor: %s", err))
+		}
+		cursor = c
+	}
+
+	limit := 100
+	if v := e.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > 1000 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit must be between 1 and 1000")
+		}
+		limit = l
+	}
+
+	var refs []blobRef
+	if blob != "" {
+		c, err := cid.Decode(blob)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid cid: %s", err))
+		}
+		refs, err = bgs.blobRefs.RefsToBlob(ctx, c.String(), uint(cursor), limit)
+		if err != nil {
+			return err
+		}
+	} else {
+		u, err := bgs.lookupUserByDid(ctx, did)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return echo.NewHTTPError(http.StatusNotFound, "repo not found")
+			}
+			return err
+		}
+		refs, err = bgs.blobRefs.RepoRefs(ctx, u.ID, e.QueryParam("collection"), uint(cursor), limit)
+		if err != nil {
+			return err
+		}
+	}
+
+	out := blobRefsResponse{Refs: refs}
+	if out.Refs == nil {
+		out.Refs = []blobRef{}
+	}
+	if len(refs) == limit {
+		out.Cursor = refs[len(refs)-1].ID
+	}
+	return e.JSON(200, out)
+}
+
+type adminActionsResponse struct {
+	Actions []AdminAction `json:"actions"`
+	Cursor  uint          `json:"cursor,omitempty"`
+}
+
+// parseTimeFilter parses an RFC 3339 time, or a duration before now
+func parseTimeFilter(now time.Time, name, v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	ago, err := time.ParseDuration(v)
+	if err != nil || ago < 0 {
+		return time.Time{}, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid %s: must be an RFC 3339 time or a duration ago", name))
+	}
+	return now.Add(-ago), nil
+}
+
+func (bgs *BGS) handleAdminListActions(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	now := bgs.adminLog.clock.Now()
+	var f AdminActionFilter
+	var err error
+	if f.Since, err = parseTimeFilter(now, "since", e.QueryParam("since")); err != nil {
+		return err
+	}
+	if f.Until, err = parseTimeFilter(now, "until", e.QueryParam("until")); err != nil {
+		return err
+	}
+	f.Actor = e.QueryParam("actor")
+	f.Path = e.QueryParam("path")
+
+	var cursor uint64
+	if v := e.QueryParam("cursor"); v != "" {
+		c, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid cursor: %s", err))
+		}
+		cursor = c
+	}
+
+	limit := 100
+	if v := e.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > 1000 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit must be between 1 and 1000")
+		}
+		limit = l
+	}
+
+	actions, err := bgs.adminLog.List(ctx, f, uint(cursor), limit)
+	if err != nil {
+		return err
+	}
+
+	out := adminActionsResponse{Actions: actions}
+	if len(actions) == limit {
+		out.Cursor = actions[len(actions)-1].ID
+	}
+	return e.JSON(200, out)
 }
@@ -0,0 +1,277 @@
+package bgs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/util"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// AdminAction is an entry in the admin audit log: one admin API request
+// that changed something, who made it, and how it turned out
+type AdminAction struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+
+	// the admin token (by hash) or service-auth DID the request was made with
+	Actor    string `gorm:"index" json:"actor"`
+	RemoteIP string `json:"remote_ip"`
+	Method   string `json:"method"`
+	Path     string `gorm:"index" json:"path"`
+	Query    string `json:"query,omitempty"`
+	// the request's JSON body, if it had one no bigger than MaxBodySize
+	Body json.RawMessage `json:"body,omitempty"`
+
+	Status     int    `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+type AdminAuditLogOptions struct {
+	// If set, actions are also appended to this file, one JSON object per line
+	File string
+	// If set, actions are also POSTed to this URL as JSON
+	WebhookURL     string
+	WebhookTimeout time.Duration
+	// JSON request bodies larger than this are logged without their body
+	MaxBodySize int64
+}
+
+func DefaultAdminAuditLogOptions() *AdminAuditLogOptions {
+	return &AdminAuditLogOptions{
+		WebhookTimeout: 10 * time.Second,
+		MaxBodySize:    16 << 10,
+	}
+}
+
+// AdminAuditLog records every admin API request that isn't a GET, such as
+// takedowns, host blocks, limit changes and compactions, to an append-only
+// table, and optionally streams them to a file and a webhook. Requests
+// rejected by admin auth aren't recorded.
+type AdminAuditLog struct {
+	db     *gorm.DB
+	opts   AdminAuditLogOptions
+	clock  util.Clock
+	client *http.Client
+
+	fileLk sync.Mutex
+	file   *os.File
+	enc    *json.Encoder
+
+	wg sync.WaitGroup
+}
+
+func NewAdminAuditLog(db *gorm.DB, opts *AdminAuditLogOptions, clock util.Clock) (*AdminAuditLog, error) {
+	if opts == nil {
+		opts = DefaultAdminAuditLogOptions()
+	}
+	if err := db.AutoMigrate(&AdminAction{}); err != nil {
+		return nil, err
+	}
+
+	al := &AdminAuditLog{
+		db:     db,
+		opts:   *opts,
+		clock:  util.ClockOrSystem(clock),
+		client: &http.Client{Timeout: opts.WebhookTimeout},
+	}
+	if opts.File != "" {
+		f, err := os.OpenFile(opts.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("opening admin audit log file: %w", err)
+		}
+		al.file = f
+		al.enc = json.NewEncoder(f)
+	}
+	return al, nil
+}
+
+// Shutdown waits for webhooks in flight and closes the log file
+func (al *AdminAuditLog) Shutdown() error {
+	al.wg.Wait()
+
+	al.fileLk.Lock()
+	defer al.fileLk.Unlock()
+	if al.file == nil {
+		return nil
+	}
+	err := al.file.Close()
+	al.file = nil
+	return err
+}
+
+// Middleware records admin requests that aren't reads. It must run after
+// checkAdminAuth.
+func (al *AdminAuditLog) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if req.Method == http.MethodGet || req.Method == http.MethodHead || req.Method == http.MethodOptions {
+			return next(c)
+		}
+
+		actor, _ := c.Get(adminIdentityKey).(string)
+		act := &AdminAction{
+			CreatedAt: al.clock.Now(),
+			Actor:     actor,
+			RemoteIP:  c.RealIP(),
+			Method:    req.Method,
+			Path:      req.URL.Path,
+			Query:     req.URL.RawQuery,
+			Body:      al.readBody(c),
+		}
+
+		err := next(c)
+
+		act.DurationMs = al.clock.Since(act.CreatedAt).Milliseconds()
+		act.Status = c.Response().Status
+		if err != nil {
+			act.Status, act.Error = errorDetail(err)
+		}
+		// the route, rather than the path, keeps the metric's labels bounded
+		adminActions.WithLabelValues(c.Path()).Inc()
+		al.record(context.WithoutCancel(req.Context()), act)
+		return err
+	}
+}
+
+// readBody returns the request's body if it's JSON and small enough to log,
+// leaving it in place for the handler
+func (al *AdminAuditLog) readBody(c echo.Context) json.RawMessage {
+	req := c.Request()
+	if req.Body == nil || !strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		return nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(req.Body, al.opts.MaxBodySize+1))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+	if err != nil || int64(len(buf)) > al.opts.MaxBodySize || !json.Valid(buf) {
+		return nil
+	}
+
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, buf); err != nil {
+		return nil
+	}
+	return compact.Bytes()
+}
+
+// errorDetail returns the status a handler error is served with, and its
+// message
+func errorDetail(err error) (int, string) {
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return he.Code, fmt.Sprint(he.Message)
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Status, apiErr.Message
+	}
+	return http.StatusInternalServerError, err.Error()
+}
+
+func (al *AdminAuditLog) record(ctx context.Context, act *AdminAction) {
+	log.Infow("admin action", "actor", act.Actor, "method", act.Method, "path", act.Path, "query", act.Query, "status", act.Status)
+
+	if err := al.db.WithContext(ctx).Create(act).Error; err != nil {
+		log.Errorw("failed to record admin action", "path", act.Path, "err", err)
+		adminAuditLogFailures.WithLabelValues("db").Inc()
+	}
+
+	if al.enc != nil {
+		al.fileLk.Lock()
+		if al.file != nil {
+			if err := al.enc.Encode(act); err != nil {
+				log.Errorw("failed to write admin action to audit log file", "path", act.Path, "err", err)
+				adminAuditLogFailures.WithLabelValues("file").Inc()
+			}
+		}
+		al.fileLk.Unlock()
+	}
+
+	if al.opts.WebhookURL == "" {
+		return
+	}
+	al.wg.Add(1)
+	go func() {
+		defer al.wg.Done()
+		if err := al.sendWebhook(act); err != nil {
+			log.Errorw("failed to send admin action webhook", "path", act.Path, "err", err)
+			adminAuditLogFailures.WithLabelValues("webhook").Inc()
+		}
+	}()
+}
+
+func (al *AdminAuditLog) sendWebhook(act *AdminAction) error {
+	body, err := json.Marshal(act)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", al.opts.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "indigo-relay")
+
+	resp, err := al.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// AdminActionFilter narrows a listing of the admin audit log; zero fields
+// match everything
+type AdminActionFilter struct {
+	Since time.Time
+	Until time.Time
+	Actor string
+	Path  string
+}
+
+// List returns up to limit logged actions matching the filter, newest first,
+// starting before cursor
+func (al *AdminAuditLog) List(ctx context.Context, f AdminActionFilter, cursor uint, limit int) ([]AdminAction, error) {
+	q := al.db.WithContext(ctx).Order("id desc").Limit(limit)
+	if cursor > 0 {
+		q = q.Where("id < ?", cursor)
+	}
+	if !f.Since.IsZero() {
+		q = q.Where("created_at >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		q = q.Where("created_at < ?", f.Until)
+	}
+	if f.Actor != "" {
+		q = q.Where("actor = ?", f.Actor)
+	}
+	if f.Path != "" {
+		q = q.Where("path = ?", f.Path)
+	}
+
+	var out []AdminAction
+	if err := q.Find(&out).Error; err != nil {
+		return nil, fmt.Errorf("listing admin actions: %w", err)
+	}
+	return out, nil
+}
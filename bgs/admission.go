@@ -0,0 +1,247 @@
+package bgs
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+type AdmissionKind string
+
+const (
+	// a PDS the relay has not subscribed to before
+	AdmissionKindHost AdmissionKind = "host"
+	// an account the relay has not seen before
+	AdmissionKindRepo AdmissionKind = "repo"
+)
+
+type AdmissionRequest struct {
+	Kind AdmissionKind
+	// hostname (and port) of the PDS; set for both kinds
+	Host string
+	// set for AdmissionKindRepo
+	Did string
+}
+
+type AdmissionDecision struct {
+	Allow  bool
+	Reason string
+	// How long the decision may be cached; zero uses the hook's default
+	TTL time.Duration
+}
+
+// AdmissionPolicy decides whether newly discovered hosts and repos may be
+// admitted, letting operators centralize that policy outside the relay
+type AdmissionPolicy interface {
+	Check(ctx context.Context, req *AdmissionRequest) (*AdmissionDecision, error)
+}
+
+// ErrNotAdmitted is returned when the admission policy denies a host or repo
+type ErrNotAdmitted struct {
+	Req    AdmissionRequest
+	Reason string
+}
+
+func (e *ErrNotAdmitted) Error() string {
+	subject := e.Req.Host
+	if e.Req.Kind == AdmissionKindRepo {
+		subject = e.Req.Did
+	}
+	if e.Reason == "" {
+		return fmt.Sprintf("%s %s not admitted by policy", e.Req.Kind, subject)
+	}
+	return fmt.Sprintf("%s %s not admitted by policy: %s", e.Req.Kind, subject, e.Reason)
+}
+
+type AdmissionOptions struct {
+	// Default lifetime of cached decisions
+	CacheTTL  time.Duration
+	CacheSize int
+	// Deadline for each call to the policy
+	Timeout time.Duration
+	// If set, hosts and repos are admitted when the policy can't be reached
+	// or returns an error. Otherwise they are rejected.
+	FailOpen bool
+}
+
+func DefaultAdmissionOptions() *AdmissionOptions {
+	return &AdmissionOptions{
+		CacheTTL:  10 * time.Minute,
+		CacheSize: 100_000,
+		Timeout:   2 * time.Second,
+		FailOpen:  true,
+	}
+}
+
+type cachedDecision struct {
+	decision AdmissionDecision
+	expires  time.Time
+}
+
+// admissionHook wraps an AdmissionPolicy with caching, timeouts and the
+// configured failure mode
+type admissionHook struct {
+	policy   AdmissionPolicy
+	cache    *expirable.LRU[string, *cachedDecision]
+	ttl      time.Duration
+	timeout  time.Duration
+	failOpen bool
+}
+
+func newAdmissionHook(policy AdmissionPolicy, opts *AdmissionOptions) *admissionHook {
+	if opts == nil {
+		opts = DefaultAdmissionOptions()
+	}
+
+	return &admissionHook{
+		policy:   policy,
+		cache:    expirable.NewLRU[string, *cachedDecision](opts.CacheSize, nil, 0),
+		ttl:      opts.CacheTTL,
+		timeout:  opts.Timeout,
+		failOpen: opts.FailOpen,
+	}
+}
+
+// check returns nil if the request is admitted, an *ErrNotAdmitted if the
+// policy denied it, or another error if the policy failed and the hook is
+// configured to fail closed
+func (h *admissionHook) check(ctx context.Context, req *AdmissionRequest) error {
+	ctx, span := tracer.Start(ctx, "admissionCheck")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("kind", string(req.Kind)),
+		attribute.String("host", req.Host),
+		attribute.String("did", req.Did),
+	)
+
+	key := string(req.Kind) + "|" + req.Host + "|" + req.Did
+	if cd, ok := h.cache.Get(key); ok && time.Now().Before(cd.expires) {
+		admissionChecks.WithLabelValues(string(req.Kind), decisionLabel(&cd.decision), "true").Inc()
+		return decisionErr(req, &cd.decision)
+	}
+
+	cctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	dec, err := h.policy.Check(cctx, req)
+	if err != nil {
+		admissionChecks.WithLabelValues(string(req.Kind), "error", "false").Inc()
+		if h.failOpen {
+			log.Warnw("admission policy check failed, admitting", "kind", req.Kind, "host", req.Host, "did", req.Did, "err", err)
+			return nil
+		}
+		return fmt.Errorf("admission policy check failed: %w", err)
+	}
+
+	ttl := h.ttl
+	if dec.TTL > 0 {
+		ttl = dec.TTL
+	}
+	h.cache.Add(key, &cachedDecision{decision: *dec, expires: time.Now().Add(ttl)})
+
+	admissionChecks.WithLabelValues(string(req.Kind), decisionLabel(dec), "false").Inc()
+	return decisionErr(req, dec)
+}
+
+func decisionLabel(dec *AdmissionDecision) string {
+	if dec.Allow {
+		return "allow"
+	}
+	return "deny"
+}
+
+func decisionErr(req *AdmissionRequest, dec *AdmissionDecision) error {
+	if dec.Allow {
+		return nil
+	}
+	return &ErrNotAdmitted{Req: *req, Reason: dec.Reason}
+}
+
+// checkAdmission consults the admission policy, if one is configured
+func (bgs *BGS) checkAdmission(ctx context.Context, req *AdmissionRequest) error {
+	if bgs.admission == nil {
+		return nil
+	}
+	return bgs.admission.check(ctx, req)
+}
+
+func isNotAdmitted(err error) bool {
+	var na *ErrNotAdmitted
+	return errors.As(err, &na)
+}
+
+// grpcAdmissionMethod is the full method name called on the policy service.
+// Messages are encoded as google.protobuf.Struct so that no generated code is
+// needed on either side:
+//
+//	service AdmissionService {
+//	  // request fields: kind ("host" or "repo"), host, did
+//	  // response fields: allow (bool), reason (string), ttl_seconds (number, optional)
+//	  rpc Check(google.protobuf.Struct) returns (google.protobuf.Struct);
+//	}
+const grpcAdmissionMethod = "/atproto.relay.admission.v1.AdmissionService/Check"
+
+type GRPCAdmissionPolicy struct {
+	conn *grpc.ClientConn
+}
+
+// NewGRPCAdmissionPolicy connects lazily to the policy service at addr. TLS is
+// used unless plaintext is set.
+func NewGRPCAdmissionPolicy(addr string, plaintext bool) (*GRPCAdmissionPolicy, error) {
+	creds := credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	if plaintext {
+		creds = insecure.NewCredentials()
+	}
+
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up admission policy client: %w", err)
+	}
+
+	return &GRPCAdmissionPolicy{conn: conn}, nil
+}
+
+func (p *GRPCAdmissionPolicy) Check(ctx context.Context, req *AdmissionRequest) (*AdmissionDecision, error) {
+	in, err := structpb.NewStruct(map[string]any{
+		"kind": string(req.Kind),
+		"host": req.Host,
+		"did":  req.Did,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var out structpb.Struct
+	if err := p.conn.Invoke(ctx, grpcAdmissionMethod, in, &out); err != nil {
+		return nil, err
+	}
+
+	fields := out.GetFields()
+	allow, ok := fields["allow"]
+	if !ok {
+		return nil, fmt.Errorf("admission response missing allow field")
+	}
+
+	dec := &AdmissionDecision{
+		Allow:  allow.GetBoolValue(),
+		Reason: fields["reason"].GetStringValue(),
+	}
+	if ttl := fields["ttl_seconds"].GetNumberValue(); ttl > 0 {
+		dec.TTL = time.Duration(ttl * float64(time.Second))
+	}
+
+	return dec, nil
+}
+
+func (p *GRPCAdmissionPolicy) Close() error {
+	return p.conn.Close()
+}
@@ -0,0 +1,223 @@
+package bgs
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// fakeAdmissionService answers admission checks with the response set for
+// the request's host, counting the calls it gets for each
+type fakeAdmissionService struct {
+	lk        sync.Mutex
+	responses map[string]map[string]any
+	calls     map[string]int
+	delay     time.Duration
+}
+
+func (fs *fakeAdmissionService) check(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error) {
+	host := in.GetFields()["host"].GetStringValue()
+
+	fs.lk.Lock()
+	fs.calls[host]++
+	resp, ok := fs.responses[host]
+	delay := fs.delay
+	fs.lk.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if !ok {
+		return nil, status.Error(codes.Internal, "policy failed")
+	}
+	return structpb.NewStruct(resp)
+}
+
+func (fs *fakeAdmissionService) callsFor(host string) int {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+	return fs.calls[host]
+}
+
+// startAdmissionServer serves fs as the admission policy service, returning
+// a policy client connected to it
+func startAdmissionServer(t *testing.T, fs *fakeAdmissionService) *GRPCAdmissionPolicy {
+	t.Helper()
+	fs.calls = make(map[string]int)
+
+	srv := grpc.NewServer()
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "atproto.relay.admission.v1.AdmissionService",
+		HandlerType: (*any)(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Check",
+			Handler: func(_ any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+				var in structpb.Struct
+				if err := dec(&in); err != nil {
+					return nil, err
+				}
+				return fs.check(ctx, &in)
+			},
+		}},
+	}, fs)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+
+	policy, err := NewGRPCAdmissionPolicy(l.Addr().String(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { policy.Close() })
+	return policy
+}
+
+func hostRequest(host string) *AdmissionRequest {
+	return &AdmissionRequest{Kind: AdmissionKindHost, Host: host}
+}
+
+func TestAdmissionHook(t *testing.T) {
+	fs := &fakeAdmissionService{responses: map[string]map[string]any{
+		"good.test":      {"allow": true},
+		"bad.test":       {"allow": false, "reason": "spam"},
+		"brief.test":     {"allow": true, "ttl_seconds": 0.05},
+		"malformed.test": {"reason": "no decision"},
+	}}
+	policy := startAdmissionServer(t, fs)
+	ctx := context.Background()
+
+	h := newAdmissionHook(policy, &AdmissionOptions{CacheTTL: time.Hour, CacheSize: 100, Timeout: time.Second, FailOpen: false})
+
+	// allowed, then the decision is cached
+	for i := 0; i < 3; i++ {
+		if err := h.check(ctx, hostRequest("good.test")); err != nil {
+			t.Fatalf("expected good.test admitted, got %v", err)
+		}
+	}
+	if n := fs.callsFor("good.test"); n != 1 {
+		t.Fatalf("expected one call to the policy for good.test, got %d", n)
+	}
+
+	// denied, with the policy's reason, and cached the same way
+	for i := 0; i < 2; i++ {
+		err := h.check(ctx, hostRequest("bad.test"))
+		var na *ErrNotAdmitted
+		if !errors.As(err, &na) || na.Reason != "spam" || na.Req.Host != "bad.test" {
+			t.Fatalf("expected bad.test denied for spam, got %v", err)
+		}
+	}
+	if n := fs.callsFor("bad.test"); n != 1 {
+		t.Fatalf("expected one call to the policy for bad.test, got %d", n)
+	}
+
+	// a repo on an admitted host is a separate decision
+	if err := h.check(ctx, &AdmissionRequest{Kind: AdmissionKindRepo, Host: "good.test", Did: "did:plc:alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := fs.callsFor("good.test"); n != 2 {
+		t.Fatalf("expected the repo checked separately, got %d calls", n)
+	}
+
+	// the policy's ttl overrides the default, and the decision is asked for
+	// again once it runs out
+	if err := h.check(ctx, hostRequest("brief.test")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.check(ctx, hostRequest("brief.test")); err != nil {
+		t.Fatal(err)
+	}
+	if n := fs.callsFor("brief.test"); n != 1 {
+		t.Fatalf("expected the decision cached before it expires, got %d calls", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := h.check(ctx, hostRequest("brief.test")); err != nil {
+		t.Fatal(err)
+	}
+	if n := fs.callsFor("brief.test"); n != 2 {
+		t.Fatalf("expected the decision asked for again after it expired, got %d calls", n)
+	}
+
+	// a response without a decision is an error
+	if err := h.check(ctx, hostRequest("malformed.test")); err == nil || isNotAdmitted(err) {
+		t.Fatalf("expected a malformed response to fail the check, got %v", err)
+	}
+}
+
+func TestAdmissionHookFailures(t *testing.T) {
+	fs := &fakeAdmissionService{responses: map[string]map[string]any{
+		"good.test": {"allow": true},
+	}}
+	policy := startAdmissionServer(t, fs)
+	ctx := context.Background()
+
+	for _, failOpen := range []bool{true, false} {
+		h := newAdmissionHook(policy, &AdmissionOptions{CacheTTL: time.Hour, CacheSize: 100, Timeout: time.Second, FailOpen: failOpen})
+		before := fs.callsFor("broken.test")
+
+		for i := 0; i < 2; i++ {
+			err := h.check(ctx, hostRequest("broken.test"))
+			if failOpen && err != nil {
+				t.Fatalf("expected a failed check admitted when failing open, got %v", err)
+			}
+			if !failOpen && (err == nil || isNotAdmitted(err)) {
+				t.Fatalf("expected a failed check to be an error when failing closed, got %v", err)
+			}
+		}
+		// failures aren't cached
+		if n := fs.callsFor("broken.test") - before; n != 2 {
+			t.Fatalf("fail open %v: expected the policy asked every time after an error, got %d calls", failOpen, n)
+		}
+	}
+
+	// a policy slower than the timeout is a failure too
+	const delay = 200 * time.Millisecond
+	fs.lk.Lock()
+	fs.delay = delay
+	fs.lk.Unlock()
+	for _, failOpen := range []bool{true, false} {
+		h := newAdmissionHook(policy, &AdmissionOptions{CacheTTL: time.Hour, CacheSize: 100, Timeout: 20 * time.Millisecond, FailOpen: failOpen})
+		start := time.Now()
+		err := h.check(ctx, hostRequest("good.test"))
+		if time.Since(start) >= delay {
+			t.Fatalf("expected the check to give up at the timeout, took %s", time.Since(start))
+		}
+		if failOpen != (err == nil) {
+			t.Fatalf("fail open %v: unexpected result of a timed out check: %v", failOpen, err)
+		}
+	}
+
+	// as is a policy that can't be reached at all
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	unreachable, err := NewGRPCAdmissionPolicy(addr, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unreachable.Close()
+	for _, failOpen := range []bool{true, false} {
+		h := newAdmissionHook(unreachable, &AdmissionOptions{CacheTTL: time.Hour, CacheSize: 100, Timeout: 100 * time.Millisecond, FailOpen: failOpen})
+		if err := h.check(ctx, hostRequest("good.test")); failOpen != (err == nil) {
+			t.Fatalf("fail open %v: unexpected result with the policy unreachable: %v", failOpen, err)
+		}
+	}
+}
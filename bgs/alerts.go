@@ -0,0 +1,593 @@
+package bgs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluesky-social/indigo/events"
+)
+
+// Conditions operators can be alerted on. Each is measured every interval:
+// persister_failures is the number of failed event persister writes, and
+// db_connections the share of the relay database's connection pool in use;
+// subscriber_flood is the number of firehose subscribers that connected, and
+// denied_crawl the number of crawl requests for banned hosts.
+const (
+	AlertConditionPersisterFailures = "persister_failures"
+	AlertConditionDBConnections     = "db_connections"
+	AlertConditionSubscriberFlood   = "subscriber_flood"
+	AlertConditionDeniedCrawl       = "denied_crawl"
+)
+
+const (
+	AlertSeverityWarning  = "warning"
+	AlertSeverityCritical = "critical"
+)
+
+func alertSeverityLevel(s string) int {
+	switch s {
+	case AlertSeverityCritical:
+		return 2
+	case AlertSeverityWarning:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// AlertCondition fires when its measurement goes over Threshold
+type AlertCondition struct {
+	Threshold float64
+	Severity  string
+}
+
+// Notifier sends alerts somewhere operators will see them
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, a *Alert) error
+}
+
+// AlertRoute sends alerts to a notifier
+type AlertRoute struct {
+	Notifier Notifier
+	// Only alerts at least this severe are sent; all of them if empty
+	MinSeverity string
+}
+
+type AlertingOptions struct {
+	// How often conditions are checked, and the period counts are measured
+	// over
+	Interval time.Duration
+	// How long a condition that stays over its threshold waits before
+	// alerting again
+	RepeatAfter time.Duration
+	// Identifies the relay in alerts, eg. its hostname
+	Source string
+	// Conditions alerted on, by name
+	Conditions map[string]AlertCondition
+	Routes     []AlertRoute
+	// How long each notification may take
+	Timeout time.Duration
+}
+
+func DefaultAlertingOptions() *AlertingOptions {
+	return &AlertingOptions{
+		Interval:    time.Minute,
+		RepeatAfter: time.Hour,
+		Timeout:     10 * time.Second,
+	}
+}
+
+// Alert is a condition crossing its threshold, or going back under it
+type Alert struct {
+	Event     string         `json:"event"`
+	Source    string         `json:"source,omitempty"`
+	Condition string         `json:"condition"`
+	Severity  string         `json:"severity"`
+	Summary   string         `json:"summary"`
+	Value     float64        `json:"value"`
+	Threshold float64        `json:"threshold"`
+	Resolved  bool           `json:"resolved,omitempty"`
+	Details   map[string]any `json:"details,omitempty"`
+	Time      time.Time      `json:"time"`
+}
+
+// title is a one line description of the alert
+func (a *Alert) title() string {
+	state := strings.ToUpper(a.Severity)
+	if a.Resolved {
+		state = "RESOLVED"
+	}
+	if a.Source != "" {
+		return fmt.Sprintf("[%s] %s: %s", state, a.Source, a.Summary)
+	}
+	return fmt.Sprintf("[%s] %s", state, a.Summary)
+}
+
+// Alerter watches for operational problems, such as failing event writes
+// or an exhausted database pool, and sends alerts through the configured
+// notifiers. Each condition alerts once when it crosses its threshold, again
+// every RepeatAfter while it stays over, and once more when it's resolved.
+type Alerter struct {
+	opts AlertingOptions
+
+	newSubscribers atomic.Int64
+
+	lk           sync.Mutex
+	deniedCrawls map[string]int
+	// conditions over their threshold, and when they last alerted
+	firing map[string]time.Time
+	// persister failures at the last check
+	lastPersistFailures int64
+
+	exit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewAlerter(opts *AlertingOptions) (*Alerter, error) {
+	if opts == nil {
+		opts = DefaultAlertingOptions()
+	}
+
+	for name, c := range opts.Conditions {
+		switch name {
+		case AlertConditionPersisterFailures, AlertConditionDBConnections, AlertConditionSubscriberFlood, AlertConditionDeniedCrawl:
+		default:
+			return nil, fmt.Errorf("unknown alert condition %q", name)
+		}
+		if alertSeverityLevel(c.Severity) == 0 {
+			return nil, fmt.Errorf("alert condition %s has unknown severity %q", name, c.Severity)
+		}
+		if c.Threshold < 0 {
+			return nil, fmt.Errorf("alert condition %s threshold must not be negative", name)
+		}
+	}
+	for _, r := range opts.Routes {
+		if r.MinSeverity != "" && alertSeverityLevel(r.MinSeverity) == 0 {
+			return nil, fmt.Errorf("alert notifier %s has unknown min severity %q", r.Notifier.Name(), r.MinSeverity)
+		}
+	}
+	if len(opts.Conditions) > 0 && opts.Interval <= 0 {
+		return nil, fmt.Errorf("alerting interval must be positive")
+	}
+
+	return &Alerter{
+		opts:                *opts,
+		deniedCrawls:        make(map[string]int),
+		firing:              make(map[string]time.Time),
+		lastPersistFailures: events.PersistFailures(),
+		exit:                make(chan struct{}),
+	}, nil
+}
+
+// Start starts checking conditions, if any are configured
+func (al *Alerter) Start(bgs *BGS) {
+	if len(al.opts.Conditions) == 0 {
+		return
+	}
+
+	log.Infow("starting alerting", "interval", al.opts.Interval, "conditions", len(al.opts.Conditions), "notifiers", len(al.opts.Routes))
+
+	al.wg.Add(1)
+	go func() {
+		defer al.wg.Done()
+
+		t := time.NewTicker(al.opts.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-al.exit:
+				return
+			case <-t.C:
+			}
+
+			al.RunChecks(context.Background(), bgs)
+		}
+	}()
+}
+
+// Shutdown stops checking conditions, waiting for notifications in flight
+func (al *Alerter) Shutdown() {
+	close(al.exit)
+	al.wg.Wait()
+}
+
+// observeSubscriber counts a firehose subscriber connecting
+func (al *Alerter) observeSubscriber() {
+	al.newSubscribers.Add(1)
+}
+
+// observeDeniedCrawl counts a crawl request for a banned host
+func (al *Alerter) observeDeniedCrawl(host string) {
+	if _, ok := al.opts.Conditions[AlertConditionDeniedCrawl]; !ok {
+		return
+	}
+	al.lk.Lock()
+	al.deniedCrawls[host]++
+	al.lk.Unlock()
+}
+
+// RunChecks measures every condition since the last check, and alerts on
+// those that crossed their threshold or went back under it
+func (al *Alerter) RunChecks(ctx context.Context, bgs *BGS) {
+	now := time.Now()
+
+	al.lk.Lock()
+	denied := al.deniedCrawls
+	al.deniedCrawls = make(map[string]int)
+	failures := events.PersistFailures()
+	newFailures := failures - al.lastPersistFailures
+	al.lastPersistFailures = failures
+	al.lk.Unlock()
+	subscribers := al.newSubscribers.Swap(0)
+
+	for name, cond := range al.opts.Conditions {
+		a := &Alert{
+			Event:     "relay_alert",
+			Source:    al.opts.Source,
+			Condition: name,
+			Severity:  cond.Severity,
+			Threshold: cond.Threshold,
+			Time:      now,
+		}
+
+		switch name {
+		case AlertConditionPersisterFailures:
+			a.Value = float64(newFailures)
+			a.Summary = fmt.Sprintf("%d event persister writes failed in the last %s", newFailures, al.opts.Interval)
+		case AlertConditionDBConnections:
+			sqldb, err := bgs.db.DB()
+			if err != nil {
+				log.Errorw("failed to get relay database stats for alerting", "err", err)
+				continue
+			}
+			st := sqldb.Stats()
+			if st.MaxOpenConnections <= 0 {
+				// the pool is unlimited, so can't run out
+				continue
+			}
+			a.Value = float64(st.InUse) / float64(st.MaxOpenConnections)
+			a.Summary = fmt.Sprintf("%d of %d relay database connections in use", st.InUse, st.MaxOpenConnections)
+			a.Details = map[string]any{
+				"in_use":        st.InUse,
+				"max_open":      st.MaxOpenConnections,
+				"wait_count":    st.WaitCount,
+				"wait_duration": st.WaitDuration.String(),
+			}
+		case AlertConditionSubscriberFlood:
+			a.Value = float64(subscribers)
+			a.Summary = fmt.Sprintf("%d firehose subscribers connected in the last %s", subscribers, al.opts.Interval)
+			bgs.consumersLk.RLock()
+			a.Details = map[string]any{"connected": len(bgs.consumers)}
+			bgs.consumersLk.RUnlock()
+		case AlertConditionDeniedCrawl:
+			hosts := make([]string, 0, len(denied))
+			n := 0
+			for h, c := range denied {
+				hosts = append(hosts, h)
+				n += c
+			}
+			sort.Strings(hosts)
+			a.Value = float64(n)
+			a.Summary = fmt.Sprintf("%d crawl requests for banned hosts in the last %s", n, al.opts.Interval)
+			if len(hosts) > 0 {
+				a.Details = map[string]any{"hosts": hosts}
+			}
+		}
+
+		al.evaluate(ctx, a)
+	}
+}
+
+// evaluate sends an alert if its condition just crossed its threshold, has
+// been over it for RepeatAfter, or just went back under
+func (al *Alerter) evaluate(ctx context.Context, a *Alert) {
+	al.lk.Lock()
+	last, firing := al.firing[a.Condition]
+	over := a.Value > a.Threshold
+	switch {
+	case over && firing && (al.opts.RepeatAfter <= 0 || a.Time.Sub(last) < al.opts.RepeatAfter):
+		al.lk.Unlock()
+		return
+	case over:
+		al.firing[a.Condition] = a.Time
+	case firing:
+		delete(al.firing, a.Condition)
+		a.Resolved = true
+	default:
+		al.lk.Unlock()
+		return
+	}
+	al.lk.Unlock()
+
+	if a.Resolved {
+		log.Infow("alert condition resolved", "condition", a.Condition, "value", a.Value, "threshold", a.Threshold)
+	} else {
+		log.Warnw("alert condition crossed", "condition", a.Condition, "value", a.Value, "threshold", a.Threshold, "summary", a.Summary)
+		alertsFired.WithLabelValues(a.Condition).Inc()
+	}
+	al.notify(ctx, a)
+}
+
+// notify sends an alert to every notifier that wants it, in the background
+func (al *Alerter) notify(ctx context.Context, a *Alert) {
+	for _, r := range al.opts.Routes {
+		if r.MinSeverity != "" && alertSeverityLevel(a.Severity) < alertSeverityLevel(r.MinSeverity) {
+			continue
+		}
+
+		n := r.Notifier
+		al.wg.Add(1)
+		go func() {
+			defer al.wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), al.opts.Timeout)
+			defer cancel()
+			if err := n.Notify(ctx, a); err != nil {
+				log.Errorw("failed to send alert", "notifier", n.Name(), "condition", a.Condition, "err", err)
+				alertNotifyFailures.WithLabelValues(n.Name()).Inc()
+			}
+		}()
+	}
+}
+
+// postJSON POSTs body to url as JSON, failing on a non-2xx response
+func postJSON(ctx context.Context, url string, body any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "indigo-relay")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// SlackNotifier posts alerts to a Slack incoming webhook
+type SlackNotifier struct {
+	WebhookURL string
+}
+
+func (sn *SlackNotifier) Name() string { return "slack" }
+
+func (sn *SlackNotifier) Notify(ctx context.Context, a *Alert) error {
+	text := a.title()
+	if !a.Resolved && len(a.Details) > 0 {
+		details, _ := json.Marshal(a.Details)
+		text += "\n```" + string(details) + "```"
+	}
+	return postJSON(ctx, sn.WebhookURL, map[string]string{"text": text})
+}
+
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// PagerDutyNotifier triggers and resolves PagerDuty incidents through the
+// Events API, one incident per condition
+type PagerDutyNotifier struct {
+	RoutingKey string
+	// The Events API endpoint; PagerDuty's if empty
+	URL string
+}
+
+func (pn *PagerDutyNotifier) Name() string { return "pagerduty" }
+
+func (pn *PagerDutyNotifier) Notify(ctx context.Context, a *Alert) error {
+	url := pn.URL
+	if url == "" {
+		url = pagerDutyEventsURL
+	}
+
+	source := a.Source
+	if source == "" {
+		source = "relay"
+	}
+	action := "trigger"
+	if a.Resolved {
+		action = "resolve"
+	}
+	return postJSON(ctx, url, map[string]any{
+		"routing_key":  pn.RoutingKey,
+		"event_action": action,
+		"dedup_key":    source + "/" + a.Condition,
+		"payload": map[string]any{
+			"summary":        a.title(),
+			"source":         source,
+			"severity":       a.Severity,
+			"component":      "relay",
+			"group":          a.Condition,
+			"timestamp":      a.Time.UTC().Format(time.RFC3339),
+			"custom_details": a,
+		},
+	})
+}
+
+// EmailNotifier sends alerts by email through an SMTP server, using STARTTLS
+// if the server supports it
+type EmailNotifier struct {
+	// host:port of the SMTP server
+	SMTPAddr string
+	From     string
+	To       []string
+	// If set, used to log in to the server
+	Username string
+	Password string
+}
+
+func (en *EmailNotifier) Name() string { return "email" }
+
+func (en *EmailNotifier) Notify(ctx context.Context, a *Alert) error {
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\n", en.From)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(en.To, ", "))
+	fmt.Fprintf(&body, "Subject: %s\r\n", a.title())
+	fmt.Fprintf(&body, "Date: %s\r\n", a.Time.Format(time.RFC1123Z))
+	body.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	details, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	body.Write(details)
+	body.WriteString("\r\n")
+
+	var auth smtp.Auth
+	if en.Username != "" {
+		host, _, err := net.SplitHostPort(en.SMTPAddr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", en.Username, en.Password, host)
+	}
+
+	// SendMail doesn't take a context, so give up on it rather than wait
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(en.SMTPAddr, auth, en.From, en.To, body.Bytes())
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// alertingFile is the layout of an alerting config file
+type alertingFile struct {
+	Interval    string `json:"interval"`
+	RepeatAfter string `json:"repeat_after"`
+	Source      string `json:"source"`
+	Conditions  map[string]struct {
+		Threshold float64 `json:"threshold"`
+		Severity  string  `json:"severity"`
+	} `json:"conditions"`
+	Notifiers []struct {
+		Type        string `json:"type"`
+		MinSeverity string `json:"min_severity"`
+
+		// slack
+		WebhookURL string `json:"webhook_url"`
+
+		// pagerduty
+		RoutingKey string `json:"routing_key"`
+		URL        string `json:"url"`
+
+		// email
+		SMTPAddr    string   `json:"smtp_addr"`
+		From        string   `json:"from"`
+		To          []string `json:"to"`
+		Username    string   `json:"username"`
+		PasswordEnv string   `json:"password_env"`
+	} `json:"notifiers"`
+}
+
+// default severities of conditions that don't set one
+var defaultAlertSeverity = map[string]string{
+	AlertConditionPersisterFailures: AlertSeverityCritical,
+	AlertConditionDBConnections:     AlertSeverityCritical,
+	AlertConditionSubscriberFlood:   AlertSeverityWarning,
+	AlertConditionDeniedCrawl:       AlertSeverityWarning,
+}
+
+// LoadAlertingConfig reads alerting options from a JSON config file:
+//
+//	{
+//	  "interval": "1m",
+//	  "repeat_after": "1h",
+//	  "source": "relay.example.com",
+//	  "conditions": {
+//	    "persister_failures": {"threshold": 0},
+//	    "db_connections": {"threshold": 0.9},
+//	    "subscriber_flood": {"threshold": 500, "severity": "warning"},
+//	    "denied_crawl": {"threshold": 0}
+//	  },
+//	  "notifiers": [
+//	    {"type": "slack", "webhook_url": "https://hooks.slack.com/services/..."},
+//	    {"type": "pagerduty", "routing_key": "...", "min_severity": "critical"},
+//	    {"type": "email", "smtp_addr": "smtp.example.com:587", "from": "relay@example.com", "to": ["ops@example.com"], "username": "relay", "password_env": "RELAY_ALERT_SMTP_PASSWORD"}
+//	  ]
+//	}
+func LoadAlertingConfig(path string) (*AlertingOptions, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading alerting config: %w", err)
+	}
+
+	var af alertingFile
+	if err := json.Unmarshal(data, &af); err != nil {
+		return nil, fmt.Errorf("parsing alerting config %s: %w", path, err)
+	}
+
+	opts := DefaultAlertingOptions()
+	opts.Source = af.Source
+	if af.Interval != "" {
+		if opts.Interval, err = time.ParseDuration(af.Interval); err != nil {
+			return nil, fmt.Errorf("alerting interval: %w", err)
+		}
+	}
+	if af.RepeatAfter != "" {
+		if opts.RepeatAfter, err = time.ParseDuration(af.RepeatAfter); err != nil {
+			return nil, fmt.Errorf("alerting repeat_after: %w", err)
+		}
+	}
+
+	opts.Conditions = make(map[string]AlertCondition)
+	for name, c := range af.Conditions {
+		sev := c.Severity
+		if sev == "" {
+			sev = defaultAlertSeverity[name]
+		}
+		opts.Conditions[name] = AlertCondition{Threshold: c.Threshold, Severity: sev}
+	}
+
+	for i, n := range af.Notifiers {
+		var notifier Notifier
+		switch n.Type {
+		case "slack":
+			if n.WebhookURL == "" {
+				return nil, fmt.Errorf("alerting notifier %d: slack needs a webhook_url", i)
+			}
+			notifier = &SlackNotifier{WebhookURL: n.WebhookURL}
+		case "pagerduty":
+			if n.RoutingKey == "" {
+				return nil, fmt.Errorf("alerting notifier %d: pagerduty needs a routing_key", i)
+			}
+			notifier = &PagerDutyNotifier{RoutingKey: n.RoutingKey, URL: n.URL}
+		case "email":
+			if n.SMTPAddr == "" || n.From == "" || len(n.To) == 0 {
+				return nil, fmt.Errorf("alerting notifier %d: email needs smtp_addr, from and to", i)
+			}
+			en := &EmailNotifier{SMTPAddr: n.SMTPAddr, From: n.From, To: n.To, Username: n.Username}
+			if n.PasswordEnv != "" {
+				en.Password = os.Getenv(n.PasswordEnv)
+			}
+			notifier = en
+		default:
+			return nil, fmt.Errorf("alerting notifier %d has unknown type %q", i, n.Type)
+		}
+		opts.Routes = append(opts.Routes, AlertRoute{Notifier: notifier, MinSeverity: n.MinSeverity})
+	}
+	return opts, nil
+}
@@ -0,0 +1,861 @@
+package bgs
+
+import (
+	"encoding"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	comatprototypes "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/indexer"
+
+	"github.com/labstack/echo/v4"
+)
+
+// apiParam describes a query parameter accepted by an endpoint
+type apiParam struct {
+	Name     string
+	Type     string // string, integer or boolean
+	Array    bool
+	Required bool
+	Desc     string
+}
+
+// apiRouteDoc annotates a registered route with what can't be recovered from
+// the echo router itself. Body and Response are zero values of the types the
+// handler binds or returns, and are reflected into JSON schemas.
+type apiRouteDoc struct {
+	Summary  string
+	Query    []apiParam
+	Body     any
+	Response any
+	// content type of a non-JSON request body, used instead of Body
+	Consumes string
+	// content type of a non-JSON response body
+	Produces string
+}
+
+var (
+	didParam  = apiParam{Name: "did", Type: "string", Required: true, Desc: "DID of the repo"}
+	hostParam = apiParam{Name: "host", Type: "string", Required: true, Desc: "hostname of the PDS"}
+)
+
+type apiSuccessResponse struct {
+	Success string `json:"success"`
+}
+
+// apiRouteDocs is keyed by "METHOD path", as registered in StartWithListener.
+// Routes missing from here are still described, just without parameters or
+// schemas.
+var apiRouteDocs = map[string]apiRouteDoc{
+	"GET /xrpc/com.atproto.sync.subscribeRepos": {
+		Summary: "Repository event stream (websocket upgrade, DAG-CBOR frames)",
+		Query: []apiParam{
+			{Name: "cursor", Type: "string", Desc: "last sequence number processed, or a cursor token carrying the epoch; the stream resumes after it"},
+			{Name: "cursorTime", Type: "string", Desc: "instead of a cursor, start from the events persisted at this RFC 3339 time, or this long ago (eg. 2h); playback may start a little earlier"},
+			{Name: "excludeTypes", Type: "string", Array: true, Desc: "message types to leave out of the stream (commit, sync, identity, account, handle, migrate, tombstone), comma separated or repeated"},
+			{Name: "version", Type: "integer", Desc: "newest frame format version the consumer understands (default 1; version 2 adds an integrity chain to each frame header); the version used is returned in the Atproto-Stream-Version header"},
+		},
+		Produces: "application/vnd.ipld.dag-cbor",
+	},
+	"GET /xrpc/_dev/sampleFirehose": {
+		Summary: "Event stream of a deterministic sample of repos, for load testing consumers (websocket upgrade, DAG-CBOR frames); only served when enabled",
+		Query: []apiParam{
+			{Name: "rate", Type: "number", Desc: "fraction of repos to include, greater than 0 and at most 1 (default 0.01)"},
+			{Name: "seed", Type: "string", Desc: "picks a different set of repos at the same rate"},
+			{Name: "cursor", Type: "string", Desc: "as for subscribeRepos"},
+			{Name: "cursorTime", Type: "string", Desc: "as for subscribeRepos"},
+			{Name: "version", Type: "integer", Desc: "as for subscribeRepos"},
+			{Name: "excludeTypes", Type: "string", Array: true, Desc: "as for subscribeRepos"},
+		},
+		Produces: "application/vnd.ipld.dag-cbor",
+	},
+	"GET /xrpc/_relay/listHosts": {
+		Summary:  "List the hosts the relay is consuming from and in good standing with, for other relays to gossip with; only served when enabled",
+		Response: GossipHostsResponse{},
+	},
+	"GET /xrpc/_relay/getRepoHistory": {
+		Summary: "List the latest events the relay persisted for a repo, newest first; only served when enabled",
+		Query: []apiParam{
+			didParam,
+			{Name: "limit", Type: "integer", Desc: "maximum number of events, at most 500 (default 50)"},
+		},
+		Response: RepoHistoryResponse{},
+	},
+	"GET /xrpc/com.atproto.sync.getRecord": {
+		Summary:  "Get a record and the blocks proving its inclusion in the repo, as a CAR file; a record with fields removed by redaction rules is named as a second root",
+		Query:    []apiParam{didParam, {Name: "collection", Type: "string", Required: true}, {Name: "rkey", Type: "string", Required: true}},
+		Produces: "application/vnd.ipld.car",
+	},
+	"GET /xrpc/com.atproto.sync.getRepo": {
+		Summary:  "Export a repo as a CAR file",
+		Query:    []apiParam{didParam, {Name: "since", Type: "string", Desc: "only include blocks written after this revision"}},
+		Produces: "application/vnd.ipld.car",
+	},
+	"GET /xrpc/com.atproto.sync.getBlocks": {
+		Summary:  "Get blocks from a repo by CID, as a CAR file",
+		Query:    []apiParam{didParam, {Name: "cids", Type: "string", Array: true, Required: true}},
+		Produces: "application/vnd.ipld.car",
+	},
+	"GET /xrpc/com.atproto.sync.getBlob": {
+		Summary:  "Get a blob, proxied from the account's PDS",
+		Query:    []apiParam{didParam, {Name: "cid", Type: "string", Required: true}},
+		Produces: "*/*",
+	},
+	"GET /xrpc/com.atproto.sync.requestCrawl": {
+		Summary: "Request that the relay subscribe to a PDS",
+		Query:   []apiParam{{Name: "hostname", Type: "string", Required: true}},
+	},
+	"POST /xrpc/com.atproto.sync.requestCrawl": {
+		Summary: "Request that the relay subscribe to a PDS",
+		Body:    comatprototypes.SyncRequestCrawl_Input{},
+	},
+	"GET /xrpc/com.atproto.sync.listRepos": {
+		Summary:  "List repos hosted by the relay",
+		Query:    []apiParam{{Name: "cursor", Type: "integer"}, {Name: "limit", Type: "integer"}},
+		Response: comatprototypes.SyncListRepos_Output{},
+	},
+	"GET /xrpc/com.atproto.sync.listReposByCollection": {
+		Summary: "List repos with records in a collection; repos stay listed after deleting their last record in it",
+		Query: []apiParam{
+			{Name: "collection", Type: "string", Required: true},
+			{Name: "cursor", Type: "string"},
+			{Name: "limit", Type: "integer", Desc: "max results, 1-2000 (default 500)"},
+		},
+		Response: comatprototypes.SyncListReposByCollection_Output{},
+	},
+	"GET /xrpc/com.atproto.sync.getLatestCommit": {
+		Summary:  "Get the current commit CID and revision of a repo",
+		Query:    []apiParam{didParam},
+		Response: comatprototypes.SyncGetLatestCommit_Output{},
+	},
+	"GET /xrpc/com.atproto.sync.notifyOfUpdate": {
+		Summary: "Notify the relay of a repo update (no-op)",
+		Body:    comatprototypes.SyncNotifyOfUpdate_Input{},
+	},
+	"GET /xrpc/_health": {
+		Summary:  "Health check",
+		Response: HealthStatus{},
+	},
+	"GET /_health": {
+		Summary:  "Health check",
+		Response: HealthStatus{},
+	},
+
+	"GET /admin/subs/getUpstreamConns": {
+		Summary:  "List hosts with an active upstream connection",
+		Response: []string{},
+	},
+	"GET /admin/subs/health": {
+		Summary: "Get the health of each upstream connection",
+		Query: []apiParam{
+			{Name: "sort", Type: "string", Desc: "host (default), reconnects, rtt or bytes; all but host sort highest first"},
+			{Name: "limit", Type: "integer"},
+		},
+		Response: []HostConnHealth{},
+	},
+	"GET /admin/subs/getEnabled": {
+		Summary:  "Get whether new PDS subscriptions are enabled",
+		Response: map[string]bool{},
+	},
+	"GET /admin/subs/perDayLimit": {
+		Summary:  "Get the limit on new PDS subscriptions per day",
+		Response: map[string]int64{},
+	},
+	"POST /admin/subs/setEnabled": {
+		Summary: "Enable or disable new PDS subscriptions",
+		Query:   []apiParam{{Name: "enabled", Type: "boolean", Required: true}},
+	},
+	"POST /admin/subs/killUpstream": {
+		Summary:  "Disconnect from a PDS, optionally blocking it",
+		Query:    []apiParam{hostParam, {Name: "block", Type: "boolean"}},
+		Response: apiSuccessResponse{},
+	},
+	"POST /admin/subs/setPerDayLimit": {
+		Summary: "Set the limit on new PDS subscriptions per day",
+		Query:   []apiParam{{Name: "limit", Type: "integer", Required: true}},
+	},
+	"GET /admin/subs/listDomainBans": {
+		Summary:  "List banned domains",
+		Response: bannedDomains{},
+	},
+	"POST /admin/subs/banDomain": {
+		Summary:  "Ban a domain and its subdomains",
+		Body:     banDomainBody{},
+		Response: apiSuccessResponse{},
+	},
+	"POST /admin/subs/unbanDomain": {
+		Summary:  "Remove a domain ban",
+		Body:     banDomainBody{},
+		Response: apiSuccessResponse{},
+	},
+	"POST /admin/repo/takeDown": {
+		Summary: "Take down a repo",
+		Body:    map[string]string{},
+	},
+	"POST /admin/repo/reverseTakedown": {
+		Summary: "Reverse a repo takedown",
+		Query:   []apiParam{didParam},
+	},
+	"POST /admin/repo/compact": {
+		Summary:  "Compact a repo's shards",
+		Query:    []apiParam{didParam, {Name: "fast", Type: "boolean"}},
+		Response: map[string]any{},
+	},
+	"POST /admin/repo/compactAll": {
+		Summary: "Queue compaction of all repos needing it",
+		Query: []apiParam{
+			{Name: "fast", Type: "boolean"},
+			{Name: "limit", Type: "integer"},
+			{Name: "threshold", Type: "integer", Desc: "minimum number of shards for a repo to be compacted"},
+		},
+		Response: map[string]any{},
+	},
+	"POST /admin/repo/reset": {
+		Summary:  "Wipe and re-crawl a repo",
+		Query:    []apiParam{didParam},
+		Response: apiSuccessResponse{},
+	},
+	"GET /admin/repo/trash": {
+		Summary:  "List repo data removed by takedowns and deletions that can still be restored",
+		Query:    []apiParam{{Name: "did", Type: "string", Desc: "only list entries for this repo"}},
+		Response: repoTrashResponse{},
+	},
+	"GET /admin/repo/history": {
+		Summary: "List the latest events the relay persisted for a repo, newest first, including repos that aren't served",
+		Query: []apiParam{
+			didParam,
+			{Name: "limit", Type: "integer", Desc: "maximum number of events, at most 500 (default 50)"},
+		},
+		Response: RepoHistoryResponse{},
+	},
+	"POST /admin/repo/restore": {
+		Summary: "Restore a repo's data from the trash",
+		Query: []apiParam{
+			didParam,
+			{Name: "id", Type: "string", Desc: "trash entry to restore; defaults to the most recent"},
+		},
+		Response: map[string]any{},
+	},
+	"POST /admin/repo/import": {
+		Summary: "Replace a repo's data with a CAR archive of the whole repo",
+		Query: []apiParam{
+			didParam,
+			{Name: "force", Type: "boolean", Desc: "import even if the stored repo is as new or newer"},
+		},
+		Consumes: "application/vnd.ipld.car",
+		Response: RepoImportResponse{},
+	},
+	"POST /admin/repo/verify": {
+		Summary:  "Verify a repo's stored data against its commit",
+		Query:    []apiParam{didParam},
+		Response: apiSuccessResponse{},
+	},
+	"POST /admin/repo/reverifyHandle": {
+		Summary:  "Re-verify a repo's handle, emitting #identity if it changed",
+		Query:    []apiParam{didParam},
+		Response: map[string]any{},
+	},
+	"POST /admin/repo/reverifyAllHandles": {
+		Summary:  "Start a background handle verification pass over all repos",
+		Response: apiSuccessResponse{},
+	},
+	"POST /admin/pds/requestCrawl": {
+		Summary: "Subscribe to a PDS, bypassing new PDS limits",
+		Body:    AdminRequestCrawlRequest{},
+	},
+	"POST /admin/pds/import": {
+		Summary:  "Validate and subscribe to many PDSs at once; also accepts a text/plain list of hostnames, one per line",
+		Query:    []apiParam{{Name: "skip_validation", Type: "boolean", Desc: "for text/plain bodies, subscribe without calling describeServer first"}},
+		Body:     AdminImportHostsRequest{},
+		Response: AdminImportHostsResponse{},
+	},
+	"GET /admin/pds/list": {
+		Summary:  "List known PDSs with their limits and connection state",
+		Response: []enrichedPDS{},
+	},
+	"POST /admin/pds/resync": {
+		Summary:  "Start a resync of all repos on a PDS",
+		Query:    []apiParam{hostParam},
+		Response: map[string]any{},
+	},
+	"GET /admin/pds/resync": {
+		Summary:  "Get the status of a PDS resync",
+		Query:    []apiParam{hostParam},
+		Response: map[string]any{},
+	},
+	"POST /admin/pds/changeLimits": {
+		Summary:  "Change a PDS's rate limits",
+		Body:     RateLimitChangeRequest{},
+		Response: apiSuccessResponse{},
+	},
+	"POST /admin/pds/block": {
+		Summary:  "Block a PDS and disconnect from it",
+		Query:    []apiParam{hostParam},
+		Response: apiSuccessResponse{},
+	},
+	"POST /admin/pds/unblock": {
+		Summary:  "Unblock a PDS",
+		Query:    []apiParam{hostParam},
+		Response: apiSuccessResponse{},
+	},
+	"POST /admin/pds/addTrustedDomain": {
+		Summary:  "Trust a domain suffix, exempting its PDSs from new PDS limits",
+		Query:    []apiParam{{Name: "domain", Type: "string", Required: true}},
+		Response: apiSuccessResponse{},
+	},
+	"POST /admin/pds/setStorageQuota": {
+		Summary:  "Set a PDS's storage quota; hosts over quota are disconnected until it is raised",
+		Body:     StorageQuotaChangeRequest{},
+		Response: apiSuccessResponse{},
+	},
+	"POST /admin/pds/recountStorage": {
+		Summary:  "Recompute a PDS's storage total from the current size of its accounts' repos",
+		Query:    []apiParam{hostParam},
+		Response: map[string]any{},
+	},
+	"POST /admin/pds/setTier": {
+		Summary:  "Move a PDS to a repo limit tier, setting its repo limit to the tier's; pinned unless unpinned is set",
+		Body:     TierChangeRequest{},
+		Response: map[string]any{},
+	},
+	"GET /admin/pds/growth": {
+		Summary: "List the PDSs whose repo counts grew the most within the growth monitor's window",
+		Query: []apiParam{
+			{Name: "limit", Type: "integer", Desc: "max results, 1-1000 (default 100)"},
+		},
+		Response: pdsGrowthResponse{},
+	},
+	"GET /admin/pds/statsHistory": {
+		Summary: "Get a PDS's event rate, error rate and repo count over time",
+		Query: []apiParam{
+			hostParam,
+			{Name: "since", Type: "string", Desc: "RFC 3339 time, or how long ago (eg. 6h); default 24h"},
+			{Name: "until", Type: "string", Desc: "RFC 3339 time, or how long ago; default now"},
+			{Name: "resolution", Type: "string", Desc: "sample or hourly; by default, samples if they go back as far as since"},
+		},
+		Response: pdsStatsHistoryResponse{},
+	},
+	"GET /admin/collections/registry": {
+		Summary: "List the collections records have been seen in, newest first, with where each was first seen, record counts and a sample record",
+		Query: []apiParam{
+			{Name: "status", Type: "string", Desc: "only collections that are approved, pending or rejected"},
+			{Name: "limit", Type: "integer", Desc: "1-1000, default 100"},
+		},
+		Response: collectionRegistryResponse{},
+	},
+	"POST /admin/collections/approve": {
+		Summary:  "Approve a collection, so commits in it are sent out on the firehose, along with those held back until now",
+		Body:     CollectionReviewRequest{},
+		Response: RegisteredCollection{},
+	},
+	"POST /admin/collections/reject": {
+		Summary:  "Reject a collection, so commits in it stay held back from the firehose while quarantine is on",
+		Body:     CollectionReviewRequest{},
+		Response: RegisteredCollection{},
+	},
+	"GET /admin/tiers": {
+		Summary:  "List repo limit tiers with the number of hosts in each, and the automatic promotion rules",
+		Response: repoLimitTiersResponse{},
+	},
+	"POST /admin/tiers/promote": {
+		Summary:  "Promote every eligible host now, rather than waiting for the next scheduled pass",
+		Response: map[string]int{},
+	},
+	"GET /admin/policy": {
+		Summary:  "Get the defederation policy's rules, and the most recent actions it took, newest first",
+		Response: policyResponse{},
+	},
+	"POST /admin/policy/override": {
+		Summary:  "Lift a host's defederation policy pause, and exempt it from the policy or clear its exemption if exempt is set; policy blocks are lifted with /admin/pds/unblock",
+		Body:     PolicyOverrideRequest{},
+		Response: map[string]any{},
+	},
+	"GET /admin/faults": {
+		Summary:  "Get the faults being injected",
+		Response: FaultInjectionState{},
+	},
+	"POST /admin/faults": {
+		Summary:  "Replace the faults being injected",
+		Body:     FaultConfig{},
+		Response: FaultInjectionState{},
+	},
+	"POST /admin/faults/clear": {
+		Summary:  "Stop injecting faults",
+		Response: FaultInjectionState{},
+	},
+	"GET /admin/gossip/peers": {
+		Summary:  "Get how the last gossip with each peer relay went",
+		Response: gossipPeersResponse{},
+	},
+	"POST /admin/gossip/run": {
+		Summary:  "Fetch every gossip peer's host list and request the new hosts on them now, rather than waiting for the next scheduled pass",
+		Response: gossipPeersResponse{},
+	},
+	"GET /admin/storage/repo": {
+		Summary:  "Get the carstore usage of a repo",
+		Query:    []apiParam{didParam},
+		Response: repoStorage{},
+	},
+	"GET /admin/storage/repos": {
+		Summary: "List the repos using the most carstore space",
+		Query: []apiParam{
+			{Name: "limit", Type: "integer", Desc: "max results, 1-1000 (default 100)"},
+		},
+		Response: []repoStorage{},
+	},
+	"GET /admin/storage/pds": {
+		Summary: "List PDSs by carstore usage, largest first",
+		Query: []apiParam{
+			{Name: "overQuota", Type: "boolean", Desc: "only hosts over their storage quota"},
+			{Name: "limit", Type: "integer", Desc: "max results, 1-1000 (default 100)"},
+		},
+		Response: []pdsStorage{},
+	},
+	"GET /admin/storage/scrub": {
+		Summary:  "Get what the carstore scrubber has checked, and the corrupt shards it found",
+		Response: ScrubReport{},
+	},
+	"GET /admin/blobs/refs": {
+		Summary: "List blob references from the blob reference index, either the records referencing a blob or the blobs a repo's records reference",
+		Query: []apiParam{
+			{Name: "cid", Type: "string", Desc: "list the records referencing this blob"},
+			{Name: "did", Type: "string", Desc: "list the blobs this repo's records reference"},
+			{Name: "collection", Type: "string", Desc: "with did, only records in this collection"},
+			{Name: "cursor", Type: "integer", Desc: "pagination cursor from the previous response"},
+			{Name: "limit", Type: "integer", Desc: "max results, 1-1000 (default 100)"},
+		},
+		Response: blobRefsResponse{},
+	},
+	"GET /admin/crawl/priorities": {
+		Summary:  "Get crawl scheduling weights, overrides and queue depths",
+		Response: indexer.CrawlPriorityConfig{},
+	},
+	"POST /admin/crawl/setPriority": {
+		Summary:  "Set or clear the crawl priority override for a host or repo",
+		Body:     CrawlPriorityChangeRequest{},
+		Response: apiSuccessResponse{},
+	},
+	"POST /admin/crawl/setWeights": {
+		Summary:  "Set crawl priority class weights",
+		Body:     map[string]int{},
+		Response: indexer.CrawlPriorityConfig{},
+	},
+	"GET /admin/crawl/hostBudgets": {
+		Summary:  "List each host's share of the crawl fetch workers and the worker time its crawls have used",
+		Response: crawlHostBudgetsResponse{},
+	},
+	"POST /admin/crawl/setHostWeight": {
+		Summary:  "Set a host's weight in sharing the crawl fetch workers with other hosts",
+		Body:     CrawlHostWeightRequest{},
+		Response: apiSuccessResponse{},
+	},
+	"GET /admin/crawl/fetchFailures": {
+		Summary: "List repos whose crawls have failed, either awaiting retry or dead-lettered",
+		Query: []apiParam{
+			{Name: "dead", Type: "boolean", Desc: "list dead-lettered repos (default) or those awaiting a retry"},
+			{Name: "cursor", Type: "integer"},
+			{Name: "limit", Type: "integer"},
+		},
+		Response: fetchFailuresResponse{},
+	},
+	"POST /admin/crawl/retryFetch": {
+		Summary: "Reset a failed repo's retry schedule so it is crawled again shortly",
+		Query: []apiParam{
+			{Name: "did", Type: "string", Desc: "DID of the repo"},
+			{Name: "all", Type: "boolean", Desc: "retry every dead-lettered repo"},
+		},
+		Response: apiSuccessResponse{},
+	},
+	"POST /admin/repo/audit": {
+		Summary: "Compare a repo's stored state against a fresh copy from its PDS",
+		Query: []apiParam{
+			{Name: "did", Type: "string", Desc: "DID of the repo"},
+			{Name: "repair", Type: "boolean", Desc: "re-import the repo if it is out of sync"},
+		},
+		Response: indexer.RepoAudit{},
+	},
+	"GET /admin/repo/audits": {
+		Summary: "List repo audit results, newest first",
+		Query: []apiParam{
+			{Name: "did", Type: "string", Desc: "only audits of this repo"},
+			{Name: "status", Type: "string", Desc: "only audits with this outcome: ok, behind, mismatch, invalid or error"},
+			{Name: "cursor", Type: "integer", Desc: "pagination cursor from the previous response"},
+			{Name: "limit", Type: "integer", Desc: "max results, 1-1000 (default 100)"},
+		},
+		Response: repoAuditsResponse{},
+	},
+	"POST /admin/pds/audit": {
+		Summary: "Audit every repo on a PDS in the background",
+		Query: []apiParam{
+			{Name: "host", Type: "string", Desc: "PDS hostname"},
+			{Name: "limit", Type: "integer", Desc: "max repos to audit, 0 for all"},
+			{Name: "repair", Type: "boolean", Desc: "re-import repos found to be out of sync"},
+		},
+		Response: apiSuccessResponse{},
+	},
+	"GET /admin/ingest/stages": {
+		Summary:  "List the stages events from PDSs pass through, in order, and whether each is enabled",
+		Response: ingestStagesResponse{},
+	},
+	"GET /admin/ingest/flagged": {
+		Summary: "List the latest commits scoring above a content score threshold, newest first",
+		Query: []apiParam{
+			{Name: "limit", Type: "integer", Desc: "max results, 1-500 (default 100)"},
+		},
+		Response: flaggedCommitsResponse{},
+	},
+	"POST /admin/ingest/setStage": {
+		Summary: "Enable or disable an ingest stage",
+		Query: []apiParam{
+			{Name: "name", Type: "string", Required: true, Desc: "stage name, e.g. size, lexicon, signature or rev"},
+			{Name: "enabled", Type: "boolean", Required: true},
+		},
+		Response: apiSuccessResponse{},
+	},
+	"GET /admin/ingest/revReport": {
+		Summary: "Count each PDS's commits that broke rev ordering (out of order, duplicate or future dated) since the relay started",
+		Query: []apiParam{
+			{Name: "host", Type: "string", Desc: "only this PDS"},
+			{Name: "sort", Type: "string", Desc: "one of violations (default), rate or host"},
+			{Name: "limit", Type: "integer", Desc: "max results"},
+		},
+		Response: revReportResponse{},
+	},
+	"GET /admin/consumers/list": {
+		Summary:  "List connected firehose consumers",
+		Response: []consumer{},
+	},
+	"GET /admin/consumers/history": {
+		Summary: "List firehose consumers seen over time, with connection and traffic totals",
+		Query: []apiParam{
+			{Name: "sort", Type: "string", Desc: "one of last_seen (default), bytes, events, connections, short_connections; descending"},
+			{Name: "host", Type: "string", Desc: "only this remote address"},
+			{Name: "limit", Type: "integer", Desc: "max results, 1-1000 (default 100)"},
+		},
+		Response: []FirehoseConsumer{},
+	},
+	"POST /admin/consumers/replay": {
+		Summary:  "Send a range of past events again, into a connected consumer's stream, or over a replay connection opened with the returned ticket if consumer_id is unset",
+		Body:     ReplayEventsRequest{},
+		Response: replayEventsResponse{},
+	},
+	"GET /admin/debug/pprof/profile": {
+		Summary: "Capture a CPU profile, for go tool pprof",
+		Query: []apiParam{
+			{Name: "seconds", Type: "integer", Desc: "how long to profile for, at most 300 (default 30)"},
+		},
+		Produces: "application/octet-stream",
+	},
+	"GET /admin/debug/pprof/trace": {
+		Summary: "Capture a runtime execution trace, for go tool trace",
+		Query: []apiParam{
+			{Name: "seconds", Type: "integer", Desc: "how long to trace for, at most 300 (default 5)"},
+		},
+		Produces: "application/octet-stream",
+	},
+	"GET /admin/debug/pprof/:profile": {
+		Summary: "Write a runtime profile: heap, allocs, goroutine, block, mutex or threadcreate",
+		Query: []apiParam{
+			{Name: "debug", Type: "integer", Desc: "if above 0, a text format instead of pprof's binary one"},
+			{Name: "gc", Type: "boolean", Desc: "run a garbage collection before taking a heap profile"},
+		},
+		Produces: "application/octet-stream",
+	},
+	"GET /admin/actions": {
+		Summary: "List admin actions from the audit log, newest first",
+		Query: []apiParam{
+			{Name: "since", Type: "string", Desc: "only actions at or after this time, RFC 3339 or a duration ago like 24h"},
+			{Name: "until", Type: "string", Desc: "only actions before this time, RFC 3339 or a duration ago"},
+			{Name: "actor", Type: "string", Desc: "only actions by this admin token hash or service-auth DID"},
+			{Name: "path", Type: "string", Desc: "only actions on this admin path, eg /admin/repo/takeDown"},
+			{Name: "cursor", Type: "integer", Desc: "pagination cursor from the previous response"},
+			{Name: "limit", Type: "integer", Desc: "max results, 1-1000 (default 100)"},
+		},
+		Response: adminActionsResponse{},
+	},
+	"GET /admin/openapi.json": {
+		Summary:  "This document",
+		Response: map[string]any{},
+	},
+}
+
+// only these routes are part of the described API
+var apiDocPrefixes = []string{"/xrpc/", "/admin/", "/_health"}
+
+func (bgs *BGS) handleAdminGetAPIDescription(e echo.Context) error {
+	return e.JSON(http.StatusOK, buildAPIDescription(e.Echo().Routes()))
+}
+
+// buildAPIDescription produces an OpenAPI 3 document describing the given
+// routes, so operators can generate typed clients for their tooling
+func buildAPIDescription(routes []*echo.Route) map[string]any {
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return routes[i].Method < routes[j].Method
+	})
+
+	sg := &schemaGen{components: make(map[string]any)}
+	paths := make(map[string]map[string]any)
+
+	for _, r := range routes {
+		described := false
+		for _, pref := range apiDocPrefixes {
+			if strings.HasPrefix(r.Path, pref) {
+				described = true
+				break
+			}
+		}
+		if !described || strings.Contains(r.Path, "*") {
+			continue
+		}
+
+		doc := apiRouteDocs[r.Method+" "+r.Path]
+		op := map[string]any{
+			"operationId": operationID(r.Method, r.Path),
+		}
+		if doc.Summary != "" {
+			op["summary"] = doc.Summary
+		}
+
+		isAdmin := strings.HasPrefix(r.Path, "/admin/")
+		if isAdmin {
+			op["tags"] = []string{"admin"}
+			op["security"] = []map[string][]string{{"adminToken": {}}}
+		} else {
+			op["tags"] = []string{"sync"}
+		}
+
+		if len(doc.Query) > 0 {
+			var params []map[string]any
+			for _, p := range doc.Query {
+				schema := map[string]any{"type": p.Type}
+				if p.Array {
+					schema = map[string]any{"type": "array", "items": schema}
+				}
+				param := map[string]any{
+					"name":     p.Name,
+					"in":       "query",
+					"required": p.Required,
+					"schema":   schema,
+				}
+				if p.Desc != "" {
+					param["description"] = p.Desc
+				}
+				params = append(params, param)
+			}
+			op["parameters"] = params
+		}
+
+		switch {
+		case doc.Consumes != "":
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					doc.Consumes: map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}},
+				},
+			}
+		case doc.Body != nil:
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": sg.schemaFor(reflect.TypeOf(doc.Body))},
+				},
+			}
+		}
+
+		ok := map[string]any{"description": "OK"}
+		switch {
+		case doc.Produces != "":
+			ok["content"] = map[string]any{
+				doc.Produces: map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}},
+			}
+		case doc.Response != nil:
+			ok["content"] = map[string]any{
+				"application/json": map[string]any{"schema": sg.schemaFor(reflect.TypeOf(doc.Response))},
+			}
+		}
+		errResp := map[string]any{
+			"description": "Error",
+			"content": map[string]any{
+				"application/json": map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/Error"}},
+			},
+		}
+		responses := map[string]any{"200": ok, "400": errResp, "500": errResp}
+		if isAdmin {
+			responses["403"] = errResp
+		}
+		op["responses"] = responses
+
+		if paths[r.Path] == nil {
+			paths[r.Path] = make(map[string]any)
+		}
+		paths[r.Path][strings.ToLower(r.Method)] = op
+	}
+
+	sg.components["Error"] = map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"error":   map[string]any{"type": "string"},
+			"message": map[string]any{"type": "string"},
+		},
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "Relay (BGS) API",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": sg.components,
+			"securitySchemes": map[string]any{
+				"adminToken": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// operationID turns a route into an identifier suitable for generated client
+// method names, eg. "POST /admin/repo/takeDown" -> "postAdminRepoTakeDown"
+func operationID(method, path string) string {
+	var sb strings.Builder
+	sb.WriteString(strings.ToLower(method))
+	for _, seg := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '.' || r == '_' }) {
+		if seg == "xrpc" {
+			continue
+		}
+		sb.WriteString(strings.ToUpper(seg[:1]) + seg[1:])
+	}
+	return sb.String()
+}
+
+// schemaGen reflects Go types into OpenAPI schemas. Named structs are emitted
+// once into components and referenced from there.
+type schemaGen struct {
+	components map[string]any
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+func (sg *schemaGen) schemaFor(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	// types with custom encodings don't follow their Go structure
+	if t.Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(jsonMarshalerType) {
+		return map[string]any{}
+	}
+	if t.Implements(textMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType) {
+		return map[string]any{"type": "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": sg.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": sg.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return sg.structSchema(t)
+		}
+		name := componentName(t)
+		if _, ok := sg.components[name]; !ok {
+			// placeholder guards against recursive types
+			sg.components[name] = map[string]any{}
+			sg.components[name] = sg.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	default:
+		return map[string]any{}
+	}
+}
+
+func (sg *schemaGen) structSchema(t reflect.Type) map[string]any {
+	props := make(map[string]any)
+	var required []string
+	sg.addFields(t, props, &required)
+
+	out := map[string]any{
+		"type":       "object",
+		"properties": props,
+	}
+	if len(required) > 0 {
+		sort.Strings(required)
+		out["required"] = required
+	}
+	return out
+}
+
+// addFields follows encoding/json's rules for field names and embedding
+func (sg *schemaGen) addFields(t reflect.Type, props map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			for ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				sg.addFields(ft, props, required)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		props[name] = sg.schemaFor(f.Type)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// componentName qualifies type names with their package, since eg. both
+// models and bgs define a User
+func componentName(t reflect.Type) string {
+	pkg := t.PkgPath()
+	if i := strings.LastIndex(pkg, "/"); i >= 0 {
+		pkg = pkg[i+1:]
+	}
+	if pkg == "" {
+		return t.Name()
+	}
+	return pkg + "." + t.Name()
+}
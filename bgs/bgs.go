@@ -2,23 +2,27 @@ package bgs
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
-	_ "net/http/pprof"
 	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"contrib.go.opencensus.io/exporter/prometheus"
 	"github.com/bluesky-social/indigo/api"
 	atproto "github.com/bluesky-social/indigo/api/atproto"
 	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/lexicon"
 	"github.com/bluesky-social/indigo/carstore"
 	"github.com/bluesky-social/indigo/did"
 	"github.com/bluesky-social/indigo/events"
@@ -26,11 +30,13 @@ import (
 	lexutil "github.com/bluesky-social/indigo/lex/util"
 	"github.com/bluesky-social/indigo/models"
 	"github.com/bluesky-social/indigo/repomgr"
+	"github.com/bluesky-social/indigo/util"
 	"github.com/bluesky-social/indigo/xrpc"
 	"golang.org/x/sync/semaphore"
 	"golang.org/x/time/rate"
 
 	"github.com/gorilla/websocket"
+	"github.com/hashicorp/golang-lru/v2/expirable"
 	"github.com/ipfs/go-cid"
 	ipld "github.com/ipfs/go-ipld-format"
 	logging "github.com/ipfs/go-log"
@@ -39,6 +45,7 @@ import (
 	promclient "github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	dto "github.com/prometheus/client_model/go"
+	"github.com/quic-go/quic-go/http3"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"gorm.io/gorm"
@@ -64,10 +71,24 @@ type BGS struct {
 
 	hr api.HandleResolver
 
+	// how the relay identifies itself to hosts; may be nil
+	identity *RelayIdentity
+
+	// for checking on hosts asking to be crawled; doesn't retry
+	hostClient    *http.Client
+	outboundProxy util.ProxyFunc
+	pdsTLSConfig  *tls.Config
+
 	// TODO: work on doing away with this flag in favor of more pluggable
 	// pieces that abstract the need for explicit ssl checks
 	ssl bool
 
+	// for serving the API over TLS without a reverse proxy
+	tlsConfig *tls.Config
+
+	serviceAuth *serviceAuthVerifier
+	subAuth     *SubscriberAuth
+
 	crawlOnly bool
 
 	// TODO: at some point we will want to lock specific DIDs, this lock as is
@@ -77,16 +98,102 @@ type BGS struct {
 	repoman *repomgr.RepoManager
 
 	// Management of Socket Consumers
+	// experimental HTTP/3 event stream listener, and the Alt-Svc header
+	// advertising it
+	h3srv    *http3.Server
+	h3AltSvc string
+
+	// the API server, once started
+	srvLk sync.Mutex
+	srv   *http.Server
+
 	consumersLk    sync.RWMutex
 	nextConsumerID uint64
 	consumers      map[uint64]*SocketConsumer
 
+	// tickets for opening connections that replay a range of events
+	replayTicketsLk sync.Mutex
+	replayTickets   map[string]replayTicket
+
 	// Management of Resyncs
 	pdsResyncsLk sync.RWMutex
 	pdsResyncs   map[uint]*PDSResync
 
 	// Management of Compaction
 	compactor *Compactor
+
+	// nil unless blob proxying is enabled
+	blobs *blobProxy
+
+	handleVerifier *HandleVerifier
+
+	storage *StorageTracker
+
+	// memory budget for serving sync reads
+	reads *ReadBudget
+
+	// compresses sync responses for clients that accept it
+	compression *SyncCompressor
+
+	// nil unless APIRateLimit is set
+	rateLimit *APIRateLimiter
+
+	adminLog *AdminAuditLog
+
+	// nil unless an admission policy is configured
+	admission *admissionHook
+
+	// checks events from PDSs before they're processed
+	ingest *IngestPipeline
+	// the pipeline's rev stage, which needs to forget reset repos
+	revCheck *revStage
+	dedup    *dedupStage
+	scoring  *scoringStage
+	// rev ordering violations per host, for the admin report
+	revStats *revOrderStats
+
+	// repos recently reset, so a burst of stale events only resets once
+	recentResets *expirable.LRU[string, struct{}]
+
+	tiers *TierManager
+
+	// applied to hosts found by spidering
+	spidering *spideringPolicy
+
+	growth *GrowthMonitor
+
+	hostStats *HostStatsHistory
+
+	publicStats *PublicStats
+	deactivated *DeactivationSweeper
+	scrubber    *Scrubber
+
+	// new collections seen, and which ones are held back from the firehose
+	collRegistry *CollectionRegistry
+
+	policy *DefederationPolicy
+
+	// nil unless redaction rules are configured
+	redactor *Redactor
+
+	alerts *Alerter
+
+	gossip *Gossiper
+
+	// which repos have records in each collection
+	collections *CollectionIndex
+	// nil unless BlobRefIndex is set
+	blobRefs *BlobRefIndex
+
+	// serve the sampled firehose for load testing consumers
+	sampleFirehose bool
+	// serve the firehose in Jetstream's format
+	jetstream bool
+	// serve repos' event history without authentication
+	publicRepoHistory bool
+
+	// nil unless fault injection is enabled
+	faults *FaultInjector
 }
 
 type PDSResync struct {
@@ -104,23 +211,177 @@ type SocketConsumer struct {
 	RemoteAddr  string
 	ConnectedAt time.Time
 	EventsSent  promclient.Counter
+	// "websocket" or "http3"
+	Transport string
+	// negotiated event stream frame format
+	StreamVersion int
+	BytesSent     atomic.Int64
+	// who the subscriber authenticated as, if subscriber auth is on
+	Identity string
+
+	// past events replayed to the consumer alongside the live stream; nil
+	// if its transport doesn't take replays
+	replayCh chan *events.XRPCStreamEvent
+	// the events the consumer subscribed to, applied to replays too
+	filter func(*events.XRPCStreamEvent) bool
+	// closed once the consumer disconnects
+	gone     chan struct{}
+	replayLk sync.Mutex
+	replay   *ConsumerReplay
 }
 
 type BGSConfig struct {
 	SSL               bool
 	CompactInterval   time.Duration
-	DefaultRepoLimit  int64
 	ConcurrencyPerPDS int64
 	MaxQueuePerPDS    int64
+
+	// If set, com.atproto.sync.getBlob is served by proxying to the account's PDS
+	BlobProxy bool
+	// Directory for the proxy's blob cache; caching is disabled if empty
+	BlobCacheDir      string
+	BlobCacheMaxBytes int64
+	// Largest blob the proxy will serve, zero for no limit
+	BlobMaxSize int64
+
+	// Interval between handle re-verification passes, zero disables them
+	HandleReverifyInterval time.Duration
+	// Maximum handle resolutions per second during re-verification
+	HandleReverifyRate float64
+
+	// If set, consulted before admitting new hosts and repos
+	Admission        AdmissionPolicy
+	AdmissionOptions *AdmissionOptions
+
+	// Which hosts found by spidering are admitted; defaults if nil
+	Spidering *SpideringOptions
+
+	// If set, the API and metrics listeners terminate TLS themselves
+	TLSConfig *tls.Config
+
+	// If set, admin routes also accept service-auth JWTs from these accounts
+	ServiceAuth *ServiceAuthConfig
+
+	// If set, firehose subscribers must authenticate; open to all if nil
+	SubscriberAuth *SubscriberAuthOptions
+
+	// Storage quota given to newly added hosts, zero for no limit
+	DefaultStorageQuota int64
+
+	// Repo limits for each tier of host, and when hosts are promoted; defaults
+	// if nil
+	RepoLimitTiers *RepoLimitTiersOptions
+
+	// Which checks events from PDSs go through; defaults if nil
+	Ingest *IngestOptions
+
+	// When to alert on hosts' repo counts growing quickly; defaults if nil
+	Growth *GrowthMonitorOptions
+
+	// Keeping a history of each host's event and error rates; off if nil
+	HostStats *HostStatsOptions
+
+	// Serving aggregate stats at /xrpc/_relay/stats without authentication;
+	// off if nil
+	PublicStats *PublicStatsOptions
+
+	// Moving the repos of accounts deactivated for a long time to the
+	// carstore trash; kept until reactivation if nil
+	Deactivation *DeactivationOptions
+
+	// Checking carstore shards for corruption in the background; off if nil
+	Scrub *ScrubOptions
+
+	// If set, faults can be injected through /admin/faults to rehearse
+	// failure handling in staging. Not for production.
+	FaultInjection bool
+
+	// If set, /xrpc/_relay/getRepoHistory serves repos' latest events
+	// without authentication, as /admin/repo/history does for admins. Both
+	// need a persister that indexes events by repo.
+	PublicRepoHistory bool
+
+	// Keeping a registry of the collections records are seen in, and
+	// optionally holding back commits in ones not yet approved; off if nil
+	CollectionRegistry *CollectionRegistryOptions
+
+	// Rules for automatically pausing or blocking misbehaving hosts; none
+	// if nil
+	Policy *DefederationPolicyOptions
+
+	// Alerting operators on operational problems; off if nil
+	Alerting *AlertingOptions
+
+	// Exchanging known hosts with other relays; off if nil
+	Gossip *GossipOptions
+
+	// Memory budget for serving getRepo and getBlocks; defaults if nil
+	ReadBudget *ReadBudgetOptions
+
+	// Compressing getRepo, getBlocks and getRecord responses; defaults if nil
+	SyncCompression *SyncCompressionOptions
+
+	// If set, /xrpc/_dev/sampleFirehose serves a sample of the firehose
+	SampleFirehose bool
+
+	// If set, /subscribe serves the firehose in Jetstream's JSON format
+	Jetstream bool
+
+	// Number of (collection, repo) pairs the collection index remembers
+	// having stored, to avoid rewriting them
+	CollectionIndexCacheSize int
+
+	// Per-client API rate limits; nil disables rate limiting, leaving it to
+	// a proxy in front of the relay
+	APIRateLimit *APIRateLimitOptions
+
+	// Where admin actions are recorded besides the database; defaults if nil
+	AdminAuditLog *AdminAuditLogOptions
+
+	// If set, the blobs referenced by records are indexed by repo and
+	// collection, for /admin/blobs/refs
+	BlobRefIndex bool
+
+	// The relay's public hostname and operator contact, sent to the hosts it
+	// crawls and served at /.well-known/atproto-relay; if nil, the relay
+	// identifies itself only by its software version
+	Identity *RelayIdentity
+
+	// If set, connections to PDSs go through this proxy. PDS requests made
+	// by the indexer are proxied by its ApplyPDSClientSettings.
+	OutboundProxy util.ProxyFunc
+
+	// Time source for the slurper and compactor, for deterministic tests;
+	// the system clock if nil. Event persisters take theirs in their own
+	// options.
+	Clock util.Clock
+
+	// TLS requirements for connections to PDSs, such as a minimum version or
+	// pinned keys; defaults if nil. PDS requests made by the indexer get
+	// them from its ApplyPDSClientSettings.
+	PDSTLSConfig *tls.Config
+
+	// Run on every event before it is sequenced and sent out, in order, to
+	// annotate, redact or drop it
+	EventMiddleware []events.EventMiddleware
+
+	// Fields removed from records before they're sent out or served by
+	// getRecord; none if nil
+	Redaction *RedactionOptions
 }
 
 func DefaultBGSConfig() *BGSConfig {
 	return &BGSConfig{
 		SSL:               true,
 		CompactInterval:   4 * time.Hour,
-		DefaultRepoLimit:  100,
 		ConcurrencyPerPDS: 100,
 		MaxQueuePerPDS:    1_000,
+		BlobCacheMaxBytes: 10 << 30,
+		BlobMaxSize:       100 << 20,
+
+		HandleReverifyRate: 10,
+
+		CollectionIndexCacheSize: 1_000_000,
 	}
 }
 
@@ -133,6 +394,15 @@ func NewBGS(db *gorm.DB, ix *indexer.Indexer, repoman *repomgr.RepoManager, evtm
 	db.AutoMigrate(AuthToken{})
 	db.AutoMigrate(models.PDS{})
 	db.AutoMigrate(models.DomainBan{})
+	db.AutoMigrate(FirehoseConsumer{})
+
+	var faults *FaultInjector
+	if config.FaultInjection {
+		log.Warnw("fault injection is enabled; faults set through /admin/faults will disrupt the relay")
+		faults = NewFaultInjector()
+		hr = &faultyHandleResolver{HandleResolver: hr, faults: faults}
+		evtman.Use(faults.delayPersist)
+	}
 
 	bgs := &BGS{
 		Index:       ix,
@@ -141,22 +411,195 @@ func NewBGS(db *gorm.DB, ix *indexer.Indexer, repoman *repomgr.RepoManager, evtm
 
 		hr:      hr,
 		repoman: repoman,
-		events:  evtman,
-		didr:    didr,
-		ssl:     config.SSL,
+		faults:  faults,
+
+		identity:      config.Identity,
+		hostClient:    util.ProxiedHTTPClientWithTLS(config.OutboundProxy, config.PDSTLSConfig),
+		outboundProxy: config.OutboundProxy,
+		pdsTLSConfig:  config.PDSTLSConfig,
+
+		events: evtman,
+		didr:   didr,
+		ssl:    config.SSL,
+
+		tlsConfig:      config.TLSConfig,
+		sampleFirehose: config.SampleFirehose,
+		jetstream:      config.Jetstream,
+
+		publicRepoHistory: config.PublicRepoHistory,
 
 		consumersLk: sync.RWMutex{},
 		consumers:   make(map[uint64]*SocketConsumer),
 
 		pdsResyncs: make(map[uint]*PDSResync),
+
+		replayTickets: make(map[string]replayTicket),
+
+		recentResets: expirable.NewLRU[string, struct{}](10_000, nil, repoResetCooldown),
+	}
+
+	evtman.Use(config.EventMiddleware...)
+
+	if config.Redaction != nil {
+		redactor, err := NewRedactor(config.Redaction)
+		if err != nil {
+			return nil, err
+		}
+		bgs.redactor = redactor
+		evtman.Use(redactor.middleware)
+	}
+
+	if config.ServiceAuth != nil {
+		v, err := newServiceAuthVerifier(config.ServiceAuth)
+		if err != nil {
+			return nil, err
+		}
+		bgs.serviceAuth = v
+	}
+
+	if config.SubscriberAuth != nil {
+		sa, err := NewSubscriberAuth(config.SubscriberAuth)
+		if err != nil {
+			return nil, err
+		}
+		bgs.subAuth = sa
+	}
+
+	tiers, err := NewTierManager(config.RepoLimitTiers)
+	if err != nil {
+		return nil, err
+	}
+	bgs.tiers = tiers
+
+	spidering, err := newSpideringPolicy(config.Spidering, config.Clock)
+	if err != nil {
+		return nil, err
+	}
+	bgs.spidering = spidering
+
+	growth, err := NewGrowthMonitor(config.Growth)
+	if err != nil {
+		return nil, err
+	}
+	bgs.growth = growth
+
+	hostStats, err := NewHostStatsHistory(config.HostStats)
+	if err != nil {
+		return nil, err
+	}
+	bgs.hostStats = hostStats
+
+	publicStats, err := NewPublicStats(config.PublicStats)
+	if err != nil {
+		return nil, err
+	}
+	bgs.publicStats = publicStats
+
+	deactivated, err := NewDeactivationSweeper(config.Deactivation)
+	if err != nil {
+		return nil, err
+	}
+	bgs.deactivated = deactivated
+
+	scrubber, err := NewScrubber(config.Scrub)
+	if err != nil {
+		return nil, err
+	}
+	bgs.scrubber = scrubber
+
+	var catalog lexicon.Catalog
+	if config.Ingest != nil {
+		catalog = config.Ingest.LexiconCatalog
+	}
+	collRegistry, err := NewCollectionRegistry(config.CollectionRegistry, catalog)
+	if err != nil {
+		return nil, err
+	}
+	bgs.collRegistry = collRegistry
+	if collRegistry.quarantining() {
+		evtman.Use(collRegistry.middleware)
+	}
+
+	compression, err := NewSyncCompressor(config.SyncCompression)
+	if err != nil {
+		return nil, err
+	}
+	bgs.compression = compression
+
+	policy, err := NewDefederationPolicy(config.Policy)
+	if err != nil {
+		return nil, err
+	}
+	bgs.policy = policy
+
+	alerts, err := NewAlerter(config.Alerting)
+	if err != nil {
+		return nil, err
+	}
+	bgs.alerts = alerts
+
+	gossip, err := NewGossiper(config.Gossip, config.OutboundProxy)
+	if err != nil {
+		return nil, err
+	}
+	gossip.identity = config.Identity
+	bgs.gossip = gossip
+
+	collections, err := NewCollectionIndex(db, config.CollectionIndexCacheSize)
+	if err != nil {
+		return nil, fmt.Errorf("setting up collection index: %w", err)
 	}
+	collections.writes = ix.GroupCommitter()
+	bgs.collections = collections
 
-	ix.CreateExternalUser = bgs.createExternalUser
+	if config.BlobRefIndex {
+		blobRefs, err := NewBlobRefIndex(db, repoman)
+		if err != nil {
+			return nil, fmt.Errorf("setting up blob reference index: %w", err)
+		}
+		blobRefs.writes = ix.GroupCommitter()
+		bgs.blobRefs = blobRefs
+	}
+
+	if config.APIRateLimit != nil {
+		rl, err := NewAPIRateLimiter(config.APIRateLimit, config.Clock)
+		if err != nil {
+			return nil, fmt.Errorf("setting up API rate limits: %w", err)
+		}
+		bgs.rateLimit = rl
+	}
+
+	adminLog, err := NewAdminAuditLog(db, config.AdminAuditLog, config.Clock)
+	if err != nil {
+		return nil, fmt.Errorf("setting up admin audit log: %w", err)
+	}
+	bgs.adminLog = adminLog
+
+	// accounts the indexer finds referenced in records are spidered
+	ix.CreateExternalUser = bgs.createSpideredUser
+	// repo fetches and other requests to PDSs identify the relay, on top of
+	// whatever settings the indexer was given
+	ix.ApplyPDSClientSettings = bgs.identifyPDSClients(ix.ApplyPDSClientSettings)
+	rf.ApplyPDSClientSettings = bgs.identifyPDSClients(rf.ApplyPDSClientSettings)
+	ix.ObserveRepoEvent = collections.ObserveRepoEvent
+	if bgs.blobRefs != nil {
+		ix.ObserveRepoEvent = func(ctx context.Context, evt *repomgr.RepoEvent) {
+			collections.ObserveRepoEvent(ctx, evt)
+			bgs.blobRefs.ObserveRepoEvent(ctx, evt)
+		}
+	}
 	slOpts := DefaultSlurperOptions()
 	slOpts.SSL = config.SSL
-	slOpts.DefaultRepoLimit = config.DefaultRepoLimit
+	slOpts.DefaultRepoLimit, _ = tiers.Limit(TierNew)
+	slOpts.TrustedRepoLimit, _ = tiers.Limit(TierTrusted)
 	slOpts.ConcurrencyPerPDS = config.ConcurrencyPerPDS
 	slOpts.MaxQueuePerPDS = config.MaxQueuePerPDS
+	slOpts.DefaultStorageQuota = config.DefaultStorageQuota
+	slOpts.Proxy = config.OutboundProxy
+	slOpts.TLSConfig = config.PDSTLSConfig
+	slOpts.Clock = config.Clock
+	slOpts.Headers = config.Identity.Headers()
+	slOpts.Faults = faults
 	s, err := NewSlurper(db, bgs.handleFedEvent, slOpts)
 	if err != nil {
 		return nil, err
@@ -164,21 +607,77 @@ func NewBGS(db *gorm.DB, ix *indexer.Indexer, repoman *repomgr.RepoManager, evtm
 
 	bgs.slurper = s
 
+	if config.Admission != nil {
+		bgs.admission = newAdmissionHook(config.Admission, config.AdmissionOptions)
+	}
+
+	if err := bgs.setupIngestPipeline(config.Ingest, config.Clock); err != nil {
+		return nil, fmt.Errorf("setting up ingest pipeline: %w", err)
+	}
+
+	if config.BlobProxy {
+		bp, err := newBlobProxy(config)
+		if err != nil {
+			return nil, err
+		}
+		bgs.blobs = bp
+	}
+
 	if err := bgs.slurper.RestartAll(); err != nil {
 		return nil, err
 	}
 
-	compactor := NewCompactor(nil)
-	compactor.requeueInterval = config.CompactInterval
+	cOpts := DefaultCompactorOptions()
+	cOpts.RequeueInterval = config.CompactInterval
+	cOpts.Clock = config.Clock
+	compactor := NewCompactor(cOpts)
 	compactor.Start(bgs)
 	bgs.compactor = compactor
 
+	hvOpts := DefaultHandleVerifierOptions()
+	hvOpts.Interval = config.HandleReverifyInterval
+	hvOpts.RateLimit = config.HandleReverifyRate
+	bgs.handleVerifier = NewHandleVerifier(hvOpts)
+	bgs.handleVerifier.Start(bgs)
+
+	bgs.storage = NewStorageTracker(nil)
+	repoman.CarStore().SetStorageObserver(bgs.storage.Observe)
+	bgs.storage.Start(bgs)
+
+	bgs.reads = NewReadBudget(config.ReadBudget)
+
+	bgs.tiers.Start(bgs)
+	bgs.growth.Start(bgs)
+	bgs.hostStats.Start(bgs)
+	bgs.publicStats.Start(bgs)
+	bgs.deactivated.Start(bgs)
+	bgs.scrubber.Start(bgs)
+	bgs.collRegistry.Start(bgs)
+	bgs.policy.Start(bgs)
+	bgs.alerts.Start(bgs)
+	bgs.gossip.Start(bgs)
+
 	return bgs, nil
 }
 
 func (bgs *BGS) StartMetrics(listen string) error {
-	http.Handle("/metrics", promhttp.Handler())
-	return http.ListenAndServe(listen, nil)
+	li, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	return bgs.StartMetricsWithListener(li)
+}
+
+// StartMetricsWithListener serves prometheus metrics. Profiling is available
+// from the admin API instead, see debug.go.
+func (bgs *BGS) StartMetricsWithListener(li net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Handler: mux, TLSConfig: bgs.tlsConfig}
+	if bgs.tlsConfig != nil {
+		return srv.ServeTLS(li, "", "")
+	}
+	return srv.Serve(li)
 }
 
 // Disabled for now, maybe reimplement behind admin auth later
@@ -287,13 +786,16 @@ func (bgs *BGS) StartWithListener(listen net.Listener) error {
 	e.HideBanner = true
 
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: []string{"*"},
-		AllowHeaders: []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization},
+		AllowOrigins:  []string{"*"},
+		AllowHeaders:  []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization},
+		ExposeHeaders: []string{RequestIDHeader},
 	}))
 
+	e.Use(RequestIDMiddleware)
+
 	if !bgs.ssl {
 		e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
-			Format: "method=${method}, uri=${uri}, status=${status} latency=${latency_human}\n",
+			Format: "id=${id} method=${method}, uri=${uri}, status=${status} latency=${latency_human}\n",
 		}))
 	} else {
 		e.Use(middleware.LoggerWithConfig(middleware.DefaultLoggerConfig))
@@ -307,22 +809,45 @@ func (bgs *BGS) StartWithListener(listen net.Listener) error {
 
 	e.Use(MetricsMiddleware)
 
+	adminMiddleware := []echo.MiddlewareFunc{bgs.checkAdminAuth}
+	if bgs.rateLimit != nil {
+		e.Use(bgs.rateLimit.Middleware)
+		adminMiddleware = append(adminMiddleware, bgs.rateLimit.AdminMiddleware)
+	}
+	adminMiddleware = append(adminMiddleware, bgs.adminLog.Middleware)
+
 	e.HTTPErrorHandler = func(err error, ctx echo.Context) {
+		log := ctxLog(ctx.Request().Context())
+		if ctx.Response().Committed {
+			log.Warnf("HANDLER ERROR: (%s) %s", ctx.Path(), err)
+			return
+		}
+
+		xrpcPath := strings.HasPrefix(ctx.Request().URL.Path, "/xrpc/")
+
+		var apiErr *APIError
 		switch err := err.(type) {
+		case *APIError:
+			apiErr = err
 		case *echo.HTTPError:
-			if err2 := ctx.JSON(err.Code, map[string]any{
-				"error": err.Message,
-			}); err2 != nil {
-				log.Errorf("Failed to write http error: %s", err2)
+			if !xrpcPath {
+				if err2 := ctx.JSON(err.Code, map[string]any{
+					"error": err.Message,
+				}); err2 != nil {
+					log.Errorf("Failed to write http error: %s", err2)
+				}
+				return
 			}
+			apiErr = &APIError{Status: err.Code, Name: xrpcErrorName(err.Code), Message: fmt.Sprint(err.Message)}
 		default:
-			sendHeader := true
-			if ctx.Path() == "/xrpc/com.atproto.sync.subscribeRepos" {
-				sendHeader = false
-			}
-
 			log.Warnf("HANDLER ERROR: (%s) %s", ctx.Path(), err)
 
+			// event streams fail like this once they've taken over the
+			// connection, and there's no response left to write
+			if ctx.Path() == "/xrpc/com.atproto.sync.subscribeRepos" || ctx.Path() == sampleFirehosePath || ctx.Path() == jetstreamPath || ctx.Path() == replayStreamPath {
+				return
+			}
+
 			if strings.HasPrefix(ctx.Path(), "/admin/") {
 				ctx.JSON(500, map[string]any{
 					"error": err.Error(),
@@ -330,9 +855,15 @@ func (bgs *BGS) StartWithListener(listen net.Listener) error {
 				return
 			}
 
-			if sendHeader {
-				ctx.Response().WriteHeader(500)
-			}
+			// don't leak internal errors to the public
+			apiErr = &APIError{Status: http.StatusInternalServerError, Name: XRPCErrInternal, Message: "internal error"}
+		}
+
+		if apiErr.RetryAfter > 0 {
+			ctx.Response().Header().Set("Retry-After", retryAfterSeconds(apiErr.RetryAfter))
+		}
+		if err2 := ctx.JSON(apiErr.Status, XRPCError{Error: apiErr.Name, Message: apiErr.Message}); err2 != nil {
+			log.Errorf("Failed to write http error: %s", err2)
 		}
 	}
 
@@ -345,16 +876,38 @@ func (bgs *BGS) StartWithListener(listen net.Listener) error {
 	e.GET("/xrpc/com.atproto.sync.requestCrawl", bgs.HandleComAtprotoSyncRequestCrawl)
 	e.POST("/xrpc/com.atproto.sync.requestCrawl", bgs.HandleComAtprotoSyncRequestCrawl)
 	e.GET("/xrpc/com.atproto.sync.listRepos", bgs.HandleComAtprotoSyncListRepos)
+	e.GET("/xrpc/com.atproto.sync.listReposByCollection", bgs.HandleComAtprotoSyncListReposByCollection)
+	if bgs.sampleFirehose {
+		e.GET(sampleFirehosePath, bgs.handleSampleFirehose)
+	}
+	if bgs.jetstream {
+		e.GET(jetstreamPath, bgs.handleJetstreamSubscribe)
+	}
+	e.GET(replayStreamPath, bgs.handleReplayStream)
+	if bgs.gossip.opts.Serve {
+		e.GET(gossipHostsPath, bgs.handleGossipHosts)
+	}
 	e.GET("/xrpc/com.atproto.sync.getLatestCommit", bgs.HandleComAtprotoSyncGetLatestCommit)
 	e.GET("/xrpc/com.atproto.sync.notifyOfUpdate", bgs.HandleComAtprotoSyncNotifyOfUpdate)
+	if bgs.blobs != nil {
+		e.GET("/xrpc/com.atproto.sync.getBlob", bgs.HandleComAtprotoSyncGetBlob)
+	}
 	e.GET("/xrpc/_health", bgs.HandleHealthCheck)
 	e.GET("/_health", bgs.HandleHealthCheck)
 	e.GET("/", bgs.HandleHomeMessage)
+	e.GET(relayDescriptionPath, bgs.handleRelayDescription)
+	if bgs.publicStats.enabled() {
+		e.GET(publicStatsPath, bgs.handlePublicStats)
+	}
+	if bgs.publicRepoHistory {
+		e.GET(publicRepoHistoryPath, bgs.handleGetRepoHistory)
+	}
 
-	admin := e.Group("/admin", bgs.checkAdminAuth)
+	admin := e.Group("/admin", adminMiddleware...)
 
 	// Slurper-related Admin API
 	admin.GET("/subs/getUpstreamConns", bgs.handleAdminGetUpstreamConns)
+	admin.GET("/subs/health", bgs.handleAdminGetUpstreamHealth)
 	admin.GET("/subs/getEnabled", bgs.handleAdminGetSubsEnabled)
 	admin.GET("/subs/perDayLimit", bgs.handleAdminGetNewPDSPerDayRateLimit)
 	admin.POST("/subs/setEnabled", bgs.handleAdminSetSubsEnabled)
@@ -372,10 +925,17 @@ func (bgs *BGS) StartWithListener(listen net.Listener) error {
 	admin.POST("/repo/compact", bgs.handleAdminCompactRepo)
 	admin.POST("/repo/compactAll", bgs.handleAdminCompactAllRepos)
 	admin.POST("/repo/reset", bgs.handleAdminResetRepo)
+	admin.GET("/repo/trash", bgs.handleAdminListRepoTrash)
+	admin.GET("/repo/history", bgs.handleAdminGetRepoHistory)
+	admin.POST("/repo/restore", bgs.handleAdminRestoreRepo)
+	admin.POST("/repo/import", bgs.handleAdminImportRepo)
 	admin.POST("/repo/verify", bgs.handleAdminVerifyRepo)
+	admin.POST("/repo/reverifyHandle", bgs.handleAdminReverifyHandle)
+	admin.POST("/repo/reverifyAllHandles", bgs.handleAdminReverifyAllHandles)
 
 	// PDS-related Admin API
 	admin.POST("/pds/requestCrawl", bgs.handleAdminRequestCrawl)
+	admin.POST("/pds/import", bgs.handleAdminImportHosts)
 	admin.GET("/pds/list", bgs.handleListPDSs)
 	admin.POST("/pds/resync", bgs.handleAdminPostResyncPDS)
 	admin.GET("/pds/resync", bgs.handleAdminGetResyncPDS)
@@ -383,28 +943,96 @@ func (bgs *BGS) StartWithListener(listen net.Listener) error {
 	admin.POST("/pds/block", bgs.handleBlockPDS)
 	admin.POST("/pds/unblock", bgs.handleUnblockPDS)
 	admin.POST("/pds/addTrustedDomain", bgs.handleAdminAddTrustedDomain)
+	admin.POST("/pds/setStorageQuota", bgs.handleAdminSetPDSStorageQuota)
+	admin.POST("/pds/recountStorage", bgs.handleAdminRecountPDSStorage)
+	admin.POST("/pds/setTier", bgs.handleAdminSetPDSTier)
+	admin.GET("/pds/growth", bgs.handleAdminGetPDSGrowth)
+	admin.GET("/pds/statsHistory", bgs.handleAdminGetPDSStatsHistory)
+
+	// Repo limit tiers
+	admin.GET("/tiers", bgs.handleAdminListTiers)
+	admin.POST("/tiers/promote", bgs.handleAdminRunTierPromotions)
+
+	// Defederation policy
+	admin.GET("/policy", bgs.handleAdminGetPolicy)
+	admin.POST("/policy/override", bgs.handleAdminPolicyOverride)
+
+	// Fault injection, for staging
+	if bgs.faults != nil {
+		admin.GET("/faults", bgs.handleAdminGetFaults)
+		admin.POST("/faults", bgs.handleAdminSetFaults)
+		admin.POST("/faults/clear", bgs.handleAdminClearFaults)
+	}
+
+	// Relay gossip
+	admin.GET("/gossip/peers", bgs.handleAdminGetGossipPeers)
+	admin.POST("/gossip/run", bgs.handleAdminRunGossip)
+
+	// Storage usage
+	admin.GET("/storage/repo", bgs.handleAdminGetRepoStorage)
+	admin.GET("/storage/repos", bgs.handleAdminListRepoStorage)
+	admin.GET("/storage/pds", bgs.handleAdminListPDSStorage)
+	admin.GET("/storage/scrub", bgs.handleAdminGetScrubReport)
+
+	// Blob references
+	admin.GET("/blobs/refs", bgs.handleAdminListBlobRefs)
+
+	// Crawl scheduling
+	admin.GET("/crawl/priorities", bgs.handleAdminGetCrawlPriorities)
+	admin.POST("/crawl/setPriority", bgs.handleAdminSetCrawlPriority)
+	admin.POST("/crawl/setWeights", bgs.handleAdminSetCrawlWeights)
+	admin.GET("/crawl/hostBudgets", bgs.handleAdminGetCrawlHostBudgets)
+	admin.POST("/crawl/setHostWeight", bgs.handleAdminSetCrawlHostWeight)
+	admin.GET("/crawl/fetchFailures", bgs.handleAdminListFetchFailures)
+	admin.POST("/crawl/retryFetch", bgs.handleAdminRetryFetch)
+	admin.POST("/repo/audit", bgs.handleAdminAuditRepo)
+	admin.GET("/repo/audits", bgs.handleAdminListRepoAudits)
+	admin.POST("/pds/audit", bgs.handleAdminAuditPDS)
+
+	// Ingest pipeline
+	admin.GET("/ingest/stages", bgs.handleAdminListIngestStages)
+	admin.POST("/ingest/setStage", bgs.handleAdminSetIngestStage)
+	admin.GET("/ingest/revReport", bgs.handleAdminRevReport)
+	if bgs.scoring != nil {
+		admin.GET("/ingest/flagged", bgs.handleAdminListFlaggedCommits)
+	}
+
+	// Collection registry
+	admin.GET("/collections/registry", bgs.handleAdminListCollectionRegistry)
+	admin.POST("/collections/approve", bgs.handleAdminApproveCollection)
+	admin.POST("/collections/reject", bgs.handleAdminRejectCollection)
 
 	// Consumer-related Admin API
 	admin.GET("/consumers/list", bgs.handleAdminListConsumers)
+	admin.GET("/consumers/history", bgs.handleAdminListConsumerHistory)
+	admin.POST("/consumers/replay", bgs.handleAdminReplayEvents)
+
+	// Admin audit log
+	admin.GET("/actions", bgs.handleAdminListActions)
+
+	// Profiling
+	admin.GET("/debug/pprof/profile", bgs.handleAdminCPUProfile)
+	admin.GET("/debug/pprof/trace", bgs.handleAdminTrace)
+	admin.GET("/debug/pprof/:profile", bgs.handleAdminProfile)
+
+	// OpenAPI description of everything registered above
+	admin.GET("/openapi.json", bgs.handleAdminGetAPIDescription)
 
 	// In order to support booting on random ports in tests, we need to tell the
 	// Echo instance it's already got a port, and then use its StartServer
 	// method to re-use that listener.
+	if bgs.tlsConfig != nil {
+		listen = tls.NewListener(listen, bgs.tlsConfig)
+	}
 	e.Listener = listen
 	srv := &http.Server{}
-	return e.StartServer(srv)
-}
-
-func (bgs *BGS) Shutdown() []error {
-	errs := bgs.slurper.Shutdown()
-
-	if err := bgs.events.Shutdown(context.TODO()); err != nil {
-		errs = append(errs, err)
+	bgs.srvLk.Lock()
+	bgs.srv = srv
+	bgs.srvLk.Unlock()
+	if err := e.StartServer(srv); !errors.Is(err, http.ErrServerClosed) {
+		return err
 	}
-
-	bgs.compactor.Shutdown()
-
-	return errs
+	return nil
 }
 
 type HealthStatus struct {
@@ -471,6 +1099,10 @@ func (bgs *BGS) CreateAdminToken(tok string) error {
 	}).Error
 }
 
+// adminIdentityKey is the echo context key checkAdminAuth stores who made an
+// admin request under: the service-auth DID, or a hash of the admin token
+const adminIdentityKey = "bgs.adminIdentity"
+
 func (bgs *BGS) checkAdminAuth(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(e echo.Context) error {
 		ctx, span := tracer.Start(e.Request().Context(), "checkAdminAuth")
@@ -486,6 +1118,17 @@ func (bgs *BGS) checkAdminAuth(next echo.HandlerFunc) echo.HandlerFunc {
 
 		token := authheader[len(pref):]
 
+		if bgs.serviceAuth != nil && looksLikeJWT(token) {
+			did, err := bgs.serviceAuth.Verify(ctx, token)
+			if err != nil {
+				log.Warnw("rejected admin service auth token", "err", err, "path", e.Path())
+				return echo.ErrForbidden
+			}
+			log.Infow("admin request with service auth", "did", did, "method", e.Request().Method, "path", e.Path())
+			e.Set(adminIdentityKey, did.String())
+			return next(e)
+		}
+
 		exists, err := bgs.lookupAdminToken(token)
 		if err != nil {
 			return err
@@ -495,6 +1138,8 @@ func (bgs *BGS) checkAdminAuth(next echo.HandlerFunc) echo.HandlerFunc {
 			return echo.ErrForbidden
 		}
 
+		sum := sha256.Sum256([]byte(token))
+		e.Set(adminIdentityKey, "token:"+hex.EncodeToString(sum[:8]))
 		return next(e)
 	}
 }
@@ -517,29 +1162,40 @@ type User struct {
 
 	// UpstreamStatus is the state of the user as reported by the upstream PDS
 	UpstreamStatus string `gorm:"index"`
+	// DeactivatedAt is when the upstream PDS reported the user deactivated,
+	// nil unless they still are
+	DeactivatedAt *time.Time
+	// DataTrashed is set once a deactivated user's repo has been moved to
+	// the carstore trash, to be brought back if they're reactivated
+	DataTrashed bool
 }
 
 type addTargetBody struct {
 	Host string `json:"host"`
 }
 
-func (bgs *BGS) registerConsumer(c *SocketConsumer) uint64 {
+func (bgs *BGS) registerConsumer(c *SocketConsumer, since *int64) uint64 {
 	bgs.consumersLk.Lock()
-	defer bgs.consumersLk.Unlock()
-
 	id := bgs.nextConsumerID
 	bgs.nextConsumerID++
 
+	c.gone = make(chan struct{})
 	bgs.consumers[id] = c
+	streamVersionConsumers.WithLabelValues(strconv.Itoa(c.StreamVersion)).Inc()
+	bgs.consumersLk.Unlock()
 
+	bgs.recordConsumerConnect(c, since)
+	bgs.alerts.observeSubscriber()
 	return id
 }
 
 func (bgs *BGS) cleanupConsumer(id uint64) {
 	bgs.consumersLk.Lock()
-	defer bgs.consumersLk.Unlock()
-
 	c := bgs.consumers[id]
+	streamVersionConsumers.WithLabelValues(strconv.Itoa(c.StreamVersion)).Dec()
+	delete(bgs.consumers, id)
+	bgs.consumersLk.Unlock()
+	close(c.gone)
 
 	var m = &dto.Metric{}
 	if err := c.EventsSent.Write(m); err != nil {
@@ -550,25 +1206,91 @@ func (bgs *BGS) cleanupConsumer(id uint64) {
 		"consumer_id", id,
 		"remote_addr", c.RemoteAddr,
 		"user_agent", c.UserAgent,
-		"events_sent", m.Counter.GetValue())
+		"identity", c.Identity,
+		"events_sent", m.Counter.GetValue(),
+		"bytes_sent", c.BytesSent.Load())
 
-	delete(bgs.consumers, id)
+	bgs.recordConsumerDisconnect(c, int64(m.Counter.GetValue()))
 }
 
-func (bgs *BGS) EventsHandler(c echo.Context) error {
-	var since *int64
-	if sinceVal := c.QueryParam("cursor"); sinceVal != "" {
-		sval, err := strconv.ParseInt(sinceVal, 10, 64)
-		if err != nil {
-			return err
+// parseSubscribeCursor parses and validates the cursor params of a
+// subscribeRepos request: either a cursor, or a cursorTime to start from,
+// given as an RFC 3339 timestamp or a duration ago like "2h". Empty params
+// mean no cursor.
+func (bgs *BGS) parseSubscribeCursor(ctx context.Context, param, timeParam string) (*int64, error) {
+	if timeParam != "" {
+		if param != "" {
+			return nil, &events.CursorError{Name: events.CursorErrInvalid, Message: "cursor and cursorTime can't both be set"}
 		}
-		since = &sval
+		return bgs.cursorForTime(ctx, timeParam)
+	}
+	if param == "" {
+		return nil, nil
 	}
+	cur, err := events.ParseCursor(param)
+	if err == nil {
+		err = bgs.events.ValidateCursor(cur)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cur.Seq, nil
+}
+
+func (bgs *BGS) cursorForTime(ctx context.Context, param string) (*int64, error) {
+	t, err := time.Parse(time.RFC3339, param)
+	if err != nil {
+		ago, derr := time.ParseDuration(param)
+		if derr != nil || ago < 0 {
+			return nil, &events.CursorError{Name: events.CursorErrInvalid, Message: fmt.Sprintf("invalid cursorTime: %q", param)}
+		}
+		t = time.Now().Add(-ago)
+	}
+
+	seq, err := bgs.events.SeqForTime(ctx, t)
+	if err != nil {
+		return nil, fmt.Errorf("looking up cursor for time: %w", err)
+	}
+	return &seq, nil
+}
 
+func (bgs *BGS) EventsHandler(c echo.Context) error {
+	return bgs.serveEventStream(c, "websocket", func(evt *events.XRPCStreamEvent) bool { return true })
+}
+
+// serveEventStream upgrades a request to a websocket and streams it the
+// events that pass filter
+func (bgs *BGS) serveEventStream(c echo.Context, transport string, filter func(*events.XRPCStreamEvent) bool) error {
+	version, err := events.NegotiateStreamVersion(c.QueryParam(events.StreamVersionParam))
+	if err != nil {
+		streamVersionRejected.Inc()
+		return apiError(http.StatusBadRequest, XRPCErrInvalidRequest, "%s", err)
+	}
+	excluded, err := parseExcludeTypes(c.QueryParams()[excludeTypesParam])
+	if err != nil {
+		return apiError(http.StatusBadRequest, XRPCErrInvalidRequest, "%s", err)
+	}
+	filter = excludeTypesFilter(excluded, filter)
+	fw := events.NewFrameWriter(version)
 	ctx, cancel := context.WithCancel(c.Request().Context())
 	defer cancel()
 
-	// TODO: authhhh
+	since, cursorErr := bgs.parseSubscribeCursor(ctx, c.QueryParam("cursor"), c.QueryParam("cursorTime"))
+
+	if ce := bgs.events.CursorEpochs(); ce != nil {
+		c.Response().Header().Set(events.CursorEpochHeader, events.FormatCursorEpoch(ce.Current()))
+	}
+	if bgs.h3AltSvc != "" {
+		c.Response().Header().Set("Alt-Svc", bgs.h3AltSvc)
+	}
+	c.Response().Header().Set(events.StreamVersionHeader, strconv.Itoa(version))
+
+	identity, release, err := bgs.admitSubscriber(ctx, c.Request())
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	conn, err := websocket.Upgrade(c.Response(), c.Request(), c.Response().Header(), 10<<10, 10<<10)
 	if err != nil {
 		return fmt.Errorf("upgrading websocket: %w", err)
@@ -576,6 +1298,24 @@ func (bgs *BGS) EventsHandler(c echo.Context) error {
 
 	defer conn.Close()
 
+	// cursor problems are reported over the stream, as the spec has consumers
+	// expect an error frame rather than an HTTP status
+	if cursorErr != nil {
+		var ce *events.CursorError
+		if !errors.As(cursorErr, &ce) {
+			return cursorErr
+		}
+		wc, err := conn.NextWriter(websocket.BinaryMessage)
+		if err != nil {
+			return err
+		}
+		evt := &events.XRPCStreamEvent{Error: &events.ErrorFrame{Error: ce.Name, Message: ce.Message}}
+		if err := fw.WriteFrame(wc, evt); err != nil {
+			return err
+		}
+		return wc.Close()
+	}
+
 	lastWriteLk := sync.Mutex{}
 	lastWrite := time.Now()
 
@@ -598,7 +1338,7 @@ func (bgs *BGS) EventsHandler(c echo.Context) error {
 				}
 
 				if err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(5*time.Second)); err != nil {
-					log.Warnf("failed to ping client: %s", err)
+					ctxLog(ctx).Warnf("failed to ping client: %s", err)
 					cancel()
 					return
 				}
@@ -623,7 +1363,7 @@ func (bgs *BGS) EventsHandler(c echo.Context) error {
 		for {
 			_, _, err := conn.ReadMessage()
 			if err != nil {
-				log.Warnf("failed to read message from client: %s", err)
+				ctxLog(ctx).Warnf("failed to read message from client: %s", err)
 				cancel()
 				return
 			}
@@ -632,67 +1372,80 @@ func (bgs *BGS) EventsHandler(c echo.Context) error {
 
 	ident := c.RealIP() + "-" + c.Request().UserAgent()
 
-	evts, cleanup, err := bgs.events.Subscribe(ctx, ident, func(evt *events.XRPCStreamEvent) bool { return true }, since)
+	evts, cleanup, err := bgs.events.Subscribe(ctx, ident, filter, since)
 	if err != nil {
 		return err
 	}
 	defer cleanup()
 
 	// Keep track of the consumer for metrics and admin endpoints
-	consumer := SocketConsumer{
-		RemoteAddr:  c.RealIP(),
-		UserAgent:   c.Request().UserAgent(),
-		ConnectedAt: time.Now(),
+	consumer := &SocketConsumer{
+		RemoteAddr:    c.RealIP(),
+		UserAgent:     c.Request().UserAgent(),
+		ConnectedAt:   time.Now(),
+		Transport:     transport,
+		StreamVersion: version,
+		Identity:      identity,
+		replayCh:      make(chan *events.XRPCStreamEvent),
+		filter:        filter,
 	}
 	sentCounter := eventsSentCounter.WithLabelValues(consumer.RemoteAddr, consumer.UserAgent)
 	consumer.EventsSent = sentCounter
+	versionSentCounter := streamVersionEventsSent.WithLabelValues(strconv.Itoa(version))
+	var identitySentCounter promclient.Counter
+	if identity != "" {
+		identitySentCounter = subscriberEventsSent.WithLabelValues(identity)
+	}
 
-	consumerID := bgs.registerConsumer(&consumer)
+	consumerID := bgs.registerConsumer(consumer, since)
 	defer bgs.cleanupConsumer(consumerID)
 
-	logger := log.With(
+	logger := ctxLog(ctx).With(
 		"consumer_id", consumerID,
 		"remote_addr", consumer.RemoteAddr,
 		"user_agent", consumer.UserAgent,
+		"identity", consumer.Identity,
 	)
 
-	logger.Infow("new consumer", "cursor", since)
+	logger.Infow("new consumer", "cursor", since, "stream_version", version)
 
 	for {
+		var evt *events.XRPCStreamEvent
 		select {
-		case evt, ok := <-evts:
+		case e, ok := <-evts:
 			if !ok {
 				logger.Error("event stream closed unexpectedly")
 				return nil
 			}
+			evt = e
+		case evt = <-consumer.replayCh:
+		case <-ctx.Done():
+			return nil
+		}
 
-			wc, err := conn.NextWriter(websocket.BinaryMessage)
-			if err != nil {
-				logger.Errorf("failed to get next writer: %s", err)
-				return err
-			}
-
-			if evt.Preserialized != nil {
-				_, err = wc.Write(evt.Preserialized)
-			} else {
-				err = evt.Serialize(wc)
-			}
-			if err != nil {
-				return fmt.Errorf("failed to write event: %w", err)
-			}
+		wc, err := conn.NextWriter(websocket.BinaryMessage)
+		if err != nil {
+			logger.Errorf("failed to get next writer: %s", err)
+			return err
+		}
 
-			if err := wc.Close(); err != nil {
-				logger.Warnf("failed to flush-close our event write: %s", err)
-				return nil
-			}
+		if err := fw.WriteFrame(countingWriter{w: wc, n: &consumer.BytesSent}, evt); err != nil {
+			return fmt.Errorf("failed to write event: %w", err)
+		}
 
-			lastWriteLk.Lock()
-			lastWrite = time.Now()
-			lastWriteLk.Unlock()
-			sentCounter.Inc()
-		case <-ctx.Done():
+		if err := wc.Close(); err != nil {
+			logger.Warnf("failed to flush-close our event write: %s", err)
 			return nil
 		}
+
+		lastWriteLk.Lock()
+		lastWrite = time.Now()
+		lastWriteLk.Unlock()
+		sentCounter.Inc()
+		versionSentCounter.Inc()
+		if identitySentCounter != nil {
+			identitySentCounter.Inc()
+		}
 	}
 }
 
@@ -803,7 +1556,7 @@ func stringLink(lnk *lexutil.LexLink) string {
 	return lnk.String()
 }
 
-func (bgs *BGS) handleFedEvent(ctx context.Context, host *models.PDS, env *events.XRPCStreamEvent) error {
+func (bgs *BGS) handleFedEvent(ctx context.Context, host *models.PDS, env *events.XRPCStreamEvent) (rerr error) {
 	ctx, span := tracer.Start(ctx, "handleFedEvent")
 	defer span.End()
 
@@ -814,6 +1567,44 @@ func (bgs *BGS) handleFedEvent(ctx context.Context, host *models.PDS, env *event
 
 	eventsReceivedCounter.WithLabelValues(host.Host).Add(1)
 
+	ievt := &IngestEvent{Host: host, Event: env}
+	err := bgs.ingest.Check(ctx, ievt)
+	bgs.revStats.observe(host, ievt, err)
+	if err != nil {
+		bgs.policy.observe(host.ID, err)
+		bgs.hostStats.observe(host.ID, err)
+		var dup *ErrDuplicateEvent
+		if errors.As(err, &dup) {
+			log.Debugw("dropping duplicate event", "kind", dup.Kind, "pdsHost", host.Host, "repo", dup.Repo, "rev", dup.Rev, "firstHost", dup.FirstHost)
+			return nil
+		}
+		if env.RepoCommit != nil {
+			log.Warnw("dropping commit from PDS", "pdsHost", host.Host, "repo", env.RepoCommit.Repo, "rev", env.RepoCommit.Rev, "err", err)
+		} else {
+			log.Warnw("dropping event from PDS", "pdsHost", host.Host, "err", err)
+		}
+		var reset *ErrRepoReset
+		if errors.As(err, &reset) {
+			return bgs.handleRepoReset(ctx, host, reset.Repo, "rev_regressed")
+		}
+		bgs.tiers.RecordIncident(ctx, bgs.db, host.ID, "ingest_rejected")
+		return nil
+	}
+	bgs.collRegistry.observe(ctx, ievt)
+
+	// if we fail to handle a commit, let a retry or a copy from another
+	// source through, rather than reject it as a duplicate
+	defer func() {
+		bgs.policy.observe(host.ID, rerr)
+		bgs.hostStats.observe(host.ID, rerr)
+		if rerr != nil {
+			bgs.dedup.Forget(ievt)
+			if env.RepoCommit != nil {
+				bgs.revCheck.Forget(env.RepoCommit.Repo)
+			}
+		}
+	}()
+
 	switch {
 	case env.RepoCommit != nil:
 		repoCommitsReceivedCounter.WithLabelValues(host.Host).Add(1)
@@ -855,7 +1646,8 @@ func (bgs *BGS) handleFedEvent(ctx context.Context, host *models.PDS, env *event
 		}
 
 		if evt.Rebase {
-			return fmt.Errorf("rebase was true in event seq:%d,host:%s", evt.Seq, host.Host)
+			rebasesCounter.WithLabelValues(host.Host).Add(1)
+			return bgs.handleRepoReset(ctx, host, evt.Repo, "rebase")
 		}
 
 		if host.ID != u.PDS && u.PDS != 0 {
@@ -1099,7 +1891,7 @@ func (bgs *BGS) handleRepoTombstone(ctx context.Context, pds *models.PDS, evt *a
 	}
 
 	// delete data from carstore
-	if err := bgs.repoman.TakeDownRepo(ctx, u.ID); err != nil {
+	if err := bgs.repoman.DeleteRepo(ctx, u.ID); err != nil {
 		// don't let a failure here prevent us from propagating this event
 		log.Errorf("failed to delete user data from carstore: %s", err)
 	}
@@ -1111,6 +1903,16 @@ func (bgs *BGS) handleRepoTombstone(ctx context.Context, pds *models.PDS, evt *a
 
 // TODO: rename? This also updates users, and 'external' is an old phrasing
 func (s *BGS) createExternalUser(ctx context.Context, did string) (*models.ActorInfo, error) {
+	return s.createUser(ctx, did, false)
+}
+
+// createSpideredUser creates an account found by spidering. If it's on a host
+// the relay hasn't seen before, the host has to pass the spidering policy.
+func (s *BGS) createSpideredUser(ctx context.Context, did string) (*models.ActorInfo, error) {
+	return s.createUser(ctx, did, true)
+}
+
+func (s *BGS) createUser(ctx context.Context, did string, spidered bool) (*models.ActorInfo, error) {
 	ctx, span := tracer.Start(ctx, "createExternalUser")
 	defer span.End()
 
@@ -1152,31 +1954,55 @@ func (s *BGS) createExternalUser(ctx context.Context, did string) (*models.Actor
 		return nil, fmt.Errorf("cannot create user on pds with banned domain")
 	}
 
+	if peering.ID == 0 {
+		if spidered {
+			if err := s.spidering.discover(durl.Host); err != nil {
+				return nil, err
+			}
+		}
+		if err := s.checkAdmission(ctx, &AdmissionRequest{Kind: AdmissionKindHost, Host: durl.Host}); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.checkAdmission(ctx, &AdmissionRequest{Kind: AdmissionKindRepo, Host: durl.Host, Did: did}); err != nil {
+		return nil, err
+	}
+
 	c := &xrpc.Client{Host: durl.String()}
 	s.Index.ApplyPDSClientSettings(c)
 
 	if peering.ID == 0 {
+		peering.SSL = (durl.Scheme == "https")
+		if s.ssl && !peering.SSL {
+			return nil, fmt.Errorf("did references non-ssl PDS, this is disallowed in prod: %q %q", did, svc.ServiceEndpoint)
+		}
+
 		// TODO: the case of handling a new user on a new PDS probably requires more thought
 		cfg, err := atproto.ServerDescribeServer(ctx, c)
-		if err != nil {
-			// TODO: failing this shouldn't halt our indexing
+		if spidered {
+			if err := s.spidering.admit(durl.Host, cfg, err); err != nil {
+				return nil, err
+			}
+			if err != nil {
+				log.Warnw("admitting spidered host that didn't answer describeServer", "host", durl.Host, "err", err)
+			}
+		} else if err != nil {
 			return nil, fmt.Errorf("failed to check unrecognized pds: %w", err)
 		}
 
-		// since handles can be anything, checking against this list doesn't matter...
-		_ = cfg
-
 		// TODO: could check other things, a valid response is good enough for now
 		peering.Host = durl.Host
-		peering.SSL = (durl.Scheme == "https")
 		peering.CrawlRateLimit = float64(s.slurper.DefaultCrawlLimit)
 		peering.RateLimit = float64(s.slurper.DefaultPerSecondLimit)
 		peering.HourlyEventLimit = s.slurper.DefaultPerHourLimit
 		peering.DailyEventLimit = s.slurper.DefaultPerDayLimit
-		peering.RepoLimit = s.slurper.DefaultRepoLimit
+		peering.Tier, peering.RepoLimit = s.slurper.NewHostTier(durl.Host)
 
-		if s.ssl && !peering.SSL {
-			return nil, fmt.Errorf("did references non-ssl PDS, this is disallowed in prod: %q %q", did, svc.ServiceEndpoint)
+		if until := s.spidering.autoTrustUntil(); spidered && until != nil && peering.Tier == TierNew {
+			peering.Tier = TierTrusted
+			peering.RepoLimit, _ = s.tiers.Limit(TierTrusted)
+			peering.AutoTrustedUntil = until
 		}
 
 		if err := s.db.Create(&peering).Error; err != nil {
@@ -1363,11 +2189,28 @@ func (bgs *BGS) UpdateAccountStatus(ctx context.Context, did string, status stri
 	switch status {
 	case events.AccountStatusActive:
 		// Unset the PDS-specific status flags
-		if err := bgs.db.Model(User{}).Where("id = ?", u.ID).Update("upstream_status", events.AccountStatusActive).Error; err != nil {
+		if err := bgs.db.Model(User{}).Where("id = ?", u.ID).UpdateColumns(map[string]any{
+			"upstream_status": events.AccountStatusActive,
+			"deactivated_at":  nil,
+			"data_trashed":    false,
+		}).Error; err != nil {
 			return fmt.Errorf("failed to set user active status: %w", err)
 		}
+
+		// the repo is served again as soon as the status is cleared, so
+		// bring back data trashed while it was deactivated
+		if u.DataTrashed {
+			if err := bgs.reactivateRepo(ctx, u); err != nil {
+				log.Errorw("failed to bring back reactivated repo", "did", did, "err", err)
+			}
+		}
 	case events.AccountStatusDeactivated:
-		if err := bgs.db.Model(User{}).Where("id = ?", u.ID).Update("upstream_status", events.AccountStatusDeactivated).Error; err != nil {
+		// keep the time of the first report, so repeated events don't
+		// postpone the retention
+		if err := bgs.db.Model(User{}).Where("id = ?", u.ID).UpdateColumns(map[string]any{
+			"upstream_status": events.AccountStatusDeactivated,
+			"deactivated_at":  gorm.Expr("COALESCE(deactivated_at, ?)", time.Now()),
+		}).Error; err != nil {
 			return fmt.Errorf("failed to set user deactivation status: %w", err)
 		}
 	case events.AccountStatusSuspended:
@@ -1400,7 +2243,7 @@ func (bgs *BGS) UpdateAccountStatus(ctx context.Context, did string, status stri
 		}
 
 		// delete data from carstore
-		if err := bgs.repoman.TakeDownRepo(ctx, u.ID); err != nil {
+		if err := bgs.repoman.DeleteRepo(ctx, u.ID); err != nil {
 			// don't let a failure here prevent us from propagating this event
 			log.Errorf("failed to delete user data from carstore: %s", err)
 		}
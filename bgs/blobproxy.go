@@ -0,0 +1,508 @@
+package bgs
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+	mh "github.com/multiformats/go-multihash"
+	"go.opentelemetry.io/otel"
+)
+
+// blobProxy serves com.atproto.sync.getBlob by fetching blobs from the PDS
+// hosting the account, so that downstream services only need to talk to the
+// relay. Fetched blobs are optionally kept in a size-bounded on-disk LRU.
+type blobProxy struct {
+	client   *http.Client
+	maxSize  int64
+	identity *RelayIdentity
+
+	// nil if caching is disabled
+	cache *blobCache
+}
+
+func newBlobProxy(config *BGSConfig) (*blobProxy, error) {
+	client := util.RobustHTTPClientWithProxy(config.OutboundProxy)
+	client.Timeout = 2 * time.Minute
+
+	bp := &blobProxy{
+		client:   client,
+		maxSize:  config.BlobMaxSize,
+		identity: config.Identity,
+	}
+
+	if config.BlobCacheDir != "" && config.BlobCacheMaxBytes > 0 {
+		bc, err := newBlobCache(config.BlobCacheDir, config.BlobCacheMaxBytes)
+		if err != nil {
+			return nil, fmt.Errorf("setting up blob cache: %w", err)
+		}
+		bp.cache = bc
+	}
+
+	return bp, nil
+}
+
+func (s *BGS) HandleComAtprotoSyncGetBlob(c echo.Context) error {
+	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleComAtprotoSyncGetBlob")
+	defer span.End()
+
+	did := c.QueryParam("did")
+	cidStr := c.QueryParam("cid")
+
+	if _, err := syntax.ParseDID(did); err != nil {
+		return c.JSON(http.StatusBadRequest, XRPCError{Error: XRPCErrInvalidRequest, Message: fmt.Sprintf("invalid did: %s", did)})
+	}
+
+	bcid, err := cid.Decode(cidStr)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, XRPCError{Error: XRPCErrInvalidRequest, Message: fmt.Sprintf("invalid cid: %s", cidStr)})
+	}
+
+	if _, err := s.lookupRepo(ctx, did); err != nil {
+		return err
+	}
+
+	// blobs are user content served from the relay's origin, don't let
+	// browsers interpret them as anything active
+	c.Response().Header().Set("X-Content-Type-Options", "nosniff")
+	c.Response().Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+
+	return s.blobs.serve(c, did, bcid, func(ctx context.Context) (string, error) {
+		return s.pdsEndpointForDid(ctx, did)
+	})
+}
+
+var (
+	errBlobTooLarge = errors.New("blob exceeds maximum proxied size")
+	errBlobMismatch = errors.New("blob does not match its CID")
+)
+
+// serve responds with the blob, from the cache or else fetched from the PDS
+// pds returns. Fetched blobs are checked against their CID before any of
+// them is served or cached.
+func (bp *blobProxy) serve(c echo.Context, did string, bcid cid.Cid, pds func(context.Context) (string, error)) error {
+	ctx := c.Request().Context()
+	key := blobCacheKey(did, bcid)
+
+	if bp.cache != nil {
+		if rc, ctype, ok := bp.cache.open(key); ok {
+			defer rc.Close()
+			blobProxyRequests.WithLabelValues("hit").Inc()
+			return c.Stream(http.StatusOK, ctype, rc)
+		}
+	}
+
+	endpoint, err := pds(ctx)
+	if err != nil {
+		blobProxyRequests.WithLabelValues("error").Inc()
+		log.Warnw("failed to resolve pds for blob fetch", "err", err, "did", did)
+		return apiError(http.StatusBadGateway, XRPCErrUpstreamFailure, "failed to resolve account PDS")
+	}
+
+	resp, err := bp.fetch(ctx, endpoint, did, bcid)
+	if err != nil {
+		blobProxyRequests.WithLabelValues("error").Inc()
+		log.Warnw("failed to fetch blob from pds", "err", err, "did", did, "cid", bcid, "pds", endpoint)
+		return apiError(http.StatusBadGateway, XRPCErrUpstreamFailure, "failed to fetch blob from PDS")
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusNotFound:
+		blobProxyRequests.WithLabelValues("not_found").Inc()
+		return apiError(http.StatusNotFound, XRPCErrBlobNotFound, "blob not found")
+	default:
+		blobProxyRequests.WithLabelValues("error").Inc()
+		return apiError(http.StatusBadGateway, XRPCErrUpstreamFailure, "PDS returned status %d", resp.StatusCode)
+	}
+
+	if bp.maxSize > 0 && resp.ContentLength > bp.maxSize {
+		blobProxyRequests.WithLabelValues("too_large").Inc()
+		return apiError(http.StatusBadGateway, XRPCErrUpstreamFailure, "blob exceeds maximum proxied size")
+	}
+
+	ctype := resp.Header.Get("Content-Type")
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+
+	// the blob is downloaded in full before any of it is served, into the
+	// cache's file for it if caching, so it can be checked first
+	var w *blobCacheWriter
+	if bp.cache != nil {
+		if w, err = bp.cache.create(key, ctype); err != nil {
+			log.Warnw("failed to create blob cache entry", "err", err, "key", key)
+			w = nil
+		}
+	}
+	var fi *os.File
+	var start int64
+	if w != nil {
+		fi, start = w.fi, w.start
+		defer func() {
+			if w != nil {
+				w.abort()
+			}
+		}()
+	} else {
+		if fi, err = os.CreateTemp("", "relay-blob-*"+blobCacheTmpSuffix); err != nil {
+			blobProxyRequests.WithLabelValues("error").Inc()
+			return fmt.Errorf("creating blob download file: %w", err)
+		}
+		defer func() {
+			fi.Close()
+			_ = os.Remove(fi.Name())
+		}()
+	}
+
+	n, err := bp.download(fi, resp.Body, bcid)
+	switch {
+	case errors.Is(err, errBlobTooLarge):
+		blobProxyRequests.WithLabelValues("too_large").Inc()
+		return apiError(http.StatusBadGateway, XRPCErrUpstreamFailure, "blob exceeds maximum proxied size")
+	case errors.Is(err, errBlobMismatch):
+		blobProxyRequests.WithLabelValues("mismatch").Inc()
+		log.Warnw("blob from pds does not match its cid", "did", did, "cid", bcid, "pds", endpoint)
+		return apiError(http.StatusBadGateway, XRPCErrUpstreamFailure, "blob from PDS does not match its CID")
+	case err != nil:
+		blobProxyRequests.WithLabelValues("error").Inc()
+		log.Warnw("failed to download blob from pds", "err", err, "did", did, "cid", bcid, "pds", endpoint)
+		return apiError(http.StatusBadGateway, XRPCErrUpstreamFailure, "failed to fetch blob from PDS")
+	}
+
+	blobProxyRequests.WithLabelValues("miss").Inc()
+
+	if _, err := fi.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderContentLength, strconv.FormatInt(n, 10))
+	if err := c.Stream(http.StatusOK, ctype, io.LimitReader(fi, n)); err != nil {
+		return err
+	}
+
+	if w != nil {
+		w.n = n
+		err := w.commit()
+		w = nil
+		if err != nil {
+			log.Warnw("failed to commit blob cache entry", "err", err, "key", key)
+		}
+	}
+	return nil
+}
+
+// download copies the blob body into fi, returning its size, or
+// errBlobTooLarge or errBlobMismatch if it's over the size limit or doesn't
+// hash to c
+func (bp *blobProxy) download(fi *os.File, body io.Reader, c cid.Cid) (int64, error) {
+	dmh, err := mh.Decode(c.Hash())
+	if err != nil {
+		return 0, err
+	}
+	h, err := mh.GetHasher(dmh.Code)
+	if err != nil {
+		return 0, err
+	}
+
+	if bp.maxSize > 0 {
+		// read one byte past the limit, to tell a blob of exactly maxSize
+		// from a larger one
+		body = io.LimitReader(body, bp.maxSize+1)
+	}
+	n, err := io.Copy(io.MultiWriter(fi, h), body)
+	if err != nil {
+		return 0, err
+	}
+	if bp.maxSize > 0 && n > bp.maxSize {
+		return 0, errBlobTooLarge
+	}
+
+	sum := h.Sum(nil)
+	if len(sum) < dmh.Length || !bytes.Equal(sum[:dmh.Length], dmh.Digest) {
+		return 0, errBlobMismatch
+	}
+	return n, nil
+}
+
+func (bp *blobProxy) fetch(ctx context.Context, endpoint, did string, c cid.Cid) (*http.Response, error) {
+	q := url.Values{}
+	q.Set("did", did)
+	q.Set("cid", c.String())
+
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint+"/xrpc/com.atproto.sync.getBlob?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	bp.identity.setHeaders(req)
+
+	return bp.client.Do(req)
+}
+
+// pdsEndpointForDid returns the #atproto_pds service endpoint from the
+// account's DID document
+func (s *BGS) pdsEndpointForDid(ctx context.Context, did string) (string, error) {
+	doc, err := s.didr.GetDocument(ctx, did)
+	if err != nil {
+		return "", fmt.Errorf("could not locate DID document (%s): %w", did, err)
+	}
+
+	for _, svc := range doc.Service {
+		if svc.ID.String() == "#atproto_pds" && svc.Type == "AtprotoPersonalDataServer" {
+			u, err := url.Parse(svc.ServiceEndpoint)
+			if err != nil {
+				return "", fmt.Errorf("invalid pds endpoint %q: %w", svc.ServiceEndpoint, err)
+			}
+			if u.Scheme != "https" && !(u.Scheme == "http" && !s.ssl) {
+				return "", fmt.Errorf("refusing to fetch from pds endpoint %q", svc.ServiceEndpoint)
+			}
+			return strings.TrimSuffix(svc.ServiceEndpoint, "/"), nil
+		}
+	}
+
+	return "", fmt.Errorf("DID document for %s has no pds service", did)
+}
+
+func blobCacheKey(did string, c cid.Cid) string {
+	return strings.ReplaceAll(did, ":", "_") + "_" + c.String()
+}
+
+// blobCache is an on-disk LRU of blobs, bounded by total size. Each file
+// holds the content type on its first line followed by the blob bytes.
+type blobCache struct {
+	dir      string
+	maxBytes int64
+
+	lk      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	// front is most recently used
+	order *list.List
+}
+
+type blobCacheEntry struct {
+	key  string
+	size int64
+}
+
+const blobCacheTmpSuffix = ".tmp"
+
+func newBlobCache(dir string, maxBytes int64) (*blobCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	bc := &blobCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+
+	// pick up whatever was cached before a restart, treating the most
+	// recently written files as the most recently used
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type existing struct {
+		name  string
+		size  int64
+		mtime time.Time
+	}
+	var found []existing
+	for _, de := range des {
+		if de.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(de.Name(), blobCacheTmpSuffix) {
+			_ = os.Remove(filepath.Join(dir, de.Name()))
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		found = append(found, existing{name: de.Name(), size: info.Size(), mtime: info.ModTime()})
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].mtime.After(found[j].mtime)
+	})
+
+	for _, f := range found {
+		bc.entries[f.name] = bc.order.PushBack(&blobCacheEntry{key: f.name, size: f.size})
+		bc.size += f.size
+	}
+
+	bc.lk.Lock()
+	bc.evict()
+	bc.lk.Unlock()
+
+	return bc, nil
+}
+
+func (bc *blobCache) path(key string) string {
+	return filepath.Join(bc.dir, key)
+}
+
+type blobCacheReader struct {
+	*bufio.Reader
+	fi *os.File
+}
+
+func (r *blobCacheReader) Close() error {
+	return r.fi.Close()
+}
+
+// open returns a reader for the cached blob and its content type
+func (bc *blobCache) open(key string) (io.ReadCloser, string, bool) {
+	bc.lk.Lock()
+	elem, ok := bc.entries[key]
+	if ok {
+		bc.order.MoveToFront(elem)
+	}
+	bc.lk.Unlock()
+
+	if !ok {
+		return nil, "", false
+	}
+
+	fi, err := os.Open(bc.path(key))
+	if err != nil {
+		bc.remove(key)
+		return nil, "", false
+	}
+
+	br := bufio.NewReader(fi)
+	ctype, err := br.ReadString('\n')
+	if err != nil {
+		fi.Close()
+		bc.remove(key)
+		return nil, "", false
+	}
+
+	return &blobCacheReader{Reader: br, fi: fi}, strings.TrimSuffix(ctype, "\n"), true
+}
+
+func (bc *blobCache) remove(key string) {
+	bc.lk.Lock()
+	defer bc.lk.Unlock()
+
+	elem, ok := bc.entries[key]
+	if !ok {
+		return
+	}
+	bc.removeElem(elem)
+}
+
+// must be called with lk held
+func (bc *blobCache) removeElem(elem *list.Element) {
+	ent := elem.Value.(*blobCacheEntry)
+	bc.order.Remove(elem)
+	delete(bc.entries, ent.key)
+	bc.size -= ent.size
+
+	if err := os.Remove(bc.path(ent.key)); err != nil && !os.IsNotExist(err) {
+		log.Warnw("failed to remove evicted blob", "err", err, "key", ent.key)
+	}
+}
+
+// must be called with lk held
+func (bc *blobCache) evict() {
+	for bc.size > bc.maxBytes && bc.order.Len() > 0 {
+		bc.removeElem(bc.order.Back())
+	}
+	blobCacheBytes.Set(float64(bc.size))
+}
+
+type blobCacheWriter struct {
+	bc  *blobCache
+	key string
+	fi  *os.File
+	// offset of the blob in fi, after the content type
+	start int64
+	// size of the blob written
+	n int64
+}
+
+func (bc *blobCache) create(key, ctype string) (*blobCacheWriter, error) {
+	fi, err := os.CreateTemp(bc.dir, key+"-*"+blobCacheTmpSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	hn, err := fi.WriteString(ctype + "\n")
+	if err != nil {
+		fi.Close()
+		_ = os.Remove(fi.Name())
+		return nil, err
+	}
+
+	return &blobCacheWriter{bc: bc, key: key, fi: fi, start: int64(hn)}, nil
+}
+
+func (w *blobCacheWriter) abort() {
+	w.fi.Close()
+	_ = os.Remove(w.fi.Name())
+}
+
+// commit moves the cache file into place and adds it to the LRU
+func (w *blobCacheWriter) commit() error {
+	// don't bother with blobs that would immediately push everything else out
+	if w.n > w.bc.maxBytes/4 {
+		w.abort()
+		return nil
+	}
+
+	if err := w.fi.Close(); err != nil {
+		_ = os.Remove(w.fi.Name())
+		return err
+	}
+
+	bc := w.bc
+	if err := os.Rename(w.fi.Name(), bc.path(w.key)); err != nil {
+		_ = os.Remove(w.fi.Name())
+		return err
+	}
+
+	info, err := os.Stat(bc.path(w.key))
+	if err != nil {
+		return err
+	}
+
+	bc.lk.Lock()
+	defer bc.lk.Unlock()
+
+	if elem, ok := bc.entries[w.key]; ok {
+		// raced with another request for the same blob, file was replaced
+		ent := elem.Value.(*blobCacheEntry)
+		bc.size += info.Size() - ent.size
+		ent.size = info.Size()
+		bc.order.MoveToFront(elem)
+	} else {
+		bc.entries[w.key] = bc.order.PushFront(&blobCacheEntry{key: w.key, size: info.Size()})
+		bc.size += info.Size()
+	}
+
+	bc.evict()
+	return nil
+}
@@ -0,0 +1,261 @@
+package bgs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+	mh "github.com/multiformats/go-multihash"
+)
+
+func blobCid(t *testing.T, b []byte) cid.Cid {
+	h, err := mh.Sum(b, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cid.NewCidV1(cid.Raw, h)
+}
+
+// blobPDS serves blobs by CID, counting the requests it gets. With chunked
+// set it leaves out Content-Length.
+func blobPDS(blobs map[string][]byte, chunked bool, hits *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(hits, 1)
+		b, ok := blobs[r.URL.Query().Get("cid")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		if chunked {
+			w.(http.Flusher).Flush()
+		}
+		w.Write(b)
+	}))
+}
+
+func serveBlob(bp *blobProxy, endpoint string, c cid.Cid) (*httptest.ResponseRecorder, error) {
+	rec := httptest.NewRecorder()
+	ectx := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.sync.getBlob", nil), rec)
+	err := bp.serve(ectx, "did:plc:alice", c, func(context.Context) (string, error) {
+		return endpoint, nil
+	})
+	return rec, err
+}
+
+func isBadGateway(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Status == http.StatusBadGateway
+}
+
+func TestBlobProxy(t *testing.T) {
+	const maxSize = 64
+
+	good := bytes.Repeat([]byte("a"), 10)
+	exact := bytes.Repeat([]byte("b"), maxSize)
+	large := bytes.Repeat([]byte("c"), maxSize+1)
+	swapped := blobCid(t, []byte("something else"))
+	missing := blobCid(t, []byte("missing"))
+
+	blobs := map[string][]byte{
+		blobCid(t, good).String():  good,
+		blobCid(t, exact).String(): exact,
+		blobCid(t, large).String(): large,
+		swapped.String():           good,
+	}
+
+	for _, chunked := range []bool{false, true} {
+		var hits int64
+		pds := blobPDS(blobs, chunked, &hits)
+
+		bc, err := newBlobCache(t.TempDir(), 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bp := &blobProxy{client: http.DefaultClient, maxSize: maxSize, cache: bc}
+
+		for _, b := range [][]byte{good, exact} {
+			rec, err := serveBlob(bp, pds.URL, blobCid(t, b))
+			if err != nil {
+				t.Fatalf("chunked %v: %v", chunked, err)
+			}
+			if !bytes.Equal(rec.Body.Bytes(), b) || rec.Header().Get("Content-Type") != "image/png" {
+				t.Fatalf("chunked %v: unexpected response %q %v", chunked, rec.Body.String(), rec.Header())
+			}
+		}
+
+		// both were cached, and are served without going back to the PDS
+		before := atomic.LoadInt64(&hits)
+		for _, b := range [][]byte{good, exact} {
+			rec, err := serveBlob(bp, pds.URL, blobCid(t, b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rec.Body.Bytes(), b) || rec.Header().Get("Content-Type") != "image/png" {
+				t.Fatalf("chunked %v: unexpected cached response %q %v", chunked, rec.Body.String(), rec.Header())
+			}
+		}
+		if atomic.LoadInt64(&hits) != before {
+			t.Fatalf("chunked %v: expected cache hits", chunked)
+		}
+
+		// one byte over the limit is rejected, whether or not the PDS said
+		// how long it was
+		if _, err := serveBlob(bp, pds.URL, blobCid(t, large)); !isBadGateway(err) {
+			t.Fatalf("chunked %v: expected oversize blob rejected, got %v", chunked, err)
+		}
+
+		// as are bytes that aren't the blob asked for
+		if _, err := serveBlob(bp, pds.URL, swapped); !isBadGateway(err) {
+			t.Fatalf("chunked %v: expected mismatched blob rejected, got %v", chunked, err)
+		}
+
+		var apiErr *APIError
+		if _, err := serveBlob(bp, pds.URL, missing); !errors.As(err, &apiErr) || apiErr.Name != XRPCErrBlobNotFound {
+			t.Fatalf("chunked %v: expected blob not found, got %v", chunked, err)
+		}
+
+		// nothing rejected made it into the cache, or was left behind
+		before = atomic.LoadInt64(&hits)
+		if _, err := serveBlob(bp, pds.URL, swapped); !isBadGateway(err) {
+			t.Fatalf("chunked %v: expected mismatched blob rejected again, got %v", chunked, err)
+		}
+		if atomic.LoadInt64(&hits) == before {
+			t.Fatalf("chunked %v: expected rejected blob not cached", chunked)
+		}
+		des, err := os.ReadDir(bc.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(des) != 2 {
+			t.Fatalf("chunked %v: expected only the two good blobs on disk, got %d files", chunked, len(des))
+		}
+
+		pds.Close()
+	}
+}
+
+func TestBlobProxyNoCache(t *testing.T) {
+	good := []byte("hello")
+	var hits int64
+	pds := blobPDS(map[string][]byte{
+		blobCid(t, good).String():        good,
+		blobCid(t, []byte("x")).String(): good,
+	}, true, &hits)
+	defer pds.Close()
+
+	bp := &blobProxy{client: http.DefaultClient}
+
+	rec, err := serveBlob(bp, pds.URL, blobCid(t, good))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), good) {
+		t.Fatalf("unexpected response %q", rec.Body.String())
+	}
+	if _, err := serveBlob(bp, pds.URL, blobCid(t, []byte("x"))); !isBadGateway(err) {
+		t.Fatalf("expected mismatched blob rejected, got %v", err)
+	}
+}
+
+func TestBlobCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	bc, err := newBlobCache(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(key string, size int) {
+		t.Helper()
+		w, err := bc.create(key, "a/b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.fi.Write(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		w.n = int64(size)
+		if err := w.commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cached := func(key string) bool {
+		rc, ctype, ok := bc.open(key)
+		if ok {
+			rc.Close()
+			if ctype != "a/b" {
+				t.Fatalf("unexpected content type %q", ctype)
+			}
+		}
+		return ok
+	}
+
+	// each entry is 4 bytes of content type plus the blob
+	put("one", 20)
+	put("two", 20)
+	put("three", 20)
+	put("four", 20)
+	// using one makes two the least recently used
+	if !cached("one") {
+		t.Fatal("expected one cached")
+	}
+	put("five", 20)
+	if cached("two") {
+		t.Fatal("expected two evicted")
+	}
+	for _, k := range []string{"one", "three", "four", "five"} {
+		if !cached(k) {
+			t.Fatalf("expected %s cached", k)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "two")); !os.IsNotExist(err) {
+		t.Fatalf("expected evicted file removed, got %v", err)
+	}
+
+	// blobs over a quarter of the cache aren't kept
+	put("big", 26)
+	if cached("big") {
+		t.Fatal("expected big blob not cached")
+	}
+
+	// a restart picks up the existing entries, and drops partial writes
+	if err := os.WriteFile(filepath.Join(dir, "partial-1"+blobCacheTmpSuffix), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i, k := range []string{"one", "three", "four", "five"} {
+		mtime := now.Add(time.Duration(i) * time.Second)
+		if err := os.Chtimes(filepath.Join(dir, k), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bc, err = newBlobCache(dir, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, de := range des {
+		names = append(names, de.Name())
+	}
+	// the oldest are evicted to fit the smaller limit
+	if strings.Join(names, ",") != "five,four" {
+		t.Fatalf("unexpected files after restart: %v", names)
+	}
+	if !cached("five") || !cached("four") || cached("one") {
+		t.Fatal("unexpected entries after restart")
+	}
+}
@@ -0,0 +1,230 @@
+package bgs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/indexer"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/repomgr"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	"gorm.io/gorm"
+)
+
+// RepoBlobRef records that a record references a blob. Only the reference
+// is kept; the relay doesn't store blobs.
+type RepoBlobRef struct {
+	ID         uint       `gorm:"primarykey"`
+	Uid        models.Uid `gorm:"index:idx_repo_blob_refs_record,priority:1"`
+	Collection string     `gorm:"index:idx_repo_blob_refs_record,priority:2"`
+	Rkey       string     `gorm:"index:idx_repo_blob_refs_record,priority:3"`
+	Blob       string     `gorm:"index"`
+	MimeType   string
+	Size       int64
+}
+
+// BlobRefIndex tracks the blobs records reference, by repo and collection,
+// so tooling can find blob references without re-parsing the firehose. It's
+// updated from the records in every commit the relay takes in; creating or
+// updating a record replaces its references, and deleting it drops them.
+// Like the collection index, records written before it was enabled aren't
+// indexed until they're written again or their repo is reset.
+type BlobRefIndex struct {
+	db      *gorm.DB
+	repoman *repomgr.RepoManager
+	// if set, writes are batched with the indexer's other writes
+	writes *indexer.GroupCommitter
+}
+
+func NewBlobRefIndex(db *gorm.DB, repoman *repomgr.RepoManager) (*BlobRefIndex, error) {
+	if err := db.AutoMigrate(&RepoBlobRef{}); err != nil {
+		return nil, err
+	}
+	return &BlobRefIndex{db: db, repoman: repoman}, nil
+}
+
+// ObserveRepoEvent updates the blob references of the records written by a
+// repo event. Failures are logged rather than holding up the event.
+func (bi *BlobRefIndex) ObserveRepoEvent(ctx context.Context, evt *repomgr.RepoEvent) {
+	reset := evt.TooBig || evt.Sync
+
+	type recordKey struct{ collection, rkey string }
+	var touched []recordKey
+	var rows []RepoBlobRef
+	var blocks map[cid.Cid][]byte
+	for _, op := range evt.Ops {
+		if op.Collection == "" {
+			continue
+		}
+		touched = append(touched, recordKey{op.Collection, op.Rkey})
+		if op.Kind == repomgr.EvtKindDeleteRecord || op.RecCid == nil {
+			continue
+		}
+
+		if blocks == nil {
+			var err error
+			if blocks, err = sliceBlocks(evt.RepoSlice); err != nil {
+				log.Warnw("failed to read repo event blocks for blob index", "uid", evt.User, "err", err)
+				blocks = make(map[cid.Cid][]byte)
+			}
+		}
+		refs, err := bi.recordBlobs(ctx, evt.User, *op.RecCid, blocks)
+		if err != nil {
+			blobRefIndexSkipped.Inc()
+			log.Debugw("skipping record in blob index", "uid", evt.User, "collection", op.Collection, "rkey", op.Rkey, "err", err)
+			continue
+		}
+		for _, b := range refs {
+			rows = append(rows, RepoBlobRef{
+				Uid:        evt.User,
+				Collection: op.Collection,
+				Rkey:       op.Rkey,
+				Blob:       cid.Cid(b.Ref).String(),
+				MimeType:   b.MimeType,
+				Size:       b.Size,
+			})
+		}
+	}
+	if !reset && len(touched) == 0 {
+		return
+	}
+
+	update := func(tx *gorm.DB) error {
+		if reset {
+			// a reset or replaced repo's import carries every record it has
+			// now, so start over
+			if err := tx.Where("uid = ?", evt.User).Delete(&RepoBlobRef{}).Error; err != nil {
+				return err
+			}
+		} else {
+			for _, k := range touched {
+				if err := tx.Where("uid = ? AND collection = ? AND rkey = ?", evt.User, k.collection, k.rkey).Delete(&RepoBlobRef{}).Error; err != nil {
+					return err
+				}
+			}
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		// a retried batch mustn't reuse IDs from the failed one
+		for i := range rows {
+			rows[i].ID = 0
+		}
+		return tx.Create(&rows).Error
+	}
+	var err error
+	if bi.writes != nil {
+		err = bi.writes.Write(ctx, update)
+	} else {
+		err = bi.db.WithContext(ctx).Transaction(update)
+	}
+	if err != nil {
+		log.Errorw("failed to update blob index", "uid", evt.User, "err", err)
+		return
+	}
+	blobRefIndexInserts.Add(float64(len(rows)))
+}
+
+// recordBlobs returns the blobs a record references, reading it from the
+// event's blocks or, for events that don't carry their records, the carstore
+func (bi *BlobRefIndex) recordBlobs(ctx context.Context, uid models.Uid, rc cid.Cid, blocks map[cid.Cid][]byte) ([]data.Blob, error) {
+	raw, ok := blocks[rc]
+	if !ok {
+		blks, err := bi.repoman.GetBlocks(ctx, uid, []cid.Cid{rc})
+		if err != nil {
+			return nil, fmt.Errorf("reading record %s: %w", rc, err)
+		}
+		if len(blks) == 0 {
+			return nil, fmt.Errorf("record %s not found", rc)
+		}
+		raw = blks[0].RawData()
+	}
+
+	rec, err := data.UnmarshalCBOR(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parsing record %s: %w", rc, err)
+	}
+
+	// a record may reference the same blob more than once
+	var out []data.Blob
+	seen := make(map[string]bool)
+	for _, b := range data.ExtractBlobs(rec) {
+		k := cid.Cid(b.Ref).String()
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+func sliceBlocks(slice []byte) (map[cid.Cid][]byte, error) {
+	blocks := make(map[cid.Cid][]byte)
+	if len(slice) == 0 {
+		return blocks, nil
+	}
+	cr, err := car.NewCarReader(bytes.NewReader(slice))
+	if err != nil {
+		return nil, err
+	}
+	for {
+		blk, err := cr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return blocks, nil
+			}
+			return nil, err
+		}
+		blocks[blk.Cid()] = blk.RawData()
+	}
+}
+
+type blobRef struct {
+	ID         uint   `json:"-"`
+	Did        string `json:"did"`
+	Collection string `json:"collection"`
+	Rkey       string `json:"rkey"`
+	Cid        string `json:"cid"`
+	MimeType   string `json:"mimeType"`
+	Size       int64  `json:"size"`
+}
+
+func (bi *BlobRefIndex) query(ctx context.Context, cursor uint, limit int) *gorm.DB {
+	return bi.db.WithContext(ctx).Model(&RepoBlobRef{}).
+		Select("repo_blob_refs.id, users.did, repo_blob_refs.collection, repo_blob_refs.rkey, repo_blob_refs.blob AS cid, repo_blob_refs.mime_type, repo_blob_refs.size").
+		Joins("JOIN users ON users.id = repo_blob_refs.uid").
+		Where("repo_blob_refs.id > ?", cursor).
+		Order("repo_blob_refs.id").
+		Limit(limit)
+}
+
+// RefsToBlob returns up to limit records referencing a blob, in the order
+// they were indexed, starting after cursor
+func (bi *BlobRefIndex) RefsToBlob(ctx context.Context, blob string, cursor uint, limit int) ([]blobRef, error) {
+	var out []blobRef
+	if err := bi.query(ctx, cursor, limit).Where("repo_blob_refs.blob = ?", blob).Scan(&out).Error; err != nil {
+		return nil, fmt.Errorf("listing references to blob %s: %w", blob, err)
+	}
+	return out, nil
+}
+
+// RepoRefs returns up to limit blob references from a repo's records,
+// optionally only those in one collection, starting after cursor
+func (bi *BlobRefIndex) RepoRefs(ctx context.Context, uid models.Uid, collection string, cursor uint, limit int) ([]blobRef, error) {
+	q := bi.query(ctx, cursor, limit).Where("repo_blob_refs.uid = ?", uid)
+	if collection != "" {
+		q = q.Where("repo_blob_refs.collection = ?", collection)
+	}
+	var out []blobRef
+	if err := q.Scan(&out).Error; err != nil {
+		return nil, fmt.Errorf("listing blob references of repo %d: %w", uid, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,238 @@
+package bgs
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo/v4"
+)
+
+type SyncCompressionOptions struct {
+	// Most sync responses compressed at once. Each takes up to a core while
+	// it's being written, so this caps the CPU compression can use;
+	// responses past it are sent uncompressed. Zero disables compression.
+	MaxConcurrent int
+	// Compression level: fastest, default, better or best. zstd levels are
+	// used as is, gzip uses the nearest equivalent.
+	Level string
+}
+
+func DefaultSyncCompressionOptions() *SyncCompressionOptions {
+	return &SyncCompressionOptions{
+		MaxConcurrent: max(runtime.NumCPU()/2, 1),
+		Level:         "fastest",
+	}
+}
+
+const (
+	encodingZstd     = "zstd"
+	encodingGzip     = "gzip"
+	encodingIdentity = "identity"
+)
+
+// SyncCompressor compresses CAR responses from the sync endpoints (getRepo,
+// getBlocks and getRecord) for clients that send Accept-Encoding, streaming
+// them out as they're written
+type SyncCompressor struct {
+	slots chan struct{}
+
+	zlevel zstd.EncoderLevel
+	glevel int
+
+	zstdPool sync.Pool
+	gzipPool sync.Pool
+}
+
+func NewSyncCompressor(opts *SyncCompressionOptions) (*SyncCompressor, error) {
+	if opts == nil {
+		opts = DefaultSyncCompressionOptions()
+	}
+
+	sc := &SyncCompressor{
+		slots: make(chan struct{}, max(opts.MaxConcurrent, 0)),
+	}
+
+	switch opts.Level {
+	case "fastest", "":
+		sc.zlevel, sc.glevel = zstd.SpeedFastest, gzip.BestSpeed
+	case "default":
+		sc.zlevel, sc.glevel = zstd.SpeedDefault, gzip.DefaultCompression
+	case "better":
+		sc.zlevel, sc.glevel = zstd.SpeedBetterCompression, 7
+	case "best":
+		sc.zlevel, sc.glevel = zstd.SpeedBestCompression, gzip.BestCompression
+	default:
+		return nil, fmt.Errorf("unknown sync compression level %q, must be fastest, default, better or best", opts.Level)
+	}
+
+	return sc, nil
+}
+
+// acceptedEncoding picks the encoding to compress a response with from the
+// request's Accept-Encoding header, preferring zstd, or returns "" if the
+// client accepts neither
+func acceptedEncoding(header string) string {
+	var zq, gq float64
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+			if ok && strings.EqualFold(k, "q") {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case encodingZstd:
+			zq = q
+		case encodingGzip, "x-gzip":
+			gq = q
+		}
+	}
+
+	switch {
+	case zq > 0 && zq >= gq:
+		return encodingZstd
+	case gq > 0:
+		return encodingGzip
+	default:
+		return ""
+	}
+}
+
+// compressedWriter compresses what's written to it onto the response. Close
+// finishes the compressed stream; release must be called once the response is
+// done with, whether or not it was closed.
+type compressedWriter struct {
+	sc       *SyncCompressor
+	encoding string
+	w        io.Writer
+	enc      io.WriteCloser
+
+	in, out int64
+}
+
+// wrap returns a writer compressing onto w in an encoding the client
+// accepts, if it accepts one and there's capacity to compress another
+// response. Otherwise the writer passes writes through as they are.
+func (sc *SyncCompressor) wrap(acceptEncoding string, w io.Writer) *compressedWriter {
+	cw := &compressedWriter{sc: sc, w: w}
+
+	encoding := acceptedEncoding(acceptEncoding)
+	if encoding == "" {
+		return cw
+	}
+
+	select {
+	case sc.slots <- struct{}{}:
+	default:
+		syncCompressionSkipped.Inc()
+		return cw
+	}
+
+	cw.encoding = encoding
+	switch encoding {
+	case encodingZstd:
+		zw, ok := sc.zstdPool.Get().(*zstd.Encoder)
+		if !ok {
+			// one goroutine per response, so each takes at most a core
+			zw, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(sc.zlevel), zstd.WithEncoderConcurrency(1))
+		}
+		zw.Reset(writerFunc(cw.writeOut))
+		cw.enc = zw
+	case encodingGzip:
+		gw, ok := sc.gzipPool.Get().(*gzip.Writer)
+		if !ok {
+			gw, _ = gzip.NewWriterLevel(nil, sc.glevel)
+		}
+		gw.Reset(writerFunc(cw.writeOut))
+		cw.enc = gw
+	}
+
+	return cw
+}
+
+// Encoding is the Content-Encoding of what's written, or "" if it's sent as
+// is
+func (cw *compressedWriter) Encoding() string {
+	return cw.encoding
+}
+
+func (cw *compressedWriter) Write(p []byte) (int, error) {
+	if cw.enc == nil {
+		return cw.w.Write(p)
+	}
+	cw.in += int64(len(p))
+	return cw.enc.Write(p)
+}
+
+func (cw *compressedWriter) writeOut(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.out += int64(n)
+	return n, err
+}
+
+// Close writes out the end of the compressed stream
+func (cw *compressedWriter) Close() error {
+	if cw.enc == nil {
+		return nil
+	}
+	return cw.enc.Close()
+}
+
+// release returns the encoder for reuse and frees up the response's share of
+// compression capacity
+func (cw *compressedWriter) release() {
+	encoding := cw.encoding
+	if encoding == "" {
+		encoding = encodingIdentity
+	}
+	syncResponsesByEncoding.WithLabelValues(encoding).Inc()
+
+	if cw.enc == nil {
+		return
+	}
+
+	syncCompressionInputBytes.WithLabelValues(encoding).Add(float64(cw.in))
+	syncCompressionOutputBytes.WithLabelValues(encoding).Add(float64(cw.out))
+
+	switch enc := cw.enc.(type) {
+	case *zstd.Encoder:
+		enc.Reset(nil)
+		cw.sc.zstdPool.Put(enc)
+	case *gzip.Writer:
+		enc.Reset(io.Discard)
+		cw.sc.gzipPool.Put(enc)
+	}
+	cw.enc = nil
+	<-cw.sc.slots
+}
+
+// streamCar sends a CAR response, compressed if the client accepts it
+func (s *BGS) streamCar(c echo.Context, r io.Reader) error {
+	resp := c.Response()
+	cw := s.compression.wrap(c.Request().Header.Get("Accept-Encoding"), resp)
+	defer cw.release()
+
+	resp.Header().Set(echo.HeaderContentType, "application/vnd.ipld.car")
+	resp.Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+	if cw.Encoding() != "" {
+		resp.Header().Set(echo.HeaderContentEncoding, cw.Encoding())
+	}
+	resp.WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(cw, r); err != nil {
+		return err
+	}
+	return cw.Close()
+}
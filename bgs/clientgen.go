@@ -0,0 +1,337 @@
+package bgs
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// WriteAdminClient generates Go bindings for the admin API, from the same
+// route descriptions the OpenAPI document is built from. It's run by go
+// generate in the bgsclient package; the output relies on the hand written
+// Client there.
+func WriteAdminClient(w io.Writer, pkg string) error {
+	var keys []string
+	for k := range apiRouteDocs {
+		method, path, _ := strings.Cut(k, " ")
+		if method == "" || !strings.HasPrefix(path, "/admin/") || strings.Contains(path, ":") {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	cg := &clientGen{types: make(map[string]reflect.Type), imports: make(map[string]bool)}
+
+	var methods bytes.Buffer
+	for _, k := range keys {
+		method, path, _ := strings.Cut(k, " ")
+		if err := cg.writeMethod(&methods, method, path, apiRouteDocs[k]); err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+	}
+
+	// emitting a type can discover more types, so go until there are none left
+	var types bytes.Buffer
+	emitted := make(map[string]bool)
+	for {
+		var names []string
+		for name := range cg.types {
+			if !emitted[name] {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			break
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			emitted[name] = true
+			cg.writeType(&types, name, cg.types[name])
+		}
+	}
+	// emitted in order of discovery, which depends on map order; sort them
+	typeDecls := strings.Split(strings.TrimSpace(types.String()), "\n\n")
+	sort.Strings(typeDecls)
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by bgsclient/gen. DO NOT EDIT.\n\npackage %s\n\n", pkg)
+	out.WriteString("import (\n\t\"context\"\n")
+	var imports []string
+	for imp := range cg.imports {
+		imports = append(imports, imp)
+	}
+	sort.Strings(imports)
+	for _, imp := range imports {
+		fmt.Fprintf(&out, "\t%q\n", imp)
+	}
+	out.WriteString(")\n\n")
+	for _, decl := range typeDecls {
+		if decl != "" {
+			out.WriteString(decl + "\n\n")
+		}
+	}
+	out.Write(methods.Bytes())
+
+	src, err := format.Source(out.Bytes())
+	if err != nil {
+		return fmt.Errorf("formatting generated client: %w", err)
+	}
+	_, err = w.Write(src)
+	return err
+}
+
+type clientGen struct {
+	// named structs referenced so far, by generated name
+	types   map[string]reflect.Type
+	imports map[string]bool
+}
+
+// methodName turns a route into a method name, eg. "POST /admin/repo/takeDown"
+// -> "PostRepoTakeDown"
+func methodName(method, path string) string {
+	id := operationID(method, strings.TrimPrefix(path, "/admin"))
+	return strings.ToUpper(id[:1]) + id[1:]
+}
+
+// paramName turns a query parameter into a Go identifier
+func paramName(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+func paramType(p apiParam) string {
+	var t string
+	switch p.Type {
+	case "integer":
+		t = "int64"
+	case "number":
+		t = "float64"
+	case "boolean":
+		t = "bool"
+	default:
+		t = "string"
+	}
+	if p.Array {
+		return "[]" + t
+	}
+	if !p.Required {
+		return "*" + t
+	}
+	return t
+}
+
+func paramFormat(p apiParam, v string) string {
+	switch p.Type {
+	case "integer":
+		return fmt.Sprintf("strconv.FormatInt(%s, 10)", v)
+	case "number":
+		return fmt.Sprintf("strconv.FormatFloat(%s, 'f', -1, 64)", v)
+	case "boolean":
+		return fmt.Sprintf("strconv.FormatBool(%s)", v)
+	default:
+		return v
+	}
+}
+
+func (cg *clientGen) writeMethod(w *bytes.Buffer, method, path string, doc apiRouteDoc) error {
+	name := methodName(method, path)
+
+	args := []string{"ctx context.Context"}
+	for _, p := range doc.Query {
+		args = append(args, paramName(p.Name)+" "+paramType(p))
+	}
+	switch {
+	case doc.Consumes != "":
+		cg.imports["io"] = true
+		args = append(args, "body io.Reader")
+	case doc.Body != nil:
+		args = append(args, "body "+cg.goType(reflect.TypeOf(doc.Body)))
+	}
+
+	var ret, zero string
+	switch {
+	case doc.Produces != "":
+		ret, zero = "[]byte", "nil"
+	case doc.Response != nil:
+		rt := reflect.TypeOf(doc.Response)
+		ret = cg.goType(rt)
+		zero = "nil"
+		if rt.Kind() == reflect.Struct {
+			ret = "*" + ret
+		}
+	}
+
+	if doc.Summary != "" {
+		fmt.Fprintf(w, "// %s %s\n", name, lowerFirst(doc.Summary))
+	}
+	if ret != "" {
+		fmt.Fprintf(w, "func (c *Client) %s(%s) (%s, error) {\n", name, strings.Join(args, ", "), ret)
+	} else {
+		fmt.Fprintf(w, "func (c *Client) %s(%s) error {\n", name, strings.Join(args, ", "))
+	}
+
+	query := "nil"
+	if len(doc.Query) > 0 {
+		query = "q"
+		cg.imports["net/url"] = true
+		w.WriteString("\tq := url.Values{}\n")
+		for _, p := range doc.Query {
+			v := paramName(p.Name)
+			switch {
+			case p.Array:
+				fmt.Fprintf(w, "\tfor _, v := range %s {\n\t\tq.Add(%q, %s)\n\t}\n", v, p.Name, paramFormat(p, "v"))
+			case p.Required:
+				fmt.Fprintf(w, "\tq.Set(%q, %s)\n", p.Name, paramFormat(p, v))
+			default:
+				fmt.Fprintf(w, "\tif %s != nil {\n\t\tq.Set(%q, %s)\n\t}\n", v, p.Name, paramFormat(p, "*"+v))
+			}
+			if p.Type != "string" {
+				cg.imports["strconv"] = true
+			}
+		}
+	}
+
+	body := "nil"
+	switch {
+	case doc.Consumes != "":
+		body = fmt.Sprintf("rawBody{contentType: %q, r: body}", doc.Consumes)
+	case doc.Body != nil:
+		body = "body"
+	}
+
+	if ret == "" {
+		fmt.Fprintf(w, "\treturn c.do(ctx, %q, %q, %s, %s, nil)\n}\n\n", method, path, query, body)
+		return nil
+	}
+
+	fmt.Fprintf(w, "\tvar out %s\n", strings.TrimPrefix(ret, "*"))
+	fmt.Fprintf(w, "\tif err := c.do(ctx, %q, %q, %s, %s, &out); err != nil {\n\t\treturn %s, err\n\t}\n", method, path, query, body, zero)
+	if strings.HasPrefix(ret, "*") {
+		w.WriteString("\treturn &out, nil\n}\n\n")
+	} else {
+		w.WriteString("\treturn out, nil\n}\n\n")
+	}
+	return nil
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	r := []rune(s)
+	// leave acronyms like PDS alone
+	if len(r) > 1 && unicode.IsUpper(r[1]) {
+		return s
+	}
+	r[0] = unicode.ToLower(r[0])
+	return string(r)
+}
+
+// typeName names a generated struct: bgs types keep their own name, others
+// are prefixed with their package since eg. both models and bgs define a User
+func typeName(t reflect.Type) string {
+	pkg := t.PkgPath()
+	if i := strings.LastIndex(pkg, "/"); i >= 0 {
+		pkg = pkg[i+1:]
+	}
+	name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+	if pkg == "bgs" || pkg == "" {
+		return name
+	}
+	return strings.ToUpper(pkg[:1]) + pkg[1:] + name
+}
+
+// goType returns the Go type a value of t decodes into from JSON, following
+// the same rules as the OpenAPI schemas
+func (cg *clientGen) goType(t reflect.Type) string {
+	if t.Kind() == reflect.Pointer {
+		return "*" + cg.goType(t.Elem())
+	}
+
+	if t == timeType {
+		cg.imports["time"] = true
+		return "time.Time"
+	}
+	if t.Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(jsonMarshalerType) {
+		cg.imports["encoding/json"] = true
+		return "json.RawMessage"
+	}
+	if t.Implements(textMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType) {
+		return "string"
+	}
+
+	switch t.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return t.Kind().String()
+	case reflect.Slice, reflect.Array:
+		return "[]" + cg.goType(t.Elem())
+	case reflect.Map:
+		return "map[" + cg.goType(t.Key()) + "]" + cg.goType(t.Elem())
+	case reflect.Struct:
+		if t.Name() == "" {
+			var sb strings.Builder
+			sb.WriteString("struct {\n")
+			cg.writeFields(&sb, t)
+			sb.WriteString("}")
+			return sb.String()
+		}
+		name := typeName(t)
+		cg.types[name] = t
+		return name
+	default:
+		return "any"
+	}
+}
+
+func (cg *clientGen) writeType(w *bytes.Buffer, name string, t reflect.Type) {
+	var sb strings.Builder
+	cg.writeFields(&sb, t)
+	fmt.Fprintf(w, "type %s struct {\n%s}\n\n", name, sb.String())
+}
+
+// writeFields follows encoding/json's rules for field names and embedding,
+// flattening embedded structs into the generated one
+func (cg *clientGen) writeFields(sb *strings.Builder, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			for ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				cg.writeFields(sb, ft)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+
+		fmt.Fprintf(sb, "\t%s %s", f.Name, cg.goType(f.Type))
+		if tag != "" {
+			fmt.Fprintf(sb, " `json:%q`", tag)
+		}
+		sb.WriteString("\n")
+	}
+}
@@ -0,0 +1,137 @@
+package bgs
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bluesky-social/indigo/indexer"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/repomgr"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RepoCollection records that a repo has had records in a collection
+type RepoCollection struct {
+	Collection string     `gorm:"primaryKey"`
+	Uid        models.Uid `gorm:"primaryKey;index"`
+}
+
+type collectionKey struct {
+	collection string
+	uid        models.Uid
+}
+
+// CollectionIndex maps collection NSIDs to the repos with records in them,
+// for com.atproto.sync.listReposByCollection. It's updated from the ops of
+// every commit the relay takes in, so repos are added when they first create
+// a record in a collection. Deleting records doesn't remove a repo, since the
+// relay can't cheaply tell whether it was the last one in the collection;
+// entries are only dropped when a repo is reset and refetched. Repos whose
+// last write predates the index aren't listed until they write again.
+type CollectionIndex struct {
+	db *gorm.DB
+	// pairs known to be in the table, to skip writing them again
+	seen *lru.Cache[collectionKey, struct{}]
+	// if set, inserts are batched with the indexer's other writes
+	writes *indexer.GroupCommitter
+}
+
+func NewCollectionIndex(db *gorm.DB, cacheSize int) (*CollectionIndex, error) {
+	if err := db.AutoMigrate(&RepoCollection{}); err != nil {
+		return nil, err
+	}
+
+	seen, err := lru.New[collectionKey, struct{}](cacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CollectionIndex{db: db, seen: seen}, nil
+}
+
+// ObserveRepoEvent adds the collections written to by a repo event. Failures
+// are logged rather than holding up the event.
+func (ci *CollectionIndex) ObserveRepoEvent(ctx context.Context, evt *repomgr.RepoEvent) {
+	// a reset or replaced repo's import carries every record it has now, so
+	// start over
+	if evt.TooBig || evt.Sync {
+		if err := ci.forgetRepo(ctx, evt.User); err != nil {
+			log.Errorw("failed to clear collection index for reset repo", "uid", evt.User, "err", err)
+		}
+	}
+
+	var rows []RepoCollection
+	added := make(map[string]bool)
+	for _, op := range evt.Ops {
+		if op.Kind == repomgr.EvtKindDeleteRecord || op.Collection == "" || added[op.Collection] {
+			continue
+		}
+		added[op.Collection] = true
+		if ci.seen.Contains(collectionKey{collection: op.Collection, uid: evt.User}) {
+			continue
+		}
+		rows = append(rows, RepoCollection{Collection: op.Collection, Uid: evt.User})
+	}
+	if len(rows) == 0 {
+		return
+	}
+
+	insert := func(tx *gorm.DB) error {
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&rows).Error
+	}
+	var err error
+	if ci.writes != nil {
+		err = ci.writes.Write(ctx, insert)
+	} else {
+		err = insert(ci.db.WithContext(ctx))
+	}
+	if err != nil {
+		log.Errorw("failed to update collection index", "uid", evt.User, "err", err)
+		return
+	}
+	for _, r := range rows {
+		ci.seen.Add(collectionKey{collection: r.Collection, uid: r.Uid}, struct{}{})
+	}
+	collectionIndexInserts.Add(float64(len(rows)))
+}
+
+func (ci *CollectionIndex) forgetRepo(ctx context.Context, uid models.Uid) error {
+	var collections []string
+	if err := ci.db.WithContext(ctx).Model(&RepoCollection{}).Where("uid = ?", uid).Pluck("collection", &collections).Error; err != nil {
+		return err
+	}
+	if err := ci.db.WithContext(ctx).Where("uid = ?", uid).Delete(&RepoCollection{}).Error; err != nil {
+		return err
+	}
+	for _, c := range collections {
+		ci.seen.Remove(collectionKey{collection: c, uid: uid})
+	}
+	return nil
+}
+
+type collectionRepo struct {
+	Uid models.Uid
+	Did string
+}
+
+// ListRepos returns up to limit active repos with records in the collection,
+// in uid order starting after cursor
+func (ci *CollectionIndex) ListRepos(ctx context.Context, collection string, cursor models.Uid, limit int) ([]collectionRepo, error) {
+	var out []collectionRepo
+	err := ci.db.WithContext(ctx).Model(&RepoCollection{}).
+		Select("repo_collections.uid, users.did").
+		Joins("JOIN users ON users.id = repo_collections.uid").
+		Where("repo_collections.collection = ? AND repo_collections.uid > ?", collection, cursor).
+		Where("users.deleted_at IS NULL").
+		Where(activeUserFilter("users")).
+		Order("repo_collections.uid").
+		Limit(limit).
+		Scan(&out).Error
+	if err != nil {
+		return nil, fmt.Errorf("listing repos in collection %q: %w", collection, err)
+	}
+	return out, nil
+}
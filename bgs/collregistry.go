@@ -0,0 +1,717 @@
+package bgs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/atproto/lexicon"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/repomgr"
+
+	"github.com/ipfs/go-cid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type CollectionRegistryOptions struct {
+	// If set, commits touching a collection that hasn't been approved are
+	// stored but held back from the firehose until it is
+	Quarantine bool
+	// Collections approved without review, as NSIDs or prefixes like
+	// app.bsky.*. Collections the ingest pipeline's lexicon catalog has a
+	// schema for are approved too.
+	Approved []string
+	// How often record counts are written to the registry
+	FlushInterval time.Duration
+	// Sample records whose JSON is larger than this aren't kept
+	SampleMaxBytes int
+}
+
+func DefaultCollectionRegistryOptions() *CollectionRegistryOptions {
+	return &CollectionRegistryOptions{
+		Approved:       []string{"app.bsky.*", "chat.bsky.*", "com.atproto.*"},
+		FlushInterval:  time.Minute,
+		SampleMaxBytes: 8 << 10,
+	}
+}
+
+const (
+	CollectionApproved = "approved"
+	CollectionPending  = "pending"
+	CollectionRejected = "rejected"
+)
+
+// RegisteredCollection is a collection the relay has seen records in
+type RegisteredCollection struct {
+	NSID      string    `gorm:"column:nsid;primarykey" json:"nsid"`
+	FirstSeen time.Time `gorm:"index" json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// where the first record came from
+	FirstHost string `json:"first_host"`
+	FirstRepo string `json:"first_repo"`
+	// created and updated records seen
+	Records int64 `json:"records"`
+	// commits held back from the firehose while the collection wasn't
+	// approved
+	Held int64 `json:"held"`
+	// a record from the collection as JSON, empty until one small enough is
+	// seen
+	SampleRecord string `json:"sample_record,omitempty"`
+	// whether the lexicon catalog had a schema for it when first seen
+	KnownSchema bool `json:"known_schema"`
+
+	Status     string     `gorm:"index" json:"status"`
+	ReviewedAt *time.Time `json:"reviewed_at,omitempty"`
+	ReviewedBy string     `json:"reviewed_by,omitempty"`
+}
+
+// HeldCommit is a commit held back from the firehose by the quarantine, in
+// the order it would have gone out. Collections lists those it touches that
+// weren't approved; it's empty for commits held only because an earlier one
+// from the same repo is, so the repo's commits go out in order.
+type HeldCommit struct {
+	ID          uint   `gorm:"primarykey"`
+	Repo        string `gorm:"index"`
+	Rev         string
+	Collections string
+	// the commit as CBOR
+	Commit    []byte
+	CreatedAt time.Time
+}
+
+// heldRepo tracks the held commits of one repo. Commits from a repo with
+// any held go in behind them, so the repo's since/prevData chain is never
+// broken on the firehose.
+type heldRepo struct {
+	lk    sync.Mutex
+	count int
+	// set once the repo's held commits are all released and it's been
+	// removed from the registry's map
+	gone bool
+}
+
+type releasingKey struct{}
+
+type collectionCounter struct {
+	records, held int64
+	lastSeen      time.Time
+	// a sample for a collection whose row doesn't have one yet
+	sample string
+}
+
+// CollectionRegistry keeps track of every record collection the relay takes
+// in, so operators can see when new lexicons show up on the network, with
+// where they came from and what their records look like. With Quarantine
+// set, commits touching a collection nobody has approved yet are stored in
+// the carstore as usual but held back from the firehose, in the held_commits
+// table, until an admin approves the collection; they are then sent out in
+// the order they arrived. Later commits from a repo with commits held are
+// held behind them.
+//
+// When the registry is first enabled, the collections in the collection
+// index are approved as they are, so only collections that turn up
+// afterwards are held.
+type CollectionRegistry struct {
+	opts    CollectionRegistryOptions
+	catalog lexicon.Catalog
+	// nil if every collection must be reviewed
+	approved *jetstreamFilter
+
+	// status by collection, read for every commit without taking lk
+	statuses sync.Map
+	// *heldRepo by DID, for repos with commits held
+	held sync.Map
+
+	lk sync.Mutex
+	// collections whose row has a sample record, or is getting one
+	sampled map[string]bool
+	counts  map[string]*collectionCounter
+
+	db     *gorm.DB
+	events *events.EventManager
+	exit   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewCollectionRegistry sets up the registry. It is disabled if opts is nil.
+// catalog may be nil.
+func NewCollectionRegistry(opts *CollectionRegistryOptions, catalog lexicon.Catalog) (*CollectionRegistry, error) {
+	cr := &CollectionRegistry{
+		catalog: catalog,
+		sampled: make(map[string]bool),
+		counts:  make(map[string]*collectionCounter),
+		exit:    make(chan struct{}),
+	}
+	if opts == nil {
+		return cr, nil
+	}
+	cr.opts = *opts
+	if cr.opts.FlushInterval <= 0 {
+		cr.opts.FlushInterval = time.Minute
+	}
+
+	if len(opts.Approved) > 0 {
+		f := &jetstreamFilter{collections: make(map[string]bool)}
+		// parsed one at a time, as the filter caps how many it takes
+		for _, a := range opts.Approved {
+			one, err := parseJetstreamFilter([]string{a}, nil, 0)
+			if err != nil {
+				return nil, fmt.Errorf("approved collections: %w", err)
+			}
+			for col := range one.collections {
+				f.collections[col] = true
+			}
+			f.prefixes = append(f.prefixes, one.prefixes...)
+		}
+		cr.approved = f
+	}
+
+	return cr, nil
+}
+
+func (cr *CollectionRegistry) enabled() bool {
+	return cr.opts.FlushInterval > 0
+}
+
+func (cr *CollectionRegistry) quarantining() bool {
+	return cr.enabled() && cr.opts.Quarantine
+}
+
+// Start loads the registry and starts writing out counts, if enabled
+func (cr *CollectionRegistry) Start(bgs *BGS) {
+	if !cr.enabled() {
+		return
+	}
+
+	cr.events = bgs.events
+	collections, err := cr.load(context.Background(), bgs.db)
+	if err != nil {
+		log.Errorw("failed to load collection registry, not keeping it", "err", err)
+		cr.opts = CollectionRegistryOptions{}
+		return
+	}
+
+	log.Infow("starting collection registry", "collections", collections, "quarantine", cr.opts.Quarantine)
+
+	// collections may have been approved while the relay was down, or by
+	// another relay sharing the database
+	cr.releaseAsync()
+
+	cr.wg.Add(1)
+	go func() {
+		defer cr.wg.Done()
+
+		t := time.NewTicker(cr.opts.FlushInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-cr.exit:
+				if err := cr.flush(context.Background()); err != nil {
+					log.Errorw("failed to write collection registry counts", "err", err)
+				}
+				return
+			case <-t.C:
+			}
+
+			if err := cr.flush(context.Background()); err != nil {
+				log.Errorw("failed to write collection registry counts", "err", err)
+			}
+		}
+	}()
+}
+
+// Shutdown stops the flush routine after writing out the last counts
+func (cr *CollectionRegistry) Shutdown() {
+	close(cr.exit)
+	cr.wg.Wait()
+}
+
+// load reads the registry and the repos with commits held, returning how many
+// collections are registered
+func (cr *CollectionRegistry) load(ctx context.Context, db *gorm.DB) (int, error) {
+	if err := db.AutoMigrate(&RegisteredCollection{}, &HeldCommit{}); err != nil {
+		return 0, err
+	}
+
+	var rows []RegisteredCollection
+	if err := db.WithContext(ctx).Select("nsid", "status", "sample_record").Find(&rows).Error; err != nil {
+		return 0, err
+	}
+
+	if len(rows) == 0 && db.Migrator().HasTable(&RepoCollection{}) {
+		// first run, approve what's already here
+		var existing []string
+		if err := db.WithContext(ctx).Model(&RepoCollection{}).Distinct("collection").Pluck("collection", &existing).Error; err != nil {
+			return 0, err
+		}
+		now := time.Now()
+		for _, col := range existing {
+			rows = append(rows, RegisteredCollection{
+				NSID:      col,
+				FirstSeen: now,
+				LastSeen:  now,
+				Status:    CollectionApproved,
+			})
+		}
+		if len(rows) > 0 {
+			if err := db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(rows, 500).Error; err != nil {
+				return 0, err
+			}
+			log.Infow("approved existing collections in new collection registry", "count", len(rows))
+		}
+	}
+
+	var held []struct {
+		Repo  string
+		Count int
+	}
+	if err := db.WithContext(ctx).Model(&HeldCommit{}).Select("repo, count(*) as count").Group("repo").Scan(&held).Error; err != nil {
+		return 0, err
+	}
+	for _, h := range held {
+		cr.held.Store(h.Repo, &heldRepo{count: h.Count})
+	}
+
+	cr.lk.Lock()
+	defer cr.lk.Unlock()
+	cr.db = db
+	for _, r := range rows {
+		cr.statuses.Store(r.NSID, r.Status)
+		cr.sampled[r.NSID] = r.SampleRecord != ""
+	}
+	return len(rows), nil
+}
+
+func (cr *CollectionRegistry) status(col string) (string, bool) {
+	v, ok := cr.statuses.Load(col)
+	if !ok {
+		return "", false
+	}
+	return v.(string), true
+}
+
+// autoApproved reports whether a collection is approved without review
+func (cr *CollectionRegistry) autoApproved(col string) (approved bool, knownSchema bool) {
+	if cr.catalog != nil {
+		if _, err := cr.catalog.Resolve(col); err == nil {
+			knownSchema = true
+		}
+	}
+	if !cr.opts.Quarantine || knownSchema {
+		return true, knownSchema
+	}
+	return cr.approved != nil && cr.approved.wantsCollection(col), knownSchema
+}
+
+// observe counts the records in a commit that made it through the ingest
+// pipeline, adding any collections the registry hasn't seen before
+func (cr *CollectionRegistry) observe(ctx context.Context, ievt *IngestEvent) {
+	if !cr.enabled() || ievt.Event.RepoCommit == nil {
+		return
+	}
+	commit := ievt.Event.RepoCommit
+
+	cr.lk.Lock()
+	defer cr.lk.Unlock()
+	if cr.db == nil {
+		// not started
+		return
+	}
+
+	now := time.Now()
+	for _, op := range commit.Ops {
+		switch repomgr.EventKind(op.Action) {
+		case repomgr.EvtKindCreateRecord, repomgr.EvtKindUpdateRecord:
+		default:
+			continue
+		}
+		col, _, _ := strings.Cut(op.Path, "/")
+
+		var sample string
+		if !cr.sampled[col] && op.Cid != nil {
+			sample = cr.sampleRecord(ievt, cid.Cid(*op.Cid))
+		}
+
+		if _, ok := cr.status(col); !ok {
+			if err := cr.register(ctx, col, ievt, sample, now); err != nil {
+				log.Errorw("failed to add collection to registry", "collection", col, "err", err)
+				continue
+			}
+			cr.sampled[col] = sample != ""
+			sample = ""
+		}
+
+		c, ok := cr.counts[col]
+		if !ok {
+			c = &collectionCounter{}
+			cr.counts[col] = c
+		}
+		c.records++
+		c.lastSeen = now
+		if sample != "" {
+			c.sample = sample
+			cr.sampled[col] = true
+		}
+	}
+}
+
+func (cr *CollectionRegistry) register(ctx context.Context, col string, ievt *IngestEvent, sample string, now time.Time) error {
+	approved, known := cr.autoApproved(col)
+	status := CollectionPending
+	if approved {
+		status = CollectionApproved
+	}
+
+	row := RegisteredCollection{
+		NSID:         col,
+		FirstSeen:    now,
+		LastSeen:     now,
+		FirstHost:    ievt.Host.Host,
+		FirstRepo:    ievt.Event.RepoCommit.Repo,
+		SampleRecord: sample,
+		KnownSchema:  known,
+		Status:       status,
+	}
+	// another relay sharing the database may have got there first
+	if err := cr.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&row).Error; err != nil {
+		return err
+	}
+	var cur RegisteredCollection
+	if err := cr.db.WithContext(ctx).Select("status").Where("nsid = ?", col).First(&cur).Error; err != nil {
+		return err
+	}
+	cr.statuses.Store(col, cur.Status)
+
+	collectionsRegistered.WithLabelValues(cur.Status).Inc()
+	log.Infow("new collection seen", "collection", col, "status", cur.Status, "pdsHost", row.FirstHost, "repo", row.FirstRepo)
+	return nil
+}
+
+// sampleRecord returns a record from the commit as JSON, or "" if it can't
+// be decoded or is too big to keep
+func (cr *CollectionRegistry) sampleRecord(ievt *IngestEvent, c cid.Cid) string {
+	blocks, err := ievt.Blocks()
+	if err != nil {
+		return ""
+	}
+	blk, ok := blocks[c]
+	if !ok {
+		return ""
+	}
+	rec, err := data.UnmarshalCBOR(blk)
+	if err != nil {
+		return ""
+	}
+	b, err := json.Marshal(rec)
+	if err != nil || len(b) > cr.opts.SampleMaxBytes {
+		return ""
+	}
+	return string(b)
+}
+
+// unapproved returns the collections a commit touches that aren't approved
+func (cr *CollectionRegistry) unapproved(commit *comatproto.SyncSubscribeRepos_Commit) []string {
+	var out []string
+	for _, op := range commit.Ops {
+		col, _, _ := strings.Cut(op.Path, "/")
+		status, ok := cr.status(col)
+		if !ok {
+			// written by some path other than the firehose, like a resync
+			if approved, _ := cr.autoApproved(col); approved {
+				continue
+			}
+			status = CollectionPending
+		}
+		if status != CollectionApproved && !slices.Contains(out, col) {
+			out = append(out, col)
+		}
+	}
+	return out
+}
+
+// middleware holds back commits touching a collection that isn't approved,
+// and commits from repos that already have some held, before they're
+// sequenced
+func (cr *CollectionRegistry) middleware(ctx context.Context, evt *events.XRPCStreamEvent) (*events.XRPCStreamEvent, error) {
+	if !cr.quarantining() || evt.RepoCommit == nil {
+		return evt, nil
+	}
+	if releasing, _ := ctx.Value(releasingKey{}).(bool); releasing {
+		return evt, nil
+	}
+
+	commit := evt.RepoCommit
+	unapproved := cr.unapproved(commit)
+	for {
+		v, ok := cr.held.Load(commit.Repo)
+		if !ok {
+			if len(unapproved) == 0 {
+				return evt, nil
+			}
+			v, _ = cr.held.LoadOrStore(commit.Repo, &heldRepo{})
+		}
+		hr := v.(*heldRepo)
+
+		hr.lk.Lock()
+		if hr.gone {
+			// released and removed meanwhile; look again
+			hr.lk.Unlock()
+			continue
+		}
+		if hr.count == 0 && len(unapproved) == 0 {
+			hr.lk.Unlock()
+			return evt, nil
+		}
+		err := cr.hold(ctx, commit, unapproved)
+		if err == nil {
+			hr.count++
+		}
+		hr.lk.Unlock()
+		if err != nil {
+			// dropped rather than sent out unapproved
+			return nil, fmt.Errorf("holding commit back: %w", err)
+		}
+		return nil, nil
+	}
+}
+
+// hold stores a commit to be sent out once its collections are approved
+func (cr *CollectionRegistry) hold(ctx context.Context, commit *comatproto.SyncSubscribeRepos_Commit, unapproved []string) error {
+	cr.lk.Lock()
+	db := cr.db
+	cr.lk.Unlock()
+	if db == nil {
+		return fmt.Errorf("collection registry is not running")
+	}
+
+	buf := new(bytes.Buffer)
+	if err := commit.MarshalCBOR(buf); err != nil {
+		return err
+	}
+	row := HeldCommit{
+		Repo:        commit.Repo,
+		Rev:         commit.Rev,
+		Collections: strings.Join(unapproved, ","),
+		Commit:      buf.Bytes(),
+	}
+	if err := db.WithContext(ctx).Create(&row).Error; err != nil {
+		return err
+	}
+
+	if len(unapproved) > 0 {
+		cr.lk.Lock()
+		for _, col := range unapproved {
+			if _, ok := cr.status(col); !ok {
+				continue
+			}
+			c, ok := cr.counts[col]
+			if !ok {
+				c = &collectionCounter{}
+				cr.counts[col] = c
+			}
+			c.held++
+		}
+		cr.lk.Unlock()
+	}
+	quarantinedCommits.Inc()
+	log.Debugw("holding back commit", "repo", commit.Repo, "rev", commit.Rev, "collections", unapproved)
+	return nil
+}
+
+// releaseAsync sends out the held commits whose collections are now all
+// approved, in the background
+func (cr *CollectionRegistry) releaseAsync() {
+	if !cr.quarantining() {
+		return
+	}
+	cr.wg.Add(1)
+	go func() {
+		defer cr.wg.Done()
+		if err := cr.release(context.Background()); err != nil {
+			log.Errorw("failed to release held commits", "err", err)
+		}
+	}()
+}
+
+// release sends out held commits, each repo's in the order they arrived, up
+// to the first that still touches a collection that isn't approved
+func (cr *CollectionRegistry) release(ctx context.Context) error {
+	var repos []string
+	cr.held.Range(func(k, v any) bool {
+		repos = append(repos, k.(string))
+		return true
+	})
+
+	var errs []error
+	for _, repo := range repos {
+		select {
+		case <-cr.exit:
+			return errors.Join(errs...)
+		default:
+		}
+		if err := cr.releaseRepo(ctx, repo); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", repo, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (cr *CollectionRegistry) releaseRepo(ctx context.Context, repo string) error {
+	v, ok := cr.held.Load(repo)
+	if !ok {
+		return nil
+	}
+	hr := v.(*heldRepo)
+	hr.lk.Lock()
+	defer hr.lk.Unlock()
+
+	cr.lk.Lock()
+	db := cr.db
+	cr.lk.Unlock()
+
+	for hr.count > 0 && !hr.gone {
+		var row HeldCommit
+		err := db.WithContext(ctx).Where("repo = ?", repo).Order("id").First(&row).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			hr.count = 0
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var commit comatproto.SyncSubscribeRepos_Commit
+		if err := commit.UnmarshalCBOR(bytes.NewReader(row.Commit)); err != nil {
+			return fmt.Errorf("decoding held commit %d: %w", row.ID, err)
+		}
+		if len(cr.unapproved(&commit)) > 0 {
+			return nil
+		}
+
+		rctx := context.WithValue(ctx, releasingKey{}, true)
+		if err := cr.events.AddEvent(rctx, &events.XRPCStreamEvent{RepoCommit: &commit}); err != nil {
+			return err
+		}
+		if err := db.WithContext(ctx).Delete(&HeldCommit{}, row.ID).Error; err != nil {
+			return err
+		}
+		hr.count--
+		releasedCommits.Inc()
+	}
+
+	if hr.count <= 0 {
+		hr.gone = true
+		cr.held.Delete(repo)
+	}
+	return nil
+}
+
+// flush adds the counts since the last flush to the registry
+func (cr *CollectionRegistry) flush(ctx context.Context) error {
+	cr.lk.Lock()
+	counts := cr.counts
+	cr.counts = make(map[string]*collectionCounter)
+	db := cr.db
+	cr.lk.Unlock()
+
+	if db == nil {
+		return nil
+	}
+
+	for col, c := range counts {
+		updates := map[string]any{
+			"records": gorm.Expr("records + ?", c.records),
+			"held":    gorm.Expr("held + ?", c.held),
+		}
+		if !c.lastSeen.IsZero() {
+			updates["last_seen"] = c.lastSeen
+		}
+		if err := db.WithContext(ctx).Model(&RegisteredCollection{}).Where("nsid = ?", col).Updates(updates).Error; err != nil {
+			return err
+		}
+		if c.sample != "" {
+			err := db.WithContext(ctx).Model(&RegisteredCollection{}).
+				Where("nsid = ? AND (sample_record = '' OR sample_record IS NULL)", col).
+				Update("sample_record", c.sample).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// List returns registered collections, newest first, optionally only those
+// with the given status
+func (cr *CollectionRegistry) List(ctx context.Context, status string, limit int) ([]RegisteredCollection, error) {
+	cr.lk.Lock()
+	db := cr.db
+	cr.lk.Unlock()
+	if db == nil {
+		return nil, fmt.Errorf("collection registry is not running")
+	}
+
+	// so the counts are up to date
+	if err := cr.flush(ctx); err != nil {
+		return nil, err
+	}
+
+	q := db.WithContext(ctx).Order("first_seen desc").Limit(limit)
+	if status != "" {
+		q = q.Where("status = ?", status)
+	}
+	var rows []RegisteredCollection
+	if err := q.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// Review sets a collection's status to approved or rejected. If approved,
+// commits in it are sent out from then on, and those held are released;
+// if rejected and the registry is quarantining, they stay held back.
+func (cr *CollectionRegistry) Review(ctx context.Context, col, status, reviewer string) (*RegisteredCollection, error) {
+	switch status {
+	case CollectionApproved, CollectionRejected:
+	default:
+		return nil, fmt.Errorf("unknown collection status %q", status)
+	}
+
+	cr.lk.Lock()
+	defer cr.lk.Unlock()
+	if cr.db == nil {
+		return nil, fmt.Errorf("collection registry is not running")
+	}
+
+	now := time.Now()
+	res := cr.db.WithContext(ctx).Model(&RegisteredCollection{}).Where("nsid = ?", col).Updates(map[string]any{
+		"status":      status,
+		"reviewed_at": now,
+		"reviewed_by": reviewer,
+	})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	cr.statuses.Store(col, status)
+	if status == CollectionApproved {
+		cr.releaseAsync()
+	}
+
+	var row RegisteredCollection
+	if err := cr.db.WithContext(ctx).Where("nsid = ?", col).First(&row).Error; err != nil {
+		return nil, err
+	}
+	return &row, nil
+}
@@ -0,0 +1,137 @@
+package bgs
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+
+	"github.com/ipfs/go-cid"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// recordingPersister remembers the revs of the commits it persists
+type recordingPersister struct {
+	*events.MemPersister
+	lk   sync.Mutex
+	revs []string
+}
+
+func (rp *recordingPersister) Persist(ctx context.Context, e *events.XRPCStreamEvent) error {
+	if e.RepoCommit != nil {
+		rp.lk.Lock()
+		rp.revs = append(rp.revs, e.RepoCommit.Rev)
+		rp.lk.Unlock()
+	}
+	return rp.MemPersister.Persist(ctx, e)
+}
+
+func (rp *recordingPersister) persisted() []string {
+	rp.lk.Lock()
+	defer rp.lk.Unlock()
+	return append([]string(nil), rp.revs...)
+}
+
+func TestQuarantineHoldsAndReleases(t *testing.T) {
+	ctx := context.Background()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "registry.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultCollectionRegistryOptions()
+	opts.Quarantine = true
+	cr, err := NewCollectionRegistry(opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cr.load(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	rp := &recordingPersister{MemPersister: events.NewMemPersister()}
+	em := events.NewEventManager(rp)
+	defer em.Shutdown(ctx)
+	em.Use(cr.middleware)
+	cr.events = em
+
+	// a new collection, pending review
+	if err := db.Create(&RegisteredCollection{NSID: "com.example.thing", Status: CollectionPending}).Error; err != nil {
+		t.Fatal(err)
+	}
+	cr.statuses.Store("com.example.thing", CollectionPending)
+
+	add := func(repo, rev, path string) {
+		c, err := cid.NewPrefixV1(cid.DagCBOR, 0x12).Sum([]byte(repo + rev))
+		if err != nil {
+			t.Fatal(err)
+		}
+		evt := &events.XRPCStreamEvent{RepoCommit: &comatproto.SyncSubscribeRepos_Commit{
+			Repo:   repo,
+			Rev:    rev,
+			Commit: lexutil.LexLink(c),
+			Blocks: []byte{},
+			Blobs:  []lexutil.LexLink{},
+			Ops:    []*comatproto.SyncSubscribeRepos_RepoOp{{Action: "create", Path: path}},
+		}}
+		if err := em.AddEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	add("did:plc:one", "a", "app.bsky.feed.post/1")
+	add("did:plc:one", "b", "com.example.thing/1")
+	// held behind b, so did:plc:one's commits stay in order
+	add("did:plc:one", "c", "app.bsky.feed.post/2")
+	add("did:plc:two", "d", "app.bsky.feed.post/1")
+
+	if got := rp.persisted(); !equalStrings(got, []string{"a", "d"}) {
+		t.Fatalf("expected only a and d sent out, got %v", got)
+	}
+	var held int64
+	if err := db.Model(&HeldCommit{}).Count(&held).Error; err != nil {
+		t.Fatal(err)
+	}
+	if held != 2 {
+		t.Fatalf("expected two held commits stored, got %d", held)
+	}
+
+	if _, err := cr.Review(ctx, "com.example.thing", CollectionApproved, "test"); err != nil {
+		t.Fatal(err)
+	}
+	cr.wg.Wait()
+
+	if got := rp.persisted(); !equalStrings(got, []string{"a", "d", "b", "c"}) {
+		t.Fatalf("expected held commits released in order, got %v", got)
+	}
+	if err := db.Model(&HeldCommit{}).Count(&held).Error; err != nil {
+		t.Fatal(err)
+	}
+	if held != 0 {
+		t.Fatalf("expected released commits removed, got %d left", held)
+	}
+
+	// with nothing held, the repo's commits go straight out again
+	add("did:plc:one", "e", "app.bsky.feed.post/3")
+	if got := rp.persisted(); !equalStrings(got, []string{"a", "d", "b", "c", "e"}) {
+		t.Fatalf("expected e sent out, got %v", got)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/bluesky-social/indigo/carstore"
 	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/util"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 )
@@ -152,6 +153,8 @@ type Compactor struct {
 
 	numWorkers int
 	wg         sync.WaitGroup
+
+	clock util.Clock
 }
 
 type CompactorOptions struct {
@@ -160,6 +163,9 @@ type CompactorOptions struct {
 	RequeueShardCount int
 	RequeueFast       bool
 	NumWorkers        int
+	// time source for requeueing and waiting for work; defaults to the
+	// system clock
+	Clock util.Clock
 }
 
 func DefaultCompactorOptions() *CompactorOptions {
@@ -187,6 +193,7 @@ func NewCompactor(opts *CompactorOptions) *Compactor {
 		requeueFast:       opts.RequeueFast,
 		requeueShardCount: opts.RequeueShardCount,
 		numWorkers:        opts.NumWorkers,
+		clock:             util.ClockOrSystem(opts.Clock),
 	}
 }
 
@@ -217,12 +224,13 @@ func (c *Compactor) Start(bgs *BGS) {
 				"fast", c.requeueFast,
 			)
 
-			t := time.NewTicker(c.requeueInterval)
+			t := c.clock.NewTicker(c.requeueInterval)
+			defer t.Stop()
 			for {
 				select {
 				case <-c.exit:
 					return
-				case <-t.C:
+				case <-t.C():
 					ctx := context.Background()
 					ctx, span := otel.Tracer("compactor").Start(ctx, "RequeueRoutine")
 					if err := c.EnqueueAllRepos(ctx, bgs, c.requeueLimit, c.requeueShardCount, c.requeueFast); err != nil {
@@ -245,6 +253,16 @@ func (c *Compactor) Shutdown() {
 
 func (c *Compactor) doWork(bgs *BGS, strategy NextStrategy) {
 	defer c.wg.Done()
+
+	// waits between compactions end early on shutdown, while compactions
+	// themselves run to completion
+	waitCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-c.exit
+		cancel()
+	}()
+
 	for {
 		select {
 		case <-c.exit:
@@ -259,7 +277,7 @@ func (c *Compactor) doWork(bgs *BGS, strategy NextStrategy) {
 		if err != nil {
 			if err == errNoReposToCompact {
 				log.Debug("no repos to compact, waiting and retrying")
-				time.Sleep(time.Second * 5)
+				c.clock.Sleep(waitCtx, time.Second*5)
 				continue
 			}
 			log.Errorw("failed to compact repo",
@@ -271,7 +289,7 @@ func (c *Compactor) doWork(bgs *BGS, strategy NextStrategy) {
 				"duration", time.Since(start),
 			)
 			// Pause for a bit to avoid spamming failed compactions
-			time.Sleep(time.Millisecond * 100)
+			c.clock.Sleep(waitCtx, time.Millisecond*100)
 		} else {
 			log.Infow("compacted repo",
 				"uid", state.latestUID,
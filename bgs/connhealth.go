@@ -0,0 +1,216 @@
+package bgs
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluesky-social/indigo/util"
+)
+
+// HostConnHealth describes the health of the relay's firehose connection to a
+// host
+type HostConnHealth struct {
+	Host      string `json:"host"`
+	Connected bool   `json:"connected"`
+	// when the current connection was made, or the last one ended
+	Since time.Time `json:"since"`
+
+	// connections made since the first, and dials that failed
+	Reconnects   int64 `json:"reconnects"`
+	DialFailures int64 `json:"dial_failures"`
+
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+
+	// round trip time of the last websocket ping answered
+	PingRTTMillis float64    `json:"ping_rtt_ms"`
+	LastPongAt    *time.Time `json:"last_pong_at,omitempty"`
+
+	BytesReceived int64   `json:"bytes_received"`
+	BytesPerSec   float64 `json:"bytes_per_sec"`
+}
+
+// hostConnHealth tracks a host's connection across reconnects, for as long
+// as the slurper is subscribed to it
+type hostConnHealth struct {
+	clock util.Clock
+	host  string
+	bytes atomic.Int64
+
+	lk           sync.Mutex
+	connected    bool
+	since        time.Time
+	connections  int64
+	dialFailures int64
+	lastErr      string
+	lastErrAt    time.Time
+	rtt          time.Duration
+	lastPong     time.Time
+
+	// throughput over the last sampling interval
+	sampledBytes int64
+	sampledAt    time.Time
+	bytesPerSec  float64
+}
+
+// connHealth tracks the health of every subscription
+type connHealth struct {
+	clock util.Clock
+	lk    sync.Mutex
+	hosts map[string]*hostConnHealth
+}
+
+func newConnHealth(clock util.Clock) *connHealth {
+	return &connHealth{clock: clock, hosts: make(map[string]*hostConnHealth)}
+}
+
+func (ch *connHealth) get(host string) *hostConnHealth {
+	ch.lk.Lock()
+	defer ch.lk.Unlock()
+
+	h, ok := ch.hosts[host]
+	if !ok {
+		h = &hostConnHealth{clock: ch.clock, host: host, sampledAt: ch.clock.Now()}
+		ch.hosts[host] = h
+	}
+	return h
+}
+
+// remove forgets a host once the slurper stops subscribing to it
+func (ch *connHealth) remove(host string) {
+	ch.lk.Lock()
+	delete(ch.hosts, host)
+	ch.lk.Unlock()
+
+	upstreamConnected.DeleteLabelValues(host)
+	upstreamPingRTT.DeleteLabelValues(host)
+	upstreamReconnects.DeleteLabelValues(host)
+	upstreamDialFailures.DeleteLabelValues(host)
+	upstreamBytes.DeleteLabelValues(host)
+	upstreamBytesPerSec.DeleteLabelValues(host)
+}
+
+func (h *hostConnHealth) connect() {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	h.connected = true
+	h.since = h.clock.Now()
+	h.connections++
+	if h.connections > 1 {
+		upstreamReconnects.WithLabelValues(h.host).Inc()
+	}
+	upstreamConnected.WithLabelValues(h.host).Set(1)
+}
+
+func (h *hostConnHealth) disconnect(err error) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	h.connected = false
+	h.since = h.clock.Now()
+	if err != nil {
+		h.setErrorLocked(err)
+	}
+	upstreamConnected.WithLabelValues(h.host).Set(0)
+}
+
+func (h *hostConnHealth) dialFailed(err error) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	h.dialFailures++
+	h.setErrorLocked(err)
+	upstreamDialFailures.WithLabelValues(h.host).Inc()
+}
+
+func (h *hostConnHealth) setErrorLocked(err error) {
+	h.lastErr = err.Error()
+	h.lastErrAt = h.clock.Now()
+}
+
+func (h *hostConnHealth) pong(rtt time.Duration) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	h.rtt = rtt
+	h.lastPong = h.clock.Now()
+	upstreamPingRTT.WithLabelValues(h.host).Set(rtt.Seconds())
+}
+
+// sample updates the host's throughput from the bytes received since the
+// last sample
+func (h *hostConnHealth) sample(now time.Time) {
+	total := h.bytes.Load()
+
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	if d := now.Sub(h.sampledAt); d > 0 {
+		h.bytesPerSec = float64(total-h.sampledBytes) / d.Seconds()
+	}
+	upstreamBytes.WithLabelValues(h.host).Add(float64(total - h.sampledBytes))
+	upstreamBytesPerSec.WithLabelValues(h.host).Set(h.bytesPerSec)
+	h.sampledBytes = total
+	h.sampledAt = now
+}
+
+func (h *hostConnHealth) snapshot() HostConnHealth {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	out := HostConnHealth{
+		Host:          h.host,
+		Connected:     h.connected,
+		Since:         h.since,
+		Reconnects:    max(h.connections-1, 0),
+		DialFailures:  h.dialFailures,
+		LastError:     h.lastErr,
+		PingRTTMillis: float64(h.rtt) / float64(time.Millisecond),
+		BytesReceived: h.bytes.Load(),
+		BytesPerSec:   h.bytesPerSec,
+	}
+	if !h.lastErrAt.IsZero() {
+		at := h.lastErrAt
+		out.LastErrorAt = &at
+	}
+	if !h.lastPong.IsZero() {
+		at := h.lastPong
+		out.LastPongAt = &at
+	}
+	return out
+}
+
+func (ch *connHealth) all() []*hostConnHealth {
+	ch.lk.Lock()
+	defer ch.lk.Unlock()
+
+	hosts := make([]*hostConnHealth, 0, len(ch.hosts))
+	for _, h := range ch.hosts {
+		hosts = append(hosts, h)
+	}
+	return hosts
+}
+
+func (ch *connHealth) sampleAll() {
+	now := ch.clock.Now()
+	for _, h := range ch.all() {
+		h.sample(now)
+	}
+}
+
+// ConnectionHealth returns the health of the slurper's subscriptions, sorted
+// by host
+func (s *Slurper) ConnectionHealth() []HostConnHealth {
+	hosts := s.health.all()
+	out := make([]HostConnHealth, 0, len(hosts))
+	for _, h := range hosts {
+		out = append(out, h.snapshot())
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Host < out[j].Host
+	})
+	return out
+}
@@ -0,0 +1,109 @@
+package bgs
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// FirehoseConsumer is the persistent record of a firehose consumer, one per
+// remote host and user agent, accumulated across all its connections. It lets
+// operators find consumers which are heavy or reconnect excessively, which the
+// in-memory list of connected consumers can't show.
+type FirehoseConsumer struct {
+	ID         uint      `gorm:"primarykey" json:"id"`
+	RemoteHost string    `gorm:"uniqueIndex:idx_firehose_consumer_host_ua" json:"remote_host"`
+	UserAgent  string    `gorm:"uniqueIndex:idx_firehose_consumer_host_ua" json:"user_agent"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `gorm:"index" json:"last_seen"`
+	// who the consumer last authenticated as, if subscriber auth is on
+	Identity string `json:"identity,omitempty"`
+
+	Connections int64 `json:"connections"`
+	// connections which lasted less than shortConnectionThreshold
+	ShortConnections int64 `json:"short_connections"`
+	// connections which asked for a cursor, ie replayed history
+	CursorConnections int64 `json:"cursor_connections"`
+	LastCursor        int64 `json:"last_cursor"`
+	// how far behind the live sequence the consumer's last cursor was
+	LastCursorLag int64 `json:"last_cursor_lag"`
+
+	ConnectedSeconds int64 `json:"connected_seconds"`
+	EventsSent       int64 `json:"events_sent"`
+	BytesSent        int64 `json:"bytes_sent"`
+}
+
+// connections shorter than this are counted as churn
+const shortConnectionThreshold = time.Minute
+
+func (bgs *BGS) recordConsumerConnect(c *SocketConsumer, since *int64) {
+	now := time.Now()
+	rec := FirehoseConsumer{
+		RemoteHost:  c.RemoteAddr,
+		UserAgent:   c.UserAgent,
+		FirstSeen:   now,
+		LastSeen:    now,
+		Connections: 1,
+		Identity:    c.Identity,
+	}
+	updates := map[string]any{
+		"last_seen":   now,
+		"connections": gorm.Expr("firehose_consumers.connections + 1"),
+	}
+	if c.Identity != "" {
+		updates["identity"] = c.Identity
+	}
+	if since != nil {
+		rec.CursorConnections = 1
+		rec.LastCursor = *since
+		updates["cursor_connections"] = gorm.Expr("firehose_consumers.cursor_connections + 1")
+		updates["last_cursor"] = *since
+
+		if cur := bgs.events.LastSeq(); cur > *since {
+			rec.LastCursorLag = cur - *since
+		}
+		updates["last_cursor_lag"] = rec.LastCursorLag
+	}
+
+	if err := bgs.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "remote_host"}, {Name: "user_agent"}},
+		DoUpdates: clause.Assignments(updates),
+	}).Create(&rec).Error; err != nil {
+		log.Warnw("failed to record firehose consumer", "remote_addr", c.RemoteAddr, "err", err)
+	}
+}
+
+func (bgs *BGS) recordConsumerDisconnect(c *SocketConsumer, eventsSent int64) {
+	dur := time.Since(c.ConnectedAt)
+	short := 0
+	if dur < shortConnectionThreshold {
+		short = 1
+	}
+
+	if err := bgs.db.Model(&FirehoseConsumer{}).
+		Where("remote_host = ? AND user_agent = ?", c.RemoteAddr, c.UserAgent).
+		Updates(map[string]any{
+			"last_seen":         time.Now(),
+			"short_connections": gorm.Expr("short_connections + ?", short),
+			"connected_seconds": gorm.Expr("connected_seconds + ?", int64(dur.Seconds())),
+			"events_sent":       gorm.Expr("events_sent + ?", eventsSent),
+			"bytes_sent":        gorm.Expr("bytes_sent + ?", c.BytesSent.Load()),
+		}).Error; err != nil {
+		log.Warnw("failed to update firehose consumer", "remote_addr", c.RemoteAddr, "err", err)
+	}
+}
+
+// countingWriter tallies bytes written to a consumer
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,265 @@
+package bgs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// HostCursor is how far through a host's event stream the relay has got:
+// every event from the host up to Cursor has been handled, and the events the
+// relay sent out for them persisted. It is what the relay resumes from after
+// a restart, so it is only advanced once the event persister acknowledges
+// writing an event out, never when the event is merely handled.
+//
+// It is saved separately from, and after, the events it covers, so it can
+// lag behind them: ingestion is at-least-once, and a crash in between has
+// those events received and possibly sent out again.
+type HostCursor struct {
+	PDS       uint `gorm:"primarykey"`
+	Cursor    int64
+	UpdatedAt time.Time
+}
+
+// pendingEvent is an event received from a host that hasn't been persisted
+type pendingEvent struct {
+	seq       int64
+	gen       int
+	at        time.Time
+	handled   bool
+	persisted bool
+}
+
+// cursorTracker follows the events of a host's stream through handling and
+// persistence. Events are handled concurrently and persisted in batches, so
+// they finish out of order; the cursor only moves past an event once every
+// event before it has finished too.
+type cursorTracker struct {
+	lk sync.Mutex
+	// events in the order received, from the oldest not yet persisted
+	pending []*pendingEvent
+	bySeq   map[int64]*pendingEvent
+	// persisted is the durable cursor, received the last sequence number
+	// received, and gen counts resets so acks from before one are ignored
+	persisted int64
+	received  int64
+	gen       int
+	// set once an event fails to persist, until the stream is resubscribed
+	// to; events still coming in on the old connection aren't tracked, so
+	// the cursor can't move past the failed one
+	failed bool
+
+	// called with the new cursor whenever it advances
+	onAdvance func(int64)
+	// called when the events sent out for a received event fail to persist,
+	// so the stream can be resubscribed to from the durable cursor
+	onFail func()
+}
+
+func newCursorTracker(cursor int64, onAdvance func(int64)) *cursorTracker {
+	return &cursorTracker{
+		bySeq:     make(map[int64]*pendingEvent),
+		persisted: cursor,
+		received:  cursor,
+		onAdvance: onAdvance,
+	}
+}
+
+// receive records an event read from the stream, in stream order. Events
+// without a sequence number, and out of order ones, aren't tracked.
+func (ct *cursorTracker) receive(seq int64) {
+	ct.lk.Lock()
+	defer ct.lk.Unlock()
+
+	if ct.failed || seq <= ct.received {
+		return
+	}
+	ct.received = seq
+	pe := &pendingEvent{seq: seq, gen: ct.gen, at: time.Now()}
+	ct.pending = append(ct.pending, pe)
+	ct.bySeq[seq] = pe
+}
+
+// handling is called as the event with the given sequence number is handled.
+// It returns a context that ties the events the relay sends out for it to
+// the event and the time it was received, and a func to call once it has
+// been handled.
+func (ct *cursorTracker) handling(ctx context.Context, seq int64) (context.Context, func()) {
+	ct.lk.Lock()
+	pe, ok := ct.bySeq[seq]
+	ct.lk.Unlock()
+	if !ok {
+		return ctx, func() {}
+	}
+
+	ack := events.NewPersistAck(func(persisted bool) {
+		if persisted {
+			ct.finish(pe, true)
+		} else {
+			ct.fail(pe)
+		}
+	})
+	ctx = events.WithReceivedAt(ctx, pe.at)
+	return events.WithPersistAck(ctx, ack), func() {
+		ct.finish(pe, false)
+		ack.Release()
+	}
+}
+
+// finish marks an event handled, or persisted, advancing the cursor past
+// every persisted event at the front of the queue
+func (ct *cursorTracker) finish(pe *pendingEvent, persisted bool) {
+	ct.lk.Lock()
+	if pe.gen != ct.gen {
+		ct.lk.Unlock()
+		return
+	}
+	pe.handled = true
+	if !persisted {
+		ct.lk.Unlock()
+		return
+	}
+	pe.persisted = true
+
+	advanced := false
+	for len(ct.pending) > 0 && ct.pending[0].persisted {
+		ct.persisted = ct.pending[0].seq
+		delete(ct.bySeq, ct.pending[0].seq)
+		ct.pending[0] = nil
+		ct.pending = ct.pending[1:]
+		advanced = true
+	}
+	cursor := ct.persisted
+	ct.lk.Unlock()
+
+	if advanced && ct.onAdvance != nil {
+		ct.onAdvance(cursor)
+	}
+}
+
+// fail handles an event whose output couldn't be persisted. The cursor can't
+// move past it, so the tracker starts over from the durable cursor, leaving
+// the event and everything after it to be received again.
+func (ct *cursorTracker) fail(pe *pendingEvent) {
+	ct.lk.Lock()
+	if pe.gen != ct.gen {
+		ct.lk.Unlock()
+		return
+	}
+	ct.gen++
+	ct.pending = nil
+	ct.bySeq = make(map[int64]*pendingEvent)
+	ct.received = ct.persisted
+	ct.failed = true
+	cursor := ct.persisted
+	onFail := ct.onFail
+	ct.lk.Unlock()
+
+	log.Warnw("failed to persist events for a host event, resubscribing from the last persisted one", "seq", pe.seq, "cursor", cursor)
+	if onFail != nil {
+		onFail()
+	}
+}
+
+// setOnFail sets the func called when an event fails to persist
+func (ct *cursorTracker) setOnFail(f func()) {
+	ct.lk.Lock()
+	ct.onFail = f
+	ct.lk.Unlock()
+}
+
+// resume returns the cursor to resubscribe from: past every event already
+// handled, as those will be persisted without being received again
+func (ct *cursorTracker) resume() int64 {
+	ct.lk.Lock()
+	defer ct.lk.Unlock()
+
+	ct.failed = false
+
+	cursor := ct.persisted
+	for _, pe := range ct.pending {
+		if !pe.handled {
+			break
+		}
+		cursor = pe.seq
+	}
+	return cursor
+}
+
+// reset starts the tracker over from cursor, forgetting events in flight
+func (ct *cursorTracker) reset(cursor int64) {
+	ct.lk.Lock()
+	ct.gen++
+	ct.pending = nil
+	ct.bySeq = make(map[int64]*pendingEvent)
+	ct.persisted = cursor
+	ct.received = cursor
+	ct.failed = false
+	ct.lk.Unlock()
+
+	if ct.onAdvance != nil {
+		ct.onAdvance(cursor)
+	}
+}
+
+// trackingScheduler records each event with the cursor tracker as it is read
+// from the stream, before it is handed to a worker
+type trackingScheduler struct {
+	events.Scheduler
+	cursors *cursorTracker
+}
+
+func (ts *trackingScheduler) AddWork(ctx context.Context, repo string, evt *events.XRPCStreamEvent) error {
+	ts.cursors.receive(evt.Sequence())
+	return ts.Scheduler.AddWork(ctx, repo, evt)
+}
+
+// loadCursor returns the cursor to start a host's subscription from. Hosts
+// last subscribed to before cursors had their own table resume from the
+// cursor saved on the host.
+func (s *Slurper) loadCursor(ctx context.Context, host *models.PDS) (int64, error) {
+	var hc []HostCursor
+	if err := s.db.WithContext(ctx).Limit(1).Find(&hc, "pds = ?", host.ID).Error; err != nil {
+		return 0, err
+	}
+	if len(hc) == 0 {
+		return host.Cursor, nil
+	}
+	return hc[0].Cursor, nil
+}
+
+// saveCursors writes the given host cursors, and mirrors them onto the hosts
+// so they show up in the host listing. This happens after the events they
+// cover were persisted, not atomically with them; see HostCursor.
+func saveCursors(ctx context.Context, db *gorm.DB, cursors []cursorSnapshot) error {
+	if len(cursors) == 0 {
+		return nil
+	}
+
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		rows := make([]HostCursor, 0, len(cursors))
+		for _, c := range cursors {
+			rows = append(rows, HostCursor{PDS: c.id, Cursor: c.cursor, UpdatedAt: now})
+		}
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "pds"}},
+			DoUpdates: clause.AssignmentColumns([]string{"cursor", "updated_at"}),
+		}).Create(&rows).Error; err != nil {
+			return err
+		}
+
+		for _, c := range cursors {
+			if err := tx.Model(models.PDS{}).Where("id = ?", c.id).UpdateColumn("cursor", c.cursor).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
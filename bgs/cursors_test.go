@@ -0,0 +1,84 @@
+package bgs
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+)
+
+// flakyPersister fails to persist while fail is set
+type flakyPersister struct {
+	*events.MemPersister
+	fail atomic.Bool
+}
+
+func (fp *flakyPersister) Persist(ctx context.Context, e *events.XRPCStreamEvent) error {
+	if fp.fail.Load() {
+		return fmt.Errorf("disk full")
+	}
+	return fp.MemPersister.Persist(ctx, e)
+}
+
+func TestCursorHoldsOnPersistFailure(t *testing.T) {
+	ctx := context.Background()
+	fp := &flakyPersister{MemPersister: events.NewMemPersister()}
+	em := events.NewEventManager(fp)
+	defer em.Shutdown(ctx)
+
+	var stored atomic.Int64
+	ct := newCursorTracker(0, func(c int64) { stored.Store(c) })
+	var resubscribes atomic.Int64
+	ct.setOnFail(func() { resubscribes.Add(1) })
+
+	handle := func(seq int64) {
+		ct.receive(seq)
+		hctx, done := ct.handling(ctx, seq)
+		evt := &events.XRPCStreamEvent{RepoIdentity: &comatproto.SyncSubscribeRepos_Identity{
+			Did:  "did:plc:one",
+			Seq:  seq,
+			Time: "2024-01-01T00:00:00Z",
+		}}
+		if err := em.AddEvent(hctx, evt); err != nil {
+			t.Fatal(err)
+		}
+		done()
+	}
+
+	handle(1)
+	if c := stored.Load(); c != 1 {
+		t.Fatalf("expected cursor 1 once the event was persisted, got %d", c)
+	}
+
+	fp.fail.Store(true)
+	handle(2)
+	fp.fail.Store(false)
+
+	if c := stored.Load(); c != 1 {
+		t.Fatalf("expected cursor to stay at 1 after a failed persist, got %d", c)
+	}
+	if n := resubscribes.Load(); n != 1 {
+		t.Fatalf("expected one resubscribe, got %d", n)
+	}
+
+	// events still arriving on the old connection don't move the cursor past
+	// the lost one
+	handle(3)
+	if c := stored.Load(); c != 1 {
+		t.Fatalf("expected cursor to stay at 1 until resubscribing, got %d", c)
+	}
+
+	// resubscribing starts from the last persisted event, so the lost one
+	// is received again
+	if c := ct.resume(); c != 1 {
+		t.Fatalf("expected to resume from 1, got %d", c)
+	}
+	handle(2)
+	handle(3)
+	if c := stored.Load(); c != 3 {
+		t.Fatalf("expected cursor 3 once the events were persisted again, got %d", c)
+	}
+}
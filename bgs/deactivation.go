@@ -0,0 +1,173 @@
+package bgs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/carstore"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/repomgr"
+)
+
+type DeactivationOptions struct {
+	// How long a deactivated account's repo is kept in the carstore before
+	// it's moved to the trash; from there it's purged after the carstore's
+	// trash retention, unless the account is reactivated first
+	Retention time.Duration
+	// How often accounts deactivated past Retention are looked for
+	Interval time.Duration
+}
+
+func DefaultDeactivationOptions() *DeactivationOptions {
+	return &DeactivationOptions{
+		Retention: 30 * 24 * time.Hour,
+		Interval:  time.Hour,
+	}
+}
+
+// DeactivationSweeper moves the repos of accounts that have been deactivated
+// for longer than the retention to the carstore trash. Deactivated repos
+// aren't served either way; this only bounds how long their data takes up
+// space. When an account is reactivated its data is restored from the trash,
+// or fetched again from its PDS if it's since been purged.
+type DeactivationSweeper struct {
+	opts DeactivationOptions
+
+	exit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewDeactivationSweeper(opts *DeactivationOptions) (*DeactivationSweeper, error) {
+	var o DeactivationOptions
+	if opts != nil {
+		o = *opts
+		if o.Retention <= 0 || o.Interval <= 0 {
+			return nil, fmt.Errorf("deactivated repo retention and sweep interval must be positive")
+		}
+	}
+
+	return &DeactivationSweeper{
+		opts: o,
+		exit: make(chan struct{}),
+	}, nil
+}
+
+func (ds *DeactivationSweeper) enabled() bool {
+	return ds.opts.Interval > 0
+}
+
+// Start starts the sweeping routine, if enabled
+func (ds *DeactivationSweeper) Start(bgs *BGS) {
+	if !ds.enabled() {
+		return
+	}
+
+	// accounts deactivated before their deactivation time was recorded start
+	// their retention now
+	if err := bgs.db.Model(&User{}).
+		Where("upstream_status = ? AND deactivated_at IS NULL", events.AccountStatusDeactivated).
+		Update("deactivated_at", time.Now()).Error; err != nil {
+		log.Errorw("failed to backfill account deactivation times", "err", err)
+	}
+
+	log.Infow("starting deactivated repo sweeper", "retention", ds.opts.Retention, "interval", ds.opts.Interval)
+
+	ds.wg.Add(1)
+	go func() {
+		defer ds.wg.Done()
+
+		t := time.NewTicker(ds.opts.Interval)
+		defer t.Stop()
+		for {
+			if _, err := ds.RunPass(context.Background(), bgs); err != nil {
+				log.Errorw("deactivated repo sweep failed", "err", err)
+			}
+
+			select {
+			case <-ds.exit:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+func (ds *DeactivationSweeper) Shutdown() {
+	close(ds.exit)
+	ds.wg.Wait()
+}
+
+// RunPass moves the data of every account deactivated for longer than the
+// retention to the trash, returning how many repos were moved
+func (ds *DeactivationSweeper) RunPass(ctx context.Context, bgs *BGS) (int, error) {
+	var users []User
+	if err := bgs.db.WithContext(ctx).
+		Where("upstream_status = ? AND deactivated_at < ? AND NOT data_trashed", events.AccountStatusDeactivated, time.Now().Add(-ds.opts.Retention)).
+		Find(&users).Error; err != nil {
+		return 0, err
+	}
+
+	var moved int
+	for _, u := range users {
+		// mark the repo first, and only if it's still deactivated, so that a
+		// reactivation racing with the sweep always goes looking for the data
+		res := bgs.db.WithContext(ctx).Model(&User{}).
+			Where("id = ? AND upstream_status = ?", u.ID, events.AccountStatusDeactivated).
+			Update("data_trashed", true)
+		if res.Error != nil {
+			return moved, res.Error
+		}
+		if res.RowsAffected == 0 {
+			continue
+		}
+
+		if err := bgs.repoman.DeactivateRepo(ctx, u.ID); err != nil {
+			log.Errorw("failed to trash deactivated repo", "did", u.Did, "err", err)
+			continue
+		}
+		deactivatedReposTrashed.Inc()
+		moved++
+	}
+
+	if moved > 0 {
+		log.Infow("moved deactivated repos to the trash", "repos", moved, "retention", ds.opts.Retention)
+	}
+	return moved, nil
+}
+
+// reactivateRepo brings back the data of an account whose repo was trashed
+// while it was deactivated: from the trash if it's still there, otherwise by
+// fetching the repo from its PDS again
+func (bgs *BGS) reactivateRepo(ctx context.Context, u *User) error {
+	entries, err := bgs.repoman.ListTrash(ctx, u.ID)
+	if err != nil {
+		return fmt.Errorf("listing trashed repo data: %w", err)
+	}
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Reason != repomgr.TrashReasonDeactivated {
+			continue
+		}
+
+		err := bgs.repoman.RestoreRepo(ctx, u.ID, entries[i].ID)
+		if err == nil {
+			reactivatedRepos.WithLabelValues("restored").Inc()
+			log.Infow("restored reactivated repo from the trash", "did", u.Did, "id", entries[i].ID)
+			return nil
+		}
+		if !errors.Is(err, carstore.ErrTrashNotFound) && !errors.Is(err, carstore.ErrRepoHasData) {
+			return fmt.Errorf("restoring reactivated repo: %w", err)
+		}
+		// purged since it was listed, or the repo has been written to again;
+		// either way the trashed copy is no use
+		break
+	}
+
+	reactivatedRepos.WithLabelValues("refetched").Inc()
+	log.Infow("reactivated repo's data was purged, refetching", "did", u.Did)
+
+	return bgs.refetchRepo(ctx, u.ID, u.Did)
+}
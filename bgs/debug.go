@@ -0,0 +1,118 @@
+package bgs
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Profiling endpoints for the admin API. These replace net/http/pprof on the
+// metrics listener, which anyone who could reach the port could use; here
+// they sit behind admin auth. Output is in the formats `go tool pprof` and
+// `go tool trace` read.
+
+// longest CPU profile or trace that can be requested
+const maxCaptureDuration = 5 * time.Minute
+
+func captureDuration(e echo.Context, def time.Duration) (time.Duration, error) {
+	v := e.QueryParam("seconds")
+	if v == "" {
+		return def, nil
+	}
+	secs, err := strconv.ParseFloat(v, 64)
+	if err != nil || secs <= 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "seconds must be a positive number")
+	}
+	d := time.Duration(secs * float64(time.Second))
+	if d > maxCaptureDuration {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("seconds must be at most %d", int(maxCaptureDuration.Seconds())))
+	}
+	return d, nil
+}
+
+func setCaptureHeaders(e echo.Context, filename string) {
+	h := e.Response().Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	h.Set("X-Content-Type-Options", "nosniff")
+}
+
+// waitCapture waits out the capture, stopping early if the client goes away
+func waitCapture(e echo.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-e.Request().Context().Done():
+	}
+}
+
+func (bgs *BGS) handleAdminCPUProfile(e echo.Context) error {
+	d, err := captureDuration(e, 30*time.Second)
+	if err != nil {
+		return err
+	}
+
+	setCaptureHeaders(e, "cpu.pprof")
+	if err := pprof.StartCPUProfile(e.Response()); err != nil {
+		// only one CPU profile can run at a time
+		e.Response().Header().Del("Content-Disposition")
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("could not start CPU profile: %s", err))
+	}
+	log.Infow("capturing cpu profile", "duration", d, "remote", e.RealIP())
+	waitCapture(e, d)
+	pprof.StopCPUProfile()
+	return nil
+}
+
+func (bgs *BGS) handleAdminTrace(e echo.Context) error {
+	d, err := captureDuration(e, 5*time.Second)
+	if err != nil {
+		return err
+	}
+
+	setCaptureHeaders(e, "trace.out")
+	if err := trace.Start(e.Response()); err != nil {
+		e.Response().Header().Del("Content-Disposition")
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("could not start trace: %s", err))
+	}
+	log.Infow("capturing runtime trace", "duration", d, "remote", e.RealIP())
+	waitCapture(e, d)
+	trace.Stop()
+	return nil
+}
+
+// handleAdminProfile writes one of the runtime's named profiles: heap,
+// allocs, goroutine, block, mutex or threadcreate
+func (bgs *BGS) handleAdminProfile(e echo.Context) error {
+	name := e.Param("profile")
+	p := pprof.Lookup(name)
+	if p == nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("unknown profile %q", name))
+	}
+
+	debug := 0
+	if v := e.QueryParam("debug"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid debug level")
+		}
+		debug = n
+	}
+	if name == "heap" && e.QueryParam("gc") == "true" {
+		runtime.GC()
+	}
+
+	if debug > 0 {
+		e.Response().Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		setCaptureHeaders(e, name+".pprof")
+	}
+	return p.WriteTo(e.Response(), debug)
+}
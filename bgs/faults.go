@@ -0,0 +1,255 @@
+package bgs
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/api"
+	"github.com/bluesky-social/indigo/events"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Kinds of injected fault, as counted in relay_injected_faults_total
+const (
+	faultDisconnect   = "disconnect"
+	faultPersistDelay = "persist_delay"
+	faultDNS          = "dns"
+)
+
+// FaultConfig describes the faults to inject. Rates are the chance, from 0
+// to 1, of each fault happening at each opportunity.
+type FaultConfig struct {
+	// Chance that a host's connection is dropped after each event it sends,
+	// so the relay has to redial it and resume from its cursor
+	DisconnectRate float64 `json:"disconnect_rate"`
+	// Chance that an event is held up for PersistDelayMs before it's
+	// persisted, holding up the events behind it too
+	PersistDelayRate float64 `json:"persist_delay_rate"`
+	PersistDelayMs   int64   `json:"persist_delay_ms"`
+	// Chance that dialing a host or resolving a handle fails as if its DNS
+	// lookup had
+	DNSFailureRate float64 `json:"dns_failure_rate"`
+	// Limits disconnects and dial failures to these hosts; all hosts if empty
+	Hosts []string `json:"hosts,omitempty"`
+	// Faults stop being injected after this many seconds; zero to keep on
+	// until cleared
+	ForSeconds int64 `json:"for_seconds,omitempty"`
+}
+
+func (fc *FaultConfig) validate() error {
+	for _, r := range []float64{fc.DisconnectRate, fc.PersistDelayRate, fc.DNSFailureRate} {
+		if r < 0 || r > 1 {
+			return fmt.Errorf("fault rates must be between 0 and 1")
+		}
+	}
+	if fc.PersistDelayMs < 0 || fc.ForSeconds < 0 {
+		return fmt.Errorf("persist delay and duration can't be negative")
+	}
+	if fc.PersistDelayRate > 0 && fc.PersistDelayMs == 0 {
+		return fmt.Errorf("persist_delay_ms must be set with persist_delay_rate")
+	}
+	return nil
+}
+
+// FaultInjectionState is what /admin/faults reports
+type FaultInjectionState struct {
+	// The faults being injected, nil if none
+	Config  *FaultConfig `json:"config"`
+	Expires *time.Time   `json:"expires,omitempty"`
+	// Faults injected since they were last set, by kind
+	Injected map[string]int64 `json:"injected"`
+}
+
+// FaultInjector injects failures into upstream connections, event
+// persistence and DNS lookups, so operators can rehearse how a relay and its
+// consumers cope in staging with the binary they run in production. It only
+// exists when enabled in the config; a nil FaultInjector injects nothing.
+type FaultInjector struct {
+	lk       sync.Mutex
+	cfg      *FaultConfig
+	hosts    map[string]bool
+	expires  time.Time
+	injected map[string]int64
+	rng      *rand.Rand
+}
+
+func NewFaultInjector() *FaultInjector {
+	return &FaultInjector{
+		injected: make(map[string]int64),
+		rng:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Set replaces the faults being injected
+func (fi *FaultInjector) Set(cfg FaultConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	fi.lk.Lock()
+	defer fi.lk.Unlock()
+
+	fi.cfg = &cfg
+	fi.hosts = nil
+	if len(cfg.Hosts) > 0 {
+		fi.hosts = make(map[string]bool, len(cfg.Hosts))
+		for _, h := range cfg.Hosts {
+			fi.hosts[h] = true
+		}
+	}
+	fi.expires = time.Time{}
+	if cfg.ForSeconds > 0 {
+		fi.expires = time.Now().Add(time.Duration(cfg.ForSeconds) * time.Second)
+	}
+	fi.injected = make(map[string]int64)
+	return nil
+}
+
+// Clear stops injecting faults
+func (fi *FaultInjector) Clear() {
+	fi.lk.Lock()
+	defer fi.lk.Unlock()
+	fi.cfg = nil
+}
+
+func (fi *FaultInjector) State() FaultInjectionState {
+	fi.lk.Lock()
+	defer fi.lk.Unlock()
+
+	st := FaultInjectionState{Injected: make(map[string]int64, len(fi.injected))}
+	for k, n := range fi.injected {
+		st.Injected[k] = n
+	}
+	if fi.active() {
+		cfg := *fi.cfg
+		st.Config = &cfg
+		if !fi.expires.IsZero() {
+			exp := fi.expires
+			st.Expires = &exp
+		}
+	}
+	return st
+}
+
+// active reports whether faults are set and haven't expired. Must be called
+// with lk held.
+func (fi *FaultInjector) active() bool {
+	if fi.cfg == nil {
+		return false
+	}
+	if !fi.expires.IsZero() && time.Now().After(fi.expires) {
+		log.Warnw("fault injection expired")
+		fi.cfg = nil
+		return false
+	}
+	return true
+}
+
+// roll decides whether a fault of the given kind happens, counting it if so.
+// host is empty for faults that aren't about a host. It returns the config
+// the fault comes from, or nil if there's no fault; configs are replaced
+// rather than modified, so it can be read without holding lk.
+func (fi *FaultInjector) roll(kind, host string) *FaultConfig {
+	if fi == nil {
+		return nil
+	}
+
+	fi.lk.Lock()
+	defer fi.lk.Unlock()
+
+	if !fi.active() {
+		return nil
+	}
+	if host != "" && fi.hosts != nil && !fi.hosts[host] {
+		return nil
+	}
+
+	var rate float64
+	switch kind {
+	case faultDisconnect:
+		rate = fi.cfg.DisconnectRate
+	case faultPersistDelay:
+		rate = fi.cfg.PersistDelayRate
+	case faultDNS:
+		rate = fi.cfg.DNSFailureRate
+	}
+	if rate <= 0 || fi.rng.Float64() >= rate {
+		return nil
+	}
+
+	fi.injected[kind]++
+	injectedFaults.WithLabelValues(kind).Inc()
+	return fi.cfg
+}
+
+// dropConnection reports whether to drop the connection to host
+func (fi *FaultInjector) dropConnection(host string) bool {
+	return fi.roll(faultDisconnect, host) != nil
+}
+
+// dnsFailure returns an error like a failed lookup of name, if one should be
+// injected
+func (fi *FaultInjector) dnsFailure(name, host string) error {
+	if fi.roll(faultDNS, host) == nil {
+		return nil
+	}
+	return &net.DNSError{Err: "injected fault", Name: name, IsNotFound: true}
+}
+
+// delayPersist is event middleware holding events up before they're
+// persisted
+func (fi *FaultInjector) delayPersist(ctx context.Context, evt *events.XRPCStreamEvent) (*events.XRPCStreamEvent, error) {
+	cfg := fi.roll(faultPersistDelay, "")
+	if cfg == nil {
+		return evt, nil
+	}
+
+	select {
+	case <-time.After(time.Duration(cfg.PersistDelayMs) * time.Millisecond):
+	case <-ctx.Done():
+	}
+	return evt, nil
+}
+
+// faultyHandleResolver fails handle resolutions with injected DNS errors
+type faultyHandleResolver struct {
+	api.HandleResolver
+	faults *FaultInjector
+}
+
+func (r *faultyHandleResolver) ResolveHandleToDid(ctx context.Context, handle string) (string, error) {
+	if err := r.faults.dnsFailure(handle, ""); err != nil {
+		return "", err
+	}
+	return r.HandleResolver.ResolveHandleToDid(ctx, handle)
+}
+
+func (bgs *BGS) handleAdminGetFaults(e echo.Context) error {
+	return e.JSON(http.StatusOK, bgs.faults.State())
+}
+
+func (bgs *BGS) handleAdminSetFaults(e echo.Context) error {
+	var body FaultConfig
+	if err := e.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid body: %s", err))
+	}
+
+	if err := bgs.faults.Set(body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	ctxLog(e.Request().Context()).Warnw("injecting faults", "config", body)
+	return e.JSON(http.StatusOK, bgs.faults.State())
+}
+
+func (bgs *BGS) handleAdminClearFaults(e echo.Context) error {
+	bgs.faults.Clear()
+	ctxLog(e.Request().Context()).Warnw("cleared injected faults")
+	return e.JSON(http.StatusOK, bgs.faults.State())
+}
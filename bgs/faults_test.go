@@ -0,0 +1,171 @@
+package bgs
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+)
+
+func TestFaultConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		cfg FaultConfig
+		ok  bool
+	}{
+		{FaultConfig{DisconnectRate: 0.5, DNSFailureRate: 1}, true},
+		{FaultConfig{PersistDelayRate: 0.1, PersistDelayMs: 100, ForSeconds: 60}, true},
+		{FaultConfig{DisconnectRate: 1.5}, false},
+		{FaultConfig{DNSFailureRate: -0.1}, false},
+		{FaultConfig{PersistDelayRate: 0.1}, false},
+		{FaultConfig{PersistDelayMs: -1}, false},
+		{FaultConfig{ForSeconds: -1}, false},
+	} {
+		if err := tc.cfg.validate(); (err == nil) != tc.ok {
+			t.Errorf("%+v: expected ok %v, got %v", tc.cfg, tc.ok, err)
+		}
+	}
+}
+
+func TestFaultInjectorRoll(t *testing.T) {
+	// a nil injector, or one without faults set, injects nothing
+	var none *FaultInjector
+	if none.dropConnection("pds.test") || none.dnsFailure("pds.test", "pds.test") != nil {
+		t.Fatal("expected no faults from a nil injector")
+	}
+	fi := NewFaultInjector()
+	if fi.dropConnection("pds.test") {
+		t.Fatal("expected no faults before any are set")
+	}
+
+	if err := fi.Set(FaultConfig{DisconnectRate: 1, DNSFailureRate: 1, Hosts: []string{"pds.test"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fi.dropConnection("pds.test") {
+		t.Fatal("expected a disconnect at rate 1")
+	}
+	if fi.dropConnection("other.test") {
+		t.Fatal("expected hosts not listed left alone")
+	}
+	err := fi.dnsFailure("pds.test", "pds.test")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound || dnsErr.Name != "pds.test" {
+		t.Fatalf("expected an injected not found error, got %v", err)
+	}
+	// faults that aren't about a host aren't limited by it
+	if fi.dnsFailure("alice.test", "") == nil {
+		t.Fatal("expected handle resolution to fail")
+	}
+
+	st := fi.State()
+	if st.Config == nil || st.Injected[faultDisconnect] != 1 || st.Injected[faultDNS] != 2 {
+		t.Fatalf("unexpected state %+v", st)
+	}
+
+	// setting new faults starts the counts over
+	if err := fi.Set(FaultConfig{DNSFailureRate: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if fi.dropConnection("pds.test") {
+		t.Fatal("expected no disconnects at rate 0")
+	}
+	if fi.dnsFailure("other.test", "other.test") == nil {
+		t.Fatal("expected all hosts affected without a host list")
+	}
+	if st := fi.State(); len(st.Injected) != 1 || st.Injected[faultDNS] != 1 {
+		t.Fatalf("unexpected counts %v", st.Injected)
+	}
+
+	fi.Clear()
+	if fi.dnsFailure("pds.test", "pds.test") != nil || fi.State().Config != nil {
+		t.Fatal("expected no faults once cleared")
+	}
+}
+
+func TestFaultInjectorExpiry(t *testing.T) {
+	fi := NewFaultInjector()
+	if err := fi.Set(FaultConfig{DisconnectRate: 1, ForSeconds: 60}); err != nil {
+		t.Fatal(err)
+	}
+	st := fi.State()
+	if st.Config == nil || st.Expires == nil || time.Until(*st.Expires) <= 0 {
+		t.Fatalf("expected faults with a future expiry, got %+v", st)
+	}
+	if !fi.dropConnection("pds.test") {
+		t.Fatal("expected a disconnect before expiry")
+	}
+
+	fi.lk.Lock()
+	fi.expires = time.Now().Add(-time.Second)
+	fi.lk.Unlock()
+
+	if fi.dropConnection("pds.test") {
+		t.Fatal("expected no disconnects after expiry")
+	}
+	if st := fi.State(); st.Config != nil || st.Expires != nil {
+		t.Fatalf("expected expired faults not reported, got %+v", st)
+	}
+}
+
+func TestFaultInjectorDelayPersist(t *testing.T) {
+	evt := &events.XRPCStreamEvent{RepoIdentity: &comatproto.SyncSubscribeRepos_Identity{Did: "did:plc:alice"}}
+
+	fi := NewFaultInjector()
+	if err := fi.Set(FaultConfig{PersistDelayRate: 1, PersistDelayMs: 20}); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	out, err := fi.delayPersist(context.Background(), evt)
+	if err != nil || out != evt {
+		t.Fatalf("expected the event passed through, got %v %v", out, err)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatalf("expected the event held up, took %s", time.Since(start))
+	}
+
+	// a cancelled context cuts the delay short
+	if err := fi.Set(FaultConfig{PersistDelayRate: 1, PersistDelayMs: 60_000}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if out, err := fi.delayPersist(ctx, evt); err != nil || out != evt {
+		t.Fatalf("expected the event passed through, got %v %v", out, err)
+	}
+
+	// faults being cleared while an event is being delayed don't upset it
+	if err := fi.Set(FaultConfig{PersistDelayRate: 1, PersistDelayMs: 1}); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			fi.Clear()
+			if err := fi.Set(FaultConfig{PersistDelayRate: 1, PersistDelayMs: 1}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		if out, err := fi.delayPersist(context.Background(), evt); err != nil || out != evt {
+			t.Fatalf("expected the event passed through, got %v %v", out, err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
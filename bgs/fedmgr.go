@@ -2,9 +2,10 @@ package bgs
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"math/rand"
+	"net/http"
 	"strings"
 	"sync"
 	"time"
@@ -14,6 +15,8 @@ import (
 	"github.com/bluesky-social/indigo/events"
 	"github.com/bluesky-social/indigo/events/schedulers/parallel"
 	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/util/retry"
 	"go.opentelemetry.io/otel"
 	"golang.org/x/time/rate"
 
@@ -41,18 +44,37 @@ type Slurper struct {
 
 	DefaultCrawlLimit rate.Limit
 	DefaultRepoLimit  int64
+	TrustedRepoLimit  int64
 	ConcurrencyPerPDS int64
 	MaxQueuePerPDS    int64
 
+	DefaultStorageQuota int64
+
 	NewPDSPerDayLimiter *slidingwindow.Limiter
 
 	newSubsDisabled bool
 	trustedDomains  []string
 
-	shutdownChan   chan bool
-	shutdownResult chan []error
+	// closed by Shutdown to stop the cursor flusher; subs tracks the
+	// subscription goroutines so shutdown can wait for them to drain, and
+	// stopped holds them for saving the cursors acknowledged after
+	exit        chan struct{}
+	flusherDone chan struct{}
+	subs        sync.WaitGroup
+	shutdown    bool
+	stopped     []*activeSub
+
+	// signalled when a host cursor advances, to save it
+	cursorsAdvanced chan struct{}
+
+	ssl       bool
+	proxy     util.ProxyFunc
+	tlsConfig *tls.Config
+	headers   http.Header
 
-	ssl bool
+	health *connHealth
+	clock  util.Clock
+	faults *FaultInjector
 }
 
 type Limiters struct {
@@ -68,8 +90,24 @@ type SlurperOptions struct {
 	DefaultPerDayLimit    int64
 	DefaultCrawlLimit     rate.Limit
 	DefaultRepoLimit      int64
-	ConcurrencyPerPDS     int64
-	MaxQueuePerPDS        int64
+	// repo limit for new hosts under a trusted domain, which start out in
+	// the trusted tier
+	TrustedRepoLimit  int64
+	ConcurrencyPerPDS int64
+	MaxQueuePerPDS    int64
+	// storage quota given to newly added hosts, zero for no limit
+	DefaultStorageQuota int64
+	// if set, connections to hosts go through this proxy
+	Proxy util.ProxyFunc
+	// if set, TLS connections to hosts are made with this config
+	TLSConfig *tls.Config
+	// sent when connecting to hosts, to identify the relay
+	Headers http.Header
+	// time source for cursor flushing, redial backoff and host pauses;
+	// defaults to the system clock
+	Clock util.Clock
+	// if set, drops connections and fails dials when told to
+	Faults *FaultInjector
 }
 
 func DefaultSlurperOptions() *SlurperOptions {
@@ -80,6 +118,7 @@ func DefaultSlurperOptions() *SlurperOptions {
 		DefaultPerDayLimit:    20_000,
 		DefaultCrawlLimit:     rate.Limit(5),
 		DefaultRepoLimit:      100,
+		TrustedRepoLimit:      10_000,
 		ConcurrencyPerPDS:     100,
 		MaxQueuePerPDS:        1_000,
 	}
@@ -90,6 +129,11 @@ type activeSub struct {
 	lk     sync.RWMutex
 	ctx    context.Context
 	cancel func()
+
+	// follows the host's events through to persistence; saved is the
+	// cursor last written out
+	cursors *cursorTracker
+	saved   int64
 }
 
 func NewSlurper(db *gorm.DB, cb IndexCallback, opts *SlurperOptions) (*Slurper, error) {
@@ -97,6 +141,8 @@ func NewSlurper(db *gorm.DB, cb IndexCallback, opts *SlurperOptions) (*Slurper,
 		opts = DefaultSlurperOptions()
 	}
 	db.AutoMigrate(&SlurpConfig{})
+	db.AutoMigrate(&HostCursor{})
+	clock := util.ClockOrSystem(opts.Clock)
 	s := &Slurper{
 		cb:                    cb,
 		db:                    db,
@@ -107,48 +153,26 @@ func NewSlurper(db *gorm.DB, cb IndexCallback, opts *SlurperOptions) (*Slurper,
 		DefaultPerDayLimit:    opts.DefaultPerDayLimit,
 		DefaultCrawlLimit:     opts.DefaultCrawlLimit,
 		DefaultRepoLimit:      opts.DefaultRepoLimit,
+		TrustedRepoLimit:      opts.TrustedRepoLimit,
 		ConcurrencyPerPDS:     opts.ConcurrencyPerPDS,
 		MaxQueuePerPDS:        opts.MaxQueuePerPDS,
+		DefaultStorageQuota:   opts.DefaultStorageQuota,
 		ssl:                   opts.SSL,
-		shutdownChan:          make(chan bool),
-		shutdownResult:        make(chan []error),
+		proxy:                 opts.Proxy,
+		tlsConfig:             opts.TLSConfig,
+		headers:               opts.Headers,
+		health:                newConnHealth(clock),
+		clock:                 clock,
+		faults:                opts.Faults,
+		exit:                  make(chan struct{}),
+		flusherDone:           make(chan struct{}),
+		cursorsAdvanced:       make(chan struct{}, 1),
 	}
 	if err := s.loadConfig(); err != nil {
 		return nil, err
 	}
 
-	// Start a goroutine to flush cursors to the DB every 30s
-	go func() {
-		for {
-			select {
-			case <-s.shutdownChan:
-				log.Info("flushing PDS cursors on shutdown")
-				ctx := context.Background()
-				ctx, span := otel.Tracer("feedmgr").Start(ctx, "CursorFlusherShutdown")
-				defer span.End()
-				var errs []error
-				if errs = s.flushCursors(ctx); len(errs) > 0 {
-					for _, err := range errs {
-						log.Errorf("failed to flush cursors on shutdown: %s", err)
-					}
-				}
-				log.Info("done flushing PDS cursors on shutdown")
-				s.shutdownResult <- errs
-				return
-			case <-time.After(time.Second * 10):
-				log.Debug("flushing PDS cursors")
-				ctx := context.Background()
-				ctx, span := otel.Tracer("feedmgr").Start(ctx, "CursorFlusher")
-				defer span.End()
-				if errs := s.flushCursors(ctx); len(errs) > 0 {
-					for _, err := range errs {
-						log.Errorf("failed to flush cursors: %s", err)
-					}
-				}
-				log.Debug("done flushing PDS cursors")
-			}
-		}
-	}()
+	go s.cursorFlusher()
 
 	return s, nil
 }
@@ -203,20 +227,91 @@ func (s *Slurper) SetLimits(pdsID uint, perSecLimit int64, perHourLimit int64, p
 	lim.PerDay.SetLimit(perDayLimit)
 }
 
-// Shutdown shuts down the slurper
-func (s *Slurper) Shutdown() []error {
-	s.shutdownChan <- true
-	log.Info("waiting for slurper shutdown")
-	errs := <-s.shutdownResult
-	if len(errs) > 0 {
-		for _, err := range errs {
-			log.Errorf("shutdown error: %s", err)
+// cursorFlusher saves the cursors of active subscriptions as they advance,
+// and samples their throughput every 10s
+func (s *Slurper) cursorFlusher() {
+	defer close(s.flusherDone)
+
+	flush := func() {
+		ctx, span := otel.Tracer("feedmgr").Start(context.Background(), "CursorFlusher")
+		defer span.End()
+		for _, err := range s.flushCursors(ctx, s.activeSubs()) {
+			log.Errorf("failed to flush cursors: %s", err)
 		}
 	}
+
+	t := s.clock.NewTicker(time.Second * 10)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.exit:
+			return
+		case <-s.cursorsAdvanced:
+			flush()
+		case <-t.C():
+			flush()
+			s.health.sampleAll()
+		}
+	}
+}
+
+// Shutdown disconnects from every PDS, waits for the events already received
+// to be handled, and saves the cursors of those persisted so far. The events
+// still buffered by the event persister are acknowledged when it flushes
+// them, after which SaveCursors saves the final cursors.
+func (s *Slurper) Shutdown(ctx context.Context) []error {
+	ctx, span := otel.Tracer("feedmgr").Start(ctx, "SlurperShutdown")
+	defer span.End()
+
+	s.lk.Lock()
+	s.shutdown = true
+	subs := make([]*activeSub, 0, len(s.active))
+	for _, sub := range s.active {
+		subs = append(subs, sub)
+		sub.cancel()
+	}
+	s.stopped = subs
+	s.lk.Unlock()
+
+	close(s.exit)
+
+	log.Infow("waiting for pds subscriptions to stop", "subscriptions", len(subs))
+	var errs []error
+	drained := make(chan struct{})
+	go func() {
+		s.subs.Wait()
+		<-s.flusherDone
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("pds subscriptions did not stop in time: %w", ctx.Err()))
+	}
+
+	// the subscriptions have removed themselves from the active set by now,
+	// so flush the cursors of the ones we stopped
+	log.Info("flushing PDS cursors on shutdown")
+	fctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	errs = append(errs, s.flushCursors(fctx, subs)...)
+	for _, err := range errs {
+		log.Errorf("slurper shutdown error: %s", err)
+	}
 	log.Info("slurper shutdown complete")
 	return errs
 }
 
+// SaveCursors saves the cursors of the subscriptions stopped by Shutdown, for
+// once the event persister has flushed the last of their events
+func (s *Slurper) SaveCursors(ctx context.Context) []error {
+	s.lk.Lock()
+	subs := s.stopped
+	s.lk.Unlock()
+
+	return s.flushCursors(ctx, subs)
+}
+
 func (s *Slurper) loadConfig() error {
 	var sc SlurpConfig
 	if err := s.db.Find(&sc).Error; err != nil {
@@ -334,6 +429,12 @@ func (s *Slurper) GetTrustedDomains() []string {
 
 var ErrNewSubsDisabled = fmt.Errorf("new subscriptions temporarily disabled")
 
+var ErrStorageQuotaExceeded = fmt.Errorf("host is over its storage quota")
+
+var ErrHostPaused = fmt.Errorf("host is paused by the defederation policy")
+
+var ErrSlurperShutdown = fmt.Errorf("slurper is shutting down")
+
 // Checks whether a host is allowed to be subscribed to
 // must be called with the slurper lock held
 func (s *Slurper) canSlurpHost(host string) bool {
@@ -343,21 +444,48 @@ func (s *Slurper) canSlurpHost(host string) bool {
 	}
 
 	// Check if the host is a trusted domain
+	if s.isTrustedHost(host) {
+		return true
+	}
+
+	return !s.newSubsDisabled
+}
+
+// must be called with the slurper lock held
+func (s *Slurper) isTrustedHost(host string) bool {
 	for _, d := range s.trustedDomains {
-		// If the domain starts with a *., it's a wildcard
-		if strings.HasPrefix(d, "*.") {
-			// Cut off the * so we have .domain.com
-			if strings.HasSuffix(host, strings.TrimPrefix(d, "*")) {
-				return true
-			}
-		} else {
-			if host == d {
-				return true
-			}
+		if hostMatchesDomain(host, d) {
+			return true
 		}
 	}
+	return false
+}
 
-	return !s.newSubsDisabled
+// hostMatchesDomain reports whether host is the domain d, or under it if d is
+// a wildcard like "*.example.com"
+func hostMatchesDomain(host, d string) bool {
+	// If the domain starts with a *., it's a wildcard
+	if strings.HasPrefix(d, "*.") {
+		// Cut off the * so we have .domain.com
+		return strings.HasSuffix(host, strings.TrimPrefix(d, "*"))
+	}
+	return host == d
+}
+
+// NewHostTier returns the repo limit tier and limit a newly added host starts
+// out with
+func (s *Slurper) NewHostTier(host string) (string, int64) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.newHostTier(host)
+}
+
+// must be called with the slurper lock held
+func (s *Slurper) newHostTier(host string) (string, int64) {
+	if s.isTrustedHost(host) {
+		return TierTrusted, s.TrustedRepoLimit
+	}
+	return TierNew, s.DefaultRepoLimit
 }
 
 func (s *Slurper) SubscribeToPds(ctx context.Context, host string, reg bool, adminOverride bool) error {
@@ -365,6 +493,10 @@ func (s *Slurper) SubscribeToPds(ctx context.Context, host string, reg bool, adm
 	s.lk.Lock()
 	defer s.lk.Unlock()
 
+	if s.shutdown {
+		return ErrSlurperShutdown
+	}
+
 	_, ok := s.active[host]
 	if ok {
 		return nil
@@ -379,11 +511,20 @@ func (s *Slurper) SubscribeToPds(ctx context.Context, host string, reg bool, adm
 		return fmt.Errorf("cannot subscribe to blocked pds")
 	}
 
+	if peering.OverStorageQuota() {
+		return ErrStorageQuotaExceeded
+	}
+
+	if peering.Paused() {
+		return ErrHostPaused
+	}
+
 	if peering.ID == 0 {
 		if !adminOverride && !s.canSlurpHost(host) {
 			return ErrNewSubsDisabled
 		}
 		// New PDS!
+		tier, repoLimit := s.newHostTier(host)
 		npds := models.PDS{
 			Host:             host,
 			SSL:              s.ssl,
@@ -392,7 +533,9 @@ func (s *Slurper) SubscribeToPds(ctx context.Context, host string, reg bool, adm
 			HourlyEventLimit: s.DefaultPerHourLimit,
 			DailyEventLimit:  s.DefaultPerDayLimit,
 			CrawlRateLimit:   float64(s.DefaultCrawlLimit),
-			RepoLimit:        s.DefaultRepoLimit,
+			RepoLimit:        repoLimit,
+			Tier:             tier,
+			StorageQuota:     s.DefaultStorageQuota,
 		}
 		if err := s.db.Create(&npds).Error; err != nil {
 			return err
@@ -418,6 +561,7 @@ func (s *Slurper) SubscribeToPds(ctx context.Context, host string, reg bool, adm
 
 	s.GetOrCreateLimiters(peering.ID, int64(peering.RateLimit), peering.HourlyEventLimit, peering.DailyEventLimit)
 
+	s.subs.Add(1)
 	go s.subscribeWithRedialer(ctx, &peering, &sub)
 
 	return nil
@@ -428,7 +572,7 @@ func (s *Slurper) RestartAll() error {
 	defer s.lk.Unlock()
 
 	var all []models.PDS
-	if err := s.db.Find(&all, "registered = true AND blocked = false").Error; err != nil {
+	if err := s.db.Find(&all, "registered = true AND blocked = false AND (storage_quota = 0 OR storage_bytes < storage_quota) AND (paused_until IS NULL OR paused_until < ?)", s.clock.Now()).Error; err != nil {
 		return err
 	}
 
@@ -445,6 +589,7 @@ func (s *Slurper) RestartAll() error {
 
 		// Check if we've already got a limiter for this PDS
 		s.GetOrCreateLimiters(pds.ID, int64(pds.RateLimit), pds.HourlyEventLimit, pds.DailyEventLimit)
+		s.subs.Add(1)
 		go s.subscribeWithRedialer(ctx, &pds, &sub)
 	}
 
@@ -452,15 +597,21 @@ func (s *Slurper) RestartAll() error {
 }
 
 func (s *Slurper) subscribeWithRedialer(ctx context.Context, host *models.PDS, sub *activeSub) {
+	defer s.subs.Done()
 	defer func() {
 		s.lk.Lock()
 		defer s.lk.Unlock()
 
 		delete(s.active, host.Host)
+		s.health.remove(host.Host)
 	}()
 
+	health := s.health.get(host.Host)
+
 	d := websocket.Dialer{
 		HandshakeTimeout: time.Second * 5,
+		Proxy:            s.proxy,
+		TLSClientConfig:  s.tlsConfig,
 	}
 
 	protocol := "ws"
@@ -468,9 +619,19 @@ func (s *Slurper) subscribeWithRedialer(ctx context.Context, host *models.PDS, s
 		protocol = "wss"
 	}
 
-	cursor := host.Cursor
+	cursor, err := s.loadCursor(ctx, host)
+	if err != nil {
+		log.Errorw("failed to load host cursor, resuming from the one saved on the host", "pdsHost", host.Host, "err", err)
+		cursor = host.Cursor
+	}
+	sub.lk.Lock()
+	sub.pds.Cursor = cursor
+	sub.saved = cursor
+	sub.cursors = newCursorTracker(cursor, func(c int64) { s.updateCursor(sub, c) })
+	sub.lk.Unlock()
 
-	var backoff int
+	backoff := retry.NewDecorrelated(retry.Backoff{Initial: time.Second, Max: time.Second * 30})
+	var failures int
 	for {
 		select {
 		case <-ctx.Done():
@@ -478,14 +639,24 @@ func (s *Slurper) subscribeWithRedialer(ctx context.Context, host *models.PDS, s
 		default:
 		}
 
+		cursor := sub.cursors.resume()
 		url := fmt.Sprintf("%s://%s/xrpc/com.atproto.sync.subscribeRepos?cursor=%d", protocol, host.Host, cursor)
-		con, res, err := d.DialContext(ctx, url, nil)
+		var con *websocket.Conn
+		var res *http.Response
+		err := s.faults.dnsFailure(host.Host, host.Host)
+		if err == nil {
+			con, res, err = d.DialContext(ctx, url, s.headers)
+		}
 		if err != nil {
-			log.Warnw("dialing failed", "pdsHost", host.Host, "err", err, "backoff", backoff)
-			time.Sleep(sleepForBackoff(backoff))
-			backoff++
+			health.dialFailed(err)
+			wait := backoff.Next()
+			log.Warnw("dialing failed", "pdsHost", host.Host, "err", err, "failures", failures, "wait", wait)
+			if err := s.clock.Sleep(ctx, wait); err != nil {
+				return
+			}
+			failures++
 
-			if backoff > 15 {
+			if failures > 15 {
 				log.Warnw("pds does not appear to be online, disabling for now", "pdsHost", host.Host)
 				if err := s.db.Model(&models.PDS{}).Where("id = ?", host.ID).Update("registered", false).Error; err != nil {
 					log.Errorf("failed to unregister failing pds: %w", err)
@@ -499,8 +670,10 @@ func (s *Slurper) subscribeWithRedialer(ctx context.Context, host *models.PDS, s
 
 		log.Info("event subscription response code: ", res.StatusCode)
 
-		curCursor := cursor
-		if err := s.handleConnection(ctx, host, con, &cursor, sub); err != nil {
+		health.connect()
+		err = s.handleConnection(ctx, host, con, sub, health)
+		health.disconnect(err)
+		if err != nil {
 			if errors.Is(err, ErrTimeoutShutdown) {
 				log.Infof("shutting down pds subscription to %s, no activity after %s", host.Host, EventsTimeout)
 				return
@@ -508,91 +681,70 @@ func (s *Slurper) subscribeWithRedialer(ctx context.Context, host *models.PDS, s
 			log.Warnf("connection to %q failed: %s", host.Host, err)
 		}
 
-		if cursor > curCursor {
-			backoff = 0
+		if sub.cursors.resume() > cursor {
+			failures = 0
+			backoff.Reset()
 		}
 	}
 }
 
-func sleepForBackoff(b int) time.Duration {
-	if b == 0 {
-		return 0
-	}
-
-	if b < 10 {
-		return (time.Duration(b) * 2) + (time.Millisecond * time.Duration(rand.Intn(1000)))
-	}
-
-	return time.Second * 30
-}
-
 var ErrTimeoutShutdown = fmt.Errorf("timed out waiting for new events")
 
 var EventsTimeout = time.Minute
 
-func (s *Slurper) handleConnection(ctx context.Context, host *models.PDS, con *websocket.Conn, lastCursor *int64, sub *activeSub) error {
+func (s *Slurper) handleConnection(ctx context.Context, host *models.PDS, con *websocket.Conn, sub *activeSub, health *hostConnHealth) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	// events that failed to persist have to be received again, so the
+	// connection is dropped and resubscribed to from the durable cursor
+	sub.cursors.setOnFail(func() {
+		cancel()
+		con.Close()
+	})
+	defer sub.cursors.setOnFail(nil)
+
+	// the cursor only moves past an event once the events the relay sent out
+	// for it are persisted
+	handle := func(seq int64, evt *events.XRPCStreamEvent) {
+		hctx, done := sub.cursors.handling(context.TODO(), seq)
+		defer done()
+		if err := s.cb(hctx, host, evt); err != nil {
+			log.Errorf("failed handling event from %q (%d): %s", host.Host, seq, err)
+		}
+		if s.faults.dropConnection(host.Host) {
+			log.Warnw("dropping host connection (injected fault)", "pdsHost", host.Host, "seq", seq)
+			con.Close()
+		}
+	}
+
 	rsc := &events.RepoStreamCallbacks{
 		RepoCommit: func(evt *comatproto.SyncSubscribeRepos_Commit) error {
 			log.Debugw("got remote repo event", "pdsHost", host.Host, "repo", evt.Repo, "seq", evt.Seq)
-			if err := s.cb(context.TODO(), host, &events.XRPCStreamEvent{
+			handle(evt.Seq, &events.XRPCStreamEvent{
 				RepoCommit: evt,
-			}); err != nil {
-				log.Errorf("failed handling event from %q (%d): %s", host.Host, evt.Seq, err)
-			}
-			*lastCursor = evt.Seq
-
-			if err := s.updateCursor(sub, *lastCursor); err != nil {
-				return fmt.Errorf("updating cursor: %w", err)
-			}
-
+			})
 			return nil
 		},
 		RepoHandle: func(evt *comatproto.SyncSubscribeRepos_Handle) error {
 			log.Infow("got remote handle update event", "pdsHost", host.Host, "did", evt.Did, "handle", evt.Handle)
-			if err := s.cb(context.TODO(), host, &events.XRPCStreamEvent{
+			handle(evt.Seq, &events.XRPCStreamEvent{
 				RepoHandle: evt,
-			}); err != nil {
-				log.Errorf("failed handling event from %q (%d): %s", host.Host, evt.Seq, err)
-			}
-			*lastCursor = evt.Seq
-
-			if err := s.updateCursor(sub, *lastCursor); err != nil {
-				return fmt.Errorf("updating cursor: %w", err)
-			}
-
+			})
 			return nil
 		},
 		RepoMigrate: func(evt *comatproto.SyncSubscribeRepos_Migrate) error {
 			log.Infow("got remote repo migrate event", "pdsHost", host.Host, "did", evt.Did, "migrateTo", evt.MigrateTo)
-			if err := s.cb(context.TODO(), host, &events.XRPCStreamEvent{
+			handle(evt.Seq, &events.XRPCStreamEvent{
 				RepoMigrate: evt,
-			}); err != nil {
-				log.Errorf("failed handling event from %q (%d): %s", host.Host, evt.Seq, err)
-			}
-			*lastCursor = evt.Seq
-
-			if err := s.updateCursor(sub, *lastCursor); err != nil {
-				return fmt.Errorf("updating cursor: %w", err)
-			}
-
+			})
 			return nil
 		},
 		RepoTombstone: func(evt *comatproto.SyncSubscribeRepos_Tombstone) error {
 			log.Infow("got remote repo tombstone event", "pdsHost", host.Host, "did", evt.Did)
-			if err := s.cb(context.TODO(), host, &events.XRPCStreamEvent{
+			handle(evt.Seq, &events.XRPCStreamEvent{
 				RepoTombstone: evt,
-			}); err != nil {
-				log.Errorf("failed handling event from %q (%d): %s", host.Host, evt.Seq, err)
-			}
-			*lastCursor = evt.Seq
-
-			if err := s.updateCursor(sub, *lastCursor); err != nil {
-				return fmt.Errorf("updating cursor: %w", err)
-			}
-
+			})
 			return nil
 		},
 		RepoInfo: func(info *comatproto.SyncSubscribeRepos_Info) error {
@@ -601,32 +753,16 @@ func (s *Slurper) handleConnection(ctx context.Context, host *models.PDS, con *w
 		},
 		RepoIdentity: func(ident *comatproto.SyncSubscribeRepos_Identity) error {
 			log.Infow("identity event", "did", ident.Did)
-			if err := s.cb(context.TODO(), host, &events.XRPCStreamEvent{
+			handle(ident.Seq, &events.XRPCStreamEvent{
 				RepoIdentity: ident,
-			}); err != nil {
-				log.Errorf("failed handling event from %q (%d): %s", host.Host, ident.Seq, err)
-			}
-			*lastCursor = ident.Seq
-
-			if err := s.updateCursor(sub, *lastCursor); err != nil {
-				return fmt.Errorf("updating cursor: %w", err)
-			}
-
+			})
 			return nil
 		},
 		RepoAccount: func(acct *comatproto.SyncSubscribeRepos_Account) error {
 			log.Infow("account event", "did", acct.Did, "status", acct.Status)
-			if err := s.cb(context.TODO(), host, &events.XRPCStreamEvent{
+			handle(acct.Seq, &events.XRPCStreamEvent{
 				RepoAccount: acct,
-			}); err != nil {
-				log.Errorf("failed handling event from %q (%d): %s", host.Host, acct.Seq, err)
-			}
-			*lastCursor = acct.Seq
-
-			if err := s.updateCursor(sub, *lastCursor); err != nil {
-				return fmt.Errorf("updating cursor: %w", err)
-			}
-
+			})
 			return nil
 		},
 		// TODO: all the other event types (handle change, migration, etc)
@@ -634,11 +770,10 @@ func (s *Slurper) handleConnection(ctx context.Context, host *models.PDS, con *w
 			switch errf.Error {
 			case "FutureCursor":
 				// if we get a FutureCursor frame, reset our sequence number for this host
-				if err := s.db.Table("pds").Where("id = ?", host.ID).Update("cursor", 0).Error; err != nil {
+				sub.cursors.reset(0)
+				if err := saveCursors(ctx, s.db, []cursorSnapshot{{id: host.ID, cursor: 0}}); err != nil {
 					return err
 				}
-
-				*lastCursor = 0
 				return fmt.Errorf("got FutureCursor frame, reset cursor tracking for host")
 			default:
 				return fmt.Errorf("error frame: %s: %s", errf.Error, errf.Message)
@@ -662,14 +797,22 @@ func (s *Slurper) handleConnection(ctx context.Context, host *models.PDS, con *w
 		con.RemoteAddr().String(),
 		instrumentedRSC.EventHandler,
 	)
-	return events.HandleRepoStream(ctx, con, pool)
+	return events.HandleRepoStreamWithOptions(ctx, con, &trackingScheduler{Scheduler: pool, cursors: sub.cursors}, &events.RepoStreamOptions{
+		OnPong:    health.pong,
+		BytesRead: &health.bytes,
+	})
 }
 
-func (s *Slurper) updateCursor(sub *activeSub, curs int64) error {
+// updateCursor records a host's new cursor, and has the flusher save it
+func (s *Slurper) updateCursor(sub *activeSub, curs int64) {
 	sub.lk.Lock()
-	defer sub.lk.Unlock()
 	sub.pds.Cursor = curs
-	return nil
+	sub.lk.Unlock()
+
+	select {
+	case s.cursorsAdvanced <- struct{}{}:
+	default:
+	}
 }
 
 type cursorSnapshot struct {
@@ -677,38 +820,49 @@ type cursorSnapshot struct {
 	cursor int64
 }
 
-// flushCursors updates the PDS cursors in the DB for all active subscriptions
-func (s *Slurper) flushCursors(ctx context.Context) []error {
+func (s *Slurper) activeSubs() []*activeSub {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	subs := make([]*activeSub, 0, len(s.active))
+	for _, sub := range s.active {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// flushCursors saves the cursors of the given subscriptions that have
+// advanced since they were last saved
+func (s *Slurper) flushCursors(ctx context.Context, subs []*activeSub) []error {
 	ctx, span := otel.Tracer("feedmgr").Start(ctx, "flushCursors")
 	defer span.End()
 
-	var cursors []cursorSnapshot
-
-	s.lk.Lock()
-	// Iterate over active subs and copy the current cursor
-	for _, sub := range s.active {
+	// copy the current cursors
+	cursors := make([]cursorSnapshot, 0, len(subs))
+	changed := make([]*activeSub, 0, len(subs))
+	for _, sub := range subs {
 		sub.lk.RLock()
-		cursors = append(cursors, cursorSnapshot{
-			id:     sub.pds.ID,
-			cursor: sub.pds.Cursor,
-		})
+		if sub.pds.Cursor != sub.saved {
+			cursors = append(cursors, cursorSnapshot{
+				id:     sub.pds.ID,
+				cursor: sub.pds.Cursor,
+			})
+			changed = append(changed, sub)
+		}
 		sub.lk.RUnlock()
 	}
-	s.lk.Unlock()
-
-	errs := []error{}
 
-	tx := s.db.WithContext(ctx).Begin()
-	for _, cursor := range cursors {
-		if err := tx.WithContext(ctx).Model(models.PDS{}).Where("id = ?", cursor.id).UpdateColumn("cursor", cursor.cursor).Error; err != nil {
-			errs = append(errs, err)
-		}
+	if err := saveCursors(ctx, s.db, cursors); err != nil {
+		return []error{err}
 	}
-	if err := tx.WithContext(ctx).Commit().Error; err != nil {
-		errs = append(errs, err)
+
+	for i, sub := range changed {
+		sub.lk.Lock()
+		sub.saved = cursors[i].cursor
+		sub.lk.Unlock()
 	}
 
-	return errs
+	return nil
 }
 
 func (s *Slurper) GetActiveList() []string {
@@ -735,7 +889,10 @@ func (s *Slurper) KillUpstreamConnection(host string, block bool) error {
 	ac.cancel()
 
 	if block {
-		if err := s.db.Model(models.PDS{}).Where("id = ?", ac.pds.ID).UpdateColumn("blocked", true).Error; err != nil {
+		if err := s.db.Model(models.PDS{}).Where("id = ?", ac.pds.ID).UpdateColumns(map[string]any{
+			"blocked":          true,
+			"last_incident_at": s.clock.Now(),
+		}).Error; err != nil {
 			return fmt.Errorf("failed to set host as blocked: %w", err)
 		}
 	}
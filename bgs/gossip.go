@@ -0,0 +1,309 @@
+package bgs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/util"
+
+	"github.com/labstack/echo/v4"
+)
+
+// gossipHostsPath serves the hosts a relay is consuming from to other relays
+const gossipHostsPath = "/xrpc/_relay/listHosts"
+
+type GossipOptions struct {
+	// Serve the hosts this relay is healthily consuming from at
+	// /xrpc/_relay/listHosts, for other relays to gossip with
+	Serve bool
+
+	// Base URLs of other relays to fetch host lists from every Interval.
+	// Hosts this relay doesn't know yet are requested as for requestCrawl.
+	Peers    []string
+	Interval time.Duration
+	// Hosts that had an incident at a peer within this long aren't requested
+	CleanFor time.Duration
+	// Most new hosts requested from one peer's list per pass
+	MaxNewPerPass int
+}
+
+func DefaultGossipOptions() *GossipOptions {
+	return &GossipOptions{
+		Interval:      time.Hour,
+		CleanFor:      24 * time.Hour,
+		MaxNewPerPass: 100,
+	}
+}
+
+// GossipHost is a host a relay is consuming from, with what it knows of the
+// host's standing
+type GossipHost struct {
+	Host      string `json:"host"`
+	RepoCount int64  `json:"repo_count"`
+	// The relay's repo limit tier for the host
+	Tier string `json:"tier,omitempty"`
+	// When the relay first saw the host, and when it last blocked, paused
+	// or rejected events from it
+	FirstSeen      time.Time  `json:"first_seen"`
+	LastIncidentAt *time.Time `json:"last_incident_at,omitempty"`
+}
+
+type GossipHostsResponse struct {
+	Hosts []GossipHost `json:"hosts"`
+}
+
+// GossipPeerStatus is how gossip with a peer went last time
+type GossipPeerStatus struct {
+	Peer      string    `json:"peer"`
+	LastFetch time.Time `json:"last_fetch,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	// Hosts on the peer's list, and how many were new here and requested
+	Hosts     int `json:"hosts"`
+	Requested int `json:"requested"`
+}
+
+// Gossiper exchanges lists of known, healthy hosts with other relays, so that
+// a new relay finds the network's PDSs without waiting for each to request a
+// crawl
+type Gossiper struct {
+	opts     GossipOptions
+	client   *http.Client
+	identity *RelayIdentity
+
+	lk    sync.Mutex
+	peers map[string]*GossipPeerStatus
+
+	exit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewGossiper(opts *GossipOptions, proxy util.ProxyFunc) (*Gossiper, error) {
+	if opts == nil {
+		opts = DefaultGossipOptions()
+	}
+	if len(opts.Peers) > 0 && opts.Interval <= 0 {
+		return nil, fmt.Errorf("gossip interval must be positive")
+	}
+
+	g := &Gossiper{
+		opts:   *opts,
+		client: util.ProxiedHTTPClient(proxy),
+		peers:  make(map[string]*GossipPeerStatus),
+		exit:   make(chan struct{}),
+	}
+	g.client.Timeout = time.Minute
+
+	g.opts.Peers = nil
+	for _, p := range opts.Peers {
+		p = strings.TrimSuffix(strings.TrimSpace(p), "/")
+		if !strings.HasPrefix(p, "http://") && !strings.HasPrefix(p, "https://") {
+			return nil, fmt.Errorf("gossip peer %q must be an http(s) URL", p)
+		}
+		if _, ok := g.peers[p]; ok {
+			continue
+		}
+		g.opts.Peers = append(g.opts.Peers, p)
+		g.peers[p] = &GossipPeerStatus{Peer: p}
+	}
+	return g, nil
+}
+
+// Start starts gossiping with peers, if there are any
+func (g *Gossiper) Start(bgs *BGS) {
+	if len(g.opts.Peers) == 0 {
+		return
+	}
+
+	log.Infow("starting relay gossip", "peers", len(g.opts.Peers), "interval", g.opts.Interval)
+
+	// cancelled on shutdown, abandoning a pass in progress
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-g.exit
+		cancel()
+	}()
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+
+		t := time.NewTicker(g.opts.Interval)
+		defer t.Stop()
+		for {
+			g.RunPass(ctx, bgs)
+
+			select {
+			case <-g.exit:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+// Shutdown stops gossiping, abandoning a pass in progress
+func (g *Gossiper) Shutdown() {
+	close(g.exit)
+	g.wg.Wait()
+}
+
+// RunPass fetches every peer's host list, and requests crawls of the hosts on
+// them this relay doesn't know yet
+func (g *Gossiper) RunPass(ctx context.Context, bgs *BGS) {
+	for _, peer := range g.opts.Peers {
+		if ctx.Err() != nil {
+			return
+		}
+
+		hosts, err := g.fetchHosts(ctx, peer)
+		if err != nil {
+			log.Warnw("failed to fetch hosts from gossip peer", "peer", peer, "err", err)
+			gossipFetchFailures.WithLabelValues(peer).Inc()
+			g.setStatus(peer, func(st *GossipPeerStatus) {
+				st.LastFetch = time.Now()
+				st.LastError = err.Error()
+			})
+			continue
+		}
+
+		requested, err := g.requestNew(ctx, bgs, hosts)
+		if err != nil {
+			log.Errorw("failed to request hosts from gossip peer", "peer", peer, "err", err)
+		}
+		g.setStatus(peer, func(st *GossipPeerStatus) {
+			st.LastFetch = time.Now()
+			st.LastError = ""
+			if err != nil {
+				st.LastError = err.Error()
+			}
+			st.Hosts = len(hosts)
+			st.Requested = requested
+		})
+	}
+}
+
+func (g *Gossiper) fetchHosts(ctx context.Context, peer string) ([]GossipHost, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", peer+gossipHostsPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	g.identity.setHeaders(req)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer returned status %d", resp.StatusCode)
+	}
+
+	var out GossipHostsResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 32<<20)).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decoding host list: %w", err)
+	}
+	return out.Hosts, nil
+}
+
+// requestNew requests crawls of the hosts in good standing that this relay
+// doesn't know yet, returning how many were requested
+func (g *Gossiper) requestNew(ctx context.Context, bgs *BGS, hosts []GossipHost) (int, error) {
+	var known []string
+	if err := bgs.db.WithContext(ctx).Model(&models.PDS{}).Pluck("host", &known).Error; err != nil {
+		return 0, fmt.Errorf("listing known hosts: %w", err)
+	}
+	seen := make(map[string]bool, len(known))
+	for _, h := range known {
+		seen[strings.ToLower(h)] = true
+	}
+
+	cutoff := time.Now().Add(-g.opts.CleanFor)
+	var fresh []string
+	for _, h := range hosts {
+		name := strings.ToLower(strings.TrimSpace(h.Host))
+		if name == "" || seen[name] {
+			continue
+		}
+		if h.LastIncidentAt != nil && h.LastIncidentAt.After(cutoff) {
+			continue
+		}
+		seen[name] = true
+		fresh = append(fresh, name)
+		if g.opts.MaxNewPerPass > 0 && len(fresh) >= g.opts.MaxNewPerPass {
+			break
+		}
+	}
+	if len(fresh) == 0 {
+		return 0, nil
+	}
+
+	results := bgs.importHosts(ctx, fresh, 10, true, false)
+	requested := 0
+	for _, r := range results {
+		gossipHostsRequested.WithLabelValues(r.Status).Inc()
+		if r.Status == ImportHostQueued {
+			requested++
+		}
+	}
+	log.Infow("requested hosts learned from gossip", "new", len(fresh), "queued", requested)
+	return requested, nil
+}
+
+func (g *Gossiper) setStatus(peer string, fn func(st *GossipPeerStatus)) {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+	fn(g.peers[peer])
+}
+
+// Peers returns how gossip with each peer went last time
+func (g *Gossiper) Peers() []GossipPeerStatus {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+
+	out := make([]GossipPeerStatus, 0, len(g.opts.Peers))
+	for _, p := range g.opts.Peers {
+		out = append(out, *g.peers[p])
+	}
+	return out
+}
+
+// handleGossipHosts lists the hosts the relay is connected to and in good
+// standing with: registered, not blocked, paused or over quota
+func (bgs *BGS) handleGossipHosts(e echo.Context) error {
+	var hosts []models.PDS
+	if err := bgs.db.WithContext(e.Request().Context()).
+		Where("registered = true AND blocked = false AND (storage_quota = 0 OR storage_bytes < storage_quota) AND (paused_until IS NULL OR paused_until < ?)", time.Now()).
+		Find(&hosts).Error; err != nil {
+		return err
+	}
+
+	active := make(map[string]bool)
+	for _, h := range bgs.slurper.GetActiveList() {
+		active[h] = true
+	}
+
+	out := GossipHostsResponse{Hosts: make([]GossipHost, 0, len(hosts))}
+	for _, h := range hosts {
+		if !active[h.Host] {
+			continue
+		}
+		out.Hosts = append(out.Hosts, GossipHost{
+			Host:           h.Host,
+			RepoCount:      h.RepoCount,
+			Tier:           h.Tier,
+			FirstSeen:      h.CreatedAt,
+			LastIncidentAt: h.LastIncidentAt,
+		})
+	}
+
+	e.Response().Header().Set("Cache-Control", "public, max-age=300")
+	return e.JSON(http.StatusOK, out)
+}
@@ -0,0 +1,359 @@
+package bgs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+)
+
+// Thresholds a host's repo count growth can trip
+const (
+	GrowthThresholdNewRepos = "max_new_repos"
+	GrowthThresholdFactor   = "max_growth_factor"
+)
+
+type GrowthMonitorOptions struct {
+	// Interval between samples of each host's repo count, zero disables the
+	// monitor
+	Interval time.Duration
+	// Period growth is measured over
+	Window time.Duration
+
+	// Alert when a host gains more than this many repos within Window; zero
+	// disables the threshold
+	MaxNewRepos int64
+	// Alert when a host's repo count grows by more than this factor within
+	// Window, eg. 2 for doubling; zero disables the threshold. Only applies
+	// once the host has gained MinNewRepos, so small hosts don't trip it.
+	MaxGrowthFactor float64
+	MinNewRepos     int64
+
+	// If set, hosts are blocked and disconnected when they alert, until an
+	// admin unblocks them
+	Pause bool
+	// If set, alerts are POSTed to this URL as JSON
+	WebhookURL     string
+	WebhookTimeout time.Duration
+}
+
+func DefaultGrowthMonitorOptions() *GrowthMonitorOptions {
+	return &GrowthMonitorOptions{
+		Interval:       time.Minute,
+		Window:         time.Hour,
+		MinNewRepos:    100,
+		WebhookTimeout: 10 * time.Second,
+	}
+}
+
+type repoCountSample struct {
+	at    time.Time
+	count int64
+}
+
+// HostGrowth is a host's repo count, and how much it grew within the window
+type HostGrowth struct {
+	Host      string     `json:"host"`
+	RepoCount int64      `json:"repo_count"`
+	NewRepos  int64      `json:"new_repos"`
+	PerHour   float64    `json:"per_hour"`
+	Since     time.Time  `json:"since"`
+	AlertedAt *time.Time `json:"alerted_at,omitempty"`
+}
+
+// GrowthAlert is the body of the webhook sent when a host trips a threshold
+type GrowthAlert struct {
+	Event     string    `json:"event"`
+	Host      string    `json:"host"`
+	Threshold string    `json:"threshold"`
+	RepoCount int64     `json:"repo_count"`
+	NewRepos  int64     `json:"new_repos"`
+	Since     time.Time `json:"since"`
+	Paused    bool      `json:"paused"`
+	Time      time.Time `json:"time"`
+}
+
+// GrowthMonitor samples every host's repo count, exporting it along with how
+// fast it's growing, and raises an alert when a host grows faster than the
+// configured thresholds; a sudden burst of new accounts is a common sign of a
+// spam PDS. Each host alerts at most once per window.
+type GrowthMonitor struct {
+	opts   GrowthMonitorOptions
+	client *http.Client
+
+	lk      sync.Mutex
+	samples map[uint][]repoCountSample
+	hosts   map[uint]string
+	alerted map[uint]time.Time
+
+	exit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewGrowthMonitor(opts *GrowthMonitorOptions) (*GrowthMonitor, error) {
+	if opts == nil {
+		opts = DefaultGrowthMonitorOptions()
+	}
+	if opts.Interval > 0 && opts.Window < opts.Interval {
+		return nil, fmt.Errorf("growth window (%s) must be at least the sample interval (%s)", opts.Window, opts.Interval)
+	}
+
+	return &GrowthMonitor{
+		opts:    *opts,
+		client:  &http.Client{Timeout: opts.WebhookTimeout},
+		samples: make(map[uint][]repoCountSample),
+		hosts:   make(map[uint]string),
+		alerted: make(map[uint]time.Time),
+		exit:    make(chan struct{}),
+	}, nil
+}
+
+// Start starts the sampling routine, if enabled
+func (gm *GrowthMonitor) Start(bgs *BGS) {
+	if gm.opts.Interval <= 0 {
+		return
+	}
+
+	log.Infow("starting repo growth monitor", "interval", gm.opts.Interval, "window", gm.opts.Window)
+
+	gm.wg.Add(1)
+	go func() {
+		defer gm.wg.Done()
+
+		t := time.NewTicker(gm.opts.Interval)
+		defer t.Stop()
+		for {
+			if err := gm.RunPass(context.Background(), bgs); err != nil {
+				log.Errorw("repo growth monitor pass failed", "err", err)
+			}
+
+			select {
+			case <-gm.exit:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+// Shutdown stops the sampling routine, waiting for webhooks in flight
+func (gm *GrowthMonitor) Shutdown() {
+	close(gm.exit)
+	gm.wg.Wait()
+}
+
+// RunPass samples every host's repo count and raises alerts for hosts over a
+// threshold
+func (gm *GrowthMonitor) RunPass(ctx context.Context, bgs *BGS) error {
+	var hosts []models.PDS
+	if err := bgs.db.WithContext(ctx).Model(&models.PDS{}).Select("id, host, repo_count, blocked").Find(&hosts).Error; err != nil {
+		return fmt.Errorf("listing hosts: %w", err)
+	}
+
+	now := time.Now()
+	cutoff := now.Add(-gm.opts.Window)
+	seen := make(map[uint]bool, len(hosts))
+
+	var total int64
+	var alerts []GrowthAlert
+	var alertHosts []*models.PDS
+
+	gm.lk.Lock()
+	for i := range hosts {
+		pds := &hosts[i]
+		seen[pds.ID] = true
+		total += pds.RepoCount
+
+		samples := append(gm.samples[pds.ID], repoCountSample{at: now, count: pds.RepoCount})
+		for len(samples) > 1 && samples[0].at.Before(cutoff) {
+			samples = samples[1:]
+		}
+		gm.samples[pds.ID] = samples
+		gm.hosts[pds.ID] = pds.Host
+
+		base := samples[0]
+		newRepos := pds.RepoCount - base.count
+		pdsRepoCount.WithLabelValues(pds.Host).Set(float64(pds.RepoCount))
+		pdsRepoGrowth.WithLabelValues(pds.Host).Set(float64(newRepos))
+
+		if pds.Blocked {
+			continue
+		}
+		if last, ok := gm.alerted[pds.ID]; ok && now.Sub(last) < gm.opts.Window {
+			continue
+		}
+
+		threshold := gm.exceeded(base.count, newRepos)
+		if threshold == "" {
+			continue
+		}
+		gm.alerted[pds.ID] = now
+		alerts = append(alerts, GrowthAlert{
+			Event:     "repo_growth",
+			Host:      pds.Host,
+			Threshold: threshold,
+			RepoCount: pds.RepoCount,
+			NewRepos:  newRepos,
+			Since:     base.at,
+			Paused:    gm.opts.Pause,
+			Time:      now,
+		})
+		alertHosts = append(alertHosts, pds)
+	}
+
+	// forget hosts that have been removed
+	for id := range gm.samples {
+		if !seen[id] {
+			pdsRepoCount.DeleteLabelValues(gm.hosts[id])
+			pdsRepoGrowth.DeleteLabelValues(gm.hosts[id])
+			delete(gm.samples, id)
+			delete(gm.hosts, id)
+			delete(gm.alerted, id)
+		}
+	}
+	gm.lk.Unlock()
+
+	repoCountTotal.Set(float64(total))
+
+	for i := range alerts {
+		gm.raise(ctx, bgs, alertHosts[i], &alerts[i])
+	}
+	return nil
+}
+
+// exceeded returns the threshold growth from base by newRepos trips, if any
+func (gm *GrowthMonitor) exceeded(base, newRepos int64) string {
+	if gm.opts.MaxNewRepos > 0 && newRepos > gm.opts.MaxNewRepos {
+		return GrowthThresholdNewRepos
+	}
+	if gm.opts.MaxGrowthFactor > 0 && newRepos >= gm.opts.MinNewRepos && newRepos > 0 {
+		if base <= 0 || float64(base+newRepos)/float64(base) > gm.opts.MaxGrowthFactor {
+			return GrowthThresholdFactor
+		}
+	}
+	return ""
+}
+
+func (gm *GrowthMonitor) raise(ctx context.Context, bgs *BGS, pds *models.PDS, alert *GrowthAlert) {
+	log.Warnw("host repo count growing faster than threshold", "host", alert.Host, "threshold", alert.Threshold,
+		"repoCount", alert.RepoCount, "newRepos", alert.NewRepos, "since", alert.Since, "pause", alert.Paused)
+
+	action := "alerted"
+	if alert.Paused {
+		action = "paused"
+		if err := gm.pause(ctx, bgs, pds); err != nil {
+			log.Errorw("failed to pause host for repo growth", "host", pds.Host, "err", err)
+		}
+	} else {
+		bgs.tiers.RecordIncident(ctx, bgs.db, pds.ID, "repo_growth")
+	}
+	growthAlerts.WithLabelValues(action).Inc()
+
+	if gm.opts.WebhookURL == "" {
+		return
+	}
+	gm.wg.Add(1)
+	go func() {
+		defer gm.wg.Done()
+		if err := gm.sendWebhook(alert); err != nil {
+			log.Errorw("failed to send repo growth alert webhook", "host", alert.Host, "err", err)
+			growthWebhookFailures.Inc()
+		}
+	}()
+}
+
+// pause blocks the host and drops its connection; the block also restarts
+// the clean history the host needs for tier promotion
+func (gm *GrowthMonitor) pause(ctx context.Context, bgs *BGS, pds *models.PDS) error {
+	if err := bgs.db.WithContext(ctx).Model(&models.PDS{}).Where("id = ?", pds.ID).Updates(map[string]any{
+		"blocked":          true,
+		"last_incident_at": time.Now(),
+	}).Error; err != nil {
+		return err
+	}
+
+	err := bgs.slurper.KillUpstreamConnection(pds.Host, false)
+	if err != nil && !errors.Is(err, ErrNoActiveConnection) {
+		return err
+	}
+	return nil
+}
+
+func (gm *GrowthMonitor) sendWebhook(alert *GrowthAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", gm.opts.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "indigo-relay")
+
+	resp, err := gm.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// newRepos returns how many repos the host gained within the window, if it
+// has been sampled
+func (gm *GrowthMonitor) newRepos(id uint) (int64, bool) {
+	gm.lk.Lock()
+	defer gm.lk.Unlock()
+
+	samples, ok := gm.samples[id]
+	if !ok {
+		return 0, false
+	}
+	return samples[len(samples)-1].count - samples[0].count, true
+}
+
+// Growth returns the hosts that grew the most within the window, most first
+func (gm *GrowthMonitor) Growth(limit int) []HostGrowth {
+	gm.lk.Lock()
+	defer gm.lk.Unlock()
+
+	out := make([]HostGrowth, 0, len(gm.samples))
+	for id, samples := range gm.samples {
+		first, last := samples[0], samples[len(samples)-1]
+		hg := HostGrowth{
+			Host:      gm.hosts[id],
+			RepoCount: last.count,
+			NewRepos:  last.count - first.count,
+			Since:     first.at,
+		}
+		if d := last.at.Sub(first.at); d > 0 {
+			hg.PerHour = float64(hg.NewRepos) / d.Hours()
+		}
+		if at, ok := gm.alerted[id]; ok {
+			hg.AlertedAt = &at
+		}
+		out = append(out, hg)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].NewRepos != out[j].NewRepos {
+			return out[i].NewRepos > out[j].NewRepos
+		}
+		return out[i].Host < out[j].Host
+	})
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
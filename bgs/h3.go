@@ -0,0 +1,215 @@
+package bgs
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bluesky-social/indigo/events"
+
+	promclient "github.com/prometheus/client_golang/prometheus"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// H3StreamContentType is the content type of the HTTP/3 firehose stream. The
+// body is a sequence of frames, each the same header+body DAG-CBOR bytes
+// carried by a websocket message on the regular endpoint, prefixed with its
+// length as a uvarint.
+const H3StreamContentType = "application/vnd.atproto.firehose-frames"
+
+// StartHTTP3 serves the event stream over HTTP/3 on the given UDP address.
+// This is experimental: it exists for high-latency consumers which benefit
+// from QUIC's loss recovery and lack of head-of-line blocking. Once it is
+// running, websocket responses from the regular listener carry an Alt-Svc
+// header advertising it; consumers which can't speak HTTP/3 just keep using
+// the websocket endpoint.
+//
+// Must be called before Start; the server itself runs in the background.
+func (bgs *BGS) StartHTTP3(addr string, tlsConf *tls.Config) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("http3 listen: %w", err)
+	}
+	_, port, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/xrpc/com.atproto.sync.subscribeRepos", bgs.handleH3Subscribe)
+
+	bgs.h3srv = &http3.Server{
+		Handler:   mux,
+		TLSConfig: tlsConf,
+		QuicConfig: &quic.Config{
+			MaxIdleTimeout:  time.Minute,
+			KeepAlivePeriod: 15 * time.Second,
+		},
+	}
+	bgs.h3AltSvc = fmt.Sprintf(`h3=":%s"; ma=86400`, port)
+
+	go func() {
+		log.Infow("serving event stream over http3", "addr", conn.LocalAddr())
+		if err := bgs.h3srv.Serve(conn); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, quic.ErrServerClosed) {
+			log.Errorw("http3 server failed", "err", err)
+		}
+	}()
+	return nil
+}
+
+func (bgs *BGS) handleH3Subscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeXRPCError(w, apiError(http.StatusMethodNotAllowed, XRPCErrInvalidRequest, "method not allowed"))
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeXRPCError(w, apiError(http.StatusInternalServerError, XRPCErrInternal, "streaming not supported"))
+		return
+	}
+
+	version, err := events.NegotiateStreamVersion(r.URL.Query().Get(events.StreamVersionParam))
+	if err != nil {
+		streamVersionRejected.Inc()
+		writeXRPCError(w, apiError(http.StatusBadRequest, XRPCErrInvalidRequest, "%s", err))
+		return
+	}
+	excluded, err := parseExcludeTypes(r.URL.Query()[excludeTypesParam])
+	if err != nil {
+		writeXRPCError(w, apiError(http.StatusBadRequest, XRPCErrInvalidRequest, "%s", err))
+		return
+	}
+	since, cursorErr := bgs.parseSubscribeCursor(r.Context(), r.URL.Query().Get("cursor"), r.URL.Query().Get("cursorTime"))
+	var ce *events.CursorError
+	if cursorErr != nil && !errors.As(cursorErr, &ce) {
+		log.Errorw("failed to resolve h3 subscriber cursor", "err", cursorErr)
+		writeXRPCError(w, apiError(http.StatusInternalServerError, XRPCErrInternal, "failed to resolve cursor"))
+		return
+	}
+
+	identity, release, err := bgs.admitSubscriber(r.Context(), r)
+	if err != nil {
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) {
+			apiErr = apiError(http.StatusInternalServerError, XRPCErrInternal, "internal error")
+		}
+		writeXRPCError(w, apiErr)
+		return
+	}
+	defer release()
+
+	w.Header().Set("Content-Type", H3StreamContentType)
+	w.Header().Set(events.StreamVersionHeader, strconv.Itoa(version))
+	if ce := bgs.events.CursorEpochs(); ce != nil {
+		w.Header().Set(events.CursorEpochHeader, events.FormatCursorEpoch(ce.Current()))
+	}
+	w.WriteHeader(http.StatusOK)
+
+	fw := events.NewFrameWriter(version)
+	var lenbuf [binary.MaxVarintLen64]byte
+	var frame bytes.Buffer
+	writeFrame := func(evt *events.XRPCStreamEvent) (int64, error) {
+		frame.Reset()
+		if err := fw.WriteFrame(&frame, evt); err != nil {
+			return 0, err
+		}
+		n := binary.PutUvarint(lenbuf[:], uint64(frame.Len()))
+		if _, err := w.Write(lenbuf[:n]); err != nil {
+			return 0, err
+		}
+		if _, err := w.Write(frame.Bytes()); err != nil {
+			return 0, err
+		}
+		flusher.Flush()
+		return int64(n + frame.Len()), nil
+	}
+
+	// as on the websocket endpoint, cursor problems are reported in-stream
+	if ce != nil {
+		writeFrame(&events.XRPCStreamEvent{Error: &events.ErrorFrame{Error: ce.Name, Message: ce.Message}})
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	remoteAddr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteAddr = r.RemoteAddr
+	}
+	ident := remoteAddr + "-" + r.UserAgent()
+
+	filter := excludeTypesFilter(excluded, func(evt *events.XRPCStreamEvent) bool { return true })
+	evts, cleanup, err := bgs.events.Subscribe(ctx, ident, filter, since)
+	if err != nil {
+		log.Errorw("failed to subscribe http3 consumer", "err", err)
+		return
+	}
+	defer cleanup()
+
+	consumer := &SocketConsumer{
+		RemoteAddr:    remoteAddr,
+		UserAgent:     r.UserAgent(),
+		ConnectedAt:   time.Now(),
+		Transport:     "http3",
+		StreamVersion: version,
+		Identity:      identity,
+		replayCh:      make(chan *events.XRPCStreamEvent),
+		filter:        filter,
+	}
+	sentCounter := eventsSentCounter.WithLabelValues(consumer.RemoteAddr, consumer.UserAgent)
+	consumer.EventsSent = sentCounter
+	versionSentCounter := streamVersionEventsSent.WithLabelValues(strconv.Itoa(version))
+	var identitySentCounter promclient.Counter
+	if identity != "" {
+		identitySentCounter = subscriberEventsSent.WithLabelValues(identity)
+	}
+
+	consumerID := bgs.registerConsumer(consumer, since)
+	defer bgs.cleanupConsumer(consumerID)
+
+	logger := log.With(
+		"consumer_id", consumerID,
+		"remote_addr", consumer.RemoteAddr,
+		"user_agent", consumer.UserAgent,
+		"transport", consumer.Transport,
+		"identity", consumer.Identity,
+	)
+	logger.Infow("new consumer", "cursor", since, "stream_version", version)
+
+	for {
+		var evt *events.XRPCStreamEvent
+		select {
+		case e, ok := <-evts:
+			if !ok {
+				logger.Error("event stream closed unexpectedly")
+				return
+			}
+			evt = e
+		case evt = <-consumer.replayCh:
+		case <-ctx.Done():
+			return
+		}
+
+		n, err := writeFrame(evt)
+		if err != nil {
+			logger.Warnw("failed to write event", "err", err)
+			return
+		}
+		consumer.BytesSent.Add(n)
+		sentCounter.Inc()
+		versionSentCounter.Inc()
+		if identitySentCounter != nil {
+			identitySentCounter.Inc()
+		}
+	}
+}
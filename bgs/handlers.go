@@ -14,58 +14,67 @@ import (
 	comatprototypes "github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/carstore"
 	"github.com/bluesky-social/indigo/events"
-	"github.com/bluesky-social/indigo/mst"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/repomgr"
 	"gorm.io/gorm"
 
 	"github.com/bluesky-social/indigo/xrpc"
 	"github.com/ipfs/go-cid"
 	cbor "github.com/ipfs/go-ipld-cbor"
 	"github.com/ipld/go-car"
-	"github.com/labstack/echo/v4"
 )
 
-func (s *BGS) handleComAtprotoSyncGetRecord(ctx context.Context, collection string, did string, rkey string) (io.Reader, error) {
-	u, err := s.lookupUserByDid(ctx, did)
-	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, echo.NewHTTPError(http.StatusNotFound, "user not found")
-		}
-		log.Errorw("failed to lookup user", "err", err, "did", did)
-		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to lookup user")
-	}
-
-	if u.Tombstoned {
-		return nil, fmt.Errorf("account was deleted")
-	}
+// errIndexOnly is returned by sync endpoints that serve repo data, which an
+// index-only relay doesn't keep
+func errIndexOnly() error {
+	return apiError(http.StatusNotImplemented, XRPCErrNotImplemented, "this relay does not keep repo data")
+}
 
-	if u.TakenDown {
-		return nil, fmt.Errorf("account was taken down by the Relay")
+func (s *BGS) handleComAtprotoSyncGetRecord(ctx context.Context, collection string, did string, rkey string) (io.Reader, error) {
+	if s.repoman.IndexOnly() {
+		return nil, errIndexOnly()
 	}
 
-	if u.UpstreamStatus == events.AccountStatusTakendown {
-		return nil, fmt.Errorf("account was taken down by its PDS")
+	u, err := s.lookupRepo(ctx, did)
+	if err != nil {
+		return nil, err
 	}
 
-	if u.UpstreamStatus == events.AccountStatusDeactivated {
-		return nil, fmt.Errorf("account is temporarily deactivated")
+	// a missing record is served like any other, with the blocks proving
+	// it isn't there, so clients can tell it's absent rather than withheld
+	root, rec, blocks, err := s.repoman.GetRecordProof(ctx, u.ID, collection, rkey)
+	if err != nil {
+		if errors.Is(err, repomgr.ErrRepoHasNoCommits) {
+			return nil, apiError(http.StatusNotFound, XRPCErrRepoNotFound, "repo has no commits: %s", did)
+		}
+		ctxLog(ctx).Errorw("failed to get record from repo", "err", err, "did", did, "collection", collection, "rkey", rkey)
+		return nil, apiError(http.StatusInternalServerError, XRPCErrInternal, "failed to get record from repo")
 	}
-
-	if u.UpstreamStatus == events.AccountStatusSuspended {
-		return nil, fmt.Errorf("account is suspended by its PDS")
+	if rec.Defined() {
+		recordProofsServed.WithLabelValues("inclusion").Inc()
+	} else {
+		recordProofsServed.WithLabelValues("exclusion").Inc()
 	}
 
-	root, blocks, err := s.repoman.GetRecordProof(ctx, u.ID, collection, rkey)
-	if err != nil {
-		if errors.Is(err, mst.ErrNotFound) {
-			return nil, echo.NewHTTPError(http.StatusNotFound, "record not found in repo")
+	roots := []cid.Cid{root}
+	if s.redactor != nil {
+		var redacted cid.Cid
+		blocks, redacted, err = s.redactor.redactProof(collection, rec, blocks)
+		if err != nil {
+			// better to fail than serve what should have been removed
+			ctxLog(ctx).Errorw("failed to redact record", "err", err, "did", did, "collection", collection, "rkey", rkey)
+			return nil, apiError(http.StatusInternalServerError, XRPCErrInternal, "failed to get record from repo")
+		}
+		// the proof leads to the original record; the redacted one is
+		// named as a second root so clients can find it
+		if redacted.Defined() {
+			roots = append(roots, redacted)
 		}
-		log.Errorw("failed to get record from repo", "err", err, "did", did, "collection", collection, "rkey", rkey)
-		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get record from repo")
 	}
 
 	buf := new(bytes.Buffer)
 	hb, err := cbor.DumpObject(&car.CarHeader{
-		Roots:   []cid.Cid{root},
+		Roots:   roots,
 		Version: 1,
 	})
 	if _, err := carstore.LdWrite(buf, hb); err != nil {
@@ -81,54 +90,154 @@ func (s *BGS) handleComAtprotoSyncGetRecord(ctx context.Context, collection stri
 	return buf, nil
 }
 
-func (s *BGS) handleComAtprotoSyncGetRepo(ctx context.Context, did string, since string) (io.Reader, error) {
-	u, err := s.lookupUserByDid(ctx, did)
+// handleComAtprotoSyncGetRepo writes the repo to w, buffering up to the
+// request's share of the read budget and streaming the rest, compressed if
+// acceptEncoding allows
+func (s *BGS) handleComAtprotoSyncGetRepo(ctx context.Context, did string, since string, acceptEncoding string, w http.ResponseWriter) error {
+	if s.repoman.IndexOnly() {
+		return errIndexOnly()
+	}
+
+	u, err := s.lookupRepo(ctx, did)
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, echo.NewHTTPError(http.StatusNotFound, "user not found")
+		return err
+	}
+
+	// the repo's storage is an upper bound on its size; if it can't be
+	// found the request reserves the most it could buffer
+	var size int64
+	if us, err := s.repoman.CarStore().UserStorage(ctx, u.ID); err == nil {
+		size = us.Bytes
+	}
+
+	release, err := s.reads.Acquire(ctx, size)
+	if err != nil {
+		if errors.Is(err, errReadBudgetExhausted) {
+			return s.reads.budgetExhaustedError()
+		}
+		return err
+	}
+	defer release()
+
+	out := newStreamWriter(w, "application/vnd.ipld.car", s.reads.reservation(size))
+	cw := s.compression.wrap(acceptEncoding, out)
+	defer cw.release()
+	out.contentEncoding = cw.Encoding()
+
+	if err := s.repoman.ReadRepo(ctx, u.ID, since, cw); err != nil {
+		if out.Committed() {
+			// too late to send an error; the client sees a truncated CAR
+			ctxLog(ctx).Errorw("failed to stream repo", "err", err, "did", did)
+			return nil
 		}
-		log.Errorw("failed to lookup user", "err", err, "did", did)
-		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to lookup user")
+		ctxLog(ctx).Errorw("failed to read repo", "err", err, "did", did)
+		return apiError(http.StatusInternalServerError, XRPCErrInternal, "failed to read repo")
 	}
 
-	if u.Tombstoned {
-		return nil, fmt.Errorf("account was deleted")
+	if err := cw.Close(); err != nil {
+		ctxLog(ctx).Warnw("failed to finish compressing repo", "err", err, "did", did)
+	}
+	if err := out.Close(); err != nil {
+		ctxLog(ctx).Warnw("failed to finish streaming repo", "err", err, "did", did)
 	}
+	return nil
+}
+
+// maximum number of cids that may be requested in a single getBlocks call
+const maxGetBlocksCids = 1000
 
-	if u.TakenDown {
-		return nil, fmt.Errorf("account was taken down by the Relay")
+// bytes reserved from the read budget for each cid requested from getBlocks,
+// generously more than a typical record or MST node
+const getBlocksBytesPerCid = 4 << 10
+
+func (s *BGS) handleComAtprotoSyncGetBlocks(ctx context.Context, cids []string, did string) (io.Reader, error) {
+	if s.repoman.IndexOnly() {
+		return nil, errIndexOnly()
+	}
+	if len(cids) == 0 {
+		return nil, apiError(http.StatusBadRequest, XRPCErrInvalidRequest, "must request at least one cid")
+	}
+	if len(cids) > maxGetBlocksCids {
+		return nil, apiError(http.StatusBadRequest, XRPCErrInvalidRequest, "too many cids requested (max %d)", maxGetBlocksCids)
 	}
 
-	if u.UpstreamStatus == events.AccountStatusTakendown {
-		return nil, fmt.Errorf("account was taken down by its PDS")
+	u, err := s.lookupRepo(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+
+	want := make([]cid.Cid, 0, len(cids))
+	for _, c := range cids {
+		cc, err := cid.Decode(c)
+		if err != nil {
+			return nil, apiError(http.StatusBadRequest, XRPCErrInvalidRequest, "invalid cid: %s", c)
+		}
+		want = append(want, cc)
+	}
+
+	release, err := s.reads.Acquire(ctx, int64(len(want))*getBlocksBytesPerCid)
+	if err != nil {
+		if errors.Is(err, errReadBudgetExhausted) {
+			return nil, s.reads.budgetExhaustedError()
+		}
+		return nil, err
+	}
+	defer release()
+
+	root, err := s.repoman.GetRepoRoot(ctx, u.ID)
+	if err != nil {
+		ctxLog(ctx).Errorw("failed to get repo root", "err", err, "did", did)
+		return nil, apiError(http.StatusInternalServerError, XRPCErrInternal, "failed to get repo root")
 	}
 
-	if u.UpstreamStatus == events.AccountStatusDeactivated {
-		return nil, fmt.Errorf("account is temporarily deactivated")
+	blocks, err := s.repoman.GetBlocks(ctx, u.ID, want)
+	if err != nil {
+		ctxLog(ctx).Errorw("failed to read blocks", "err", err, "did", did, "count", len(want))
+		return nil, apiError(http.StatusInternalServerError, XRPCErrInternal, "failed to read blocks")
 	}
 
-	if u.UpstreamStatus == events.AccountStatusSuspended {
-		return nil, fmt.Errorf("account is suspended by its PDS")
+	if len(blocks) < len(want) {
+		found := make(map[cid.Cid]bool, len(blocks))
+		for _, blk := range blocks {
+			found[blk.Cid()] = true
+		}
+		var missing []string
+		for _, c := range want {
+			if !found[c] {
+				missing = append(missing, c.String())
+			}
+		}
+		if len(missing) > 0 {
+			return nil, apiError(http.StatusBadRequest, XRPCErrBlockNotFound, "could not find cids: %s", strings.Join(missing, ","))
+		}
 	}
 
-	// TODO: stream the response
 	buf := new(bytes.Buffer)
-	if err := s.repoman.ReadRepo(ctx, u.ID, since, buf); err != nil {
-		log.Errorw("failed to read repo into buffer", "err", err, "did", did)
-		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to read repo into buffer")
+	hb, err := cbor.DumpObject(&car.CarHeader{
+		Roots:   []cid.Cid{root},
+		Version: 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := carstore.LdWrite(buf, hb); err != nil {
+		return nil, err
 	}
 
-	return buf, nil
-}
+	for _, blk := range blocks {
+		if _, err := carstore.LdWrite(buf, blk.Cid().Bytes(), blk.RawData()); err != nil {
+			return nil, err
+		}
+	}
 
-func (s *BGS) handleComAtprotoSyncGetBlocks(ctx context.Context, cids []string, did string) (io.Reader, error) {
-	return nil, fmt.Errorf("NYI")
+	return buf, nil
 }
 
-func (s *BGS) handleComAtprotoSyncRequestCrawl(ctx context.Context, body *comatprototypes.SyncRequestCrawl_Input) error {
-	host := body.Hostname
+// parseCrawlHost validates a hostname passed in a crawl request, returning
+// it as a URL on the scheme this relay uses for PDSs
+func (s *BGS) parseCrawlHost(host string) (*url.URL, error) {
 	if host == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "must pass hostname")
+		return nil, apiError(http.StatusBadRequest, XRPCErrInvalidRequest, "must pass hostname")
 	}
 
 	if !strings.HasPrefix(host, "http://") && !strings.HasPrefix(host, "https://") {
@@ -141,45 +250,62 @@ func (s *BGS) handleComAtprotoSyncRequestCrawl(ctx context.Context, body *comatp
 
 	u, err := url.Parse(host)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to parse hostname")
+		return nil, apiError(http.StatusBadRequest, XRPCErrInvalidRequest, "failed to parse hostname")
 	}
 
 	if u.Scheme == "http" && s.ssl {
-		return echo.NewHTTPError(http.StatusBadRequest, "this server requires https")
+		return nil, apiError(http.StatusBadRequest, XRPCErrInvalidRequest, "this server requires https")
 	}
 
 	if u.Scheme == "https" && !s.ssl {
-		return echo.NewHTTPError(http.StatusBadRequest, "this server does not support https")
+		return nil, apiError(http.StatusBadRequest, XRPCErrInvalidRequest, "this server does not support https")
 	}
 
 	if u.Path != "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "must pass hostname without path")
+		return nil, apiError(http.StatusBadRequest, XRPCErrInvalidRequest, "must pass hostname without path")
 	}
 
 	if u.Query().Encode() != "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "must pass hostname without query")
+		return nil, apiError(http.StatusBadRequest, XRPCErrInvalidRequest, "must pass hostname without query")
+	}
+
+	return u, nil
+}
+
+func (s *BGS) handleComAtprotoSyncRequestCrawl(ctx context.Context, body *comatprototypes.SyncRequestCrawl_Input) error {
+	u, err := s.parseCrawlHost(body.Hostname)
+	if err != nil {
+		return err
 	}
 
-	host = u.Host // potentially hostname:port
+	host := u.Host // potentially hostname:port
 
 	banned, err := s.domainIsBanned(ctx, host)
 	if banned {
-		return echo.NewHTTPError(http.StatusUnauthorized, "domain is banned")
+		s.alerts.observeDeniedCrawl(host)
+		return apiError(http.StatusUnauthorized, XRPCErrHostBanned, "domain is banned")
 	}
 
-	log.Warnf("TODO: better host validation for crawl requests")
+	if err := s.checkAdmission(ctx, &AdmissionRequest{Kind: AdmissionKindHost, Host: host}); err != nil {
+		if isNotAdmitted(err) {
+			return apiError(http.StatusForbidden, XRPCErrHostNotAllowed, "%s", err)
+		}
+		return apiError(http.StatusServiceUnavailable, XRPCErrUnavailable, "unable to check host admission")
+	}
+
+	ctxLog(ctx).Warnf("TODO: better host validation for crawl requests")
 
 	clientHost := fmt.Sprintf("%s://%s", u.Scheme, host)
 
 	c := &xrpc.Client{
 		Host:   clientHost,
-		Client: http.DefaultClient, // not using the client that auto-retries
+		Client: s.hostClient, // not using the client that auto-retries
 	}
+	s.identity.applyToClient(c)
 
 	desc, err := atproto.ServerDescribeServer(ctx, c)
 	if err != nil {
-		errMsg := fmt.Sprintf("requested host (%s) failed to respond to describe request", clientHost)
-		return echo.NewHTTPError(http.StatusBadRequest, errMsg)
+		return apiError(http.StatusBadRequest, XRPCErrHostUnreachable, "requested host (%s) failed to respond to describe request", clientHost)
 	}
 
 	// Maybe we could do something with this response later
@@ -193,19 +319,22 @@ func (s *BGS) handleComAtprotoSyncNotifyOfUpdate(ctx context.Context, body *coma
 	return nil
 }
 
-func (s *BGS) handleComAtprotoSyncListRepos(ctx context.Context, cursor int64, limit int) (*comatprototypes.SyncListRepos_Output, error) {
-	// Filter out tombstoned, taken down, and deactivated accounts
-	q := fmt.Sprintf("id > ? AND NOT tombstoned AND NOT taken_down AND (upstream_status is NULL OR (upstream_status != '%s' AND upstream_status != '%s' AND upstream_status != '%s'))",
-		events.AccountStatusDeactivated, events.AccountStatusSuspended, events.AccountStatusTakendown)
+// activeUserFilter is a condition on the named users table that filters out
+// tombstoned, taken down, and deactivated accounts
+func activeUserFilter(table string) string {
+	return fmt.Sprintf("NOT %[1]s.tombstoned AND NOT %[1]s.taken_down AND (%[1]s.upstream_status is NULL OR (%[1]s.upstream_status != '%[2]s' AND %[1]s.upstream_status != '%[3]s' AND %[1]s.upstream_status != '%[4]s'))",
+		table, events.AccountStatusDeactivated, events.AccountStatusSuspended, events.AccountStatusTakendown)
+}
 
+func (s *BGS) handleComAtprotoSyncListRepos(ctx context.Context, cursor int64, limit int) (*comatprototypes.SyncListRepos_Output, error) {
 	// Load the users
 	users := []*User{}
-	if err := s.db.Model(&User{}).Where(q, cursor).Order("id").Limit(limit).Find(&users).Error; err != nil {
+	if err := s.db.Model(&User{}).Where("id > ?", cursor).Where(activeUserFilter("users")).Order("id").Limit(limit).Find(&users).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return &comatprototypes.SyncListRepos_Output{}, nil
 		}
-		log.Errorw("failed to query users", "err", err)
-		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to query users")
+		ctxLog(ctx).Errorw("failed to query users", "err", err)
+		return nil, apiError(http.StatusInternalServerError, XRPCErrInternal, "failed to query users")
 	}
 
 	if len(users) == 0 {
@@ -225,8 +354,8 @@ func (s *BGS) handleComAtprotoSyncListRepos(ctx context.Context, cursor int64, l
 
 		root, err := s.repoman.GetRepoRoot(ctx, user.ID)
 		if err != nil {
-			log.Errorw("failed to get repo root", "err", err, "did", user.Did)
-			return nil, echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("failed to get repo root for (%s): %v", user.Did, err.Error()))
+			ctxLog(ctx).Errorw("failed to get repo root", "err", err, "did", user.Did)
+			return nil, apiError(http.StatusInternalServerError, XRPCErrInternal, "failed to get repo root for %s", user.Did)
 		}
 
 		resp.Repos[i] = &comatprototypes.SyncListRepos_Repo{
@@ -244,45 +373,42 @@ func (s *BGS) handleComAtprotoSyncListRepos(ctx context.Context, cursor int64, l
 	return resp, nil
 }
 
-func (s *BGS) handleComAtprotoSyncGetLatestCommit(ctx context.Context, did string) (*comatprototypes.SyncGetLatestCommit_Output, error) {
-	u, err := s.lookupUserByDid(ctx, did)
+func (s *BGS) handleComAtprotoSyncListReposByCollection(ctx context.Context, collection string, cursor int64, limit int) (*comatprototypes.SyncListReposByCollection_Output, error) {
+	repos, err := s.collections.ListRepos(ctx, collection, models.Uid(cursor), limit)
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, echo.NewHTTPError(http.StatusNotFound, "user not found")
-		}
-		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to lookup user")
+		ctxLog(ctx).Errorw("failed to list repos by collection", "err", err, "collection", collection)
+		return nil, apiError(http.StatusInternalServerError, XRPCErrInternal, "failed to list repos")
 	}
 
-	if u.Tombstoned {
-		return nil, fmt.Errorf("account was deleted")
+	resp := &comatprototypes.SyncListReposByCollection_Output{
+		Repos: make([]*comatprototypes.SyncListReposByCollection_Repo, len(repos)),
 	}
-
-	if u.TakenDown {
-		return nil, fmt.Errorf("account was taken down by the Relay")
-	}
-
-	if u.UpstreamStatus == events.AccountStatusTakendown {
-		return nil, fmt.Errorf("account was taken down by its PDS")
+	for i, r := range repos {
+		resp.Repos[i] = &comatprototypes.SyncListReposByCollection_Repo{Did: r.Did}
 	}
 
-	if u.UpstreamStatus == events.AccountStatusDeactivated {
-		return nil, fmt.Errorf("account is temporarily deactivated")
+	// If this is not the last page, set the cursor
+	if len(repos) >= limit {
+		nextCursor := fmt.Sprintf("%d", repos[len(repos)-1].Uid)
+		resp.Cursor = &nextCursor
 	}
 
-	if u.UpstreamStatus == events.AccountStatusSuspended {
-		return nil, fmt.Errorf("account is suspended by its PDS")
-	}
+	return resp, nil
+}
 
-	root, err := s.repoman.GetRepoRoot(ctx, u.ID)
+func (s *BGS) handleComAtprotoSyncGetLatestCommit(ctx context.Context, did string) (*comatprototypes.SyncGetLatestCommit_Output, error) {
+	u, err := s.lookupRepo(ctx, did)
 	if err != nil {
-		log.Errorw("failed to get repo root", "err", err, "did", u.Did)
-		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get repo root")
+		return nil, err
 	}
 
-	rev, err := s.repoman.GetRepoRev(ctx, u.ID)
+	root, rev, err := s.repoman.GetLatestCommit(ctx, u.ID)
 	if err != nil {
-		log.Errorw("failed to get repo rev", "err", err, "did", u.Did)
-		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get repo rev")
+		if errors.Is(err, repomgr.ErrRepoHasNoCommits) {
+			return nil, apiError(http.StatusNotFound, XRPCErrRepoNotFound, "repo has no commits: %s", u.Did)
+		}
+		ctxLog(ctx).Errorw("failed to get latest commit", "err", err, "did", u.Did)
+		return nil, apiError(http.StatusInternalServerError, XRPCErrInternal, "failed to get latest commit")
 	}
 
 	return &comatprototypes.SyncGetLatestCommit_Output{
@@ -0,0 +1,282 @@
+package bgs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/api"
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/util"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/time/rate"
+)
+
+// handle value used in #identity events when the account's handle does not
+// resolve back to its DID
+const invalidHandle = "handle.invalid"
+
+// HandleVerifier periodically re-checks that each active account's handle
+// still resolves back to its DID. When the result differs from what the relay
+// has on record, the user is updated and an #identity event is emitted so
+// downstream consumers don't need to do their own verification.
+type HandleVerifier struct {
+	interval time.Duration
+	limiter  *rate.Limiter
+	pageSize int
+
+	passLk  sync.Mutex
+	running bool
+
+	exit chan struct{}
+	wg   sync.WaitGroup
+}
+
+type HandleVerifierOptions struct {
+	// Interval between full passes over all accounts, zero disables scheduled passes
+	Interval time.Duration
+	// Maximum number of handle resolutions per second
+	RateLimit float64
+	PageSize  int
+}
+
+func DefaultHandleVerifierOptions() *HandleVerifierOptions {
+	return &HandleVerifierOptions{
+		Interval:  0,
+		RateLimit: 10,
+		PageSize:  500,
+	}
+}
+
+func NewHandleVerifier(opts *HandleVerifierOptions) *HandleVerifier {
+	if opts == nil {
+		opts = DefaultHandleVerifierOptions()
+	}
+
+	return &HandleVerifier{
+		interval: opts.Interval,
+		limiter:  rate.NewLimiter(rate.Limit(opts.RateLimit), 1),
+		pageSize: opts.PageSize,
+		exit:     make(chan struct{}),
+	}
+}
+
+// Start starts the scheduled re-verification routine, if enabled
+func (hv *HandleVerifier) Start(bgs *BGS) {
+	if hv.interval <= 0 {
+		return
+	}
+
+	log.Infow("starting handle verifier", "interval", hv.interval, "rateLimit", hv.limiter.Limit())
+
+	hv.wg.Add(1)
+	go func() {
+		defer hv.wg.Done()
+
+		t := time.NewTicker(hv.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-hv.exit:
+				return
+			case <-t.C:
+				if err := hv.RunPass(context.Background(), bgs); err != nil {
+					log.Errorw("handle verification pass failed", "err", err)
+				}
+			}
+		}
+	}()
+}
+
+// Shutdown stops the verifier, interrupting any pass in progress
+func (hv *HandleVerifier) Shutdown() {
+	close(hv.exit)
+	hv.wg.Wait()
+}
+
+var errHandlePassRunning = fmt.Errorf("handle verification pass already running")
+
+// Trigger starts a pass in the background
+func (hv *HandleVerifier) Trigger(bgs *BGS) error {
+	hv.passLk.Lock()
+	running := hv.running
+	hv.passLk.Unlock()
+	if running {
+		return errHandlePassRunning
+	}
+
+	hv.wg.Add(1)
+	go func() {
+		defer hv.wg.Done()
+		if err := hv.RunPass(context.Background(), bgs); err != nil {
+			log.Errorw("handle verification pass failed", "err", err)
+		}
+	}()
+
+	return nil
+}
+
+// RunPass walks all active accounts and re-verifies their handles
+func (hv *HandleVerifier) RunPass(ctx context.Context, bgs *BGS) error {
+	hv.passLk.Lock()
+	if hv.running {
+		hv.passLk.Unlock()
+		return errHandlePassRunning
+	}
+	hv.running = true
+	hv.passLk.Unlock()
+
+	defer func() {
+		hv.passLk.Lock()
+		hv.running = false
+		hv.passLk.Unlock()
+	}()
+
+	ctx, span := otel.Tracer("bgs").Start(ctx, "HandleVerificationPass")
+	defer span.End()
+
+	start := time.Now()
+	var checked, changed, failed int
+
+	var cursor models.Uid
+	for {
+		var users []User
+		if err := bgs.db.Model(User{}).
+			Where("id > ? AND tombstoned = false AND taken_down = false", cursor).
+			Order("id asc").
+			Limit(hv.pageSize).
+			Find(&users).Error; err != nil {
+			return fmt.Errorf("failed to list users: %w", err)
+		}
+
+		if len(users) == 0 {
+			break
+		}
+
+		for i := range users {
+			select {
+			case <-hv.exit:
+				return nil
+			default:
+			}
+
+			if err := hv.limiter.Wait(ctx); err != nil {
+				return err
+			}
+
+			u := &users[i]
+			didChange, err := bgs.reverifyHandle(ctx, u)
+			checked++
+			if err != nil {
+				failed++
+				log.Debugw("failed to re-verify handle", "did", u.Did, "err", err)
+				continue
+			}
+			if didChange {
+				changed++
+			}
+		}
+
+		cursor = users[len(users)-1].ID
+	}
+
+	span.SetAttributes(
+		attribute.Int("checked", checked),
+		attribute.Int("changed", changed),
+		attribute.Int("failed", failed),
+	)
+	log.Infow("handle verification pass complete", "checked", checked, "changed", changed, "failed", failed, "duration", time.Since(start))
+
+	return nil
+}
+
+// reverifyHandle resolves the user's DID document and claimed handle, and if
+// either the handle or its validity differ from our records, updates the user
+// and emits an #identity event. A handle that no longer resolves is marked
+// invalid, but other resolution failures leave the user untouched, so that
+// transient DNS or network trouble doesn't flap handles downstream.
+func (bgs *BGS) reverifyHandle(ctx context.Context, u *User) (bool, error) {
+	ctx, span := otel.Tracer("bgs").Start(ctx, "reverifyHandle")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("did", u.Did))
+
+	bgs.didr.FlushCacheFor(u.Did)
+	doc, err := bgs.didr.GetDocument(ctx, u.Did)
+	if err != nil {
+		handleVerifications.WithLabelValues("error").Inc()
+		return false, fmt.Errorf("failed to fetch DID document: %w", err)
+	}
+
+	var handle string
+	if len(doc.AlsoKnownAs) > 0 {
+		hurl, err := url.Parse(doc.AlsoKnownAs[0])
+		if err == nil {
+			handle = hurl.Host
+		}
+	}
+
+	valid := false
+	if handle != "" {
+		resdid, err := bgs.hr.ResolveHandleToDid(ctx, handle)
+		switch {
+		case errors.Is(err, api.ErrHandleNotFound):
+			// left invalid
+		case err != nil:
+			handleVerifications.WithLabelValues("error").Inc()
+			return false, fmt.Errorf("failed to resolve handle %q: %w", handle, err)
+		default:
+			valid = resdid == u.Did
+		}
+	}
+
+	if handle == u.Handle.String && valid == u.ValidHandle {
+		handleVerifications.WithLabelValues("unchanged").Inc()
+		return false, nil
+	}
+
+	log.Infow("handle verification changed", "did", u.Did, "oldHandle", u.Handle.String, "oldValid", u.ValidHandle, "handle", handle, "valid", valid)
+
+	nh := sql.NullString{String: handle, Valid: handle != ""}
+	if err := bgs.db.Model(User{}).Where("id = ?", u.ID).Updates(map[string]any{
+		"handle":       nh,
+		"valid_handle": valid,
+	}).Error; err != nil {
+		return false, fmt.Errorf("failed to update user handle: %w", err)
+	}
+
+	if err := bgs.db.Model(models.ActorInfo{}).Where("uid = ?", u.ID).Updates(map[string]any{
+		"handle":       nh,
+		"valid_handle": valid,
+	}).Error; err != nil {
+		return false, fmt.Errorf("failed to update actorInfo handle: %w", err)
+	}
+
+	u.Handle = nh
+	u.ValidHandle = valid
+
+	evtHandle := handle
+	if !valid {
+		evtHandle = invalidHandle
+	}
+
+	if err := bgs.events.AddEvent(ctx, &events.XRPCStreamEvent{
+		RepoIdentity: &comatproto.SyncSubscribeRepos_Identity{
+			Did:    u.Did,
+			Time:   time.Now().Format(util.ISO8601),
+			Handle: &evtHandle,
+		},
+	}); err != nil {
+		return false, fmt.Errorf("failed to broadcast Identity event: %w", err)
+	}
+
+	handleVerifications.WithLabelValues("changed").Inc()
+	return true, nil
+}
@@ -0,0 +1,120 @@
+package bgs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/bluesky-social/indigo/api"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/models"
+
+	"github.com/whyrusleeping/go-did"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// handleDocs serves DID documents claiming a handle for each DID
+type handleDocs map[string]string
+
+func (d handleDocs) GetDocument(ctx context.Context, didstr string) (*did.Document, error) {
+	return &did.Document{AlsoKnownAs: []string{"at://" + d[didstr]}}, nil
+}
+
+func (d handleDocs) FlushCacheFor(didstr string) {}
+
+// handleAnswers resolves each handle to a DID, or fails with an error
+type handleAnswers map[string]any
+
+func (h handleAnswers) ResolveHandleToDid(ctx context.Context, handle string) (string, error) {
+	switch v := h[handle].(type) {
+	case string:
+		return v, nil
+	case error:
+		return "", v
+	}
+	return "", fmt.Errorf("no did record found for handle %q: %w", handle, api.ErrHandleNotFound)
+}
+
+func TestReverifyHandle(t *testing.T) {
+	ctx := context.Background()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "users.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&User{}, &models.ActorInfo{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var identities []string
+	em := events.NewEventManager(events.NewMemPersister())
+	defer em.Shutdown(ctx)
+	em.Use(func(ctx context.Context, evt *events.XRPCStreamEvent) (*events.XRPCStreamEvent, error) {
+		if evt.RepoIdentity != nil {
+			identities = append(identities, evt.RepoIdentity.Did+" "+*evt.RepoIdentity.Handle)
+		}
+		return evt, nil
+	})
+
+	bgs := &BGS{
+		db:     db,
+		events: em,
+		didr: handleDocs{
+			"did:plc:valid":     "valid.test",
+			"did:plc:mismatch":  "mismatch.test",
+			"did:plc:gone":      "gone.test",
+			"did:plc:transient": "transient.test",
+		},
+		hr: handleAnswers{
+			"valid.test":     "did:plc:valid",
+			"mismatch.test":  "did:plc:someone-else",
+			"transient.test": fmt.Errorf("i/o timeout"),
+		},
+	}
+
+	for _, tc := range []struct {
+		did     string
+		changed bool
+		fail    bool
+		valid   bool
+		event   string
+	}{
+		{did: "did:plc:valid", valid: true},
+		{did: "did:plc:mismatch", changed: true, event: "did:plc:mismatch handle.invalid"},
+		{did: "did:plc:gone", changed: true, event: "did:plc:gone handle.invalid"},
+		{did: "did:plc:transient", fail: true, valid: true},
+	} {
+		handle := bgs.didr.(handleDocs)[tc.did]
+		u := &User{Did: tc.did, Handle: sql.NullString{String: handle, Valid: true}, ValidHandle: true}
+		if err := db.Create(u).Error; err != nil {
+			t.Fatal(err)
+		}
+		identities = nil
+
+		changed, err := bgs.reverifyHandle(ctx, u)
+		if (err != nil) != tc.fail {
+			t.Errorf("%s: expected failure %v, got %v", tc.did, tc.fail, err)
+		}
+		if changed != tc.changed {
+			t.Errorf("%s: expected changed %v, got %v", tc.did, tc.changed, changed)
+		}
+
+		var stored User
+		if err := db.First(&stored, u.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if stored.ValidHandle != tc.valid {
+			t.Errorf("%s: expected stored validity %v, got %v", tc.did, tc.valid, stored.ValidHandle)
+		}
+
+		var expected []string
+		if tc.event != "" {
+			expected = []string{tc.event}
+		}
+		if !equalStrings(identities, expected) {
+			t.Errorf("%s: expected identity events %v, got %v", tc.did, expected, identities)
+		}
+	}
+}
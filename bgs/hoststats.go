@@ -0,0 +1,371 @@
+package bgs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+	"gorm.io/gorm"
+)
+
+type HostStatsOptions struct {
+	// How often each host's counts are written out as a sample; zero
+	// disables the history
+	Interval time.Duration
+	// How long samples are kept. Each hour's samples are also rolled up
+	// into an hourly sample once the hour is over, which is kept for
+	// HourlyRetention.
+	Retention       time.Duration
+	HourlyRetention time.Duration
+}
+
+func DefaultHostStatsOptions() *HostStatsOptions {
+	return &HostStatsOptions{
+		Interval:        time.Minute,
+		Retention:       48 * time.Hour,
+		HourlyRetention: 90 * 24 * time.Hour,
+	}
+}
+
+// HostStatsSample is a host's activity over one sample interval. Samples are
+// only written for hosts that sent events during the interval.
+type HostStatsSample struct {
+	ID    uint      `gorm:"primarykey"`
+	PDS   uint      `gorm:"index:idx_host_stats_samples_pds_start,priority:1"`
+	Start time.Time `gorm:"index:idx_host_stats_samples_pds_start,priority:2;index"`
+	HostStatsCounts
+}
+
+// HostStatsHourly is a host's samples for one hour, added up
+type HostStatsHourly struct {
+	ID    uint      `gorm:"primarykey"`
+	PDS   uint      `gorm:"index:idx_host_stats_hourlies_pds_start,priority:1"`
+	Start time.Time `gorm:"index:idx_host_stats_hourlies_pds_start,priority:2;index"`
+	HostStatsCounts
+}
+
+type HostStatsCounts struct {
+	// how much of the period the counts cover
+	Seconds float64 `json:"seconds"`
+	// events received, events rejected by an ingest stage (other than
+	// duplicates), and events that failed to be processed
+	Events   int64 `json:"events"`
+	Rejected int64 `json:"rejected"`
+	Errors   int64 `json:"errors"`
+	// the host's repo count at the end of the sample, or the highest of the
+	// hour's samples for an hourly rollup
+	RepoCount int64 `json:"repo_count"`
+}
+
+// HostStatsPoint is a sample as returned by the query endpoint
+type HostStatsPoint struct {
+	Start time.Time `json:"start"`
+	HostStatsCounts
+	EventsPerSecond float64 `json:"events_per_second"`
+	// fraction of events that were rejected or failed
+	ErrorRate float64 `json:"error_rate"`
+}
+
+const (
+	HostStatsResolutionSample = "sample"
+	HostStatsResolutionHourly = "hourly"
+)
+
+type hostStatsCounter struct {
+	events, rejected, errors int64
+}
+
+// HostStatsHistory keeps a history of each host's event rate, error rate and
+// repo count in the database, so that what a host was doing before an
+// incident can be looked into after the fact. Counts are sampled every
+// Interval, then downsampled to hourly totals kept for longer.
+type HostStatsHistory struct {
+	opts HostStatsOptions
+
+	lk        sync.Mutex
+	counts    map[uint]*hostStatsCounter
+	lastFlush time.Time
+
+	// start of the latest hour rolled up, zero until looked up
+	rolledUp time.Time
+
+	exit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewHostStatsHistory(opts *HostStatsOptions) (*HostStatsHistory, error) {
+	if opts == nil {
+		opts = &HostStatsOptions{}
+	}
+	if opts.Interval > 0 {
+		if opts.Interval > time.Hour {
+			return nil, fmt.Errorf("host stats interval (%s) can be at most an hour", opts.Interval)
+		}
+		if opts.Retention < time.Hour {
+			return nil, fmt.Errorf("host stats retention (%s) must be at least an hour, so samples are kept until they're rolled up", opts.Retention)
+		}
+	}
+
+	return &HostStatsHistory{
+		opts:      *opts,
+		counts:    make(map[uint]*hostStatsCounter),
+		lastFlush: time.Now(),
+		exit:      make(chan struct{}),
+	}, nil
+}
+
+func (hs *HostStatsHistory) enabled() bool {
+	return hs.opts.Interval > 0
+}
+
+// Start starts the sampling routine, if enabled
+func (hs *HostStatsHistory) Start(bgs *BGS) {
+	if !hs.enabled() {
+		return
+	}
+
+	if err := bgs.db.AutoMigrate(&HostStatsSample{}, &HostStatsHourly{}); err != nil {
+		log.Errorw("failed to migrate host stats tables, not keeping host stats history", "err", err)
+		hs.opts.Interval = 0
+		return
+	}
+
+	log.Infow("starting host stats history", "interval", hs.opts.Interval, "retention", hs.opts.Retention, "hourlyRetention", hs.opts.HourlyRetention)
+
+	hs.wg.Add(1)
+	go func() {
+		defer hs.wg.Done()
+
+		t := time.NewTicker(hs.opts.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-hs.exit:
+				// keep what was counted since the last sample
+				if err := hs.RunPass(context.Background(), bgs.db); err != nil {
+					log.Errorw("host stats pass failed", "err", err)
+				}
+				return
+			case <-t.C:
+			}
+
+			if err := hs.RunPass(context.Background(), bgs.db); err != nil {
+				log.Errorw("host stats pass failed", "err", err)
+			}
+		}
+	}()
+}
+
+// Shutdown stops the sampling routine after writing out a last sample
+func (hs *HostStatsHistory) Shutdown() {
+	close(hs.exit)
+	hs.wg.Wait()
+}
+
+// observe counts an event from a host, and how handling it turned out
+func (hs *HostStatsHistory) observe(pdsID uint, err error) {
+	if !hs.enabled() {
+		return
+	}
+
+	hs.lk.Lock()
+	defer hs.lk.Unlock()
+
+	c, ok := hs.counts[pdsID]
+	if !ok {
+		c = &hostStatsCounter{}
+		hs.counts[pdsID] = c
+	}
+	c.events++
+
+	if err == nil {
+		return
+	}
+	var rejected *ErrIngestRejected
+	if errors.As(err, &rejected) {
+		if rejected.Stage != IngestStageDedup {
+			c.rejected++
+		}
+		return
+	}
+	c.errors++
+}
+
+// RunPass writes out a sample for every host counted since the last pass,
+// rolls up any hours that have ended, and drops samples past retention
+func (hs *HostStatsHistory) RunPass(ctx context.Context, db *gorm.DB) error {
+	if err := hs.flush(ctx, db); err != nil {
+		return fmt.Errorf("writing samples: %w", err)
+	}
+	if err := hs.rollUp(ctx, db); err != nil {
+		return fmt.Errorf("rolling up hourly samples: %w", err)
+	}
+
+	now := time.Now()
+	if err := db.WithContext(ctx).Where("start < ?", now.Add(-hs.opts.Retention)).Delete(&HostStatsSample{}).Error; err != nil {
+		return fmt.Errorf("pruning samples: %w", err)
+	}
+	if hs.opts.HourlyRetention > 0 {
+		if err := db.WithContext(ctx).Where("start < ?", now.Add(-hs.opts.HourlyRetention)).Delete(&HostStatsHourly{}).Error; err != nil {
+			return fmt.Errorf("pruning hourly samples: %w", err)
+		}
+	}
+	return nil
+}
+
+func (hs *HostStatsHistory) flush(ctx context.Context, db *gorm.DB) error {
+	now := time.Now()
+
+	hs.lk.Lock()
+	counts := hs.counts
+	start := hs.lastFlush
+	hs.counts = make(map[uint]*hostStatsCounter)
+	hs.lastFlush = now
+	hs.lk.Unlock()
+
+	if len(counts) == 0 {
+		return nil
+	}
+
+	ids := make([]uint, 0, len(counts))
+	for id := range counts {
+		ids = append(ids, id)
+	}
+	var hosts []models.PDS
+	if err := db.WithContext(ctx).Model(&models.PDS{}).Select("id, repo_count").Where("id IN ?", ids).Find(&hosts).Error; err != nil {
+		return err
+	}
+	repoCounts := make(map[uint]int64, len(hosts))
+	for _, h := range hosts {
+		repoCounts[h.ID] = h.RepoCount
+	}
+
+	secs := now.Sub(start).Seconds()
+	samples := make([]HostStatsSample, 0, len(counts))
+	for id, c := range counts {
+		samples = append(samples, HostStatsSample{
+			PDS:   id,
+			Start: start,
+			HostStatsCounts: HostStatsCounts{
+				Seconds:   secs,
+				Events:    c.events,
+				Rejected:  c.rejected,
+				Errors:    c.errors,
+				RepoCount: repoCounts[id],
+			},
+		})
+	}
+	return db.WithContext(ctx).CreateInBatches(samples, 500).Error
+}
+
+// rollUp adds up the samples of each hour that has ended since the last
+// rollup into hourly samples
+func (hs *HostStatsHistory) rollUp(ctx context.Context, db *gorm.DB) error {
+	current := time.Now().Truncate(time.Hour)
+
+	if hs.rolledUp.IsZero() {
+		var last HostStatsHourly
+		err := db.WithContext(ctx).Order("start desc").Limit(1).Find(&last).Error
+		if err != nil {
+			return err
+		}
+		if last.ID != 0 {
+			hs.rolledUp = last.Start
+		} else {
+			// nothing rolled up yet, start from the oldest sample we have
+			var first HostStatsSample
+			if err := db.WithContext(ctx).Order("start asc").Limit(1).Find(&first).Error; err != nil {
+				return err
+			}
+			if first.ID == 0 {
+				return nil
+			}
+			hs.rolledUp = first.Start.Truncate(time.Hour).Add(-time.Hour)
+		}
+	}
+
+	// anything older than the retention has no samples left to roll up
+	if oldest := current.Add(-hs.opts.Retention).Truncate(time.Hour); hs.rolledUp.Before(oldest) {
+		hs.rolledUp = oldest
+	}
+
+	for hour := hs.rolledUp.Add(time.Hour); hour.Before(current); hour = hour.Add(time.Hour) {
+		var sums []struct {
+			PDS uint
+			HostStatsCounts
+		}
+		err := db.WithContext(ctx).Model(&HostStatsSample{}).
+			Select("pds, SUM(seconds) AS seconds, SUM(events) AS events, SUM(rejected) AS rejected, SUM(errors) AS errors, MAX(repo_count) AS repo_count").
+			Where("start >= ? AND start < ?", hour, hour.Add(time.Hour)).
+			Group("pds").
+			Scan(&sums).Error
+		if err != nil {
+			return err
+		}
+
+		if len(sums) > 0 {
+			rows := make([]HostStatsHourly, len(sums))
+			for i, s := range sums {
+				rows[i] = HostStatsHourly{PDS: s.PDS, Start: hour, HostStatsCounts: s.HostStatsCounts}
+			}
+			if err := db.WithContext(ctx).CreateInBatches(rows, 500).Error; err != nil {
+				return err
+			}
+		}
+		hs.rolledUp = hour
+	}
+
+	return nil
+}
+
+// History returns a host's samples starting within [since, until), oldest
+// first. Resolution is HostStatsResolutionSample or HostStatsResolutionHourly;
+// if empty, samples are used when they go back as far as since.
+func (hs *HostStatsHistory) History(ctx context.Context, db *gorm.DB, pdsID uint, since, until time.Time, resolution string) ([]HostStatsPoint, string, error) {
+	if resolution == "" {
+		resolution = HostStatsResolutionHourly
+		if time.Since(since) <= hs.opts.Retention {
+			resolution = HostStatsResolutionSample
+		}
+	}
+
+	q := db.WithContext(ctx).Where("pds = ? AND start >= ? AND start < ?", pdsID, since, until).Order("start asc")
+
+	var points []HostStatsPoint
+	switch resolution {
+	case HostStatsResolutionSample:
+		var rows []HostStatsSample
+		if err := q.Find(&rows).Error; err != nil {
+			return nil, "", err
+		}
+		for _, r := range rows {
+			points = append(points, newHostStatsPoint(r.Start, r.HostStatsCounts))
+		}
+	case HostStatsResolutionHourly:
+		var rows []HostStatsHourly
+		if err := q.Find(&rows).Error; err != nil {
+			return nil, "", err
+		}
+		for _, r := range rows {
+			points = append(points, newHostStatsPoint(r.Start, r.HostStatsCounts))
+		}
+	default:
+		return nil, "", fmt.Errorf("unknown resolution %q", resolution)
+	}
+
+	return points, resolution, nil
+}
+
+func newHostStatsPoint(start time.Time, c HostStatsCounts) HostStatsPoint {
+	p := HostStatsPoint{Start: start, HostStatsCounts: c}
+	if c.Seconds > 0 {
+		p.EventsPerSecond = float64(c.Events) / c.Seconds
+	}
+	if c.Events > 0 {
+		p.ErrorRate = float64(c.Rejected+c.Errors) / float64(c.Events)
+	}
+	return p
+}
@@ -0,0 +1,120 @@
+package bgs
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/bluesky-social/indigo/xrpc"
+
+	"github.com/carlmjohnson/versioninfo"
+	"github.com/labstack/echo/v4"
+)
+
+const relayDescriptionPath = "/.well-known/atproto-relay"
+
+// RelayIdentity is how the relay identifies itself to the hosts it crawls,
+// so their operators can tell who is crawling them and how to get in touch
+type RelayIdentity struct {
+	// The relay's public hostname, eg. relay.example.com
+	Hostname string
+	// How to reach the relay's operator: an email address or a URL
+	Contact string
+}
+
+// UserAgent is the User-Agent sent on requests to other hosts, eg.
+// "indigo-relay/0.1 (+https://relay.example.com; admin@example.com)"
+func (ri *RelayIdentity) UserAgent() string {
+	ua := "indigo-relay/" + versioninfo.Short()
+	if ri == nil {
+		return ua
+	}
+
+	var about []string
+	if ri.Hostname != "" {
+		about = append(about, "+https://"+ri.Hostname)
+	}
+	if ri.Contact != "" {
+		about = append(about, ri.Contact)
+	}
+	if len(about) == 0 {
+		return ua
+	}
+	return fmt.Sprintf("%s (%s)", ua, strings.Join(about, "; "))
+}
+
+// contactEmail returns the contact address if it's an email address, for
+// the From header
+func (ri *RelayIdentity) contactEmail() string {
+	if ri == nil || !strings.Contains(ri.Contact, "@") || strings.Contains(ri.Contact, "://") {
+		return ""
+	}
+	return strings.TrimPrefix(ri.Contact, "mailto:")
+}
+
+// Headers returns the headers identifying the relay: User-Agent, and From if
+// the contact is an email address
+func (ri *RelayIdentity) Headers() http.Header {
+	h := http.Header{}
+	h.Set("User-Agent", ri.UserAgent())
+	if from := ri.contactEmail(); from != "" {
+		h.Set("From", from)
+	}
+	return h
+}
+
+// setHeaders sets the identifying headers on an outbound request
+func (ri *RelayIdentity) setHeaders(req *http.Request) {
+	for k, v := range ri.Headers() {
+		req.Header[k] = v
+	}
+}
+
+// applyToClient sets the identifying headers on an XRPC client, keeping any
+// headers it already has
+func (ri *RelayIdentity) applyToClient(c *xrpc.Client) {
+	ua := ri.UserAgent()
+	c.UserAgent = &ua
+	if from := ri.contactEmail(); from != "" {
+		headers := make(map[string]string, len(c.Headers)+1)
+		for k, v := range c.Headers {
+			headers[k] = v
+		}
+		headers["From"] = from
+		c.Headers = headers
+	}
+}
+
+func (bgs *BGS) identifyPDSClients(apply func(*xrpc.Client)) func(*xrpc.Client) {
+	return func(c *xrpc.Client) {
+		if apply != nil {
+			apply(c)
+		}
+		bgs.identity.applyToClient(c)
+	}
+}
+
+// RelayDescription is served at /.well-known/atproto-relay
+type RelayDescription struct {
+	Hostname string `json:"hostname,omitempty"`
+	Contact  string `json:"contact,omitempty"`
+	// the DID admin service-auth tokens are addressed to, if configured
+	ServiceDid string `json:"serviceDid,omitempty"`
+	Software   string `json:"software"`
+	Version    string `json:"version"`
+}
+
+func (bgs *BGS) handleRelayDescription(c echo.Context) error {
+	desc := RelayDescription{
+		Software: "indigo-relay",
+		Version:  versioninfo.Short(),
+	}
+	if bgs.identity != nil {
+		desc.Hostname = bgs.identity.Hostname
+		desc.Contact = bgs.identity.Contact
+	}
+	if bgs.serviceAuth != nil {
+		desc.ServiceDid = bgs.serviceAuth.conf.Audience
+	}
+	return c.JSON(http.StatusOK, desc)
+}
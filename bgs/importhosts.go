@@ -0,0 +1,197 @@
+package bgs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/xrpc"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Outcomes of importing a host
+const (
+	ImportHostQueued           = "queued"
+	ImportHostAlreadyConnected = "already_connected"
+	ImportHostInvalid          = "invalid"
+	ImportHostBanned           = "banned"
+	ImportHostUnreachable      = "unreachable"
+	ImportHostFailed           = "failed"
+)
+
+// most hosts accepted in one import request
+const maxImportHosts = 10_000
+
+type AdminImportHostsRequest struct {
+	Hostnames []string `json:"hostnames"`
+	// How many hosts to validate at once (default 20, at most 100)
+	Concurrency int `json:"concurrency,omitempty"`
+	// Subscribe without checking that each host answers describeServer
+	SkipValidation bool `json:"skip_validation,omitempty"`
+}
+
+type ImportHostResult struct {
+	Hostname string `json:"hostname"`
+	// The host as the relay knows it, if the hostname was valid
+	Host   string `json:"host,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type AdminImportHostsResponse struct {
+	Results []ImportHostResult `json:"results"`
+	// Number of hosts with each status
+	Counts map[string]int `json:"counts"`
+}
+
+// handleAdminImportHosts requests crawls of many hosts at once, as when
+// bootstrapping a relay. It takes a JSON AdminImportHostsRequest, or a plain
+// text list of hostnames, one per line. Hosts are validated concurrently, and
+// subscribed to as with an admin requestCrawl.
+func (bgs *BGS) handleAdminImportHosts(e echo.Context) error {
+	var body AdminImportHostsRequest
+	if strings.HasPrefix(e.Request().Header.Get("Content-Type"), "text/plain") {
+		hosts, err := readHostList(io.LimitReader(e.Request().Body, 10<<20))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid body: %s", err))
+		}
+		body.Hostnames = hosts
+		body.SkipValidation = e.QueryParam("skip_validation") == "true"
+	} else if err := e.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid body: %s", err))
+	}
+
+	if len(body.Hostnames) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "must pass hostnames")
+	}
+	if len(body.Hostnames) > maxImportHosts {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("at most %d hostnames may be imported at once", maxImportHosts))
+	}
+
+	concurrency := body.Concurrency
+	if concurrency <= 0 {
+		concurrency = 20
+	}
+	if concurrency > 100 {
+		concurrency = 100
+	}
+
+	results := bgs.importHosts(e.Request().Context(), body.Hostnames, concurrency, !body.SkipValidation, true)
+
+	counts := make(map[string]int)
+	for _, r := range results {
+		counts[r.Status]++
+	}
+	log.Infow("imported hosts", "count", len(results), "results", counts)
+
+	return e.JSON(http.StatusOK, AdminImportHostsResponse{
+		Results: results,
+		Counts:  counts,
+	})
+}
+
+// readHostList reads hostnames one per line, skipping blank lines and
+// #-comments
+func readHostList(r io.Reader) ([]string, error) {
+	var hosts []string
+	scan := bufio.NewScanner(r)
+	for scan.Scan() {
+		line, _, _ := strings.Cut(scan.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line != "" {
+			hosts = append(hosts, line)
+		}
+	}
+	return hosts, scan.Err()
+}
+
+// importHosts validates and subscribes to hosts. Unless adminOverride is set,
+// subscriptions are subject to the limits on new hosts, as for requestCrawl.
+func (bgs *BGS) importHosts(ctx context.Context, hostnames []string, concurrency int, validate, adminOverride bool) []ImportHostResult {
+	active := make(map[string]bool)
+	for _, h := range bgs.slurper.GetActiveList() {
+		active[h] = true
+	}
+
+	client := util.ProxiedHTTPClientWithTLS(bgs.outboundProxy, bgs.pdsTLSConfig)
+	client.Timeout = 10 * time.Second
+
+	results := make([]ImportHostResult, len(hostnames))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, hostname := range hostnames {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, hostname string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = bgs.importHost(ctx, client, hostname, active, validate, adminOverride)
+		}(i, strings.TrimSpace(hostname))
+	}
+	wg.Wait()
+
+	return results
+}
+
+func (bgs *BGS) importHost(ctx context.Context, client *http.Client, hostname string, active map[string]bool, validate, adminOverride bool) ImportHostResult {
+	res := ImportHostResult{Hostname: hostname}
+
+	u, err := bgs.parseCrawlHost(hostname)
+	if err != nil {
+		res.Status = ImportHostInvalid
+		var herr *echo.HTTPError
+		if errors.As(err, &herr) {
+			res.Error = fmt.Sprint(herr.Message)
+		} else {
+			res.Error = err.Error()
+		}
+		return res
+	}
+	res.Host = u.Host
+
+	if active[res.Host] {
+		res.Status = ImportHostAlreadyConnected
+		return res
+	}
+
+	banned, err := bgs.domainIsBanned(ctx, res.Host)
+	if err != nil {
+		res.Status = ImportHostFailed
+		res.Error = err.Error()
+		return res
+	}
+	if banned {
+		res.Status = ImportHostBanned
+		return res
+	}
+
+	if validate {
+		c := &xrpc.Client{
+			Host:   fmt.Sprintf("%s://%s", u.Scheme, res.Host),
+			Client: client,
+		}
+		if _, err := atproto.ServerDescribeServer(ctx, c); err != nil {
+			res.Status = ImportHostUnreachable
+			res.Error = err.Error()
+			return res
+		}
+	}
+
+	if err := bgs.slurper.SubscribeToPds(ctx, res.Host, true, adminOverride); err != nil {
+		res.Status = ImportHostFailed
+		res.Error = err.Error()
+		return res
+	}
+
+	res.Status = ImportHostQueued
+	return res
+}
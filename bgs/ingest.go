@@ -0,0 +1,570 @@
+package bgs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/atproto/lexicon"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/bluesky-social/indigo/repomgr"
+	"github.com/bluesky-social/indigo/util"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	"gorm.io/gorm"
+)
+
+// IngestEvent is an event received from a PDS, on its way through the ingest
+// pipeline
+type IngestEvent struct {
+	Host  *models.PDS
+	Event *events.XRPCStreamEvent
+
+	// the commit's blocks, decoded by the first stage that needs them
+	blocks map[cid.Cid][]byte
+}
+
+// Blocks returns the blocks carried by a commit, keyed by CID
+func (ie *IngestEvent) Blocks() (map[cid.Cid][]byte, error) {
+	if ie.blocks != nil {
+		return ie.blocks, nil
+	}
+	if ie.Event.RepoCommit == nil {
+		return nil, fmt.Errorf("not a commit")
+	}
+
+	blocks, err := readCommitBlocks(ie.Event.RepoCommit.Blocks)
+	if err != nil {
+		return nil, err
+	}
+	ie.blocks = blocks
+	return blocks, nil
+}
+
+// readCommitBlocks decodes the CAR slice carried in a commit's blocks field
+func readCommitBlocks(b []byte) (map[cid.Cid][]byte, error) {
+	cr, err := car.NewCarReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("reading commit blocks: %w", err)
+	}
+	blocks := make(map[cid.Cid][]byte)
+	for {
+		blk, err := cr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("reading commit blocks: %w", err)
+		}
+		blocks[blk.Cid()] = blk.RawData()
+	}
+	return blocks, nil
+}
+
+// IngestStage is one check events from PDSs must pass before the relay
+// processes them. A stage rejects an event by returning an error; rejected
+// events are dropped.
+type IngestStage interface {
+	Name() string
+	Check(ctx context.Context, evt *IngestEvent) error
+}
+
+// ingestAcceptor is implemented by stages that need to know when an event
+// has passed every stage
+type ingestAcceptor interface {
+	Accepted(evt *IngestEvent)
+}
+
+// ingestRejecter is implemented by stages that need to know when an event
+// they passed is rejected by a later stage
+type ingestRejecter interface {
+	Rejected(evt *IngestEvent)
+}
+
+type ingestStageFunc struct {
+	name string
+	fn   func(ctx context.Context, evt *IngestEvent) error
+}
+
+func (s *ingestStageFunc) Name() string { return s.name }
+
+func (s *ingestStageFunc) Check(ctx context.Context, evt *IngestEvent) error {
+	return s.fn(ctx, evt)
+}
+
+// IngestStageFunc makes an IngestStage from a function
+func IngestStageFunc(name string, fn func(ctx context.Context, evt *IngestEvent) error) IngestStage {
+	return &ingestStageFunc{name: name, fn: fn}
+}
+
+// ErrIngestRejected is returned when a stage rejects an event
+type ErrIngestRejected struct {
+	Stage string
+	Err   error
+}
+
+func (e *ErrIngestRejected) Error() string {
+	return fmt.Sprintf("rejected by %s stage: %s", e.Stage, e.Err)
+}
+
+func (e *ErrIngestRejected) Unwrap() error {
+	return e.Err
+}
+
+// ErrRepoReset is returned by the rev stage when a repo's rev goes backwards
+// to a commit we don't have, meaning its history was rewritten upstream
+type ErrRepoReset struct {
+	Repo    string
+	Rev     string
+	LastRev string
+}
+
+func (e *ErrRepoReset) Error() string {
+	return fmt.Sprintf("repo %s was reset: rev %s is before the last accepted rev %s", e.Repo, e.Rev, e.LastRev)
+}
+
+// Names of the built in stages, in the order they run
+const (
+	IngestStageDedup     = "dedup"
+	IngestStageSize      = "size"
+	IngestStageLexicon   = "lexicon"
+	IngestStageSignature = "signature"
+	IngestStageRev       = "rev"
+	// only with IngestOptions.Scoring set
+	IngestStageScoring = "scoring"
+)
+
+type IngestOptions struct {
+	// Stages that start out disabled
+	Disabled []string
+
+	// Largest blocks field and number of ops and blocks accepted in a commit,
+	// and largest single block. Zero means no limit.
+	MaxCommitBytes  int
+	MaxCommitOps    int
+	MaxCommitBlocks int
+	MaxBlockBytes   int
+
+	// Commits to repos already taking up more than this much carstore space
+	// are rejected. Zero means no limit; otherwise each commit costs a lookup.
+	MaxRepoBytes int64
+
+	// Hosts that break a size limit this many times within SizeViolationWindow
+	// are blocked. Zero disables blocking.
+	SizeViolationsToBlock int
+	SizeViolationWindow   time.Duration
+
+	// How far ahead of the relay's clock a commit's rev may be
+	MaxRevSkew time.Duration
+
+	// If set, created and updated records in collections it has schemas
+	// for are validated against them
+	LexiconCatalog lexicon.Catalog
+
+	// Number of recently accepted events remembered by the dedup stage, and
+	// for how long
+	DedupCacheSize int
+	DedupTTL       time.Duration
+
+	// Scoring the records in commits, to tag, delay or drop them from the
+	// firehose; off if nil
+	Scoring *ScoringOptions
+
+	// Stages run after the built in ones, in order
+	Hooks []IngestStage
+}
+
+func DefaultIngestOptions() *IngestOptions {
+	return &IngestOptions{
+		MaxCommitBytes:      2_000_000,
+		MaxCommitOps:        200,
+		MaxCommitBlocks:     10_000,
+		MaxBlockBytes:       1 << 20,
+		SizeViolationWindow: time.Hour,
+		MaxRevSkew:          5 * time.Minute,
+		DedupCacheSize:      500_000,
+		DedupTTL:            time.Hour,
+	}
+}
+
+type pipelineStage struct {
+	stage   IngestStage
+	enabled atomic.Bool
+}
+
+// IngestPipeline runs events received from PDSs through an ordered list of
+// named stages. Any stage can be disabled or re-enabled while the relay is
+// running.
+type IngestPipeline struct {
+	lk     sync.RWMutex
+	stages []*pipelineStage
+}
+
+func newIngestPipeline() *IngestPipeline {
+	return &IngestPipeline{}
+}
+
+// Register appends a stage to the pipeline, enabled
+func (p *IngestPipeline) Register(stage IngestStage) error {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	for _, ps := range p.stages {
+		if ps.stage.Name() == stage.Name() {
+			return fmt.Errorf("ingest stage %q already registered", stage.Name())
+		}
+	}
+
+	ps := &pipelineStage{stage: stage}
+	ps.enabled.Store(true)
+	p.stages = append(p.stages, ps)
+	return nil
+}
+
+// SetEnabled enables or disables a stage by name
+func (p *IngestPipeline) SetEnabled(name string, enabled bool) error {
+	p.lk.RLock()
+	defer p.lk.RUnlock()
+
+	for _, ps := range p.stages {
+		if ps.stage.Name() == name {
+			ps.enabled.Store(enabled)
+			log.Infow("ingest stage toggled", "stage", name, "enabled", enabled)
+			return nil
+		}
+	}
+	return fmt.Errorf("no ingest stage named %q", name)
+}
+
+type IngestStageStatus struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// Stages lists the stages in the order they run
+func (p *IngestPipeline) Stages() []IngestStageStatus {
+	p.lk.RLock()
+	defer p.lk.RUnlock()
+
+	out := make([]IngestStageStatus, 0, len(p.stages))
+	for _, ps := range p.stages {
+		out = append(out, IngestStageStatus{Name: ps.stage.Name(), Enabled: ps.enabled.Load()})
+	}
+	return out
+}
+
+// Check runs the event through each enabled stage, returning an
+// *ErrIngestRejected from the first that rejects it
+func (p *IngestPipeline) Check(ctx context.Context, evt *IngestEvent) error {
+	p.lk.RLock()
+	stages := p.stages
+	p.lk.RUnlock()
+
+	for i, ps := range stages {
+		if !ps.enabled.Load() {
+			continue
+		}
+
+		name := ps.stage.Name()
+		start := time.Now()
+		err := ps.stage.Check(ctx, evt)
+		ingestStageDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+		if err != nil {
+			ingestStageRejections.WithLabelValues(name).Inc()
+			for _, prev := range stages[:i] {
+				if r, ok := prev.stage.(ingestRejecter); ok && prev.enabled.Load() {
+					r.Rejected(evt)
+				}
+			}
+			return &ErrIngestRejected{Stage: name, Err: err}
+		}
+	}
+
+	for _, ps := range stages {
+		if a, ok := ps.stage.(ingestAcceptor); ok && ps.enabled.Load() {
+			a.Accepted(evt)
+		}
+	}
+	return nil
+}
+
+// setupIngestPipeline builds the pipeline: the built in stages, then the
+// configured hooks
+func (bgs *BGS) setupIngestPipeline(opts *IngestOptions, clock util.Clock) error {
+	if opts == nil {
+		opts = DefaultIngestOptions()
+	}
+
+	p := newIngestPipeline()
+	bgs.revCheck = newRevStage(bgs, opts.MaxRevSkew, clock)
+	bgs.dedup = newDedupStage(opts.DedupCacheSize, opts.DedupTTL)
+	bgs.revStats = newRevOrderStats()
+	stages := []IngestStage{
+		bgs.dedup,
+		newSizeStage(bgs, opts),
+		&lexiconStage{catalog: opts.LexiconCatalog},
+		&signatureStage{repoman: bgs.repoman},
+		bgs.revCheck,
+	}
+	if opts.Scoring != nil {
+		scoring, err := newScoringStage(opts.Scoring)
+		if err != nil {
+			return err
+		}
+		bgs.events.Use(scoring.middleware)
+		bgs.scoring = scoring
+		stages = append(stages, scoring)
+	}
+	stages = append(stages, opts.Hooks...)
+	for _, st := range stages {
+		if err := p.Register(st); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range opts.Disabled {
+		if err := p.SetEnabled(name, false); err != nil {
+			return err
+		}
+	}
+
+	// the signature stage takes over checking commit signatures from the
+	// repo manager, so disabling it turns them off entirely
+	bgs.repoman.SetExternalSigCheck(false)
+
+	bgs.ingest = p
+	return nil
+}
+
+// lexiconStage checks that a commit's ops are well formed, and if it has a
+// catalog, that created and updated records match their schemas
+type lexiconStage struct {
+	catalog lexicon.Catalog
+}
+
+func (s *lexiconStage) Name() string { return IngestStageLexicon }
+
+func (s *lexiconStage) Check(ctx context.Context, evt *IngestEvent) error {
+	commit := evt.Event.RepoCommit
+	if commit == nil {
+		return nil
+	}
+
+	for _, op := range commit.Ops {
+		col, rkey, ok := strings.Cut(op.Path, "/")
+		if !ok {
+			return fmt.Errorf("invalid op path %q", op.Path)
+		}
+		if _, err := syntax.ParseNSID(col); err != nil {
+			return fmt.Errorf("invalid collection in op path %q: %w", op.Path, err)
+		}
+		if _, err := syntax.ParseRecordKey(rkey); err != nil {
+			return fmt.Errorf("invalid record key in op path %q: %w", op.Path, err)
+		}
+
+		switch repomgr.EventKind(op.Action) {
+		case repomgr.EvtKindCreateRecord, repomgr.EvtKindUpdateRecord:
+			if op.Cid == nil {
+				return fmt.Errorf("%s op for %q has no cid", op.Action, op.Path)
+			}
+		case repomgr.EvtKindDeleteRecord:
+			if op.Cid != nil {
+				return fmt.Errorf("delete op for %q has a cid", op.Path)
+			}
+			continue
+		default:
+			return fmt.Errorf("unknown op action %q", op.Action)
+		}
+
+		if s.catalog == nil {
+			continue
+		}
+		if _, err := s.catalog.Resolve(col); err != nil {
+			// no schema for this collection
+			continue
+		}
+
+		blocks, err := evt.Blocks()
+		if err != nil {
+			return err
+		}
+		blk, ok := blocks[cid.Cid(*op.Cid)]
+		if !ok {
+			return fmt.Errorf("record for %q missing from commit blocks", op.Path)
+		}
+		rec, err := data.UnmarshalCBOR(blk)
+		if err != nil {
+			return fmt.Errorf("decoding record %q: %w", op.Path, err)
+		}
+		if err := lexicon.ValidateRecord(s.catalog, rec, col, lexicon.LenientMode); err != nil {
+			return fmt.Errorf("record %q does not match its lexicon: %w", op.Path, err)
+		}
+	}
+	return nil
+}
+
+// signatureStage verifies that a commit is signed by the account's current
+// key
+type signatureStage struct {
+	repoman *repomgr.RepoManager
+}
+
+func (s *signatureStage) Name() string { return IngestStageSignature }
+
+func (s *signatureStage) Check(ctx context.Context, evt *IngestEvent) error {
+	commit := evt.Event.RepoCommit
+	if commit == nil {
+		return nil
+	}
+
+	blocks, err := evt.Blocks()
+	if err != nil {
+		return err
+	}
+	blk, ok := blocks[cid.Cid(commit.Commit)]
+	if !ok {
+		return fmt.Errorf("commit block %s missing from commit blocks", commit.Commit)
+	}
+
+	var sc repo.SignedCommit
+	if err := sc.UnmarshalCBOR(bytes.NewReader(blk)); err != nil {
+		return fmt.Errorf("decoding commit: %w", err)
+	}
+	if sc.Did != commit.Repo {
+		return fmt.Errorf("DID in commit did not match (%q != %q)", sc.Did, commit.Repo)
+	}
+
+	return s.repoman.CheckCommitSig(ctx, commit.Repo, &sc)
+}
+
+// revStage rejects commits whose rev isn't after the last accepted one for
+// the repo, or is too far in the future, with an ErrRevViolation. An older
+// rev for a commit we've never seen means the upstream repo was reset, and is
+// rejected with ErrRepoReset.
+type revStage struct {
+	bgs     *BGS
+	maxSkew time.Duration
+	clock   util.Clock
+
+	// last accepted rev per repo; falls back to the carstore
+	last *expirable.LRU[string, string]
+}
+
+func newRevStage(bgs *BGS, maxSkew time.Duration, clock util.Clock) *revStage {
+	return &revStage{
+		bgs:     bgs,
+		maxSkew: maxSkew,
+		clock:   util.ClockOrSystem(clock),
+		last:    expirable.NewLRU[string, string](100_000, nil, time.Hour),
+	}
+}
+
+func (s *revStage) Name() string { return IngestStageRev }
+
+func (s *revStage) Check(ctx context.Context, evt *IngestEvent) error {
+	commit := evt.Event.RepoCommit
+	if commit == nil {
+		return nil
+	}
+
+	revTime, err := parseRevTime(commit.Rev)
+	if err != nil {
+		return err
+	}
+	if s.maxSkew > 0 && revTime.After(s.clock.Now().Add(s.maxSkew)) {
+		return &ErrRevViolation{Kind: RevViolationFuture, Repo: commit.Repo, Rev: commit.Rev}
+	}
+
+	last, ok := s.last.Get(commit.Repo)
+	if !ok {
+		last, err = s.storedRev(ctx, commit.Repo)
+		if err != nil {
+			// don't hold up ingest on a lookup failure; the repo manager
+			// catches out of order commits against what it has stored
+			log.Warnw("failed to look up stored rev for ingest check", "repo", commit.Repo, "err", err)
+			return nil
+		}
+	}
+
+	if last != "" && commit.Rev <= last {
+		if commit.Rev == last {
+			return &ErrRevViolation{Kind: RevViolationDuplicate, Repo: commit.Repo, Rev: commit.Rev, LastRev: last}
+		}
+		if !s.haveCommit(ctx, commit.Repo, cid.Cid(commit.Commit)) {
+			return &ErrRepoReset{Repo: commit.Repo, Rev: commit.Rev, LastRev: last}
+		}
+		return &ErrRevViolation{Kind: RevViolationOutOfOrder, Repo: commit.Repo, Rev: commit.Rev, LastRev: last}
+	}
+	return nil
+}
+
+// haveCommit reports whether the commit is in our copy of the repo, telling
+// a replayed old event apart from a rewritten history. Lookup failures count
+// as having it, so they never trigger a reset.
+func (s *revStage) haveCommit(ctx context.Context, did string, c cid.Cid) bool {
+	u, err := s.bgs.lookupUserByDid(ctx, did)
+	if err != nil {
+		return true
+	}
+
+	ses, err := s.bgs.repoman.CarStore().ReadOnlySession(u.ID)
+	if err != nil {
+		return true
+	}
+	has, err := ses.Has(ctx, c)
+	if err != nil {
+		return true
+	}
+	return has
+}
+
+// Forget drops the last accepted rev for a repo, for after it's been reset
+// or a commit accepted for it failed to be handled, so the rev is checked
+// against what's stored again
+func (s *revStage) Forget(did string) {
+	s.last.Remove(did)
+}
+
+// parseRevTime returns the time a rev was generated. Revs are TIDs, but some
+// implementations (repo.NextTID among them) don't pad the clock ID, so only
+// the 11 character timestamp is parsed.
+func parseRevTime(rev string) (time.Time, error) {
+	if len(rev) < 11 || len(rev) > 13 {
+		return time.Time{}, fmt.Errorf("invalid rev %q: wrong length", rev)
+	}
+	tid, err := syntax.ParseTID(rev[:11] + "22")
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid rev %q: %w", rev, err)
+	}
+	return tid.Time(), nil
+}
+
+func (s *revStage) Accepted(evt *IngestEvent) {
+	if commit := evt.Event.RepoCommit; commit != nil {
+		s.last.Add(commit.Repo, commit.Rev)
+	}
+}
+
+func (s *revStage) storedRev(ctx context.Context, did string) (string, error) {
+	u, err := s.bgs.lookupUserByDid(ctx, did)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return s.bgs.repoman.CarStore().GetUserRepoRev(ctx, u.ID)
+}
@@ -0,0 +1,195 @@
+package bgs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/ipfs/go-cid"
+)
+
+// ErrDuplicateEvent is returned by the dedup stage for an event the relay
+// has already taken in, from the same host or another one
+type ErrDuplicateEvent struct {
+	// commit, identity or account
+	Kind string
+	Repo string
+	// the commit's rev, or the time of an identity or account event
+	Rev string
+	// ID of the host the event was first received from
+	FirstHost uint
+}
+
+func (e *ErrDuplicateEvent) Error() string {
+	return fmt.Sprintf("duplicate %s %s for repo %s", e.Kind, e.Rev, e.Repo)
+}
+
+// kinds of event the dedup stage suppresses
+const (
+	dedupKindCommit   = "commit"
+	dedupKindIdentity = "identity"
+	dedupKindAccount  = "account"
+)
+
+type dedupKey struct {
+	kind string
+	did  string
+	rev  string
+	// set for the key an identity or account event claims on its own host,
+	// see replayKey
+	host uint
+	seq  int64
+}
+
+type dedupEntry struct {
+	// the commit's CID, or the contents of an identity or account event
+	id   string
+	host uint
+	// the host's seq for an identity or account event
+	seq int64
+}
+
+// dedupKeyFor returns the key and entry an event claims, or false for events
+// that aren't deduplicated. Identity and account events have no rev, but a
+// host replaying one sends the time and seq it was first sent with.
+func dedupKeyFor(evt *IngestEvent) (dedupKey, dedupEntry, bool) {
+	env := evt.Event
+	switch {
+	case env.RepoCommit != nil:
+		return dedupKey{kind: dedupKindCommit, did: env.RepoCommit.Repo, rev: env.RepoCommit.Rev},
+			dedupEntry{id: cid.Cid(env.RepoCommit.Commit).String(), host: evt.Host.ID}, true
+	case env.RepoIdentity != nil:
+		var handle string
+		if env.RepoIdentity.Handle != nil {
+			handle = *env.RepoIdentity.Handle
+		}
+		return dedupKey{kind: dedupKindIdentity, did: env.RepoIdentity.Did, rev: env.RepoIdentity.Time},
+			dedupEntry{id: handle, host: evt.Host.ID, seq: env.RepoIdentity.Seq}, true
+	case env.RepoAccount != nil:
+		status := "active"
+		if !env.RepoAccount.Active {
+			status = "inactive"
+			if env.RepoAccount.Status != nil {
+				status = *env.RepoAccount.Status
+			}
+		}
+		return dedupKey{kind: dedupKindAccount, did: env.RepoAccount.Did, rev: env.RepoAccount.Time},
+			dedupEntry{id: status, host: evt.Host.ID, seq: env.RepoAccount.Seq}, true
+	default:
+		return dedupKey{}, dedupEntry{}, false
+	}
+}
+
+// replayKey returns the key an identity or account event claims on the host
+// it came from. Times only go down to the millisecond, so a host can send two
+// events with the same time and contents, eg. reactivating an account twice
+// in quick succession, and only the host's seq tells them apart.
+func replayKey(key dedupKey, entry dedupEntry) dedupKey {
+	key.host = entry.host
+	key.seq = entry.seq
+	return key
+}
+
+// dedupStage suppresses events the relay has already taken in, which
+// happens when a repo is seen through more than one upstream, or a host
+// replays events after a reconnect. Commits are keyed by (did, rev), and
+// identity and account events by (did, time) across hosts and by
+// (did, time, seq) on the host they came from; an event claims its keys when
+// it's checked, and gives them up if a later stage rejects it or the relay
+// fails to handle it, so another copy can take its place. A different commit
+// with the same rev isn't a duplicate, and is left for the rev stage to deal
+// with.
+type dedupStage struct {
+	lk   sync.Mutex
+	seen *expirable.LRU[dedupKey, dedupEntry]
+}
+
+func newDedupStage(size int, ttl time.Duration) *dedupStage {
+	return &dedupStage{
+		seen: expirable.NewLRU[dedupKey, dedupEntry](size, nil, ttl),
+	}
+}
+
+func (s *dedupStage) Name() string { return IngestStageDedup }
+
+func (s *dedupStage) Check(ctx context.Context, evt *IngestEvent) error {
+	key, entry, ok := dedupKeyFor(evt)
+	if !ok {
+		return nil
+	}
+
+	prev, dup := s.claim(key, entry)
+	if !dup {
+		return nil
+	}
+
+	source := "same_host"
+	if prev.host != entry.host {
+		source = "other_host"
+	}
+	if key.kind == dedupKindCommit {
+		duplicateCommits.WithLabelValues(evt.Host.Host, source).Inc()
+	}
+	duplicateEvents.WithLabelValues(evt.Host.Host, key.kind, source).Inc()
+	return &ErrDuplicateEvent{Kind: key.kind, Repo: key.did, Rev: key.rev, FirstHost: prev.host}
+}
+
+// claim takes the keys an event is entitled to, or returns the entry of the
+// event it duplicates. An identity or account event is a duplicate if its
+// host already sent one with the same time and seq, or if another host sent
+// one with the same time and contents; two from the same host with the same
+// time but different seqs are both kept.
+func (s *dedupStage) claim(key dedupKey, entry dedupEntry) (dedupEntry, bool) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if key.kind == dedupKindCommit {
+		prev, ok := s.seen.Get(key)
+		if !ok {
+			s.seen.Add(key, entry)
+			return dedupEntry{}, false
+		}
+		return prev, prev.id == entry.id
+	}
+
+	rk := replayKey(key, entry)
+	if prev, ok := s.seen.Get(rk); ok && prev.id == entry.id {
+		return prev, true
+	}
+	prev, ok := s.seen.Get(key)
+	if ok && prev.id == entry.id && prev.host != entry.host {
+		return prev, true
+	}
+
+	s.seen.Add(rk, entry)
+	if !ok {
+		s.seen.Add(key, entry)
+	}
+	return dedupEntry{}, false
+}
+
+func (s *dedupStage) Rejected(evt *IngestEvent) {
+	s.Forget(evt)
+}
+
+// Forget gives up the claims an event made on its keys
+func (s *dedupStage) Forget(evt *IngestEvent) {
+	key, entry, ok := dedupKeyFor(evt)
+	if !ok {
+		return
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	keys := []dedupKey{key}
+	if key.kind != dedupKindCommit {
+		keys = append(keys, replayKey(key, entry))
+	}
+	for _, k := range keys {
+		if cur, ok := s.seen.Peek(k); ok && cur == entry {
+			s.seen.Remove(k)
+		}
+	}
+}
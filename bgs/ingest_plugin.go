@@ -0,0 +1,33 @@
+package bgs
+
+import (
+	"fmt"
+	"plugin"
+)
+
+// IngestPluginSymbol is the symbol LoadIngestPlugin looks up. Plugins export
+// it as a function returning the stages to add:
+//
+//	func IngestStages() []bgs.IngestStage
+const IngestPluginSymbol = "IngestStages"
+
+// LoadIngestPlugin opens a Go plugin (built with -buildmode=plugin against
+// the same version of this module) and returns the ingest stages it provides
+func LoadIngestPlugin(path string) ([]IngestStage, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening ingest plugin: %w", err)
+	}
+
+	sym, err := p.Lookup(IngestPluginSymbol)
+	if err != nil {
+		return nil, fmt.Errorf("ingest plugin %s: %w", path, err)
+	}
+
+	fn, ok := sym.(func() []IngestStage)
+	if !ok {
+		return nil, fmt.Errorf("ingest plugin %s: %s has type %T, expected func() []bgs.IngestStage", path, IngestPluginSymbol, sym)
+	}
+
+	return fn(), nil
+}
@@ -0,0 +1,179 @@
+package bgs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+
+	"gorm.io/gorm"
+)
+
+// Size limits enforced by the size stage
+const (
+	SizeLimitCommitBytes  = "commit_bytes"
+	SizeLimitCommitOps    = "commit_ops"
+	SizeLimitCommitBlocks = "commit_blocks"
+	SizeLimitBlockBytes   = "block_bytes"
+	SizeLimitRepoBytes    = "repo_bytes"
+)
+
+// ErrSizeLimitExceeded is returned by the size stage for a commit over one of
+// its limits
+type ErrSizeLimitExceeded struct {
+	Limit string
+	Size  int64
+	Max   int64
+}
+
+func (e *ErrSizeLimitExceeded) Error() string {
+	return fmt.Sprintf("%s limit exceeded: %d is more than %d", e.Limit, e.Size, e.Max)
+}
+
+// sizeStage bounds the size of commits, and of the repos they're added to.
+// Hosts that keep sending oversized commits are blocked.
+type sizeStage struct {
+	bgs *BGS
+
+	maxBytes     int
+	maxOps       int
+	maxBlocks    int
+	maxBlockSize int
+	maxRepoBytes int64
+
+	violationsToBlock int
+	violationWindow   time.Duration
+
+	lk         sync.Mutex
+	violations map[uint]*sizeViolations
+}
+
+// sizeViolations counts a host's violations in the current window
+type sizeViolations struct {
+	since time.Time
+	count int
+}
+
+func newSizeStage(bgs *BGS, opts *IngestOptions) *sizeStage {
+	return &sizeStage{
+		bgs:               bgs,
+		maxBytes:          opts.MaxCommitBytes,
+		maxOps:            opts.MaxCommitOps,
+		maxBlocks:         opts.MaxCommitBlocks,
+		maxBlockSize:      opts.MaxBlockBytes,
+		maxRepoBytes:      opts.MaxRepoBytes,
+		violationsToBlock: opts.SizeViolationsToBlock,
+		violationWindow:   opts.SizeViolationWindow,
+		violations:        make(map[uint]*sizeViolations),
+	}
+}
+
+func (s *sizeStage) Name() string { return IngestStageSize }
+
+func (s *sizeStage) Check(ctx context.Context, evt *IngestEvent) error {
+	if evt.Event.RepoCommit == nil {
+		return nil
+	}
+
+	err := s.check(ctx, evt)
+	var lerr *ErrSizeLimitExceeded
+	if errors.As(err, &lerr) {
+		s.recordViolation(ctx, evt.Host, lerr.Limit)
+	}
+	return err
+}
+
+func (s *sizeStage) check(ctx context.Context, evt *IngestEvent) error {
+	commit := evt.Event.RepoCommit
+
+	if s.maxBytes > 0 && len(commit.Blocks) > s.maxBytes {
+		return &ErrSizeLimitExceeded{Limit: SizeLimitCommitBytes, Size: int64(len(commit.Blocks)), Max: int64(s.maxBytes)}
+	}
+	if s.maxOps > 0 && len(commit.Ops) > s.maxOps {
+		return &ErrSizeLimitExceeded{Limit: SizeLimitCommitOps, Size: int64(len(commit.Ops)), Max: int64(s.maxOps)}
+	}
+
+	if s.maxBlocks > 0 || s.maxBlockSize > 0 {
+		blocks, err := evt.Blocks()
+		if err != nil {
+			return err
+		}
+		if s.maxBlocks > 0 && len(blocks) > s.maxBlocks {
+			return &ErrSizeLimitExceeded{Limit: SizeLimitCommitBlocks, Size: int64(len(blocks)), Max: int64(s.maxBlocks)}
+		}
+		if s.maxBlockSize > 0 {
+			for _, blk := range blocks {
+				if len(blk) > s.maxBlockSize {
+					return &ErrSizeLimitExceeded{Limit: SizeLimitBlockBytes, Size: int64(len(blk)), Max: int64(s.maxBlockSize)}
+				}
+			}
+		}
+	}
+
+	if s.maxRepoBytes > 0 {
+		size, err := s.repoBytes(ctx, commit.Repo)
+		if err != nil {
+			// as with the rev stage, don't hold up ingest on a lookup failure
+			log.Warnw("failed to look up repo size for ingest check", "repo", commit.Repo, "err", err)
+			return nil
+		}
+		if size > s.maxRepoBytes {
+			return &ErrSizeLimitExceeded{Limit: SizeLimitRepoBytes, Size: size, Max: s.maxRepoBytes}
+		}
+	}
+
+	return nil
+}
+
+func (s *sizeStage) repoBytes(ctx context.Context, did string) (int64, error) {
+	u, err := s.bgs.lookupUserByDid(ctx, did)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	us, err := s.bgs.repoman.CarStore().UserStorage(ctx, u.ID)
+	if err != nil {
+		return 0, err
+	}
+	return us.Bytes, nil
+}
+
+// recordViolation counts a size limit violation against the host, blocking it
+// once it reaches the threshold
+func (s *sizeStage) recordViolation(ctx context.Context, host *models.PDS, limit string) {
+	sizeLimitViolations.WithLabelValues(host.Host, limit).Inc()
+
+	if s.violationsToBlock <= 0 {
+		return
+	}
+
+	now := time.Now()
+	s.lk.Lock()
+	v, ok := s.violations[host.ID]
+	if !ok || now.Sub(v.since) > s.violationWindow {
+		v = &sizeViolations{since: now}
+		s.violations[host.ID] = v
+	}
+	v.count++
+	block := v.count >= s.violationsToBlock
+	if block {
+		delete(s.violations, host.ID)
+	}
+	s.lk.Unlock()
+
+	if !block {
+		return
+	}
+
+	log.Warnw("blocking pds for repeated size limit violations", "host", host.Host, "violations", s.violationsToBlock, "window", s.violationWindow)
+	sizeLimitBlocks.Inc()
+	if err := s.bgs.slurper.KillUpstreamConnection(host.Host, true); err != nil {
+		log.Errorw("failed to block pds over size limit violations", "host", host.Host, "err", err)
+	}
+}
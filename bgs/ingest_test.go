@@ -0,0 +1,129 @@
+package bgs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/util"
+
+	"gorm.io/gorm"
+)
+
+// fixedClock is a util.Clock stopped at one time
+type fixedClock struct {
+	util.Clock
+	now time.Time
+}
+
+func (fc fixedClock) Now() time.Time { return fc.now }
+
+func commitEvent(repo, rev string) *IngestEvent {
+	return &IngestEvent{Event: &events.XRPCStreamEvent{RepoCommit: &comatproto.SyncSubscribeRepos_Commit{
+		Repo: repo,
+		Rev:  rev,
+	}}}
+}
+
+func TestRevStageSkewUsesClock(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	s := newRevStage(nil, 5*time.Minute, fixedClock{now: now})
+	s.last.Add("did:plc:one", syntax.NewTIDFromTime(now.Add(-time.Hour), 0).String())
+
+	for _, tc := range []struct {
+		name   string
+		at     time.Time
+		reject bool
+	}{
+		{"now", now, false},
+		{"within skew", now.Add(4 * time.Minute), false},
+		{"past skew", now.Add(6 * time.Minute), true},
+	} {
+		rev := syntax.NewTIDFromTime(tc.at, 0).String()
+		err := s.Check(context.Background(), commitEvent("did:plc:one", rev))
+		var rv *ErrRevViolation
+		if got := errors.As(err, &rv) && rv.Kind == RevViolationFuture; got != tc.reject {
+			t.Errorf("%s: expected future rejection %v, got err %v", tc.name, tc.reject, err)
+		}
+	}
+}
+
+func TestRevStageForget(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	s := newRevStage(nil, 0, fixedClock{now: now})
+	evt := commitEvent("did:plc:one", syntax.NewTIDFromTime(now, 0).String())
+
+	s.Accepted(evt)
+	err := s.Check(context.Background(), evt)
+	var rv *ErrRevViolation
+	if !errors.As(err, &rv) || rv.Kind != RevViolationDuplicate {
+		t.Fatalf("expected the accepted rev to be a duplicate, got %v", err)
+	}
+
+	// a commit that failed to be handled is forgotten, so its rev is checked
+	// against the stored one again
+	s.Forget("did:plc:one")
+	if _, ok := s.last.Get("did:plc:one"); ok {
+		t.Fatal("expected the rev to be forgotten")
+	}
+}
+
+func TestDedupStageAccountEvents(t *testing.T) {
+	s := newDedupStage(100, time.Hour)
+	pds := &models.PDS{Model: gorm.Model{ID: 1}, Host: "pds.example.com"}
+	relay := &models.PDS{Model: gorm.Model{ID: 2}, Host: "relay.example.com"}
+
+	account := func(host *models.PDS, seq int64, active bool) *IngestEvent {
+		evt := &comatproto.SyncSubscribeRepos_Account{
+			Did:    "did:plc:one",
+			Seq:    seq,
+			Time:   "2024-06-01T12:00:00.123Z",
+			Active: active,
+		}
+		if !active {
+			evt.Status = &events.AccountStatusDeactivated
+		}
+		return &IngestEvent{Host: host, Event: &events.XRPCStreamEvent{RepoAccount: evt}}
+	}
+
+	for _, tc := range []struct {
+		name string
+		evt  *IngestEvent
+		dup  bool
+	}{
+		{"first", account(pds, 1, true), false},
+		{"deactivated in the same millisecond", account(pds, 2, false), false},
+		{"reactivated in the same millisecond", account(pds, 3, true), false},
+		{"replayed", account(pds, 1, true), true},
+		{"second in the millisecond replayed", account(pds, 2, false), true},
+		{"third in the millisecond replayed", account(pds, 3, true), true},
+		{"from another upstream", account(relay, 57, true), true},
+		{"deactivation from another upstream", account(relay, 58, false), false},
+		{"deactivation from another upstream replayed", account(relay, 58, false), true},
+	} {
+		err := s.Check(context.Background(), tc.evt)
+		var de *ErrDuplicateEvent
+		if got := errors.As(err, &de); got != tc.dup {
+			t.Errorf("%s: expected duplicate %v, got %v", tc.name, tc.dup, err)
+		}
+	}
+
+	// a forgotten event gives up both its claims, so a copy from either host
+	// takes its place
+	s.Forget(account(pds, 2, false))
+	if err := s.Check(context.Background(), account(pds, 2, false)); err != nil {
+		t.Fatalf("expected the forgotten event to be taken again, got %v", err)
+	}
+	s.Forget(account(pds, 1, true))
+	if err := s.Check(context.Background(), account(relay, 57, true)); err != nil {
+		t.Fatalf("expected a copy from another upstream to take the forgotten event's place, got %v", err)
+	}
+	if err := s.Check(context.Background(), account(pds, 1, true)); err == nil {
+		t.Fatal("expected the forgotten event to be a duplicate of the copy that replaced it")
+	}
+}
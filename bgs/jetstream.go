@@ -0,0 +1,485 @@
+package bgs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/repomgr"
+
+	"github.com/gorilla/websocket"
+	"github.com/ipfs/go-cid"
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo/v4"
+	promclient "github.com/prometheus/client_golang/prometheus"
+)
+
+const jetstreamPath = "/subscribe"
+
+// the limits Jetstream puts on subscriber filters
+const (
+	jetstreamMaxWantedCollections = 100
+	jetstreamMaxWantedDids        = 10_000
+)
+
+// JetstreamEvent is an event in Jetstream's JSON format. Commits are split
+// into one event per op.
+type JetstreamEvent struct {
+	Did string `json:"did"`
+	// the event's time, in microseconds since the epoch; passed back as the
+	// cursor to resume from it
+	TimeUS   int64                                   `json:"time_us"`
+	Kind     string                                  `json:"kind"`
+	Commit   *JetstreamCommit                        `json:"commit,omitempty"`
+	Identity *comatproto.SyncSubscribeRepos_Identity `json:"identity,omitempty"`
+	Account  *comatproto.SyncSubscribeRepos_Account  `json:"account,omitempty"`
+}
+
+// JetstreamCommit is one op of a commit
+type JetstreamCommit struct {
+	Rev        string `json:"rev"`
+	Operation  string `json:"operation"`
+	Collection string `json:"collection"`
+	RKey       string `json:"rkey"`
+	// the record, for creates and updates
+	Record json.RawMessage `json:"record,omitempty"`
+	Cid    string          `json:"cid,omitempty"`
+}
+
+// jetstreamFilter is what a Jetstream subscriber asked for. Empty
+// collections or DIDs mean all of them.
+type jetstreamFilter struct {
+	collections map[string]bool
+	// from wildcards like app.bsky.feed.*, with the trailing dot
+	prefixes []string
+	dids     map[string]bool
+	// messages larger than this are skipped; zero for no limit
+	maxSize int
+}
+
+func parseJetstreamFilter(collections, dids []string, maxSize int) (*jetstreamFilter, error) {
+	if len(collections) > jetstreamMaxWantedCollections {
+		return nil, fmt.Errorf("at most %d wantedCollections are allowed", jetstreamMaxWantedCollections)
+	}
+	if len(dids) > jetstreamMaxWantedDids {
+		return nil, fmt.Errorf("at most %d wantedDids are allowed", jetstreamMaxWantedDids)
+	}
+	if maxSize < 0 {
+		return nil, fmt.Errorf("maxMessageSizeBytes must not be negative")
+	}
+
+	f := &jetstreamFilter{
+		collections: make(map[string]bool),
+		dids:        make(map[string]bool),
+		maxSize:     maxSize,
+	}
+	for _, col := range collections {
+		if prefix, ok := strings.CutSuffix(col, ".*"); ok {
+			// the prefix must be the start of a valid NSID
+			if _, err := syntax.ParseNSID(prefix + ".a.b"); err != nil {
+				return nil, fmt.Errorf("invalid collection wildcard %q", col)
+			}
+			f.prefixes = append(f.prefixes, prefix+".")
+			continue
+		}
+		if _, err := syntax.ParseNSID(col); err != nil {
+			return nil, fmt.Errorf("invalid collection %q", col)
+		}
+		f.collections[col] = true
+	}
+	for _, did := range dids {
+		if _, err := syntax.ParseDID(did); err != nil {
+			return nil, fmt.Errorf("invalid DID %q", did)
+		}
+		f.dids[did] = true
+	}
+	return f, nil
+}
+
+func (f *jetstreamFilter) wantsDid(did string) bool {
+	return len(f.dids) == 0 || f.dids[did]
+}
+
+func (f *jetstreamFilter) wantsCollection(col string) bool {
+	if len(f.collections) == 0 && len(f.prefixes) == 0 {
+		return true
+	}
+	if f.collections[col] {
+		return true
+	}
+	for _, p := range f.prefixes {
+		if strings.HasPrefix(col, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether any of an event's Jetstream events would pass the
+// filter, so the rest are dropped before they're decoded. Identity and
+// account events are filtered by DID only.
+func (f *jetstreamFilter) match(evt *events.XRPCStreamEvent) bool {
+	switch {
+	case evt.RepoCommit != nil:
+		if !f.wantsDid(evt.RepoCommit.Repo) {
+			return false
+		}
+		for _, op := range evt.RepoCommit.Ops {
+			col, _, _ := strings.Cut(op.Path, "/")
+			if f.wantsCollection(col) {
+				return true
+			}
+		}
+		return false
+	case evt.RepoIdentity != nil:
+		return f.wantsDid(evt.RepoIdentity.Did)
+	case evt.RepoAccount != nil:
+		return f.wantsDid(evt.RepoAccount.Did)
+	default:
+		return false
+	}
+}
+
+// jetstreamEvents converts a firehose event into Jetstream events, keeping
+// the ones that pass the filter
+func jetstreamEvents(evt *events.XRPCStreamEvent, f *jetstreamFilter) ([]*JetstreamEvent, error) {
+	switch {
+	case evt.RepoCommit != nil:
+		commit := evt.RepoCommit
+		if !f.wantsDid(commit.Repo) {
+			return nil, nil
+		}
+
+		var blocks map[cid.Cid][]byte
+		var out []*JetstreamEvent
+		for _, op := range commit.Ops {
+			col, rkey, ok := strings.Cut(op.Path, "/")
+			if !ok || !f.wantsCollection(col) {
+				continue
+			}
+
+			jc := &JetstreamCommit{
+				Rev:        commit.Rev,
+				Operation:  op.Action,
+				Collection: col,
+				RKey:       rkey,
+			}
+			switch repomgr.EventKind(op.Action) {
+			case repomgr.EvtKindCreateRecord, repomgr.EvtKindUpdateRecord:
+				if op.Cid == nil {
+					continue
+				}
+				if blocks == nil {
+					b, err := readCommitBlocks(commit.Blocks)
+					if err != nil {
+						return nil, err
+					}
+					blocks = b
+				}
+				blk, ok := blocks[cid.Cid(*op.Cid)]
+				if !ok {
+					// too big commits don't carry their records
+					continue
+				}
+				rec, err := data.UnmarshalCBOR(blk)
+				if err != nil {
+					return nil, fmt.Errorf("decoding record %q: %w", op.Path, err)
+				}
+				if jc.Record, err = json.Marshal(rec); err != nil {
+					return nil, fmt.Errorf("encoding record %q: %w", op.Path, err)
+				}
+				jc.Cid = cid.Cid(*op.Cid).String()
+			case repomgr.EvtKindDeleteRecord:
+			default:
+				continue
+			}
+			out = append(out, &JetstreamEvent{Did: commit.Repo, TimeUS: eventTimeUS(commit.Time), Kind: "commit", Commit: jc})
+		}
+		return out, nil
+	case evt.RepoIdentity != nil:
+		if !f.wantsDid(evt.RepoIdentity.Did) {
+			return nil, nil
+		}
+		return []*JetstreamEvent{{Did: evt.RepoIdentity.Did, TimeUS: eventTimeUS(evt.RepoIdentity.Time), Kind: "identity", Identity: evt.RepoIdentity}}, nil
+	case evt.RepoAccount != nil:
+		if !f.wantsDid(evt.RepoAccount.Did) {
+			return nil, nil
+		}
+		return []*JetstreamEvent{{Did: evt.RepoAccount.Did, TimeUS: eventTimeUS(evt.RepoAccount.Time), Kind: "account", Account: evt.RepoAccount}}, nil
+	}
+	return nil, nil
+}
+
+// eventTimeUS returns an event's time in microseconds, or now if it doesn't
+// have a valid one
+func eventTimeUS(ts string) int64 {
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return time.Now().UnixMicro()
+	}
+	return t.UnixMicro()
+}
+
+// jetstreamSince maps a Jetstream time_us cursor to the sequence number to
+// play back from. It returns nil, for the live stream, if there's no cursor
+// or it's in the future.
+func (bgs *BGS) jetstreamSince(ctx context.Context, cursor string) (*int64, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	us, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil || us < 0 {
+		return nil, apiError(http.StatusBadRequest, XRPCErrInvalidRequest, "cursor must be a time in microseconds")
+	}
+	t := time.UnixMicro(us)
+	if !t.Before(time.Now()) {
+		return nil, nil
+	}
+	seq, err := bgs.events.SeqForTime(ctx, t)
+	if err != nil {
+		return nil, fmt.Errorf("looking up cursor for time: %w", err)
+	}
+	return &seq, nil
+}
+
+// jetstreamOptionsUpdate is the message Jetstream subscribers send to change
+// their filter without reconnecting
+type jetstreamOptionsUpdate struct {
+	Type    string `json:"type"`
+	Payload struct {
+		WantedCollections   []string `json:"wantedCollections"`
+		WantedDids          []string `json:"wantedDids"`
+		MaxMessageSizeBytes int      `json:"maxMessageSizeBytes"`
+	} `json:"payload"`
+}
+
+// handleJetstreamSubscribe serves the firehose in Jetstream's simplified
+// JSON format, so consumers that only want records don't need a separate
+// Jetstream service. Subscribers filter by collection and DID with
+// wantedCollections and wantedDids, can resume from a time_us cursor, and can
+// ask for zstd compressed messages with compress=true.
+func (bgs *BGS) handleJetstreamSubscribe(c echo.Context) error {
+	ctx, cancel := context.WithCancel(c.Request().Context())
+	defer cancel()
+
+	params := c.QueryParams()
+	maxSize := 0
+	if v := params.Get("maxMessageSizeBytes"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return apiError(http.StatusBadRequest, XRPCErrInvalidRequest, "invalid maxMessageSizeBytes")
+		}
+		maxSize = n
+	}
+	f, err := parseJetstreamFilter(params["wantedCollections"], params["wantedDids"], maxSize)
+	if err != nil {
+		return apiError(http.StatusBadRequest, XRPCErrInvalidRequest, "%s", err)
+	}
+	var filter atomic.Pointer[jetstreamFilter]
+	filter.Store(f)
+
+	since, err := bgs.jetstreamSince(ctx, params.Get("cursor"))
+	if err != nil {
+		return err
+	}
+	requireHello := params.Get("requireHello") == "true"
+	compress := params.Get("compress") == "true" || c.Request().Header.Get("Socket-Encoding") == "zstd"
+
+	identity, release, err := bgs.admitSubscriber(ctx, c.Request())
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	var enc *zstd.Encoder
+	if compress {
+		enc, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if err != nil {
+			return err
+		}
+		defer enc.Close()
+	}
+
+	conn, err := websocket.Upgrade(c.Response(), c.Request(), c.Response().Header(), 10<<10, 10<<10)
+	if err != nil {
+		return fmt.Errorf("upgrading websocket: %w", err)
+	}
+	defer conn.Close()
+
+	lastWriteLk := sync.Mutex{}
+	lastWrite := time.Now()
+
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				lastWriteLk.Lock()
+				lw := lastWrite
+				lastWriteLk.Unlock()
+
+				if time.Since(lw) < 30*time.Second {
+					continue
+				}
+
+				if err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(5*time.Second)); err != nil {
+					ctxLog(ctx).Warnf("failed to ping client: %s", err)
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	conn.SetPingHandler(func(message string) error {
+		err := conn.WriteControl(websocket.PongMessage, []byte(message), time.Now().Add(time.Second*60))
+		if err == websocket.ErrCloseSent {
+			return nil
+		} else if e, ok := err.(net.Error); ok && e.Temporary() {
+			return nil
+		}
+		return err
+	})
+
+	// subscribers can replace their filter at any time, and with
+	// requireHello, nothing is sent until they first do
+	hello := make(chan struct{})
+	var helloOnce sync.Once
+	if !requireHello {
+		close(hello)
+	}
+	go func() {
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				ctxLog(ctx).Warnf("failed to read message from client: %s", err)
+				cancel()
+				return
+			}
+
+			var upd jetstreamOptionsUpdate
+			if err := json.Unmarshal(msg, &upd); err != nil || upd.Type != "options_update" {
+				continue
+			}
+			f, err := parseJetstreamFilter(upd.Payload.WantedCollections, upd.Payload.WantedDids, upd.Payload.MaxMessageSizeBytes)
+			if err != nil {
+				ctxLog(ctx).Infow("rejected jetstream options update", "err", err)
+				continue
+			}
+			filter.Store(f)
+			if requireHello {
+				helloOnce.Do(func() { close(hello) })
+			}
+		}
+	}()
+
+	select {
+	case <-hello:
+	case <-ctx.Done():
+		return nil
+	}
+
+	ident := c.RealIP() + "-" + c.Request().UserAgent()
+
+	evts, cleanup, err := bgs.events.Subscribe(ctx, ident, func(evt *events.XRPCStreamEvent) bool {
+		return filter.Load().match(evt)
+	}, since)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	consumer := &SocketConsumer{
+		RemoteAddr:  c.RealIP(),
+		UserAgent:   c.Request().UserAgent(),
+		ConnectedAt: time.Now(),
+		Transport:   "jetstream",
+		Identity:    identity,
+	}
+	sentCounter := eventsSentCounter.WithLabelValues(consumer.RemoteAddr, consumer.UserAgent)
+	consumer.EventsSent = sentCounter
+	var identitySentCounter promclient.Counter
+	if identity != "" {
+		identitySentCounter = subscriberEventsSent.WithLabelValues(identity)
+	}
+
+	consumerID := bgs.registerConsumer(consumer, since)
+	defer bgs.cleanupConsumer(consumerID)
+
+	logger := ctxLog(ctx).With(
+		"consumer_id", consumerID,
+		"remote_addr", consumer.RemoteAddr,
+		"user_agent", consumer.UserAgent,
+		"transport", consumer.Transport,
+		"identity", consumer.Identity,
+	)
+	logger.Infow("new consumer", "cursor", since, "compress", compress)
+
+	msgType := websocket.TextMessage
+	if compress {
+		msgType = websocket.BinaryMessage
+	}
+
+	for {
+		select {
+		case evt, ok := <-evts:
+			if !ok {
+				logger.Error("event stream closed unexpectedly")
+				return nil
+			}
+
+			f := filter.Load()
+			jevts, err := jetstreamEvents(evt, f)
+			if err != nil {
+				logger.Warnw("failed to convert event for jetstream", "seq", evt.Sequence(), "err", err)
+				continue
+			}
+
+			for _, je := range jevts {
+				msg, err := json.Marshal(je)
+				if err != nil {
+					return fmt.Errorf("encoding jetstream event: %w", err)
+				}
+				if f.maxSize > 0 && len(msg) > f.maxSize {
+					continue
+				}
+				if enc != nil {
+					msg = enc.EncodeAll(msg, nil)
+				}
+
+				if err := conn.WriteMessage(msgType, msg); err != nil {
+					logger.Warnf("failed to write event: %s", err)
+					return nil
+				}
+
+				consumer.BytesSent.Add(int64(len(msg)))
+				jetstreamEventsSent.WithLabelValues(je.Kind).Inc()
+				sentCounter.Inc()
+				if identitySentCounter != nil {
+					identitySentCounter.Inc()
+				}
+			}
+
+			lastWriteLk.Lock()
+			lastWrite = time.Now()
+			lastWriteLk.Unlock()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
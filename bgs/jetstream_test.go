@@ -0,0 +1,386 @@
+package bgs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+
+	"github.com/gorilla/websocket"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+var jetstreamTestTime = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func testIdentityEvent(did string, at time.Time) *events.XRPCStreamEvent {
+	handle := strings.TrimPrefix(did, "did:plc:") + ".test"
+	return &events.XRPCStreamEvent{RepoIdentity: &comatproto.SyncSubscribeRepos_Identity{
+		Did:    did,
+		Handle: &handle,
+		Time:   at.Format(time.RFC3339Nano),
+	}}
+}
+
+func TestJetstreamEvents(t *testing.T) {
+	post := recordBlock(t, map[string]any{"$type": "app.bsky.feed.post", "text": "hello", "createdAt": "2024-06-01T12:00:00Z"})
+	like := recordBlock(t, map[string]any{"$type": "app.bsky.feed.like", "createdAt": "2024-06-01T12:00:00Z"})
+	missing, err := cid.NewPrefixV1(cid.DagCBOR, 0x12).Sum([]byte("not in the commit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := func(c cid.Cid) *lexutil.LexLink {
+		l := lexutil.LexLink(c)
+		return &l
+	}
+
+	commit := &events.XRPCStreamEvent{RepoCommit: &comatproto.SyncSubscribeRepos_Commit{
+		Repo:   "did:plc:alice",
+		Rev:    "3kabc",
+		Time:   jetstreamTestTime.Format(time.RFC3339),
+		Blocks: writeTestCar(t, post.Cid(), post, like),
+		Ops: []*comatproto.SyncSubscribeRepos_RepoOp{
+			{Action: "create", Path: "app.bsky.feed.post/1", Cid: link(post.Cid())},
+			{Action: "update", Path: "app.bsky.feed.like/2", Cid: link(like.Cid())},
+			{Action: "delete", Path: "app.bsky.feed.post/3"},
+			// records left out of the blocks, as in too big commits
+			{Action: "create", Path: "app.bsky.feed.post/4", Cid: link(missing)},
+			{Action: "create", Path: "app.bsky.feed.post/5"},
+			// and ops that don't make sense
+			{Action: "bogus", Path: "app.bsky.feed.post/6", Cid: link(post.Cid())},
+			{Action: "create", Path: "app.bsky.feed.post", Cid: link(post.Cid())},
+		},
+	}}
+	active := &events.XRPCStreamEvent{RepoAccount: &comatproto.SyncSubscribeRepos_Account{
+		Did:    "did:plc:alice",
+		Active: true,
+		Time:   jetstreamTestTime.Format(time.RFC3339),
+	}}
+	identity := testIdentityEvent("did:plc:alice", jetstreamTestTime)
+
+	for _, tc := range []struct {
+		name        string
+		evt         *events.XRPCStreamEvent
+		collections []string
+		dids        []string
+		// kind and, for commits, operation and path of each event
+		expected []string
+	}{
+		{name: "commit", evt: commit, expected: []string{
+			"commit create app.bsky.feed.post/1",
+			"commit update app.bsky.feed.like/2",
+			"commit delete app.bsky.feed.post/3",
+		}},
+		{name: "commit, one collection", evt: commit, collections: []string{"app.bsky.feed.like"}, expected: []string{
+			"commit update app.bsky.feed.like/2",
+		}},
+		{name: "commit, wildcard", evt: commit, collections: []string{"app.bsky.feed.*"}, expected: []string{
+			"commit create app.bsky.feed.post/1",
+			"commit update app.bsky.feed.like/2",
+			"commit delete app.bsky.feed.post/3",
+		}},
+		{name: "commit, other collection", evt: commit, collections: []string{"app.bsky.graph.*"}},
+		{name: "commit, wanted did", evt: commit, dids: []string{"did:plc:alice"}, collections: []string{"app.bsky.feed.post"}, expected: []string{
+			"commit create app.bsky.feed.post/1",
+			"commit delete app.bsky.feed.post/3",
+		}},
+		{name: "commit, other did", evt: commit, dids: []string{"did:plc:bob"}},
+		{name: "identity", evt: identity, expected: []string{"identity"}},
+		// collections don't apply to identity and account events
+		{name: "identity, collection filter", evt: identity, collections: []string{"app.bsky.feed.post"}, expected: []string{"identity"}},
+		{name: "identity, other did", evt: identity, dids: []string{"did:plc:bob"}},
+		{name: "account", evt: active, dids: []string{"did:plc:alice"}, expected: []string{"account"}},
+		{name: "account, other did", evt: active, dids: []string{"did:plc:bob"}},
+	} {
+		f, err := parseJetstreamFilter(tc.collections, tc.dids, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if f.match(tc.evt) != (len(tc.expected) > 0) {
+			t.Errorf("%s: expected match %v", tc.name, len(tc.expected) > 0)
+		}
+
+		out, err := jetstreamEvents(tc.evt, f)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		var got []string
+		for _, je := range out {
+			if je.Did != "did:plc:alice" || je.TimeUS != jetstreamTestTime.UnixMicro() {
+				t.Errorf("%s: unexpected did or time in %+v", tc.name, je)
+			}
+			desc := je.Kind
+			switch je.Kind {
+			case "commit":
+				desc += " " + je.Commit.Operation + " " + je.Commit.Collection + "/" + je.Commit.RKey
+				if je.Commit.Rev != "3kabc" {
+					t.Errorf("%s: unexpected rev %q", tc.name, je.Commit.Rev)
+				}
+			case "identity":
+				if je.Identity == nil || *je.Identity.Handle != "alice.test" {
+					t.Errorf("%s: unexpected identity %+v", tc.name, je.Identity)
+				}
+			case "account":
+				if je.Account == nil || !je.Account.Active {
+					t.Errorf("%s: unexpected account %+v", tc.name, je.Account)
+				}
+			}
+			got = append(got, desc)
+		}
+		if !equalStrings(got, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+
+	// records are carried as JSON, with their CID; deletes have neither
+	out, err := jetstreamEvents(commit, &jetstreamFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec map[string]any
+	if err := json.Unmarshal(out[0].Commit.Record, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec["text"] != "hello" || rec["$type"] != "app.bsky.feed.post" || out[0].Commit.Cid != post.Cid().String() {
+		t.Fatalf("unexpected record %s (%s)", out[0].Commit.Record, out[0].Commit.Cid)
+	}
+	if out[1].Commit.Cid != like.Cid().String() {
+		t.Fatalf("unexpected cid for update %s", out[1].Commit.Cid)
+	}
+	if out[2].Commit.Record != nil || out[2].Commit.Cid != "" {
+		t.Fatalf("expected no record for a delete, got %+v", out[2].Commit)
+	}
+}
+
+func TestParseJetstreamFilter(t *testing.T) {
+	many := func(n int, format string) []string {
+		out := make([]string, n)
+		for i := range out {
+			out[i] = fmt.Sprintf(format, i)
+		}
+		return out
+	}
+
+	for _, tc := range []struct {
+		name        string
+		collections []string
+		dids        []string
+		maxSize     int
+		ok          bool
+		// collections and whether they're wanted
+		wants map[string]bool
+	}{
+		{name: "everything", ok: true, wants: map[string]bool{"app.bsky.feed.post": true, "com.example.thing": true}},
+		{name: "exact", collections: []string{"app.bsky.feed.post"}, ok: true,
+			wants: map[string]bool{"app.bsky.feed.post": true, "app.bsky.feed.like": false, "app.bsky.feed.postgate": false}},
+		{name: "prefix", collections: []string{"app.bsky.feed.*"}, ok: true,
+			wants: map[string]bool{"app.bsky.feed.post": true, "app.bsky.feed.like": true, "app.bsky.feedx.post": false, "app.bsky.graph.follow": false}},
+		{name: "short prefix", collections: []string{"app.*"}, ok: true,
+			wants: map[string]bool{"app.bsky.feed.post": true, "com.example.thing": false}},
+		{name: "prefix and exact", collections: []string{"app.bsky.graph.*", "app.bsky.feed.like"}, ok: true,
+			wants: map[string]bool{"app.bsky.graph.follow": true, "app.bsky.feed.like": true, "app.bsky.feed.post": false}},
+		{name: "bare wildcard", collections: []string{"*"}},
+		{name: "empty prefix", collections: []string{".*"}},
+		{name: "wildcard in the middle", collections: []string{"app.*.post"}},
+		{name: "invalid nsid", collections: []string{"not an nsid"}},
+		{name: "most collections", collections: many(jetstreamMaxWantedCollections, "com.example%d.thing"), ok: true},
+		{name: "too many collections", collections: many(jetstreamMaxWantedCollections+1, "com.example%d.thing")},
+		{name: "most dids", dids: many(jetstreamMaxWantedDids, "did:plc:u%d"), ok: true},
+		{name: "too many dids", dids: many(jetstreamMaxWantedDids+1, "did:plc:u%d")},
+		{name: "invalid did", dids: []string{"alice"}},
+		{name: "size limit", maxSize: 1000, ok: true},
+		{name: "negative size limit", maxSize: -1},
+	} {
+		f, err := parseJetstreamFilter(tc.collections, tc.dids, tc.maxSize)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: expected ok %v, got %v", tc.name, tc.ok, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if f.maxSize != tc.maxSize {
+			t.Errorf("%s: expected max size %d, got %d", tc.name, tc.maxSize, f.maxSize)
+		}
+		for col, want := range tc.wants {
+			if f.wantsCollection(col) != want {
+				t.Errorf("%s: expected %s wanted %v", tc.name, col, want)
+			}
+		}
+	}
+}
+
+// jetstreamTestBGS returns a BGS with just enough set up to serve Jetstream,
+// with an identity event for alice, bob and alice a second apart
+func jetstreamTestBGS(t *testing.T) *BGS {
+	ctx := context.Background()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "jetstream.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&FirehoseConsumer{}); err != nil {
+		t.Fatal(err)
+	}
+	alerts, err := NewAlerter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	em := events.NewEventManager(events.NewMemPersister())
+	t.Cleanup(func() { em.Shutdown(ctx) })
+	for i, did := range []string{"did:plc:alice", "did:plc:bob", "did:plc:alice"} {
+		if err := em.AddEvent(ctx, testIdentityEvent(did, jetstreamTestTime.Add(time.Duration(i)*time.Second))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &BGS{db: db, events: em, alerts: alerts, consumers: make(map[uint64]*SocketConsumer)}
+}
+
+func TestJetstreamSince(t *testing.T) {
+	bgs := jetstreamTestBGS(t)
+	us := func(d time.Duration) string {
+		return strconv.FormatInt(jetstreamTestTime.Add(d).UnixMicro(), 10)
+	}
+
+	for _, tc := range []struct {
+		cursor string
+		// -1 for the live stream
+		since int64
+		bad   bool
+	}{
+		{cursor: "", since: -1},
+		{cursor: strconv.FormatInt(time.Now().Add(time.Hour).UnixMicro(), 10), since: -1},
+		{cursor: us(-time.Hour), since: 0},
+		{cursor: us(0), since: 0},
+		{cursor: us(time.Second), since: 1},
+		{cursor: us(1500 * time.Millisecond), since: 2},
+		{cursor: us(2 * time.Second), since: 2},
+		{cursor: us(time.Hour), since: 3},
+		{cursor: "yesterday", bad: true},
+		{cursor: "-1", bad: true},
+	} {
+		since, err := bgs.jetstreamSince(context.Background(), tc.cursor)
+		if tc.bad {
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.Status != http.StatusBadRequest {
+				t.Errorf("%q: expected a bad request, got %v", tc.cursor, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.cursor, err)
+			continue
+		}
+		got := int64(-1)
+		if since != nil {
+			got = *since
+		}
+		if got != tc.since {
+			t.Errorf("%q: expected since %d, got %d", tc.cursor, tc.since, got)
+		}
+	}
+}
+
+func TestJetstreamSubscribe(t *testing.T) {
+	bgs := jetstreamTestBGS(t)
+	e := echo.New()
+	e.GET(jetstreamPath, bgs.handleJetstreamSubscribe)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	dial := func(query string) *websocket.Conn {
+		t.Helper()
+		con, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+jetstreamPath+"?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { con.Close() })
+		con.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return con
+	}
+	read := func(con *websocket.Conn) *JetstreamEvent {
+		t.Helper()
+		_, msg, err := con.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var je JetstreamEvent
+		if err := json.Unmarshal(msg, &je); err != nil {
+			t.Fatal(err)
+		}
+		return &je
+	}
+	update := func(con *websocket.Conn, dids ...string) {
+		t.Helper()
+		var upd jetstreamOptionsUpdate
+		upd.Type = "options_update"
+		upd.Payload.WantedDids = dids
+		if err := con.WriteJSON(upd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cursor := func(d time.Duration) string {
+		return strconv.FormatInt(jetstreamTestTime.Add(d).UnixMicro(), 10)
+	}
+
+	// a time_us cursor plays back from that time; bob's event there is
+	// filtered out
+	con := dial("wantedDids=did:plc:alice&cursor=" + cursor(time.Second))
+	je := read(con)
+	if je.Did != "did:plc:alice" || je.TimeUS != jetstreamTestTime.Add(2*time.Second).UnixMicro() {
+		t.Fatalf("expected alice's second event first, got %+v", je)
+	}
+
+	// with requireHello, nothing is sent until the first options update, so
+	// the filter the connection was opened with never applies
+	con = dial("requireHello=true&wantedDids=did:plc:alice&cursor=" + cursor(0))
+	update(con, "did:plc:bob")
+	if je := read(con); je.Did != "did:plc:bob" {
+		t.Fatalf("expected bob's event first after the hello, got %+v", je)
+	}
+
+	// invalid updates are ignored, and later ones replace the filter on the
+	// live stream
+	update(con, "not a did")
+	update(con, "did:plc:carol")
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			for _, did := range []string{"did:plc:alice", "did:plc:carol"} {
+				if err := bgs.events.AddEvent(context.Background(), testIdentityEvent(did, time.Now())); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+	for {
+		je := read(con)
+		if je.Did == "did:plc:carol" {
+			break
+		}
+		if je.Did != "did:plc:bob" {
+			t.Fatalf("expected only bob's events before the update took effect, got %+v", je)
+		}
+	}
+}
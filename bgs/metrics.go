@@ -1,7 +1,6 @@
 package bgs
 
 import (
-	"errors"
 	"net/http"
 	"strconv"
 	"time"
@@ -37,6 +36,31 @@ var eventsSentCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 	Help: "The total number of events sent to consumers",
 }, []string{"remote_addr", "user_agent"})
 
+var streamVersionConsumers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "stream_version_consumers",
+	Help: "Number of connected event stream consumers, by negotiated frame format version",
+}, []string{"version"})
+
+var streamVersionEventsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "stream_version_events_sent",
+	Help: "The total number of events sent to consumers, by negotiated frame format version",
+}, []string{"version"})
+
+var streamVersionRejected = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "stream_version_rejected",
+	Help: "Number of event stream connections refused because of an unsupported frame format version",
+})
+
+var pdsStorageBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "bgs_pds_storage_bytes",
+	Help: "Bytes of carstore data attributed to each PDS",
+}, []string{"pds"})
+
+var storageQuotaPauses = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "bgs_storage_quota_pauses",
+	Help: "Number of times a PDS was disconnected for exceeding its storage quota",
+})
+
 var externalUserCreationAttempts = promauto.NewCounter(prometheus.CounterOpts{
 	Name: "bgs_external_user_creation_attempts",
 	Help: "The total number of external users created",
@@ -94,17 +118,7 @@ func MetricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 
 		err := next(c)
 
-		status := c.Response().Status
-		if err != nil {
-			var httpError *echo.HTTPError
-			if errors.As(err, &httpError) {
-				status = httpError.Code
-			}
-			if status == 0 || status == http.StatusOK {
-				status = http.StatusInternalServerError
-			}
-		}
-
+		status := responseStatus(c, err)
 		elapsed := float64(time.Since(start)) / float64(time.Second)
 
 		statusStr := strconv.Itoa(status)
@@ -144,3 +158,341 @@ func computeApproximateRequestSize(r *http.Request) int {
 	}
 	return s
 }
+
+var blobProxyRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_blob_proxy_requests_total",
+	Help: "The total number of proxied getBlob requests, by result",
+}, []string{"result"})
+
+var blobCacheBytes = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "relay_blob_cache_bytes",
+	Help: "Total size of blobs held in the on-disk blob cache",
+})
+
+var handleVerifications = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_handle_verifications_total",
+	Help: "The total number of handle re-verifications, by result",
+}, []string{"result"})
+
+var admissionChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_admission_checks_total",
+	Help: "The total number of admission policy checks, by kind, decision and whether the decision was cached",
+}, []string{"kind", "decision", "cached"})
+
+var ingestStageRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_ingest_stage_rejections_total",
+	Help: "The total number of events from PDSs rejected by each ingest stage",
+}, []string{"stage"})
+
+var contentScores = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "relay_content_scores",
+	Help:    "Scores given to records by the content scorer",
+	Buckets: prometheus.LinearBuckets(0, 0.1, 11),
+})
+
+var contentScoringDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "relay_content_scoring_duration_seconds",
+	Help:    "Time taken by the content scorer to score a record",
+	Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+})
+
+var contentScoringErrors = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "relay_content_scoring_errors_total",
+	Help: "The total number of records the content scorer failed to score, which were let through",
+})
+
+var scoredCommits = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_scored_commits_total",
+	Help: "The total number of commits scoring above a content score threshold, by the action taken",
+}, []string{"action"})
+
+var ingestStageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "relay_ingest_stage_duration_seconds",
+	Help:    "Time taken by each ingest stage to check an event",
+	Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+}, []string{"stage"})
+
+var tierPromotions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_tier_promotions_total",
+	Help: "The total number of hosts automatically promoted, by the tier they were promoted to",
+}, []string{"tier"})
+
+var hostIncidents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_host_incidents_total",
+	Help: "The total number of host incidents recorded against repo limit tier promotion, by reason",
+}, []string{"reason"})
+
+var repoResets = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_repo_resets_total",
+	Help: "The total number of repos discarded and refetched because their upstream history was rewritten, by how it was detected",
+}, []string{"reason"})
+
+var sizeLimitViolations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_size_limit_violations_total",
+	Help: "The total number of commits rejected for breaking a size limit, by PDS and limit",
+}, []string{"pds", "limit"})
+
+var sizeLimitBlocks = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "relay_size_limit_blocks_total",
+	Help: "The total number of hosts blocked for repeatedly breaking size limits",
+})
+
+var duplicateCommits = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_duplicate_commits_total",
+	Help: "The total number of commits dropped because the relay already had them, by PDS and whether they were first received from the same PDS or another",
+}, []string{"pds", "source"})
+
+var injectedFaults = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_injected_faults_total",
+	Help: "The total number of faults injected for rehearsing failure handling, by kind",
+}, []string{"kind"})
+
+var deactivatedReposTrashed = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "relay_deactivated_repos_trashed_total",
+	Help: "The total number of repos moved to the carstore trash after their accounts were deactivated for longer than the retention",
+})
+
+var scrubRefetches = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_scrub_refetches_total",
+	Help: "The total number of repos refetched after the scrubber found corrupt shards, by whether the refetch started",
+}, []string{"outcome"})
+
+var reactivatedRepos = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_reactivated_repos_total",
+	Help: "The total number of trashed repos brought back when their accounts were reactivated, by whether they were restored from the trash or refetched",
+}, []string{"outcome"})
+
+var duplicateEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_duplicate_events_total",
+	Help: "The total number of events dropped because the relay already had them, by PDS, kind of event, and whether they were first received from the same PDS or another",
+}, []string{"pds", "kind", "source"})
+
+var pdsRepoCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "relay_pds_repo_count",
+	Help: "Number of repos hosted by each PDS, as last sampled by the growth monitor",
+}, []string{"pds"})
+
+var pdsRepoGrowth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "relay_pds_repo_growth",
+	Help: "Number of repos each PDS gained within the growth monitor's window",
+}, []string{"pds"})
+
+var repoCountTotal = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "relay_repo_count",
+	Help: "Number of repos across all PDSs, as last sampled by the growth monitor",
+})
+
+var growthAlerts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_growth_alerts_total",
+	Help: "The total number of hosts whose repo count grew faster than the configured thresholds, by whether they were paused",
+}, []string{"action"})
+
+var growthWebhookFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "relay_growth_webhook_failures_total",
+	Help: "The total number of repo growth alerts that couldn't be delivered to the webhook",
+})
+
+var collectionIndexInserts = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "relay_collection_index_inserts_total",
+	Help: "The total number of (collection, repo) pairs written to the collection index",
+})
+
+var upstreamConnected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "relay_upstream_connected",
+	Help: "Whether the firehose connection to each PDS is up",
+}, []string{"pds"})
+
+var upstreamPingRTT = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "relay_upstream_ping_rtt_seconds",
+	Help: "Round trip time of the last websocket ping answered by each PDS",
+}, []string{"pds"})
+
+var upstreamReconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_upstream_reconnects_total",
+	Help: "Number of times the firehose connection to each PDS was re-established",
+}, []string{"pds"})
+
+var upstreamDialFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_upstream_dial_failures_total",
+	Help: "Number of failed attempts to connect to each PDS's firehose",
+}, []string{"pds"})
+
+var upstreamBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_upstream_bytes_total",
+	Help: "Bytes of firehose frames received from each PDS",
+}, []string{"pds"})
+
+var upstreamBytesPerSec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "relay_upstream_bytes_per_second",
+	Help: "Rate firehose frames were received from each PDS over the last sampling interval",
+}, []string{"pds"})
+
+var policyActions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_policy_actions_total",
+	Help: "The total number of times a host crossed a defederation policy rule, by rule and action taken",
+}, []string{"rule", "action"})
+
+var policyWebhookFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "relay_policy_webhook_failures_total",
+	Help: "The total number of defederation policy actions that couldn't be delivered to the webhook",
+})
+
+var gossipFetchFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_gossip_fetch_failures_total",
+	Help: "The total number of times a gossip peer's host list couldn't be fetched",
+}, []string{"peer"})
+
+var gossipHostsRequested = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_gossip_hosts_requested_total",
+	Help: "The total number of new hosts learned from gossip peers, by the outcome of requesting them",
+}, []string{"status"})
+
+var readBudgetUsed = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "relay_read_budget_used_bytes",
+	Help: "Bytes of the sync read memory budget reserved by requests being served",
+})
+
+var readBudgetQueued = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "relay_read_budget_queued_requests",
+	Help: "Number of sync read requests waiting for memory budget",
+})
+
+var readBudgetRejected = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "relay_read_budget_rejected_total",
+	Help: "The total number of sync read requests turned away for lack of memory budget",
+})
+
+var subscriberConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "relay_subscriber_connections",
+	Help: "Number of open firehose connections, by authenticated subscriber identity",
+}, []string{"identity"})
+
+var subscriberEventsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_subscriber_events_sent_total",
+	Help: "The total number of events sent to firehose subscribers, by authenticated subscriber identity",
+}, []string{"identity"})
+
+var subscriberAuthRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_subscriber_auth_rejected_total",
+	Help: "The total number of firehose subscribers turned away by subscriber auth, by reason",
+}, []string{"reason"})
+
+var blobRefIndexInserts = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "relay_blob_ref_index_inserts_total",
+	Help: "The total number of blob references written to the blob reference index",
+})
+
+var blobRefIndexSkipped = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "relay_blob_ref_index_skipped_records_total",
+	Help: "The total number of records the blob reference index couldn't read or parse",
+})
+
+var apiRateLimitAllowed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_api_rate_limit_allowed_total",
+	Help: "The total number of rate limited API requests let through, by endpoint class",
+}, []string{"class"})
+
+var apiRateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_api_rate_limited_total",
+	Help: "The total number of API requests turned away for exceeding a rate limit, by endpoint class",
+}, []string{"class"})
+
+var adminActions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_admin_actions_total",
+	Help: "The total number of admin API requests recorded in the admin audit log, by route",
+}, []string{"route"})
+
+var adminAuditLogFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_admin_audit_log_failures_total",
+	Help: "The total number of admin actions that couldn't be written to an audit log destination",
+}, []string{"dest"})
+
+var recordProofsServed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_record_proofs_served_total",
+	Help: "The total number of getRecord proofs served, by whether they prove the record's inclusion or exclusion",
+}, []string{"kind"})
+
+var spideredHostsDiscovered = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "relay_spidered_hosts_discovered_total",
+	Help: "The total number of times spidering found an account on a host the relay doesn't know",
+})
+
+var spideredHostsAdmitted = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "relay_spidered_hosts_admitted_total",
+	Help: "The total number of hosts found by spidering that the spidering policy admitted",
+})
+
+var spideredHostsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_spidered_hosts_rejected_total",
+	Help: "The total number of hosts found by spidering that the spidering policy turned away, by reason",
+}, []string{"reason"})
+
+var autoTrustExpired = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "relay_spidered_hosts_auto_trust_expired_total",
+	Help: "The total number of hosts admitted by spidering moved back to the new tier when their probationary trust ran out",
+})
+
+var revViolations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_rev_violations_total",
+	Help: "The total number of commits from PDSs that broke their repo's rev ordering, by PDS and kind: out_of_order, duplicate or future",
+}, []string{"pds", "kind"})
+
+var jetstreamEventsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_jetstream_events_sent_total",
+	Help: "The total number of Jetstream events sent to subscribers, by kind",
+}, []string{"kind"})
+
+var alertsFired = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_alerts_fired_total",
+	Help: "The total number of alerts sent because a condition crossed its threshold, by condition",
+}, []string{"condition"})
+
+var alertNotifyFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_alert_notify_failures_total",
+	Help: "The total number of alerts that failed to send, by notifier",
+}, []string{"notifier"})
+
+var syncResponsesByEncoding = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_sync_responses_by_encoding_total",
+	Help: "Number of getRepo, getBlocks and getRecord responses sent, by content encoding",
+}, []string{"encoding"})
+
+var syncCompressionSkipped = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "relay_sync_compression_skipped_total",
+	Help: "Number of sync responses sent uncompressed to a client that accepts compression, because too many were already being compressed",
+})
+
+var syncCompressionInputBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_sync_compression_input_bytes_total",
+	Help: "Bytes of sync responses before compression, by content encoding",
+}, []string{"encoding"})
+
+var syncCompressionOutputBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_sync_compression_output_bytes_total",
+	Help: "Bytes of sync responses sent after compression, by content encoding",
+}, []string{"encoding"})
+
+var collectionsRegistered = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_collections_registered_total",
+	Help: "Number of collections added to the collection registry on first being seen, by the status they started with",
+}, []string{"status"})
+
+var quarantinedCommits = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "relay_quarantined_commits_total",
+	Help: "Number of commits held back from the firehose for touching a collection that isn't approved, or coming after one that was",
+})
+
+var releasedCommits = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "relay_released_commits_total",
+	Help: "Number of held commits sent out once their collections were approved",
+})
+
+var replayedEventsSent = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "relay_replayed_events_sent_total",
+	Help: "Number of past events sent again to consumers by admin replays",
+})
+
+var redactedRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_redacted_records_total",
+	Help: "Number of records sent out or served with fields removed by redaction rules, by collection",
+}, []string{"collection"})
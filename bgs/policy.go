@@ -0,0 +1,551 @@
+package bgs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+)
+
+// Signals a defederation policy rule can watch. The rates are the share of a
+// host's events within each evaluation interval that were rejected for a bad
+// commit signature, rejected by the lexicon stage or an ingest hook (where
+// operators plug in spam filters), or failed to be handled. Repo growth is
+// the number of repos the host gained within the growth monitor's window,
+// and needs the growth monitor running.
+const (
+	PolicySignalInvalidSignatureRate = "invalid_signature_rate"
+	PolicySignalSpamScore            = "spam_score"
+	PolicySignalRepoGrowth           = "repo_growth"
+	PolicySignalErrorRate            = "error_rate"
+)
+
+// What is done to a host that crosses a rule. Alerts only send the webhook
+// and count against the host's tier promotion; pauses disconnect the host
+// for the rule's PauseFor; blocks disconnect it until an admin unblocks it.
+const (
+	PolicyActionAlert = "alert"
+	PolicyActionPause = "pause"
+	PolicyActionBlock = "block"
+)
+
+// most recent actions kept for the admin API
+const policyActionHistory = 200
+
+type PolicyRule struct {
+	Name   string `json:"name"`
+	Signal string `json:"signal"`
+	// The rule is crossed when the signal goes over this
+	Threshold float64 `json:"threshold"`
+	// Rate signals are only checked for hosts that sent at least this many
+	// events within the interval, so a single bad event doesn't trip them
+	MinEvents int64         `json:"min_events,omitempty"`
+	Action    string        `json:"action"`
+	PauseFor  time.Duration `json:"pause_for,omitempty"`
+}
+
+type DefederationPolicyOptions struct {
+	// How often hosts are checked against the rules, and the period rates
+	// are measured over
+	Interval time.Duration
+	Rules    []PolicyRule
+
+	// If set, actions are POSTed to this URL as JSON
+	WebhookURL     string
+	WebhookTimeout time.Duration
+}
+
+func DefaultDefederationPolicyOptions() *DefederationPolicyOptions {
+	return &DefederationPolicyOptions{
+		Interval:       time.Minute,
+		WebhookTimeout: 10 * time.Second,
+	}
+}
+
+// policyFile is the layout of a defederation policy config file
+type policyFile struct {
+	Interval   string `json:"interval"`
+	WebhookURL string `json:"webhook_url"`
+	Rules      []struct {
+		Name      string  `json:"name"`
+		Signal    string  `json:"signal"`
+		Threshold float64 `json:"threshold"`
+		MinEvents int64   `json:"min_events"`
+		Action    string  `json:"action"`
+		PauseFor  string  `json:"pause_for"`
+	} `json:"rules"`
+}
+
+// LoadDefederationPolicy reads policy options from a JSON config file:
+//
+//	{
+//	  "interval": "1m",
+//	  "webhook_url": "https://alerts.example.com/relay",
+//	  "rules": [
+//	    {"name": "bad-sigs", "signal": "invalid_signature_rate", "threshold": 0.05, "min_events": 100, "action": "pause", "pause_for": "6h"},
+//	    {"name": "account-spam", "signal": "repo_growth", "threshold": 10000, "action": "block"}
+//	  ]
+//	}
+func LoadDefederationPolicy(path string) (*DefederationPolicyOptions, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading defederation policy: %w", err)
+	}
+
+	var pf policyFile
+	if err := json.Unmarshal(data, &pf); err != nil {
+		return nil, fmt.Errorf("parsing defederation policy %s: %w", path, err)
+	}
+
+	opts := DefaultDefederationPolicyOptions()
+	opts.WebhookURL = pf.WebhookURL
+	if pf.Interval != "" {
+		if opts.Interval, err = time.ParseDuration(pf.Interval); err != nil {
+			return nil, fmt.Errorf("defederation policy interval: %w", err)
+		}
+	}
+	for _, r := range pf.Rules {
+		rule := PolicyRule{
+			Name:      r.Name,
+			Signal:    r.Signal,
+			Threshold: r.Threshold,
+			MinEvents: r.MinEvents,
+			Action:    r.Action,
+		}
+		if r.PauseFor != "" {
+			if rule.PauseFor, err = time.ParseDuration(r.PauseFor); err != nil {
+				return nil, fmt.Errorf("defederation policy rule %q pause_for: %w", r.Name, err)
+			}
+		}
+		opts.Rules = append(opts.Rules, rule)
+	}
+	return opts, nil
+}
+
+func (r *PolicyRule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("defederation policy rules must have a name")
+	}
+	switch r.Signal {
+	case PolicySignalInvalidSignatureRate, PolicySignalSpamScore, PolicySignalRepoGrowth, PolicySignalErrorRate:
+	default:
+		return fmt.Errorf("defederation policy rule %q has unknown signal %q", r.Name, r.Signal)
+	}
+	switch r.Action {
+	case PolicyActionAlert, PolicyActionBlock:
+	case PolicyActionPause:
+		if r.PauseFor <= 0 {
+			return fmt.Errorf("defederation policy rule %q pauses hosts, so needs a pause_for", r.Name)
+		}
+	default:
+		return fmt.Errorf("defederation policy rule %q has unknown action %q", r.Name, r.Action)
+	}
+	return nil
+}
+
+// actionSeverity orders actions, so a host crossing several rules gets the
+// harshest
+func actionSeverity(action string) int {
+	switch action {
+	case PolicyActionBlock:
+		return 2
+	case PolicyActionPause:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// PolicyAction is a rule a host crossed and what was done about it. It is
+// also the body of the webhook.
+type PolicyAction struct {
+	Event     string     `json:"event"`
+	Host      string     `json:"host"`
+	Rule      string     `json:"rule"`
+	Signal    string     `json:"signal"`
+	Value     float64    `json:"value"`
+	Threshold float64    `json:"threshold"`
+	Action    string     `json:"action"`
+	Until     *time.Time `json:"until,omitempty"`
+	Time      time.Time  `json:"time"`
+}
+
+type policyCounts struct {
+	events      int64
+	invalidSigs int64
+	spam        int64
+	errors      int64
+}
+
+type policyAlertKey struct {
+	host uint
+	rule string
+}
+
+// DefederationPolicy checks every host against operator defined rules each
+// interval, and alerts on, pauses or blocks the hosts that cross them. Admins
+// can lift a pause early, and exempt hosts from the policy, through the admin
+// API.
+type DefederationPolicy struct {
+	opts   DefederationPolicyOptions
+	client *http.Client
+
+	lk sync.Mutex
+	// event outcomes per host since the last pass
+	counts map[uint]*policyCounts
+	// alert rules currently crossed, so each alerts once until the host
+	// goes back under it
+	alerting map[policyAlertKey]bool
+	actions  []PolicyAction
+
+	exit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewDefederationPolicy(opts *DefederationPolicyOptions) (*DefederationPolicy, error) {
+	if opts == nil {
+		opts = DefaultDefederationPolicyOptions()
+	}
+
+	names := make(map[string]bool)
+	for i := range opts.Rules {
+		r := &opts.Rules[i]
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("defederation policy has more than one rule named %q", r.Name)
+		}
+		names[r.Name] = true
+	}
+	if len(opts.Rules) > 0 && opts.Interval <= 0 {
+		return nil, fmt.Errorf("defederation policy interval must be positive")
+	}
+
+	return &DefederationPolicy{
+		opts:     *opts,
+		client:   &http.Client{Timeout: opts.WebhookTimeout},
+		counts:   make(map[uint]*policyCounts),
+		alerting: make(map[policyAlertKey]bool),
+		exit:     make(chan struct{}),
+	}, nil
+}
+
+// Start starts checking hosts, if there are any rules
+func (dp *DefederationPolicy) Start(bgs *BGS) {
+	if len(dp.opts.Rules) == 0 {
+		return
+	}
+
+	log.Infow("starting defederation policy", "interval", dp.opts.Interval, "rules", len(dp.opts.Rules))
+
+	dp.wg.Add(1)
+	go func() {
+		defer dp.wg.Done()
+
+		t := time.NewTicker(dp.opts.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-dp.exit:
+				return
+			case <-t.C:
+			}
+
+			if err := dp.RunPass(context.Background(), bgs); err != nil {
+				log.Errorw("defederation policy pass failed", "err", err)
+			}
+		}
+	}()
+}
+
+// Shutdown stops checking hosts, waiting for webhooks in flight
+func (dp *DefederationPolicy) Shutdown() {
+	close(dp.exit)
+	dp.wg.Wait()
+}
+
+// observe counts the outcome of handling an event from a host: nil, the
+// ingest pipeline's rejection, or the error handling it
+func (dp *DefederationPolicy) observe(pdsID uint, err error) {
+	if len(dp.opts.Rules) == 0 {
+		return
+	}
+
+	dp.lk.Lock()
+	defer dp.lk.Unlock()
+
+	c, ok := dp.counts[pdsID]
+	if !ok {
+		c = &policyCounts{}
+		dp.counts[pdsID] = c
+	}
+	c.events++
+
+	if err == nil {
+		return
+	}
+	var rejected *ErrIngestRejected
+	if !errors.As(err, &rejected) {
+		c.errors++
+		return
+	}
+	switch rejected.Stage {
+	case IngestStageSignature:
+		c.invalidSigs++
+	case IngestStageDedup, IngestStageSize, IngestStageRev:
+		// duplicates are expected, and the size and rev stages act on
+		// their own
+	default:
+		c.spam++
+	}
+}
+
+// signal returns the value of a rule's signal for a host, if there is enough
+// to go on
+func (dp *DefederationPolicy) signal(bgs *BGS, rule *PolicyRule, pdsID uint, c *policyCounts) (float64, bool) {
+	if rule.Signal == PolicySignalRepoGrowth {
+		n, ok := bgs.growth.newRepos(pdsID)
+		return float64(n), ok
+	}
+
+	if c == nil || c.events == 0 || c.events < rule.MinEvents {
+		return 0, false
+	}
+	var n int64
+	switch rule.Signal {
+	case PolicySignalInvalidSignatureRate:
+		n = c.invalidSigs
+	case PolicySignalSpamScore:
+		n = c.spam
+	case PolicySignalErrorRate:
+		n = c.errors
+	}
+	return float64(n) / float64(c.events), true
+}
+
+// RunPass checks every host against the rules, acting on those that cross
+// them, and resumes hosts whose pause is up
+func (dp *DefederationPolicy) RunPass(ctx context.Context, bgs *BGS) error {
+	dp.lk.Lock()
+	counts := dp.counts
+	dp.counts = make(map[uint]*policyCounts)
+	dp.lk.Unlock()
+
+	var hosts []models.PDS
+	if err := bgs.db.WithContext(ctx).Model(&models.PDS{}).Select("id, host, registered, blocked, paused_until, policy_exempt").Find(&hosts).Error; err != nil {
+		return fmt.Errorf("listing hosts: %w", err)
+	}
+
+	now := time.Now()
+	for i := range hosts {
+		pds := &hosts[i]
+		if pds.PausedUntil != nil && !pds.Paused() {
+			dp.resume(ctx, bgs, pds)
+		}
+		if pds.Blocked || pds.Paused() || pds.PolicyExempt {
+			continue
+		}
+
+		var crossed *PolicyAction
+		for j := range dp.opts.Rules {
+			rule := &dp.opts.Rules[j]
+			value, ok := dp.signal(bgs, rule, pds.ID, counts[pds.ID])
+			if !ok {
+				continue
+			}
+
+			key := policyAlertKey{host: pds.ID, rule: rule.Name}
+			if value <= rule.Threshold {
+				dp.lk.Lock()
+				delete(dp.alerting, key)
+				dp.lk.Unlock()
+				continue
+			}
+			if rule.Action == PolicyActionAlert {
+				dp.lk.Lock()
+				already := dp.alerting[key]
+				dp.alerting[key] = true
+				dp.lk.Unlock()
+				if already {
+					continue
+				}
+			}
+
+			if crossed != nil && actionSeverity(rule.Action) <= actionSeverity(crossed.Action) {
+				continue
+			}
+			crossed = &PolicyAction{
+				Event:     "defederation_policy",
+				Host:      pds.Host,
+				Rule:      rule.Name,
+				Signal:    rule.Signal,
+				Value:     value,
+				Threshold: rule.Threshold,
+				Action:    rule.Action,
+				Time:      now,
+			}
+			if rule.Action == PolicyActionPause {
+				until := now.Add(rule.PauseFor)
+				crossed.Until = &until
+			}
+		}
+
+		if crossed != nil {
+			dp.act(ctx, bgs, pds, crossed)
+		}
+	}
+
+	return nil
+}
+
+func (dp *DefederationPolicy) act(ctx context.Context, bgs *BGS, pds *models.PDS, action *PolicyAction) {
+	log.Warnw("host crossed defederation policy rule", "host", action.Host, "rule", action.Rule, "signal", action.Signal,
+		"value", action.Value, "threshold", action.Threshold, "action", action.Action)
+
+	var err error
+	switch action.Action {
+	case PolicyActionAlert:
+		bgs.tiers.RecordIncident(ctx, bgs.db, pds.ID, "policy_"+action.Rule)
+	case PolicyActionPause:
+		err = dp.disconnect(ctx, bgs, pds, map[string]any{
+			"paused_until":     *action.Until,
+			"last_incident_at": action.Time,
+		})
+	case PolicyActionBlock:
+		// the block also restarts the clean history the host needs for
+		// tier promotion
+		err = dp.disconnect(ctx, bgs, pds, map[string]any{
+			"blocked":          true,
+			"last_incident_at": action.Time,
+		})
+	}
+	if err != nil {
+		log.Errorw("failed to apply defederation policy action", "host", pds.Host, "action", action.Action, "err", err)
+	}
+	policyActions.WithLabelValues(action.Rule, action.Action).Inc()
+
+	dp.lk.Lock()
+	dp.actions = append(dp.actions, *action)
+	if len(dp.actions) > policyActionHistory {
+		dp.actions = dp.actions[len(dp.actions)-policyActionHistory:]
+	}
+	dp.lk.Unlock()
+
+	if dp.opts.WebhookURL == "" {
+		return
+	}
+	dp.wg.Add(1)
+	go func() {
+		defer dp.wg.Done()
+		if err := dp.sendWebhook(action); err != nil {
+			log.Errorw("failed to send defederation policy webhook", "host", action.Host, "err", err)
+			policyWebhookFailures.Inc()
+		}
+	}()
+}
+
+// disconnect updates the host and drops its connection
+func (dp *DefederationPolicy) disconnect(ctx context.Context, bgs *BGS, pds *models.PDS, updates map[string]any) error {
+	if err := bgs.db.WithContext(ctx).Model(&models.PDS{}).Where("id = ?", pds.ID).Updates(updates).Error; err != nil {
+		return err
+	}
+
+	err := bgs.slurper.KillUpstreamConnection(pds.Host, false)
+	if err != nil && !errors.Is(err, ErrNoActiveConnection) {
+		return err
+	}
+	return nil
+}
+
+// resume clears a host's pause and reconnects to it
+func (dp *DefederationPolicy) resume(ctx context.Context, bgs *BGS, pds *models.PDS) {
+	if err := bgs.db.WithContext(ctx).Model(&models.PDS{}).Where("id = ?", pds.ID).Update("paused_until", nil).Error; err != nil {
+		log.Errorw("failed to clear host pause", "host", pds.Host, "err", err)
+		return
+	}
+	pds.PausedUntil = nil
+
+	if !pds.Registered || pds.Blocked {
+		return
+	}
+	log.Infow("resuming host paused by defederation policy", "host", pds.Host)
+	if err := bgs.slurper.SubscribeToPds(ctx, pds.Host, true, true); err != nil {
+		log.Errorw("failed to resume paused host", "host", pds.Host, "err", err)
+	}
+}
+
+// Override lifts a host's pause, and exempts it from the policy or clears its
+// exemption if exempt is set. Blocks are lifted by unblocking the host as
+// usual.
+func (dp *DefederationPolicy) Override(ctx context.Context, bgs *BGS, pds *models.PDS, exempt *bool) error {
+	if exempt != nil {
+		if err := bgs.db.WithContext(ctx).Model(&models.PDS{}).Where("id = ?", pds.ID).Update("policy_exempt", *exempt).Error; err != nil {
+			return err
+		}
+		pds.PolicyExempt = *exempt
+	}
+
+	// start the host over with a clean slate
+	dp.lk.Lock()
+	delete(dp.counts, pds.ID)
+	for key := range dp.alerting {
+		if key.host == pds.ID {
+			delete(dp.alerting, key)
+		}
+	}
+	dp.lk.Unlock()
+
+	if pds.PausedUntil != nil {
+		dp.resume(ctx, bgs, pds)
+	}
+	return nil
+}
+
+// Rules returns the policy's rules
+func (dp *DefederationPolicy) Rules() []PolicyRule {
+	return dp.opts.Rules
+}
+
+// Actions returns the most recent actions taken, newest first
+func (dp *DefederationPolicy) Actions() []PolicyAction {
+	dp.lk.Lock()
+	defer dp.lk.Unlock()
+
+	out := make([]PolicyAction, len(dp.actions))
+	for i, a := range dp.actions {
+		out[len(out)-1-i] = a
+	}
+	return out
+}
+
+func (dp *DefederationPolicy) sendWebhook(action *PolicyAction) error {
+	body, err := json.Marshal(action)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", dp.opts.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "indigo-relay")
+
+	resp, err := dp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package bgs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+
+	"github.com/carlmjohnson/versioninfo"
+	"github.com/labstack/echo/v4"
+)
+
+// publicStatsPath serves aggregate stats about the relay to anyone, for
+// dashboards following the health of the network's relays
+const publicStatsPath = "/xrpc/_relay/stats"
+
+type PublicStatsOptions struct {
+	// How long a computed response is served for, and may be cached by
+	// clients
+	CacheTTL time.Duration
+	// The events per second figure is averaged over this long
+	RateWindow time.Duration
+}
+
+func DefaultPublicStatsOptions() *PublicStatsOptions {
+	return &PublicStatsOptions{
+		CacheTTL:   30 * time.Second,
+		RateWindow: time.Minute,
+	}
+}
+
+// PublicRelayStats are the aggregate stats served at /xrpc/_relay/stats
+type PublicRelayStats struct {
+	Version       string    `json:"version"`
+	StartedAt     time.Time `json:"started_at"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+	// Repos on the hosts the relay crawls
+	Repos int64 `json:"repos"`
+	// Hosts the relay crawls, and those it's connected to now
+	Hosts          int64 `json:"hosts"`
+	ConnectedHosts int   `json:"connected_hosts"`
+	// The sequence number of the latest event on the firehose
+	Seq int64 `json:"seq"`
+	// Events emitted per second, averaged over the last RateWindow
+	EventsPerSecond float64   `json:"events_per_second"`
+	GeneratedAt     time.Time `json:"generated_at"`
+}
+
+type seqSample struct {
+	at  time.Time
+	seq int64
+}
+
+// PublicStats serves aggregate relay stats without authentication. The
+// stats are computed at most once per CacheTTL however many clients ask, and
+// the firehose sequence is sampled in the background to work out the event
+// rate.
+type PublicStats struct {
+	opts      PublicStatsOptions
+	startedAt time.Time
+
+	lk      sync.Mutex
+	samples []seqSample
+	cached  *PublicRelayStats
+	// held while the stats are computed, so requests arriving meanwhile
+	// wait for them rather than computing them too
+	computeLk sync.Mutex
+
+	exit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewPublicStats(opts *PublicStatsOptions) (*PublicStats, error) {
+	var o PublicStatsOptions
+	if opts != nil {
+		o = *opts
+		if o.CacheTTL <= 0 || o.RateWindow <= 0 {
+			return nil, fmt.Errorf("public stats cache ttl and rate window must be positive")
+		}
+	}
+
+	return &PublicStats{
+		opts:      o,
+		startedAt: time.Now(),
+		exit:      make(chan struct{}),
+	}, nil
+}
+
+func (ps *PublicStats) enabled() bool {
+	return ps.opts.RateWindow > 0
+}
+
+// Start starts sampling the firehose sequence, if enabled
+func (ps *PublicStats) Start(bgs *BGS) {
+	if !ps.enabled() {
+		return
+	}
+
+	ps.sample(bgs.events.LastSeq())
+
+	// a few samples per window keep the rate's window close to RateWindow
+	interval := ps.opts.RateWindow / 6
+	ps.wg.Add(1)
+	go func() {
+		defer ps.wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ps.exit:
+				return
+			case <-t.C:
+				ps.sample(bgs.events.LastSeq())
+			}
+		}
+	}()
+}
+
+func (ps *PublicStats) Shutdown() {
+	close(ps.exit)
+	ps.wg.Wait()
+}
+
+// sample records the sequence, dropping samples no longer needed to cover
+// the rate window
+func (ps *PublicStats) sample(seq int64) {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+
+	now := time.Now()
+	ps.samples = append(ps.samples, seqSample{at: now, seq: seq})
+	for len(ps.samples) > 2 && now.Sub(ps.samples[1].at) >= ps.opts.RateWindow {
+		ps.samples = ps.samples[1:]
+	}
+}
+
+// rate returns the events per second between the oldest sample and seq
+func (ps *PublicStats) rate(now time.Time, seq int64) float64 {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+
+	if len(ps.samples) == 0 {
+		return 0
+	}
+	oldest := ps.samples[0]
+	secs := now.Sub(oldest.at).Seconds()
+	if secs <= 0 || seq < oldest.seq {
+		return 0
+	}
+	return float64(seq-oldest.seq) / secs
+}
+
+// stats returns the cached stats, computing them again once they're older
+// than CacheTTL
+func (ps *PublicStats) stats(ctx context.Context, bgs *BGS) (*PublicRelayStats, error) {
+	return ps.cachedOr(ctx, func(ctx context.Context) (*PublicRelayStats, error) {
+		return ps.compute(ctx, bgs)
+	})
+}
+
+// fresh returns the cached stats if they're younger than CacheTTL
+func (ps *PublicStats) fresh() *PublicRelayStats {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+
+	if ps.cached != nil && time.Since(ps.cached.GeneratedAt) < ps.opts.CacheTTL {
+		return ps.cached
+	}
+	return nil
+}
+
+// cachedOr returns the cached stats, or computes and caches them if they're
+// stale. Only one computation runs at a time; the requests waiting on it get
+// its result. Failures aren't cached.
+func (ps *PublicStats) cachedOr(ctx context.Context, compute func(context.Context) (*PublicRelayStats, error)) (*PublicRelayStats, error) {
+	if cached := ps.fresh(); cached != nil {
+		return cached, nil
+	}
+
+	ps.computeLk.Lock()
+	defer ps.computeLk.Unlock()
+
+	if cached := ps.fresh(); cached != nil {
+		return cached, nil
+	}
+
+	out, err := compute(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ps.lk.Lock()
+	ps.cached = out
+	ps.lk.Unlock()
+	return out, nil
+}
+
+func (ps *PublicStats) compute(ctx context.Context, bgs *BGS) (*PublicRelayStats, error) {
+	var counts struct {
+		Hosts int64
+		Repos int64
+	}
+	if err := bgs.db.WithContext(ctx).Model(&models.PDS{}).
+		Select("COUNT(*) AS hosts, COALESCE(SUM(repo_count), 0) AS repos").
+		Where("registered = true AND blocked = false").
+		Scan(&counts).Error; err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	seq := bgs.events.LastSeq()
+	out := &PublicRelayStats{
+		Version:         versioninfo.Short(),
+		StartedAt:       ps.startedAt,
+		UptimeSeconds:   int64(now.Sub(ps.startedAt).Seconds()),
+		Repos:           counts.Repos,
+		Hosts:           counts.Hosts,
+		ConnectedHosts:  len(bgs.slurper.GetActiveList()),
+		Seq:             seq,
+		EventsPerSecond: ps.rate(now, seq),
+		GeneratedAt:     now,
+	}
+	return out, nil
+}
+
+func (bgs *BGS) handlePublicStats(e echo.Context) error {
+	stats, err := bgs.publicStats.stats(e.Request().Context(), bgs)
+	if err != nil {
+		return err
+	}
+
+	maxAge := bgs.publicStats.opts.CacheTTL - time.Since(stats.GeneratedAt)
+	e.Response().Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", max(int(maxAge.Seconds()), 0)))
+	return e.JSON(http.StatusOK, stats)
+}
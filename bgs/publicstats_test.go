@@ -0,0 +1,119 @@
+package bgs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPublicStatsComputedOncePerTTL(t *testing.T) {
+	ps, err := NewPublicStats(&PublicStatsOptions{CacheTTL: 200 * time.Millisecond, RateWindow: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var computed atomic.Int64
+	var fail atomic.Bool
+	compute := func(ctx context.Context) (*PublicRelayStats, error) {
+		computed.Add(1)
+		// slow enough for every request to arrive while it runs
+		time.Sleep(20 * time.Millisecond)
+		if fail.Load() {
+			return nil, fmt.Errorf("db is down")
+		}
+		return &PublicRelayStats{Seq: computed.Load(), GeneratedAt: time.Now()}, nil
+	}
+
+	burst := func() []*PublicRelayStats {
+		out := make([]*PublicRelayStats, 20)
+		var wg sync.WaitGroup
+		for i := range out {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				st, err := ps.cachedOr(context.Background(), compute)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				out[i] = st
+			}(i)
+		}
+		wg.Wait()
+		return out
+	}
+
+	first := burst()
+	if n := computed.Load(); n != 1 {
+		t.Fatalf("expected the stats computed once for concurrent requests, got %d", n)
+	}
+	for _, st := range first {
+		if st != first[0] {
+			t.Fatal("expected every request to get the same stats")
+		}
+	}
+
+	// still fresh
+	if st, err := ps.cachedOr(context.Background(), compute); err != nil || st != first[0] || computed.Load() != 1 {
+		t.Fatalf("expected the cached stats, got %+v (err: %v, computed %d)", st, err, computed.Load())
+	}
+
+	// failures aren't cached, and don't throw away what was
+	time.Sleep(250 * time.Millisecond)
+	fail.Store(true)
+	if _, err := ps.cachedOr(context.Background(), compute); err == nil {
+		t.Fatal("expected the failure returned")
+	}
+	fail.Store(false)
+
+	second := burst()
+	if n := computed.Load(); n != 3 {
+		t.Fatalf("expected the stats computed once more after they went stale, got %d computations", n)
+	}
+	if second[0] == first[0] || second[0].Seq != 3 {
+		t.Fatalf("expected new stats, got %+v", second[0])
+	}
+	for _, st := range second {
+		if st != second[0] {
+			t.Fatal("expected every request to get the same stats")
+		}
+	}
+}
+
+func TestPublicStatsRate(t *testing.T) {
+	ps, err := NewPublicStats(&PublicStatsOptions{CacheTTL: time.Second, RateWindow: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if r := ps.rate(now, 100); r != 0 {
+		t.Fatalf("expected no rate without samples, got %f", r)
+	}
+
+	ps.samples = []seqSample{{at: now.Add(-10 * time.Second), seq: 100}, {at: now.Add(-5 * time.Second), seq: 150}}
+	if r := ps.rate(now, 300); r != 20 {
+		t.Fatalf("expected 20 events per second since the oldest sample, got %f", r)
+	}
+	// the sequence going backwards, eg after a restore, isn't a negative rate
+	if r := ps.rate(now, 50); r != 0 {
+		t.Fatalf("expected no rate for a sequence behind the samples, got %f", r)
+	}
+
+	// samples older than the window are dropped, keeping at least two
+	ps.samples = []seqSample{{at: now.Add(-3 * time.Minute), seq: 1}, {at: now.Add(-2 * time.Minute), seq: 2}, {at: now.Add(-30 * time.Second), seq: 3}}
+	ps.sample(4)
+	if len(ps.samples) != 3 || ps.samples[0].seq != 2 {
+		t.Fatalf("unexpected samples after pruning: %+v", ps.samples)
+	}
+
+	if _, err := NewPublicStats(&PublicStatsOptions{CacheTTL: 0, RateWindow: time.Minute}); err == nil {
+		t.Fatal("expected a zero cache ttl rejected")
+	}
+	if ps, err := NewPublicStats(nil); err != nil || ps.enabled() {
+		t.Fatalf("expected public stats disabled without options, got %v", err)
+	}
+}
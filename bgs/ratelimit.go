@@ -0,0 +1,288 @@
+package bgs
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/util"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/time/rate"
+)
+
+// Endpoint classes API rate limits are set for
+const (
+	// subscribeRepos, the sample firehose and Jetstream, counting connection
+	// attempts
+	RateClassSubscribe = "subscribe"
+	// sync reads that serve repo data: getRepo, getBlocks, getRecord, getBlob
+	RateClassSync = "sync"
+	// requestCrawl
+	RateClassCrawl = "crawl"
+	// every other XRPC endpoint
+	RateClassXRPC = "xrpc"
+	// the admin API, limited per admin token or service-auth DID rather
+	// than per IP
+	RateClassAdmin = "admin"
+)
+
+// RateLimit is a token bucket holding Requests tokens, refilled over Window
+type RateLimit struct {
+	Requests int
+	Window   time.Duration
+}
+
+func (l RateLimit) String() string {
+	return fmt.Sprintf("%d/%s", l.Requests, l.Window)
+}
+
+// ParseRateLimit parses a limit like "300/1m"
+func ParseRateLimit(s string) (RateLimit, error) {
+	n, w, ok := strings.Cut(s, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("rate limit %q must look like 300/1m", s)
+	}
+	reqs, err := strconv.Atoi(n)
+	if err != nil || reqs < 1 {
+		return RateLimit{}, fmt.Errorf("rate limit %q must allow at least one request", s)
+	}
+	window, err := time.ParseDuration(w)
+	if err != nil || window <= 0 {
+		return RateLimit{}, fmt.Errorf("rate limit %q has an invalid window", s)
+	}
+	return RateLimit{Requests: reqs, Window: window}, nil
+}
+
+type APIRateLimitOptions struct {
+	// Limits by endpoint class; classes without one aren't limited
+	Limits map[string]RateLimit
+	// Most clients tracked per class. Past that, the least recently seen are
+	// forgotten, and start over with a full bucket.
+	MaxClients int
+	// Client addresses that aren't limited, eg. other services on the
+	// private network
+	Exempt []netip.Prefix
+	// Take the client's address from X-Forwarded-For, for relays behind a
+	// proxy on the private network that sets it. Otherwise clients could
+	// pick their own address.
+	TrustProxyHeaders bool
+}
+
+func DefaultAPIRateLimitOptions() *APIRateLimitOptions {
+	return &APIRateLimitOptions{
+		Limits: map[string]RateLimit{
+			RateClassSubscribe: {Requests: 30, Window: time.Minute},
+			RateClassSync:      {Requests: 1500, Window: 5 * time.Minute},
+			RateClassCrawl:     {Requests: 10, Window: time.Minute},
+			RateClassXRPC:      {Requests: 3000, Window: 5 * time.Minute},
+			RateClassAdmin:     {Requests: 600, Window: time.Minute},
+		},
+		MaxClients: 100_000,
+	}
+}
+
+// APIRateLimiter limits API requests with a token bucket per client and
+// endpoint class. Clients are identified by IP address, except on the admin
+// API, where they're identified by their admin token or service-auth DID.
+// Responses carry RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset
+// headers, and requests over the limit get a 429 RateLimitExceeded error
+// with Retry-After.
+type APIRateLimiter struct {
+	opts    APIRateLimitOptions
+	clock   util.Clock
+	classes map[string]*classLimiter
+	ipx     echo.IPExtractor
+}
+
+type classLimiter struct {
+	name  string
+	limit RateLimit
+
+	lk      sync.Mutex
+	buckets *lru.Cache[string, *rate.Limiter]
+}
+
+func NewAPIRateLimiter(opts *APIRateLimitOptions, clock util.Clock) (*APIRateLimiter, error) {
+	if opts == nil {
+		opts = DefaultAPIRateLimitOptions()
+	}
+	maxClients := opts.MaxClients
+	if maxClients <= 0 {
+		maxClients = DefaultAPIRateLimitOptions().MaxClients
+	}
+
+	rl := &APIRateLimiter{
+		opts:    *opts,
+		clock:   util.ClockOrSystem(clock),
+		classes: make(map[string]*classLimiter),
+		ipx:     echo.ExtractIPDirect(),
+	}
+	if opts.TrustProxyHeaders {
+		rl.ipx = echo.ExtractIPFromXFFHeader(echo.TrustLinkLocal(true), echo.TrustPrivateNet(true), echo.TrustLoopback(true))
+	}
+
+	for name, limit := range opts.Limits {
+		switch name {
+		case RateClassSubscribe, RateClassSync, RateClassCrawl, RateClassXRPC, RateClassAdmin:
+		default:
+			return nil, fmt.Errorf("unknown rate limit class %q", name)
+		}
+		if limit.Requests < 1 || limit.Window <= 0 {
+			return nil, fmt.Errorf("rate limit for %s must allow at least one request per window", name)
+		}
+		buckets, err := lru.New[string, *rate.Limiter](maxClients)
+		if err != nil {
+			return nil, err
+		}
+		rl.classes[name] = &classLimiter{name: name, limit: limit, buckets: buckets}
+	}
+	return rl, nil
+}
+
+// endpointClass returns the rate limit class of a public API path, or ""
+// for paths that aren't limited. Admin routes are limited after they're
+// authenticated, by AdminMiddleware.
+func endpointClass(path string) string {
+	switch path {
+	case "/xrpc/com.atproto.sync.subscribeRepos", sampleFirehosePath, jetstreamPath:
+		return RateClassSubscribe
+	case "/xrpc/com.atproto.sync.getRepo", "/xrpc/com.atproto.sync.getBlocks",
+		"/xrpc/com.atproto.sync.getRecord", "/xrpc/com.atproto.sync.getBlob":
+		return RateClassSync
+	case "/xrpc/com.atproto.sync.requestCrawl":
+		return RateClassCrawl
+	case "/xrpc/_health":
+		return ""
+	}
+	if strings.HasPrefix(path, "/xrpc/") {
+		return RateClassXRPC
+	}
+	return ""
+}
+
+// Middleware limits public API requests by client IP
+func (rl *APIRateLimiter) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cl := rl.classes[endpointClass(c.Request().URL.Path)]
+		if cl == nil {
+			return next(c)
+		}
+
+		ip := rl.ipx(c.Request())
+		if rl.exempt(ip) {
+			return next(c)
+		}
+		if err := rl.take(c, cl, "ip:"+ip); err != nil {
+			return err
+		}
+		return next(c)
+	}
+}
+
+// AdminMiddleware limits admin API requests by admin identity. It must run
+// after checkAdminAuth.
+func (rl *APIRateLimiter) AdminMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cl := rl.classes[RateClassAdmin]
+		ident, _ := c.Get(adminIdentityKey).(string)
+		if cl == nil || ident == "" || rl.exempt(rl.ipx(c.Request())) {
+			return next(c)
+		}
+		if err := rl.take(c, cl, ident); err != nil {
+			return err
+		}
+		return next(c)
+	}
+}
+
+func (rl *APIRateLimiter) exempt(ip string) bool {
+	if len(rl.opts.Exempt) == 0 {
+		return false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range rl.opts.Exempt {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// take takes a token from the client's bucket, setting the RateLimit
+// headers, and returns an APIError if there are none left
+func (rl *APIRateLimiter) take(c echo.Context, cl *classLimiter, key string) error {
+	now := rl.clock.Now()
+	lim := cl.bucket(key)
+	allowed := lim.AllowN(now, 1)
+	tokens := lim.TokensAt(now)
+
+	per := cl.limit.Window / time.Duration(cl.limit.Requests)
+	remaining := int(math.Max(0, math.Floor(tokens)))
+	// how long until the bucket is full again
+	reset := time.Duration((float64(cl.limit.Requests) - tokens) * float64(per))
+
+	h := c.Response().Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(cl.limit.Requests))
+	h.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("RateLimit-Reset", retryAfterSeconds(reset))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", cl.limit.Requests, int(cl.limit.Window.Seconds())))
+
+	if !allowed {
+		apiRateLimited.WithLabelValues(cl.name).Inc()
+		err := apiError(http.StatusTooManyRequests, XRPCErrRateLimited, "rate limit of %s exceeded", cl.limit)
+		// the next token comes when the bucket gets back up to one
+		err.RetryAfter = time.Duration((1 - tokens) * float64(per))
+		return err
+	}
+	apiRateLimitAllowed.WithLabelValues(cl.name).Inc()
+	return nil
+}
+
+func (cl *classLimiter) bucket(key string) *rate.Limiter {
+	cl.lk.Lock()
+	defer cl.lk.Unlock()
+	lim, ok := cl.buckets.Get(key)
+	if !ok {
+		lim = rate.NewLimiter(rate.Every(cl.limit.Window/time.Duration(cl.limit.Requests)), cl.limit.Requests)
+		cl.buckets.Add(key, lim)
+	}
+	return lim
+}
+
+// ParseExemptAddrs parses CIDR prefixes or bare addresses for
+// APIRateLimitOptions.Exempt
+func ParseExemptAddrs(addrs []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, a := range addrs {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		if strings.Contains(a, "/") {
+			p, err := netip.ParsePrefix(a)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(a)
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return out, nil
+}
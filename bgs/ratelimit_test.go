@@ -0,0 +1,241 @@
+package bgs
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// rateLimitRequest runs a request through the middleware, returning the
+// response headers and the error it was turned away with, if any
+func rateLimitRequest(mw echo.MiddlewareFunc, path, remoteAddr, xff, adminIdent string) (http.Header, error) {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = remoteAddr
+	if xff != "" {
+		req.Header.Set(echo.HeaderXForwardedFor, xff)
+	}
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	if adminIdent != "" {
+		c.Set(adminIdentityKey, adminIdent)
+	}
+	err := mw(func(c echo.Context) error { return nil })(c)
+	return rec.Header(), err
+}
+
+func isRateLimited(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Status == http.StatusTooManyRequests && apiErr.Name == XRPCErrRateLimited
+}
+
+func TestAPIRateLimiterBuckets(t *testing.T) {
+	clk := &fixedClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	rl, err := NewAPIRateLimiter(&APIRateLimitOptions{
+		Limits: map[string]RateLimit{
+			RateClassSync:  {Requests: 2, Window: time.Minute},
+			RateClassCrawl: {Requests: 1, Window: time.Minute},
+		},
+	}, clk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const getRepo = "/xrpc/com.atproto.sync.getRepo"
+	const requestCrawl = "/xrpc/com.atproto.sync.requestCrawl"
+	const client = "203.0.113.5:1234"
+
+	h, err := rateLimitRequest(rl.Middleware, getRepo, client, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Get("RateLimit-Limit") != "2" || h.Get("RateLimit-Remaining") != "1" || h.Get("RateLimit-Policy") != "2;w=60" {
+		t.Fatalf("unexpected rate limit headers %v", h)
+	}
+	if _, err := rateLimitRequest(rl.Middleware, getRepo, client, "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = rateLimitRequest(rl.Middleware, getRepo, client, "", "")
+	if !isRateLimited(err) {
+		t.Fatalf("expected the third request limited, got %v", err)
+	}
+	var apiErr *APIError
+	errors.As(err, &apiErr)
+	if apiErr.RetryAfter != 30*time.Second {
+		t.Fatalf("expected to retry once a token is back in 30s, got %s", apiErr.RetryAfter)
+	}
+
+	// buckets are per class and per IP
+	if _, err := rateLimitRequest(rl.Middleware, requestCrawl, client, "", ""); err != nil {
+		t.Fatalf("expected another class's bucket untouched, got %v", err)
+	}
+	if _, err := rateLimitRequest(rl.Middleware, getRepo, "203.0.113.6:1234", "", ""); err != nil {
+		t.Fatalf("expected another client's bucket untouched, got %v", err)
+	}
+	// classes without a limit, and paths outside any class, aren't limited
+	for i := 0; i < 5; i++ {
+		if _, err := rateLimitRequest(rl.Middleware, "/xrpc/com.atproto.sync.listRepos", client, "", ""); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rateLimitRequest(rl.Middleware, "/xrpc/_health", client, "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the bucket refills over the window
+	clk.now = clk.now.Add(30 * time.Second)
+	if _, err := rateLimitRequest(rl.Middleware, getRepo, client, "", ""); err != nil {
+		t.Fatalf("expected a token back after 30s, got %v", err)
+	}
+	if _, err := rateLimitRequest(rl.Middleware, getRepo, client, "", ""); !isRateLimited(err) {
+		t.Fatalf("expected only one token back, got %v", err)
+	}
+}
+
+func TestAPIRateLimiterProxyHeaders(t *testing.T) {
+	const proxy = "10.0.0.1:1234"
+	limits := map[string]RateLimit{RateClassSync: {Requests: 1, Window: time.Minute}}
+
+	for _, tc := range []struct {
+		name  string
+		trust bool
+		addr  string
+		// whether requests with different X-Forwarded-For addresses get
+		// their own buckets
+		separate bool
+	}{
+		{"not trusted, from proxy", false, proxy, false},
+		{"not trusted, from client", false, "203.0.113.5:1234", false},
+		{"trusted, from proxy", true, proxy, true},
+		// only proxies on the private network are trusted to set it
+		{"trusted, from public address", true, "203.0.113.5:1234", false},
+	} {
+		rl, err := NewAPIRateLimiter(&APIRateLimitOptions{Limits: limits, TrustProxyHeaders: tc.trust}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rateLimitRequest(rl.Middleware, "/xrpc/com.atproto.sync.getRepo", tc.addr, "198.51.100.1", ""); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		_, err = rateLimitRequest(rl.Middleware, "/xrpc/com.atproto.sync.getRepo", tc.addr, "198.51.100.2", "")
+		if tc.separate && err != nil {
+			t.Errorf("%s: expected the forwarded address limited on its own, got %v", tc.name, err)
+		}
+		if !tc.separate && !isRateLimited(err) {
+			t.Errorf("%s: expected X-Forwarded-For ignored, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestAPIRateLimiterExempt(t *testing.T) {
+	exempt, err := ParseExemptAddrs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := NewAPIRateLimiter(&APIRateLimitOptions{
+		Limits: map[string]RateLimit{RateClassSync: {Requests: 1, Window: time.Minute}},
+		Exempt: exempt,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := rateLimitRequest(rl.Middleware, "/xrpc/com.atproto.sync.getRepo", "10.1.2.3:1234", "", ""); err != nil {
+			t.Fatalf("expected exempt address not limited, got %v", err)
+		}
+	}
+}
+
+func TestAPIRateLimiterAdmin(t *testing.T) {
+	rl, err := NewAPIRateLimiter(&APIRateLimitOptions{
+		Limits: map[string]RateLimit{RateClassAdmin: {Requests: 1, Window: time.Minute}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const addr = "203.0.113.5:1234"
+	if _, err := rateLimitRequest(rl.AdminMiddleware, "/admin/pds/list", addr, "", "did:plc:admin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rateLimitRequest(rl.AdminMiddleware, "/admin/pds/list", addr, "", "did:plc:admin"); !isRateLimited(err) {
+		t.Fatalf("expected the admin's second request limited, got %v", err)
+	}
+	// admins are limited by identity, not address
+	if _, err := rateLimitRequest(rl.AdminMiddleware, "/admin/pds/list", addr, "", "token:0123abcd"); err != nil {
+		t.Fatalf("expected another admin from the same address let through, got %v", err)
+	}
+	// and unauthenticated requests are left to checkAdminAuth
+	if _, err := rateLimitRequest(rl.AdminMiddleware, "/admin/pds/list", addr, "", ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewAPIRateLimiterValidates(t *testing.T) {
+	for _, limits := range []map[string]RateLimit{
+		{"bogus": {Requests: 1, Window: time.Minute}},
+		{RateClassSync: {Requests: 0, Window: time.Minute}},
+		{RateClassSync: {Requests: 1}},
+	} {
+		if _, err := NewAPIRateLimiter(&APIRateLimitOptions{Limits: limits}, nil); err == nil {
+			t.Errorf("expected %v rejected", limits)
+		}
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	for _, tc := range []struct {
+		in  string
+		out RateLimit
+		ok  bool
+	}{
+		{"300/1m", RateLimit{Requests: 300, Window: time.Minute}, true},
+		{"10/30s", RateLimit{Requests: 10, Window: 30 * time.Second}, true},
+		{"300", RateLimit{}, false},
+		{"0/1m", RateLimit{}, false},
+		{"-1/1m", RateLimit{}, false},
+		{"x/1m", RateLimit{}, false},
+		{"300/1", RateLimit{}, false},
+		{"300/0s", RateLimit{}, false},
+		{"300/-1m", RateLimit{}, false},
+	} {
+		out, err := ParseRateLimit(tc.in)
+		if (err == nil) != tc.ok || out != tc.out {
+			t.Errorf("%q: expected %v ok %v, got %v %v", tc.in, tc.out, tc.ok, out, err)
+		}
+	}
+}
+
+func TestParseExemptAddrs(t *testing.T) {
+	out, err := ParseExemptAddrs([]string{"10.0.0.0/8", " 192.168.1.7 ", "", "::ffff:172.16.0.1", "fd00::/8", "10.1.2.3/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.1.7/32"),
+		netip.MustParsePrefix("172.16.0.1/32"),
+		netip.MustParsePrefix("fd00::/8"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+	}
+	if len(out) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, out)
+	}
+	for i := range out {
+		if out[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, out)
+		}
+	}
+
+	for _, bad := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0/8"} {
+		if _, err := ParseExemptAddrs([]string{bad}); err == nil {
+			t.Errorf("expected %q rejected", bad)
+		}
+	}
+}
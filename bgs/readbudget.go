@@ -0,0 +1,251 @@
+package bgs
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type ReadBudgetOptions struct {
+	// Total bytes responses to sync reads (getRepo and getBlocks) may hold in
+	// memory at once; zero for no limit
+	Budget int64
+	// Most bytes of one response held in memory; larger responses are
+	// streamed out as they're read
+	PerRequest int64
+	// Least a request reserves, for small repos and requests of unknown size
+	MinReservation int64
+	// How long a request waits for budget to free up before being turned
+	// away, and how many may wait at once. Requests past MaxQueued are turned
+	// away immediately.
+	QueueTimeout time.Duration
+	MaxQueued    int
+}
+
+func DefaultReadBudgetOptions() *ReadBudgetOptions {
+	return &ReadBudgetOptions{
+		Budget:         512 << 20,
+		PerRequest:     4 << 20,
+		MinReservation: 64 << 10,
+		QueueTimeout:   5 * time.Second,
+		MaxQueued:      100,
+	}
+}
+
+var errReadBudgetExhausted = errors.New("read memory budget exhausted")
+
+// ReadBudget admits sync read requests against a budget of memory, so that a
+// burst of requests for large repos can't exhaust the relay's. Each request
+// reserves what it may buffer, which is capped at PerRequest by streaming the
+// rest; requests that don't fit queue in order until there is room.
+type ReadBudget struct {
+	opts ReadBudgetOptions
+
+	lk      sync.Mutex
+	used    int64
+	waiting *list.List
+}
+
+type budgetWaiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+func NewReadBudget(opts *ReadBudgetOptions) *ReadBudget {
+	if opts == nil {
+		opts = DefaultReadBudgetOptions()
+	}
+	rb := &ReadBudget{
+		opts:    *opts,
+		waiting: list.New(),
+	}
+	if rb.opts.PerRequest <= 0 {
+		rb.opts.PerRequest = DefaultReadBudgetOptions().PerRequest
+	}
+	if rb.opts.MinReservation > rb.opts.PerRequest {
+		rb.opts.MinReservation = rb.opts.PerRequest
+	}
+	if rb.opts.Budget > 0 && rb.opts.PerRequest > rb.opts.Budget {
+		rb.opts.PerRequest = rb.opts.Budget
+	}
+	return rb
+}
+
+// reservation is what a response of about size bytes reserves; size is zero
+// when unknown
+func (rb *ReadBudget) reservation(size int64) int64 {
+	if size <= 0 || size > rb.opts.PerRequest {
+		size = rb.opts.PerRequest
+	}
+	if size < rb.opts.MinReservation {
+		size = rb.opts.MinReservation
+	}
+	return size
+}
+
+// Acquire reserves memory for a response of about size bytes, waiting up to
+// QueueTimeout for it. It returns errReadBudgetExhausted if the request is
+// turned away, and otherwise a func to give the reservation back.
+func (rb *ReadBudget) Acquire(ctx context.Context, size int64) (func(), error) {
+	n := rb.reservation(size)
+	if rb.opts.Budget <= 0 {
+		return func() {}, nil
+	}
+
+	rb.lk.Lock()
+	if rb.waiting.Len() == 0 && rb.used+n <= rb.opts.Budget {
+		rb.used += n
+		readBudgetUsed.Set(float64(rb.used))
+		rb.lk.Unlock()
+		return rb.releaser(n), nil
+	}
+	if rb.opts.QueueTimeout <= 0 || rb.waiting.Len() >= rb.opts.MaxQueued {
+		rb.lk.Unlock()
+		readBudgetRejected.Inc()
+		return nil, errReadBudgetExhausted
+	}
+	w := &budgetWaiter{n: n, ready: make(chan struct{})}
+	el := rb.waiting.PushBack(w)
+	readBudgetQueued.Set(float64(rb.waiting.Len()))
+	rb.lk.Unlock()
+
+	t := time.NewTimer(rb.opts.QueueTimeout)
+	defer t.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+		return rb.releaser(n), nil
+	case <-t.C:
+		err = errReadBudgetExhausted
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	rb.lk.Lock()
+	select {
+	case <-w.ready:
+		// admitted as we gave up; hand the reservation back
+		rb.lk.Unlock()
+		rb.release(n)
+	default:
+		rb.waiting.Remove(el)
+		readBudgetQueued.Set(float64(rb.waiting.Len()))
+		// the next in line may fit now that this one isn't ahead of it
+		rb.admitWaiting()
+		rb.lk.Unlock()
+	}
+	if errors.Is(err, errReadBudgetExhausted) {
+		readBudgetRejected.Inc()
+	}
+	return nil, err
+}
+
+func (rb *ReadBudget) releaser(n int64) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { rb.release(n) })
+	}
+}
+
+func (rb *ReadBudget) release(n int64) {
+	rb.lk.Lock()
+	defer rb.lk.Unlock()
+
+	rb.used -= n
+	rb.admitWaiting()
+}
+
+// admitWaiting admits queued requests in order while they fit. Must be
+// called with the lock held.
+func (rb *ReadBudget) admitWaiting() {
+	for rb.waiting.Len() > 0 {
+		w := rb.waiting.Front().Value.(*budgetWaiter)
+		if rb.used+w.n > rb.opts.Budget {
+			break
+		}
+		rb.used += w.n
+		rb.waiting.Remove(rb.waiting.Front())
+		close(w.ready)
+	}
+	readBudgetUsed.Set(float64(rb.used))
+	readBudgetQueued.Set(float64(rb.waiting.Len()))
+}
+
+// budgetExhaustedError is the response to a request turned away for lack of
+// memory budget
+func (rb *ReadBudget) budgetExhaustedError() *APIError {
+	err := apiError(http.StatusServiceUnavailable, XRPCErrUnavailable, "relay is busy serving other sync requests, try again shortly")
+	err.RetryAfter = rb.opts.QueueTimeout
+	if err.RetryAfter < time.Second {
+		err.RetryAfter = time.Second
+	}
+	return err
+}
+
+// streamWriter buffers a response up to a limit before committing to it, so
+// that responses that fit can still fail with an error, and streams larger
+// ones out as they're written
+type streamWriter struct {
+	resp        http.ResponseWriter
+	contentType string
+	buf         *bufio.Writer
+	committed   bool
+
+	// Content-Encoding of the body, if it's compressed
+	contentEncoding string
+}
+
+func newStreamWriter(resp http.ResponseWriter, contentType string, limit int64) *streamWriter {
+	sw := &streamWriter{resp: resp, contentType: contentType}
+	sw.buf = bufio.NewWriterSize(writerFunc(sw.writeThrough), int(limit))
+	return sw
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	return sw.buf.Write(p)
+}
+
+func (sw *streamWriter) writeThrough(p []byte) (int, error) {
+	sw.commit()
+	return sw.resp.Write(p)
+}
+
+func (sw *streamWriter) commit() {
+	if sw.committed {
+		return
+	}
+	sw.committed = true
+	sw.resp.Header().Set("Content-Type", sw.contentType)
+	sw.resp.Header().Add("Vary", "Accept-Encoding")
+	if sw.contentEncoding != "" {
+		sw.resp.Header().Set("Content-Encoding", sw.contentEncoding)
+	}
+	sw.resp.WriteHeader(http.StatusOK)
+}
+
+// Committed reports whether any of the response has been sent, after which
+// an error can't be
+func (sw *streamWriter) Committed() bool {
+	return sw.committed
+}
+
+// Close sends whatever is still buffered
+func (sw *streamWriter) Close() error {
+	if err := sw.buf.Flush(); err != nil {
+		return err
+	}
+	sw.commit()
+	return nil
+}
+
+var _ io.WriteCloser = (*streamWriter)(nil)
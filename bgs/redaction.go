@@ -0,0 +1,362 @@
+package bgs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/carstore"
+	"github.com/bluesky-social/indigo/events"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/repomgr"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/ipld/go-car"
+)
+
+// RedactionMarkerField is added to redacted records, naming the CID of the
+// record as its repo has it and the paths that were removed:
+//
+//	{"$redacted": {"cid": {"$link": "bafyrei..."}, "paths": ["embed.external.uri"]}}
+//
+// The record's repo commits to the original CID, so with the marker a
+// consumer can still check that the redacted record came from a signed one.
+const RedactionMarkerField = "$redacted"
+
+// RedactionRule removes fields from records in a collection before they're
+// sent out
+type RedactionRule struct {
+	// An NSID, or a prefix like app.bsky.feed.*
+	Collection string `json:"collection"`
+	// Fields to remove, as dot separated paths into the record, like
+	// embed.external.uri. A path through an array applies to each of its
+	// elements.
+	Paths []string `json:"paths"`
+}
+
+type RedactionOptions struct {
+	Rules []RedactionRule
+}
+
+// LoadRedactionRules reads redaction rules from a JSON config file:
+//
+//	{
+//	  "rules": [
+//	    {"collection": "app.bsky.feed.post", "paths": ["embed.external.uri", "facets.features.uri"]},
+//	    {"collection": "app.bsky.actor.*", "paths": ["description"]}
+//	  ]
+//	}
+func LoadRedactionRules(path string) (*RedactionOptions, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading redaction rules: %w", err)
+	}
+
+	var opts RedactionOptions
+	if err := json.Unmarshal(b, &opts); err != nil {
+		return nil, fmt.Errorf("parsing redaction rules %s: %w", path, err)
+	}
+	return &opts, nil
+}
+
+func (r *RedactionRule) validate() error {
+	if r.Collection == "" {
+		return fmt.Errorf("redaction rules must have a collection")
+	}
+	if r.Collection != "*" && strings.Contains(strings.TrimSuffix(r.Collection, ".*"), "*") {
+		return fmt.Errorf("redaction rule collection %q can only end in a wildcard", r.Collection)
+	}
+	if len(r.Paths) == 0 {
+		return fmt.Errorf("redaction rule for %s has no paths", r.Collection)
+	}
+	for _, p := range r.Paths {
+		if p == "" || strings.HasPrefix(p, ".") || strings.HasSuffix(p, ".") || strings.Contains(p, "..") {
+			return fmt.Errorf("redaction rule for %s has a bad path %q", r.Collection, p)
+		}
+		if p == RedactionMarkerField || strings.HasPrefix(p, RedactionMarkerField+".") {
+			return fmt.Errorf("redaction rule for %s can't remove the redaction marker", r.Collection)
+		}
+	}
+	return nil
+}
+
+// Redactor removes fields from the records in commits, by collection, before
+// they're sequenced: the same redacted commit is then sent to live
+// subscribers, persisted for playback and passed to sinks. getRecord serves
+// redacted records too. getRepo and getBlocks serve the repo as its PDS
+// signed it, so a relay that mustn't serve the removed fields at all should
+// keep those closed to the public.
+//
+// A redacted record is re-encoded without the removed fields and with a
+// RedactionMarkerField, and goes out under its new CID, in place of the
+// original in the commit's blocks and its op.
+type Redactor struct {
+	rules []RedactionRule
+}
+
+func NewRedactor(opts *RedactionOptions) (*Redactor, error) {
+	if opts == nil || len(opts.Rules) == 0 {
+		return nil, fmt.Errorf("redaction needs at least one rule")
+	}
+	for i := range opts.Rules {
+		if err := opts.Rules[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &Redactor{rules: opts.Rules}, nil
+}
+
+// pathsFor returns the paths removed from records in col, from every rule
+// matching it
+func (rd *Redactor) pathsFor(col string) []string {
+	var paths []string
+	for _, r := range rd.rules {
+		if collectionMatches(r.Collection, col) {
+			paths = append(paths, r.Paths...)
+		}
+	}
+	return paths
+}
+
+func collectionMatches(pattern, col string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(col, prefix)
+	}
+	return pattern == col
+}
+
+// redactRecord removes paths from the record blk, stored under c. It returns
+// the redacted record and its CID, or ok false if none of the paths were in
+// the record, which then goes out as it is.
+func redactRecord(c cid.Cid, blk []byte, paths []string) (out []byte, outCid cid.Cid, ok bool, err error) {
+	rec, err := data.UnmarshalCBOR(blk)
+	if err != nil {
+		return nil, cid.Undef, false, fmt.Errorf("decoding record %s: %w", c, err)
+	}
+
+	var removed []any
+	for _, p := range paths {
+		if removeField(rec, strings.Split(p, ".")) {
+			removed = append(removed, p)
+		}
+	}
+	if len(removed) == 0 {
+		return nil, cid.Undef, false, nil
+	}
+
+	rec[RedactionMarkerField] = map[string]any{
+		"cid":   data.CIDLink(c),
+		"paths": removed,
+	}
+	out, err = data.MarshalCBOR(rec)
+	if err != nil {
+		return nil, cid.Undef, false, fmt.Errorf("encoding redacted record %s: %w", c, err)
+	}
+	outCid, err = c.Prefix().Sum(out)
+	if err != nil {
+		return nil, cid.Undef, false, err
+	}
+	return out, outCid, true, nil
+}
+
+// removeField removes the field at path from obj, descending into each
+// element of arrays along the way, and reports whether it found any
+func removeField(obj any, path []string) bool {
+	switch v := obj.(type) {
+	case map[string]any:
+		if len(path) == 1 {
+			_, ok := v[path[0]]
+			delete(v, path[0])
+			return ok
+		}
+		next, ok := v[path[0]]
+		if !ok {
+			return false
+		}
+		return removeField(next, path[1:])
+	case []any:
+		found := false
+		for _, elem := range v {
+			if removeField(elem, path) {
+				found = true
+			}
+		}
+		return found
+	default:
+		return false
+	}
+}
+
+// middleware redacts the records created or updated by commits. A commit
+// whose records can't be redacted is dropped, rather than sent out with what
+// should have been removed.
+func (rd *Redactor) middleware(ctx context.Context, evt *events.XRPCStreamEvent) (*events.XRPCStreamEvent, error) {
+	commit := evt.RepoCommit
+	if commit == nil {
+		return evt, nil
+	}
+
+	var blks map[cid.Cid][]byte
+	// original CIDs of redacted records, and what replaces them
+	replaced := make(map[cid.Cid]blocks.Block)
+	// records some op still refers to as they are
+	kept := make(map[cid.Cid]bool)
+	ops := make([]*comatproto.SyncSubscribeRepos_RepoOp, len(commit.Ops))
+	copy(ops, commit.Ops)
+	for i, op := range ops {
+		switch repomgr.EventKind(op.Action) {
+		case repomgr.EvtKindCreateRecord, repomgr.EvtKindUpdateRecord:
+		default:
+			continue
+		}
+		if op.Cid == nil {
+			continue
+		}
+		c := cid.Cid(*op.Cid)
+		col, _, _ := strings.Cut(op.Path, "/")
+		paths := rd.pathsFor(col)
+		if len(paths) == 0 {
+			kept[c] = true
+			continue
+		}
+
+		if blks == nil {
+			var err error
+			if blks, err = readCommitBlocks(commit.Blocks); err != nil {
+				return nil, err
+			}
+		}
+
+		nb, ok := replaced[c]
+		if !ok {
+			blk, found := blks[c]
+			if !found {
+				// not in this commit's blocks, so there's nothing to remove
+				continue
+			}
+			out, outCid, redacted, err := redactRecord(c, blk, paths)
+			if err != nil {
+				return nil, fmt.Errorf("redacting %s in %s: %w", op.Path, commit.Repo, err)
+			}
+			if !redacted {
+				kept[c] = true
+				continue
+			}
+			if nb, err = blocks.NewBlockWithCid(out, outCid); err != nil {
+				return nil, err
+			}
+			replaced[c] = nb
+			redactedRecords.WithLabelValues(col).Inc()
+		}
+
+		newOp := *op
+		link := lexutil.LexLink(nb.Cid())
+		newOp.Cid = &link
+		ops[i] = &newOp
+	}
+	if len(replaced) == 0 {
+		return evt, nil
+	}
+
+	carBytes, err := rewriteCommitBlocks(commit.Blocks, replaced, kept)
+	if err != nil {
+		return nil, fmt.Errorf("rewriting blocks of %s: %w", commit.Repo, err)
+	}
+
+	// the commit may be referred to elsewhere, so it's copied rather than
+	// changed
+	out := *commit
+	out.Ops = ops
+	out.Blocks = carBytes
+	evt.RepoCommit = &out
+	return evt, nil
+}
+
+// rewriteCommitBlocks re-encodes a commit's CAR slice with redacted records
+// in place of the originals, keeping an original too if kept says an
+// unredacted op still needs it
+func rewriteCommitBlocks(b []byte, replaced map[cid.Cid]blocks.Block, kept map[cid.Cid]bool) ([]byte, error) {
+	cr, err := car.NewCarReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	hb, err := cbor.DumpObject(cr.Header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := carstore.LdWrite(buf, hb); err != nil {
+		return nil, err
+	}
+
+	for {
+		blk, err := cr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+
+		if nb, ok := replaced[blk.Cid()]; ok {
+			if _, err := carstore.LdWrite(buf, nb.Cid().Bytes(), nb.RawData()); err != nil {
+				return nil, err
+			}
+			if !kept[blk.Cid()] {
+				continue
+			}
+		}
+		if _, err := carstore.LdWrite(buf, blk.Cid().Bytes(), blk.RawData()); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// redactProof replaces the record rec among a getRecord proof's blocks with
+// its redacted form, if any of col's rules apply. The redacted record's CID
+// is returned so the response can name it as a root: the proof's MST still
+// points at the original, which the redaction marker names.
+func (rd *Redactor) redactProof(col string, rec cid.Cid, proof []blocks.Block) ([]blocks.Block, cid.Cid, error) {
+	paths := rd.pathsFor(col)
+	if len(paths) == 0 || !rec.Defined() {
+		return proof, cid.Undef, nil
+	}
+
+	out := make([]blocks.Block, 0, len(proof))
+	redactedCid := cid.Undef
+	for _, blk := range proof {
+		if !blk.Cid().Equals(rec) {
+			out = append(out, blk)
+			continue
+		}
+		b, outCid, ok, err := redactRecord(rec, blk.RawData(), paths)
+		if err != nil {
+			return nil, cid.Undef, err
+		}
+		if !ok {
+			return proof, cid.Undef, nil
+		}
+		nb, err := blocks.NewBlockWithCid(b, outCid)
+		if err != nil {
+			return nil, cid.Undef, err
+		}
+		out = append(out, nb)
+		redactedCid = outCid
+		redactedRecords.WithLabelValues(col).Inc()
+	}
+	return out, redactedCid, nil
+}
@@ -0,0 +1,323 @@
+package bgs
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/carstore"
+	"github.com/bluesky-social/indigo/events"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+)
+
+func testRedactor(t *testing.T) *Redactor {
+	t.Helper()
+	rd, err := NewRedactor(&RedactionOptions{Rules: []RedactionRule{
+		{Collection: "app.bsky.feed.post", Paths: []string{"embed.external.uri", "facets.features.uri"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rd
+}
+
+func recordBlock(t *testing.T, rec map[string]any) blocks.Block {
+	t.Helper()
+	b, err := data.MarshalCBOR(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := cid.NewPrefixV1(cid.DagCBOR, 0x12).Sum(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk, err := blocks.NewBlockWithCid(b, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blk
+}
+
+func testPost() map[string]any {
+	return map[string]any{
+		"$type":     "app.bsky.feed.post",
+		"text":      "look at this",
+		"createdAt": "2024-06-01T12:00:00Z",
+		"embed": map[string]any{
+			"$type": "app.bsky.embed.external",
+			"external": map[string]any{
+				"uri":   "https://example.com/secret",
+				"title": "a page",
+			},
+		},
+		"facets": []any{
+			map[string]any{"features": []any{
+				map[string]any{"$type": "app.bsky.richtext.facet#link", "uri": "https://example.com/a"},
+				map[string]any{"$type": "app.bsky.richtext.facet#tag", "tag": "news"},
+			}},
+		},
+	}
+}
+
+func writeTestCar(t *testing.T, root cid.Cid, blks ...blocks.Block) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{root}, Version: 1}, buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, blk := range blks {
+		if _, err := carstore.LdWrite(buf, blk.Cid().Bytes(), blk.RawData()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// checkRedactedPost checks that b is testPost with its redacted fields
+// removed, and a marker naming the original
+func checkRedactedPost(t *testing.T, b []byte, orig cid.Cid) {
+	t.Helper()
+	rec, err := data.UnmarshalCBOR(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	external := rec["embed"].(map[string]any)["external"].(map[string]any)
+	if _, ok := external["uri"]; ok {
+		t.Fatal("expected embed.external.uri removed")
+	}
+	if external["title"] != "a page" || rec["text"] != "look at this" {
+		t.Fatalf("expected unrelated fields kept, got %v", rec)
+	}
+	features := rec["facets"].([]any)[0].(map[string]any)["features"].([]any)
+	if _, ok := features[0].(map[string]any)["uri"]; ok {
+		t.Fatal("expected facets.features.uri removed from every feature")
+	}
+	if features[1].(map[string]any)["tag"] != "news" {
+		t.Fatal("expected the tag facet kept")
+	}
+
+	marker, ok := rec[RedactionMarkerField].(map[string]any)
+	if !ok {
+		t.Fatal("expected a redaction marker")
+	}
+	if link, ok := marker["cid"].(data.CIDLink); !ok || !link.CID().Equals(orig) {
+		t.Fatalf("expected the marker to name %s, got %v", orig, marker["cid"])
+	}
+	if paths := marker["paths"].([]any); len(paths) != 2 {
+		t.Fatalf("expected both paths in the marker, got %v", paths)
+	}
+}
+
+func TestRedactorMiddleware(t *testing.T) {
+	rd := testRedactor(t)
+
+	root := recordBlock(t, map[string]any{"did": "did:plc:one", "version": int64(3)})
+	post := recordBlock(t, testPost())
+	like := recordBlock(t, map[string]any{
+		"$type":     "app.bsky.feed.like",
+		"createdAt": "2024-06-01T12:00:00Z",
+	})
+	// a post none of the rule's paths are in goes out as it is
+	plain := recordBlock(t, map[string]any{
+		"$type":     "app.bsky.feed.post",
+		"text":      "nothing to see",
+		"createdAt": "2024-06-01T12:00:00Z",
+	})
+
+	link := func(blk blocks.Block) *lexutil.LexLink {
+		l := lexutil.LexLink(blk.Cid())
+		return &l
+	}
+	commit := &comatproto.SyncSubscribeRepos_Commit{
+		Repo:   "did:plc:one",
+		Commit: lexutil.LexLink(root.Cid()),
+		Blocks: writeTestCar(t, root.Cid(), root, post, like, plain),
+		Ops: []*comatproto.SyncSubscribeRepos_RepoOp{
+			{Action: "create", Path: "app.bsky.feed.post/1", Cid: link(post)},
+			{Action: "create", Path: "app.bsky.feed.like/1", Cid: link(like)},
+			{Action: "create", Path: "app.bsky.feed.post/2", Cid: link(plain)},
+			{Action: "delete", Path: "app.bsky.feed.post/3"},
+		},
+	}
+	origBlocks := commit.Blocks
+
+	out, err := rd.middleware(context.Background(), &events.XRPCStreamEvent{RepoCommit: commit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := out.RepoCommit
+	if rc == commit || !bytes.Equal(commit.Blocks, origBlocks) {
+		t.Fatal("expected the original commit left untouched")
+	}
+
+	postCid := cid.Cid(*rc.Ops[0].Cid)
+	if postCid.Equals(post.Cid()) {
+		t.Fatal("expected the redacted post under a new CID")
+	}
+	for i, blk := range []blocks.Block{like, plain} {
+		if c := cid.Cid(*rc.Ops[i+1].Cid); !c.Equals(blk.Cid()) {
+			t.Fatalf("expected op %d's CID unchanged, got %s", i+1, c)
+		}
+	}
+	if rc.Ops[3].Cid != nil {
+		t.Fatal("expected the delete op unchanged")
+	}
+
+	cr, err := car.NewCarReader(bytes.NewReader(rc.Blocks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cr.Header.Roots) != 1 || !cr.Header.Roots[0].Equals(root.Cid()) {
+		t.Fatalf("expected the commit root unchanged, got %v", cr.Header.Roots)
+	}
+	blks, err := readCommitBlocks(rc.Blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := blks[post.Cid()]; ok {
+		t.Fatal("expected the unredacted post left out of the blocks")
+	}
+	for _, blk := range []blocks.Block{root, like, plain} {
+		if !bytes.Equal(blks[blk.Cid()], blk.RawData()) {
+			t.Fatalf("expected block %s unchanged", blk.Cid())
+		}
+	}
+	checkRedactedPost(t, blks[postCid], post.Cid())
+}
+
+func TestRedactorKeepsSharedRecords(t *testing.T) {
+	rd, err := NewRedactor(&RedactionOptions{Rules: []RedactionRule{
+		{Collection: "app.bsky.feed.post", Paths: []string{"text"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same record in two collections is one block; only the op in the
+	// redacted collection gets the redacted copy
+	root := recordBlock(t, map[string]any{"did": "did:plc:one"})
+	rec := recordBlock(t, map[string]any{"text": "shared"})
+	l := lexutil.LexLink(rec.Cid())
+	commit := &comatproto.SyncSubscribeRepos_Commit{
+		Repo:   "did:plc:one",
+		Blocks: writeTestCar(t, root.Cid(), root, rec),
+		Ops: []*comatproto.SyncSubscribeRepos_RepoOp{
+			{Action: "create", Path: "app.bsky.feed.post/1", Cid: &l},
+			{Action: "create", Path: "com.example.thing/1", Cid: &l},
+		},
+	}
+	out, err := rd.middleware(context.Background(), &events.XRPCStreamEvent{RepoCommit: commit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blks, err := readCommitBlocks(out.RepoCommit.Blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := blks[rec.Cid()]; !ok {
+		t.Fatal("expected the original kept for the unredacted op")
+	}
+	if _, ok := blks[cid.Cid(*out.RepoCommit.Ops[0].Cid)]; !ok {
+		t.Fatal("expected the redacted copy added")
+	}
+	if c := cid.Cid(*out.RepoCommit.Ops[1].Cid); !c.Equals(rec.Cid()) {
+		t.Fatalf("expected the unredacted op's CID unchanged, got %s", c)
+	}
+}
+
+func TestRedactorFailsClosed(t *testing.T) {
+	rd := testRedactor(t)
+	ctx := context.Background()
+
+	root := recordBlock(t, map[string]any{"did": "did:plc:one"})
+	// not a record, but stored under a CID an op names
+	c, err := cid.NewPrefixV1(cid.DagCBOR, 0x12).Sum([]byte{0xff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, err := blocks.NewBlockWithCid([]byte{0xff}, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := lexutil.LexLink(c)
+	ops := []*comatproto.SyncSubscribeRepos_RepoOp{{Action: "create", Path: "app.bsky.feed.post/1", Cid: &l}}
+
+	for _, tc := range []struct {
+		name   string
+		blocks []byte
+	}{
+		{"undecodable record", writeTestCar(t, root.Cid(), root, bad)},
+		{"bad CAR", []byte("not a car")},
+	} {
+		evt := &events.XRPCStreamEvent{RepoCommit: &comatproto.SyncSubscribeRepos_Commit{
+			Repo:   "did:plc:one",
+			Blocks: tc.blocks,
+			Ops:    ops,
+		}}
+		if out, err := rd.middleware(ctx, evt); err == nil {
+			t.Errorf("%s: expected the commit dropped, got %v", tc.name, out)
+		}
+	}
+
+	if _, _, err := rd.redactProof("app.bsky.feed.post", c, []blocks.Block{root, bad}); err == nil {
+		t.Error("expected getRecord to fail on an undecodable record")
+	}
+}
+
+func TestRedactProof(t *testing.T) {
+	rd := testRedactor(t)
+
+	root := recordBlock(t, map[string]any{"did": "did:plc:one"})
+	post := recordBlock(t, testPost())
+	proof := []blocks.Block{root, post}
+
+	out, redacted, err := rd.redactProof("app.bsky.feed.post", post.Cid(), proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !redacted.Defined() || redacted.Equals(post.Cid()) {
+		t.Fatalf("expected a new root for the redacted record, got %s", redacted)
+	}
+	if len(out) != 2 || !out[0].Cid().Equals(root.Cid()) || !bytes.Equal(out[0].RawData(), root.RawData()) {
+		t.Fatal("expected the rest of the proof unchanged")
+	}
+	if !out[1].Cid().Equals(redacted) {
+		t.Fatalf("expected the record replaced by %s, got %s", redacted, out[1].Cid())
+	}
+	checkRedactedPost(t, out[1].RawData(), post.Cid())
+
+	// records in other collections are served as they are
+	out, redacted, err = rd.redactProof("app.bsky.feed.like", post.Cid(), proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redacted.Defined() || len(out) != 2 || !out[1].Cid().Equals(post.Cid()) {
+		t.Fatal("expected the proof unchanged outside the rule's collection")
+	}
+}
+
+func TestRedactionRuleValidate(t *testing.T) {
+	for _, tc := range []struct {
+		rule RedactionRule
+		ok   bool
+	}{
+		{RedactionRule{Collection: "app.bsky.feed.post", Paths: []string{"embed.external.uri"}}, true},
+		{RedactionRule{Collection: "app.bsky.*", Paths: []string{"text"}}, true},
+		{RedactionRule{Collection: "*", Paths: []string{"text"}}, true},
+		{RedactionRule{Collection: "", Paths: []string{"text"}}, false},
+		{RedactionRule{Collection: "app.*.post", Paths: []string{"text"}}, false},
+		{RedactionRule{Collection: "app.bsky.feed.post"}, false},
+		{RedactionRule{Collection: "app.bsky.feed.post", Paths: []string{"embed..uri"}}, false},
+		{RedactionRule{Collection: "app.bsky.feed.post", Paths: []string{"$redacted.cid"}}, false},
+	} {
+		if err := tc.rule.validate(); (err == nil) != tc.ok {
+			t.Errorf("%s %v: expected ok %v, got %v", tc.rule.Collection, tc.rule.Paths, tc.ok, err)
+		}
+	}
+}
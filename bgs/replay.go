@@ -0,0 +1,251 @@
+package bgs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bluesky-social/indigo/events"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// After an incident where consumers lost events, an admin can send a range
+// of past events again without the consumers rewinding their cursors: either
+// into a connected consumer's stream, interleaved with the live events, or
+// over a fresh connection opened with a replay ticket, which is closed once
+// the range has been sent. Replayed events keep their original sequence
+// numbers, so consumers that track their cursor as the last sequence seen
+// rather than the highest should take a fresh connection.
+
+const replayStreamPath = "/xrpc/_relay/replay"
+
+// how long a replay ticket can be used to open replay connections
+const replayTicketTTL = 24 * time.Hour
+
+var errConsumerGone = errors.New("consumer disconnected")
+
+// ConsumerReplay is the progress of a range of events being replayed to a
+// connected consumer
+type ConsumerReplay struct {
+	Since      int64      `json:"since"`
+	Until      int64      `json:"until"`
+	Sent       int64      `json:"sent"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+type replayTicket struct {
+	since, until int64
+	expires      time.Time
+}
+
+// checkReplayRange checks that (since, until] is a range of events the relay
+// has sequenced
+func (bgs *BGS) checkReplayRange(since, until int64) error {
+	if since < 0 {
+		return fmt.Errorf("since must not be negative")
+	}
+	if until <= since {
+		return fmt.Errorf("until must be greater than since")
+	}
+	if last := bgs.events.LastSeq(); until > last {
+		return fmt.Errorf("until (%d) is past the latest sequence number (%d)", until, last)
+	}
+	return nil
+}
+
+// replayToConsumer starts sending the events after since, up to and
+// including until, to a connected consumer. A consumer has one replay at a
+// time.
+func (bgs *BGS) replayToConsumer(id uint64, since, until int64) (*ConsumerReplay, error) {
+	bgs.consumersLk.RLock()
+	c, ok := bgs.consumers[id]
+	bgs.consumersLk.RUnlock()
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "consumer not found")
+	}
+	if c.replayCh == nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("consumers over %s can't take replays", c.Transport))
+	}
+
+	c.replayLk.Lock()
+	defer c.replayLk.Unlock()
+	if c.replay != nil && c.replay.FinishedAt == nil {
+		return nil, echo.NewHTTPError(http.StatusConflict, "consumer already has a replay running")
+	}
+	r := &ConsumerReplay{Since: since, Until: until, StartedAt: time.Now()}
+	c.replay = r
+
+	log.Infow("replaying events to consumer", "consumer_id", id, "remote_addr", c.RemoteAddr, "since", since, "until", until)
+
+	go func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-c.gone:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		err := bgs.events.Replay(ctx, since, until, func(evt *events.XRPCStreamEvent) error {
+			if c.filter != nil && !c.filter(evt) {
+				return nil
+			}
+			select {
+			case c.replayCh <- evt:
+				replayedEventsSent.Inc()
+				c.replayLk.Lock()
+				r.Sent++
+				c.replayLk.Unlock()
+				return nil
+			case <-c.gone:
+				return errConsumerGone
+			}
+		})
+
+		c.replayLk.Lock()
+		defer c.replayLk.Unlock()
+		now := time.Now()
+		r.FinishedAt = &now
+		if err != nil {
+			r.Error = err.Error()
+			log.Warnw("replay to consumer failed", "consumer_id", id, "sent", r.Sent, "err", err)
+			return
+		}
+		log.Infow("replay to consumer finished", "consumer_id", id, "sent", r.Sent)
+	}()
+
+	snap := *r
+	return &snap, nil
+}
+
+// replayStatus returns a copy of the consumer's latest replay, if any
+func (c *SocketConsumer) replayStatus() *ConsumerReplay {
+	c.replayLk.Lock()
+	defer c.replayLk.Unlock()
+	if c.replay == nil {
+		return nil
+	}
+	snap := *c.replay
+	return &snap
+}
+
+// newReplayTicket returns a ticket a consumer can open replay connections
+// for the range with
+func (bgs *BGS) newReplayTicket(since, until int64) (string, time.Time) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	ticket := hex.EncodeToString(b[:])
+	now := time.Now()
+	expires := now.Add(replayTicketTTL)
+
+	bgs.replayTicketsLk.Lock()
+	defer bgs.replayTicketsLk.Unlock()
+	for t, rt := range bgs.replayTickets {
+		if now.After(rt.expires) {
+			delete(bgs.replayTickets, t)
+		}
+	}
+	bgs.replayTickets[ticket] = replayTicket{since: since, until: until, expires: expires}
+	return ticket, expires
+}
+
+func (bgs *BGS) lookupReplayTicket(ticket string) (replayTicket, bool) {
+	bgs.replayTicketsLk.Lock()
+	defer bgs.replayTicketsLk.Unlock()
+	rt, ok := bgs.replayTickets[ticket]
+	if !ok || time.Now().After(rt.expires) {
+		return replayTicket{}, false
+	}
+	return rt, true
+}
+
+// handleReplayStream serves the range of events a replay ticket is for over
+// a websocket, in the same frames as subscribeRepos, then closes it
+func (bgs *BGS) handleReplayStream(c echo.Context) error {
+	rt, ok := bgs.lookupReplayTicket(c.QueryParam("ticket"))
+	if !ok {
+		return apiError(http.StatusForbidden, XRPCErrForbidden, "unknown or expired replay ticket")
+	}
+
+	version, err := events.NegotiateStreamVersion(c.QueryParam(events.StreamVersionParam))
+	if err != nil {
+		streamVersionRejected.Inc()
+		return apiError(http.StatusBadRequest, XRPCErrInvalidRequest, "%s", err)
+	}
+	fw := events.NewFrameWriter(version)
+	c.Response().Header().Set(events.StreamVersionHeader, strconv.Itoa(version))
+
+	conn, err := websocket.Upgrade(c.Response(), c.Request(), c.Response().Header(), 10<<10, 10<<10)
+	if err != nil {
+		return fmt.Errorf("upgrading websocket: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(c.Request().Context())
+	defer cancel()
+
+	// the client sends nothing, but reading notices it going away
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	consumer := &SocketConsumer{
+		RemoteAddr:    c.RealIP(),
+		UserAgent:     c.Request().UserAgent(),
+		ConnectedAt:   time.Now(),
+		Transport:     "replay",
+		StreamVersion: version,
+	}
+	sentCounter := eventsSentCounter.WithLabelValues(consumer.RemoteAddr, consumer.UserAgent)
+	consumer.EventsSent = sentCounter
+
+	consumerID := bgs.registerConsumer(consumer, nil)
+	defer bgs.cleanupConsumer(consumerID)
+
+	logger := ctxLog(ctx).With("consumer_id", consumerID, "remote_addr", consumer.RemoteAddr, "user_agent", consumer.UserAgent)
+	logger.Infow("new replay consumer", "since", rt.since, "until", rt.until, "stream_version", version)
+
+	err = bgs.events.Replay(ctx, rt.since, rt.until, func(evt *events.XRPCStreamEvent) error {
+		wc, err := conn.NextWriter(websocket.BinaryMessage)
+		if err != nil {
+			return err
+		}
+		if err := fw.WriteFrame(countingWriter{w: wc, n: &consumer.BytesSent}, evt); err != nil {
+			return err
+		}
+		if err := wc.Close(); err != nil {
+			return err
+		}
+		sentCounter.Inc()
+		replayedEventsSent.Inc()
+		return nil
+	})
+	if err != nil {
+		logger.Warnw("replay connection failed", "err", err)
+		return nil
+	}
+
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "replay complete")
+	if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(5*time.Second)); err != nil {
+		logger.Warnw("failed to close replay connection", "err", err)
+	}
+	return nil
+}
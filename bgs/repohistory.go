@@ -0,0 +1,107 @@
+package bgs
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/bluesky-social/indigo/events"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// publicRepoHistoryPath serves a repo's recent events to anyone, for account
+// holders and PDS operators debugging why events aren't propagating
+const publicRepoHistoryPath = "/xrpc/_relay/getRepoHistory"
+
+const (
+	defaultRepoHistoryLimit = 50
+	maxRepoHistoryLimit     = 500
+)
+
+// RepoHistoryResponse lists the latest events the relay persisted for a repo,
+// newest first
+type RepoHistoryResponse struct {
+	Did    string                    `json:"did"`
+	Events []events.RepoHistoryEntry `json:"events"`
+}
+
+func parseRepoHistoryLimit(v string) (int, bool) {
+	if v == "" {
+		return defaultRepoHistoryLimit, true
+	}
+	l, err := strconv.Atoi(v)
+	if err != nil || l < 1 || l > maxRepoHistoryLimit {
+		return 0, false
+	}
+	return l, true
+}
+
+func (bgs *BGS) handleAdminGetRepoHistory(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	did := e.QueryParam("did")
+	if did == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "must pass a did")
+	}
+	limit, ok := parseRepoHistoryLimit(e.QueryParam("limit"))
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxRepoHistoryLimit))
+	}
+
+	// admins see the history of repos that aren't served, too
+	u, err := bgs.lookupUserByDid(ctx, did)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "repo not found")
+		}
+		return err
+	}
+
+	hist, err := bgs.events.RepoHistory(ctx, u.ID, limit)
+	if err != nil {
+		if errors.Is(err, events.ErrNoRepoHistory) {
+			return echo.NewHTTPError(http.StatusNotImplemented, "the event persister doesn't index events by repo")
+		}
+		return err
+	}
+
+	return e.JSON(http.StatusOK, repoHistoryResponse(did, hist))
+}
+
+func (bgs *BGS) handleGetRepoHistory(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	did := e.QueryParam("did")
+	if did == "" {
+		return apiError(http.StatusBadRequest, XRPCErrInvalidRequest, "must pass a did")
+	}
+	limit, ok := parseRepoHistoryLimit(e.QueryParam("limit"))
+	if !ok {
+		return apiError(http.StatusBadRequest, XRPCErrInvalidRequest, "limit must be between 1 and %d", maxRepoHistoryLimit)
+	}
+
+	u, err := bgs.lookupRepo(ctx, did)
+	if err != nil {
+		return err
+	}
+
+	hist, err := bgs.events.RepoHistory(ctx, u.ID, limit)
+	if err != nil {
+		if errors.Is(err, events.ErrNoRepoHistory) {
+			return apiError(http.StatusNotImplemented, XRPCErrNotImplemented, "this relay doesn't keep repo history")
+		}
+		ctxLog(ctx).Errorw("failed to read repo history", "err", err, "did", did)
+		return apiError(http.StatusInternalServerError, XRPCErrInternal, "failed to read repo history")
+	}
+
+	return e.JSON(http.StatusOK, repoHistoryResponse(did, hist))
+}
+
+func repoHistoryResponse(did string, hist []events.RepoHistoryEntry) *RepoHistoryResponse {
+	if hist == nil {
+		hist = []events.RepoHistoryEntry{}
+	}
+	return &RepoHistoryResponse{Did: did, Events: hist}
+}
@@ -0,0 +1,127 @@
+package bgs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// RequestIDHeader is the header each API response carries the request's ID
+// in. A request that already has a well-formed ID in it, eg. from a proxy in
+// front of the relay or the client itself, keeps that ID.
+const RequestIDHeader = echo.HeaderXRequestID
+
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// RequestID returns the ID of the API request ctx belongs to, if any
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// ctxLog returns the package logger, tagged with the request's ID if ctx
+// belongs to an API request
+func ctxLog(ctx context.Context) *zap.SugaredLogger {
+	if id := RequestID(ctx); id != "" {
+		return log.With("request_id", id)
+	}
+	return &log.SugaredLogger
+}
+
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID checks an incoming ID is safe to repeat in logs and headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// responseStatus is the status a handler's response will have once any error
+// it returned has been handled
+func responseStatus(c echo.Context, err error) int {
+	status := c.Response().Status
+	if err != nil {
+		var httpError *echo.HTTPError
+		var apiErr *APIError
+		switch {
+		case errors.As(err, &httpError):
+			status = httpError.Code
+		case errors.As(err, &apiErr):
+			status = apiErr.Status
+		}
+		if status == 0 || status == http.StatusOK {
+			status = http.StatusInternalServerError
+		}
+	}
+	return status
+}
+
+// RequestIDMiddleware assigns each request an ID, returns it in the
+// RequestIDHeader response header, and starts a span for the request tagged
+// with it. The ID is carried in the request's context, so spans started by
+// handlers are children of the request's span, and ctxLog tags log lines with
+// it.
+func RequestIDMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+
+		id := req.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			// the access log reads the ID from the request
+			req.Header.Set(RequestIDHeader, id)
+		}
+		c.Response().Header().Set(RequestIDHeader, id)
+
+		ctx, span := tracer.Start(req.Context(), req.Method+" "+c.Path(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", req.Method),
+				attribute.String("http.route", c.Path()),
+				attribute.String("request_id", id),
+			),
+		)
+		defer span.End()
+
+		c.SetRequest(req.WithContext(context.WithValue(ctx, requestIDKey{}, id)))
+
+		err := next(c)
+
+		status := responseStatus(c, err)
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		if err != nil {
+			span.RecordError(err)
+		}
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+
+		return err
+	}
+}
@@ -0,0 +1,63 @@
+package bgs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+
+	"gorm.io/gorm"
+)
+
+// how long after resetting a repo further reset signals for it are ignored
+const repoResetCooldown = 10 * time.Minute
+
+// handleRepoReset deals with an upstream PDS rewriting a repo's history, as
+// signalled by a rebase or a rev going backwards. Our copy can no longer be
+// brought up to date by applying commits, so it's discarded and a fresh copy
+// fetched. The import of that copy goes out on the firehose flagged tooBig,
+// telling consumers to refetch the repo too.
+func (bgs *BGS) handleRepoReset(ctx context.Context, host *models.PDS, did string, reason string) error {
+	u, err := bgs.lookupUserByDid(ctx, did)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// nothing to reset
+			return nil
+		}
+		return fmt.Errorf("looking up reset repo: %w", err)
+	}
+
+	if u.PDS != host.ID {
+		log.Warnw("ignoring repo reset from non-authoritative pds", "repo", did, "expPds", u.PDS, "gotPds", host.Host)
+		return nil
+	}
+
+	if _, ok := bgs.recentResets.Get(did); ok {
+		log.Debugw("repo was reset recently, dropping event", "repo", did, "pdsHost", host.Host, "reason", reason)
+		return nil
+	}
+	bgs.recentResets.Add(did, struct{}{})
+
+	repoResets.WithLabelValues(reason).Inc()
+	log.Warnw("upstream repo was reset, refetching", "repo", did, "pdsHost", host.Host, "reason", reason)
+
+	return bgs.refetchRepo(ctx, u.ID, did)
+}
+
+// refetchRepo discards our copy of a repo and fetches it again from its PDS.
+// The import goes out on the firehose flagged tooBig.
+func (bgs *BGS) refetchRepo(ctx context.Context, uid models.Uid, did string) error {
+	if err := bgs.repoman.ResetRepo(ctx, uid); err != nil {
+		return fmt.Errorf("resetting repo: %w", err)
+	}
+	bgs.revCheck.Forget(did)
+
+	ai, err := bgs.Index.LookupUser(ctx, uid)
+	if err != nil {
+		return fmt.Errorf("failed to look up user (refetch): %w", err)
+	}
+
+	return bgs.Index.Crawler.Crawl(ctx, ai)
+}
@@ -0,0 +1,157 @@
+package bgs
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+)
+
+// Kinds of rev ordering violation. A duplicate is a commit the relay already
+// has, or another commit with the same rev as the last accepted one; an out
+// of order commit has a rev before the last accepted one, including repo
+// resets; a future dated commit has a rev too far ahead of the relay's clock.
+const (
+	RevViolationOutOfOrder = "out_of_order"
+	RevViolationDuplicate  = "duplicate"
+	RevViolationFuture     = "future"
+)
+
+// ErrRevViolation is returned by the rev stage for a commit whose rev breaks
+// the repo's ordering
+type ErrRevViolation struct {
+	Kind    string
+	Repo    string
+	Rev     string
+	LastRev string
+}
+
+func (e *ErrRevViolation) Error() string {
+	switch e.Kind {
+	case RevViolationFuture:
+		return fmt.Sprintf("rev %s is too far in the future", e.Rev)
+	case RevViolationDuplicate:
+		return fmt.Sprintf("rev %s is the same as the last accepted rev", e.Rev)
+	default:
+		return fmt.Sprintf("rev %s is not after the last accepted rev %s", e.Rev, e.LastRev)
+	}
+}
+
+// RevViolation is a commit that broke its repo's rev ordering
+type RevViolation struct {
+	Kind    string    `json:"kind"`
+	Repo    string    `json:"repo"`
+	Rev     string    `json:"rev"`
+	LastRev string    `json:"last_rev,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// HostRevOrderStats counts a host's commits, and the ones that broke rev
+// ordering, since the relay started
+type HostRevOrderStats struct {
+	Host       string `json:"host"`
+	Commits    int64  `json:"commits"`
+	OutOfOrder int64  `json:"out_of_order"`
+	Duplicate  int64  `json:"duplicate"`
+	Future     int64  `json:"future"`
+	// share of the host's commits that broke rev ordering
+	ViolationRate float64       `json:"violation_rate"`
+	Last          *RevViolation `json:"last_violation,omitempty"`
+}
+
+func (s *HostRevOrderStats) violations() int64 {
+	return s.OutOfOrder + s.Duplicate + s.Future
+}
+
+// revOrderStats tallies rev ordering violations per host, from the errors
+// the dedup and rev stages reject commits with, so operators can see which
+// upstreams misbehave and how often
+type revOrderStats struct {
+	since time.Time
+
+	lk    sync.Mutex
+	hosts map[uint]*HostRevOrderStats
+}
+
+func newRevOrderStats() *revOrderStats {
+	return &revOrderStats{
+		since: time.Now(),
+		hosts: make(map[uint]*HostRevOrderStats),
+	}
+}
+
+// observe records a commit from a host, and the error it was rejected with
+// by the ingest pipeline, if any
+func (rs *revOrderStats) observe(host *models.PDS, evt *IngestEvent, err error) {
+	commit := evt.Event.RepoCommit
+	if commit == nil {
+		return
+	}
+
+	v := &RevViolation{Repo: commit.Repo, Rev: commit.Rev}
+	var revErr *ErrRevViolation
+	var reset *ErrRepoReset
+	var dup *ErrDuplicateEvent
+	switch {
+	case err == nil:
+		v = nil
+	case errors.As(err, &revErr):
+		v.Kind, v.LastRev = revErr.Kind, revErr.LastRev
+	case errors.As(err, &reset):
+		v.Kind, v.LastRev = RevViolationOutOfOrder, reset.LastRev
+	case errors.As(err, &dup):
+		v.Kind = RevViolationDuplicate
+	default:
+		v = nil
+	}
+
+	rs.lk.Lock()
+	defer rs.lk.Unlock()
+
+	hs, ok := rs.hosts[host.ID]
+	if !ok {
+		hs = &HostRevOrderStats{Host: host.Host}
+		rs.hosts[host.ID] = hs
+	}
+	hs.Commits++
+	if v == nil {
+		return
+	}
+
+	switch v.Kind {
+	case RevViolationOutOfOrder:
+		hs.OutOfOrder++
+	case RevViolationDuplicate:
+		hs.Duplicate++
+	case RevViolationFuture:
+		hs.Future++
+	}
+	v.At = time.Now()
+	hs.Last = v
+	revViolations.WithLabelValues(host.Host, v.Kind).Inc()
+}
+
+// report returns every host's counts, optionally just the named host's
+func (rs *revOrderStats) report(host string) []HostRevOrderStats {
+	rs.lk.Lock()
+	defer rs.lk.Unlock()
+
+	out := make([]HostRevOrderStats, 0, len(rs.hosts))
+	for _, hs := range rs.hosts {
+		if host != "" && hs.Host != host {
+			continue
+		}
+		s := *hs
+		if s.Last != nil {
+			last := *s.Last
+			s.Last = &last
+		}
+		if s.Commits > 0 {
+			s.ViolationRate = float64(s.violations()) / float64(s.Commits)
+		}
+		out = append(out, s)
+	}
+	return out
+}
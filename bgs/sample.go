@@ -0,0 +1,62 @@
+package bgs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/bluesky-social/indigo/events"
+
+	"github.com/labstack/echo/v4"
+)
+
+const sampleFirehosePath = "/xrpc/_dev/sampleFirehose"
+
+// default fraction of repos included in a sampled firehose
+const defaultSampleRate = 0.01
+
+// handleSampleFirehose serves the firehose filtered down to a fraction of
+// repos, for developers load testing consumers. Repos are picked by a hash of
+// their DID, so the same rate and seed always give the same repos and each
+// sampled repo's full event history, keeping commit chains intact. Events
+// that aren't about a repo are always included.
+func (bgs *BGS) handleSampleFirehose(c echo.Context) error {
+	rate := defaultSampleRate
+	if v := c.QueryParam("rate"); v != "" {
+		r, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(r > 0 && r <= 1) {
+			return apiError(http.StatusBadRequest, XRPCErrInvalidRequest, "rate must be a number greater than 0 and at most 1")
+		}
+		rate = r
+	}
+	seed := c.QueryParam("seed")
+
+	c.Response().Header().Set("Firehose-Sample-Rate", strconv.FormatFloat(rate, 'f', -1, 64))
+
+	return bgs.serveEventStream(c, "websocket-sample", sampleFilter(rate, seed))
+}
+
+// sampleFilter keeps events for the given fraction of repos
+func sampleFilter(rate float64, seed string) func(*events.XRPCStreamEvent) bool {
+	// a repo is sampled if the top 64 bits of its hash fall below this
+	threshold := uint64(math.MaxUint64)
+	if rate < 1 {
+		threshold = uint64(rate * math.MaxUint64)
+	}
+
+	return func(evt *events.XRPCStreamEvent) bool {
+		did := evt.RepoDID()
+		if did == "" {
+			return true
+		}
+		return sampleHash(seed, did) <= threshold
+	}
+}
+
+func sampleHash(seed, did string) uint64 {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s:%s", seed, did)))
+	return binary.BigEndian.Uint64(h[:8])
+}
@@ -0,0 +1,388 @@
+package bgs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/repomgr"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+)
+
+// how many flagged commits the scoring stage keeps for /admin/ingest/flagged
+const maxFlaggedCommits = 500
+
+// What the scoring stage does with commits scoring above each threshold
+const (
+	ScoreActionTag   = "tag"
+	ScoreActionDelay = "delay"
+	ScoreActionDrop  = "drop"
+)
+
+// ScoredRecord is a record created or updated by a commit, as passed to a
+// ContentScorer
+type ScoredRecord struct {
+	Repo       string
+	Rev        string
+	Host       string
+	Collection string
+	Rkey       string
+	Action     string
+	Cid        cid.Cid
+	// The record's CBOR, as it appears in the commit's blocks
+	Record []byte
+}
+
+// ContentScorer scores records for how likely they are to be spam, or
+// anything else an operator wants to keep off the firehose. Higher scores
+// are worse; what they mean is up to the thresholds in ScoringOptions.
+type ContentScorer interface {
+	Score(ctx context.Context, rec *ScoredRecord) (float64, error)
+}
+
+type ScoringOptions struct {
+	Scorer ContentScorer
+	// Only records in these collections are scored; all if empty
+	Collections []string
+	// Commits whose highest scoring record scores above these are tagged,
+	// delayed or dropped from the firehose. Zero turns an action off; a
+	// commit above several thresholds gets the most severe action.
+	TagAbove   float64
+	DelayAbove float64
+	DropAbove  float64
+	// How long delayed commits are held before being processed
+	Delay time.Duration
+	// How long the scorer has for each record; records it fails to score in
+	// time are let through
+	Timeout time.Duration
+}
+
+func DefaultScoringOptions() *ScoringOptions {
+	return &ScoringOptions{
+		Delay:   30 * time.Second,
+		Timeout: 2 * time.Second,
+	}
+}
+
+// FlaggedCommit is a commit that scored above one of the thresholds
+type FlaggedCommit struct {
+	Repo string `json:"repo"`
+	Rev  string `json:"rev"`
+	Host string `json:"host"`
+	// The highest scoring record
+	Path   string    `json:"path"`
+	Score  float64   `json:"score"`
+	Action string    `json:"action"`
+	At     time.Time `json:"at"`
+}
+
+// scoringStage scores the records in commits with a ContentScorer. Commits
+// are applied to their repos whatever they score, so that later commits still
+// follow on from them; what's affected is whether and when they go out on
+// the firehose:
+//
+//   - tag: the commit goes out as usual, and is listed as flagged
+//   - delay: the commit is held for the delay first, which also holds up
+//     the repo's later events
+//   - drop: the commit is kept off the firehose by event middleware
+type scoringStage struct {
+	opts        ScoringOptions
+	collections map[string]bool
+
+	// commits to keep off the firehose, by repo and rev
+	dropped *expirable.LRU[string, struct{}]
+
+	lk      sync.Mutex
+	flagged []FlaggedCommit
+}
+
+func newScoringStage(opts *ScoringOptions) (*scoringStage, error) {
+	if opts.Scorer == nil {
+		return nil, fmt.Errorf("content scoring needs a scorer")
+	}
+	if opts.TagAbove < 0 || opts.DelayAbove < 0 || opts.DropAbove < 0 {
+		return nil, fmt.Errorf("score thresholds can't be negative")
+	}
+	if opts.DelayAbove > 0 && opts.Delay <= 0 {
+		return nil, fmt.Errorf("delaying commits needs a delay")
+	}
+	if opts.Timeout <= 0 {
+		return nil, fmt.Errorf("content scoring timeout must be positive")
+	}
+
+	s := &scoringStage{
+		opts:    *opts,
+		dropped: expirable.NewLRU[string, struct{}](100_000, nil, time.Hour),
+	}
+	if len(opts.Collections) > 0 {
+		s.collections = make(map[string]bool, len(opts.Collections))
+		for _, col := range opts.Collections {
+			s.collections[col] = true
+		}
+	}
+	return s, nil
+}
+
+func (s *scoringStage) Name() string { return IngestStageScoring }
+
+func (s *scoringStage) Check(ctx context.Context, evt *IngestEvent) error {
+	commit := evt.Event.RepoCommit
+	if commit == nil {
+		return nil
+	}
+
+	var top float64
+	var topPath string
+	for _, op := range commit.Ops {
+		switch repomgr.EventKind(op.Action) {
+		case repomgr.EvtKindCreateRecord, repomgr.EvtKindUpdateRecord:
+		default:
+			continue
+		}
+		col, rkey, _ := strings.Cut(op.Path, "/")
+		if s.collections != nil && !s.collections[col] {
+			continue
+		}
+		if op.Cid == nil {
+			continue
+		}
+
+		blocks, err := evt.Blocks()
+		if err != nil {
+			return err
+		}
+		c := cid.Cid(*op.Cid)
+		blk, ok := blocks[c]
+		if !ok {
+			continue
+		}
+
+		score, err := s.score(ctx, &ScoredRecord{
+			Repo:       commit.Repo,
+			Rev:        commit.Rev,
+			Host:       evt.Host.Host,
+			Collection: col,
+			Rkey:       rkey,
+			Action:     op.Action,
+			Cid:        c,
+			Record:     blk,
+		})
+		if err != nil {
+			log.Warnw("failed to score record, letting it through", "repo", commit.Repo, "path", op.Path, "err", err)
+			contentScoringErrors.Inc()
+			continue
+		}
+		contentScores.Observe(score)
+		if topPath == "" || score > top {
+			top, topPath = score, op.Path
+		}
+	}
+	if topPath == "" {
+		return nil
+	}
+
+	var action string
+	switch {
+	case s.opts.DropAbove > 0 && top > s.opts.DropAbove:
+		action = ScoreActionDrop
+		s.dropped.Add(commit.Repo+"@"+commit.Rev, struct{}{})
+	case s.opts.DelayAbove > 0 && top > s.opts.DelayAbove:
+		action = ScoreActionDelay
+	case s.opts.TagAbove > 0 && top > s.opts.TagAbove:
+		action = ScoreActionTag
+	default:
+		return nil
+	}
+
+	scoredCommits.WithLabelValues(action).Inc()
+	log.Infow("flagged commit by content score", "repo", commit.Repo, "rev", commit.Rev, "path", topPath, "score", top, "action", action)
+	s.flag(FlaggedCommit{
+		Repo:   commit.Repo,
+		Rev:    commit.Rev,
+		Host:   evt.Host.Host,
+		Path:   topPath,
+		Score:  top,
+		Action: action,
+		At:     time.Now(),
+	})
+
+	if action == ScoreActionDelay {
+		t := time.NewTimer(s.opts.Delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (s *scoringStage) score(ctx context.Context, rec *ScoredRecord) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.opts.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	defer func() {
+		contentScoringDuration.Observe(time.Since(start).Seconds())
+	}()
+	return s.opts.Scorer.Score(ctx, rec)
+}
+
+// Rejected forgets a commit that was to be dropped if a later stage rejects
+// it, so a copy from another host isn't dropped without being scored
+func (s *scoringStage) Rejected(evt *IngestEvent) {
+	if commit := evt.Event.RepoCommit; commit != nil {
+		s.dropped.Remove(commit.Repo + "@" + commit.Rev)
+	}
+}
+
+func (s *scoringStage) flag(fc FlaggedCommit) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.flagged = append(s.flagged, fc)
+	if len(s.flagged) > maxFlaggedCommits {
+		s.flagged = s.flagged[len(s.flagged)-maxFlaggedCommits:]
+	}
+}
+
+// Flagged returns up to limit of the latest flagged commits, newest first
+func (s *scoringStage) Flagged(limit int) []FlaggedCommit {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	out := make([]FlaggedCommit, 0, min(limit, len(s.flagged)))
+	for i := len(s.flagged) - 1; i >= 0 && len(out) < limit; i-- {
+		out = append(out, s.flagged[i])
+	}
+	return out
+}
+
+// middleware keeps commits that scored above the drop threshold off the
+// firehose
+func (s *scoringStage) middleware(ctx context.Context, evt *events.XRPCStreamEvent) (*events.XRPCStreamEvent, error) {
+	if evt.RepoCommit == nil {
+		return evt, nil
+	}
+	key := evt.RepoCommit.Repo + "@" + evt.RepoCommit.Rev
+	if _, ok := s.dropped.Peek(key); !ok {
+		return evt, nil
+	}
+	s.dropped.Remove(key)
+	return nil, nil
+}
+
+// HTTPScorer is a ContentScorer that asks an external service to score each
+// record. It POSTs
+//
+//	{"repo", "rev", "host", "collection", "rkey", "action", "cid", "record"}
+//
+// with the record as JSON, and expects {"score": 0.5} back.
+type HTTPScorer struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTPScorer(url string) (*HTTPScorer, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("scoring service %q must be an http(s) URL", url)
+	}
+	return &HTTPScorer{
+		url:    url,
+		client: &http.Client{},
+	}, nil
+}
+
+type httpScoreRequest struct {
+	Repo       string          `json:"repo"`
+	Rev        string          `json:"rev"`
+	Host       string          `json:"host"`
+	Collection string          `json:"collection"`
+	Rkey       string          `json:"rkey"`
+	Action     string          `json:"action"`
+	Cid        string          `json:"cid"`
+	Record     json.RawMessage `json:"record"`
+}
+
+type httpScoreResponse struct {
+	Score *float64 `json:"score"`
+}
+
+func (hs *HTTPScorer) Score(ctx context.Context, rec *ScoredRecord) (float64, error) {
+	obj, err := data.UnmarshalCBOR(rec.Record)
+	if err != nil {
+		return 0, fmt.Errorf("decoding record: %w", err)
+	}
+	recJSON, err := json.Marshal(obj)
+	if err != nil {
+		return 0, fmt.Errorf("encoding record: %w", err)
+	}
+
+	b, err := json.Marshal(httpScoreRequest{
+		Repo:       rec.Repo,
+		Rev:        rec.Rev,
+		Host:       rec.Host,
+		Collection: rec.Collection,
+		Rkey:       rec.Rkey,
+		Action:     rec.Action,
+		Cid:        rec.Cid.String(),
+		Record:     recJSON,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", hs.url, bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "indigo-relay")
+
+	resp, err := hs.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("scoring service returned status %d", resp.StatusCode)
+	}
+
+	var out httpScoreResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return 0, fmt.Errorf("decoding scoring service response: %w", err)
+	}
+	if out.Score == nil {
+		return 0, fmt.Errorf("scoring service response has no score")
+	}
+	return *out.Score, nil
+}
+
+type flaggedCommitsResponse struct {
+	Commits []FlaggedCommit `json:"commits"`
+}
+
+func (bgs *BGS) handleAdminListFlaggedCommits(e echo.Context) error {
+	limit := 100
+	if v := e.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > maxFlaggedCommits {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxFlaggedCommits))
+		}
+		limit = l
+	}
+
+	return e.JSON(http.StatusOK, flaggedCommitsResponse{Commits: bgs.scoring.Flagged(limit)})
+}
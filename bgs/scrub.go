@@ -0,0 +1,225 @@
+package bgs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/carstore"
+	"github.com/bluesky-social/indigo/models"
+
+	"github.com/labstack/echo/v4"
+)
+
+// how many corrupt shards the scrub report keeps, newest first
+const maxScrubFindings = 200
+
+type ScrubOptions struct {
+	// How often a batch of shards is checked
+	Interval time.Duration
+	// How many shards each batch checks
+	BatchSize int
+	// Whether repos with corrupt shards are discarded and fetched again from
+	// their PDS
+	Refetch bool
+}
+
+func DefaultScrubOptions() *ScrubOptions {
+	return &ScrubOptions{
+		Interval:  10 * time.Second,
+		BatchSize: 100,
+	}
+}
+
+// ScrubFinding is a corrupt shard found by the scrubber
+type ScrubFinding struct {
+	carstore.ShardScrubResult
+	Did     string    `json:"did"`
+	FoundAt time.Time `json:"found_at"`
+	// Whether the repo was refetched, and why that failed if it did
+	Refetched    bool   `json:"refetched"`
+	RefetchError string `json:"refetch_error,omitempty"`
+}
+
+// ScrubReport is what /admin/storage/scrub reports
+type ScrubReport struct {
+	Enabled bool `json:"enabled"`
+	Refetch bool `json:"refetch"`
+	// The ID of the last shard checked; the next batch starts after it
+	Cursor uint `json:"cursor"`
+	// Since startup
+	ShardsChecked int64          `json:"shards_checked"`
+	CorruptShards int64          `json:"corrupt_shards"`
+	Walks         int64          `json:"walks"`
+	LastBatch     *time.Time     `json:"last_batch,omitempty"`
+	Findings      []ScrubFinding `json:"findings"`
+}
+
+// Scrubber walks every shard in the carstore a batch at a time, checking
+// that blocks still hash to their CIDs and agree with the carstore's
+// metadata, so that disk corruption is noticed before a consumer fetches the
+// repo. Once it reaches the last shard it starts over. Corrupt shards are
+// counted in carstore_scrub_problems_total, listed in the scrub report, and
+// optionally cause their repo to be refetched.
+type Scrubber struct {
+	opts ScrubOptions
+
+	lk       sync.Mutex
+	cursor   uint
+	checked  int64
+	corrupt  int64
+	walks    int64
+	last     time.Time
+	findings []ScrubFinding
+
+	exit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewScrubber(opts *ScrubOptions) (*Scrubber, error) {
+	var o ScrubOptions
+	if opts != nil {
+		o = *opts
+		if o.Interval <= 0 || o.BatchSize <= 0 {
+			return nil, fmt.Errorf("scrub interval and batch size must be positive")
+		}
+	}
+
+	return &Scrubber{
+		opts: o,
+		exit: make(chan struct{}),
+	}, nil
+}
+
+func (sc *Scrubber) enabled() bool {
+	return sc.opts.Interval > 0
+}
+
+// Start starts the scrubbing routine, if enabled
+func (sc *Scrubber) Start(bgs *BGS) {
+	if !sc.enabled() {
+		return
+	}
+
+	log.Infow("starting carstore scrubber", "interval", sc.opts.Interval, "batch", sc.opts.BatchSize, "refetch", sc.opts.Refetch)
+
+	sc.wg.Add(1)
+	go func() {
+		defer sc.wg.Done()
+
+		t := time.NewTicker(sc.opts.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-sc.exit:
+				return
+			case <-t.C:
+			}
+
+			if _, err := sc.RunBatch(context.Background(), bgs); err != nil {
+				log.Errorw("carstore scrub failed", "err", err)
+			}
+		}
+	}()
+}
+
+func (sc *Scrubber) Shutdown() {
+	close(sc.exit)
+	sc.wg.Wait()
+}
+
+// RunBatch checks the next batch of shards, returning the corrupt ones
+func (sc *Scrubber) RunBatch(ctx context.Context, bgs *BGS) ([]ScrubFinding, error) {
+	sc.lk.Lock()
+	after := sc.cursor
+	sc.lk.Unlock()
+
+	results, err := bgs.repoman.CarStore().ScrubShards(ctx, after, sc.opts.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []ScrubFinding
+	refetched := make(map[models.Uid]error)
+	for _, res := range results {
+		if !res.Corrupt() {
+			continue
+		}
+
+		f := ScrubFinding{ShardScrubResult: res, FoundAt: time.Now()}
+		var u User
+		if err := bgs.db.WithContext(ctx).Where("id = ?", res.Usr).Limit(1).Find(&u).Error; err != nil {
+			return nil, err
+		}
+		f.Did = u.Did
+		log.Errorw("found corrupt carstore shard", "shard", res.Shard, "did", u.Did, "path", res.Path, "problems", res.Problems)
+
+		if sc.opts.Refetch && u.ID != 0 {
+			// a repo with several corrupt shards is only refetched once
+			err, done := refetched[u.ID]
+			if !done {
+				err = bgs.refetchRepo(ctx, u.ID, u.Did)
+				refetched[u.ID] = err
+				outcome := "ok"
+				if err != nil {
+					outcome = "failed"
+					log.Errorw("failed to refetch repo with corrupt shard", "did", u.Did, "err", err)
+				}
+				scrubRefetches.WithLabelValues(outcome).Inc()
+			}
+			f.Refetched = err == nil
+			if err != nil {
+				f.RefetchError = err.Error()
+			}
+		}
+		found = append(found, f)
+	}
+
+	sc.lk.Lock()
+	defer sc.lk.Unlock()
+
+	if len(results) < sc.opts.BatchSize {
+		// reached the end, start over
+		sc.cursor = 0
+		sc.walks++
+	} else {
+		sc.cursor = results[len(results)-1].Shard
+	}
+	sc.checked += int64(len(results))
+	sc.corrupt += int64(len(found))
+	sc.last = time.Now()
+	for _, f := range found {
+		sc.findings = append([]ScrubFinding{f}, sc.findings...)
+	}
+	if len(sc.findings) > maxScrubFindings {
+		sc.findings = sc.findings[:maxScrubFindings]
+	}
+
+	return found, nil
+}
+
+func (sc *Scrubber) Report() *ScrubReport {
+	sc.lk.Lock()
+	defer sc.lk.Unlock()
+
+	rep := &ScrubReport{
+		Enabled:       sc.enabled(),
+		Refetch:       sc.opts.Refetch,
+		Cursor:        sc.cursor,
+		ShardsChecked: sc.checked,
+		CorruptShards: sc.corrupt,
+		Walks:         sc.walks,
+		Findings:      append([]ScrubFinding{}, sc.findings...),
+	}
+	if !sc.last.IsZero() {
+		last := sc.last
+		rep.LastBatch = &last
+	}
+	return rep
+}
+
+func (bgs *BGS) handleAdminGetScrubReport(e echo.Context) error {
+	return e.JSON(http.StatusOK, bgs.scrubber.Report())
+}
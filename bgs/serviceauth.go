@@ -0,0 +1,182 @@
+package bgs
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+)
+
+// ServiceAuthConfig allows admin requests to authenticate with atproto
+// service-auth JWTs, as issued by com.atproto.server.getServiceAuth, instead of
+// a static admin token. Tokens must be issued by one of AdminDIDs, for the
+// relay's own DID, and be short-lived.
+type ServiceAuthConfig struct {
+	// the relay's service DID, which tokens must name as their audience
+	Audience string
+	// accounts whose tokens are accepted
+	AdminDIDs []string
+	// tokens valid for longer than this are rejected, however they're signed
+	MaxLifetime time.Duration
+	// resolves the issuer's signing key; defaults to identity.DefaultDirectory
+	Directory identity.Directory
+}
+
+// allowed clock skew when checking iat and exp
+const serviceAuthLeeway = 30 * time.Second
+
+// an issuer's DID is purged and re-resolved after a bad signature at most this
+// often, so forged tokens can't force a lookup per request
+const serviceAuthPurgeCooldown = time.Minute
+
+type serviceAuthHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+type serviceAuthClaims struct {
+	Iss string `json:"iss"`
+	Aud string `json:"aud"`
+	Exp int64  `json:"exp"`
+	Iat int64  `json:"iat"`
+	Lxm string `json:"lxm"`
+}
+
+type serviceAuthVerifier struct {
+	conf ServiceAuthConfig
+	// XRPC method tokens may be bound to; if empty, tokens must not be bound
+	// to any
+	method string
+	// issuers recently purged after a bad signature
+	purged *expirable.LRU[string, struct{}]
+}
+
+func newServiceAuthVerifier(conf *ServiceAuthConfig) (*serviceAuthVerifier, error) {
+	if conf.Audience == "" {
+		return nil, fmt.Errorf("service auth requires the relay's DID as audience")
+	}
+	if len(conf.AdminDIDs) == 0 {
+		return nil, fmt.Errorf("service auth requires at least one admin DID")
+	}
+	v := &serviceAuthVerifier{
+		conf:   *conf,
+		purged: expirable.NewLRU[string, struct{}](1_000, nil, serviceAuthPurgeCooldown),
+	}
+	if v.conf.MaxLifetime == 0 {
+		v.conf.MaxLifetime = time.Hour
+	}
+	if v.conf.Directory == nil {
+		v.conf.Directory = identity.DefaultDirectory()
+	}
+	return v, nil
+}
+
+// looksLikeJWT distinguishes service-auth tokens from static admin tokens
+func looksLikeJWT(tok string) bool {
+	return strings.Count(tok, ".") == 2
+}
+
+// Verify checks a service-auth token and returns its issuer
+func (v *serviceAuthVerifier) Verify(ctx context.Context, tok string) (syntax.DID, error) {
+	parts := strings.Split(tok, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed token")
+	}
+
+	var hdr serviceAuthHeader
+	if err := decodeJWTSegment(parts[0], &hdr); err != nil {
+		return "", fmt.Errorf("token header: %w", err)
+	}
+	if hdr.Alg != "ES256K" && hdr.Alg != "ES256" {
+		return "", fmt.Errorf("unsupported token algorithm %q", hdr.Alg)
+	}
+
+	var claims serviceAuthClaims
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("token claims: %w", err)
+	}
+
+	now := time.Now()
+	switch {
+	case claims.Aud != v.conf.Audience:
+		return "", fmt.Errorf("token audience %q is not this relay", claims.Aud)
+	case claims.Exp == 0 || now.After(time.Unix(claims.Exp, 0).Add(serviceAuthLeeway)):
+		return "", fmt.Errorf("token expired")
+	case claims.Iat != 0 && time.Unix(claims.Iat, 0).After(now.Add(serviceAuthLeeway)):
+		return "", fmt.Errorf("token issued in the future")
+	case time.Until(time.Unix(claims.Exp, 0)) > v.conf.MaxLifetime+serviceAuthLeeway:
+		return "", fmt.Errorf("token lifetime exceeds %s", v.conf.MaxLifetime)
+	case claims.Lxm != "" && claims.Lxm != v.method:
+		// admin routes aren't XRPC methods, so a token bound to a method was
+		// minted for something else
+		return "", fmt.Errorf("token is bound to method %q", claims.Lxm)
+	}
+
+	// the issuer may name a service within the DID document; only the
+	// account's own key is accepted
+	issuer, _, _ := strings.Cut(claims.Iss, "#")
+	did, err := syntax.ParseDID(issuer)
+	if err != nil {
+		return "", fmt.Errorf("token issuer: %w", err)
+	}
+	if !slices.Contains(v.conf.AdminDIDs, did.String()) {
+		return "", fmt.Errorf("token issuer %s is not allowed", did)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("token signature: %w", err)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	if err := v.checkSignature(ctx, did, signed, sig); err != nil {
+		// the key may have been rotated since it was cached
+		if v.purged.Contains(did.String()) {
+			return "", err
+		}
+		v.purged.Add(did.String(), struct{}{})
+		if err := v.conf.Directory.Purge(ctx, did.AtIdentifier()); err != nil {
+			return "", err
+		}
+		if err := v.checkSignature(ctx, did, signed, sig); err != nil {
+			return "", err
+		}
+	}
+	return did, nil
+}
+
+func (v *serviceAuthVerifier) checkSignature(ctx context.Context, did syntax.DID, signed, sig []byte) error {
+	ident, err := v.conf.Directory.LookupDID(ctx, did)
+	if err != nil {
+		return fmt.Errorf("resolving token issuer: %w", err)
+	}
+	pub, err := ident.PublicKey()
+	if err != nil {
+		return fmt.Errorf("token issuer signing key: %w", err)
+	}
+	if err := pub.HashAndVerifyLenient(signed, sig); err != nil {
+		if errors.Is(err, crypto.ErrInvalidSignature) {
+			return fmt.Errorf("invalid token signature")
+		}
+		return err
+	}
+	return nil
+}
+
+func decodeJWTSegment(seg string, out any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
@@ -0,0 +1,182 @@
+package bgs
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+const testAdminDID = "did:plc:admin"
+
+// rotatingDirectory serves a cached key until purged, and the current one
+// after
+type rotatingDirectory struct {
+	identity.Directory
+	cached  crypto.PublicKey
+	current crypto.PublicKey
+	purges  int
+}
+
+func (d *rotatingDirectory) LookupDID(ctx context.Context, did syntax.DID) (*identity.Identity, error) {
+	pub := d.cached
+	if pub == nil {
+		pub = d.current
+	}
+	return &identity.Identity{
+		DID: did,
+		Keys: map[string]identity.Key{
+			"atproto": {Type: "Multikey", PublicKeyMultibase: pub.Multibase()},
+		},
+	}, nil
+}
+
+func (d *rotatingDirectory) Purge(ctx context.Context, a syntax.AtIdentifier) error {
+	d.purges++
+	d.cached = nil
+	return nil
+}
+
+func signServiceAuth(t *testing.T, priv crypto.PrivateKey, alg string, claims map[string]any) string {
+	t.Helper()
+	enc := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(map[string]string{"alg": alg, "typ": "JWT"}) + "." + enc(claims)
+	sig, err := priv.HashAndSign([]byte(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newTestKey(t *testing.T) (crypto.PrivateKey, crypto.PublicKey) {
+	t.Helper()
+	priv, err := crypto.GeneratePrivateKeyK256()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := priv.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, pub
+}
+
+func TestServiceAuthVerify(t *testing.T) {
+	ctx := context.Background()
+	priv, pub := newTestKey(t)
+	other, _ := newTestKey(t)
+
+	v, err := newServiceAuthVerifier(&ServiceAuthConfig{
+		Audience:    "did:web:relay.example.com",
+		AdminDIDs:   []string{testAdminDID},
+		MaxLifetime: 5 * time.Minute,
+		Directory:   &rotatingDirectory{current: pub},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	claims := func(mod func(map[string]any)) map[string]any {
+		c := map[string]any{
+			"iss": testAdminDID,
+			"aud": "did:web:relay.example.com",
+			"iat": now.Unix(),
+			"exp": now.Add(time.Minute).Unix(),
+		}
+		if mod != nil {
+			mod(c)
+		}
+		return c
+	}
+
+	for _, tc := range []struct {
+		name   string
+		tok    string
+		reject string
+	}{
+		{"valid", signServiceAuth(t, priv, "ES256K", claims(nil)), ""},
+		{"issuer service", signServiceAuth(t, priv, "ES256K", claims(func(c map[string]any) { c["iss"] = testAdminDID + "#atproto_labeler" })), ""},
+		{"malformed", "abc.def", "malformed token"},
+		{"alg none", signServiceAuth(t, priv, "none", claims(nil)), "unsupported token algorithm"},
+		{"alg HS256", signServiceAuth(t, priv, "HS256", claims(nil)), "unsupported token algorithm"},
+		{"wrong audience", signServiceAuth(t, priv, "ES256K", claims(func(c map[string]any) { c["aud"] = "did:web:other.example.com" })), "audience"},
+		{"no exp", signServiceAuth(t, priv, "ES256K", claims(func(c map[string]any) { delete(c, "exp") })), "expired"},
+		{"expired", signServiceAuth(t, priv, "ES256K", claims(func(c map[string]any) { c["exp"] = now.Add(-time.Minute).Unix() })), "expired"},
+		{"expired within leeway", signServiceAuth(t, priv, "ES256K", claims(func(c map[string]any) { c["exp"] = now.Add(-10 * time.Second).Unix() })), ""},
+		{"issued in the future", signServiceAuth(t, priv, "ES256K", claims(func(c map[string]any) { c["iat"] = now.Add(time.Minute).Unix() })), "issued in the future"},
+		{"lifetime too long", signServiceAuth(t, priv, "ES256K", claims(func(c map[string]any) { c["exp"] = now.Add(time.Hour).Unix() })), "lifetime exceeds"},
+		{"bound to method", signServiceAuth(t, priv, "ES256K", claims(func(c map[string]any) { c["lxm"] = "com.atproto.sync.getRepo" })), "bound to method"},
+		{"issuer not allowed", signServiceAuth(t, priv, "ES256K", claims(func(c map[string]any) { c["iss"] = "did:plc:someone" })), "not allowed"},
+		{"bad issuer", signServiceAuth(t, priv, "ES256K", claims(func(c map[string]any) { c["iss"] = "admin" })), "token issuer"},
+		{"wrong key", signServiceAuth(t, other, "ES256K", claims(nil)), "invalid token signature"},
+	} {
+		did, err := v.Verify(ctx, tc.tok)
+		switch {
+		case tc.reject == "" && err != nil:
+			t.Errorf("%s: expected token accepted, got %v", tc.name, err)
+		case tc.reject == "" && did != testAdminDID:
+			t.Errorf("%s: expected issuer %s, got %s", tc.name, testAdminDID, did)
+		case tc.reject != "" && err == nil:
+			t.Errorf("%s: expected token rejected", tc.name)
+		case tc.reject != "" && !strings.Contains(err.Error(), tc.reject):
+			t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.reject, err)
+		}
+	}
+}
+
+func TestServiceAuthKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	_, oldPub := newTestKey(t)
+	priv, pub := newTestKey(t)
+	forger, _ := newTestKey(t)
+
+	dir := &rotatingDirectory{cached: oldPub, current: pub}
+	v, err := newServiceAuthVerifier(&ServiceAuthConfig{
+		Audience:  "did:web:relay.example.com",
+		AdminDIDs: []string{testAdminDID},
+		Directory: dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	claims := map[string]any{
+		"iss": testAdminDID,
+		"aud": "did:web:relay.example.com",
+		"iat": now.Unix(),
+		"exp": now.Add(time.Minute).Unix(),
+	}
+
+	// signed with the rotated key, which is only found once the cached
+	// identity is purged
+	if _, err := v.Verify(ctx, signServiceAuth(t, priv, "ES256K", claims)); err != nil {
+		t.Fatalf("expected token signed with the rotated key accepted, got %v", err)
+	}
+	if dir.purges != 1 {
+		t.Fatalf("expected one purge, got %d", dir.purges)
+	}
+
+	// forged tokens don't purge the issuer again until the cooldown passes
+	for i := 0; i < 5; i++ {
+		if _, err := v.Verify(ctx, signServiceAuth(t, forger, "ES256K", claims)); err == nil {
+			t.Fatal("expected forged token rejected")
+		}
+	}
+	if dir.purges != 1 {
+		t.Fatalf("expected purges debounced, got %d", dir.purges)
+	}
+}
@@ -0,0 +1,169 @@
+package bgs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ShutdownPhase is the outcome of one step of an orderly shutdown
+type ShutdownPhase struct {
+	Name     string
+	Duration time.Duration
+	// set if the phase was abandoned after the phase timeout; whatever it
+	// was doing may still be running
+	TimedOut bool
+	Errors   []error
+}
+
+// ShutdownReport describes how an orderly shutdown went
+type ShutdownReport struct {
+	Phases []ShutdownPhase
+	// Events accepted by the event persister that hadn't been written out
+	// when it stopped; they are lost, and consumers never saw them
+	UnflushedEvents int
+}
+
+// Errors returns the errors from every phase
+func (r *ShutdownReport) Errors() []error {
+	var errs []error
+	for _, p := range r.Phases {
+		errs = append(errs, p.Errors...)
+	}
+	return errs
+}
+
+// Shutdown stops the relay's components in dependency order, so that work
+// accepted by one stage is drained by the stages after it:
+//
+//   - listeners: stop serving the API and HTTP/3 event stream
+//   - slurper: disconnect from PDSs and handle the events already received
+//   - indexer: drain the queued record ops
+//   - workers: stop compaction, handle re-verification, storage accounting,
+//     tier promotion, growth monitoring, host stats history, public stats
+//     sampling, the deactivated repo sweeper, the carstore scrubber, the
+//     collection registry, the defederation policy, alerting and gossip, and
+//     close the admin audit log
+//   - events: flush the event persister, and save the PDS cursors of the
+//     events it acknowledges
+//   - carstore: flush buffered repo writes
+//   - database: close the relay database
+//
+// Each phase gets up to phaseTimeout (zero waits indefinitely) before it is
+// abandoned and shutdown moves on to the next.
+func (bgs *BGS) Shutdown(phaseTimeout time.Duration) *ShutdownReport {
+	report := &ShutdownReport{}
+
+	run := func(name string, fn func(ctx context.Context) []error) {
+		ctx := context.Background()
+		if phaseTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, phaseTimeout)
+			defer cancel()
+		}
+
+		log.Infow("shutdown phase starting", "phase", name)
+		start := time.Now()
+
+		done := make(chan []error, 1)
+		go func() {
+			done <- fn(ctx)
+		}()
+
+		phase := ShutdownPhase{Name: name}
+		select {
+		case phase.Errors = <-done:
+		case <-ctx.Done():
+			phase.TimedOut = true
+			phase.Errors = []error{fmt.Errorf("shutdown phase %s timed out after %s", name, phaseTimeout)}
+		}
+		phase.Duration = time.Since(start)
+
+		for _, err := range phase.Errors {
+			log.Errorw("shutdown phase error", "phase", name, "err", err)
+		}
+		log.Infow("shutdown phase complete", "phase", name, "duration", phase.Duration, "timedOut", phase.TimedOut)
+		report.Phases = append(report.Phases, phase)
+	}
+
+	run("listeners", func(ctx context.Context) []error {
+		var errs []error
+		if srv := bgs.apiServer(); srv != nil {
+			if err := srv.Shutdown(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("api server: %w", err))
+			}
+		}
+		if bgs.h3srv != nil {
+			if err := bgs.h3srv.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("http3 server: %w", err))
+			}
+		}
+		return errs
+	})
+
+	run("slurper", bgs.slurper.Shutdown)
+
+	run("indexer", func(ctx context.Context) []error {
+		bgs.Index.Shutdown()
+		return nil
+	})
+
+	run("workers", func(ctx context.Context) []error {
+		bgs.compactor.Shutdown()
+		bgs.handleVerifier.Shutdown()
+		bgs.storage.Shutdown()
+		bgs.tiers.Shutdown()
+		bgs.growth.Shutdown()
+		bgs.hostStats.Shutdown()
+		bgs.publicStats.Shutdown()
+		bgs.deactivated.Shutdown()
+		bgs.scrubber.Shutdown()
+		bgs.collRegistry.Shutdown()
+		bgs.policy.Shutdown()
+		bgs.alerts.Shutdown()
+		bgs.gossip.Shutdown()
+		if err := bgs.adminLog.Shutdown(); err != nil {
+			return []error{fmt.Errorf("admin audit log: %w", err)}
+		}
+		return nil
+	})
+
+	run("events", func(ctx context.Context) []error {
+		if err := bgs.events.Shutdown(ctx); err != nil {
+			return []error{err}
+		}
+		// the final flush acknowledged the last events from the PDSs
+		return bgs.slurper.SaveCursors(ctx)
+	})
+	report.UnflushedEvents = bgs.events.Unflushed()
+	if report.UnflushedEvents > 0 {
+		log.Errorw("event persister stopped with unflushed events", "count", report.UnflushedEvents)
+	}
+
+	run("carstore", func(ctx context.Context) []error {
+		if err := bgs.repoman.CarStore().Shutdown(ctx); err != nil {
+			return []error{err}
+		}
+		return nil
+	})
+
+	run("database", func(ctx context.Context) []error {
+		sqldb, err := bgs.db.DB()
+		if err != nil {
+			return []error{err}
+		}
+		if err := sqldb.Close(); err != nil {
+			return []error{err}
+		}
+		return nil
+	})
+
+	return report
+}
+
+func (bgs *BGS) apiServer() *http.Server {
+	bgs.srvLk.Lock()
+	defer bgs.srvLk.Unlock()
+	return bgs.srv
+}
@@ -0,0 +1,131 @@
+package bgs
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/util"
+
+	"golang.org/x/time/rate"
+)
+
+// SpideringOptions controls which hosts are admitted when the relay discovers
+// them by spidering: following references in records to accounts on hosts
+// it hasn't seen before
+type SpideringOptions struct {
+	// Most newly discovered hosts admitted per hour; zero for no limit
+	MaxNewHostsPerHour int
+	// Only admit hosts that answer com.atproto.server.describeServer with a
+	// well-formed response. Otherwise hosts that don't answer are admitted
+	// too.
+	RequireDescribeServer bool
+	// If set, only hosts matching one of these are admitted: a hostname, or
+	// "*.example.com" for any subdomain of example.com
+	AllowedDomains []string
+	// Admitted hosts start out in the trusted tier for this long, then drop
+	// back to the new tier at the next tier promotion pass, unless an admin
+	// has changed their tier in the meantime. Zero starts them out like any
+	// other new host.
+	AutoTrustFor time.Duration
+}
+
+func DefaultSpideringOptions() *SpideringOptions {
+	return &SpideringOptions{
+		RequireDescribeServer: true,
+	}
+}
+
+// spideringPolicy applies SpideringOptions to the hosts spidering discovers
+type spideringPolicy struct {
+	opts    SpideringOptions
+	clock   util.Clock
+	limiter *rate.Limiter
+}
+
+func newSpideringPolicy(opts *SpideringOptions, clock util.Clock) (*spideringPolicy, error) {
+	if opts == nil {
+		opts = DefaultSpideringOptions()
+	}
+	for _, d := range opts.AllowedDomains {
+		if strings.TrimPrefix(d, "*.") == "" || strings.Contains(strings.TrimPrefix(d, "*."), "*") {
+			return nil, fmt.Errorf("invalid spidering domain pattern %q", d)
+		}
+	}
+	if opts.MaxNewHostsPerHour < 0 || opts.AutoTrustFor < 0 {
+		return nil, fmt.Errorf("spidering limits can't be negative")
+	}
+
+	sp := &spideringPolicy{
+		opts:  *opts,
+		clock: util.ClockOrSystem(clock),
+	}
+	if opts.MaxNewHostsPerHour > 0 {
+		sp.limiter = rate.NewLimiter(rate.Every(time.Hour/time.Duration(opts.MaxNewHostsPerHour)), opts.MaxNewHostsPerHour)
+	}
+	return sp, nil
+}
+
+func (sp *spideringPolicy) reject(host, reason, msg string) error {
+	spideredHostsRejected.WithLabelValues(reason).Inc()
+	log.Infow("spidered host not admitted", "host", host, "reason", reason)
+	return &ErrNotAdmitted{
+		Req:    AdmissionRequest{Kind: AdmissionKindHost, Host: host},
+		Reason: msg,
+	}
+}
+
+// discover records a newly discovered host, and turns it away if it's outside
+// the allowed domains
+func (sp *spideringPolicy) discover(host string) error {
+	spideredHostsDiscovered.Inc()
+
+	if len(sp.opts.AllowedDomains) == 0 {
+		return nil
+	}
+	// patterns don't include ports
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	for _, d := range sp.opts.AllowedDomains {
+		if hostMatchesDomain(name, d) {
+			return nil
+		}
+	}
+	return sp.reject(host, "domain", "spidering is limited to allowed domains")
+}
+
+// admit decides whether a discovered host is admitted, given its
+// describeServer response or the error fetching it
+func (sp *spideringPolicy) admit(host string, desc *comatproto.ServerDescribeServer_Output, descErr error) error {
+	if sp.opts.RequireDescribeServer {
+		if descErr != nil {
+			return sp.reject(host, "describe_server", fmt.Sprintf("describeServer failed: %s", descErr))
+		}
+		if _, err := syntax.ParseDID(desc.Did); err != nil {
+			return sp.reject(host, "describe_server", "describeServer didn't give a valid DID")
+		}
+	}
+
+	if sp.limiter != nil && !sp.limiter.AllowN(sp.clock.Now(), 1) {
+		return sp.reject(host, "rate_limit", fmt.Sprintf("over the limit of %d new hosts per hour", sp.opts.MaxNewHostsPerHour))
+	}
+
+	spideredHostsAdmitted.Inc()
+	return nil
+}
+
+// autoTrustUntil returns when an admitted host's probationary trust runs
+// out, or nil if they aren't given any. Like the rest of tier promotion, it
+// goes by the wall clock.
+func (sp *spideringPolicy) autoTrustUntil() *time.Time {
+	if sp.opts.AutoTrustFor <= 0 {
+		return nil
+	}
+	until := time.Now().Add(sp.opts.AutoTrustFor)
+	return &until
+}
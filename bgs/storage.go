@@ -0,0 +1,242 @@
+package bgs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+	"gorm.io/gorm"
+)
+
+// StorageTracker keeps each PDS's total carstore usage up to date. The
+// carstore reports every change in a user's storage as shards are written,
+// compacted and deleted; changes are batched up by user and periodically
+// attributed to the user's current PDS. Hosts that go over their storage
+// quota are disconnected until the quota is raised or usage drops.
+//
+// Storage stays attributed to the PDS an account was on when it was written,
+// so totals drift as accounts migrate. RecountPDS recomputes a host's total
+// from the carstore's per-user totals.
+type StorageTracker struct {
+	interval time.Duration
+
+	lk      sync.Mutex
+	pending map[models.Uid]int64
+
+	// serializes flushes and recounts
+	flushLk sync.Mutex
+
+	exit chan struct{}
+	wg   sync.WaitGroup
+}
+
+type StorageTrackerOptions struct {
+	// Interval between writing accumulated changes to the database
+	FlushInterval time.Duration
+}
+
+func DefaultStorageTrackerOptions() *StorageTrackerOptions {
+	return &StorageTrackerOptions{
+		FlushInterval: 10 * time.Second,
+	}
+}
+
+func NewStorageTracker(opts *StorageTrackerOptions) *StorageTracker {
+	if opts == nil {
+		opts = DefaultStorageTrackerOptions()
+	}
+
+	return &StorageTracker{
+		interval: opts.FlushInterval,
+		pending:  make(map[models.Uid]int64),
+		exit:     make(chan struct{}),
+	}
+}
+
+// Observe records a change in a user's storage; it is registered as the
+// carstore's storage observer
+func (st *StorageTracker) Observe(user models.Uid, delta int64) {
+	st.lk.Lock()
+	st.pending[user] += delta
+	st.lk.Unlock()
+}
+
+// Start starts periodically flushing changes to the database
+func (st *StorageTracker) Start(bgs *BGS) {
+	var hosts []models.PDS
+	if err := bgs.db.Select("host", "storage_bytes").Find(&hosts, "storage_bytes <> 0").Error; err != nil {
+		log.Errorw("failed to load pds storage usage", "err", err)
+	}
+	for _, pds := range hosts {
+		pdsStorageBytes.WithLabelValues(pds.Host).Set(float64(pds.StorageBytes))
+	}
+
+	st.wg.Add(1)
+	go func() {
+		defer st.wg.Done()
+
+		t := time.NewTicker(st.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-st.exit:
+				if err := st.Flush(context.Background(), bgs); err != nil {
+					log.Errorw("failed to flush storage usage on shutdown", "err", err)
+				}
+				return
+			case <-t.C:
+				if err := st.Flush(context.Background(), bgs); err != nil {
+					log.Errorw("failed to flush storage usage", "err", err)
+				}
+			}
+		}
+	}()
+}
+
+// Shutdown stops the flush routine after a final flush
+func (st *StorageTracker) Shutdown() {
+	close(st.exit)
+	st.wg.Wait()
+}
+
+// Flush adds the changes observed since the last flush to each PDS's total,
+// and disconnects any host that is now over its quota
+func (st *StorageTracker) Flush(ctx context.Context, bgs *BGS) error {
+	st.flushLk.Lock()
+	defer st.flushLk.Unlock()
+
+	st.lk.Lock()
+	pending := st.pending
+	st.pending = make(map[models.Uid]int64)
+	st.lk.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	uids := make([]models.Uid, 0, len(pending))
+	for uid := range pending {
+		uids = append(uids, uid)
+	}
+
+	perPDS := make(map[uint]int64)
+	for i := 0; i < len(uids); i += 1000 {
+		batch := uids[i:min(i+1000, len(uids))]
+
+		var users []User
+		if err := bgs.db.WithContext(ctx).Select("id", "pds").Find(&users, "id in ?", batch).Error; err != nil {
+			st.requeue(pending)
+			return fmt.Errorf("looking up users: %w", err)
+		}
+		for _, u := range users {
+			if u.PDS != 0 {
+				perPDS[u.PDS] += pending[u.ID]
+			}
+		}
+	}
+
+	ids := make([]uint, 0, len(perPDS))
+	for id, delta := range perPDS {
+		if delta == 0 {
+			continue
+		}
+		if err := bgs.db.WithContext(ctx).Model(&models.PDS{}).Where("id = ?", id).
+			UpdateColumn("storage_bytes", gorm.Expr("storage_bytes + ?", delta)).Error; err != nil {
+			return fmt.Errorf("updating storage for pds %d: %w", id, err)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var hosts []models.PDS
+	if err := bgs.db.WithContext(ctx).Find(&hosts, "id in ?", ids).Error; err != nil {
+		return err
+	}
+	for _, pds := range hosts {
+		pdsStorageBytes.WithLabelValues(pds.Host).Set(float64(pds.StorageBytes))
+		bgs.enforceStorageQuota(&pds)
+	}
+
+	return nil
+}
+
+// requeue puts back changes that couldn't be flushed
+func (st *StorageTracker) requeue(pending map[models.Uid]int64) {
+	st.lk.Lock()
+	defer st.lk.Unlock()
+	for uid, delta := range pending {
+		st.pending[uid] += delta
+	}
+}
+
+// RecountPDS replaces a host's storage total with the sum of the carstore's
+// totals for the accounts currently on it. Writes for those accounts that
+// land during the recount may be counted twice.
+func (st *StorageTracker) RecountPDS(ctx context.Context, bgs *BGS, pds *models.PDS) (int64, error) {
+	if err := st.Flush(ctx, bgs); err != nil {
+		return 0, err
+	}
+
+	st.flushLk.Lock()
+	defer st.flushLk.Unlock()
+
+	cs := bgs.repoman.CarStore()
+
+	var total int64
+	var cursor models.Uid
+	for {
+		var users []User
+		if err := bgs.db.WithContext(ctx).Select("id").Where("pds = ? AND id > ?", pds.ID, cursor).
+			Order("id asc").Limit(1000).Find(&users).Error; err != nil {
+			return 0, err
+		}
+		if len(users) == 0 {
+			break
+		}
+
+		for _, u := range users {
+			us, err := cs.UserStorage(ctx, u.ID)
+			if err != nil {
+				return 0, fmt.Errorf("getting storage for %d: %w", u.ID, err)
+			}
+			total += us.Bytes
+		}
+		cursor = users[len(users)-1].ID
+	}
+
+	if err := bgs.db.WithContext(ctx).Model(&models.PDS{}).Where("id = ?", pds.ID).
+		UpdateColumn("storage_bytes", total).Error; err != nil {
+		return 0, err
+	}
+
+	pds.StorageBytes = total
+	pdsStorageBytes.WithLabelValues(pds.Host).Set(float64(total))
+	bgs.enforceStorageQuota(pds)
+
+	return total, nil
+}
+
+// enforceStorageQuota disconnects the host if it is over its storage quota
+func (bgs *BGS) enforceStorageQuota(pds *models.PDS) {
+	if !pds.OverStorageQuota() {
+		return
+	}
+
+	err := bgs.slurper.KillUpstreamConnection(pds.Host, false)
+	if errors.Is(err, ErrNoActiveConnection) {
+		return
+	}
+	if err != nil {
+		log.Errorw("failed to disconnect pds over storage quota", "host", pds.Host, "err", err)
+		return
+	}
+
+	log.Warnw("disconnected pds over storage quota", "host", pds.Host, "bytes", pds.StorageBytes, "quota", pds.StorageQuota)
+	storageQuotaPauses.Inc()
+	bgs.tiers.RecordIncident(context.TODO(), bgs.db, pds.ID, "storage_quota")
+}
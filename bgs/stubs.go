@@ -13,10 +13,6 @@ import (
 	"go.opentelemetry.io/otel"
 )
 
-type XRPCError struct {
-	Message string `json:"message"`
-}
-
 func (s *BGS) RegisterHandlersAppBsky(e *echo.Echo) error {
 	return nil
 }
@@ -27,6 +23,7 @@ func (s *BGS) RegisterHandlersComAtproto(e *echo.Echo) error {
 	e.GET("/xrpc/com.atproto.sync.getRecord", s.HandleComAtprotoSyncGetRecord)
 	e.GET("/xrpc/com.atproto.sync.getRepo", s.HandleComAtprotoSyncGetRepo)
 	e.GET("/xrpc/com.atproto.sync.listRepos", s.HandleComAtprotoSyncListRepos)
+	e.GET("/xrpc/com.atproto.sync.listReposByCollection", s.HandleComAtprotoSyncListReposByCollection)
 	e.POST("/xrpc/com.atproto.sync.notifyOfUpdate", s.HandleComAtprotoSyncNotifyOfUpdate)
 	e.POST("/xrpc/com.atproto.sync.requestCrawl", s.HandleComAtprotoSyncRequestCrawl)
 	return nil
@@ -40,13 +37,13 @@ func (s *BGS) HandleComAtprotoSyncGetBlocks(c echo.Context) error {
 	did := c.QueryParam("did")
 	_, err := syntax.ParseDID(did)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, XRPCError{Message: fmt.Sprintf("invalid did: %s", did)})
+		return c.JSON(http.StatusBadRequest, XRPCError{Error: XRPCErrInvalidRequest, Message: fmt.Sprintf("invalid did: %s", did)})
 	}
 
 	for _, cd := range cids {
 		_, err = cid.Parse(cd)
 		if err != nil {
-			return c.JSON(http.StatusBadRequest, XRPCError{Message: fmt.Sprintf("invalid cid: %s", cd)})
+			return c.JSON(http.StatusBadRequest, XRPCError{Error: XRPCErrInvalidRequest, Message: fmt.Sprintf("invalid cid: %s", cd)})
 		}
 	}
 
@@ -57,7 +54,7 @@ func (s *BGS) HandleComAtprotoSyncGetBlocks(c echo.Context) error {
 	if handleErr != nil {
 		return handleErr
 	}
-	return c.Stream(200, "application/vnd.ipld.car", out)
+	return s.streamCar(c, out)
 }
 
 func (s *BGS) HandleComAtprotoSyncGetLatestCommit(c echo.Context) error {
@@ -67,7 +64,7 @@ func (s *BGS) HandleComAtprotoSyncGetLatestCommit(c echo.Context) error {
 
 	_, err := syntax.ParseDID(did)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, XRPCError{Message: fmt.Sprintf("invalid did: %s", did)})
+		return c.JSON(http.StatusBadRequest, XRPCError{Error: XRPCErrInvalidRequest, Message: fmt.Sprintf("invalid did: %s", did)})
 	}
 
 	var out *comatprototypes.SyncGetLatestCommit_Output
@@ -89,17 +86,17 @@ func (s *BGS) HandleComAtprotoSyncGetRecord(c echo.Context) error {
 
 	_, err := syntax.ParseRecordKey(rkey)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, XRPCError{Message: fmt.Sprintf("invalid rkey: %s", rkey)})
+		return c.JSON(http.StatusBadRequest, XRPCError{Error: XRPCErrInvalidRequest, Message: fmt.Sprintf("invalid rkey: %s", rkey)})
 	}
 
 	_, err = syntax.ParseNSID(collection)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, XRPCError{Message: fmt.Sprintf("invalid collection: %s", collection)})
+		return c.JSON(http.StatusBadRequest, XRPCError{Error: XRPCErrInvalidRequest, Message: fmt.Sprintf("invalid collection: %s", collection)})
 	}
 
 	_, err = syntax.ParseDID(did)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, XRPCError{Message: fmt.Sprintf("invalid did: %s", did)})
+		return c.JSON(http.StatusBadRequest, XRPCError{Error: XRPCErrInvalidRequest, Message: fmt.Sprintf("invalid did: %s", did)})
 	}
 
 	var out io.Reader
@@ -109,7 +106,7 @@ func (s *BGS) HandleComAtprotoSyncGetRecord(c echo.Context) error {
 	if handleErr != nil {
 		return handleErr
 	}
-	return c.Stream(200, "application/vnd.ipld.car", out)
+	return s.streamCar(c, out)
 }
 
 func (s *BGS) HandleComAtprotoSyncGetRepo(c echo.Context) error {
@@ -120,17 +117,11 @@ func (s *BGS) HandleComAtprotoSyncGetRepo(c echo.Context) error {
 
 	_, err := syntax.ParseDID(did)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, XRPCError{Message: fmt.Sprintf("invalid did: %s", did)})
+		return c.JSON(http.StatusBadRequest, XRPCError{Error: XRPCErrInvalidRequest, Message: fmt.Sprintf("invalid did: %s", did)})
 	}
 
-	var out io.Reader
-	var handleErr error
-	// func (s *BGS) handleComAtprotoSyncGetRepo(ctx context.Context,did string,since string) (io.Reader, error)
-	out, handleErr = s.handleComAtprotoSyncGetRepo(ctx, did, since)
-	if handleErr != nil {
-		return handleErr
-	}
-	return c.Stream(200, "application/vnd.ipld.car", out)
+	// func (s *BGS) handleComAtprotoSyncGetRepo(ctx context.Context,did string,since string,acceptEncoding string,w http.ResponseWriter) error
+	return s.handleComAtprotoSyncGetRepo(ctx, did, since, c.Request().Header.Get("Accept-Encoding"), c.Response())
 }
 
 func (s *BGS) HandleComAtprotoSyncListRepos(c echo.Context) error {
@@ -146,7 +137,7 @@ func (s *BGS) HandleComAtprotoSyncListRepos(c echo.Context) error {
 	if limitQuery != "" {
 		limit, err = strconv.Atoi(limitQuery)
 		if err != nil || limit < 1 || limit > 1000 {
-			return c.JSON(http.StatusBadRequest, XRPCError{Message: fmt.Sprintf("invalid limit: %s", limitQuery)})
+			return c.JSON(http.StatusBadRequest, XRPCError{Error: XRPCErrInvalidRequest, Message: fmt.Sprintf("invalid limit: %s", limitQuery)})
 		}
 	}
 
@@ -154,7 +145,7 @@ func (s *BGS) HandleComAtprotoSyncListRepos(c echo.Context) error {
 	if cursorQuery != "" {
 		cursor, err = strconv.ParseInt(cursorQuery, 10, 64)
 		if err != nil || cursor < 0 {
-			return c.JSON(http.StatusBadRequest, XRPCError{Message: fmt.Sprintf("invalid cursor: %s", cursorQuery)})
+			return c.JSON(http.StatusBadRequest, XRPCError{Error: XRPCErrInvalidRequest, Message: fmt.Sprintf("invalid cursor: %s", cursorQuery)})
 		}
 	}
 
@@ -165,13 +156,50 @@ func (s *BGS) HandleComAtprotoSyncListRepos(c echo.Context) error {
 	return c.JSON(200, out)
 }
 
+func (s *BGS) HandleComAtprotoSyncListReposByCollection(c echo.Context) error {
+	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleComAtprotoSyncListReposByCollection")
+	defer span.End()
+
+	collection := c.QueryParam("collection")
+	cursorQuery := c.QueryParam("cursor")
+	limitQuery := c.QueryParam("limit")
+
+	if _, err := syntax.ParseNSID(collection); err != nil {
+		return c.JSON(http.StatusBadRequest, XRPCError{Error: XRPCErrInvalidRequest, Message: fmt.Sprintf("invalid collection: %s", collection)})
+	}
+
+	var err error
+
+	limit := 500
+	if limitQuery != "" {
+		limit, err = strconv.Atoi(limitQuery)
+		if err != nil || limit < 1 || limit > 2000 {
+			return c.JSON(http.StatusBadRequest, XRPCError{Error: XRPCErrInvalidRequest, Message: fmt.Sprintf("invalid limit: %s", limitQuery)})
+		}
+	}
+
+	cursor := int64(0)
+	if cursorQuery != "" {
+		cursor, err = strconv.ParseInt(cursorQuery, 10, 64)
+		if err != nil || cursor < 0 {
+			return c.JSON(http.StatusBadRequest, XRPCError{Error: XRPCErrInvalidRequest, Message: fmt.Sprintf("invalid cursor: %s", cursorQuery)})
+		}
+	}
+
+	out, handleErr := s.handleComAtprotoSyncListReposByCollection(ctx, collection, cursor, limit)
+	if handleErr != nil {
+		return handleErr
+	}
+	return c.JSON(200, out)
+}
+
 func (s *BGS) HandleComAtprotoSyncNotifyOfUpdate(c echo.Context) error {
 	ctx, span := otel.Tracer("server").Start(c.Request().Context(), "HandleComAtprotoSyncNotifyOfUpdate")
 	defer span.End()
 
 	var body comatprototypes.SyncNotifyOfUpdate_Input
 	if err := c.Bind(&body); err != nil {
-		return c.JSON(http.StatusBadRequest, XRPCError{Message: fmt.Sprintf("invalid body: %s", err)})
+		return c.JSON(http.StatusBadRequest, XRPCError{Error: XRPCErrInvalidRequest, Message: fmt.Sprintf("invalid body: %s", err)})
 	}
 	var handleErr error
 	// func (s *BGS) handleComAtprotoSyncNotifyOfUpdate(ctx context.Context,body *comatprototypes.SyncNotifyOfUpdate_Input) error
@@ -188,7 +216,7 @@ func (s *BGS) HandleComAtprotoSyncRequestCrawl(c echo.Context) error {
 
 	var body comatprototypes.SyncRequestCrawl_Input
 	if err := c.Bind(&body); err != nil {
-		return c.JSON(http.StatusBadRequest, XRPCError{Message: fmt.Sprintf("invalid body: %s", err)})
+		return c.JSON(http.StatusBadRequest, XRPCError{Error: XRPCErrInvalidRequest, Message: fmt.Sprintf("invalid body: %s", err)})
 	}
 	var handleErr error
 	// func (s *BGS) handleComAtprotoSyncRequestCrawl(ctx context.Context,body *comatprototypes.SyncRequestCrawl_Input) error
@@ -0,0 +1,186 @@
+package bgs
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"golang.org/x/time/rate"
+)
+
+// SubscriberAuthOptions makes firehose subscribers authenticate, for private
+// and internal relays. Subscribers present a bearer token, either one of
+// Tokens or a service-auth JWT from one of DIDs, and are limited and
+// attributed by the identity it names.
+type SubscriberAuthOptions struct {
+	// Static tokens, by the name subscribers presenting them are known as
+	Tokens map[string]string
+
+	// Accounts whose service-auth tokens are accepted. Tokens must be for
+	// Audience, the relay's DID, and either unbound or bound to
+	// com.atproto.sync.subscribeRepos.
+	DIDs        []string
+	Audience    string
+	MaxLifetime time.Duration
+	// resolves the issuer's signing key; defaults to identity.DefaultDirectory
+	Directory identity.Directory
+
+	// Most connections one identity may hold open; zero for no limit
+	MaxConnsPerIdentity int
+	// New connections per second one identity may make, and how many in a
+	// burst; zero for no limit
+	ConnectRate  float64
+	ConnectBurst int
+}
+
+func DefaultSubscriberAuthOptions() *SubscriberAuthOptions {
+	return &SubscriberAuthOptions{
+		MaxLifetime:         time.Hour,
+		MaxConnsPerIdentity: 10,
+		ConnectRate:         1,
+		ConnectBurst:        10,
+	}
+}
+
+const subscribeReposMethod = "com.atproto.sync.subscribeRepos"
+
+// SubscriberAuth admits authenticated subscribers
+type SubscriberAuth struct {
+	opts     SubscriberAuthOptions
+	verifier *serviceAuthVerifier
+
+	lk       sync.Mutex
+	conns    map[string]int
+	limiters map[string]*rate.Limiter
+}
+
+func NewSubscriberAuth(opts *SubscriberAuthOptions) (*SubscriberAuth, error) {
+	if len(opts.Tokens) == 0 && len(opts.DIDs) == 0 {
+		return nil, fmt.Errorf("subscriber auth requires at least one token or DID")
+	}
+
+	sa := &SubscriberAuth{
+		opts:     *opts,
+		conns:    make(map[string]int),
+		limiters: make(map[string]*rate.Limiter),
+	}
+	for name, tok := range opts.Tokens {
+		if name == "" || tok == "" {
+			return nil, fmt.Errorf("subscriber tokens must have a name and a value")
+		}
+		if looksLikeJWT(tok) {
+			return nil, fmt.Errorf("subscriber token %q would be taken for a service-auth JWT", name)
+		}
+	}
+	if len(opts.DIDs) > 0 {
+		v, err := newServiceAuthVerifier(&ServiceAuthConfig{
+			Audience:    opts.Audience,
+			AdminDIDs:   opts.DIDs,
+			MaxLifetime: opts.MaxLifetime,
+			Directory:   opts.Directory,
+		})
+		if err != nil {
+			return nil, err
+		}
+		v.method = subscribeReposMethod
+		sa.verifier = v
+	}
+	return sa, nil
+}
+
+// authenticate returns the identity a request's bearer token names
+func (sa *SubscriberAuth) authenticate(ctx context.Context, r *http.Request) (string, error) {
+	tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || tok == "" {
+		return "", fmt.Errorf("no bearer token")
+	}
+
+	if looksLikeJWT(tok) {
+		if sa.verifier == nil {
+			return "", fmt.Errorf("service-auth tokens are not accepted")
+		}
+		did, err := sa.verifier.Verify(ctx, tok)
+		if err != nil {
+			return "", err
+		}
+		return did.String(), nil
+	}
+
+	// check every token, so the time taken doesn't give away which matched
+	var ident string
+	for name, t := range sa.opts.Tokens {
+		if subtle.ConstantTimeCompare([]byte(tok), []byte(t)) == 1 {
+			ident = "token:" + name
+		}
+	}
+	if ident == "" {
+		return "", fmt.Errorf("unknown token")
+	}
+	return ident, nil
+}
+
+// Admit authenticates a subscriber and checks its identity's limits,
+// returning the identity and a func to call once it disconnects. Errors are
+// APIErrors, to be returned before the connection is upgraded.
+func (sa *SubscriberAuth) Admit(ctx context.Context, r *http.Request) (string, func(), error) {
+	ident, err := sa.authenticate(ctx, r)
+	if err != nil {
+		subscriberAuthRejected.WithLabelValues("unauthenticated").Inc()
+		ctxLog(ctx).Warnw("rejected firehose subscriber", "err", err, "remote_addr", r.RemoteAddr)
+		return "", nil, apiError(http.StatusUnauthorized, XRPCErrAuthRequired, "subscribing requires a valid bearer token")
+	}
+
+	sa.lk.Lock()
+	defer sa.lk.Unlock()
+
+	if sa.opts.MaxConnsPerIdentity > 0 && sa.conns[ident] >= sa.opts.MaxConnsPerIdentity {
+		subscriberAuthRejected.WithLabelValues("too_many_connections").Inc()
+		return "", nil, apiError(http.StatusTooManyRequests, XRPCErrRateLimited, "%s already has %d connections open", ident, sa.conns[ident])
+	}
+	if sa.opts.ConnectRate > 0 {
+		lim, ok := sa.limiters[ident]
+		if !ok {
+			lim = rate.NewLimiter(rate.Limit(sa.opts.ConnectRate), max(sa.opts.ConnectBurst, 1))
+			sa.limiters[ident] = lim
+		}
+		if !lim.Allow() {
+			subscriberAuthRejected.WithLabelValues("rate_limited").Inc()
+			err := apiError(http.StatusTooManyRequests, XRPCErrRateLimited, "%s is connecting too often", ident)
+			err.RetryAfter = time.Duration(float64(time.Second) / sa.opts.ConnectRate)
+			return "", nil, err
+		}
+	}
+
+	sa.conns[ident]++
+	subscriberConnections.WithLabelValues(ident).Inc()
+
+	var once sync.Once
+	return ident, func() {
+		once.Do(func() { sa.release(ident) })
+	}, nil
+}
+
+func (sa *SubscriberAuth) release(ident string) {
+	sa.lk.Lock()
+	defer sa.lk.Unlock()
+
+	sa.conns[ident]--
+	if sa.conns[ident] <= 0 {
+		delete(sa.conns, ident)
+	}
+	subscriberConnections.WithLabelValues(ident).Dec()
+}
+
+// admitSubscriber admits a subscriber if subscriber auth is on. Without it,
+// every subscriber is admitted with no identity.
+func (bgs *BGS) admitSubscriber(ctx context.Context, r *http.Request) (string, func(), error) {
+	if bgs.subAuth == nil {
+		return "", func() {}, nil
+	}
+	return bgs.subAuth.Admit(ctx, r)
+}
@@ -0,0 +1,160 @@
+package bgs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func subscribeRequest(tok string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.sync.subscribeRepos", nil)
+	if tok != "" {
+		r.Header.Set("Authorization", "Bearer "+tok)
+	}
+	return r
+}
+
+func TestAdmitSubscriber(t *testing.T) {
+	ctx := context.Background()
+	priv, pub := newTestKey(t)
+	other, _ := newTestKey(t)
+
+	opts := DefaultSubscriberAuthOptions()
+	opts.Tokens = map[string]string{"indexer": "secret-token"}
+	opts.DIDs = []string{testAdminDID}
+	opts.Audience = "did:web:relay.example.com"
+	opts.Directory = &rotatingDirectory{current: pub}
+	sa, err := NewSubscriberAuth(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bgs := &BGS{subAuth: sa}
+
+	now := time.Now()
+	claims := func(lxm string) map[string]any {
+		c := map[string]any{
+			"iss": testAdminDID,
+			"aud": "did:web:relay.example.com",
+			"iat": now.Unix(),
+			"exp": now.Add(time.Minute).Unix(),
+		}
+		if lxm != "" {
+			c["lxm"] = lxm
+		}
+		return c
+	}
+
+	for _, tc := range []struct {
+		name  string
+		tok   string
+		ident string
+	}{
+		{"static token", "secret-token", "token:indexer"},
+		{"service auth", signServiceAuth(t, priv, "ES256K", claims("")), testAdminDID},
+		{"bound to subscribeRepos", signServiceAuth(t, priv, "ES256K", claims(subscribeReposMethod)), testAdminDID},
+		{"no token", "", ""},
+		{"unknown token", "wrong-token", ""},
+		{"bound to another method", signServiceAuth(t, priv, "ES256K", claims("com.atproto.sync.getRepo")), ""},
+		{"forged service auth", signServiceAuth(t, other, "ES256K", claims("")), ""},
+	} {
+		ident, done, err := bgs.admitSubscriber(ctx, subscribeRequest(tc.tok))
+		if tc.ident == "" {
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.Status != http.StatusUnauthorized || apiErr.Name != XRPCErrAuthRequired {
+				t.Errorf("%s: expected AuthRequired, got %v", tc.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected admitted, got %v", tc.name, err)
+			continue
+		}
+		if ident != tc.ident {
+			t.Errorf("%s: expected identity %s, got %s", tc.name, tc.ident, ident)
+		}
+		done()
+	}
+}
+
+func TestAdmitSubscriberLimits(t *testing.T) {
+	ctx := context.Background()
+
+	opts := DefaultSubscriberAuthOptions()
+	opts.Tokens = map[string]string{"indexer": "secret-token", "other": "other-token"}
+	opts.MaxConnsPerIdentity = 2
+	opts.ConnectRate = 0
+	sa, err := NewSubscriberAuth(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bgs := &BGS{subAuth: sa}
+
+	admit := func(tok string) (func(), error) {
+		_, done, err := bgs.admitSubscriber(ctx, subscribeRequest(tok))
+		return done, err
+	}
+
+	first, err := admit("secret-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := admit("secret-token"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = admit("secret-token")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusTooManyRequests || apiErr.Name != XRPCErrRateLimited {
+		t.Fatalf("expected the third connection turned away, got %v", err)
+	}
+
+	// the limit is per identity
+	if _, err := admit("other-token"); err != nil {
+		t.Fatalf("expected another identity admitted, got %v", err)
+	}
+
+	// a disconnect frees a slot, once however often it's reported
+	first()
+	first()
+	if _, err := admit("secret-token"); err != nil {
+		t.Fatalf("expected a connection admitted after a disconnect, got %v", err)
+	}
+	if _, err := admit("secret-token"); err == nil {
+		t.Fatal("expected the limit reached again")
+	}
+}
+
+func TestAdmitSubscriberConnectRate(t *testing.T) {
+	opts := DefaultSubscriberAuthOptions()
+	opts.Tokens = map[string]string{"indexer": "secret-token"}
+	opts.MaxConnsPerIdentity = 0
+	opts.ConnectRate = 0.01
+	opts.ConnectBurst = 2
+	sa, err := NewSubscriberAuth(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bgs := &BGS{subAuth: sa}
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := bgs.admitSubscriber(context.Background(), subscribeRequest("secret-token")); err != nil {
+			t.Fatalf("expected connection %d within the burst admitted, got %v", i, err)
+		}
+	}
+	_, _, err = bgs.admitSubscriber(context.Background(), subscribeRequest("secret-token"))
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusTooManyRequests || apiErr.RetryAfter == 0 {
+		t.Fatalf("expected rate limited with a Retry-After, got %v", err)
+	}
+}
+
+func TestAdmitSubscriberWithoutAuth(t *testing.T) {
+	ident, done, err := (&BGS{}).admitSubscriber(context.Background(), subscribeRequest(""))
+	if err != nil || ident != "" || done == nil {
+		t.Fatalf("expected every subscriber admitted without subscriber auth, got %q %v", ident, err)
+	}
+	done()
+}
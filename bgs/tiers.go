@@ -0,0 +1,301 @@
+package bgs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+
+	"gorm.io/gorm"
+)
+
+// Repo limit tiers. New hosts start in TierNew (or TierTrusted under a
+// trusted domain) and are promoted once they've been around long enough
+// without incident; TierPartner is only ever assigned by an admin.
+const (
+	TierNew     = "new"
+	TierTrusted = "trusted"
+	TierPartner = "partner"
+)
+
+// TierPromotion moves hosts from one tier to another once they've been known
+// to the relay for MinAge, and have had no incidents for CleanFor
+type TierPromotion struct {
+	From     string        `json:"from"`
+	To       string        `json:"to"`
+	MinAge   time.Duration `json:"min_age"`
+	CleanFor time.Duration `json:"clean_for"`
+}
+
+type RepoLimitTiersOptions struct {
+	// Repo limit for hosts in each tier
+	Limits map[string]int64
+	// Applied in order on each pass; a host is promoted at most once per pass
+	Promotions []TierPromotion
+	// Interval between promotion passes, zero disables them
+	PromoteInterval time.Duration
+}
+
+func DefaultRepoLimitTiersOptions() *RepoLimitTiersOptions {
+	return &RepoLimitTiersOptions{
+		Limits: map[string]int64{
+			TierNew:     100,
+			TierTrusted: 10_000,
+			TierPartner: 1_000_000,
+		},
+		Promotions: []TierPromotion{{
+			From:     TierNew,
+			To:       TierTrusted,
+			MinAge:   30 * 24 * time.Hour,
+			CleanFor: 30 * 24 * time.Hour,
+		}},
+		PromoteInterval: time.Hour,
+	}
+}
+
+// how often an incident is recorded for a single host
+const incidentDebounce = time.Minute
+
+// TierManager assigns hosts to repo limit tiers, tracks incidents that hold
+// back promotion, and periodically promotes hosts with a clean history
+type TierManager struct {
+	limits     map[string]int64
+	promotions []TierPromotion
+	interval   time.Duration
+
+	incidentsLk sync.Mutex
+	incidents   map[uint]time.Time
+
+	exit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewTierManager(opts *RepoLimitTiersOptions) (*TierManager, error) {
+	if opts == nil {
+		opts = DefaultRepoLimitTiersOptions()
+	}
+
+	for _, t := range []string{TierNew, TierTrusted} {
+		if _, ok := opts.Limits[t]; !ok {
+			return nil, fmt.Errorf("no repo limit for %q tier", t)
+		}
+	}
+	for _, p := range opts.Promotions {
+		if _, ok := opts.Limits[p.From]; !ok {
+			return nil, fmt.Errorf("promotion from unknown tier %q", p.From)
+		}
+		if _, ok := opts.Limits[p.To]; !ok {
+			return nil, fmt.Errorf("promotion to unknown tier %q", p.To)
+		}
+	}
+
+	return &TierManager{
+		limits:     opts.Limits,
+		promotions: opts.Promotions,
+		interval:   opts.PromoteInterval,
+		incidents:  make(map[uint]time.Time),
+		exit:       make(chan struct{}),
+	}, nil
+}
+
+// Limit returns the repo limit for a tier
+func (tm *TierManager) Limit(tier string) (int64, bool) {
+	l, ok := tm.limits[tier]
+	return l, ok
+}
+
+type RepoLimitTier struct {
+	Name      string `json:"name"`
+	RepoLimit int64  `json:"repo_limit"`
+	Hosts     int64  `json:"hosts"`
+}
+
+// Tiers lists the configured tiers, smallest limit first, with how many
+// hosts are in each
+func (tm *TierManager) Tiers(ctx context.Context, db *gorm.DB) ([]RepoLimitTier, error) {
+	var counts []struct {
+		Tier  string
+		Count int64
+	}
+	if err := db.WithContext(ctx).Model(&models.PDS{}).Select("tier, count(*) as count").Group("tier").Scan(&counts).Error; err != nil {
+		return nil, err
+	}
+
+	out := make([]RepoLimitTier, 0, len(tm.limits))
+	for name, limit := range tm.limits {
+		t := RepoLimitTier{Name: name, RepoLimit: limit}
+		for _, c := range counts {
+			if c.Tier == name || (c.Tier == "" && name == TierNew) {
+				t.Hosts += c.Count
+			}
+		}
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].RepoLimit < out[j].RepoLimit
+	})
+	return out, nil
+}
+
+// Start starts the scheduled promotion routine, if enabled
+func (tm *TierManager) Start(bgs *BGS) {
+	if tm.interval <= 0 {
+		return
+	}
+
+	log.Infow("starting repo limit tier promotion", "interval", tm.interval)
+
+	tm.wg.Add(1)
+	go func() {
+		defer tm.wg.Done()
+
+		t := time.NewTicker(tm.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-tm.exit:
+				return
+			case <-t.C:
+				if _, err := tm.RunPromotions(context.Background(), bgs); err != nil {
+					log.Errorw("repo limit tier promotion pass failed", "err", err)
+				}
+			}
+		}
+	}()
+}
+
+// Shutdown stops the promotion routine
+func (tm *TierManager) Shutdown() {
+	close(tm.exit)
+	tm.wg.Wait()
+}
+
+// RunPromotions promotes every eligible host, returning how many were
+// promoted. Hosts whose probationary trust from spidering has run out are
+// moved back to the new tier first, so they're promoted again straight away
+// if they're eligible.
+func (tm *TierManager) RunPromotions(ctx context.Context, bgs *BGS) (int, error) {
+	now := time.Now()
+	if err := tm.expireAutoTrust(ctx, bgs, now); err != nil {
+		return 0, err
+	}
+
+	promoted := make(map[uint]bool)
+
+	for _, p := range tm.promotions {
+		q := bgs.db.WithContext(ctx).Model(&models.PDS{}).
+			Where("NOT tier_pinned AND NOT blocked").
+			Where("created_at <= ?", now.Add(-p.MinAge)).
+			Where("last_incident_at IS NULL OR last_incident_at <= ?", now.Add(-p.CleanFor)).
+			Where("storage_quota = 0 OR storage_bytes < storage_quota")
+		if p.From == TierNew {
+			q = q.Where("tier = ? OR tier = ''", p.From)
+		} else {
+			q = q.Where("tier = ?", p.From)
+		}
+
+		var hosts []models.PDS
+		if err := q.Find(&hosts).Error; err != nil {
+			return len(promoted), fmt.Errorf("finding hosts to promote from %q: %w", p.From, err)
+		}
+
+		for i := range hosts {
+			pds := &hosts[i]
+			if promoted[pds.ID] {
+				continue
+			}
+
+			// promotion never lowers a limit an admin raised by hand
+			limit := max(tm.limits[p.To], pds.RepoLimit)
+			if err := tm.setTier(ctx, bgs.db, pds, p.To, false, limit); err != nil {
+				return len(promoted), err
+			}
+
+			log.Infow("promoted host", "host", pds.Host, "from", p.From, "to", p.To, "repoLimit", limit)
+			tierPromotions.WithLabelValues(p.To).Inc()
+			promoted[pds.ID] = true
+		}
+	}
+
+	return len(promoted), nil
+}
+
+// expireAutoTrust moves hosts admitted by spidering back to the new tier once
+// their probationary trust runs out. Hosts an admin has moved since are left
+// where they are.
+func (tm *TierManager) expireAutoTrust(ctx context.Context, bgs *BGS, now time.Time) error {
+	var hosts []models.PDS
+	if err := bgs.db.WithContext(ctx).Where("auto_trusted_until IS NOT NULL AND auto_trusted_until <= ?", now).Find(&hosts).Error; err != nil {
+		return fmt.Errorf("finding hosts with expired auto-trust: %w", err)
+	}
+
+	for i := range hosts {
+		pds := &hosts[i]
+		if pds.TierPinned || pds.Tier != TierTrusted {
+			if err := bgs.db.WithContext(ctx).Model(&models.PDS{}).Where("id = ?", pds.ID).Update("auto_trusted_until", nil).Error; err != nil {
+				return fmt.Errorf("clearing auto-trust for %q: %w", pds.Host, err)
+			}
+			continue
+		}
+
+		if err := tm.setTier(ctx, bgs.db, pds, TierNew, false, tm.limits[TierNew]); err != nil {
+			return err
+		}
+		log.Infow("host's auto-trust from spidering ran out", "host", pds.Host, "repoLimit", pds.RepoLimit)
+		autoTrustExpired.Inc()
+	}
+	return nil
+}
+
+// AssignTier puts a host in a tier and sets its repo limit to the tier's.
+// Pinned hosts stay in the tier until an admin moves them.
+func (tm *TierManager) AssignTier(ctx context.Context, db *gorm.DB, pds *models.PDS, tier string, pinned bool) error {
+	limit, ok := tm.limits[tier]
+	if !ok {
+		return fmt.Errorf("unknown tier %q", tier)
+	}
+
+	return tm.setTier(ctx, db, pds, tier, pinned, limit)
+}
+
+func (tm *TierManager) setTier(ctx context.Context, db *gorm.DB, pds *models.PDS, tier string, pinned bool, limit int64) error {
+	// any change of tier ends a spidered host's probationary trust
+	err := db.WithContext(ctx).Model(&models.PDS{}).Where("id = ?", pds.ID).Updates(map[string]any{
+		"tier":               tier,
+		"tier_pinned":        pinned,
+		"repo_limit":         limit,
+		"auto_trusted_until": nil,
+	}).Error
+	if err != nil {
+		return fmt.Errorf("setting tier for %q: %w", pds.Host, err)
+	}
+
+	pds.Tier = tier
+	pds.TierPinned = pinned
+	pds.RepoLimit = limit
+	pds.AutoTrustedUntil = nil
+	return nil
+}
+
+// RecordIncident notes that a host misbehaved, restarting the clean history
+// it needs for promotion
+func (tm *TierManager) RecordIncident(ctx context.Context, db *gorm.DB, pdsID uint, reason string) {
+	now := time.Now()
+
+	tm.incidentsLk.Lock()
+	last, ok := tm.incidents[pdsID]
+	if ok && now.Sub(last) < incidentDebounce {
+		tm.incidentsLk.Unlock()
+		return
+	}
+	tm.incidents[pdsID] = now
+	tm.incidentsLk.Unlock()
+
+	hostIncidents.WithLabelValues(reason).Inc()
+	if err := db.WithContext(ctx).Model(&models.PDS{}).Where("id = ?", pdsID).UpdateColumn("last_incident_at", now).Error; err != nil {
+		log.Errorw("failed to record host incident", "pds", pdsID, "reason", reason, "err", err)
+	}
+}
@@ -0,0 +1,71 @@
+package bgs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bluesky-social/indigo/events"
+)
+
+// excludeTypesParam names message types a firehose subscriber doesn't want,
+// eg ?excludeTypes=identity,account for a consumer that only follows commits
+const excludeTypesParam = "excludeTypes"
+
+// message types subscribers can exclude; #info and error frames are always
+// sent, since they're about the stream rather than the network
+var excludableTypes = map[string]bool{
+	"#commit":    true,
+	"#sync":      true,
+	"#identity":  true,
+	"#account":   true,
+	"#handle":    true,
+	"#migrate":   true,
+	"#tombstone": true,
+}
+
+// parseExcludeTypes reads the excludeTypes query param, given once with a
+// comma separated list or repeated. Types may be given with or without the
+// leading '#'.
+func parseExcludeTypes(vals []string) (map[string]bool, error) {
+	excluded := make(map[string]bool)
+	for _, v := range vals {
+		for _, t := range strings.Split(v, ",") {
+			t = strings.TrimSpace(t)
+			if t == "" {
+				continue
+			}
+			if !strings.HasPrefix(t, "#") {
+				t = "#" + t
+			}
+			if !excludableTypes[t] {
+				return nil, fmt.Errorf("unknown message type in %s: %q (must be one of %s)", excludeTypesParam, t, excludableTypeNames())
+			}
+			excluded[t] = true
+		}
+	}
+	return excluded, nil
+}
+
+func excludableTypeNames() string {
+	names := make([]string, 0, len(excludableTypes))
+	for t := range excludableTypes {
+		names = append(names, strings.TrimPrefix(t, "#"))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// excludeTypesFilter drops events of the excluded types before next sees
+// them, so they're never serialized for the subscriber
+func excludeTypesFilter(excluded map[string]bool, next func(*events.XRPCStreamEvent) bool) func(*events.XRPCStreamEvent) bool {
+	if len(excluded) == 0 {
+		return next
+	}
+	return func(evt *events.XRPCStreamEvent) bool {
+		if excluded[evt.MessageType()] {
+			return false
+		}
+		return next(evt)
+	}
+}
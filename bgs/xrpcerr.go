@@ -0,0 +1,133 @@
+package bgs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bluesky-social/indigo/events"
+
+	"gorm.io/gorm"
+)
+
+// Names of the errors returned by XRPC handlers, in the error field of the
+// response body. Where the lexicons name an error for a case, that name is
+// used.
+const (
+	XRPCErrInvalidRequest  = "InvalidRequest"
+	XRPCErrAuthRequired    = "AuthRequired"
+	XRPCErrForbidden       = "Forbidden"
+	XRPCErrNotFound        = "NotFound"
+	XRPCErrRateLimited     = "RateLimitExceeded"
+	XRPCErrInternal        = "InternalServerError"
+	XRPCErrUpstreamFailure = "UpstreamFailure"
+	XRPCErrUnavailable     = "ServiceUnavailable"
+	XRPCErrNotImplemented  = "MethodNotImplemented"
+
+	XRPCErrRepoNotFound    = "RepoNotFound"
+	XRPCErrRepoTakendown   = "RepoTakendown"
+	XRPCErrRepoSuspended   = "RepoSuspended"
+	XRPCErrRepoDeactivated = "RepoDeactivated"
+	XRPCErrRecordNotFound  = "RecordNotFound"
+	XRPCErrBlockNotFound   = "BlockNotFound"
+	XRPCErrBlobNotFound    = "BlobNotFound"
+
+	XRPCErrHostBanned      = "HostBanned"
+	XRPCErrHostNotAllowed  = "HostNotAllowed"
+	XRPCErrHostUnreachable = "HostUnreachable"
+)
+
+// XRPCError is the body of an XRPC error response
+type XRPCError struct {
+	Error   string `json:"error,omitempty"`
+	Message string `json:"message"`
+}
+
+// APIError is returned by handlers to respond with an XRPC error
+type APIError struct {
+	Status  int
+	Name    string
+	Message string
+	// If set, sent in a Retry-After header
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Name, e.Message)
+}
+
+func apiError(status int, name string, format string, args ...any) *APIError {
+	return &APIError{Status: status, Name: name, Message: fmt.Sprintf(format, args...)}
+}
+
+// xrpcErrorName picks an error name for an error that only carries an HTTP
+// status
+func xrpcErrorName(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return XRPCErrAuthRequired
+	case status == http.StatusForbidden:
+		return XRPCErrForbidden
+	case status == http.StatusNotFound:
+		return XRPCErrNotFound
+	case status == http.StatusTooManyRequests:
+		return XRPCErrRateLimited
+	case status == http.StatusBadGateway:
+		return XRPCErrUpstreamFailure
+	case status == http.StatusServiceUnavailable:
+		return XRPCErrUnavailable
+	case status >= 500:
+		return XRPCErrInternal
+	default:
+		return XRPCErrInvalidRequest
+	}
+}
+
+// writeXRPCError writes an error response for handlers outside echo
+func writeXRPCError(w http.ResponseWriter, e *APIError) {
+	w.Header().Set("Content-Type", "application/json")
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", retryAfterSeconds(e.RetryAfter))
+	}
+	w.WriteHeader(e.Status)
+	if err := json.NewEncoder(w).Encode(XRPCError{Error: e.Name, Message: e.Message}); err != nil {
+		log.Errorf("Failed to write http error: %s", err)
+	}
+}
+
+// retryAfterSeconds formats a Retry-After header value, rounding up to a
+// whole second
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int((d + time.Second - 1) / time.Second))
+}
+
+// lookupRepo finds the account whose repo is being requested, returning an
+// *APIError if it's unknown or its repo can't be served
+func (s *BGS) lookupRepo(ctx context.Context, did string) (*User, error) {
+	u, err := s.lookupUserByDid(ctx, did)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, apiError(http.StatusNotFound, XRPCErrRepoNotFound, "repo not found: %s", did)
+		}
+		log.Errorw("failed to lookup user", "err", err, "did", did)
+		return nil, apiError(http.StatusInternalServerError, XRPCErrInternal, "failed to lookup user")
+	}
+
+	switch {
+	case u.Tombstoned:
+		return nil, apiError(http.StatusNotFound, XRPCErrRepoNotFound, "account was deleted")
+	case u.TakenDown:
+		return nil, apiError(http.StatusBadRequest, XRPCErrRepoTakendown, "account was taken down by the Relay")
+	case u.UpstreamStatus == events.AccountStatusTakendown:
+		return nil, apiError(http.StatusBadRequest, XRPCErrRepoTakendown, "account was taken down by its PDS")
+	case u.UpstreamStatus == events.AccountStatusDeactivated:
+		return nil, apiError(http.StatusBadRequest, XRPCErrRepoDeactivated, "account is temporarily deactivated")
+	case u.UpstreamStatus == events.AccountStatusSuspended:
+		return nil, apiError(http.StatusBadRequest, XRPCErrRepoSuspended, "account is suspended by its PDS")
+	}
+	return u, nil
+}
@@ -0,0 +1,126 @@
+// Package bgsclient is a typed client for a relay's admin API. The methods
+// on Client are generated from the relay's route descriptions, the same ones
+// served as an OpenAPI document at /admin/openapi.json, so they stay in step
+// with the routes bigsky registers.
+package bgsclient
+
+//go:generate go run ./gen client_gen.go
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client calls the admin API of the relay at Host, eg.
+// "https://relay.example.com"
+type Client struct {
+	Host string
+	// Admin token, or a service auth JWT if the relay accepts them
+	AdminToken string
+
+	HTTP *http.Client
+}
+
+func New(host, adminToken string) *Client {
+	return &Client{
+		Host:       strings.TrimSuffix(host, "/"),
+		AdminToken: adminToken,
+		HTTP:       http.DefaultClient,
+	}
+}
+
+// Error is returned for requests the relay responds to with an error status
+type Error struct {
+	StatusCode int
+	Name       string `json:"error"`
+	Message    string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if e.Name != "" {
+		return fmt.Sprintf("relay returned %d: %s: %s", e.StatusCode, e.Name, e.Message)
+	}
+	return fmt.Sprintf("relay returned %d: %s", e.StatusCode, e.Message)
+}
+
+// rawBody is a request body sent as is, rather than JSON encoded
+type rawBody struct {
+	contentType string
+	r           io.Reader
+}
+
+// do makes a request, JSON encoding body if it's not nil or a rawBody. The
+// response is decoded into out as JSON, or copied into it raw if out is a
+// *[]byte.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body any, out any) error {
+	u := c.Host + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var r io.Reader
+	contentType := "application/json"
+	switch body := body.(type) {
+	case nil:
+	case rawBody:
+		r = body.r
+		contentType = body.contentType
+	default:
+		b, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("encoding request body: %w", err)
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.AdminToken)
+
+	hc := c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		rerr := &Error{StatusCode: resp.StatusCode}
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if err := json.Unmarshal(b, rerr); err != nil || (rerr.Name == "" && rerr.Message == "") {
+			rerr.Message = strings.TrimSpace(string(b))
+		}
+		return rerr
+	}
+
+	switch out := out.(type) {
+	case nil:
+		return nil
+	case *[]byte:
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		*out = b
+		return nil
+	default:
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("decoding response: %w", err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,1407 @@
+// Code generated by bgsclient/gen. DO NOT EDIT.
+
+package bgsclient
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type AdminAction struct {
+	ID         uint            `json:"id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Actor      string          `json:"actor"`
+	RemoteIP   string          `json:"remote_ip"`
+	Method     string          `json:"method"`
+	Path       string          `json:"path"`
+	Query      string          `json:"query,omitempty"`
+	Body       json.RawMessage `json:"body,omitempty"`
+	Status     int             `json:"status"`
+	Error      string          `json:"error,omitempty"`
+	DurationMs int64           `json:"duration_ms"`
+}
+
+type AdminActionsResponse struct {
+	Actions []AdminAction `json:"actions"`
+	Cursor  uint          `json:"cursor,omitempty"`
+}
+
+type AdminImportHostsRequest struct {
+	Hostnames      []string `json:"hostnames"`
+	Concurrency    int      `json:"concurrency,omitempty"`
+	SkipValidation bool     `json:"skip_validation,omitempty"`
+}
+
+type AdminImportHostsResponse struct {
+	Results []ImportHostResult `json:"results"`
+	Counts  map[string]int     `json:"counts"`
+}
+
+type AdminRequestCrawlRequest struct {
+	Hostname string `json:"hostname"`
+}
+
+type ApiSuccessResponse struct {
+	Success string `json:"success"`
+}
+
+type BanDomainBody struct {
+	Domain string
+}
+
+type BannedDomains struct {
+	BannedDomains []string `json:"banned_domains"`
+}
+
+type BlobRef struct {
+	Did        string `json:"did"`
+	Collection string `json:"collection"`
+	Rkey       string `json:"rkey"`
+	Cid        string `json:"cid"`
+	MimeType   string `json:"mimeType"`
+	Size       int64  `json:"size"`
+}
+
+type BlobRefsResponse struct {
+	Refs   []BlobRef `json:"refs"`
+	Cursor uint      `json:"cursor,omitempty"`
+}
+
+type CarstoreScrubProblem struct {
+	Kind   string `json:"kind"`
+	Cid    string `json:"cid,omitempty"`
+	Detail string `json:"detail"`
+}
+
+type CollectionRegistryResponse struct {
+	Quarantine  bool                   `json:"quarantine"`
+	Collections []RegisteredCollection `json:"collections"`
+}
+
+type CollectionReviewRequest struct {
+	Collection string `json:"collection"`
+}
+
+type Consumer struct {
+	ID             uint64          `json:"id"`
+	RemoteAddr     string          `json:"remote_addr"`
+	UserAgent      string          `json:"user_agent"`
+	EventsConsumed uint64          `json:"events_consumed"`
+	ConnectedAt    time.Time       `json:"connected_at"`
+	Transport      string          `json:"transport"`
+	StreamVersion  int             `json:"stream_version"`
+	BytesSent      int64           `json:"bytes_sent"`
+	Identity       string          `json:"identity,omitempty"`
+	Replay         *ConsumerReplay `json:"replay,omitempty"`
+}
+
+type ConsumerReplay struct {
+	Since      int64      `json:"since"`
+	Until      int64      `json:"until"`
+	Sent       int64      `json:"sent"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+type CrawlHostBudgetsResponse struct {
+	Hosts []IndexerHostCrawlBudget `json:"hosts"`
+}
+
+type CrawlHostWeightRequest struct {
+	Host   string `json:"host"`
+	Weight int    `json:"weight"`
+}
+
+type CrawlPriorityChangeRequest struct {
+	Host     string `json:"host"`
+	Did      string `json:"did"`
+	Priority string `json:"priority"`
+}
+
+type EnrichedPDS struct {
+	ID                     uint
+	CreatedAt              time.Time
+	UpdatedAt              time.Time
+	DeletedAt              json.RawMessage
+	Host                   string
+	Did                    string
+	SSL                    bool
+	Cursor                 int64
+	Registered             bool
+	Blocked                bool
+	RateLimit              float64
+	CrawlRateLimit         float64
+	RepoCount              int64
+	RepoLimit              int64
+	HourlyEventLimit       int64
+	DailyEventLimit        int64
+	StorageBytes           int64
+	StorageQuota           int64
+	Tier                   string
+	TierPinned             bool
+	LastIncidentAt         *time.Time
+	PausedUntil            *time.Time
+	PolicyExempt           bool
+	AutoTrustedUntil       *time.Time
+	HasActiveConnection    bool      `json:"HasActiveConnection"`
+	EventsSeenSinceStartup uint64    `json:"EventsSeenSinceStartup"`
+	PerSecondEventRate     RateLimit `json:"PerSecondEventRate"`
+	PerHourEventRate       RateLimit `json:"PerHourEventRate"`
+	PerDayEventRate        RateLimit `json:"PerDayEventRate"`
+	CrawlRate              RateLimit `json:"CrawlRate"`
+	UserCount              int64     `json:"UserCount"`
+}
+
+type EventsRepoHistoryEntry struct {
+	Seq         int64      `json:"seq"`
+	Type        string     `json:"type"`
+	Rev         string     `json:"rev,omitempty"`
+	Commit      string     `json:"commit,omitempty"`
+	Time        *time.Time `json:"time,omitempty"`
+	PersistedAt time.Time  `json:"persistedAt"`
+}
+
+type FaultConfig struct {
+	DisconnectRate   float64  `json:"disconnect_rate"`
+	PersistDelayRate float64  `json:"persist_delay_rate"`
+	PersistDelayMs   int64    `json:"persist_delay_ms"`
+	DNSFailureRate   float64  `json:"dns_failure_rate"`
+	Hosts            []string `json:"hosts,omitempty"`
+	ForSeconds       int64    `json:"for_seconds,omitempty"`
+}
+
+type FaultInjectionState struct {
+	Config   *FaultConfig     `json:"config"`
+	Expires  *time.Time       `json:"expires,omitempty"`
+	Injected map[string]int64 `json:"injected"`
+}
+
+type FetchFailuresResponse struct {
+	Failures []IndexerRepoFetchFailure `json:"failures"`
+	Cursor   uint                      `json:"cursor,omitempty"`
+}
+
+type FirehoseConsumer struct {
+	ID                uint      `json:"id"`
+	RemoteHost        string    `json:"remote_host"`
+	UserAgent         string    `json:"user_agent"`
+	FirstSeen         time.Time `json:"first_seen"`
+	LastSeen          time.Time `json:"last_seen"`
+	Identity          string    `json:"identity,omitempty"`
+	Connections       int64     `json:"connections"`
+	ShortConnections  int64     `json:"short_connections"`
+	CursorConnections int64     `json:"cursor_connections"`
+	LastCursor        int64     `json:"last_cursor"`
+	LastCursorLag     int64     `json:"last_cursor_lag"`
+	ConnectedSeconds  int64     `json:"connected_seconds"`
+	EventsSent        int64     `json:"events_sent"`
+	BytesSent         int64     `json:"bytes_sent"`
+}
+
+type FlaggedCommit struct {
+	Repo   string    `json:"repo"`
+	Rev    string    `json:"rev"`
+	Host   string    `json:"host"`
+	Path   string    `json:"path"`
+	Score  float64   `json:"score"`
+	Action string    `json:"action"`
+	At     time.Time `json:"at"`
+}
+
+type FlaggedCommitsResponse struct {
+	Commits []FlaggedCommit `json:"commits"`
+}
+
+type GossipPeerStatus struct {
+	Peer      string    `json:"peer"`
+	LastFetch time.Time `json:"last_fetch,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	Hosts     int       `json:"hosts"`
+	Requested int       `json:"requested"`
+}
+
+type GossipPeersResponse struct {
+	Peers []GossipPeerStatus `json:"peers"`
+}
+
+type HostConnHealth struct {
+	Host          string     `json:"host"`
+	Connected     bool       `json:"connected"`
+	Since         time.Time  `json:"since"`
+	Reconnects    int64      `json:"reconnects"`
+	DialFailures  int64      `json:"dial_failures"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorAt   *time.Time `json:"last_error_at,omitempty"`
+	PingRTTMillis float64    `json:"ping_rtt_ms"`
+	LastPongAt    *time.Time `json:"last_pong_at,omitempty"`
+	BytesReceived int64      `json:"bytes_received"`
+	BytesPerSec   float64    `json:"bytes_per_sec"`
+}
+
+type HostGrowth struct {
+	Host      string     `json:"host"`
+	RepoCount int64      `json:"repo_count"`
+	NewRepos  int64      `json:"new_repos"`
+	PerHour   float64    `json:"per_hour"`
+	Since     time.Time  `json:"since"`
+	AlertedAt *time.Time `json:"alerted_at,omitempty"`
+}
+
+type HostRevOrderStats struct {
+	Host          string        `json:"host"`
+	Commits       int64         `json:"commits"`
+	OutOfOrder    int64         `json:"out_of_order"`
+	Duplicate     int64         `json:"duplicate"`
+	Future        int64         `json:"future"`
+	ViolationRate float64       `json:"violation_rate"`
+	Last          *RevViolation `json:"last_violation,omitempty"`
+}
+
+type HostStatsPoint struct {
+	Start           time.Time `json:"start"`
+	Seconds         float64   `json:"seconds"`
+	Events          int64     `json:"events"`
+	Rejected        int64     `json:"rejected"`
+	Errors          int64     `json:"errors"`
+	RepoCount       int64     `json:"repo_count"`
+	EventsPerSecond float64   `json:"events_per_second"`
+	ErrorRate       float64   `json:"error_rate"`
+}
+
+type ImportHostResult struct {
+	Hostname string `json:"hostname"`
+	Host     string `json:"host,omitempty"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+type IndexerCrawlPriorityConfig struct {
+	Weights map[string]int    `json:"weights"`
+	Hosts   map[uint]string   `json:"hosts"`
+	Repos   map[uint64]string `json:"repos"`
+	Queued  map[string]int    `json:"queued"`
+}
+
+type IndexerHostCrawlBudget struct {
+	PDS        uint    `json:"pds"`
+	Host       string  `json:"host,omitempty"`
+	Weight     int     `json:"weight"`
+	Queued     int     `json:"queued"`
+	InFlight   int     `json:"in_flight"`
+	Dispatched int64   `json:"dispatched"`
+	WorkerSecs float64 `json:"worker_seconds"`
+	AvgCrawlMs int64   `json:"avg_crawl_ms"`
+}
+
+type IndexerRepoAudit struct {
+	ID          uint      `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	Uid         uint64    `json:"uid"`
+	Did         string    `json:"did"`
+	PDS         uint      `json:"pds"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	LocalRev    string    `json:"local_rev"`
+	RemoteRev   string    `json:"remote_rev"`
+	LocalData   string    `json:"local_data"`
+	RemoteData  string    `json:"remote_data"`
+	Missing     int       `json:"missing"`
+	Extra       int       `json:"extra"`
+	Differing   int       `json:"differing"`
+	SamplePaths string    `json:"sample_paths,omitempty"`
+	Repaired    bool      `json:"repaired"`
+}
+
+type IndexerRepoFetchFailure struct {
+	ID          uint
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Uid         uint64
+	Did         string
+	PDS         uint
+	Attempts    int
+	LastError   string
+	NextAttempt time.Time
+	Dead        bool
+}
+
+type IngestStageStatus struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+type IngestStagesResponse struct {
+	Stages []IngestStageStatus `json:"stages"`
+}
+
+type PdsGrowthResponse struct {
+	Window int64        `json:"window"`
+	Hosts  []HostGrowth `json:"hosts"`
+}
+
+type PdsStatsHistoryResponse struct {
+	Host       string           `json:"host"`
+	Resolution string           `json:"resolution"`
+	Points     []HostStatsPoint `json:"points"`
+}
+
+type PdsStorage struct {
+	Host           string `json:"host"`
+	StorageBytes   int64  `json:"storage_bytes"`
+	StorageQuota   int64  `json:"storage_quota"`
+	OverQuota      bool   `json:"over_quota"`
+	HasActiveConns bool   `json:"has_active_connection"`
+}
+
+type PolicyAction struct {
+	Event     string     `json:"event"`
+	Host      string     `json:"host"`
+	Rule      string     `json:"rule"`
+	Signal    string     `json:"signal"`
+	Value     float64    `json:"value"`
+	Threshold float64    `json:"threshold"`
+	Action    string     `json:"action"`
+	Until     *time.Time `json:"until,omitempty"`
+	Time      time.Time  `json:"time"`
+}
+
+type PolicyOverrideRequest struct {
+	Host   string `json:"host"`
+	Exempt *bool  `json:"exempt,omitempty"`
+}
+
+type PolicyResponse struct {
+	Interval int64          `json:"interval"`
+	Rules    []PolicyRule   `json:"rules"`
+	Actions  []PolicyAction `json:"actions"`
+}
+
+type PolicyRule struct {
+	Name      string  `json:"name"`
+	Signal    string  `json:"signal"`
+	Threshold float64 `json:"threshold"`
+	MinEvents int64   `json:"min_events,omitempty"`
+	Action    string  `json:"action"`
+	PauseFor  int64   `json:"pause_for,omitempty"`
+}
+
+type RateLimit struct {
+	Max           float64 `json:"Max"`
+	WindowSeconds float64 `json:"Window"`
+}
+
+type RateLimitChangeRequest struct {
+	Host      string `json:"host"`
+	PerSecond int64  `json:"per_second"`
+	PerHour   int64  `json:"per_hour"`
+	PerDay    int64  `json:"per_day"`
+	CrawlRate int64  `json:"crawl_rate"`
+	RepoLimit int64  `json:"repo_limit"`
+}
+
+type RegisteredCollection struct {
+	NSID         string     `json:"nsid"`
+	FirstSeen    time.Time  `json:"first_seen"`
+	LastSeen     time.Time  `json:"last_seen"`
+	FirstHost    string     `json:"first_host"`
+	FirstRepo    string     `json:"first_repo"`
+	Records      int64      `json:"records"`
+	Held         int64      `json:"held"`
+	SampleRecord string     `json:"sample_record,omitempty"`
+	KnownSchema  bool       `json:"known_schema"`
+	Status       string     `json:"status"`
+	ReviewedAt   *time.Time `json:"reviewed_at,omitempty"`
+	ReviewedBy   string     `json:"reviewed_by,omitempty"`
+}
+
+type ReplayEventsRequest struct {
+	ConsumerID *uint64 `json:"consumer_id,omitempty"`
+	Since      int64   `json:"since"`
+	Until      int64   `json:"until"`
+}
+
+type ReplayEventsResponse struct {
+	Replay  *ConsumerReplay `json:"replay,omitempty"`
+	Ticket  string          `json:"ticket,omitempty"`
+	Path    string          `json:"path,omitempty"`
+	Expires *time.Time      `json:"expires,omitempty"`
+}
+
+type RepoAuditsResponse struct {
+	Audits []IndexerRepoAudit `json:"audits"`
+	Cursor uint               `json:"cursor,omitempty"`
+}
+
+type RepoHistoryResponse struct {
+	Did    string                   `json:"did"`
+	Events []EventsRepoHistoryEntry `json:"events"`
+}
+
+type RepoImportResponse struct {
+	Did string `json:"did"`
+	Rev string `json:"rev"`
+}
+
+type RepoLimitTier struct {
+	Name      string `json:"name"`
+	RepoLimit int64  `json:"repo_limit"`
+	Hosts     int64  `json:"hosts"`
+}
+
+type RepoLimitTiersResponse struct {
+	Tiers      []RepoLimitTier `json:"tiers"`
+	Promotions []TierPromotion `json:"promotions"`
+}
+
+type RepoStorage struct {
+	Did    string `json:"did"`
+	Uid    uint64 `json:"uid"`
+	Bytes  int64  `json:"bytes"`
+	Shards int64  `json:"shards"`
+}
+
+type RepoTrashResponse struct {
+	Entries []TrashedRepo `json:"entries"`
+}
+
+type RevReportResponse struct {
+	Since time.Time           `json:"since"`
+	Hosts []HostRevOrderStats `json:"hosts"`
+}
+
+type RevViolation struct {
+	Kind    string    `json:"kind"`
+	Repo    string    `json:"repo"`
+	Rev     string    `json:"rev"`
+	LastRev string    `json:"last_rev,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+type ScrubFinding struct {
+	Shard        uint                   `json:"shard"`
+	Usr          uint64                 `json:"uid"`
+	Path         string                 `json:"path"`
+	Rev          string                 `json:"rev"`
+	Blocks       int                    `json:"blocks"`
+	Problems     []CarstoreScrubProblem `json:"problems,omitempty"`
+	Did          string                 `json:"did"`
+	FoundAt      time.Time              `json:"found_at"`
+	Refetched    bool                   `json:"refetched"`
+	RefetchError string                 `json:"refetch_error,omitempty"`
+}
+
+type ScrubReport struct {
+	Enabled       bool           `json:"enabled"`
+	Refetch       bool           `json:"refetch"`
+	Cursor        uint           `json:"cursor"`
+	ShardsChecked int64          `json:"shards_checked"`
+	CorruptShards int64          `json:"corrupt_shards"`
+	Walks         int64          `json:"walks"`
+	LastBatch     *time.Time     `json:"last_batch,omitempty"`
+	Findings      []ScrubFinding `json:"findings"`
+}
+
+type StorageQuotaChangeRequest struct {
+	Host  string `json:"host"`
+	Quota int64  `json:"quota"`
+}
+
+type TierChangeRequest struct {
+	Host     string `json:"host"`
+	Tier     string `json:"tier"`
+	Unpinned bool   `json:"unpinned,omitempty"`
+}
+
+type TierPromotion struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	MinAge   int64  `json:"min_age"`
+	CleanFor int64  `json:"clean_for"`
+}
+
+type TrashedRepo struct {
+	ID        string    `json:"id"`
+	Did       string    `json:"did"`
+	Uid       uint64    `json:"uid"`
+	Reason    string    `json:"reason"`
+	TrashedAt time.Time `json:"trashedAt"`
+	Bytes     int64     `json:"bytes"`
+	Shards    int       `json:"shards"`
+}
+
+// GetActions list admin actions from the audit log, newest first
+func (c *Client) GetActions(ctx context.Context, since *string, until *string, actor *string, path *string, cursor *int64, limit *int64) (*AdminActionsResponse, error) {
+	q := url.Values{}
+	if since != nil {
+		q.Set("since", *since)
+	}
+	if until != nil {
+		q.Set("until", *until)
+	}
+	if actor != nil {
+		q.Set("actor", *actor)
+	}
+	if path != nil {
+		q.Set("path", *path)
+	}
+	if cursor != nil {
+		q.Set("cursor", strconv.FormatInt(*cursor, 10))
+	}
+	if limit != nil {
+		q.Set("limit", strconv.FormatInt(*limit, 10))
+	}
+	var out AdminActionsResponse
+	if err := c.do(ctx, "GET", "/admin/actions", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetBlobsRefs list blob references from the blob reference index, either the records referencing a blob or the blobs a repo's records reference
+func (c *Client) GetBlobsRefs(ctx context.Context, cid *string, did *string, collection *string, cursor *int64, limit *int64) (*BlobRefsResponse, error) {
+	q := url.Values{}
+	if cid != nil {
+		q.Set("cid", *cid)
+	}
+	if did != nil {
+		q.Set("did", *did)
+	}
+	if collection != nil {
+		q.Set("collection", *collection)
+	}
+	if cursor != nil {
+		q.Set("cursor", strconv.FormatInt(*cursor, 10))
+	}
+	if limit != nil {
+		q.Set("limit", strconv.FormatInt(*limit, 10))
+	}
+	var out BlobRefsResponse
+	if err := c.do(ctx, "GET", "/admin/blobs/refs", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetCollectionsRegistry list the collections records have been seen in, newest first, with where each was first seen, record counts and a sample record
+func (c *Client) GetCollectionsRegistry(ctx context.Context, status *string, limit *int64) (*CollectionRegistryResponse, error) {
+	q := url.Values{}
+	if status != nil {
+		q.Set("status", *status)
+	}
+	if limit != nil {
+		q.Set("limit", strconv.FormatInt(*limit, 10))
+	}
+	var out CollectionRegistryResponse
+	if err := c.do(ctx, "GET", "/admin/collections/registry", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetConsumersHistory list firehose consumers seen over time, with connection and traffic totals
+func (c *Client) GetConsumersHistory(ctx context.Context, sort *string, host *string, limit *int64) ([]FirehoseConsumer, error) {
+	q := url.Values{}
+	if sort != nil {
+		q.Set("sort", *sort)
+	}
+	if host != nil {
+		q.Set("host", *host)
+	}
+	if limit != nil {
+		q.Set("limit", strconv.FormatInt(*limit, 10))
+	}
+	var out []FirehoseConsumer
+	if err := c.do(ctx, "GET", "/admin/consumers/history", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetConsumersList list connected firehose consumers
+func (c *Client) GetConsumersList(ctx context.Context) ([]Consumer, error) {
+	var out []Consumer
+	if err := c.do(ctx, "GET", "/admin/consumers/list", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetCrawlFetchFailures list repos whose crawls have failed, either awaiting retry or dead-lettered
+func (c *Client) GetCrawlFetchFailures(ctx context.Context, dead *bool, cursor *int64, limit *int64) (*FetchFailuresResponse, error) {
+	q := url.Values{}
+	if dead != nil {
+		q.Set("dead", strconv.FormatBool(*dead))
+	}
+	if cursor != nil {
+		q.Set("cursor", strconv.FormatInt(*cursor, 10))
+	}
+	if limit != nil {
+		q.Set("limit", strconv.FormatInt(*limit, 10))
+	}
+	var out FetchFailuresResponse
+	if err := c.do(ctx, "GET", "/admin/crawl/fetchFailures", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetCrawlHostBudgets list each host's share of the crawl fetch workers and the worker time its crawls have used
+func (c *Client) GetCrawlHostBudgets(ctx context.Context) (*CrawlHostBudgetsResponse, error) {
+	var out CrawlHostBudgetsResponse
+	if err := c.do(ctx, "GET", "/admin/crawl/hostBudgets", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetCrawlPriorities get crawl scheduling weights, overrides and queue depths
+func (c *Client) GetCrawlPriorities(ctx context.Context) (*IndexerCrawlPriorityConfig, error) {
+	var out IndexerCrawlPriorityConfig
+	if err := c.do(ctx, "GET", "/admin/crawl/priorities", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetDebugPprofProfile capture a CPU profile, for go tool pprof
+func (c *Client) GetDebugPprofProfile(ctx context.Context, seconds *int64) ([]byte, error) {
+	q := url.Values{}
+	if seconds != nil {
+		q.Set("seconds", strconv.FormatInt(*seconds, 10))
+	}
+	var out []byte
+	if err := c.do(ctx, "GET", "/admin/debug/pprof/profile", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetDebugPprofTrace capture a runtime execution trace, for go tool trace
+func (c *Client) GetDebugPprofTrace(ctx context.Context, seconds *int64) ([]byte, error) {
+	q := url.Values{}
+	if seconds != nil {
+		q.Set("seconds", strconv.FormatInt(*seconds, 10))
+	}
+	var out []byte
+	if err := c.do(ctx, "GET", "/admin/debug/pprof/trace", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetFaults get the faults being injected
+func (c *Client) GetFaults(ctx context.Context) (*FaultInjectionState, error) {
+	var out FaultInjectionState
+	if err := c.do(ctx, "GET", "/admin/faults", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetGossipPeers get how the last gossip with each peer relay went
+func (c *Client) GetGossipPeers(ctx context.Context) (*GossipPeersResponse, error) {
+	var out GossipPeersResponse
+	if err := c.do(ctx, "GET", "/admin/gossip/peers", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetIngestFlagged list the latest commits scoring above a content score threshold, newest first
+func (c *Client) GetIngestFlagged(ctx context.Context, limit *int64) (*FlaggedCommitsResponse, error) {
+	q := url.Values{}
+	if limit != nil {
+		q.Set("limit", strconv.FormatInt(*limit, 10))
+	}
+	var out FlaggedCommitsResponse
+	if err := c.do(ctx, "GET", "/admin/ingest/flagged", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetIngestRevReport count each PDS's commits that broke rev ordering (out of order, duplicate or future dated) since the relay started
+func (c *Client) GetIngestRevReport(ctx context.Context, host *string, sort *string, limit *int64) (*RevReportResponse, error) {
+	q := url.Values{}
+	if host != nil {
+		q.Set("host", *host)
+	}
+	if sort != nil {
+		q.Set("sort", *sort)
+	}
+	if limit != nil {
+		q.Set("limit", strconv.FormatInt(*limit, 10))
+	}
+	var out RevReportResponse
+	if err := c.do(ctx, "GET", "/admin/ingest/revReport", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetIngestStages list the stages events from PDSs pass through, in order, and whether each is enabled
+func (c *Client) GetIngestStages(ctx context.Context) (*IngestStagesResponse, error) {
+	var out IngestStagesResponse
+	if err := c.do(ctx, "GET", "/admin/ingest/stages", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetOpenapiJson this document
+func (c *Client) GetOpenapiJson(ctx context.Context) (map[string]any, error) {
+	var out map[string]any
+	if err := c.do(ctx, "GET", "/admin/openapi.json", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetPdsGrowth list the PDSs whose repo counts grew the most within the growth monitor's window
+func (c *Client) GetPdsGrowth(ctx context.Context, limit *int64) (*PdsGrowthResponse, error) {
+	q := url.Values{}
+	if limit != nil {
+		q.Set("limit", strconv.FormatInt(*limit, 10))
+	}
+	var out PdsGrowthResponse
+	if err := c.do(ctx, "GET", "/admin/pds/growth", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetPdsList list known PDSs with their limits and connection state
+func (c *Client) GetPdsList(ctx context.Context) ([]EnrichedPDS, error) {
+	var out []EnrichedPDS
+	if err := c.do(ctx, "GET", "/admin/pds/list", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetPdsResync get the status of a PDS resync
+func (c *Client) GetPdsResync(ctx context.Context, host string) (map[string]any, error) {
+	q := url.Values{}
+	q.Set("host", host)
+	var out map[string]any
+	if err := c.do(ctx, "GET", "/admin/pds/resync", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetPdsStatsHistory get a PDS's event rate, error rate and repo count over time
+func (c *Client) GetPdsStatsHistory(ctx context.Context, host string, since *string, until *string, resolution *string) (*PdsStatsHistoryResponse, error) {
+	q := url.Values{}
+	q.Set("host", host)
+	if since != nil {
+		q.Set("since", *since)
+	}
+	if until != nil {
+		q.Set("until", *until)
+	}
+	if resolution != nil {
+		q.Set("resolution", *resolution)
+	}
+	var out PdsStatsHistoryResponse
+	if err := c.do(ctx, "GET", "/admin/pds/statsHistory", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetPolicy get the defederation policy's rules, and the most recent actions it took, newest first
+func (c *Client) GetPolicy(ctx context.Context) (*PolicyResponse, error) {
+	var out PolicyResponse
+	if err := c.do(ctx, "GET", "/admin/policy", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetRepoAudits list repo audit results, newest first
+func (c *Client) GetRepoAudits(ctx context.Context, did *string, status *string, cursor *int64, limit *int64) (*RepoAuditsResponse, error) {
+	q := url.Values{}
+	if did != nil {
+		q.Set("did", *did)
+	}
+	if status != nil {
+		q.Set("status", *status)
+	}
+	if cursor != nil {
+		q.Set("cursor", strconv.FormatInt(*cursor, 10))
+	}
+	if limit != nil {
+		q.Set("limit", strconv.FormatInt(*limit, 10))
+	}
+	var out RepoAuditsResponse
+	if err := c.do(ctx, "GET", "/admin/repo/audits", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetRepoHistory list the latest events the relay persisted for a repo, newest first, including repos that aren't served
+func (c *Client) GetRepoHistory(ctx context.Context, did string, limit *int64) (*RepoHistoryResponse, error) {
+	q := url.Values{}
+	q.Set("did", did)
+	if limit != nil {
+		q.Set("limit", strconv.FormatInt(*limit, 10))
+	}
+	var out RepoHistoryResponse
+	if err := c.do(ctx, "GET", "/admin/repo/history", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetRepoTrash list repo data removed by takedowns and deletions that can still be restored
+func (c *Client) GetRepoTrash(ctx context.Context, did *string) (*RepoTrashResponse, error) {
+	q := url.Values{}
+	if did != nil {
+		q.Set("did", *did)
+	}
+	var out RepoTrashResponse
+	if err := c.do(ctx, "GET", "/admin/repo/trash", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetStoragePds list PDSs by carstore usage, largest first
+func (c *Client) GetStoragePds(ctx context.Context, overQuota *bool, limit *int64) ([]PdsStorage, error) {
+	q := url.Values{}
+	if overQuota != nil {
+		q.Set("overQuota", strconv.FormatBool(*overQuota))
+	}
+	if limit != nil {
+		q.Set("limit", strconv.FormatInt(*limit, 10))
+	}
+	var out []PdsStorage
+	if err := c.do(ctx, "GET", "/admin/storage/pds", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetStorageRepo get the carstore usage of a repo
+func (c *Client) GetStorageRepo(ctx context.Context, did string) (*RepoStorage, error) {
+	q := url.Values{}
+	q.Set("did", did)
+	var out RepoStorage
+	if err := c.do(ctx, "GET", "/admin/storage/repo", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetStorageRepos list the repos using the most carstore space
+func (c *Client) GetStorageRepos(ctx context.Context, limit *int64) ([]RepoStorage, error) {
+	q := url.Values{}
+	if limit != nil {
+		q.Set("limit", strconv.FormatInt(*limit, 10))
+	}
+	var out []RepoStorage
+	if err := c.do(ctx, "GET", "/admin/storage/repos", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetStorageScrub get what the carstore scrubber has checked, and the corrupt shards it found
+func (c *Client) GetStorageScrub(ctx context.Context) (*ScrubReport, error) {
+	var out ScrubReport
+	if err := c.do(ctx, "GET", "/admin/storage/scrub", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetSubsGetEnabled get whether new PDS subscriptions are enabled
+func (c *Client) GetSubsGetEnabled(ctx context.Context) (map[string]bool, error) {
+	var out map[string]bool
+	if err := c.do(ctx, "GET", "/admin/subs/getEnabled", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetSubsGetUpstreamConns list hosts with an active upstream connection
+func (c *Client) GetSubsGetUpstreamConns(ctx context.Context) ([]string, error) {
+	var out []string
+	if err := c.do(ctx, "GET", "/admin/subs/getUpstreamConns", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetSubsHealth get the health of each upstream connection
+func (c *Client) GetSubsHealth(ctx context.Context, sort *string, limit *int64) ([]HostConnHealth, error) {
+	q := url.Values{}
+	if sort != nil {
+		q.Set("sort", *sort)
+	}
+	if limit != nil {
+		q.Set("limit", strconv.FormatInt(*limit, 10))
+	}
+	var out []HostConnHealth
+	if err := c.do(ctx, "GET", "/admin/subs/health", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetSubsListDomainBans list banned domains
+func (c *Client) GetSubsListDomainBans(ctx context.Context) (*BannedDomains, error) {
+	var out BannedDomains
+	if err := c.do(ctx, "GET", "/admin/subs/listDomainBans", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetSubsPerDayLimit get the limit on new PDS subscriptions per day
+func (c *Client) GetSubsPerDayLimit(ctx context.Context) (map[string]int64, error) {
+	var out map[string]int64
+	if err := c.do(ctx, "GET", "/admin/subs/perDayLimit", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetTiers list repo limit tiers with the number of hosts in each, and the automatic promotion rules
+func (c *Client) GetTiers(ctx context.Context) (*RepoLimitTiersResponse, error) {
+	var out RepoLimitTiersResponse
+	if err := c.do(ctx, "GET", "/admin/tiers", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostCollectionsApprove approve a collection, so commits in it are sent out on the firehose, along with those held back until now
+func (c *Client) PostCollectionsApprove(ctx context.Context, body CollectionReviewRequest) (*RegisteredCollection, error) {
+	var out RegisteredCollection
+	if err := c.do(ctx, "POST", "/admin/collections/approve", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostCollectionsReject reject a collection, so commits in it stay held back from the firehose while quarantine is on
+func (c *Client) PostCollectionsReject(ctx context.Context, body CollectionReviewRequest) (*RegisteredCollection, error) {
+	var out RegisteredCollection
+	if err := c.do(ctx, "POST", "/admin/collections/reject", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostConsumersReplay send a range of past events again, into a connected consumer's stream, or over a replay connection opened with the returned ticket if consumer_id is unset
+func (c *Client) PostConsumersReplay(ctx context.Context, body ReplayEventsRequest) (*ReplayEventsResponse, error) {
+	var out ReplayEventsResponse
+	if err := c.do(ctx, "POST", "/admin/consumers/replay", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostCrawlRetryFetch reset a failed repo's retry schedule so it is crawled again shortly
+func (c *Client) PostCrawlRetryFetch(ctx context.Context, did *string, all *bool) (*ApiSuccessResponse, error) {
+	q := url.Values{}
+	if did != nil {
+		q.Set("did", *did)
+	}
+	if all != nil {
+		q.Set("all", strconv.FormatBool(*all))
+	}
+	var out ApiSuccessResponse
+	if err := c.do(ctx, "POST", "/admin/crawl/retryFetch", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostCrawlSetHostWeight set a host's weight in sharing the crawl fetch workers with other hosts
+func (c *Client) PostCrawlSetHostWeight(ctx context.Context, body CrawlHostWeightRequest) (*ApiSuccessResponse, error) {
+	var out ApiSuccessResponse
+	if err := c.do(ctx, "POST", "/admin/crawl/setHostWeight", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostCrawlSetPriority set or clear the crawl priority override for a host or repo
+func (c *Client) PostCrawlSetPriority(ctx context.Context, body CrawlPriorityChangeRequest) (*ApiSuccessResponse, error) {
+	var out ApiSuccessResponse
+	if err := c.do(ctx, "POST", "/admin/crawl/setPriority", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostCrawlSetWeights set crawl priority class weights
+func (c *Client) PostCrawlSetWeights(ctx context.Context, body map[string]int) (*IndexerCrawlPriorityConfig, error) {
+	var out IndexerCrawlPriorityConfig
+	if err := c.do(ctx, "POST", "/admin/crawl/setWeights", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostFaults replace the faults being injected
+func (c *Client) PostFaults(ctx context.Context, body FaultConfig) (*FaultInjectionState, error) {
+	var out FaultInjectionState
+	if err := c.do(ctx, "POST", "/admin/faults", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostFaultsClear stop injecting faults
+func (c *Client) PostFaultsClear(ctx context.Context) (*FaultInjectionState, error) {
+	var out FaultInjectionState
+	if err := c.do(ctx, "POST", "/admin/faults/clear", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostGossipRun fetch every gossip peer's host list and request the new hosts on them now, rather than waiting for the next scheduled pass
+func (c *Client) PostGossipRun(ctx context.Context) (*GossipPeersResponse, error) {
+	var out GossipPeersResponse
+	if err := c.do(ctx, "POST", "/admin/gossip/run", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostIngestSetStage enable or disable an ingest stage
+func (c *Client) PostIngestSetStage(ctx context.Context, name string, enabled bool) (*ApiSuccessResponse, error) {
+	q := url.Values{}
+	q.Set("name", name)
+	q.Set("enabled", strconv.FormatBool(enabled))
+	var out ApiSuccessResponse
+	if err := c.do(ctx, "POST", "/admin/ingest/setStage", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostPdsAddTrustedDomain trust a domain suffix, exempting its PDSs from new PDS limits
+func (c *Client) PostPdsAddTrustedDomain(ctx context.Context, domain string) (*ApiSuccessResponse, error) {
+	q := url.Values{}
+	q.Set("domain", domain)
+	var out ApiSuccessResponse
+	if err := c.do(ctx, "POST", "/admin/pds/addTrustedDomain", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostPdsAudit audit every repo on a PDS in the background
+func (c *Client) PostPdsAudit(ctx context.Context, host *string, limit *int64, repair *bool) (*ApiSuccessResponse, error) {
+	q := url.Values{}
+	if host != nil {
+		q.Set("host", *host)
+	}
+	if limit != nil {
+		q.Set("limit", strconv.FormatInt(*limit, 10))
+	}
+	if repair != nil {
+		q.Set("repair", strconv.FormatBool(*repair))
+	}
+	var out ApiSuccessResponse
+	if err := c.do(ctx, "POST", "/admin/pds/audit", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostPdsBlock block a PDS and disconnect from it
+func (c *Client) PostPdsBlock(ctx context.Context, host string) (*ApiSuccessResponse, error) {
+	q := url.Values{}
+	q.Set("host", host)
+	var out ApiSuccessResponse
+	if err := c.do(ctx, "POST", "/admin/pds/block", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostPdsChangeLimits change a PDS's rate limits
+func (c *Client) PostPdsChangeLimits(ctx context.Context, body RateLimitChangeRequest) (*ApiSuccessResponse, error) {
+	var out ApiSuccessResponse
+	if err := c.do(ctx, "POST", "/admin/pds/changeLimits", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostPdsImport validate and subscribe to many PDSs at once; also accepts a text/plain list of hostnames, one per line
+func (c *Client) PostPdsImport(ctx context.Context, skipValidation *bool, body AdminImportHostsRequest) (*AdminImportHostsResponse, error) {
+	q := url.Values{}
+	if skipValidation != nil {
+		q.Set("skip_validation", strconv.FormatBool(*skipValidation))
+	}
+	var out AdminImportHostsResponse
+	if err := c.do(ctx, "POST", "/admin/pds/import", q, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostPdsRecountStorage recompute a PDS's storage total from the current size of its accounts' repos
+func (c *Client) PostPdsRecountStorage(ctx context.Context, host string) (map[string]any, error) {
+	q := url.Values{}
+	q.Set("host", host)
+	var out map[string]any
+	if err := c.do(ctx, "POST", "/admin/pds/recountStorage", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PostPdsRequestCrawl subscribe to a PDS, bypassing new PDS limits
+func (c *Client) PostPdsRequestCrawl(ctx context.Context, body AdminRequestCrawlRequest) error {
+	return c.do(ctx, "POST", "/admin/pds/requestCrawl", nil, body, nil)
+}
+
+// PostPdsResync start a resync of all repos on a PDS
+func (c *Client) PostPdsResync(ctx context.Context, host string) (map[string]any, error) {
+	q := url.Values{}
+	q.Set("host", host)
+	var out map[string]any
+	if err := c.do(ctx, "POST", "/admin/pds/resync", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PostPdsSetStorageQuota set a PDS's storage quota; hosts over quota are disconnected until it is raised
+func (c *Client) PostPdsSetStorageQuota(ctx context.Context, body StorageQuotaChangeRequest) (*ApiSuccessResponse, error) {
+	var out ApiSuccessResponse
+	if err := c.do(ctx, "POST", "/admin/pds/setStorageQuota", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostPdsSetTier move a PDS to a repo limit tier, setting its repo limit to the tier's; pinned unless unpinned is set
+func (c *Client) PostPdsSetTier(ctx context.Context, body TierChangeRequest) (map[string]any, error) {
+	var out map[string]any
+	if err := c.do(ctx, "POST", "/admin/pds/setTier", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PostPdsUnblock unblock a PDS
+func (c *Client) PostPdsUnblock(ctx context.Context, host string) (*ApiSuccessResponse, error) {
+	q := url.Values{}
+	q.Set("host", host)
+	var out ApiSuccessResponse
+	if err := c.do(ctx, "POST", "/admin/pds/unblock", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostPolicyOverride lift a host's defederation policy pause, and exempt it from the policy or clear its exemption if exempt is set; policy blocks are lifted with /admin/pds/unblock
+func (c *Client) PostPolicyOverride(ctx context.Context, body PolicyOverrideRequest) (map[string]any, error) {
+	var out map[string]any
+	if err := c.do(ctx, "POST", "/admin/policy/override", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PostRepoAudit compare a repo's stored state against a fresh copy from its PDS
+func (c *Client) PostRepoAudit(ctx context.Context, did *string, repair *bool) (*IndexerRepoAudit, error) {
+	q := url.Values{}
+	if did != nil {
+		q.Set("did", *did)
+	}
+	if repair != nil {
+		q.Set("repair", strconv.FormatBool(*repair))
+	}
+	var out IndexerRepoAudit
+	if err := c.do(ctx, "POST", "/admin/repo/audit", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostRepoCompact compact a repo's shards
+func (c *Client) PostRepoCompact(ctx context.Context, did string, fast *bool) (map[string]any, error) {
+	q := url.Values{}
+	q.Set("did", did)
+	if fast != nil {
+		q.Set("fast", strconv.FormatBool(*fast))
+	}
+	var out map[string]any
+	if err := c.do(ctx, "POST", "/admin/repo/compact", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PostRepoCompactAll queue compaction of all repos needing it
+func (c *Client) PostRepoCompactAll(ctx context.Context, fast *bool, limit *int64, threshold *int64) (map[string]any, error) {
+	q := url.Values{}
+	if fast != nil {
+		q.Set("fast", strconv.FormatBool(*fast))
+	}
+	if limit != nil {
+		q.Set("limit", strconv.FormatInt(*limit, 10))
+	}
+	if threshold != nil {
+		q.Set("threshold", strconv.FormatInt(*threshold, 10))
+	}
+	var out map[string]any
+	if err := c.do(ctx, "POST", "/admin/repo/compactAll", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PostRepoImport replace a repo's data with a CAR archive of the whole repo
+func (c *Client) PostRepoImport(ctx context.Context, did string, force *bool, body io.Reader) (*RepoImportResponse, error) {
+	q := url.Values{}
+	q.Set("did", did)
+	if force != nil {
+		q.Set("force", strconv.FormatBool(*force))
+	}
+	var out RepoImportResponse
+	if err := c.do(ctx, "POST", "/admin/repo/import", q, rawBody{contentType: "application/vnd.ipld.car", r: body}, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostRepoReset wipe and re-crawl a repo
+func (c *Client) PostRepoReset(ctx context.Context, did string) (*ApiSuccessResponse, error) {
+	q := url.Values{}
+	q.Set("did", did)
+	var out ApiSuccessResponse
+	if err := c.do(ctx, "POST", "/admin/repo/reset", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostRepoRestore restore a repo's data from the trash
+func (c *Client) PostRepoRestore(ctx context.Context, did string, id *string) (map[string]any, error) {
+	q := url.Values{}
+	q.Set("did", did)
+	if id != nil {
+		q.Set("id", *id)
+	}
+	var out map[string]any
+	if err := c.do(ctx, "POST", "/admin/repo/restore", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PostRepoReverifyAllHandles start a background handle verification pass over all repos
+func (c *Client) PostRepoReverifyAllHandles(ctx context.Context) (*ApiSuccessResponse, error) {
+	var out ApiSuccessResponse
+	if err := c.do(ctx, "POST", "/admin/repo/reverifyAllHandles", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostRepoReverifyHandle re-verify a repo's handle, emitting #identity if it changed
+func (c *Client) PostRepoReverifyHandle(ctx context.Context, did string) (map[string]any, error) {
+	q := url.Values{}
+	q.Set("did", did)
+	var out map[string]any
+	if err := c.do(ctx, "POST", "/admin/repo/reverifyHandle", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PostRepoReverseTakedown reverse a repo takedown
+func (c *Client) PostRepoReverseTakedown(ctx context.Context, did string) error {
+	q := url.Values{}
+	q.Set("did", did)
+	return c.do(ctx, "POST", "/admin/repo/reverseTakedown", q, nil, nil)
+}
+
+// PostRepoTakeDown take down a repo
+func (c *Client) PostRepoTakeDown(ctx context.Context, body map[string]string) error {
+	return c.do(ctx, "POST", "/admin/repo/takeDown", nil, body, nil)
+}
+
+// PostRepoVerify verify a repo's stored data against its commit
+func (c *Client) PostRepoVerify(ctx context.Context, did string) (*ApiSuccessResponse, error) {
+	q := url.Values{}
+	q.Set("did", did)
+	var out ApiSuccessResponse
+	if err := c.do(ctx, "POST", "/admin/repo/verify", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostSubsBanDomain ban a domain and its subdomains
+func (c *Client) PostSubsBanDomain(ctx context.Context, body BanDomainBody) (*ApiSuccessResponse, error) {
+	var out ApiSuccessResponse
+	if err := c.do(ctx, "POST", "/admin/subs/banDomain", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostSubsKillUpstream disconnect from a PDS, optionally blocking it
+func (c *Client) PostSubsKillUpstream(ctx context.Context, host string, block *bool) (*ApiSuccessResponse, error) {
+	q := url.Values{}
+	q.Set("host", host)
+	if block != nil {
+		q.Set("block", strconv.FormatBool(*block))
+	}
+	var out ApiSuccessResponse
+	if err := c.do(ctx, "POST", "/admin/subs/killUpstream", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostSubsSetEnabled enable or disable new PDS subscriptions
+func (c *Client) PostSubsSetEnabled(ctx context.Context, enabled bool) error {
+	q := url.Values{}
+	q.Set("enabled", strconv.FormatBool(enabled))
+	return c.do(ctx, "POST", "/admin/subs/setEnabled", q, nil, nil)
+}
+
+// PostSubsSetPerDayLimit set the limit on new PDS subscriptions per day
+func (c *Client) PostSubsSetPerDayLimit(ctx context.Context, limit int64) error {
+	q := url.Values{}
+	q.Set("limit", strconv.FormatInt(limit, 10))
+	return c.do(ctx, "POST", "/admin/subs/setPerDayLimit", q, nil, nil)
+}
+
+// PostSubsUnbanDomain remove a domain ban
+func (c *Client) PostSubsUnbanDomain(ctx context.Context, body BanDomainBody) (*ApiSuccessResponse, error) {
+	var out ApiSuccessResponse
+	if err := c.do(ctx, "POST", "/admin/subs/unbanDomain", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PostTiersPromote promote every eligible host now, rather than waiting for the next scheduled pass
+func (c *Client) PostTiersPromote(ctx context.Context) (map[string]int, error) {
+	var out map[string]int
+	if err := c.do(ctx, "POST", "/admin/tiers/promote", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
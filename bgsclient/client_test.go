@@ -0,0 +1,79 @@
+package bgsclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/bluesky-social/indigo/bgs"
+)
+
+func TestGeneratedClientUpToDate(t *testing.T) {
+	var buf bytes.Buffer
+	if err := bgs.WriteAdminClient(&buf, "bgsclient"); err != nil {
+		t.Fatal(err)
+	}
+	cur, err := os.ReadFile("client_gen.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), cur) {
+		t.Fatal("client_gen.go is out of date with the relay's admin routes, run go generate ./bgsclient")
+	}
+}
+
+func TestClientRequests(t *testing.T) {
+	var gotAuth, gotQuery string
+	var gotBody map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		gotQuery = r.URL.RawQuery
+		switch r.URL.Path {
+		case "/admin/subs/killUpstream":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"success":"true"}`))
+		case "/admin/pds/changeLimits":
+			json.NewDecoder(r.Body).Decode(&gotBody)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"BadRequest","message":"no such host"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL+"/", "secret")
+	ctx := context.Background()
+
+	block := true
+	resp, err := c.PostSubsKillUpstream(ctx, "pds.example.com", &block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Success != "true" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	if gotAuth != "Bearer secret" {
+		t.Fatalf("unexpected auth header %q", gotAuth)
+	}
+	if gotQuery != "block=true&host=pds.example.com" {
+		t.Fatalf("unexpected query %q", gotQuery)
+	}
+
+	_, err = c.PostPdsChangeLimits(ctx, RateLimitChangeRequest{Host: "pds.example.com", PerSecond: 50})
+	var rerr *Error
+	if !errors.As(err, &rerr) {
+		t.Fatalf("expected an *Error, got %v", err)
+	}
+	if rerr.StatusCode != http.StatusBadRequest || rerr.Message != "no such host" {
+		t.Fatalf("unexpected error: %+v", rerr)
+	}
+	if gotBody["host"] != "pds.example.com" || gotBody["per_second"] != float64(50) {
+		t.Fatalf("unexpected request body: %v", gotBody)
+	}
+}
@@ -0,0 +1,27 @@
+// Command gen writes the generated methods of bgsclient.Client
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/bluesky-social/indigo/bgs"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: gen <output file>")
+		os.Exit(2)
+	}
+
+	var buf bytes.Buffer
+	if err := bgs.WriteAdminClient(&buf, "bgsclient"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(os.Args[1], buf.Bytes(), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,94 @@
+package bgstest
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fc := NewFakeClock(start)
+
+	tk := fc.NewTicker(time.Minute)
+	defer tk.Stop()
+
+	slept := make(chan error, 1)
+	go func() {
+		slept <- fc.Sleep(context.Background(), 90*time.Second)
+	}()
+	fc.BlockUntil(2)
+
+	fc.Advance(time.Minute)
+	if got := <-tk.C(); !got.Equal(start.Add(time.Minute)) {
+		t.Fatalf("ticked at %s", got)
+	}
+	select {
+	case <-slept:
+		t.Fatal("sleep returned early")
+	default:
+	}
+
+	// ticks nobody reads are dropped
+	fc.Advance(3 * time.Minute)
+	if err := <-slept; err != nil {
+		t.Fatal(err)
+	}
+	if got := <-tk.C(); !got.Equal(start.Add(2 * time.Minute)) {
+		t.Fatalf("ticked at %s", got)
+	}
+	select {
+	case <-tk.C():
+		t.Fatal("missed ticks were queued")
+	default:
+	}
+	if fc.Since(start) != 4*time.Minute {
+		t.Fatalf("clock at %s", fc.Now())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := fc.Sleep(ctx, time.Hour); err != context.Canceled {
+		t.Fatalf("expected the sleep to be cancelled, got %v", err)
+	}
+	if n := fc.Waiters(); n != 1 {
+		t.Fatalf("expected only the ticker to be waiting, got %d", n)
+	}
+}
+
+func TestRelayFromPDS(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	dir := NewDirectory()
+
+	pds := NewPDS(t, dir, clock)
+	alice := pds.CreateAccount("alice.test")
+	bob := pds.CreateAccount("bob.test")
+
+	relay := NewRelay(t, dir, clock, nil)
+	stream := relay.Subscribe(-1)
+	relay.RequestCrawl(pds)
+
+	// the accounts' first commits are played back to the relay; they're
+	// only ordered within each repo, so may come out either way round
+	evts := stream.WaitFor(2)
+	first, second := evts[0].RepoCommit.Repo, evts[1].RepoCommit.Repo
+	if !(first == alice.DID && second == bob.DID) && !(first == bob.DID && second == alice.DID) {
+		t.Fatalf("unexpected initial commits from %s and %s", first, second)
+	}
+
+	clock.Advance(time.Hour)
+	rkey := alice.Post("hello relay")
+	alice.DeleteRecord("app.bsky.feed.post", rkey)
+
+	evts = stream.WaitFor(4)
+	post, del := evts[2].RepoCommit, evts[3].RepoCommit
+	if post.Repo != alice.DID || len(post.Ops) != 1 || post.Ops[0].Action != "create" {
+		t.Fatalf("unexpected post commit: %+v", post)
+	}
+	if post.Ops[0].Path != "app.bsky.feed.post/"+rkey {
+		t.Fatalf("unexpected post path %s", post.Ops[0].Path)
+	}
+	if del.Ops[0].Action != "delete" || del.Since == nil || *del.Since != post.Rev {
+		t.Fatalf("unexpected delete commit: %+v", del)
+	}
+}
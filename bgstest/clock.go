@@ -0,0 +1,166 @@
+package bgstest
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/util"
+)
+
+// FakeClock is a util.Clock that only moves when told to, so tickers and
+// sleeps in the relay fire exactly when a test advances it
+type FakeClock struct {
+	lk      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+var _ util.Clock = (*FakeClock)(nil)
+
+type fakeWaiter struct {
+	at     time.Time
+	period time.Duration
+	c      chan time.Time
+}
+
+func NewFakeClock(start time.Time) *FakeClock {
+	fc := &FakeClock{now: start}
+	fc.cond = sync.NewCond(&fc.lk)
+	return fc
+}
+
+func (fc *FakeClock) Now() time.Time {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	return fc.now
+}
+
+func (fc *FakeClock) Since(t time.Time) time.Duration {
+	return fc.Now().Sub(t)
+}
+
+func (fc *FakeClock) NewTicker(d time.Duration) util.Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	w := &fakeWaiter{at: fc.now.Add(d), period: d, c: make(chan time.Time, 1)}
+	fc.addWaiter(w)
+	return &fakeTicker{fc: fc, w: w}
+}
+
+func (fc *FakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	fc.lk.Lock()
+	w := &fakeWaiter{at: fc.now.Add(d), c: make(chan time.Time, 1)}
+	fc.addWaiter(w)
+	fc.lk.Unlock()
+
+	select {
+	case <-w.c:
+		return nil
+	case <-ctx.Done():
+		fc.removeWaiter(w)
+		return ctx.Err()
+	}
+}
+
+// Advance moves the clock forward by d, firing every ticker and sleep that
+// comes due on the way in order. Ticks a ticker's reader hasn't taken yet
+// are dropped, as with time.Ticker.
+func (fc *FakeClock) Advance(d time.Duration) {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	fc.advanceTo(fc.now.Add(d))
+}
+
+// Set moves the clock to t, which must not be before the current time
+func (fc *FakeClock) Set(t time.Time) {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	if t.Before(fc.now) {
+		panic("FakeClock can't go backwards")
+	}
+	fc.advanceTo(t)
+}
+
+// BlockUntil waits for at least n tickers and sleeps to be waiting on the
+// clock, so a test can be sure a goroutine has reached its wait before
+// advancing past it
+func (fc *FakeClock) BlockUntil(n int) {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	for len(fc.waiters) < n {
+		fc.cond.Wait()
+	}
+}
+
+// Waiters returns how many tickers and sleeps are waiting on the clock
+func (fc *FakeClock) Waiters() int {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	return len(fc.waiters)
+}
+
+func (fc *FakeClock) advanceTo(t time.Time) {
+	for len(fc.waiters) > 0 && !fc.waiters[0].at.After(t) {
+		w := fc.waiters[0]
+		fc.now = w.at
+		select {
+		case w.c <- w.at:
+		default:
+		}
+
+		fc.waiters = fc.waiters[1:]
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+			fc.insertWaiter(w)
+		}
+	}
+	fc.now = t
+}
+
+func (fc *FakeClock) addWaiter(w *fakeWaiter) {
+	fc.insertWaiter(w)
+	fc.cond.Broadcast()
+}
+
+// insertWaiter keeps waiters sorted by when they're due
+func (fc *FakeClock) insertWaiter(w *fakeWaiter) {
+	i := sort.Search(len(fc.waiters), func(i int) bool {
+		return fc.waiters[i].at.After(w.at)
+	})
+	fc.waiters = append(fc.waiters, nil)
+	copy(fc.waiters[i+1:], fc.waiters[i:])
+	fc.waiters[i] = w
+}
+
+func (fc *FakeClock) removeWaiter(w *fakeWaiter) {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	for i, o := range fc.waiters {
+		if o == w {
+			fc.waiters = append(fc.waiters[:i], fc.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+type fakeTicker struct {
+	fc *FakeClock
+	w  *fakeWaiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.w.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.fc.removeWaiter(t.w)
+}
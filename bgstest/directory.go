@@ -0,0 +1,87 @@
+package bgstest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/bluesky-social/indigo/api"
+	"github.com/whyrusleeping/go-did"
+)
+
+// Directory resolves DIDs and handles for accounts registered with it,
+// standing in for the PLC directory and handle resolution. It is a
+// did.Resolver and an api.HandleResolver.
+type Directory struct {
+	lk      sync.RWMutex
+	docs    map[string]*did.Document
+	handles map[string]string
+}
+
+func NewDirectory() *Directory {
+	return &Directory{
+		docs:    make(map[string]*did.Document),
+		handles: make(map[string]string),
+	}
+}
+
+// Register publishes a DID document for an account with the given handle,
+// hosted at the PDS serving endpoint, with key as its atproto signing key.
+// Registering a DID again replaces its document, as a PLC operation would.
+func (d *Directory) Register(didstr, handle, endpoint string, key *did.PubKey) error {
+	id, err := did.ParseDID(didstr)
+	if err != nil {
+		return err
+	}
+	vm, err := did.VerificationMethodFromKey(key)
+	if err != nil {
+		return err
+	}
+
+	doc := &did.Document{
+		Context:     []string{"https://www.w3.org/ns/did/v1"},
+		ID:          id,
+		AlsoKnownAs: []string{"at://" + handle},
+		VerificationMethod: []did.VerificationMethod{{
+			ID:                 didstr + "#atproto",
+			Type:               vm.Type,
+			Controller:         didstr,
+			PublicKeyMultibase: vm.PublicKeyMultibase,
+		}},
+		Service: []did.Service{{
+			Type:            "AtprotoPersonalDataServer",
+			ServiceEndpoint: endpoint,
+		}},
+	}
+
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	if old, ok := d.docs[didstr]; ok && len(old.AlsoKnownAs) > 0 {
+		delete(d.handles, old.AlsoKnownAs[0][len("at://"):])
+	}
+	d.docs[didstr] = doc
+	d.handles[handle] = didstr
+	return nil
+}
+
+func (d *Directory) GetDocument(ctx context.Context, didstr string) (*did.Document, error) {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	doc, ok := d.docs[didstr]
+	if !ok {
+		return nil, fmt.Errorf("unknown DID %s", didstr)
+	}
+	return doc, nil
+}
+
+func (d *Directory) FlushCacheFor(didstr string) {}
+
+func (d *Directory) ResolveHandleToDid(ctx context.Context, handle string) (string, error) {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	didstr, ok := d.handles[handle]
+	if !ok {
+		return "", fmt.Errorf("unknown handle %s: %w", handle, api.ErrHandleNotFound)
+	}
+	return didstr, nil
+}
@@ -0,0 +1,338 @@
+package bgstest
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	bsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/carstore"
+	"github.com/bluesky-social/indigo/events"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/repomgr"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/gorilla/websocket"
+	"github.com/ipfs/go-cid"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"github.com/whyrusleeping/go-did"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// PDS is an in-memory stand-in for a PDS: it hosts signed repos for its
+// accounts and serves the sync endpoints a relay uses, describeServer,
+// subscribeRepos and getRepo, over plain HTTP on localhost
+type PDS struct {
+	t     testing.TB
+	dir   *Directory
+	clock util.Clock
+
+	repoman *repomgr.RepoManager
+	events  *events.EventManager
+
+	lk       sync.Mutex
+	accounts map[string]*Account
+	byUid    map[models.Uid]*Account
+
+	srv *httptest.Server
+}
+
+// Account is an account hosted on a PDS
+type Account struct {
+	DID    string
+	Handle string
+
+	pds *PDS
+	uid models.Uid
+	key *did.PrivKey
+}
+
+// NewPDS starts a PDS that publishes its accounts to dir and stamps events
+// with clock's time. It is shut down when the test ends.
+func NewPDS(t testing.TB, dir *Directory, clock util.Clock) *PDS {
+	t.Helper()
+
+	tmp := t.TempDir()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(tmp, "car.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := carstore.NewCarStore(db, tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &PDS{
+		t:        t,
+		dir:      dir,
+		clock:    util.ClockOrSystem(clock),
+		events:   events.NewEventManager(events.NewMemPersister()),
+		accounts: make(map[string]*Account),
+		byUid:    make(map[models.Uid]*Account),
+	}
+	p.repoman = repomgr.NewRepoManager(cs, &pdsKeys{p})
+	p.repoman.SetEventHandler(p.handleRepoEvent, false)
+
+	// the relay only treats localhost specially, not 127.0.0.1
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/xrpc/com.atproto.server.describeServer", p.handleDescribeServer)
+	mux.HandleFunc("/xrpc/com.atproto.sync.subscribeRepos", p.handleSubscribeRepos)
+	mux.HandleFunc("/xrpc/com.atproto.sync.getRepo", p.handleGetRepo)
+	p.srv = &httptest.Server{Listener: l, Config: &http.Server{Handler: mux}}
+	p.srv.Start()
+
+	t.Cleanup(p.Close)
+	return p
+}
+
+// Host is the PDS's hostname, as given to a relay's requestCrawl
+func (p *PDS) Host() string {
+	return "localhost:" + strconv.Itoa(p.srv.Listener.Addr().(*net.TCPAddr).Port)
+}
+
+// Close stops serving, closing the connections of subscribers
+func (p *PDS) Close() {
+	p.srv.CloseClientConnections()
+	p.srv.Close()
+	_ = p.events.Shutdown(context.Background())
+}
+
+// CreateAccount creates an account with an empty repo and registers it with
+// the directory. Its DID is derived from the handle, so it's the same from
+// run to run.
+func (p *PDS) CreateAccount(handle string) *Account {
+	p.t.Helper()
+	ctx := context.Background()
+
+	key, err := did.GeneratePrivKey(rand.Reader, did.KeyTypeSecp256k1)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(handle))
+	didstr := "did:plc:" + strings.ToLower(base32.StdEncoding.EncodeToString(sum[:]))[:24]
+
+	p.lk.Lock()
+	if _, ok := p.accounts[didstr]; ok {
+		p.lk.Unlock()
+		p.t.Fatalf("account %s already exists", handle)
+	}
+	acc := &Account{
+		DID:    didstr,
+		Handle: handle,
+		pds:    p,
+		uid:    models.Uid(len(p.accounts) + 1),
+		key:    key,
+	}
+	p.accounts[didstr] = acc
+	p.byUid[acc.uid] = acc
+	p.lk.Unlock()
+
+	if err := p.dir.Register(didstr, handle, "http://"+p.Host(), key.Public()); err != nil {
+		p.t.Fatal(err)
+	}
+	if err := p.repoman.InitNewActor(ctx, acc.uid, handle, didstr, "", "", ""); err != nil {
+		p.t.Fatal(err)
+	}
+	return acc
+}
+
+// CreateRecord writes a record to the account's repo, returning its rkey
+func (a *Account) CreateRecord(collection string, rec cbg.CBORMarshaler) (string, cid.Cid) {
+	a.pds.t.Helper()
+	path, cc, err := a.pds.repoman.CreateRecord(context.Background(), a.uid, collection, rec)
+	if err != nil {
+		a.pds.t.Fatal(err)
+	}
+	_, rkey, _ := strings.Cut(path, "/")
+	return rkey, cc
+}
+
+// Post creates a post with the given text, created at the PDS's time
+func (a *Account) Post(text string) string {
+	a.pds.t.Helper()
+	rkey, _ := a.CreateRecord("app.bsky.feed.post", &bsky.FeedPost{
+		Text:      text,
+		CreatedAt: a.pds.clock.Now().UTC().Format(util.ISO8601),
+	})
+	return rkey
+}
+
+// DeleteRecord deletes a record from the account's repo
+func (a *Account) DeleteRecord(collection, rkey string) {
+	a.pds.t.Helper()
+	if err := a.pds.repoman.DeleteRecord(context.Background(), a.uid, collection, rkey); err != nil {
+		a.pds.t.Fatal(err)
+	}
+}
+
+func (p *PDS) account(uid models.Uid) *Account {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	return p.byUid[uid]
+}
+
+func (p *PDS) accountByDid(didstr string) *Account {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	return p.accounts[didstr]
+}
+
+// handleRepoEvent turns repo changes into firehose commits, as the indexer
+// does for a real PDS
+func (p *PDS) handleRepoEvent(ctx context.Context, evt *repomgr.RepoEvent) {
+	acc := p.account(evt.User)
+	if acc == nil {
+		p.t.Errorf("repo event for unknown user %d", evt.User)
+		return
+	}
+
+	ops := make([]*comatproto.SyncSubscribeRepos_RepoOp, 0, len(evt.Ops))
+	for _, op := range evt.Ops {
+		ops = append(ops, &comatproto.SyncSubscribeRepos_RepoOp{
+			Path:   op.Collection + "/" + op.Rkey,
+			Action: string(op.Kind),
+			Cid:    (*lexutil.LexLink)(op.RecCid),
+		})
+	}
+
+	if err := p.events.AddEvent(ctx, &events.XRPCStreamEvent{
+		RepoCommit: &comatproto.SyncSubscribeRepos_Commit{
+			Repo:   acc.DID,
+			Prev:   (*lexutil.LexLink)(evt.OldRoot),
+			Blocks: evt.RepoSlice,
+			Rev:    evt.Rev,
+			Since:  evt.Since,
+			Commit: lexutil.LexLink(evt.NewRoot),
+			Time:   p.clock.Now().UTC().Format(util.ISO8601),
+			Ops:    ops,
+		},
+		PrivUid: evt.User,
+	}); err != nil {
+		p.t.Errorf("failed to add event: %s", err)
+	}
+}
+
+func (p *PDS) handleDescribeServer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&comatproto.ServerDescribeServer_Output{
+		Did:                  "did:web:" + strings.Split(p.Host(), ":")[0],
+		AvailableUserDomains: []string{},
+	})
+}
+
+func (p *PDS) handleGetRepo(w http.ResponseWriter, r *http.Request) {
+	acc := p.accountByDid(r.URL.Query().Get("did"))
+	if acc == nil {
+		http.Error(w, `{"error":"RepoNotFound"}`, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.ipld.car")
+	if err := p.repoman.ReadRepo(r.Context(), acc.uid, r.URL.Query().Get("since"), w); err != nil {
+		p.t.Logf("bgstest pds: reading repo %s: %s", acc.DID, err)
+	}
+}
+
+func (p *PDS) handleSubscribeRepos(w http.ResponseWriter, r *http.Request) {
+	var since *int64
+	if c := r.URL.Query().Get("cursor"); c != "" {
+		n, err := strconv.ParseInt(c, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		since = &n
+	}
+
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// notice the subscriber going away
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	evts, cleanup, err := p.events.Subscribe(ctx, "bgstest", nil, since)
+	if err != nil {
+		return
+	}
+	defer cleanup()
+
+	fw := events.NewFrameWriter(events.StreamVersion1)
+	for {
+		select {
+		case evt, ok := <-evts:
+			if !ok {
+				return
+			}
+			wc, err := conn.NextWriter(websocket.BinaryMessage)
+			if err != nil {
+				return
+			}
+			if err := fw.WriteFrame(wc, evt); err != nil {
+				return
+			}
+			if err := wc.Close(); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pdsKeys signs each account's commits with its own key
+type pdsKeys struct {
+	p *PDS
+}
+
+func (k *pdsKeys) key(didstr string) (*did.PrivKey, error) {
+	acc := k.p.accountByDid(didstr)
+	if acc == nil {
+		return nil, fmt.Errorf("no key for %s", didstr)
+	}
+	return acc.key, nil
+}
+
+func (k *pdsKeys) SignForUser(ctx context.Context, didstr string, msg []byte) ([]byte, error) {
+	key, err := k.key(didstr)
+	if err != nil {
+		return nil, err
+	}
+	return key.Sign(msg)
+}
+
+func (k *pdsKeys) VerifyUserSignature(ctx context.Context, didstr string, sig []byte, msg []byte) error {
+	key, err := k.key(didstr)
+	if err != nil {
+		return err
+	}
+	return key.Public().Verify(msg, sig)
+}
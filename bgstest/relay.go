@@ -0,0 +1,259 @@
+package bgstest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/bgs"
+	"github.com/bluesky-social/indigo/carstore"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/events/schedulers/sequential"
+	"github.com/bluesky-social/indigo/indexer"
+	"github.com/bluesky-social/indigo/notifs"
+	"github.com/bluesky-social/indigo/repomgr"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/gorilla/websocket"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// how long Stream.WaitFor waits, in real time, before failing the test
+var WaitTimeout = 10 * time.Second
+
+const adminToken = "bgstest"
+
+// Relay is a libbgs relay running against a Directory, verifying commit
+// signatures for real and timing its background work by the given clock
+type Relay struct {
+	t         testing.TB
+	BGS       *bgs.BGS
+	DB        *gorm.DB
+	persister *events.DiskPersistence
+
+	listener net.Listener
+}
+
+// NewRelay starts a relay with config, or the default config if nil. The
+// relay's persister only flushes when the clock moves past its flush
+// interval or Flush is called; Stream.WaitFor does the latter.
+func NewRelay(t testing.TB, dir *Directory, clock util.Clock, config *bgs.BGSConfig) *Relay {
+	t.Helper()
+
+	tmp := t.TempDir()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(tmp, "relay.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cardb, err := gorm.Open(sqlite.Open(filepath.Join(tmp, "car.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := carstore.NewCarStore(cardb, filepath.Join(tmp, "carstore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repoman := repomgr.NewRepoManager(cs, indexer.NewKeyManager(dir, nil))
+
+	pOpts := events.DefaultDiskPersistOptions()
+	pOpts.Clock = clock
+	dp, err := events.NewDiskPersistence(filepath.Join(tmp, "events"), "", db, pOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evtman := events.NewEventManager(dp)
+
+	rf := indexer.NewRepoFetcher(db, repoman, 10)
+	ix, err := indexer.NewIndexer(db, &notifs.NullNotifs{}, evtman, dir, rf, true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repoman.SetEventHandler(func(ctx context.Context, evt *repomgr.RepoEvent) {
+		if err := ix.HandleRepoEvent(ctx, evt); err != nil {
+			t.Errorf("relay failed to handle repo event: %s", err)
+		}
+	}, false)
+
+	if config == nil {
+		config = bgs.DefaultBGSConfig()
+	}
+	config.SSL = false
+	config.Clock = clock
+
+	b, err := bgs.NewBGS(db, ix, repoman, evtman, dir, rf, dir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.CreateAdminToken(adminToken); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if err := b.StartWithListener(l); err != nil && err != http.ErrServerClosed {
+			t.Logf("relay stopped: %s", err)
+		}
+	}()
+
+	r := &Relay{
+		t:         t,
+		BGS:       b,
+		DB:        db,
+		persister: dp,
+		listener:  l,
+	}
+	t.Cleanup(func() {
+		b.Shutdown(5 * time.Second)
+	})
+	return r
+}
+
+// Host is the relay's host:port
+func (r *Relay) Host() string {
+	return r.listener.Addr().String()
+}
+
+// Flush writes out buffered events so they reach subscribers
+func (r *Relay) Flush() {
+	r.t.Helper()
+	if err := r.persister.Flush(context.Background()); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+// RequestCrawl has the relay subscribe to a PDS, lifting the default
+// per-day event limit for new hosts first
+func (r *Relay) RequestCrawl(p *PDS) {
+	r.t.Helper()
+
+	req, err := http.NewRequest("POST", "http://"+r.Host()+"/admin/subs/setPerDayLimit?limit=1000000", nil)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		r.t.Fatalf("setting per-day limit: %s", resp.Status)
+	}
+
+	c := &xrpc.Client{Host: "http://" + r.Host()}
+	if err := atproto.SyncRequestCrawl(context.Background(), c, &atproto.SyncRequestCrawl_Input{Hostname: p.Host()}); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+// Stream is a subscription to a relay's firehose
+type Stream struct {
+	relay  *Relay
+	cancel func()
+
+	lk     sync.Mutex
+	events []*events.XRPCStreamEvent
+	err    error
+}
+
+// Subscribe subscribes to the relay's firehose from cursor, or from the
+// live tail if cursor is negative. The subscription ends with the test.
+func (r *Relay) Subscribe(cursor int64) *Stream {
+	r.t.Helper()
+
+	u := "ws://" + r.Host() + "/xrpc/com.atproto.sync.subscribeRepos"
+	if cursor >= 0 {
+		u += fmt.Sprintf("?cursor=%d", cursor)
+	}
+	con, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Stream{relay: r, cancel: cancel}
+
+	add := func(evt *events.XRPCStreamEvent) error {
+		s.lk.Lock()
+		defer s.lk.Unlock()
+		s.events = append(s.events, evt)
+		return nil
+	}
+	rsc := &events.RepoStreamCallbacks{
+		RepoCommit: func(evt *atproto.SyncSubscribeRepos_Commit) error {
+			return add(&events.XRPCStreamEvent{RepoCommit: evt})
+		},
+		RepoIdentity: func(evt *atproto.SyncSubscribeRepos_Identity) error {
+			return add(&events.XRPCStreamEvent{RepoIdentity: evt})
+		},
+		RepoAccount: func(evt *atproto.SyncSubscribeRepos_Account) error {
+			return add(&events.XRPCStreamEvent{RepoAccount: evt})
+		},
+		RepoHandle: func(evt *atproto.SyncSubscribeRepos_Handle) error {
+			return add(&events.XRPCStreamEvent{RepoHandle: evt})
+		},
+	}
+
+	go func() {
+		<-ctx.Done()
+		con.Close()
+	}()
+	go func() {
+		err := events.HandleRepoStream(ctx, con, sequential.NewScheduler("bgstest", rsc.EventHandler))
+		s.lk.Lock()
+		s.err = err
+		s.lk.Unlock()
+	}()
+
+	r.t.Cleanup(s.Close)
+	return s
+}
+
+// Close ends the subscription
+func (s *Stream) Close() {
+	s.cancel()
+}
+
+// Events returns the events received so far
+func (s *Stream) Events() []*events.XRPCStreamEvent {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return append([]*events.XRPCStreamEvent(nil), s.events...)
+}
+
+// WaitFor waits for at least n events to have been received, flushing the
+// relay's persister while it waits, and returns the first n. It fails the
+// test if they don't arrive within WaitTimeout.
+func (s *Stream) WaitFor(n int) []*events.XRPCStreamEvent {
+	s.relay.t.Helper()
+
+	deadline := time.Now().Add(WaitTimeout)
+	for {
+		s.relay.Flush()
+
+		s.lk.Lock()
+		got, err := len(s.events), s.err
+		s.lk.Unlock()
+		if got >= n {
+			return s.Events()[:n]
+		}
+		if err != nil {
+			s.relay.t.Fatalf("stream ended after %d of %d events: %s", got, n, err)
+		}
+		if time.Now().After(deadline) {
+			s.relay.t.Fatalf("timed out with %d of %d events", got, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
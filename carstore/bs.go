@@ -4,11 +4,15 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math/rand/v2"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -42,6 +46,38 @@ var blockGetTotalCounterUsrskip = blockGetTotalCounter.WithLabelValues("true", "
 var blockGetTotalCounterCached = blockGetTotalCounter.WithLabelValues("false", "hit")
 var blockGetTotalCounterNormal = blockGetTotalCounter.WithLabelValues("false", "miss")
 
+var shardIntentsRecovered = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "carstore_shard_intents_recovered_total",
+	Help: "Number of interrupted shard writes cleaned up on startup",
+})
+
+var bufferedCommits = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "carstore_buffered_commits",
+	Help: "Number of commits held in per-user write buffers",
+})
+
+var bufferFlushes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "carstore_buffer_flushes_total",
+	Help: "Number of write buffers written out as shards, by reason",
+}, []string{"reason"})
+
+var bufferFlushCommits = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "carstore_buffer_flush_commits",
+	Help:    "Number of commits consolidated into each shard written from a write buffer",
+	Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+})
+
+var compactionSwapDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "carstore_compaction_swap_seconds",
+	Help:    "How long compaction holds a user's write lock to swap in their compacted shards",
+	Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+})
+
+var readRetries = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "carstore_read_retries_total",
+	Help: "Number of block reads looked up again because compaction removed the shard file",
+})
+
 var log = logging.Logger("carstore")
 
 const MaxSliceLength = 2 << 20
@@ -56,20 +92,87 @@ type CarStore interface {
 	ImportSlice(ctx context.Context, uid models.Uid, since *string, carslice []byte) (cid.Cid, *DeltaSession, error)
 	NewDeltaSession(ctx context.Context, user models.Uid, since *string) (*DeltaSession, error)
 	ReadOnlySession(user models.Uid) (*DeltaSession, error)
+	ReadUserBlocks(ctx context.Context, user models.Uid, cids []cid.Cid) ([]blockformat.Block, error)
 	ReadUserCar(ctx context.Context, user models.Uid, sinceRev string, incremental bool, w io.Writer) error
 	Stat(ctx context.Context, usr models.Uid) ([]UserStat, error)
 	WipeUserData(ctx context.Context, user models.Uid) error
+	TrashUserData(ctx context.Context, user models.Uid, reason string) (*TrashEntry, error)
+	RestoreUserData(ctx context.Context, user models.Uid, id string) error
+	ListTrash(ctx context.Context, user models.Uid) ([]TrashEntry, error)
+	PurgeTrash(ctx context.Context, before time.Time) (int, error)
+	UserStorage(ctx context.Context, user models.Uid) (*UserStorage, error)
+	TopUserStorage(ctx context.Context, limit int) ([]UserStorage, error)
+	SetStorageObserver(fn func(user models.Uid, delta int64))
+	ScrubShards(ctx context.Context, after uint, limit int) ([]ShardScrubResult, error)
+	Flush(ctx context.Context) error
+	Shutdown(ctx context.Context) error
+}
+
+// CarStoreMeta indexes the shards written by the carstore and the blocks
+// within them
+type CarStoreMeta interface {
+	HasUidCid(ctx context.Context, user models.Uid, k cid.Cid) (bool, error)
+	LookupBlockRef(ctx context.Context, user models.Uid, k cid.Cid) (path string, offset int64, usr models.Uid, err error)
+	LookupUserBlockRefs(ctx context.Context, user models.Uid, cids []cid.Cid) ([]userBlockLocation, error)
+
+	GetLastShard(ctx context.Context, user models.Uid) (*CarShard, error)
+	GetUserShards(ctx context.Context, usr models.Uid) ([]CarShard, error)
+	GetUserShardsDesc(ctx context.Context, usr models.Uid, minSeq int) ([]CarShard, error)
+	GetUserStaleRefs(ctx context.Context, user models.Uid) ([]staleRef, error)
+	SeqForRev(ctx context.Context, user models.Uid, sinceRev string) (int, error)
+	GetCompactionTargets(ctx context.Context, minShardCount int) ([]CompactionTarget, error)
+	GetBlockRefsForShards(ctx context.Context, shardIds []uint) ([]blockRef, error)
+	GetShardsAfter(ctx context.Context, after uint, limit int) ([]CarShard, error)
+
+	PutShardAndRefs(ctx context.Context, shard *CarShard, brefs []map[string]any, rmcids map[cid.Cid]bool, intent uint) error
+	DeleteShardsAndRefs(ctx context.Context, ids []uint) error
+	SwapShards(ctx context.Context, user models.Uid, add []compactedShard, remove []uint, staleRefs []uint, staleToKeep []cid.Cid) error
+
+	PutShardIntent(ctx context.Context, intent *shardIntent) error
+	DeleteShardIntent(ctx context.Context, id uint) error
+	GetShardIntents(ctx context.Context) ([]shardIntent, error)
+	HasShardWithPath(ctx context.Context, path string) (bool, error)
+
+	GetUserStorage(ctx context.Context, usr models.Uid) (*UserStorage, error)
+	GetTopUserStorage(ctx context.Context, limit int) ([]UserStorage, error)
+
+	Close() error
 }
 
 type FileCarStore struct {
-	meta    *CarStoreGormMeta
+	meta    CarStoreMeta
 	rootDir string
 
-	lscLk          sync.Mutex
-	lastShardCache map[models.Uid]*CarShard
+	opts *CarStoreOptions
+
+	// per-user repo heads and write buffers
+	bufLk   sync.Mutex
+	buffers map[models.Uid]*userBuffer
+
+	exit chan struct{}
+	wg   sync.WaitGroup
+
+	// held while restoring or purging trash entries
+	trashLk sync.Mutex
+
+	storageObserver func(models.Uid, int64)
+
+	// when sharing the carstore with other nodes, the users we hold leases
+	// on and when they expire
+	leaser  userLeaser
+	leaseLk sync.Mutex
+	leases  map[models.Uid]time.Time
 }
 
 func NewCarStore(meta *gorm.DB, root string) (CarStore, error) {
+	return NewCarStoreWithOptions(meta, root, nil)
+}
+
+func NewCarStoreWithOptions(meta *gorm.DB, root string, opts *CarStoreOptions) (CarStore, error) {
+	if opts == nil {
+		opts = DefaultCarStoreOptions()
+	}
+
 	if _, err := os.Stat(root); err != nil {
 		if !os.IsNotExist(err) {
 			return nil, err
@@ -79,18 +182,106 @@ func NewCarStore(meta *gorm.DB, root string) (CarStore, error) {
 			return nil, err
 		}
 	}
-	if err := meta.AutoMigrate(&CarShard{}, &blockRef{}); err != nil {
-		return nil, err
+
+	if opts.Meta != nil && opts.ReadReplica != nil {
+		return nil, fmt.Errorf("a read replica can only be used with the SQL metadata store")
 	}
-	if err := meta.AutoMigrate(&staleRef{}); err != nil {
-		return nil, err
+
+	csm := opts.Meta
+	if csm == nil {
+		gm, err := NewCarStoreGormMeta(meta)
+		if err != nil {
+			return nil, err
+		}
+		gm.replica = opts.ReadReplica
+		csm = gm
 	}
 
-	return &FileCarStore{
-		meta:           &CarStoreGormMeta{meta: meta},
-		rootDir:        root,
-		lastShardCache: make(map[models.Uid]*CarShard),
-	}, nil
+	cs := &FileCarStore{
+		meta:    csm,
+		rootDir: root,
+		opts:    opts,
+		buffers: make(map[models.Uid]*userBuffer),
+		exit:    make(chan struct{}),
+		leases:  make(map[models.Uid]time.Time),
+	}
+
+	if opts.multiWriter() {
+		leaser, ok := csm.(userLeaser)
+		if !ok {
+			return nil, fmt.Errorf("sharing the carstore between nodes requires the SQL metadata store")
+		}
+		if opts.LeaseTTL <= 0 {
+			return nil, fmt.Errorf("sharing the carstore between nodes requires a lease TTL")
+		}
+		leaser.requireUserLease(opts.NodeID)
+		cs.leaser = leaser
+	}
+
+	if err := cs.recoverShardIntents(context.Background()); err != nil {
+		return nil, fmt.Errorf("recovering interrupted shard writes: %w", err)
+	}
+	if err := cs.recoverTrash(context.Background()); err != nil {
+		return nil, fmt.Errorf("recovering interrupted trashing: %w", err)
+	}
+
+	if opts.buffering() {
+		cs.wg.Add(1)
+		go cs.runFlusher()
+	}
+
+	if opts.TrashRetention > 0 {
+		cs.wg.Add(1)
+		go cs.runTrashPurger()
+	}
+
+	if opts.multiWriter() {
+		cs.wg.Add(1)
+		go cs.runLeaseReaper()
+	}
+
+	return cs, nil
+}
+
+// recoverShardIntents cleans up after shard writes that were interrupted
+// between writing the shard file and committing its rows to the meta DB. Any
+// intent still present means the commit never happened, so the file (if it
+// was written at all) is an orphan and the repo head is still the previous
+// shard.
+//
+// When the carstore is shared, only this node's own intents are recovered;
+// the others may belong to writes still in progress.
+func (cs *FileCarStore) recoverShardIntents(ctx context.Context) error {
+	intents, err := cs.meta.GetShardIntents(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, in := range intents {
+		if cs.opts.multiWriter() && in.Owner != cs.opts.NodeID {
+			continue
+		}
+
+		committed, err := cs.meta.HasShardWithPath(ctx, in.Path)
+		if err != nil {
+			return err
+		}
+
+		if !committed {
+			if err := os.Remove(in.Path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("removing orphaned shard file %q: %w", in.Path, err)
+			}
+		}
+
+		log.Warnw("recovered interrupted shard write", "uid", in.Usr, "seq", in.Seq, "rev", in.Rev, "path", in.Path, "committed", committed)
+		shardIntentsRecovered.Inc()
+
+		if err := cs.meta.DeleteShardIntent(ctx, in.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 type userView struct {
@@ -108,6 +299,9 @@ func (uv *userView) HashOnRead(hor bool) {
 }
 
 func (uv *userView) Has(ctx context.Context, k cid.Cid) (bool, error) {
+	if _, ok := uv.cs.bufferedBlock(uv.user, k); ok {
+		return true, nil
+	}
 	return uv.cs.meta.HasUidCid(ctx, uv.user, k)
 }
 
@@ -129,7 +323,22 @@ func (uv *userView) Get(ctx context.Context, k cid.Cid) (blockformat.Block, erro
 	}
 	atomic.AddInt64(&CacheMiss, 1)
 
-	path, offset, user, err := uv.cs.meta.LookupBlockRef(ctx, k)
+	if blk, ok := uv.cs.bufferedBlock(uv.user, k); ok {
+		return blk, nil
+	}
+
+	blk, err := uv.readBlock(ctx, k)
+	if errors.Is(err, fs.ErrNotExist) {
+		// compaction swapped the shard out between the lookup and the read,
+		// the block is in its replacement
+		readRetries.Inc()
+		return uv.readBlock(ctx, k)
+	}
+	return blk, err
+}
+
+func (uv *userView) readBlock(ctx context.Context, k cid.Cid) (blockformat.Block, error) {
+	path, offset, user, err := uv.cs.meta.LookupBlockRef(ctx, uv.user, k)
 	if err != nil {
 		return nil, err
 	}
@@ -271,50 +480,15 @@ type DeltaSession struct {
 	readonly bool
 	cs       *FileCarStore
 	lastRev  string
+	nodes    NodeCache
 }
 
-func (cs *FileCarStore) checkLastShardCache(user models.Uid) *CarShard {
-	cs.lscLk.Lock()
-	defer cs.lscLk.Unlock()
-
-	ls, ok := cs.lastShardCache[user]
-	if ok {
-		return ls
-	}
-
-	return nil
-}
-
-func (cs *FileCarStore) removeLastShardCache(user models.Uid) {
-	cs.lscLk.Lock()
-	defer cs.lscLk.Unlock()
-
-	delete(cs.lastShardCache, user)
-}
-
-func (cs *FileCarStore) putLastShardCache(ls *CarShard) {
-	cs.lscLk.Lock()
-	defer cs.lscLk.Unlock()
-
-	cs.lastShardCache[ls.Usr] = ls
-}
-
-func (cs *FileCarStore) getLastShard(ctx context.Context, user models.Uid) (*CarShard, error) {
-	ctx, span := otel.Tracer("carstore").Start(ctx, "getLastShard")
-	defer span.End()
-
-	maybeLs := cs.checkLastShardCache(user)
-	if maybeLs != nil {
-		return maybeLs, nil
-	}
-
-	lastShard, err := cs.meta.GetLastShard(ctx, user)
-	if err != nil {
-		return nil, err
-	}
-
-	cs.putLastShardCache(lastShard)
-	return lastShard, nil
+// NodeCache holds the links of tree nodes from earlier commits, so CalcDiff
+// can walk the old tree without reading its nodes back from the shards.
+// *mst.NodeCache implements it.
+type NodeCache interface {
+	Links(c cid.Cid) ([]cid.Cid, bool)
+	AddBlock(blk blockformat.Block) bool
 }
 
 var ErrRepoBaseMismatch = fmt.Errorf("attempted a delta session on top of the wrong previous head")
@@ -323,15 +497,19 @@ func (cs *FileCarStore) NewDeltaSession(ctx context.Context, user models.Uid, si
 	ctx, span := otel.Tracer("carstore").Start(ctx, "NewSession")
 	defer span.End()
 
+	if err := cs.claimUser(ctx, user); err != nil {
+		return nil, err
+	}
+
 	// TODO: ensure that we don't write updates on top of the wrong head
 	// this needs to be a compare and swap type operation
-	lastShard, err := cs.getLastShard(ctx, user)
+	head, err := cs.getHead(ctx, user)
 	if err != nil {
 		return nil, err
 	}
 
-	if since != nil && *since != lastShard.Rev {
-		return nil, fmt.Errorf("revision mismatch: %s != %s: %w", *since, lastShard.Rev, ErrRepoBaseMismatch)
+	if since != nil && *since != head.Rev {
+		return nil, fmt.Errorf("revision mismatch: %s != %s: %w", *since, head.Rev, ErrRepoBaseMismatch)
 	}
 
 	return &DeltaSession{
@@ -344,10 +522,10 @@ func (cs *FileCarStore) NewDeltaSession(ctx context.Context, user models.Uid, si
 			cache:    make(map[cid.Cid]blockformat.Block),
 		},
 		user:    user,
-		baseCid: lastShard.Root.CID,
+		baseCid: head.Root,
 		cs:      cs,
-		seq:     lastShard.Seq + 1,
-		lastRev: lastShard.Rev,
+		seq:     head.Seq + 1,
+		lastRev: head.Rev,
 	}, nil
 }
 
@@ -370,27 +548,21 @@ func (cs *FileCarStore) ReadUserCar(ctx context.Context, user models.Uid, sinceR
 	ctx, span := otel.Tracer("carstore").Start(ctx, "ReadUserCar")
 	defer span.End()
 
-	var earlySeq int
-	if sinceRev != "" {
-		var err error
-		earlySeq, err = cs.meta.SeqForRev(ctx, user, sinceRev)
-		if err != nil {
-			return err
-		}
-	}
-
-	// TODO: Why does ReadUserCar want shards seq DESC but CompactUserShards wants seq ASC ?
-	shards, err := cs.meta.GetUserShardsDesc(ctx, user, earlySeq)
-	if err != nil {
+	if err := cs.flushUser(ctx, user, "read"); err != nil {
 		return err
 	}
 
 	// TODO: incremental is only ever called true, so this is fine and we can remove the error check
-	if !incremental && earlySeq > 0 {
+	if !incremental && sinceRev != "" {
 		// have to do it the ugly way
 		return fmt.Errorf("nyi")
 	}
 
+	shards, err := cs.userCarShardsForRead(ctx, user, sinceRev)
+	if err != nil {
+		return err
+	}
+
 	if len(shards) == 0 {
 		return fmt.Errorf("no data found for user %d", user)
 	}
@@ -412,6 +584,144 @@ func (cs *FileCarStore) ReadUserCar(ctx context.Context, user models.Uid, sinceR
 	return nil
 }
 
+// userCarShards lists the user's shards from sinceRev on, newest first
+func (cs *FileCarStore) userCarShards(ctx context.Context, user models.Uid, sinceRev string) ([]CarShard, error) {
+	var earlySeq int
+	if sinceRev != "" {
+		var err error
+		earlySeq, err = cs.meta.SeqForRev(ctx, user, sinceRev)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// TODO: Why does ReadUserCar want shards seq DESC but CompactUserShards wants seq ASC ?
+	return cs.meta.GetUserShardsDesc(ctx, user, earlySeq)
+}
+
+// ReadUserBlocks fetches the requested blocks from the given user's shards.
+// Lookups are grouped by shard so that each shard file is opened once and read
+// front to back, rather than doing a separate lookup and open per cid. Blocks
+// the user does not have are left out of the result, and the result order is
+// unspecified.
+func (cs *FileCarStore) ReadUserBlocks(ctx context.Context, user models.Uid, cids []cid.Cid) ([]blockformat.Block, error) {
+	ctx, span := otel.Tracer("carstore").Start(ctx, "ReadUserBlocks")
+	defer span.End()
+
+	span.SetAttributes(attribute.Int("cids", len(cids)))
+
+	var out []blockformat.Block
+	seen := make(map[cid.Cid]bool)
+
+	// anything still in the write buffer doesn't need a lookup
+	ondisk := cids
+	if cs.opts.buffering() {
+		ondisk = make([]cid.Cid, 0, len(cids))
+		for _, c := range cids {
+			if seen[c] {
+				continue
+			}
+			if blk, ok := cs.bufferedBlock(user, c); ok {
+				seen[c] = true
+				out = append(out, blk)
+			} else {
+				ondisk = append(ondisk, c)
+			}
+		}
+	}
+
+	locs, err := cs.lookupUserBlockRefsForRead(ctx, user, ondisk)
+	if err != nil {
+		return nil, fmt.Errorf("looking up block refs: %w", err)
+	}
+
+	byShard := make(map[uint][]userBlockLocation)
+	for _, loc := range locs {
+		// a block may be referenced from more than one shard, we only need it once
+		if seen[loc.Cid.CID] {
+			continue
+		}
+		seen[loc.Cid.CID] = true
+		byShard[loc.Shard] = append(byShard[loc.Shard], loc)
+	}
+
+	span.SetAttributes(attribute.Int("shards", len(byShard)))
+
+	for _, shlocs := range byShard {
+		blks, err := readShardBlocksAt(shlocs)
+		if errors.Is(err, fs.ErrNotExist) {
+			// compaction swapped the shard out since the lookup
+			readRetries.Inc()
+			blks, err = cs.rereadUserBlocks(ctx, user, shlocs)
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, blks...)
+	}
+
+	return out, nil
+}
+
+// rereadUserBlocks looks up and reads blocks again from the primary, after
+// their shard file was removed
+func (cs *FileCarStore) rereadUserBlocks(ctx context.Context, user models.Uid, locs []userBlockLocation) ([]blockformat.Block, error) {
+	cids := make([]cid.Cid, len(locs))
+	for i, loc := range locs {
+		cids[i] = loc.Cid.CID
+	}
+
+	relocs, err := cs.meta.LookupUserBlockRefs(ctx, user, cids)
+	if err != nil {
+		return nil, fmt.Errorf("looking up block refs: %w", err)
+	}
+
+	seen := make(map[cid.Cid]bool)
+	byShard := make(map[uint][]userBlockLocation)
+	for _, loc := range relocs {
+		if seen[loc.Cid.CID] {
+			continue
+		}
+		seen[loc.Cid.CID] = true
+		byShard[loc.Shard] = append(byShard[loc.Shard], loc)
+	}
+
+	var out []blockformat.Block
+	for _, shlocs := range byShard {
+		blks, err := readShardBlocksAt(shlocs)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, blks...)
+	}
+	return out, nil
+}
+
+// inner loop part of ReadUserBlocks
+// read a set of blocks from a single shard file in offset order
+func readShardBlocksAt(locs []userBlockLocation) ([]blockformat.Block, error) {
+	sort.Slice(locs, func(i, j int) bool {
+		return locs[i].Offset < locs[j].Offset
+	})
+
+	fi, err := os.Open(locs[0].Path)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	out := make([]blockformat.Block, 0, len(locs))
+	for _, loc := range locs {
+		blk, err := doBlockRead(fi, loc.Cid.CID, loc.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("reading block %s from %s: %w", loc.Cid.CID, loc.Path, err)
+		}
+		out = append(out, blk)
+	}
+
+	return out, nil
+}
+
 // inner loop part of ReadUserCar
 // copy shard blocks from disk to Writer
 func (cs *FileCarStore) writeShardBlocks(ctx context.Context, sh *CarShard, w io.Writer) error {
@@ -471,6 +781,12 @@ func (ds *DeltaSession) BaseCid() cid.Cid {
 	return ds.baseCid
 }
 
+// SetNodeCache has CalcDiff look up the old tree's nodes in nc, and add the
+// session's new nodes to it for the next commit
+func (ds *DeltaSession) SetNodeCache(nc NodeCache) {
+	ds.nodes = nc
+}
+
 func (ds *DeltaSession) Put(ctx context.Context, b blockformat.Block) error {
 	if ds.readonly {
 		return fmt.Errorf("cannot write to readonly deltaSession")
@@ -541,9 +857,20 @@ func (ds *DeltaSession) GetSize(ctx context.Context, c cid.Cid) (int, error) {
 func fnameForShard(user models.Uid, seq int) string {
 	return fmt.Sprintf("sh-%d-%d", user, seq)
 }
+
+// shardFileName is fnameForShard, qualified with the node ID when the
+// carstore is shared so that a node finishing a write after its lease ran
+// out can't clobber the file of the node that took over
+func (cs *FileCarStore) shardFileName(user models.Uid, seq int) string {
+	if cs.opts.multiWriter() {
+		return fnameForShard(user, seq) + "-" + cs.opts.NodeID
+	}
+	return fnameForShard(user, seq)
+}
+
 func (cs *FileCarStore) openNewShardFile(ctx context.Context, user models.Uid, seq int) (*os.File, string, error) {
 	// TODO: some overwrite protections
-	fname := filepath.Join(cs.rootDir, fnameForShard(user, seq))
+	fname := filepath.Join(cs.rootDir, cs.shardFileName(user, seq))
 	fi, err := os.Create(fname)
 	if err != nil {
 		return nil, "", err
@@ -557,7 +884,7 @@ func (cs *FileCarStore) writeNewShardFile(ctx context.Context, user models.Uid,
 	defer span.End()
 
 	// TODO: some overwrite protections
-	fname := filepath.Join(cs.rootDir, fnameForShard(user, seq))
+	fname := filepath.Join(cs.rootDir, cs.shardFileName(user, seq))
 	if err := os.WriteFile(fname, data, 0664); err != nil {
 		return "", err
 	}
@@ -600,12 +927,41 @@ func WriteCarHeader(w io.Writer, root cid.Cid) (int64, error) {
 	return hnw, nil
 }
 
+// writeNewShard persists a commit, either as its own shard or into the user's
+// write buffer, and returns its blocks as a CAR slice
 func (cs *FileCarStore) writeNewShard(ctx context.Context, root cid.Cid, rev string, user models.Uid, seq int, blks map[cid.Cid]blockformat.Block, rmcids map[cid.Cid]bool) ([]byte, error) {
+	if err := cs.checkLease(ctx, user); err != nil {
+		return nil, err
+	}
 
+	if !cs.opts.buffering() {
+		shard, slice, err := cs.writeShard(ctx, root, rev, user, seq, blks, rmcids)
+		if err != nil {
+			return nil, err
+		}
+		cs.setLastShard(shard)
+		return slice, nil
+	}
+
+	slice, _, _, err := buildCarSlice(root, blks)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cs.bufferCommit(ctx, user, root, rev, seq, blks, rmcids); err != nil {
+		return nil, err
+	}
+
+	return slice, nil
+}
+
+// buildCarSlice encodes the blocks as a CAR file with the given root,
+// returning it along with the data start offset and block refs for each block
+func buildCarSlice(root cid.Cid, blks map[cid.Cid]blockformat.Block) ([]byte, int64, []map[string]any, error) {
 	buf := new(bytes.Buffer)
 	hnw, err := WriteCarHeader(buf, root)
 	if err != nil {
-		return nil, fmt.Errorf("failed to write car header: %w", err)
+		return nil, 0, nil, fmt.Errorf("failed to write car header: %w", err)
 	}
 
 	// TODO: writing these blocks in map traversal order is bad, I believe the
@@ -618,7 +974,7 @@ func (cs *FileCarStore) writeNewShard(ctx context.Context, root cid.Cid, rev str
 	for k, blk := range blks {
 		nw, err := LdWrite(buf, k.Bytes(), blk.RawData())
 		if err != nil {
-			return nil, fmt.Errorf("failed to write block: %w", err)
+			return nil, 0, nil, fmt.Errorf("failed to write block: %w", err)
 		}
 
 		/*
@@ -638,9 +994,39 @@ func (cs *FileCarStore) writeNewShard(ctx context.Context, root cid.Cid, rev str
 		offset += nw
 	}
 
-	path, err := cs.writeNewShardFile(ctx, user, seq, buf.Bytes())
+	return buf.Bytes(), hnw, brefs, nil
+}
+
+// writeShard writes the blocks to a new shard file and records it in the
+// meta DB, returning the shard and its contents
+func (cs *FileCarStore) writeShard(ctx context.Context, root cid.Cid, rev string, user models.Uid, seq int, blks map[cid.Cid]blockformat.Block, rmcids map[cid.Cid]bool) (*CarShard, []byte, error) {
+	if err := cs.checkLease(ctx, user); err != nil {
+		return nil, nil, err
+	}
+
+	data, hnw, brefs, err := buildCarSlice(root, blks)
 	if err != nil {
-		return nil, fmt.Errorf("failed to write shard file: %w", err)
+		return nil, nil, err
+	}
+
+	// record our intent to write this shard before touching the disk, so a
+	// crash between the file write and the DB commit can be cleaned up by
+	// recoverShardIntents on the next startup
+	intent := shardIntent{
+		Usr:   user,
+		Seq:   seq,
+		Path:  filepath.Join(cs.rootDir, cs.shardFileName(user, seq)),
+		Rev:   rev,
+		Owner: cs.opts.NodeID,
+	}
+	if err := cs.meta.PutShardIntent(ctx, &intent); err != nil {
+		return nil, nil, fmt.Errorf("failed to record shard intent: %w", err)
+	}
+
+	path, err := cs.writeNewShardFile(ctx, user, seq, data)
+	if err != nil {
+		cs.abortShardIntent(ctx, &intent, false)
+		return nil, nil, fmt.Errorf("failed to write shard file: %w", err)
 	}
 
 	shard := CarShard{
@@ -650,32 +1036,57 @@ func (cs *FileCarStore) writeNewShard(ctx context.Context, root cid.Cid, rev str
 		Path:      path,
 		Usr:       user,
 		Rev:       rev,
+		Size:      int64(len(data)),
 	}
 
-	if err := cs.putShard(ctx, &shard, brefs, rmcids, false); err != nil {
-		return nil, err
+	if err := cs.putShard(ctx, &shard, brefs, rmcids, true, intent.ID); err != nil {
+		cs.abortShardIntent(ctx, &intent, true)
+		return nil, nil, err
 	}
 
-	return buf.Bytes(), nil
+	return &shard, data, nil
 }
 
-func (cs *FileCarStore) putShard(ctx context.Context, shard *CarShard, brefs []map[string]any, rmcids map[cid.Cid]bool, nocache bool) error {
+// abortShardIntent is a best-effort cleanup for a shard write that failed
+// without crashing. Anything left behind is handled by recoverShardIntents.
+func (cs *FileCarStore) abortShardIntent(ctx context.Context, intent *shardIntent, removeFile bool) {
+	if removeFile {
+		if err := os.Remove(intent.Path); err != nil && !os.IsNotExist(err) {
+			log.Errorw("failed to remove shard file after failed db transaction", "path", intent.Path, "err", err)
+			return
+		}
+	}
+
+	if err := cs.meta.DeleteShardIntent(ctx, intent.ID); err != nil {
+		log.Errorw("failed to clear shard intent", "path", intent.Path, "err", err)
+	}
+}
+
+func (cs *FileCarStore) putShard(ctx context.Context, shard *CarShard, brefs []map[string]any, rmcids map[cid.Cid]bool, nocache bool, intent uint) error {
 	ctx, span := otel.Tracer("carstore").Start(ctx, "putShard")
 	defer span.End()
 
-	err := cs.meta.PutShardAndRefs(ctx, shard, brefs, rmcids)
+	err := cs.meta.PutShardAndRefs(ctx, shard, brefs, rmcids, intent)
 	if err != nil {
+		if errors.Is(err, ErrUserLeaseLost) {
+			cs.forgetLease(shard.Usr)
+		}
 		return err
 	}
+	cs.observeStorage(shard.Usr, shard.Size)
 
 	if !nocache {
-		cs.putLastShardCache(shard)
+		cs.setLastShard(shard)
 	}
 
 	return nil
 }
 
 func BlockDiff(ctx context.Context, bs blockstore.Blockstore, oldroot cid.Cid, newcids map[cid.Cid]blockformat.Block, skipcids map[cid.Cid]bool) (map[cid.Cid]bool, error) {
+	return blockDiff(ctx, bs, oldroot, newcids, skipcids, nil)
+}
+
+func blockDiff(ctx context.Context, bs blockstore.Blockstore, oldroot cid.Cid, newcids map[cid.Cid]blockformat.Block, skipcids map[cid.Cid]bool, nodes NodeCache) (map[cid.Cid]bool, error) {
 	ctx, span := otel.Tracer("repo").Start(ctx, "BlockDiff")
 	defer span.End()
 
@@ -697,6 +1108,10 @@ func BlockDiff(ctx context.Context, bs blockstore.Blockstore, oldroot cid.Cid, n
 		}); err != nil {
 			return nil, err
 		}
+
+		if nodes != nil {
+			nodes.AddBlock(oblk)
+		}
 	}
 
 	if keepset[oldroot] {
@@ -717,12 +1132,7 @@ func BlockDiff(ctx context.Context, bs blockstore.Blockstore, oldroot cid.Cid, n
 			continue
 		}
 
-		oblk, err := bs.Get(ctx, c)
-		if err != nil {
-			return nil, fmt.Errorf("get failed in old tree: %w", err)
-		}
-
-		if err := cbg.ScanForLinks(bytes.NewReader(oblk.RawData()), func(lnk cid.Cid) {
+		visit := func(lnk cid.Cid) {
 			if lnk.Prefix().Codec != cid.DagCBOR {
 				return
 			}
@@ -731,7 +1141,23 @@ func BlockDiff(ctx context.Context, bs blockstore.Blockstore, oldroot cid.Cid, n
 				dropset[lnk] = true
 				queue = append(queue, lnk)
 			}
-		}); err != nil {
+		}
+
+		if nodes != nil {
+			if links, ok := nodes.Links(c); ok {
+				for _, lnk := range links {
+					visit(lnk)
+				}
+				continue
+			}
+		}
+
+		oblk, err := bs.Get(ctx, c)
+		if err != nil {
+			return nil, fmt.Errorf("get failed in old tree: %w", err)
+		}
+
+		if err := cbg.ScanForLinks(bytes.NewReader(oblk.RawData()), visit); err != nil {
 			return nil, err
 		}
 	}
@@ -778,7 +1204,7 @@ func (cs *FileCarStore) ImportSlice(ctx context.Context, uid models.Uid, since *
 }
 
 func (ds *DeltaSession) CalcDiff(ctx context.Context, skipcids map[cid.Cid]bool) error {
-	rmcids, err := BlockDiff(ctx, ds, ds.baseCid, ds.blks, skipcids)
+	rmcids, err := blockDiff(ctx, ds, ds.baseCid, ds.blks, skipcids, ds.nodes)
 	if err != nil {
 		return fmt.Errorf("block diff failed (base=%s,rev=%s): %w", ds.baseCid, ds.lastRev, err)
 	}
@@ -788,27 +1214,24 @@ func (ds *DeltaSession) CalcDiff(ctx context.Context, skipcids map[cid.Cid]bool)
 }
 
 func (cs *FileCarStore) GetUserRepoHead(ctx context.Context, user models.Uid) (cid.Cid, error) {
-	lastShard, err := cs.getLastShard(ctx, user)
+	head, err := cs.getHead(ctx, user)
 	if err != nil {
 		return cid.Undef, err
 	}
-	if lastShard.ID == 0 {
-		return cid.Undef, nil
-	}
 
-	return lastShard.Root.CID, nil
+	return head.Root, nil
 }
 
 func (cs *FileCarStore) GetUserRepoRev(ctx context.Context, user models.Uid) (string, error) {
-	lastShard, err := cs.getLastShard(ctx, user)
+	head, err := cs.getHead(ctx, user)
 	if err != nil {
 		return "", err
 	}
-	if lastShard.ID == 0 {
+	if !head.Root.Defined() {
 		return "", nil
 	}
 
-	return lastShard.Rev, nil
+	return head.Rev, nil
 }
 
 type UserStat struct {
@@ -818,6 +1241,10 @@ type UserStat struct {
 }
 
 func (cs *FileCarStore) Stat(ctx context.Context, usr models.Uid) ([]UserStat, error) {
+	if err := cs.flushUser(ctx, usr, "read"); err != nil {
+		return nil, err
+	}
+
 	shards, err := cs.meta.GetUserShards(ctx, usr)
 	if err != nil {
 		return nil, err
@@ -836,6 +1263,10 @@ func (cs *FileCarStore) Stat(ctx context.Context, usr models.Uid) ([]UserStat, e
 }
 
 func (cs *FileCarStore) WipeUserData(ctx context.Context, user models.Uid) error {
+	if err := cs.claimUser(ctx, user); err != nil {
+		return err
+	}
+
 	shards, err := cs.meta.GetUserShards(ctx, user)
 	if err != nil {
 		return err
@@ -847,7 +1278,7 @@ func (cs *FileCarStore) WipeUserData(ctx context.Context, user models.Uid) error
 		}
 	}
 
-	cs.removeLastShardCache(user)
+	cs.dropUserBuffer(user)
 
 	return nil
 }
@@ -866,6 +1297,9 @@ func (cs *FileCarStore) deleteShards(ctx context.Context, shs []CarShard) error
 		if err != nil {
 			return err
 		}
+		for _, sh := range subs {
+			cs.observeStorage(sh.Usr, -sh.Size)
+		}
 
 		for _, sh := range subs {
 			if err := cs.deleteShardFile(ctx, &sh); err != nil {
@@ -978,16 +1412,17 @@ func (cb *compBucket) isEmpty() bool {
 	return len(cb.shards) == 0
 }
 
-func (cs *FileCarStore) openNewCompactedShardFile(ctx context.Context, user models.Uid, seq int) (*os.File, string, error) {
-	// TODO: some overwrite protections
-	// NOTE CreateTemp is used for creating a non-colliding file, but we keep it and don't delete it so don't think of it as "temporary".
-	// This creates "sh-%d-%d%s" with some random stuff in the last position
-	fi, err := os.CreateTemp(cs.rootDir, fnameForShard(user, seq))
-	if err != nil {
-		return nil, "", err
-	}
+// newCompactedShardPath picks a path for a compacted shard that doesn't
+// collide with the shards it replaces. Like os.CreateTemp, it appends random
+// digits to the shard's usual name, but it doesn't create the file, so the
+// shard intent can be recorded first.
+func (cs *FileCarStore) newCompactedShardPath(user models.Uid, seq int) string {
+	return filepath.Join(cs.rootDir, cs.shardFileName(user, seq)+strconv.FormatUint(uint64(rand.Uint32()), 10))
+}
 
-	return fi, fi.Name(), nil
+func (cs *FileCarStore) openNewCompactedShardFile(ctx context.Context, path string) (*os.File, error) {
+	// O_EXCL so we never write over a file some other intent recorded
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
 }
 
 type CompactionTarget struct {
@@ -1047,6 +1482,14 @@ func (cs *FileCarStore) CompactUserShards(ctx context.Context, user models.Uid,
 
 	span.SetAttributes(attribute.Int64("user", int64(user)))
 
+	if err := cs.claimUser(ctx, user); err != nil {
+		return nil, err
+	}
+
+	if err := cs.flushUser(ctx, user, "compaction"); err != nil {
+		return nil, err
+	}
+
 	shards, err := cs.meta.GetUserShards(ctx, user)
 	if err != nil {
 		return nil, err
@@ -1214,67 +1657,98 @@ func (cs *FileCarStore) CompactUserShards(ctx context.Context, user models.Uid,
 		TotalRefs:   len(brefs),
 	}
 
+	// Write out every compacted shard before touching the metadata. Nothing
+	// is locked while the blocks are copied, so commits keep landing in new
+	// shards of their own, which compaction leaves alone.
 	removedShards := make(map[uint]bool)
+	var compacted []compactedShard
+	var todelete []CarShard
 	for _, b := range compactionQueue {
 		if !b.shouldCompact() {
 			stats.SkippedShards += len(b.shards)
 			continue
 		}
 
-		if err := cs.compactBucket(ctx, user, b, shardsById, keep); err != nil {
+		c, err := cs.compactBucket(ctx, user, b, shardsById, keep)
+		if err != nil {
+			cs.abortCompaction(ctx, compacted)
 			return nil, fmt.Errorf("compact bucket: %w", err)
 		}
+		compacted = append(compacted, *c)
 
 		stats.NewShards++
 
-		todelete := make([]CarShard, 0, len(b.shards))
 		for _, s := range b.shards {
 			removedShards[s.ID] = true
 			sh, ok := shardsById[s.ID]
 			if !ok {
+				cs.abortCompaction(ctx, compacted)
 				return nil, fmt.Errorf("missing shard to delete")
 			}
 
 			todelete = append(todelete, sh)
 		}
+	}
 
-		stats.ShardsDeleted += len(todelete)
-		if err := cs.deleteShards(ctx, todelete); err != nil {
-			return nil, fmt.Errorf("deleting shards: %w", err)
-		}
+	stats.DupeCount = len(dupes)
+	if len(compacted) == 0 {
+		return stats, nil
 	}
 
-	// now we need to delete the staleRefs we successfully cleaned up
-	// we can safely delete a staleRef if all the shards that have blockRefs with matching stale refs were processed
-	if err := cs.deleteStaleRefs(ctx, user, brefs, staleRefs, removedShards); err != nil {
-		return nil, fmt.Errorf("delete stale refs: %w", err)
+	if err := cs.swapShards(ctx, user, compacted, todelete, brefs, staleRefs, removedShards); err != nil {
+		cs.abortCompaction(ctx, compacted)
+		return nil, fmt.Errorf("swapping compacted shards: %w", err)
 	}
+	stats.ShardsDeleted = len(todelete)
 
-	stats.DupeCount = len(dupes)
+	// reads that looked up a block before the swap retry once its old shard
+	// file is gone
+	for _, sh := range todelete {
+		if err := cs.deleteShardFile(ctx, &sh); err != nil {
+			if !os.IsNotExist(err) {
+				return nil, fmt.Errorf("deleting compacted shard file: %w", err)
+			}
+			log.Warnw("shard file we tried to delete did not exist", "shard", sh.ID, "path", sh.Path)
+		}
+	}
 
 	return stats, nil
 }
 
-func (cs *FileCarStore) deleteStaleRefs(ctx context.Context, uid models.Uid, brefs []blockRef, staleRefs []staleRef, removedShards map[uint]bool) error {
-	ctx, span := otel.Tracer("carstore").Start(ctx, "deleteStaleRefs")
+// compactedShard is a shard file written by compaction that isn't visible
+// until it's swapped in for the shards it was written from
+type compactedShard struct {
+	shard  *CarShard
+	brefs  []map[string]any
+	intent uint
+}
+
+// swapShards atomically replaces the compacted shards in the metadata,
+// holding the user's write lock only for the swap itself
+func (cs *FileCarStore) swapShards(ctx context.Context, user models.Uid, compacted []compactedShard, todelete []CarShard, brefs []blockRef, staleRefs []staleRef, removedShards map[uint]bool) error {
+	ctx, span := otel.Tracer("carstore").Start(ctx, "swapShards")
 	defer span.End()
 
+	// a stale cid is cleaned up if all the shards with blockRefs for it were
+	// compacted
 	brByCid := make(map[cid.Cid][]blockRef)
 	for _, br := range brefs {
 		brByCid[br.Cid.CID] = append(brByCid[br.Cid.CID], br)
 	}
 
+	staleIds := make([]uint, 0, len(staleRefs))
 	var staleToKeep []cid.Cid
 	for _, sr := range staleRefs {
+		staleIds = append(staleIds, sr.ID)
+
 		cids, err := sr.getCids()
 		if err != nil {
 			return fmt.Errorf("getCids on staleRef failed (%d): %w", sr.ID, err)
 		}
 
 		for _, c := range cids {
-			brs := brByCid[c]
 			del := true
-			for _, br := range brs {
+			for _, br := range brByCid[c] {
 				if !removedShards[br.Shard] {
 					del = false
 					break
@@ -1287,10 +1761,54 @@ func (cs *FileCarStore) deleteStaleRefs(ctx context.Context, uid models.Uid, bre
 		}
 	}
 
-	return cs.meta.SetStaleRef(ctx, uid, staleToKeep)
+	removeIds := make([]uint, len(todelete))
+	for i, sh := range todelete {
+		removeIds[i] = sh.ID
+	}
+
+	// compaction can take a while, make sure nobody took the user over
+	if err := cs.checkLease(ctx, user); err != nil {
+		return err
+	}
+
+	ub := cs.getUserBuffer(user)
+	ub.lk.Lock()
+	defer ub.lk.Unlock()
+
+	start := time.Now()
+	if err := cs.meta.SwapShards(ctx, user, compacted, removeIds, staleIds, staleToKeep); err != nil {
+		if errors.Is(err, ErrUserLeaseLost) {
+			cs.forgetLease(user)
+		}
+		return err
+	}
+	compactionSwapDuration.Observe(time.Since(start).Seconds())
+
+	// the cached head may have been one of the shards that was replaced
+	if ub.shard != nil && removedShards[ub.shard.ID] {
+		ub.shard = nil
+	}
+
+	for _, c := range compacted {
+		cs.observeStorage(user, c.shard.Size)
+	}
+	for _, sh := range todelete {
+		cs.observeStorage(user, -sh.Size)
+	}
+	return nil
 }
 
-func (cs *FileCarStore) compactBucket(ctx context.Context, user models.Uid, b *compBucket, shardsById map[uint]CarShard, keep map[cid.Cid]bool) error {
+// abortCompaction removes compacted shard files that were never swapped in
+func (cs *FileCarStore) abortCompaction(ctx context.Context, compacted []compactedShard) {
+	for _, c := range compacted {
+		cs.abortShardIntent(ctx, &shardIntent{ID: c.intent, Path: c.shard.Path}, true)
+	}
+}
+
+// compactBucket writes the blocks to keep from the bucket's shards into a new
+// shard file. The shard isn't added to the metadata; that's left to
+// swapShards.
+func (cs *FileCarStore) compactBucket(ctx context.Context, user models.Uid, b *compBucket, shardsById map[uint]CarShard, keep map[cid.Cid]bool) (*compactedShard, error) {
 	ctx, span := otel.Tracer("carstore").Start(ctx, "compactBucket")
 	defer span.End()
 
@@ -1298,9 +1816,26 @@ func (cs *FileCarStore) compactBucket(ctx context.Context, user models.Uid, b *c
 
 	last := b.shards[len(b.shards)-1]
 	lastsh := shardsById[last.ID]
-	fi, path, err := cs.openNewCompactedShardFile(ctx, user, last.Seq)
+	path := cs.newCompactedShardPath(user, last.Seq)
+
+	// as in writeShard, the intent is recorded before the file is created, so
+	// a crash part way through compaction leaves nothing recoverShardIntents
+	// doesn't know about
+	intent := shardIntent{
+		Usr:   user,
+		Seq:   lastsh.Seq,
+		Path:  path,
+		Rev:   lastsh.Rev,
+		Owner: cs.opts.NodeID,
+	}
+	if err := cs.meta.PutShardIntent(ctx, &intent); err != nil {
+		return nil, fmt.Errorf("failed to record shard intent: %w", err)
+	}
+
+	fi, err := cs.openNewCompactedShardFile(ctx, path)
 	if err != nil {
-		return fmt.Errorf("opening new file: %w", err)
+		cs.abortShardIntent(ctx, &intent, false)
+		return nil, fmt.Errorf("opening new file: %w", err)
 	}
 
 	defer fi.Close()
@@ -1308,7 +1843,9 @@ func (cs *FileCarStore) compactBucket(ctx context.Context, user models.Uid, b *c
 
 	hnw, err := WriteCarHeader(fi, root)
 	if err != nil {
-		return err
+		_ = fi.Close()
+		cs.abortShardIntent(ctx, &intent, true)
+		return nil, err
 	}
 
 	offset := hnw
@@ -1350,17 +1887,19 @@ func (cs *FileCarStore) compactBucket(ctx context.Context, user models.Uid, b *c
 		Path:      path,
 		Usr:       user,
 		Rev:       lastsh.Rev,
+		Size:      offset,
 	}
 
-	if err := cs.putShard(ctx, &shard, nbrefs, nil, true); err != nil {
-		// if writing the shard fails, we should also delete the file
+	// the file has to be on disk before the swap makes it visible
+	if err := fi.Sync(); err != nil {
 		_ = fi.Close()
-
-		if err2 := os.Remove(fi.Name()); err2 != nil {
-			log.Errorf("failed to remove shard file (%s) after failed db transaction: %w", fi.Name(), err2)
-		}
-
-		return err
+		cs.abortShardIntent(ctx, &intent, true)
+		return nil, fmt.Errorf("syncing compacted shard: %w", err)
 	}
-	return nil
+
+	return &compactedShard{
+		shard:  &shard,
+		brefs:  nbrefs,
+		intent: intent.ID,
+	}, nil
 }
@@ -0,0 +1,157 @@
+package carstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+
+	blockformat "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrIndexOnly is returned for reads of repo data from an IndexOnlyCarStore,
+// which doesn't keep any
+var ErrIndexOnly = errors.New("repo data is not retained in index-only mode")
+
+// CommitHead is the latest commit of a repo, which is all an
+// IndexOnlyCarStore keeps
+type CommitHead struct {
+	Usr       models.Uid `gorm:"primarykey"`
+	Root      models.DbCID
+	Rev       string
+	UpdatedAt time.Time
+}
+
+// IndexOnlyCarStore is a CarStore for relays that validate and forward
+// commits without serving repos. It keeps only each repo's latest commit CID
+// and rev, so the repo manager can check that commits follow on from one
+// another; all reads of blocks fail with ErrIndexOnly.
+type IndexOnlyCarStore struct {
+	db *gorm.DB
+}
+
+func NewIndexOnlyCarStore(db *gorm.DB) (*IndexOnlyCarStore, error) {
+	if err := db.AutoMigrate(&CommitHead{}); err != nil {
+		return nil, err
+	}
+	return &IndexOnlyCarStore{db: db}, nil
+}
+
+var _ CarStore = (*IndexOnlyCarStore)(nil)
+
+func (cs *IndexOnlyCarStore) getHead(ctx context.Context, user models.Uid) (*CommitHead, error) {
+	var head CommitHead
+	if err := cs.db.WithContext(ctx).Where("usr = ?", user).Limit(1).Find(&head).Error; err != nil {
+		return nil, err
+	}
+	return &head, nil
+}
+
+// PutUserHead records a repo's latest commit
+func (cs *IndexOnlyCarStore) PutUserHead(ctx context.Context, user models.Uid, root cid.Cid, rev string) error {
+	head := &CommitHead{
+		Usr:  user,
+		Root: models.DbCID{CID: root},
+		Rev:  rev,
+	}
+	return cs.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "usr"}},
+		DoUpdates: clause.AssignmentColumns([]string{"root", "rev", "updated_at"}),
+	}).Create(head).Error
+}
+
+func (cs *IndexOnlyCarStore) GetUserRepoHead(ctx context.Context, user models.Uid) (cid.Cid, error) {
+	head, err := cs.getHead(ctx, user)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return head.Root.CID, nil
+}
+
+func (cs *IndexOnlyCarStore) GetUserRepoRev(ctx context.Context, user models.Uid) (string, error) {
+	head, err := cs.getHead(ctx, user)
+	if err != nil {
+		return "", err
+	}
+	return head.Rev, nil
+}
+
+func (cs *IndexOnlyCarStore) WipeUserData(ctx context.Context, user models.Uid) error {
+	return cs.db.WithContext(ctx).Where("usr = ?", user).Delete(&CommitHead{}).Error
+}
+
+// TrashUserData removes the repo's head; there's no data to keep
+func (cs *IndexOnlyCarStore) TrashUserData(ctx context.Context, user models.Uid, reason string) (*TrashEntry, error) {
+	return nil, cs.WipeUserData(ctx, user)
+}
+
+func (cs *IndexOnlyCarStore) RestoreUserData(ctx context.Context, user models.Uid, id string) error {
+	return ErrTrashNotFound
+}
+
+func (cs *IndexOnlyCarStore) ListTrash(ctx context.Context, user models.Uid) ([]TrashEntry, error) {
+	return nil, nil
+}
+
+func (cs *IndexOnlyCarStore) PurgeTrash(ctx context.Context, before time.Time) (int, error) {
+	return 0, nil
+}
+
+func (cs *IndexOnlyCarStore) ImportSlice(ctx context.Context, uid models.Uid, since *string, carslice []byte) (cid.Cid, *DeltaSession, error) {
+	return cid.Undef, nil, ErrIndexOnly
+}
+
+func (cs *IndexOnlyCarStore) NewDeltaSession(ctx context.Context, user models.Uid, since *string) (*DeltaSession, error) {
+	return nil, ErrIndexOnly
+}
+
+func (cs *IndexOnlyCarStore) ReadOnlySession(user models.Uid) (*DeltaSession, error) {
+	return nil, ErrIndexOnly
+}
+
+func (cs *IndexOnlyCarStore) ReadUserBlocks(ctx context.Context, user models.Uid, cids []cid.Cid) ([]blockformat.Block, error) {
+	return nil, ErrIndexOnly
+}
+
+func (cs *IndexOnlyCarStore) ReadUserCar(ctx context.Context, user models.Uid, sinceRev string, incremental bool, w io.Writer) error {
+	return ErrIndexOnly
+}
+
+func (cs *IndexOnlyCarStore) Stat(ctx context.Context, usr models.Uid) ([]UserStat, error) {
+	return nil, nil
+}
+
+func (cs *IndexOnlyCarStore) CompactUserShards(ctx context.Context, user models.Uid, skipBigShards bool) (*CompactionStats, error) {
+	return &CompactionStats{}, nil
+}
+
+func (cs *IndexOnlyCarStore) GetCompactionTargets(ctx context.Context, shardCount int) ([]CompactionTarget, error) {
+	return nil, nil
+}
+
+func (cs *IndexOnlyCarStore) UserStorage(ctx context.Context, user models.Uid) (*UserStorage, error) {
+	return &UserStorage{Usr: user}, nil
+}
+
+func (cs *IndexOnlyCarStore) TopUserStorage(ctx context.Context, limit int) ([]UserStorage, error) {
+	return nil, nil
+}
+
+func (cs *IndexOnlyCarStore) SetStorageObserver(fn func(user models.Uid, delta int64)) {}
+
+func (cs *IndexOnlyCarStore) ScrubShards(ctx context.Context, after uint, limit int) ([]ShardScrubResult, error) {
+	return nil, nil
+}
+
+func (cs *IndexOnlyCarStore) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (cs *IndexOnlyCarStore) Shutdown(ctx context.Context) error {
+	return nil
+}
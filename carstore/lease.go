@@ -0,0 +1,250 @@
+package carstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Multiple processes can share one carstore (a SQL meta DB plus a shard
+// directory on shared storage) by giving each a distinct NodeID. Writes to a
+// user's repo then require a lease on that user, recorded in the meta DB, so
+// only one node writes a given repo at a time. A node takes the lease when it
+// starts a write for a user nobody else holds, renews it as it keeps writing,
+// and gives all of its leases up on Shutdown. A lease left behind by a node
+// that died expires after LeaseTTL.
+//
+// The head a node has cached for a user is only trusted while it holds their
+// lease; on acquiring one, it reloads the head from the meta DB, since
+// another node may have written to the repo since. Nodes compare lease
+// expiry times using their own clocks, so they need to be kept roughly in
+// sync, well within LeaseTTL.
+//
+// Checking the lease before a write isn't enough on its own: a node could
+// stall past LeaseTTL between the check and the commit. So the metadata
+// transaction that makes a shard visible checks the lease too, and fails with
+// ErrUserLeaseLost if the node no longer holds it.
+
+var leaseAcquisitions = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "carstore_lease_acquisitions_total",
+	Help: "Number of user write leases taken by this node",
+})
+
+var leaseConflicts = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "carstore_lease_conflicts_total",
+	Help: "Number of writes refused because another node holds the user's lease",
+})
+
+// ErrUserLeaseHeld is returned when writing to a user whose repo is leased
+// by another node
+var ErrUserLeaseHeld = errors.New("user is leased by another carstore node")
+
+// ErrUserLeaseLost is returned when a write started under a lease that
+// expired before it finished. The write is abandoned, since another node may
+// have taken over the user in the meantime.
+var ErrUserLeaseLost = errors.New("user lease expired during write")
+
+type userLease struct {
+	Usr     models.Uid `gorm:"primarykey;autoIncrement:false"`
+	Owner   string
+	Expires time.Time `gorm:"index"`
+}
+
+// userLeaser is implemented by metadata stores that can coordinate writes
+// between carstore nodes
+type userLeaser interface {
+	// AcquireUserLease takes or renews the user's lease for owner until
+	// expires, unless another owner holds an unexpired lease on them
+	AcquireUserLease(ctx context.Context, user models.Uid, owner string, now, expires time.Time) (bool, error)
+	// ReleaseUserLeases drops every lease held by owner
+	ReleaseUserLeases(ctx context.Context, owner string) error
+	// requireUserLease makes shard writes and swaps fail unless owner holds
+	// the user's lease when they commit
+	requireUserLease(owner string)
+}
+
+func (cs *CarStoreGormMeta) AcquireUserLease(ctx context.Context, user models.Uid, owner string, now, expires time.Time) (bool, error) {
+	res := cs.meta.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "usr"}},
+		DoUpdates: clause.AssignmentColumns([]string{"owner", "expires"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "user_leases.owner = ? OR user_leases.expires < ?", Vars: []any{owner, now}},
+		}},
+	}).Create(&userLease{Usr: user, Owner: owner, Expires: expires})
+	if res.Error != nil {
+		return false, res.Error
+	}
+
+	return res.RowsAffected > 0, nil
+}
+
+func (cs *CarStoreGormMeta) ReleaseUserLeases(ctx context.Context, owner string) error {
+	return cs.meta.WithContext(ctx).Where("owner = ?", owner).Delete(&userLease{}).Error
+}
+
+func (cs *CarStoreGormMeta) requireUserLease(owner string) {
+	cs.leaseOwner = owner
+}
+
+// checkUserLease makes sure, within tx, that the write it's part of still
+// holds the user's lease. The lease row stays locked until tx ends, so it
+// can't be taken over before the write commits.
+func (cs *CarStoreGormMeta) checkUserLease(tx *gorm.DB, user models.Uid) error {
+	if cs.leaseOwner == "" {
+		return nil
+	}
+
+	var held []userLease
+	if err := tx.Clauses(clause.Locking{Strength: "SHARE"}).
+		Where("usr = ? AND owner = ? AND expires > ?", user, cs.leaseOwner, time.Now()).
+		Limit(1).Find(&held).Error; err != nil {
+		return fmt.Errorf("checking user lease: %w", err)
+	}
+	if len(held) == 0 {
+		return ErrUserLeaseLost
+	}
+	return nil
+}
+
+func (o *CarStoreOptions) multiWriter() bool {
+	return o.NodeID != ""
+}
+
+// claimUser makes sure this node holds the user's lease before it starts a
+// write to their repo. If the lease wasn't already held, any head cached for
+// the user is dropped so it's reloaded from the meta DB.
+func (cs *FileCarStore) claimUser(ctx context.Context, user models.Uid) error {
+	if !cs.opts.multiWriter() {
+		return nil
+	}
+
+	held, renew := cs.leaseState(user)
+	if held && !renew {
+		return nil
+	}
+
+	if err := cs.acquireLease(ctx, user); err != nil {
+		return err
+	}
+
+	if !held {
+		leaseAcquisitions.Inc()
+		cs.dropUserBuffer(user)
+	}
+	return nil
+}
+
+// checkLease makes sure the lease this node took for a write is still held
+// before committing it, renewing it if it's getting close to expiring
+func (cs *FileCarStore) checkLease(ctx context.Context, user models.Uid) error {
+	if !cs.opts.multiWriter() {
+		return nil
+	}
+
+	held, renew := cs.leaseState(user)
+	if !held {
+		return ErrUserLeaseLost
+	}
+	if !renew {
+		return nil
+	}
+
+	if err := cs.acquireLease(ctx, user); err != nil {
+		if errors.Is(err, ErrUserLeaseHeld) {
+			return ErrUserLeaseLost
+		}
+		return err
+	}
+	return nil
+}
+
+// leaseState reports whether this node holds the user's lease, and whether
+// it's past halfway to expiring and should be renewed
+func (cs *FileCarStore) leaseState(user models.Uid) (held bool, renew bool) {
+	cs.leaseLk.Lock()
+	defer cs.leaseLk.Unlock()
+
+	exp, ok := cs.leases[user]
+	if !ok {
+		return false, true
+	}
+
+	left := time.Until(exp)
+	return left > 0, left < cs.opts.LeaseTTL/2
+}
+
+func (cs *FileCarStore) acquireLease(ctx context.Context, user models.Uid) error {
+	// the lease is only counted from before we asked for it, so we never
+	// think we hold it for longer than the meta DB does
+	now := time.Now()
+	expires := now.Add(cs.opts.LeaseTTL)
+
+	ok, err := cs.leaser.AcquireUserLease(ctx, user, cs.opts.NodeID, now, expires)
+	if err != nil {
+		return fmt.Errorf("acquiring user lease: %w", err)
+	}
+	if !ok {
+		cs.leaseLk.Lock()
+		delete(cs.leases, user)
+		cs.leaseLk.Unlock()
+
+		leaseConflicts.Inc()
+		return ErrUserLeaseHeld
+	}
+
+	cs.leaseLk.Lock()
+	cs.leases[user] = expires
+	cs.leaseLk.Unlock()
+	return nil
+}
+
+// forgetLease drops the user's lease after a write found it had been lost,
+// so the next write takes it again and reloads the user's head
+func (cs *FileCarStore) forgetLease(user models.Uid) {
+	cs.leaseLk.Lock()
+	delete(cs.leases, user)
+	cs.leaseLk.Unlock()
+}
+
+// releaseLeases gives up all of this node's leases so other nodes can take
+// over its users straight away
+func (cs *FileCarStore) releaseLeases(ctx context.Context) error {
+	cs.leaseLk.Lock()
+	cs.leases = make(map[models.Uid]time.Time)
+	cs.leaseLk.Unlock()
+
+	return cs.leaser.ReleaseUserLeases(ctx, cs.opts.NodeID)
+}
+
+// runLeaseReaper forgets leases that have expired, so the map of them
+// doesn't grow with every user the node has ever written to
+func (cs *FileCarStore) runLeaseReaper() {
+	defer cs.wg.Done()
+
+	t := time.NewTicker(cs.opts.LeaseTTL)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-cs.exit:
+			return
+		case <-t.C:
+			now := time.Now()
+			cs.leaseLk.Lock()
+			for u, exp := range cs.leases {
+				if now.After(exp) {
+					delete(cs.leases, u)
+				}
+			}
+			cs.leaseLk.Unlock()
+		}
+	}
+}
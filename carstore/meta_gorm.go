@@ -14,10 +14,25 @@ import (
 	"go.opentelemetry.io/otel"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type CarStoreGormMeta struct {
 	meta *gorm.DB
+
+	// optional read-only replica of meta, see withReplica
+	replica *gorm.DB
+
+	// if set, the node whose lease writes must hold, see requireUserLease
+	leaseOwner string
+}
+
+func NewCarStoreGormMeta(meta *gorm.DB) (*CarStoreGormMeta, error) {
+	cs := &CarStoreGormMeta{meta: meta}
+	if err := cs.Init(); err != nil {
+		return nil, err
+	}
+	return cs, nil
 }
 
 func (cs *CarStoreGormMeta) Init() error {
@@ -27,6 +42,20 @@ func (cs *CarStoreGormMeta) Init() error {
 	if err := cs.meta.AutoMigrate(&staleRef{}); err != nil {
 		return err
 	}
+	if err := cs.meta.AutoMigrate(&shardIntent{}); err != nil {
+		return err
+	}
+	if err := cs.meta.AutoMigrate(&UserStorage{}); err != nil {
+		return err
+	}
+	if err := cs.meta.AutoMigrate(&userLease{}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Close is a no-op, the DB belongs to the caller
+func (cs *CarStoreGormMeta) Close() error {
 	return nil
 }
 
@@ -47,7 +76,8 @@ func (cs *CarStoreGormMeta) HasUidCid(ctx context.Context, user models.Uid, k ci
 
 // For some Cid, lookup the block ref.
 // Return the path of the file written, the offset within the file, and the user associated with the Cid.
-func (cs *CarStoreGormMeta) LookupBlockRef(ctx context.Context, k cid.Cid) (path string, offset int64, user models.Uid, err error) {
+// The ref may belong to a user other than the one asking.
+func (cs *CarStoreGormMeta) LookupBlockRef(ctx context.Context, _ models.Uid, k cid.Cid) (path string, offset int64, user models.Uid, err error) {
 	// TODO: for now, im using a join to ensure we only query blocks from the
 	// correct user. maybe it makes sense to put the user in the blockRef
 	// directly? tradeoff of time vs space
@@ -70,6 +100,45 @@ LIMIT 1;`, models.DbCID{CID: k}).Scan(&info).Error; err != nil {
 	return info.Path, info.Offset, info.Usr, nil
 }
 
+// userBlockLocation is the on-disk location of a block held by a particular user
+type userBlockLocation struct {
+	Cid    models.DbCID
+	Shard  uint
+	Path   string
+	Offset int64
+}
+
+// maximum number of cids per lookup query, to stay under sqlite's bound parameter limit
+const blockLookupBatchSize = 500
+
+// For a set of cids, find where each is stored among the given user's shards.
+// Cids that the user does not have are omitted from the result.
+func (cs *CarStoreGormMeta) LookupUserBlockRefs(ctx context.Context, user models.Uid, cids []cid.Cid) ([]userBlockLocation, error) {
+	var out []userBlockLocation
+	for len(cids) > 0 {
+		n := min(len(cids), blockLookupBatchSize)
+
+		dbcids := make([]models.DbCID, n)
+		for i, c := range cids[:n] {
+			dbcids[i] = models.DbCID{CID: c}
+		}
+		cids = cids[n:]
+
+		var batch []userBlockLocation
+		if err := cs.reader(ctx).WithContext(ctx).
+			Model(blockRef{}).
+			Select("block_refs.cid, block_refs.shard, car_shards.path, block_refs.offset").
+			Joins("left join car_shards on block_refs.shard = car_shards.id").
+			Where("car_shards.usr = ? AND block_refs.cid IN ?", user, dbcids).
+			Scan(&batch).Error; err != nil {
+			return nil, err
+		}
+		out = append(out, batch...)
+	}
+
+	return out, nil
+}
+
 func (cs *CarStoreGormMeta) GetLastShard(ctx context.Context, user models.Uid) (*CarShard, error) {
 	var lastShard CarShard
 	if err := cs.meta.WithContext(ctx).Model(CarShard{}).Limit(1).Order("seq desc").Find(&lastShard, "usr = ?", user).Error; err != nil {
@@ -90,7 +159,7 @@ func (cs *CarStoreGormMeta) GetUserShards(ctx context.Context, usr models.Uid) (
 // return all of a users's shards, descending by Seq
 func (cs *CarStoreGormMeta) GetUserShardsDesc(ctx context.Context, usr models.Uid, minSeq int) ([]CarShard, error) {
 	var shards []CarShard
-	if err := cs.meta.Order("seq desc").Find(&shards, "usr = ? AND seq >= ?", usr, minSeq).Error; err != nil {
+	if err := cs.reader(ctx).WithContext(ctx).Order("seq desc").Find(&shards, "usr = ? AND seq >= ?", usr, minSeq).Error; err != nil {
 		return nil, err
 	}
 	return shards, nil
@@ -106,7 +175,7 @@ func (cs *CarStoreGormMeta) GetUserStaleRefs(ctx context.Context, user models.Ui
 
 func (cs *CarStoreGormMeta) SeqForRev(ctx context.Context, user models.Uid, sinceRev string) (int, error) {
 	var untilShard CarShard
-	if err := cs.meta.Where("rev >= ? AND usr = ?", sinceRev, user).Order("rev").First(&untilShard).Error; err != nil {
+	if err := cs.reader(ctx).WithContext(ctx).Where("rev >= ? AND usr = ?", sinceRev, user).Order("rev").First(&untilShard).Error; err != nil {
 		return 0, fmt.Errorf("finding early shard: %w", err)
 	}
 	return untilShard.Seq, nil
@@ -121,15 +190,42 @@ func (cs *CarStoreGormMeta) GetCompactionTargets(ctx context.Context, minShardCo
 	return targets, nil
 }
 
-func (cs *CarStoreGormMeta) PutShardAndRefs(ctx context.Context, shard *CarShard, brefs []map[string]any, rmcids map[cid.Cid]bool) error {
+// PutShardAndRefs creates the shard, its block refs and any stale refs in a
+// single transaction. If intent is non-zero, the matching shardIntent is
+// cleared in that same transaction, so the shard becomes visible exactly when
+// its write intent goes away.
+func (cs *CarStoreGormMeta) PutShardAndRefs(ctx context.Context, shard *CarShard, brefs []map[string]any, rmcids map[cid.Cid]bool, intent uint) error {
 	// TODO: there should be a way to create the shard and block_refs that
 	// reference it in the same query, would save a lot of time
 	tx := cs.meta.WithContext(ctx).Begin()
 
+	if err := cs.checkUserLease(tx, shard.Usr); err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	if err := tx.WithContext(ctx).Create(shard).Error; err != nil {
 		return fmt.Errorf("failed to create shard in DB tx: %w", err)
 	}
 
+	if err := tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "usr"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"bytes":  gorm.Expr("user_storages.bytes + ?", shard.Size),
+			"shards": gorm.Expr("user_storages.shards + 1"),
+		}),
+	}).Create(&UserStorage{Usr: shard.Usr, Bytes: shard.Size, Shards: 1}).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to update user storage in DB tx: %w", err)
+	}
+
+	if intent != 0 {
+		if err := tx.Delete(&shardIntent{}, "id = ?", intent).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to clear shard intent in DB tx: %w", err)
+		}
+	}
+
 	for _, ref := range brefs {
 		ref["shard"] = shard.ID
 	}
@@ -162,6 +258,21 @@ func (cs *CarStoreGormMeta) PutShardAndRefs(ctx context.Context, shard *CarShard
 func (cs *CarStoreGormMeta) DeleteShardsAndRefs(ctx context.Context, ids []uint) error {
 	txn := cs.meta.Begin()
 
+	var usage []UserStorage
+	if err := txn.Model(&CarShard{}).Select("usr, sum(size) as bytes, count(*) as shards").Where("id in (?)", ids).Group("usr").Scan(&usage).Error; err != nil {
+		txn.Rollback()
+		return err
+	}
+	for _, u := range usage {
+		if err := txn.Model(&UserStorage{}).Where("usr = ?", u.Usr).Updates(map[string]any{
+			"bytes":  gorm.Expr("bytes - ?", u.Bytes),
+			"shards": gorm.Expr("shards - ?", u.Shards),
+		}).Error; err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
+
 	if err := txn.Delete(&CarShard{}, "id in (?)", ids).Error; err != nil {
 		txn.Rollback()
 		return err
@@ -218,27 +329,149 @@ func valuesStatementForShards(shards []uint) string {
 	return sb.String()
 }
 
-func (cs *CarStoreGormMeta) SetStaleRef(ctx context.Context, uid models.Uid, staleToKeep []cid.Cid) error {
-	txn := cs.meta.Begin()
-
-	if err := txn.Delete(&staleRef{}, "usr = ?", uid).Error; err != nil {
+// SwapShards replaces some of a user's shards with the compacted shards
+// written from them, in a single transaction: the new shards and their block
+// refs become visible, clearing their intents, exactly when the old ones go
+// away. The staleRefs rows compaction read are replaced with one holding the
+// cids it couldn't clean up; rows recorded since then are left alone.
+func (cs *CarStoreGormMeta) SwapShards(ctx context.Context, user models.Uid, add []compactedShard, remove []uint, staleRefs []uint, staleToKeep []cid.Cid) error {
+	tx := cs.meta.WithContext(ctx).Begin()
+	if err := cs.checkUserLease(tx, user); err != nil {
+		tx.Rollback()
 		return err
 	}
+	if err := swapShards(ctx, tx, user, add, remove, staleRefs, staleToKeep); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("failed to commit shard swap: %w", err)
+	}
+	return nil
+}
 
-	// now create a new staleRef with all the refs we couldn't clear out
+func swapShards(ctx context.Context, tx *gorm.DB, user models.Uid, add []compactedShard, remove []uint, staleRefs []uint, staleToKeep []cid.Cid) error {
+	var usage UserStorage
+	for _, c := range add {
+		if err := tx.Create(c.shard).Error; err != nil {
+			return fmt.Errorf("failed to create shard in DB tx: %w", err)
+		}
+		if c.intent != 0 {
+			if err := tx.Delete(&shardIntent{}, "id = ?", c.intent).Error; err != nil {
+				return fmt.Errorf("failed to clear shard intent in DB tx: %w", err)
+			}
+		}
+
+		for _, ref := range c.brefs {
+			ref["shard"] = c.shard.ID
+		}
+		if err := createBlockRefs(ctx, tx, c.brefs); err != nil {
+			return fmt.Errorf("failed to create block refs: %w", err)
+		}
+
+		usage.Bytes += c.shard.Size
+		usage.Shards++
+	}
+
+	const chunkSize = 2000
+	for i := 0; i < len(remove); i += chunkSize {
+		ids := remove[i:min(i+chunkSize, len(remove))]
+
+		var removed UserStorage
+		if err := tx.Model(&CarShard{}).Select("coalesce(sum(size), 0) as bytes, count(*) as shards").Where("id in (?) AND usr = ?", ids, user).Scan(&removed).Error; err != nil {
+			return err
+		}
+		usage.Bytes -= removed.Bytes
+		usage.Shards -= removed.Shards
+
+		if err := tx.Delete(&CarShard{}, "id in (?) AND usr = ?", ids, user).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&blockRef{}, "shard in (?)", ids).Error; err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Model(&UserStorage{}).Where("usr = ?", user).Updates(map[string]any{
+		"bytes":  gorm.Expr("bytes + ?", usage.Bytes),
+		"shards": gorm.Expr("shards + ?", usage.Shards),
+	}).Error; err != nil {
+		return fmt.Errorf("failed to update user storage in DB tx: %w", err)
+	}
+
+	for i := 0; i < len(staleRefs); i += chunkSize {
+		ids := staleRefs[i:min(i+chunkSize, len(staleRefs))]
+		if err := tx.Delete(&staleRef{}, "id in (?) AND usr = ?", ids, user).Error; err != nil {
+			return err
+		}
+	}
 	if len(staleToKeep) > 0 {
-		if err := txn.Create(&staleRef{
-			Usr:  uid,
+		if err := tx.Create(&staleRef{
+			Usr:  user,
 			Cids: packCids(staleToKeep),
 		}).Error; err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	if err := txn.Commit().Error; err != nil {
-		return fmt.Errorf("failed to commit staleRef updates: %w", err)
+// PutShardIntent records that a shard file is about to be written at the
+// given path. It must be called before the file is created on disk.
+func (cs *CarStoreGormMeta) PutShardIntent(ctx context.Context, intent *shardIntent) error {
+	return cs.meta.WithContext(ctx).Create(intent).Error
+}
+
+func (cs *CarStoreGormMeta) DeleteShardIntent(ctx context.Context, id uint) error {
+	return cs.meta.WithContext(ctx).Delete(&shardIntent{}, "id = ?", id).Error
+}
+
+// GetShardIntents returns all outstanding shard write intents, oldest first
+func (cs *CarStoreGormMeta) GetShardIntents(ctx context.Context) ([]shardIntent, error) {
+	var intents []shardIntent
+	if err := cs.meta.WithContext(ctx).Order("id asc").Find(&intents).Error; err != nil {
+		return nil, err
 	}
-	return nil
+	return intents, nil
+}
+
+// GetUserStorage returns the user's storage totals, which are zero for
+// unknown users
+func (cs *CarStoreGormMeta) GetUserStorage(ctx context.Context, usr models.Uid) (*UserStorage, error) {
+	out := UserStorage{Usr: usr}
+	if err := cs.meta.WithContext(ctx).Where("usr = ?", usr).Limit(1).Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetTopUserStorage returns the users using the most storage, largest first
+func (cs *CarStoreGormMeta) GetTopUserStorage(ctx context.Context, limit int) ([]UserStorage, error) {
+	var out []UserStorage
+	if err := cs.meta.WithContext(ctx).Order("bytes desc").Limit(limit).Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetShardsAfter returns up to limit shards of any user with IDs above after,
+// in ID order
+func (cs *CarStoreGormMeta) GetShardsAfter(ctx context.Context, after uint, limit int) ([]CarShard, error) {
+	var shards []CarShard
+	if err := cs.meta.WithContext(ctx).Where("id > ?", after).Order("id asc").Limit(limit).Find(&shards).Error; err != nil {
+		return nil, err
+	}
+	return shards, nil
+}
+
+// HasShardWithPath returns true if a committed shard references the given file
+func (cs *CarStoreGormMeta) HasShardWithPath(ctx context.Context, path string) (bool, error) {
+	var count int64
+	if err := cs.meta.WithContext(ctx).Model(CarShard{}).Where("path = ?", path).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
 }
 
 type CarShard struct {
@@ -251,6 +484,17 @@ type CarShard struct {
 	Path      string
 	Usr       models.Uid `gorm:"index:idx_car_shards_usr;index:idx_car_shards_usr_seq,priority:1"`
 	Rev       string
+	// size of the shard file in bytes; zero for shards written before sizes
+	// were recorded, until they are compacted
+	Size int64
+}
+
+// UserStorage is the total size of a user's shards, kept up to date as shards
+// are written and deleted
+type UserStorage struct {
+	Usr    models.Uid `gorm:"primarykey" json:"uid"`
+	Bytes  int64      `json:"bytes"`
+	Shards int64      `json:"shards"`
 }
 
 type blockRef struct {
@@ -268,6 +512,21 @@ type staleRef struct {
 	Usr  models.Uid `gorm:"index"`
 }
 
+// shardIntent is a write-ahead record for a shard file. It is created before
+// the file is written and deleted in the same transaction that commits the
+// shard row, so any intent that survives a crash points at a file that never
+// became visible through the meta DB.
+type shardIntent struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	Usr       models.Uid `gorm:"index"`
+	Seq       int
+	Path      string
+	Rev       string
+	// NodeID of the carstore that wrote it, see CarStoreOptions
+	Owner string
+}
+
 func (sr *staleRef) getCids() ([]cid.Cid, error) {
 	if sr.Cid != nil {
 		return []cid.Cid{sr.Cid.CID}, nil
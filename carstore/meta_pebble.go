@@ -0,0 +1,817 @@
+package carstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipfs/go-cid"
+	"go.opentelemetry.io/otel"
+	"gorm.io/gorm"
+)
+
+// CarStorePebbleMeta keeps carstore metadata in a local Pebble database
+// instead of SQL, so block lookups are a single key seek.
+//
+// Keys are a one byte table prefix followed by big-endian integers and raw
+// CID bytes, so that each user's data is contiguous:
+//
+//	'I'                          -> next ID (shards and intents share a sequence)
+//	's' shard                    -> CarShard (json)
+//	'h' uid rev 0x00 shard       -> nil; a user's shards in rev order
+//	'p' path                     -> shard
+//	'b' uid cid shard            -> offset (uvarint); block refs by (uid, cid)
+//	'r' shard cid                -> offset (uvarint); block refs by shard
+//	'x' uid id                   -> packed cids; stale refs
+//	'n' id                       -> shardIntent (json)
+//	'c' uid                      -> number of shards the user has
+//	'z' uid                      -> total size of the user's shards in bytes
+//
+// Shards are listed in rev order and assumed to have ascending seqs, which
+// holds for every shard the carstore writes. Writes are serialized so that
+// the ID sequence and shard counts stay consistent.
+type CarStorePebbleMeta struct {
+	db *pebble.DB
+
+	lk     sync.Mutex
+	nextID uint64
+}
+
+const (
+	pmNextID     = 'I'
+	pmShard      = 's'
+	pmUserShards = 'h'
+	pmShardPath  = 'p'
+	pmUserBlocks = 'b'
+	pmShardRefs  = 'r'
+	pmStaleRefs  = 'x'
+	pmIntent     = 'n'
+	pmShardCount = 'c'
+	pmUserBytes  = 'z'
+)
+
+func NewCarStorePebbleMeta(dir string) (*CarStorePebbleMeta, error) {
+	db, err := pebble.Open(dir, &pebble.Options{})
+	if err != nil {
+		return nil, fmt.Errorf("opening pebble meta db: %w", err)
+	}
+
+	m := &CarStorePebbleMeta{db: db, nextID: 1}
+
+	v, err := m.get([]byte{pmNextID})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if v != nil {
+		m.nextID = binary.BigEndian.Uint64(v)
+	}
+
+	return m, nil
+}
+
+func (m *CarStorePebbleMeta) Close() error {
+	return m.db.Close()
+}
+
+func pmKey(table byte, parts ...[]byte) []byte {
+	n := 1
+	for _, p := range parts {
+		n += len(p)
+	}
+	k := make([]byte, 1, n)
+	k[0] = table
+	for _, p := range parts {
+		k = append(k, p...)
+	}
+	return k
+}
+
+func be64(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
+// prefixEnd returns the smallest key greater than every key with the prefix
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+func (m *CarStorePebbleMeta) get(key []byte) ([]byte, error) {
+	v, closer, err := m.db.Get(key)
+	if err != nil {
+		if errors.Is(err, pebble.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer closer.Close()
+	return bytes.Clone(v), nil
+}
+
+func (m *CarStorePebbleMeta) prefixIter(prefix []byte) (*pebble.Iterator, error) {
+	return m.db.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixEnd(prefix),
+	})
+}
+
+// allocID must be called with m.lk held. The new counter value is written
+// with the batch.
+func (m *CarStorePebbleMeta) allocID(b *pebble.Batch) (uint64, error) {
+	id := m.nextID
+	m.nextID++
+	if err := b.Set([]byte{pmNextID}, be64(m.nextID), nil); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (m *CarStorePebbleMeta) getShard(id uint) (*CarShard, error) {
+	v, err := m.get(pmKey(pmShard, be64(uint64(id))))
+	if err != nil || v == nil {
+		return nil, err
+	}
+
+	var sh CarShard
+	if err := json.Unmarshal(v, &sh); err != nil {
+		return nil, fmt.Errorf("decoding shard %d: %w", id, err)
+	}
+	return &sh, nil
+}
+
+// findUserBlock returns the first shard and offset holding the user's copy of k
+func (m *CarStorePebbleMeta) findUserBlock(iter *pebble.Iterator, user models.Uid, k cid.Cid) (uint, int64, bool) {
+	prefix := pmKey(pmUserBlocks, be64(uint64(user)), k.Bytes())
+	if !iter.SeekGE(prefix) || !bytes.HasPrefix(iter.Key(), prefix) {
+		return 0, 0, false
+	}
+
+	key := iter.Key()
+	shard := binary.BigEndian.Uint64(key[len(key)-8:])
+	offset, _ := binary.Uvarint(iter.Value())
+	return uint(shard), int64(offset), true
+}
+
+func (m *CarStorePebbleMeta) userBlocksIter(user models.Uid) (*pebble.Iterator, error) {
+	return m.prefixIter(pmKey(pmUserBlocks, be64(uint64(user))))
+}
+
+func (m *CarStorePebbleMeta) HasUidCid(ctx context.Context, user models.Uid, k cid.Cid) (bool, error) {
+	iter, err := m.userBlocksIter(user)
+	if err != nil {
+		return false, err
+	}
+	defer iter.Close()
+
+	_, _, ok := m.findUserBlock(iter, user, k)
+	return ok, nil
+}
+
+// LookupBlockRef only finds the user's own copy of the block; refs are not
+// indexed by cid alone
+func (m *CarStorePebbleMeta) LookupBlockRef(ctx context.Context, user models.Uid, k cid.Cid) (path string, offset int64, usr models.Uid, err error) {
+	iter, err := m.userBlocksIter(user)
+	if err != nil {
+		return "", -1, 0, err
+	}
+	defer iter.Close()
+
+	shard, offset, ok := m.findUserBlock(iter, user, k)
+	if !ok {
+		return "", -1, 0, nil
+	}
+
+	sh, err := m.getShard(shard)
+	if err != nil {
+		return "", -1, 0, err
+	}
+	if sh == nil {
+		return "", -1, 0, fmt.Errorf("block ref points at missing shard %d", shard)
+	}
+	return sh.Path, offset, user, nil
+}
+
+func (m *CarStorePebbleMeta) LookupUserBlockRefs(ctx context.Context, user models.Uid, cids []cid.Cid) ([]userBlockLocation, error) {
+	iter, err := m.userBlocksIter(user)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	paths := make(map[uint]string)
+	var out []userBlockLocation
+	for _, c := range cids {
+		shard, offset, ok := m.findUserBlock(iter, user, c)
+		if !ok {
+			continue
+		}
+
+		path, ok := paths[shard]
+		if !ok {
+			sh, err := m.getShard(shard)
+			if err != nil {
+				return nil, err
+			}
+			if sh == nil {
+				return nil, fmt.Errorf("block ref points at missing shard %d", shard)
+			}
+			path = sh.Path
+			paths[shard] = path
+		}
+
+		out = append(out, userBlockLocation{
+			Cid:    models.DbCID{CID: c},
+			Shard:  shard,
+			Path:   path,
+			Offset: offset,
+		})
+	}
+
+	return out, nil
+}
+
+// userShards walks the user's shards in rev order, newest first if reverse is
+// set, until fn returns false
+func (m *CarStorePebbleMeta) userShards(user models.Uid, reverse bool, fn func(*CarShard) bool) error {
+	iter, err := m.prefixIter(pmKey(pmUserShards, be64(uint64(user))))
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	valid := iter.First()
+	if reverse {
+		valid = iter.Last()
+	}
+	for valid {
+		key := iter.Key()
+		id := binary.BigEndian.Uint64(key[len(key)-8:])
+		sh, err := m.getShard(uint(id))
+		if err != nil {
+			return err
+		}
+		if sh == nil {
+			return fmt.Errorf("shard index points at missing shard %d", id)
+		}
+		if !fn(sh) {
+			return nil
+		}
+
+		if reverse {
+			valid = iter.Prev()
+		} else {
+			valid = iter.Next()
+		}
+	}
+
+	return iter.Error()
+}
+
+func (m *CarStorePebbleMeta) GetLastShard(ctx context.Context, user models.Uid) (*CarShard, error) {
+	last := &CarShard{}
+	if err := m.userShards(user, true, func(sh *CarShard) bool {
+		last = sh
+		return false
+	}); err != nil {
+		return nil, err
+	}
+	return last, nil
+}
+
+func (m *CarStorePebbleMeta) GetUserShards(ctx context.Context, usr models.Uid) ([]CarShard, error) {
+	var shards []CarShard
+	if err := m.userShards(usr, false, func(sh *CarShard) bool {
+		shards = append(shards, *sh)
+		return true
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(shards, func(i, j int) bool { return shards[i].Seq < shards[j].Seq })
+	return shards, nil
+}
+
+func (m *CarStorePebbleMeta) GetUserShardsDesc(ctx context.Context, usr models.Uid, minSeq int) ([]CarShard, error) {
+	var shards []CarShard
+	if err := m.userShards(usr, true, func(sh *CarShard) bool {
+		if sh.Seq < minSeq {
+			return false
+		}
+		shards = append(shards, *sh)
+		return true
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(shards, func(i, j int) bool { return shards[i].Seq > shards[j].Seq })
+	return shards, nil
+}
+
+func (m *CarStorePebbleMeta) GetUserStaleRefs(ctx context.Context, user models.Uid) ([]staleRef, error) {
+	iter, err := m.prefixIter(pmKey(pmStaleRefs, be64(uint64(user))))
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var out []staleRef
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		out = append(out, staleRef{
+			ID:   uint(binary.BigEndian.Uint64(key[len(key)-8:])),
+			Cids: bytes.Clone(iter.Value()),
+			Usr:  user,
+		})
+	}
+	return out, iter.Error()
+}
+
+func (m *CarStorePebbleMeta) SeqForRev(ctx context.Context, user models.Uid, sinceRev string) (int, error) {
+	prefix := pmKey(pmUserShards, be64(uint64(user)))
+	iter, err := m.prefixIter(prefix)
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+
+	if !iter.SeekGE(pmKey(pmUserShards, be64(uint64(user)), []byte(sinceRev))) {
+		if err := iter.Error(); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("finding early shard: %w", gorm.ErrRecordNotFound)
+	}
+
+	key := iter.Key()
+	sh, err := m.getShard(uint(binary.BigEndian.Uint64(key[len(key)-8:])))
+	if err != nil {
+		return 0, err
+	}
+	if sh == nil {
+		return 0, fmt.Errorf("finding early shard: %w", gorm.ErrRecordNotFound)
+	}
+	return sh.Seq, nil
+}
+
+// GetCompactionTargets scans the per-user shard counts
+func (m *CarStorePebbleMeta) GetCompactionTargets(ctx context.Context, minShardCount int) ([]CompactionTarget, error) {
+	iter, err := m.prefixIter([]byte{pmShardCount})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var targets []CompactionTarget
+	for iter.First(); iter.Valid(); iter.Next() {
+		n := int(binary.BigEndian.Uint64(iter.Value()))
+		if n > minShardCount {
+			targets = append(targets, CompactionTarget{
+				Usr:       models.Uid(binary.BigEndian.Uint64(iter.Key()[1:])),
+				NumShards: n,
+			})
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(targets, func(i, j int) bool { return targets[i].NumShards > targets[j].NumShards })
+	return targets, nil
+}
+
+// addShardCount must be called with m.lk held
+func (m *CarStorePebbleMeta) addShardCount(b *pebble.Batch, user models.Uid, delta int) error {
+	key := pmKey(pmShardCount, be64(uint64(user)))
+
+	v, closer, err := b.Get(key)
+	var n int
+	switch {
+	case err == nil:
+		n = int(binary.BigEndian.Uint64(v))
+		closer.Close()
+	case errors.Is(err, pebble.ErrNotFound):
+	default:
+		return err
+	}
+
+	n += delta
+	if n <= 0 {
+		return b.Delete(key, nil)
+	}
+	return b.Set(key, be64(uint64(n)), nil)
+}
+
+// addStorageBytes must be called with m.lk held
+func (m *CarStorePebbleMeta) addStorageBytes(b *pebble.Batch, user models.Uid, delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+	key := pmKey(pmUserBytes, be64(uint64(user)))
+
+	v, closer, err := b.Get(key)
+	var n int64
+	switch {
+	case err == nil:
+		n = int64(binary.BigEndian.Uint64(v))
+		closer.Close()
+	case errors.Is(err, pebble.ErrNotFound):
+	default:
+		return err
+	}
+
+	n += delta
+	if n <= 0 {
+		return b.Delete(key, nil)
+	}
+	return b.Set(key, be64(uint64(n)), nil)
+}
+
+func (m *CarStorePebbleMeta) userStorage(user models.Uid) (*UserStorage, error) {
+	out := &UserStorage{Usr: user}
+	v, err := m.get(pmKey(pmUserBytes, be64(uint64(user))))
+	if err != nil {
+		return nil, err
+	}
+	if v != nil {
+		out.Bytes = int64(binary.BigEndian.Uint64(v))
+	}
+	v, err = m.get(pmKey(pmShardCount, be64(uint64(user))))
+	if err != nil {
+		return nil, err
+	}
+	if v != nil {
+		out.Shards = int64(binary.BigEndian.Uint64(v))
+	}
+	return out, nil
+}
+
+func (m *CarStorePebbleMeta) GetUserStorage(ctx context.Context, usr models.Uid) (*UserStorage, error) {
+	return m.userStorage(usr)
+}
+
+// GetTopUserStorage scans the per-user byte totals
+func (m *CarStorePebbleMeta) GetTopUserStorage(ctx context.Context, limit int) ([]UserStorage, error) {
+	iter, err := m.prefixIter([]byte{pmUserBytes})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var out []UserStorage
+	for iter.First(); iter.Valid(); iter.Next() {
+		out = append(out, UserStorage{
+			Usr:   models.Uid(binary.BigEndian.Uint64(iter.Key()[1:])),
+			Bytes: int64(binary.BigEndian.Uint64(iter.Value())),
+		})
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Bytes > out[j].Bytes })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	for i := range out {
+		us, err := m.userStorage(out[i].Usr)
+		if err != nil {
+			return nil, err
+		}
+		out[i].Shards = us.Shards
+	}
+	return out, nil
+}
+
+func userShardKey(sh *CarShard) []byte {
+	return pmKey(pmUserShards, be64(uint64(sh.Usr)), []byte(sh.Rev), []byte{0}, be64(uint64(sh.ID)))
+}
+
+func (m *CarStorePebbleMeta) PutShardAndRefs(ctx context.Context, shard *CarShard, brefs []map[string]any, rmcids map[cid.Cid]bool, intent uint) error {
+	ctx, span := otel.Tracer("carstore").Start(ctx, "PutShardAndRefs")
+	defer span.End()
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	b := m.db.NewIndexedBatch()
+	defer b.Close()
+
+	if err := m.putShard(b, shard, brefs, intent); err != nil {
+		return err
+	}
+
+	if len(rmcids) > 0 {
+		cids := make([]cid.Cid, 0, len(rmcids))
+		for c := range rmcids {
+			cids = append(cids, c)
+		}
+
+		srid, err := m.allocID(b)
+		if err != nil {
+			return err
+		}
+		if err := b.Set(pmKey(pmStaleRefs, be64(uint64(shard.Usr)), be64(srid)), packCids(cids), nil); err != nil {
+			return err
+		}
+	}
+
+	if err := b.Commit(pebble.Sync); err != nil {
+		return fmt.Errorf("failed to commit shard batch: %w", err)
+	}
+	return nil
+}
+
+// putShard adds the shard and its block refs to the batch, clearing its
+// intent. Must be called with m.lk held.
+func (m *CarStorePebbleMeta) putShard(b *pebble.Batch, shard *CarShard, brefs []map[string]any, intent uint) error {
+	id, err := m.allocID(b)
+	if err != nil {
+		return err
+	}
+	shard.ID = uint(id)
+	if shard.CreatedAt.IsZero() {
+		shard.CreatedAt = time.Now()
+	}
+
+	enc, err := json.Marshal(shard)
+	if err != nil {
+		return err
+	}
+	shardKey := be64(id)
+	if err := b.Set(pmKey(pmShard, shardKey), enc, nil); err != nil {
+		return err
+	}
+	if err := b.Set(userShardKey(shard), nil, nil); err != nil {
+		return err
+	}
+	if err := b.Set(pmKey(pmShardPath, []byte(shard.Path)), shardKey, nil); err != nil {
+		return err
+	}
+	if err := m.addShardCount(b, shard.Usr, 1); err != nil {
+		return err
+	}
+	if err := m.addStorageBytes(b, shard.Usr, shard.Size); err != nil {
+		return err
+	}
+
+	if intent != 0 {
+		if err := b.Delete(pmKey(pmIntent, be64(uint64(intent))), nil); err != nil {
+			return err
+		}
+	}
+
+	usr := be64(uint64(shard.Usr))
+	for _, ref := range brefs {
+		ref["shard"] = shard.ID
+
+		c := ref["cid"].(models.DbCID).CID.Bytes()
+		off := binary.AppendUvarint(nil, uint64(ref["offset"].(int64)))
+		if err := b.Set(pmKey(pmUserBlocks, usr, c, shardKey), off, nil); err != nil {
+			return err
+		}
+		if err := b.Set(pmKey(pmShardRefs, shardKey, c), off, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *CarStorePebbleMeta) DeleteShardsAndRefs(ctx context.Context, ids []uint) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	b := m.db.NewIndexedBatch()
+	defer b.Close()
+
+	for _, id := range ids {
+		if err := m.deleteShard(b, id); err != nil {
+			return err
+		}
+	}
+
+	return b.Commit(pebble.Sync)
+}
+
+// deleteShard adds the removal of the shard and its block refs to the batch.
+// Must be called with m.lk held.
+func (m *CarStorePebbleMeta) deleteShard(b *pebble.Batch, id uint) error {
+	sh, err := m.getShard(id)
+	if err != nil {
+		return err
+	}
+	if sh == nil {
+		return nil
+	}
+
+	shardKey := be64(uint64(id))
+	usr := be64(uint64(sh.Usr))
+
+	iter, err := m.prefixIter(pmKey(pmShardRefs, shardKey))
+	if err != nil {
+		return err
+	}
+	for iter.First(); iter.Valid(); iter.Next() {
+		c := iter.Key()[1+8:]
+		if err := b.Delete(pmKey(pmUserBlocks, usr, c, shardKey), nil); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	start := pmKey(pmShardRefs, shardKey)
+	if err := b.DeleteRange(start, prefixEnd(start), nil); err != nil {
+		return err
+	}
+	if err := b.Delete(pmKey(pmShard, shardKey), nil); err != nil {
+		return err
+	}
+	if err := b.Delete(userShardKey(sh), nil); err != nil {
+		return err
+	}
+
+	// compaction can rewrite a shard under the same path, so only drop
+	// the path entry if it still points here
+	pk := pmKey(pmShardPath, []byte(sh.Path))
+	cur, err := m.get(pk)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(cur, shardKey) {
+		if err := b.Delete(pk, nil); err != nil {
+			return err
+		}
+	}
+
+	if err := m.addShardCount(b, sh.Usr, -1); err != nil {
+		return err
+	}
+	return m.addStorageBytes(b, sh.Usr, -sh.Size)
+}
+
+func (m *CarStorePebbleMeta) GetBlockRefsForShards(ctx context.Context, shardIds []uint) ([]blockRef, error) {
+	var out []blockRef
+	for _, id := range shardIds {
+		iter, err := m.prefixIter(pmKey(pmShardRefs, be64(uint64(id))))
+		if err != nil {
+			return nil, err
+		}
+
+		for iter.First(); iter.Valid(); iter.Next() {
+			_, c, err := cid.CidFromBytes(iter.Key()[1+8:])
+			if err != nil {
+				iter.Close()
+				return nil, fmt.Errorf("decoding block ref for shard %d: %w", id, err)
+			}
+			off, _ := binary.Uvarint(iter.Value())
+
+			out = append(out, blockRef{
+				Cid:    models.DbCID{CID: c},
+				Shard:  id,
+				Offset: int64(off),
+			})
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (m *CarStorePebbleMeta) GetShardsAfter(ctx context.Context, after uint, limit int) ([]CarShard, error) {
+	iter, err := m.prefixIter([]byte{pmShard})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var out []CarShard
+	for iter.SeekGE(pmKey(pmShard, be64(uint64(after)+1))); iter.Valid() && len(out) < limit; iter.Next() {
+		var sh CarShard
+		if err := json.Unmarshal(iter.Value(), &sh); err != nil {
+			return nil, fmt.Errorf("decoding shard: %w", err)
+		}
+		out = append(out, sh)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (m *CarStorePebbleMeta) SwapShards(ctx context.Context, user models.Uid, add []compactedShard, remove []uint, staleRefs []uint, staleToKeep []cid.Cid) error {
+	ctx, span := otel.Tracer("carstore").Start(ctx, "SwapShards")
+	defer span.End()
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	b := m.db.NewIndexedBatch()
+	defer b.Close()
+
+	for _, cs := range add {
+		if err := m.putShard(b, cs.shard, cs.brefs, cs.intent); err != nil {
+			return err
+		}
+	}
+	for _, id := range remove {
+		if err := m.deleteShard(b, id); err != nil {
+			return err
+		}
+	}
+
+	usr := be64(uint64(user))
+	for _, id := range staleRefs {
+		if err := b.Delete(pmKey(pmStaleRefs, usr, be64(uint64(id))), nil); err != nil {
+			return err
+		}
+	}
+	if len(staleToKeep) > 0 {
+		id, err := m.allocID(b)
+		if err != nil {
+			return err
+		}
+		if err := b.Set(pmKey(pmStaleRefs, usr, be64(id)), packCids(staleToKeep), nil); err != nil {
+			return err
+		}
+	}
+
+	if err := b.Commit(pebble.Sync); err != nil {
+		return fmt.Errorf("failed to commit shard swap: %w", err)
+	}
+	return nil
+}
+
+func (m *CarStorePebbleMeta) PutShardIntent(ctx context.Context, intent *shardIntent) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	b := m.db.NewBatch()
+	defer b.Close()
+
+	id, err := m.allocID(b)
+	if err != nil {
+		return err
+	}
+	intent.ID = uint(id)
+	if intent.CreatedAt.IsZero() {
+		intent.CreatedAt = time.Now()
+	}
+
+	enc, err := json.Marshal(intent)
+	if err != nil {
+		return err
+	}
+	if err := b.Set(pmKey(pmIntent, be64(id)), enc, nil); err != nil {
+		return err
+	}
+
+	return b.Commit(pebble.Sync)
+}
+
+func (m *CarStorePebbleMeta) DeleteShardIntent(ctx context.Context, id uint) error {
+	return m.db.Delete(pmKey(pmIntent, be64(uint64(id))), pebble.Sync)
+}
+
+func (m *CarStorePebbleMeta) GetShardIntents(ctx context.Context) ([]shardIntent, error) {
+	iter, err := m.prefixIter([]byte{pmIntent})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var out []shardIntent
+	for iter.First(); iter.Valid(); iter.Next() {
+		var in shardIntent
+		if err := json.Unmarshal(iter.Value(), &in); err != nil {
+			return nil, fmt.Errorf("decoding shard intent: %w", err)
+		}
+		out = append(out, in)
+	}
+	return out, iter.Error()
+}
+
+func (m *CarStorePebbleMeta) HasShardWithPath(ctx context.Context, path string) (bool, error) {
+	v, err := m.get(pmKey(pmShardPath, []byte(path)))
+	if err != nil {
+		return false, err
+	}
+	return v != nil, nil
+}
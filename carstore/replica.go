@@ -0,0 +1,132 @@
+package carstore
+
+import (
+	"context"
+	"os"
+
+	"github.com/bluesky-social/indigo/models"
+
+	"github.com/ipfs/go-cid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gorm.io/gorm"
+)
+
+var replicaReads = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "carstore_replica_reads_total",
+	Help: "Number of sync reads whose metadata lookups were served by the read replica, or fell back to the primary",
+}, []string{"result"})
+
+type replicaCtxKey struct{}
+
+// withReplica marks metadata queries made with ctx as safe to serve from the
+// read replica. Only reads that can detect and recover from replication lag
+// use it; everything else, in particular the write path, reads from the
+// primary.
+func withReplica(ctx context.Context) context.Context {
+	return context.WithValue(ctx, replicaCtxKey{}, true)
+}
+
+func usesReplica(ctx context.Context) bool {
+	v, _ := ctx.Value(replicaCtxKey{}).(bool)
+	return v
+}
+
+// reader returns the DB to run a metadata read on
+func (cs *CarStoreGormMeta) reader(ctx context.Context) *gorm.DB {
+	if cs.replica != nil && usesReplica(ctx) {
+		return cs.replica
+	}
+	return cs.meta
+}
+
+// userCarShardsForRead lists the shards a read of the user's repo is served
+// from. With a read replica, the replica is used so long as it has caught up
+// to the repo's head and every shard it lists is still on disk (compaction may
+// have since replaced them); otherwise the primary is asked.
+func (cs *FileCarStore) userCarShardsForRead(ctx context.Context, user models.Uid, sinceRev string) ([]CarShard, error) {
+	if cs.opts.ReadReplica != nil {
+		shards, err := cs.userCarShards(withReplica(ctx), user, sinceRev)
+		if err == nil && cs.replicaCurrent(ctx, user, shards) {
+			replicaReads.WithLabelValues("replica").Inc()
+			return shards, nil
+		}
+		replicaReads.WithLabelValues("primary_fallback").Inc()
+	}
+
+	return cs.userCarShards(ctx, user, sinceRev)
+}
+
+func (cs *FileCarStore) replicaCurrent(ctx context.Context, user models.Uid, shards []CarShard) bool {
+	if len(shards) == 0 {
+		return false
+	}
+
+	head, err := cs.getHead(ctx, user)
+	if err != nil || shards[0].Seq != head.Seq {
+		return false
+	}
+
+	return shardFilesExist(shards)
+}
+
+// lookupUserBlockRefsForRead is LookupUserBlockRefs for serving reads. With a
+// read replica, cids the replica doesn't know about (or whose shards are gone
+// from disk) are looked up again on the primary.
+func (cs *FileCarStore) lookupUserBlockRefsForRead(ctx context.Context, user models.Uid, cids []cid.Cid) ([]userBlockLocation, error) {
+	if cs.opts.ReadReplica == nil || len(cids) == 0 {
+		return cs.meta.LookupUserBlockRefs(ctx, user, cids)
+	}
+
+	locs, err := cs.meta.LookupUserBlockRefs(withReplica(ctx), user, cids)
+	if err != nil {
+		replicaReads.WithLabelValues("primary_fallback").Inc()
+		return cs.meta.LookupUserBlockRefs(ctx, user, cids)
+	}
+
+	found := make(map[cid.Cid]bool, len(locs))
+	checked := make(map[string]bool)
+	for _, loc := range locs {
+		if _, ok := checked[loc.Path]; !ok {
+			_, err := os.Stat(loc.Path)
+			checked[loc.Path] = err == nil
+		}
+		if checked[loc.Path] {
+			found[loc.Cid.CID] = true
+		}
+	}
+
+	var missing []cid.Cid
+	for _, c := range cids {
+		if !found[c] {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) == 0 {
+		replicaReads.WithLabelValues("replica").Inc()
+		return locs, nil
+	}
+
+	replicaReads.WithLabelValues("primary_fallback").Inc()
+	more, err := cs.meta.LookupUserBlockRefs(ctx, user, missing)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]userBlockLocation, 0, len(locs)+len(more))
+	for _, loc := range locs {
+		if checked[loc.Path] {
+			out = append(out, loc)
+		}
+	}
+	return append(out, more...), nil
+}
+
+func shardFilesExist(shards []CarShard) bool {
+	for _, sh := range shards {
+		if _, err := os.Stat(sh.Path); err != nil {
+			return false
+		}
+	}
+	return true
+}
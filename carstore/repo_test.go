@@ -13,6 +13,7 @@ import (
 
 	"github.com/bluesky-social/indigo/api/bsky"
 	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/models"
 	"github.com/bluesky-social/indigo/repo"
 	"github.com/bluesky-social/indigo/util"
 	sqlbs "github.com/ipfs/go-bs-sqlite3"
@@ -20,11 +21,18 @@ import (
 	flatfs "github.com/ipfs/go-ds-flatfs"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	ipld "github.com/ipfs/go-ipld-format"
+	car "github.com/ipld/go-car"
+	"github.com/multiformats/go-multihash"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
 func testCarStore() (CarStore, func(), error) {
+	return testCarStoreWithOptions(nil)
+}
+
+func testCarStoreWithOptions(opts *CarStoreOptions) (CarStore, func(), error) {
 	tempdir, err := os.MkdirTemp("", "msttest-")
 	if err != nil {
 		return nil, nil, err
@@ -45,12 +53,13 @@ func testCarStore() (CarStore, func(), error) {
 		return nil, nil, err
 	}
 
-	cs, err := NewCarStore(db, sharddir)
+	cs, err := NewCarStoreWithOptions(db, sharddir, opts)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	return cs, func() {
+		_ = cs.Shutdown(context.TODO())
 		_ = os.RemoveAll(tempdir)
 	}, nil
 }
@@ -250,6 +259,343 @@ func TestRepeatedCompactions(t *testing.T) {
 	checkRepo(t, cs, buf, recs)
 }
 
+func TestPebbleMeta(t *testing.T) {
+	ctx := context.TODO()
+
+	tempdir := t.TempDir()
+	sharddir := filepath.Join(tempdir, "shards")
+	metadir := filepath.Join(tempdir, "meta")
+
+	open := func() CarStore {
+		meta, err := NewCarStorePebbleMeta(metadir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := DefaultCarStoreOptions()
+		opts.Meta = meta
+		cs, err := NewCarStoreWithOptions(nil, sharddir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cs
+	}
+
+	cs := open()
+
+	ds, err := cs.NewDeltaSession(ctx, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ncid, rev, err := setupRepo(ctx, ds, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ds.CloseWithRoot(ctx, ncid, rev); err != nil {
+		t.Fatal(err)
+	}
+
+	var recs []cid.Cid
+	var lastRec, midRev string
+	head := ncid
+	for i := 0; i < 30; i++ {
+		ds, err := cs.NewDeltaSession(ctx, 1, &rev)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr, err := repo.OpenRepo(ctx, ds, head)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%4 == 3 {
+			if err := rr.DeleteRecord(ctx, lastRec); err != nil {
+				t.Fatal(err)
+			}
+			recs = recs[:len(recs)-1]
+		} else {
+			rc, tid, err := rr.CreateRecord(ctx, "app.bsky.feed.post", &appbsky.FeedPost{
+				Text: fmt.Sprintf("hey look its a tweet %d", time.Now().UnixNano()),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recs = append(recs, rc)
+			lastRec = "app.bsky.feed.post/" + tid
+		}
+
+		kmgr := &util.FakeKeyManager{}
+		nroot, nrev, err := rr.Commit(ctx, kmgr.SignForUser)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rev = nrev
+		if i == 20 {
+			midRev = rev
+		}
+
+		if err := ds.CalcDiff(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ds.CloseWithRoot(ctx, nroot, rev); err != nil {
+			t.Fatal(err)
+		}
+
+		head = nroot
+	}
+
+	targets, err := cs.GetCompactionTargets(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0].Usr != 1 || targets[0].NumShards != 31 {
+		t.Fatalf("unexpected compaction targets: %+v", targets)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := cs.ReadUserCar(ctx, 1, "", true, buf); err != nil {
+		t.Fatal(err)
+	}
+	checkRepo(t, cs, buf, recs)
+
+	if _, err := cs.CompactUserShards(ctx, 1, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// everything must survive a restart, and new shards must not reuse IDs
+	if err := cs.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cs = open()
+	defer cs.Shutdown(ctx)
+
+	buf = new(bytes.Buffer)
+	if err := cs.ReadUserCar(ctx, 1, "", true, buf); err != nil {
+		t.Fatal(err)
+	}
+	checkRepo(t, cs, buf, recs)
+
+	buf = new(bytes.Buffer)
+	if err := cs.ReadUserCar(ctx, 1, midRev, true, buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() == 0 {
+		t.Fatal("expected incremental car to have data")
+	}
+
+	h, err := cs.GetUserRepoHead(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != head {
+		t.Fatalf("head mismatch after reopen: %s != %s", h, head)
+	}
+
+	ds, err = cs.NewDeltaSession(ctx, 1, &rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr, err := repo.OpenRepo(ctx, ds, head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, _, err := rr.CreateRecord(ctx, "app.bsky.feed.post", &appbsky.FeedPost{Text: "after reopen"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs = append(recs, rc)
+	kmgr := &util.FakeKeyManager{}
+	nroot, nrev, err := rr.Commit(ctx, kmgr.SignForUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.CalcDiff(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.CloseWithRoot(ctx, nroot, nrev); err != nil {
+		t.Fatal(err)
+	}
+
+	buf = new(bytes.Buffer)
+	if err := cs.ReadUserCar(ctx, 1, "", true, buf); err != nil {
+		t.Fatal(err)
+	}
+	checkRepo(t, cs, buf, recs)
+
+	// compacted and new shards check out against their refs
+	scrubbed, err := cs.ScrubShards(ctx, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scrubbed) < 2 {
+		t.Fatalf("expected the compacted and new shards to be scrubbed, got %d", len(scrubbed))
+	}
+	for _, r := range scrubbed {
+		if r.Corrupt() {
+			t.Fatalf("unexpected problems with shard %d: %+v", r.Shard, r.Problems)
+		}
+	}
+
+	if err := cs.WipeUserData(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	targets, err = cs.GetCompactionTargets(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 0 {
+		t.Fatalf("expected no shards left after wipe: %+v", targets)
+	}
+}
+
+func TestWriteBuffer(t *testing.T) {
+	ctx := context.TODO()
+
+	opts := DefaultCarStoreOptions()
+	opts.BufferCommits = 5
+	opts.BufferMaxAge = time.Hour
+
+	cs, cleanup, err := testCarStoreWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	fcs := cs.(*FileCarStore)
+
+	ds, err := cs.NewDeltaSession(ctx, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ncid, rev, err := setupRepo(ctx, ds, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ds.CloseWithRoot(ctx, ncid, rev); err != nil {
+		t.Fatal(err)
+	}
+
+	var recs []cid.Cid
+	var lastRec string
+	head := ncid
+	for i := 0; i < 12; i++ {
+		ds, err := cs.NewDeltaSession(ctx, 1, &rev)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr, err := repo.OpenRepo(ctx, ds, head)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// delete a record written earlier in the same buffer
+		if i == 7 {
+			if err := rr.DeleteRecord(ctx, lastRec); err != nil {
+				t.Fatal(err)
+			}
+			recs = recs[:len(recs)-1]
+		}
+
+		rc, tid, err := rr.CreateRecord(ctx, "app.bsky.feed.post", &appbsky.FeedPost{
+			Text: fmt.Sprintf("hey look its a tweet %d", time.Now().UnixNano()),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rc)
+		lastRec = "app.bsky.feed.post/" + tid
+
+		kmgr := &util.FakeKeyManager{}
+		nroot, nrev, err := rr.Commit(ctx, kmgr.SignForUser)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rev = nrev
+
+		if err := ds.CalcDiff(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ds.CloseWithRoot(ctx, nroot, rev); err != nil {
+			t.Fatal(err)
+		}
+
+		head = nroot
+	}
+
+	// 13 commits with a buffer of 5 leaves two consolidated shards on disk
+	// and three commits in memory
+	shards, err := fcs.meta.GetUserShards(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shards) != 2 {
+		t.Fatalf("expected 2 shards on disk, got %d", len(shards))
+	}
+
+	rhead, err := cs.GetUserRepoHead(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rhead != head {
+		t.Fatalf("repo head should include buffered commits: %s != %s", rhead, head)
+	}
+
+	rrev, err := cs.GetUserRepoRev(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rrev != rev {
+		t.Fatalf("repo rev should include buffered commits: %s != %s", rrev, rev)
+	}
+
+	// buffered blocks are readable before they are flushed
+	ro, err := cs.ReadOnlySession(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr, err := repo.OpenRepo(ctx, ro, head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := rr.GetRecordBytes(ctx, lastRec); err != nil {
+		t.Fatal(err)
+	}
+
+	blks, err := cs.ReadUserBlocks(ctx, 1, []cid.Cid{head, recs[len(recs)-1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blks) != 2 {
+		t.Fatalf("expected 2 blocks from the write buffer, got %d", len(blks))
+	}
+
+	buf := new(bytes.Buffer)
+	if err := cs.ReadUserCar(ctx, 1, "", true, buf); err != nil {
+		t.Fatal(err)
+	}
+	checkRepo(t, cs, buf, recs)
+
+	shards, err = fcs.meta.GetUserShards(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shards) != 3 {
+		t.Fatalf("expected reading the car to flush the buffer, got %d shards", len(shards))
+	}
+	if shards[2].Root.CID != head || shards[2].Rev != rev {
+		t.Fatal("last shard should be at the repo head")
+	}
+}
+
 func checkRepo(t *testing.T, cs CarStore, r io.Reader, expRecs []cid.Cid) {
 	t.Helper()
 	rep, err := repo.ReadRepoFromCar(context.TODO(), r)
@@ -581,3 +927,1106 @@ func TestDuplicateBlockAcrossShards(t *testing.T) {
 	}
 	checkRepo(t, cs, buf, recs)
 }
+
+func TestRecoverShardIntents(t *testing.T) {
+	ctx := context.TODO()
+
+	cs, cleanup, err := testCarStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	ds, err := cs.NewDeltaSession(ctx, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ncid, rev, err := setupRepo(ctx, ds, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ds.CloseWithRoot(ctx, ncid, rev); err != nil {
+		t.Fatal(err)
+	}
+
+	fcs := cs.(*FileCarStore)
+
+	// simulate a crash after the shard file was written but before the
+	// meta DB transaction committed
+	orphan := filepath.Join(fcs.rootDir, fnameForShard(1, 2))
+	if err := os.WriteFile(orphan, []byte("partial"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	if err := fcs.meta.PutShardIntent(ctx, &shardIntent{Usr: 1, Seq: 2, Path: orphan, Rev: "nope"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fcs.recoverShardIntents(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatalf("expected orphaned shard file to be removed, got: %v", err)
+	}
+
+	intents, err := fcs.meta.GetShardIntents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(intents) != 0 {
+		t.Fatalf("expected no outstanding intents, got %d", len(intents))
+	}
+
+	headRev, err := cs.GetUserRepoRev(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headRev != rev {
+		t.Fatalf("repo head moved during recovery: %s != %s", headRev, rev)
+	}
+}
+
+func TestReadUserBlocks(t *testing.T) {
+	ctx := context.TODO()
+
+	cs, cleanup, err := testCarStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	ds, err := cs.NewDeltaSession(ctx, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ncid, rev, err := setupRepo(ctx, ds, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ds.CloseWithRoot(ctx, ncid, rev); err != nil {
+		t.Fatal(err)
+	}
+
+	// spread the blocks we ask for across several shards
+	want := []cid.Cid{ncid}
+	head := ncid
+	for i := 0; i < 5; i++ {
+		ds, err := cs.NewDeltaSession(ctx, 1, &rev)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr, err := repo.OpenRepo(ctx, ds, head)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rc, _, err := rr.CreateRecord(ctx, "app.bsky.feed.post", &appbsky.FeedPost{
+			Text: fmt.Sprintf("hey look its a tweet %d", time.Now().UnixNano()),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kmgr := &util.FakeKeyManager{}
+		nroot, nrev, err := rr.Commit(ctx, kmgr.SignForUser)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rev = nrev
+
+		if err := ds.CalcDiff(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ds.CloseWithRoot(ctx, nroot, rev); err != nil {
+			t.Fatal(err)
+		}
+
+		head = nroot
+		want = append(want, rc, nroot)
+	}
+
+	missing, err := cid.NewPrefixV1(cid.Raw, multihash.SHA2_256).Sum([]byte("not in the repo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blks, err := cs.ReadUserBlocks(ctx, 1, append(want, missing))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(blks) != len(want) {
+		t.Fatalf("expected %d blocks, got %d", len(want), len(blks))
+	}
+
+	got := make(map[cid.Cid]bool)
+	for _, blk := range blks {
+		got[blk.Cid()] = true
+	}
+	for _, c := range want {
+		if !got[c] {
+			t.Fatalf("missing block %s", c)
+		}
+	}
+
+	// blocks belonging to another user must not be returned
+	blks, err = cs.ReadUserBlocks(ctx, 2, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blks) != 0 {
+		t.Fatalf("expected no blocks for other user, got %d", len(blks))
+	}
+}
+
+func TestUserStorage(t *testing.T) {
+	ctx := context.TODO()
+
+	for _, backend := range []string{"gorm", "pebble"} {
+		t.Run(backend, func(t *testing.T) {
+			tempdir := t.TempDir()
+			sharddir := filepath.Join(tempdir, "shards")
+
+			opts := DefaultCarStoreOptions()
+			var db *gorm.DB
+			if backend == "pebble" {
+				meta, err := NewCarStorePebbleMeta(filepath.Join(tempdir, "meta"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				opts.Meta = meta
+			} else {
+				var err error
+				db, err = gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{SkipDefaultTransaction: true})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			cs, err := NewCarStoreWithOptions(db, sharddir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cs.Shutdown(ctx)
+
+			var observed int64
+			cs.SetStorageObserver(func(user models.Uid, delta int64) {
+				if user != 1 {
+					t.Errorf("observed change for unexpected user %d", user)
+				}
+				observed += delta
+			})
+
+			diskUsage := func() int64 {
+				var total int64
+				err := filepath.Walk(sharddir, func(path string, info os.FileInfo, err error) error {
+					if err != nil {
+						return err
+					}
+					if !info.IsDir() {
+						total += info.Size()
+					}
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return total
+			}
+
+			checkUsage := func(stage string) {
+				t.Helper()
+				if err := cs.Flush(ctx); err != nil {
+					t.Fatal(err)
+				}
+				us, err := cs.UserStorage(ctx, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				shards, err := cs.Stat(ctx, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if disk := diskUsage(); us.Bytes != disk {
+					t.Fatalf("%s: recorded %d bytes, %d on disk", stage, us.Bytes, disk)
+				}
+				if us.Shards != int64(len(shards)) {
+					t.Fatalf("%s: recorded %d shards, have %d", stage, us.Shards, len(shards))
+				}
+				if observed != us.Bytes {
+					t.Fatalf("%s: observer saw %d bytes, recorded %d", stage, observed, us.Bytes)
+				}
+			}
+
+			ds, err := cs.NewDeltaSession(ctx, 1, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			head, rev, err := setupRepo(ctx, ds, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ds.CloseWithRoot(ctx, head, rev); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 10; i++ {
+				ds, err := cs.NewDeltaSession(ctx, 1, &rev)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rr, err := repo.OpenRepo(ctx, ds, head)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, _, err := rr.CreateRecord(ctx, "app.bsky.feed.post", &appbsky.FeedPost{
+					Text: fmt.Sprintf("hey look its a tweet %d", i),
+				}); err != nil {
+					t.Fatal(err)
+				}
+				kmgr := &util.FakeKeyManager{}
+				head, rev, err = rr.Commit(ctx, kmgr.SignForUser)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := ds.CalcDiff(ctx, nil); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := ds.CloseWithRoot(ctx, head, rev); err != nil {
+					t.Fatal(err)
+				}
+			}
+			checkUsage("after writes")
+
+			if _, err := cs.CompactUserShards(ctx, 1, false); err != nil {
+				t.Fatal(err)
+			}
+			checkUsage("after compaction")
+
+			top, err := cs.TopUserStorage(ctx, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(top) != 1 || top[0].Usr != 1 || top[0].Bytes != observed {
+				t.Fatalf("unexpected top storage: %+v", top)
+			}
+
+			if err := cs.WipeUserData(ctx, 1); err != nil {
+				t.Fatal(err)
+			}
+			checkUsage("after wipe")
+			if observed != 0 {
+				t.Fatalf("expected no storage after wipe, observer saw %d", observed)
+			}
+		})
+	}
+}
+
+func TestReadReplica(t *testing.T) {
+	ctx := context.TODO()
+
+	replica, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "replica.sqlite")), &gorm.Config{
+		SkipDefaultTransaction: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewCarStoreGormMeta(replica); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultCarStoreOptions()
+	opts.ReadReplica = replica
+
+	cs, cleanup, err := testCarStoreWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	fcs := cs.(*FileCarStore)
+
+	ds, err := cs.NewDeltaSession(ctx, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head, rev, err := setupRepo(ctx, ds, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ds.CloseWithRoot(ctx, head, rev); err != nil {
+		t.Fatal(err)
+	}
+
+	commit := func() cid.Cid {
+		ds, err := cs.NewDeltaSession(ctx, 1, &rev)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr, err := repo.OpenRepo(ctx, ds, head)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rc, _, err := rr.CreateRecord(ctx, "app.bsky.feed.post", &appbsky.FeedPost{
+			Text: fmt.Sprintf("hey look its a tweet %d", time.Now().UnixNano()),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kmgr := &util.FakeKeyManager{}
+		nroot, nrev, err := rr.Commit(ctx, kmgr.SignForUser)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ds.CalcDiff(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ds.CloseWithRoot(ctx, nroot, nrev); err != nil {
+			t.Fatal(err)
+		}
+
+		head, rev = nroot, nrev
+		return rc
+	}
+
+	// stand in for replication: copy everything the primary has
+	replicate := func() {
+		primary := fcs.meta.(*CarStoreGormMeta).meta
+
+		var shards []CarShard
+		if err := primary.Find(&shards).Error; err != nil {
+			t.Fatal(err)
+		}
+		var refs []blockRef
+		if err := primary.Find(&refs).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		if err := replica.Exec("DELETE FROM car_shards").Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := replica.Exec("DELETE FROM block_refs").Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := replica.Create(&shards).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := replica.CreateInBatches(&refs, 100).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readRoot := func() cid.Cid {
+		buf := new(bytes.Buffer)
+		if err := cs.ReadUserCar(ctx, 1, "", true, buf); err != nil {
+			t.Fatal(err)
+		}
+		cr, err := car.NewCarReader(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cr.Header.Roots[0]
+	}
+
+	replicaReads.Reset()
+	counts := func() (float64, float64) {
+		return testutil.ToFloat64(replicaReads.WithLabelValues("replica")), testutil.ToFloat64(replicaReads.WithLabelValues("primary_fallback"))
+	}
+
+	// an empty replica falls back to the primary
+	rec := commit()
+	if root := readRoot(); root != head {
+		t.Fatalf("expected root %s, got %s", head, root)
+	}
+	blks, err := cs.ReadUserBlocks(ctx, 1, []cid.Cid{rec, head})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blks) != 2 {
+		t.Fatalf("expected 2 blocks, got %d", len(blks))
+	}
+	if r, f := counts(); r != 0 || f != 2 {
+		t.Fatalf("expected 2 fallbacks, got %v replica %v fallback", r, f)
+	}
+
+	// a caught up replica serves reads
+	replicate()
+	if root := readRoot(); root != head {
+		t.Fatalf("expected root %s, got %s", head, root)
+	}
+	blks, err = cs.ReadUserBlocks(ctx, 1, []cid.Cid{rec, head})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blks) != 2 {
+		t.Fatalf("expected 2 blocks, got %d", len(blks))
+	}
+	if r, f := counts(); r != 2 || f != 2 {
+		t.Fatalf("expected 2 replica reads, got %v replica %v fallback", r, f)
+	}
+
+	// a lagging replica doesn't serve a stale repo
+	rec = commit()
+	if root := readRoot(); root != head {
+		t.Fatalf("expected root %s after replica fell behind, got %s", head, root)
+	}
+	blks, err = cs.ReadUserBlocks(ctx, 1, []cid.Cid{rec, head})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blks) != 2 {
+		t.Fatalf("expected 2 blocks, got %d", len(blks))
+	}
+	if r, f := counts(); r != 2 || f != 4 {
+		t.Fatalf("expected 4 fallbacks, got %v replica %v fallback", r, f)
+	}
+}
+
+func TestTrashAndRestore(t *testing.T) {
+	ctx := context.TODO()
+
+	opts := DefaultCarStoreOptions()
+	opts.BufferCommits = 4
+	opts.TrashRetention = time.Hour
+	cs, cleanup, err := testCarStoreWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	ds, err := cs.NewDeltaSession(ctx, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, rev, err := setupRepo(ctx, ds, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.CloseWithRoot(ctx, head, rev); err != nil {
+		t.Fatal(err)
+	}
+
+	var recs []cid.Cid
+	for i := 0; i < 10; i++ {
+		ds, err := cs.NewDeltaSession(ctx, 1, &rev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr, err := repo.OpenRepo(ctx, ds, head)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, _, err := rr.CreateRecord(ctx, "app.bsky.feed.post", &appbsky.FeedPost{
+			Text: fmt.Sprintf("hey look its a tweet %d", i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rc)
+		kmgr := &util.FakeKeyManager{}
+		head, rev, err = rr.Commit(ctx, kmgr.SignForUser)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ds.CalcDiff(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ds.CloseWithRoot(ctx, head, rev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the last commits are still buffered, and must be trashed with the rest
+	entry, err := cs.TrashUserData(ctx, 1, "takedown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || entry.Usr != 1 || entry.Reason != "takedown" || len(entry.Shards) == 0 {
+		t.Fatalf("unexpected trash entry: %+v", entry)
+	}
+	if shards, err := cs.Stat(ctx, 1); err != nil || len(shards) != 0 {
+		t.Fatalf("expected no shards after trashing, got %d (err: %v)", len(shards), err)
+	}
+	if us, err := cs.UserStorage(ctx, 1); err != nil || us.Bytes != 0 {
+		t.Fatalf("expected no storage after trashing, got %+v (err: %v)", us, err)
+	}
+
+	listed, err := cs.ListTrash(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].ID != entry.ID {
+		t.Fatalf("unexpected trash listing: %+v", listed)
+	}
+	if other, err := cs.ListTrash(ctx, 2); err != nil || len(other) != 0 {
+		t.Fatalf("expected no trash for another user, got %d (err: %v)", len(other), err)
+	}
+
+	if err := cs.RestoreUserData(ctx, 2, entry.ID); !errors.Is(err, ErrTrashNotFound) {
+		t.Fatalf("expected restoring another user's entry to fail, got %v", err)
+	}
+	if err := cs.RestoreUserData(ctx, 1, entry.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := cs.GetUserRepoHead(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != head {
+		t.Fatalf("restored head %s, expected %s", restored, head)
+	}
+	buf := new(bytes.Buffer)
+	if err := cs.ReadUserCar(ctx, 1, "", true, buf); err != nil {
+		t.Fatal(err)
+	}
+	checkRepo(t, cs, buf, recs)
+
+	if listed, err := cs.ListTrash(ctx, 0); err != nil || len(listed) != 0 {
+		t.Fatalf("expected restored entry to be removed, got %d (err: %v)", len(listed), err)
+	}
+
+	fcs := cs.(*FileCarStore)
+
+	// a restore that fails partway leaves the repo empty and the entry in
+	// place, so it can be retried once the problem is fixed
+	entry, err = cs.TrashUserData(ctx, 1, "takedown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := entry.Shards[0]
+	for _, ts := range entry.Shards {
+		if ts.Seq > last.Seq {
+			last = ts
+		}
+	}
+	lastPath := filepath.Join(fcs.trashDir(), entry.ID, last.File)
+	good, err := os.ReadFile(lastPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(lastPath, good[:len(good)/2], 0664); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.RestoreUserData(ctx, 1, entry.ID); err == nil {
+		t.Fatal("expected restoring a truncated shard to fail")
+	}
+	if shards, err := cs.Stat(ctx, 1); err != nil || len(shards) != 0 {
+		t.Fatalf("expected no shards after a failed restore, got %d (err: %v)", len(shards), err)
+	}
+	if err := os.WriteFile(lastPath, good, 0664); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.RestoreUserData(ctx, 1, entry.ID); err != nil {
+		t.Fatalf("expected the retried restore to succeed, got %v", err)
+	}
+	if restored, err := cs.GetUserRepoHead(ctx, 1); err != nil || restored != head {
+		t.Fatalf("restored head %s (err: %v), expected %s", restored, err, head)
+	}
+
+	// trashing interrupted after its manifest was written is finished on the
+	// next startup, whether or not the rows were dropped yet
+	shards, err := fcs.meta.GetUserShards(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := &TrashEntry{ID: "1-1", Usr: 1, Reason: "deleted", TrashedAt: time.Now(), Pending: true}
+	for _, sh := range shards {
+		pending.Bytes += sh.Size
+		pending.Shards = append(pending.Shards, TrashedShard{Seq: sh.Seq, Root: sh.Root.CID.String(), Rev: sh.Rev, Size: sh.Size, File: sh.Path})
+	}
+	pendingDir := filepath.Join(fcs.trashDir(), pending.ID)
+	if err := os.MkdirAll(pendingDir, 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeTrashManifest(pendingDir, pending); err != nil {
+		t.Fatal(err)
+	}
+	// as is one interrupted before its manifest
+	if err := os.MkdirAll(filepath.Join(fcs.trashDir(), "1-2"), 0775); err != nil {
+		t.Fatal(err)
+	}
+
+	if listed, err := cs.ListTrash(ctx, 1); err != nil || len(listed) != 0 {
+		t.Fatalf("expected pending entries not listed, got %d (err: %v)", len(listed), err)
+	}
+	if err := cs.RestoreUserData(ctx, 1, pending.ID); !errors.Is(err, ErrTrashNotFound) {
+		t.Fatalf("expected a pending entry not to be restored, got %v", err)
+	}
+	if err := fcs.recoverTrash(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if shards, err := cs.Stat(ctx, 1); err != nil || len(shards) != 0 {
+		t.Fatalf("expected no shards after recovery, got %d (err: %v)", len(shards), err)
+	}
+	if _, err := os.Stat(filepath.Join(fcs.trashDir(), "1-2")); !os.IsNotExist(err) {
+		t.Fatalf("expected the entry without a manifest removed, got %v", err)
+	}
+	listed, err = cs.ListTrash(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].ID != pending.ID || len(listed[0].Shards) != len(shards) {
+		t.Fatalf("unexpected trash listing after recovery: %+v", listed)
+	}
+	for _, ts := range listed[0].Shards {
+		if filepath.IsAbs(ts.File) {
+			t.Fatalf("expected shard files moved into the entry, got %s", ts.File)
+		}
+	}
+	if err := cs.RestoreUserData(ctx, 1, pending.ID); err != nil {
+		t.Fatal(err)
+	}
+	if restored, err := cs.GetUserRepoHead(ctx, 1); err != nil || restored != head {
+		t.Fatalf("restored head %s (err: %v), expected %s", restored, err, head)
+	}
+
+	// trash again, then let the entry expire
+	entry, err = cs.TrashUserData(ctx, 1, "deleted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := cs.PurgeTrash(ctx, entry.TrashedAt); err != nil || n != 0 {
+		t.Fatalf("expected nothing purged before the cutoff, got %d (err: %v)", n, err)
+	}
+	if n, err := cs.PurgeTrash(ctx, time.Now().Add(time.Second)); err != nil || n != 1 {
+		t.Fatalf("expected one entry purged, got %d (err: %v)", n, err)
+	}
+	if err := cs.RestoreUserData(ctx, 1, entry.ID); !errors.Is(err, ErrTrashNotFound) {
+		t.Fatalf("expected purged entry to be gone, got %v", err)
+	}
+}
+
+func TestCompactionDuringWrites(t *testing.T) {
+	ctx := context.TODO()
+
+	for _, backend := range []string{"gorm", "pebble"} {
+		t.Run(backend, func(t *testing.T) {
+			tempdir := t.TempDir()
+			sharddir := filepath.Join(tempdir, "shards")
+
+			opts := DefaultCarStoreOptions()
+			var db *gorm.DB
+			if backend == "pebble" {
+				meta, err := NewCarStorePebbleMeta(filepath.Join(tempdir, "meta"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				opts.Meta = meta
+			} else {
+				// compaction runs alongside the writes, so this needs a DB
+				// that every connection sees
+				var err error
+				db, err = gorm.Open(sqlite.Open(filepath.Join(tempdir, "meta.sqlite")), &gorm.Config{SkipDefaultTransaction: true})
+				if err != nil {
+					t.Fatal(err)
+				}
+				sqldb, err := db.DB()
+				if err != nil {
+					t.Fatal(err)
+				}
+				sqldb.SetMaxOpenConns(1)
+			}
+			cs, err := NewCarStoreWithOptions(db, sharddir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cs.Shutdown(ctx)
+
+			ds, err := cs.NewDeltaSession(ctx, 1, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			head, rev, err := setupRepo(ctx, ds, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ds.CloseWithRoot(ctx, head, rev); err != nil {
+				t.Fatal(err)
+			}
+
+			var recs []cid.Cid
+			var lastRec string
+			write := func(i int) {
+				t.Helper()
+				ds, err := cs.NewDeltaSession(ctx, 1, &rev)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rr, err := repo.OpenRepo(ctx, ds, head)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i%4 == 3 {
+					if err := rr.DeleteRecord(ctx, lastRec); err != nil {
+						t.Fatal(err)
+					}
+					recs = recs[:len(recs)-1]
+				} else {
+					rc, tid, err := rr.CreateRecord(ctx, "app.bsky.feed.post", &appbsky.FeedPost{
+						Text: fmt.Sprintf("hey look its a tweet %d", i),
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+					recs = append(recs, rc)
+					lastRec = "app.bsky.feed.post/" + tid
+				}
+				kmgr := &util.FakeKeyManager{}
+				head, rev, err = rr.Commit(ctx, kmgr.SignForUser)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := ds.CalcDiff(ctx, nil); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := ds.CloseWithRoot(ctx, head, rev); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for i := 0; i < 40; i++ {
+				write(i)
+			}
+
+			done := make(chan struct{})
+			errs := make(chan error, 1)
+			go func() {
+				defer close(errs)
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					if _, err := cs.CompactUserShards(ctx, 1, false); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+
+			for i := 40; i < 120; i++ {
+				write(i)
+			}
+			close(done)
+			if err := <-errs; err != nil {
+				t.Fatalf("compaction failed: %s", err)
+			}
+
+			if _, err := cs.CompactUserShards(ctx, 1, false); err != nil {
+				t.Fatal(err)
+			}
+
+			headRev, err := cs.GetUserRepoRev(ctx, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if headRev != rev {
+				t.Fatalf("repo head moved during compaction: %s != %s", headRev, rev)
+			}
+
+			buf := new(bytes.Buffer)
+			if err := cs.ReadUserCar(ctx, 1, "", true, buf); err != nil {
+				t.Fatal(err)
+			}
+			checkRepo(t, cs, buf, recs)
+
+			us, err := cs.UserStorage(ctx, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			shards, err := cs.Stat(ctx, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if us.Shards != int64(len(shards)) {
+				t.Fatalf("recorded %d shards, have %d", us.Shards, len(shards))
+			}
+		})
+	}
+}
+
+func TestMultiWriterLeases(t *testing.T) {
+	ctx := context.TODO()
+
+	dir := t.TempDir()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "meta.sqlite")), &gorm.Config{
+		SkipDefaultTransaction: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	openNode := func(id string, ttl time.Duration) CarStore {
+		opts := DefaultCarStoreOptions()
+		opts.NodeID = id
+		opts.LeaseTTL = ttl
+		cs, err := NewCarStoreWithOptions(db, dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cs
+	}
+
+	a := openNode("a", time.Minute)
+	b := openNode("b", 200*time.Millisecond)
+	defer b.Shutdown(ctx)
+
+	ds, err := a.NewDeltaSession(ctx, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, rev, err := setupRepo(ctx, ds, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.CloseWithRoot(ctx, head, rev); err != nil {
+		t.Fatal(err)
+	}
+
+	var recs []cid.Cid
+	commit := func(cs CarStore) error {
+		ds, err := cs.NewDeltaSession(ctx, 1, &rev)
+		if err != nil {
+			return err
+		}
+		rr, err := repo.OpenRepo(ctx, ds, head)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, _, err := rr.CreateRecord(ctx, "app.bsky.feed.post", &appbsky.FeedPost{
+			Text: fmt.Sprintf("hey look its a tweet %d", time.Now().UnixNano()),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		kmgr := &util.FakeKeyManager{}
+		nroot, nrev, err := rr.Commit(ctx, kmgr.SignForUser)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ds.CalcDiff(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ds.CloseWithRoot(ctx, nroot, nrev); err != nil {
+			return err
+		}
+		recs = append(recs, rc)
+		head, rev = nroot, nrev
+		return nil
+	}
+
+	if err := commit(a); err != nil {
+		t.Fatal(err)
+	}
+
+	// a holds the lease, so b can read the repo but not write to it
+	if err := commit(b); !errors.Is(err, ErrUserLeaseHeld) {
+		t.Fatalf("expected lease conflict, got: %v", err)
+	}
+	bhead, err := b.GetUserRepoHead(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bhead != head {
+		t.Fatalf("other node saw the wrong head: %s != %s", bhead, head)
+	}
+
+	// once a shuts down, b picks up from a's head
+	if err := a.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(b); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := b.ReadUserCar(ctx, 1, "", true, buf); err != nil {
+		t.Fatal(err)
+	}
+	checkRepo(t, b, buf, recs)
+
+	// a write that outlasts its node's lease is abandoned
+	ds, err = b.NewDeltaSession(ctx, 1, &rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if _, err := ds.CloseWithRoot(ctx, head, rev); !errors.Is(err, ErrUserLeaseLost) {
+		t.Fatalf("expected lost lease, got: %v", err)
+	}
+
+	// and another node can take the user over
+	a = openNode("a", time.Minute)
+	defer a.Shutdown(ctx)
+
+	if err := commit(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.CompactUserShards(ctx, 1, false); !errors.Is(err, ErrUserLeaseHeld) {
+		t.Fatalf("expected lease conflict, got: %v", err)
+	}
+
+	buf = new(bytes.Buffer)
+	if err := a.ReadUserCar(ctx, 1, "", true, buf); err != nil {
+		t.Fatal(err)
+	}
+	checkRepo(t, a, buf, recs)
+
+	// a node that stalls past its lease after checking it in memory can't
+	// commit, since the lease is checked again in the write's transaction
+	expireLease := func() {
+		if err := db.Model(&userLease{}).Where("usr = ?", 1).Update("expires", time.Now().Add(-time.Second)).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	countShards := func() int64 {
+		var n int64
+		if err := db.Model(&CarShard{}).Where("usr = ?", 1).Count(&n).Error; err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	before := countShards()
+	expireLease()
+	if err := commit(a); !errors.Is(err, ErrUserLeaseLost) {
+		t.Fatalf("expected lost lease, got: %v", err)
+	}
+	if n := countShards(); n != before {
+		t.Fatalf("expected no shard added without the lease, had %d, now %d", before, n)
+	}
+
+	// the next write takes the lease again, and compaction is checked the
+	// same way
+	if err := commit(a); err != nil {
+		t.Fatal(err)
+	}
+	expireLease()
+	if _, err := a.CompactUserShards(ctx, 1, false); !errors.Is(err, ErrUserLeaseLost) {
+		t.Fatalf("expected lost lease, got: %v", err)
+	}
+
+	buf = new(bytes.Buffer)
+	if err := a.ReadUserCar(ctx, 1, "", true, buf); err != nil {
+		t.Fatal(err)
+	}
+	checkRepo(t, a, buf, recs)
+}
+
+func TestScrubShards(t *testing.T) {
+	ctx := context.TODO()
+
+	cs, cleanup, err := testCarStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	for usr := models.Uid(1); usr <= 2; usr++ {
+		ds, err := cs.NewDeltaSession(ctx, usr, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		head, rev, err := setupRepo(ctx, ds, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ds.CloseWithRoot(ctx, head, rev); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 3; i++ {
+			ds, err := cs.NewDeltaSession(ctx, usr, &rev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr, err := repo.OpenRepo(ctx, ds, head)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := rr.CreateRecord(ctx, "app.bsky.feed.post", &appbsky.FeedPost{
+				Text: fmt.Sprintf("scrub me %d", i),
+			}); err != nil {
+				t.Fatal(err)
+			}
+			kmgr := &util.FakeKeyManager{}
+			head, rev, err = rr.Commit(ctx, kmgr.SignForUser)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ds.CalcDiff(ctx, nil); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ds.CloseWithRoot(ctx, head, rev); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// walk every shard, a few at a time
+	scrubAll := func() []ShardScrubResult {
+		var all []ShardScrubResult
+		var after uint
+		for {
+			res, err := cs.ScrubShards(ctx, after, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res) == 0 {
+				return all
+			}
+			all = append(all, res...)
+			after = res[len(res)-1].Shard
+		}
+	}
+
+	res := scrubAll()
+	if len(res) != 8 {
+		t.Fatalf("expected 8 shards scrubbed, got %d", len(res))
+	}
+	for _, r := range res {
+		if r.Corrupt() || r.Blocks == 0 {
+			t.Fatalf("unexpected scrub result for healthy shard: %+v", r)
+		}
+	}
+
+	// flip the last byte of one shard, which is in its last block, and lose
+	// another shard's file
+	flipped, lost := res[1], res[6]
+	b, err := os.ReadFile(flipped.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 0xff
+	if err := os.WriteFile(flipped.Path, b, 0664); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(lost.Path); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := make(map[uint]string)
+	for _, r := range scrubAll() {
+		if r.Corrupt() {
+			corrupt[r.Shard] = r.Problems[0].Kind
+		}
+	}
+	if len(corrupt) != 2 || corrupt[flipped.Shard] != ScrubBadBlock || corrupt[lost.Shard] != ScrubMissingFile {
+		t.Fatalf("unexpected corrupt shards: %v", corrupt)
+	}
+}
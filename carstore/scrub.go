@@ -0,0 +1,220 @@
+package carstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bluesky-social/indigo/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var scrubbedShards = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "carstore_scrubbed_shards_total",
+	Help: "Number of shards checked by the scrubber",
+})
+
+var scrubProblems = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "carstore_scrub_problems_total",
+	Help: "Number of problems the scrubber found in shards, by kind",
+}, []string{"kind"})
+
+// Kinds of problem the scrubber finds
+const (
+	// the shard file is gone
+	ScrubMissingFile = "missing_file"
+	// the file isn't a well formed CAR
+	ScrubUnreadable = "unreadable"
+	// the file's root, data start or size don't match the shard's metadata
+	ScrubMetaMismatch = "meta_mismatch"
+	// a block doesn't hash to its CID
+	ScrubBadBlock = "bad_block"
+	// a block ref points at a block that isn't at its offset in the file
+	ScrubBadRef = "bad_ref"
+)
+
+// at most this many problems are reported for a shard; past the first few
+// the shard is going to be refetched anyway
+const maxScrubProblems = 20
+
+// ScrubProblem is something wrong with a shard
+type ScrubProblem struct {
+	Kind   string `json:"kind"`
+	Cid    string `json:"cid,omitempty"`
+	Detail string `json:"detail"`
+}
+
+// ShardScrubResult is what checking a shard found
+type ShardScrubResult struct {
+	Shard    uint           `json:"shard"`
+	Usr      models.Uid     `json:"uid"`
+	Path     string         `json:"path"`
+	Rev      string         `json:"rev"`
+	Blocks   int            `json:"blocks"`
+	Problems []ScrubProblem `json:"problems,omitempty"`
+}
+
+func (r *ShardScrubResult) Corrupt() bool {
+	return len(r.Problems) > 0
+}
+
+func (r *ShardScrubResult) problem(kind string, c cid.Cid, format string, args ...any) {
+	if len(r.Problems) >= maxScrubProblems {
+		return
+	}
+	p := ScrubProblem{Kind: kind, Detail: fmt.Sprintf(format, args...)}
+	if c.Defined() {
+		p.Cid = c.String()
+	}
+	r.Problems = append(r.Problems, p)
+}
+
+// ScrubShards checks up to limit shards, of any user, with IDs above after,
+// in ID order: that the file is there and matches the shard's metadata, that
+// every block hashes to its CID, and that every block ref points at its
+// block. Passing the ID of the last shard returned walks the whole carstore.
+// Shards removed while they're being checked, eg by compaction, are left out.
+func (cs *FileCarStore) ScrubShards(ctx context.Context, after uint, limit int) ([]ShardScrubResult, error) {
+	ctx, span := otel.Tracer("carstore").Start(ctx, "ScrubShards")
+	defer span.End()
+
+	shards, err := cs.meta.GetShardsAfter(ctx, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("listing shards: %w", err)
+	}
+	span.SetAttributes(attribute.Int("shards", len(shards)))
+
+	out := make([]ShardScrubResult, 0, len(shards))
+	for i := range shards {
+		if err := ctx.Err(); err != nil {
+			return out, err
+		}
+
+		res, err := cs.scrubShard(ctx, &shards[i])
+		if err != nil {
+			return out, err
+		}
+		if res.Corrupt() {
+			// problems reading a shard that's since been removed are expected
+			still, err := cs.meta.HasShardWithPath(ctx, shards[i].Path)
+			if err != nil {
+				return out, err
+			}
+			if !still {
+				continue
+			}
+			for _, p := range res.Problems {
+				scrubProblems.WithLabelValues(p.Kind).Inc()
+			}
+		}
+		scrubbedShards.Inc()
+		out = append(out, *res)
+	}
+	return out, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func (cs *FileCarStore) scrubShard(ctx context.Context, sh *CarShard) (*ShardScrubResult, error) {
+	res := &ShardScrubResult{
+		Shard: sh.ID,
+		Usr:   sh.Usr,
+		Path:  sh.Path,
+		Rev:   sh.Rev,
+	}
+
+	fi, err := os.Open(sh.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			res.problem(ScrubMissingFile, cid.Undef, "shard file doesn't exist")
+			return res, nil
+		}
+		return nil, fmt.Errorf("opening shard %d: %w", sh.ID, err)
+	}
+	defer fi.Close()
+
+	st, err := fi.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat shard %d: %w", sh.ID, err)
+	}
+	if sh.Size > 0 && st.Size() != sh.Size {
+		res.problem(ScrubMetaMismatch, cid.Undef, "file is %d bytes, expected %d", st.Size(), sh.Size)
+	}
+
+	cr := &countingReader{r: fi}
+	br := bufio.NewReader(cr)
+	pos := func() int64 { return cr.n - int64(br.Buffered()) }
+
+	hdr, err := car.ReadHeader(br)
+	if err != nil {
+		res.problem(ScrubUnreadable, cid.Undef, "reading car header: %s", err)
+		return res, nil
+	}
+	if len(hdr.Roots) != 1 || hdr.Roots[0] != sh.Root.CID {
+		res.problem(ScrubMetaMismatch, cid.Undef, "car roots %v don't match shard root %s", hdr.Roots, sh.Root.CID)
+	}
+	if pos() != sh.DataStart {
+		res.problem(ScrubMetaMismatch, cid.Undef, "blocks start at %d, expected %d", pos(), sh.DataStart)
+	}
+
+	// offset of each block found in the file
+	offsets := make(map[cid.Cid]int64)
+	for {
+		off := pos()
+		c, data, err := carutil.ReadNode(br)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				res.problem(ScrubUnreadable, cid.Undef, "reading block at %d: %s", off, err)
+			}
+			break
+		}
+		res.Blocks++
+		offsets[c] = off
+
+		sum, err := c.Prefix().Sum(data)
+		if err != nil {
+			res.problem(ScrubBadBlock, c, "hashing block at %d: %s", off, err)
+			continue
+		}
+		if !bytes.Equal(sum.Hash(), c.Hash()) {
+			res.problem(ScrubBadBlock, c, "block at %d doesn't match its cid", off)
+		}
+	}
+
+	refs, err := cs.meta.GetBlockRefsForShards(ctx, []uint{sh.ID})
+	if err != nil {
+		return nil, fmt.Errorf("getting block refs for shard %d: %w", sh.ID, err)
+	}
+	for _, ref := range refs {
+		off, ok := offsets[ref.Cid.CID]
+		switch {
+		case !ok:
+			res.problem(ScrubBadRef, ref.Cid.CID, "block isn't in the file")
+		case off != ref.Offset:
+			res.problem(ScrubBadRef, ref.Cid.CID, "block is at %d, ref says %d", off, ref.Offset)
+		}
+	}
+
+	return res, nil
+}
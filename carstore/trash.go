@@ -0,0 +1,520 @@
+package carstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	blockformat "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car"
+	"go.opentelemetry.io/otel"
+)
+
+var trashedRepos = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "carstore_trashed_repos_total",
+	Help: "Number of repos whose data was moved to the trash, by reason",
+}, []string{"reason"})
+
+var trashRestores = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "carstore_trash_restores_total",
+	Help: "Number of trashed repos restored",
+})
+
+var trashPurges = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "carstore_trash_purges_total",
+	Help: "Number of trashed repos physically deleted after their retention window",
+})
+
+// ErrTrashNotFound is returned when restoring a trash entry that doesn't
+// exist, or belongs to another user
+var ErrTrashNotFound = errors.New("trash entry not found")
+
+// ErrRepoHasData is returned when restoring into a repo that has been written
+// to since it was trashed
+var ErrRepoHasData = errors.New("repo has data")
+
+const trashDirName = "trash"
+const trashManifestName = "manifest.json"
+
+// TrashEntry is a repo's data as of when it was trashed. Its shard files are
+// kept in their own directory under the carstore root until the entry is
+// restored or purged.
+type TrashEntry struct {
+	ID        string         `json:"id"`
+	Usr       models.Uid     `json:"uid"`
+	Reason    string         `json:"reason"`
+	TrashedAt time.Time      `json:"trashedAt"`
+	Bytes     int64          `json:"bytes"`
+	Shards    []TrashedShard `json:"shards"`
+
+	// set while the repo is being trashed, until its shard files have been
+	// moved into the entry; recoverTrash finishes entries left pending
+	Pending bool `json:"pending,omitempty"`
+	// node that trashed the repo, when the carstore is shared
+	Owner string `json:"owner,omitempty"`
+}
+
+type TrashedShard struct {
+	Seq  int    `json:"seq"`
+	Root string `json:"root"`
+	Rev  string `json:"rev"`
+	Size int64  `json:"size"`
+	// name of the shard file within the entry's directory, or its original
+	// path if it's still there
+	File string `json:"file"`
+}
+
+func (cs *FileCarStore) trashDir() string {
+	return filepath.Join(cs.rootDir, trashDirName)
+}
+
+// TrashUserData removes the user's data like WipeUserData, but keeps the
+// shard files in the trash for TrashRetention so an operator can restore them
+// with RestoreUserData. If TrashRetention is zero the data is wiped
+// immediately and no entry is returned. Returns a nil entry if the user had no
+// data.
+func (cs *FileCarStore) TrashUserData(ctx context.Context, user models.Uid, reason string) (*TrashEntry, error) {
+	if cs.opts.TrashRetention <= 0 {
+		return nil, cs.WipeUserData(ctx, user)
+	}
+
+	ctx, span := otel.Tracer("carstore").Start(ctx, "TrashUserData")
+	defer span.End()
+
+	if err := cs.claimUser(ctx, user); err != nil {
+		return nil, err
+	}
+
+	// buffered commits are part of the repo too
+	if err := cs.flushUser(ctx, user, "trash"); err != nil {
+		return nil, fmt.Errorf("flushing write buffer: %w", err)
+	}
+
+	shards, err := cs.meta.GetUserShards(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	if len(shards) == 0 {
+		cs.dropUserBuffer(user)
+		return nil, nil
+	}
+
+	now := time.Now()
+	entry := &TrashEntry{
+		ID:        fmt.Sprintf("%d-%d", user, now.UnixNano()),
+		Usr:       user,
+		Reason:    reason,
+		TrashedAt: now,
+		Pending:   true,
+		Owner:     cs.opts.NodeID,
+	}
+	for _, sh := range shards {
+		entry.Bytes += sh.Size
+		entry.Shards = append(entry.Shards, TrashedShard{
+			Seq:  sh.Seq,
+			Root: sh.Root.CID.String(),
+			Rev:  sh.Rev,
+			Size: sh.Size,
+			File: sh.Path,
+		})
+	}
+	dir := filepath.Join(cs.trashDir(), entry.ID)
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return nil, err
+	}
+
+	// the manifest goes in first, listing the shards at their original
+	// paths, so the data can always be found again if we're interrupted
+	if err := writeTrashManifest(dir, entry); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, fmt.Errorf("writing trash manifest: %w", err)
+	}
+
+	if err := cs.finishTrash(ctx, entry, dir, shards); err != nil {
+		return nil, err
+	}
+
+	trashedRepos.WithLabelValues(reason).Inc()
+	return entry, nil
+}
+
+// finishTrash drops the rows of a pending entry's shards that are still in
+// the meta DB, moves their files into the entry and marks it done
+func (cs *FileCarStore) finishTrash(ctx context.Context, entry *TrashEntry, dir string, shards []CarShard) error {
+	inEntry := make(map[string]bool, len(entry.Shards))
+	for _, ts := range entry.Shards {
+		inEntry[ts.File] = true
+	}
+
+	// drop the rows first, so the repo is gone even if moving the files fails
+	// partway; anything left in place stays recorded at its original path
+	var ids []uint
+	for _, sh := range shards {
+		if inEntry[sh.Path] {
+			ids = append(ids, sh.ID)
+		}
+	}
+	chunkSize := 2000
+	for i := 0; i < len(ids); i += chunkSize {
+		if err := cs.meta.DeleteShardsAndRefs(ctx, ids[i:min(i+chunkSize, len(ids))]); err != nil {
+			return err
+		}
+	}
+	for _, sh := range shards {
+		if inEntry[sh.Path] {
+			cs.observeStorage(sh.Usr, -sh.Size)
+		}
+	}
+	cs.dropUserBuffer(entry.Usr)
+
+	kept := entry.Shards[:0]
+	for _, ts := range entry.Shards {
+		if !filepath.IsAbs(ts.File) {
+			kept = append(kept, ts)
+			continue
+		}
+		orig := ts.File
+		name := filepath.Base(orig)
+		if err := os.Rename(orig, filepath.Join(dir, name)); err != nil {
+			if !os.IsNotExist(err) {
+				log.Errorw("failed to move shard file to trash", "seq", ts.Seq, "path", orig, "err", err)
+				kept = append(kept, ts)
+				continue
+			}
+			// moved before we were interrupted, or gone altogether
+			if _, serr := os.Stat(filepath.Join(dir, name)); serr != nil {
+				log.Warnw("shard file we tried to trash did not exist", "seq", ts.Seq, "path", orig)
+				entry.Bytes -= ts.Size
+				continue
+			}
+		}
+		ts.File = name
+		kept = append(kept, ts)
+	}
+	entry.Shards = kept
+	entry.Pending = false
+
+	if err := writeTrashManifest(dir, entry); err != nil {
+		return fmt.Errorf("writing trash manifest: %w", err)
+	}
+	return nil
+}
+
+// recoverTrash finishes trashing repos that were interrupted after their
+// entry's manifest was written. When the carstore is shared, only this
+// node's own entries are recovered; the others may still be in progress.
+func (cs *FileCarStore) recoverTrash(ctx context.Context) error {
+	dirents, err := os.ReadDir(cs.trashDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, de := range dirents {
+		if !de.IsDir() {
+			continue
+		}
+		dir := filepath.Join(cs.trashDir(), de.Name())
+		entry, err := readTrashManifest(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// interrupted before the manifest was written, so nothing
+				// else was touched
+				_ = os.RemoveAll(dir)
+				continue
+			}
+			return fmt.Errorf("reading trash manifest %s: %w", de.Name(), err)
+		}
+		if !entry.Pending || (cs.opts.multiWriter() && entry.Owner != cs.opts.NodeID) {
+			continue
+		}
+
+		shards, err := cs.meta.GetUserShards(ctx, entry.Usr)
+		if err != nil {
+			return err
+		}
+		if err := cs.finishTrash(ctx, entry, dir, shards); err != nil {
+			return fmt.Errorf("finishing trash entry %s: %w", entry.ID, err)
+		}
+		log.Warnw("finished interrupted trashing of repo", "uid", entry.Usr, "id", entry.ID)
+	}
+	return nil
+}
+
+func writeTrashManifest(dir string, entry *TrashEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, trashManifestName+".tmp")
+	if err := os.WriteFile(tmp, b, 0664); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, trashManifestName))
+}
+
+func readTrashManifest(dir string) (*TrashEntry, error) {
+	b, err := os.ReadFile(filepath.Join(dir, trashManifestName))
+	if err != nil {
+		return nil, err
+	}
+	var entry TrashEntry
+	if err := json.Unmarshal(b, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// ListTrash returns the entries in the trash, oldest first. A non-zero user
+// only returns that user's entries.
+func (cs *FileCarStore) ListTrash(ctx context.Context, user models.Uid) ([]TrashEntry, error) {
+	dirents, err := os.ReadDir(cs.trashDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	prefix := ""
+	if user != 0 {
+		prefix = fmt.Sprintf("%d-", user)
+	}
+
+	var out []TrashEntry
+	for _, de := range dirents {
+		if !de.IsDir() || !strings.HasPrefix(de.Name(), prefix) {
+			continue
+		}
+		entry, err := readTrashManifest(filepath.Join(cs.trashDir(), de.Name()))
+		if err != nil {
+			log.Warnw("skipping unreadable trash entry", "id", de.Name(), "err", err)
+			continue
+		}
+		if entry.Pending {
+			// still being trashed, or interrupted and waiting for recoverTrash
+			continue
+		}
+		if user != 0 && entry.Usr != user {
+			continue
+		}
+		out = append(out, *entry)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].TrashedAt.Before(out[j].TrashedAt)
+	})
+	return out, nil
+}
+
+// RestoreUserData writes the shards of a trash entry back into the user's
+// repo and removes the entry. The user must not have any data, since the
+// restored shards replace the repo's history wholesale. Blocks the original
+// shards had marked stale are restored as live. If any shard fails to
+// restore, the ones already written are removed again, leaving the repo
+// empty and the entry in place to retry.
+func (cs *FileCarStore) RestoreUserData(ctx context.Context, user models.Uid, id string) error {
+	ctx, span := otel.Tracer("carstore").Start(ctx, "RestoreUserData")
+	defer span.End()
+
+	cs.trashLk.Lock()
+	defer cs.trashLk.Unlock()
+
+	if id == "" || strings.ContainsAny(id, `/\`) || id == "." || id == ".." {
+		return ErrTrashNotFound
+	}
+	dir := filepath.Join(cs.trashDir(), id)
+	entry, err := readTrashManifest(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrTrashNotFound
+		}
+		return fmt.Errorf("reading trash manifest: %w", err)
+	}
+	if entry.Usr != user || entry.Pending {
+		return ErrTrashNotFound
+	}
+
+	if err := cs.claimUser(ctx, user); err != nil {
+		return err
+	}
+	if err := cs.flushUser(ctx, user, "restore"); err != nil {
+		return fmt.Errorf("flushing write buffer: %w", err)
+	}
+	existing, err := cs.meta.GetUserShards(ctx, user)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return ErrRepoHasData
+	}
+
+	shards := append([]TrashedShard(nil), entry.Shards...)
+	sort.Slice(shards, func(i, j int) bool {
+		return shards[i].Seq < shards[j].Seq
+	})
+
+	sources := make(map[string]bool, len(shards))
+	for _, ts := range shards {
+		path := ts.File
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		sources[path] = true
+		if err := cs.restoreShard(ctx, user, ts, path); err != nil {
+			if uerr := cs.unrestore(ctx, user, sources); uerr != nil {
+				log.Errorw("failed to remove partially restored shards", "uid", user, "id", id, "err", uerr)
+			}
+			return fmt.Errorf("restoring shard %d: %w", ts.Seq, err)
+		}
+	}
+	cs.dropUserBuffer(user)
+
+	// shard files left at their original paths have been rewritten in place
+	if err := os.RemoveAll(dir); err != nil {
+		log.Errorw("failed to remove restored trash entry", "id", id, "err", err)
+	}
+
+	trashRestores.Inc()
+	return nil
+}
+
+func (cs *FileCarStore) restoreShard(ctx context.Context, user models.Uid, ts TrashedShard, path string) error {
+	root, err := cid.Decode(ts.Root)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	cr, err := car.NewCarReader(fi)
+	if err != nil {
+		return err
+	}
+
+	blks := make(map[cid.Cid]blockformat.Block)
+	for {
+		blk, err := cr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+		blks[blk.Cid()] = blk
+	}
+
+	_, _, err = cs.writeShard(ctx, root, ts.Rev, user, ts.Seq, blks, nil)
+	return err
+}
+
+// unrestore removes the shards a failed restore wrote, keeping the files it
+// was restoring from; shard files that were never moved into the trash are
+// restored in place
+func (cs *FileCarStore) unrestore(ctx context.Context, user models.Uid, sources map[string]bool) error {
+	shards, err := cs.meta.GetUserShards(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]uint, len(shards))
+	for i, sh := range shards {
+		ids[i] = sh.ID
+	}
+	if len(ids) > 0 {
+		if err := cs.meta.DeleteShardsAndRefs(ctx, ids); err != nil {
+			return err
+		}
+	}
+	for _, sh := range shards {
+		cs.observeStorage(sh.Usr, -sh.Size)
+		if sources[sh.Path] {
+			continue
+		}
+		if err := os.Remove(sh.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	cs.dropUserBuffer(user)
+	return nil
+}
+
+// removeTrashEntry deletes an entry's directory, along with any of its shard
+// files that couldn't be moved into it
+func (cs *FileCarStore) removeTrashEntry(entry *TrashEntry, dir string) error {
+	for _, ts := range entry.Shards {
+		if filepath.IsAbs(ts.File) {
+			if err := os.Remove(ts.File); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+// PurgeTrash physically deletes the entries trashed before the cutoff,
+// returning how many were removed
+func (cs *FileCarStore) PurgeTrash(ctx context.Context, before time.Time) (int, error) {
+	entries, err := cs.ListTrash(ctx, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	cs.trashLk.Lock()
+	defer cs.trashLk.Unlock()
+
+	var purged int
+	for i := range entries {
+		entry := &entries[i]
+		if !entry.TrashedAt.Before(before) {
+			continue
+		}
+		if err := cs.removeTrashEntry(entry, filepath.Join(cs.trashDir(), entry.ID)); err != nil {
+			return purged, fmt.Errorf("purging trash entry %s: %w", entry.ID, err)
+		}
+		purged++
+		trashPurges.Inc()
+	}
+	return purged, nil
+}
+
+func (cs *FileCarStore) runTrashPurger() {
+	defer cs.wg.Done()
+
+	interval := min(cs.opts.TrashRetention/4, time.Hour)
+	t := time.NewTicker(max(interval, time.Second))
+	defer t.Stop()
+
+	for {
+		select {
+		case <-cs.exit:
+			return
+		case <-t.C:
+			n, err := cs.PurgeTrash(context.Background(), time.Now().Add(-cs.opts.TrashRetention))
+			if err != nil {
+				log.Errorw("failed to purge trash", "err", err)
+			}
+			if n > 0 {
+				log.Infow("purged expired trash entries", "count", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package carstore
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/models"
+)
+
+// UserStorage returns how much shard storage a user is using
+func (cs *FileCarStore) UserStorage(ctx context.Context, user models.Uid) (*UserStorage, error) {
+	return cs.meta.GetUserStorage(ctx, user)
+}
+
+// TopUserStorage returns the users using the most shard storage, largest first
+func (cs *FileCarStore) TopUserStorage(ctx context.Context, limit int) ([]UserStorage, error) {
+	return cs.meta.GetTopUserStorage(ctx, limit)
+}
+
+// SetStorageObserver registers a function called with the change in a user's
+// storage whenever shards are written or deleted, eg to maintain totals
+// grouped some way the carstore doesn't know about. It is called after the
+// change is committed, and must not block.
+func (cs *FileCarStore) SetStorageObserver(fn func(user models.Uid, delta int64)) {
+	cs.storageObserver = fn
+}
+
+func (cs *FileCarStore) observeStorage(user models.Uid, delta int64) {
+	if delta != 0 && cs.storageObserver != nil {
+		cs.storageObserver(user, delta)
+	}
+}
@@ -0,0 +1,395 @@
+package carstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+
+	blockformat "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+)
+
+type CarStoreOptions struct {
+	// Number of consecutive commits per user to hold in memory and write out
+	// as a single shard. Values of 1 or less write a shard per commit.
+	BufferCommits int
+	// Write out a user's buffered commits once their blocks reach this size
+	BufferBytes int
+	// Write out a user's buffered commits once the oldest has been held this long
+	BufferMaxAge time.Duration
+
+	// Metadata store to use in place of the SQL DB passed to the constructor.
+	// It is closed on Shutdown.
+	Meta CarStoreMeta
+
+	// Read-only replica of the SQL DB passed to the constructor. If set, the
+	// metadata lookups for getRepo and getBlocks style reads go to it, falling
+	// back to the primary when it lags behind. Can't be used with Meta.
+	ReadReplica *gorm.DB
+
+	// How long data removed by TrashUserData is kept before being physically
+	// deleted. Zero deletes it immediately.
+	TrashRetention time.Duration
+
+	// Identifies this process when several share the carstore, each writing
+	// to a different set of users; see lease.go. Must be unique per process
+	// and stable across restarts. Empty means this is the only writer.
+	// Requires the SQL metadata store, with the shard directory on storage
+	// all the nodes can reach.
+	NodeID string
+	// How long a node holds a user's lease after its last write to them
+	LeaseTTL time.Duration
+}
+
+func DefaultCarStoreOptions() *CarStoreOptions {
+	return &CarStoreOptions{
+		BufferCommits: 1,
+		BufferBytes:   512 << 10,
+		BufferMaxAge:  5 * time.Second,
+		LeaseTTL:      30 * time.Second,
+	}
+}
+
+func (o *CarStoreOptions) buffering() bool {
+	return o.BufferCommits > 1
+}
+
+// userBuffer tracks the head of a user's repo: the latest shard on disk, and
+// any commits made since then that are still held in memory. Blocks in the
+// buffer are visible to reads exactly as if they had been written out.
+//
+// Buffered commits are lost if the process dies before they are flushed. The
+// repo head on disk is then behind the upstream PDS, and the next commit will
+// fail with ErrRepoBaseMismatch and trigger a resync, the same as any other
+// gap in the stream.
+type userBuffer struct {
+	lk sync.Mutex
+
+	// most recent shard on disk; nil until loaded from the meta DB
+	shard *CarShard
+
+	// number of commits held in memory, and the head as of the last one
+	commits int
+	root    cid.Cid
+	rev     string
+	seq     int
+
+	blks   map[cid.Cid]blockformat.Block
+	rmcids map[cid.Cid]bool
+	size   int
+	since  time.Time
+}
+
+// repoHead is the current head of a user's repo, buffered or not. Root is
+// undefined if the user has no data.
+type repoHead struct {
+	Root cid.Cid
+	Rev  string
+	Seq  int
+}
+
+func (cs *FileCarStore) getUserBuffer(user models.Uid) *userBuffer {
+	cs.bufLk.Lock()
+	defer cs.bufLk.Unlock()
+
+	ub, ok := cs.buffers[user]
+	if !ok {
+		ub = &userBuffer{}
+		cs.buffers[user] = ub
+	}
+	return ub
+}
+
+// must be called with ub.lk held
+func (cs *FileCarStore) loadLastShard(ctx context.Context, ub *userBuffer, user models.Uid) error {
+	if ub.shard != nil {
+		return nil
+	}
+
+	lastShard, err := cs.meta.GetLastShard(ctx, user)
+	if err != nil {
+		return err
+	}
+	ub.shard = lastShard
+	return nil
+}
+
+func (cs *FileCarStore) getHead(ctx context.Context, user models.Uid) (*repoHead, error) {
+	ctx, span := otel.Tracer("carstore").Start(ctx, "getHead")
+	defer span.End()
+
+	// another node may be writing to the user, so our cached head can't be
+	// trusted unless we hold their lease
+	if cs.opts.multiWriter() {
+		if held, _ := cs.leaseState(user); !held {
+			lastShard, err := cs.meta.GetLastShard(ctx, user)
+			if err != nil {
+				return nil, err
+			}
+			return headForShard(lastShard), nil
+		}
+	}
+
+	ub := cs.getUserBuffer(user)
+	ub.lk.Lock()
+	defer ub.lk.Unlock()
+
+	if ub.commits > 0 {
+		return &repoHead{Root: ub.root, Rev: ub.rev, Seq: ub.seq}, nil
+	}
+
+	if err := cs.loadLastShard(ctx, ub, user); err != nil {
+		return nil, err
+	}
+
+	return headForShard(ub.shard), nil
+}
+
+func headForShard(sh *CarShard) *repoHead {
+	head := &repoHead{Rev: sh.Rev, Seq: sh.Seq}
+	if sh.ID != 0 {
+		head.Root = sh.Root.CID
+	}
+	return head
+}
+
+func (cs *FileCarStore) setLastShard(shard *CarShard) {
+	ub := cs.getUserBuffer(shard.Usr)
+	ub.lk.Lock()
+	defer ub.lk.Unlock()
+
+	ub.shard = shard
+}
+
+// bufferedBlock returns a block from the user's unflushed commits, if present
+func (cs *FileCarStore) bufferedBlock(user models.Uid, k cid.Cid) (blockformat.Block, bool) {
+	if !cs.opts.buffering() {
+		return nil, false
+	}
+
+	cs.bufLk.Lock()
+	ub, ok := cs.buffers[user]
+	cs.bufLk.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	ub.lk.Lock()
+	defer ub.lk.Unlock()
+
+	blk, ok := ub.blks[k]
+	return blk, ok
+}
+
+// bufferCommit adds a commit to the user's buffer, writing the buffer out as
+// a shard if that takes it over one of the configured limits
+func (cs *FileCarStore) bufferCommit(ctx context.Context, user models.Uid, root cid.Cid, rev string, seq int, blks map[cid.Cid]blockformat.Block, rmcids map[cid.Cid]bool) error {
+	ctx, span := otel.Tracer("carstore").Start(ctx, "bufferCommit")
+	defer span.End()
+
+	ub := cs.getUserBuffer(user)
+	ub.lk.Lock()
+	defer ub.lk.Unlock()
+
+	if ub.commits == 0 {
+		ub.blks = make(map[cid.Cid]blockformat.Block)
+		ub.rmcids = make(map[cid.Cid]bool)
+		ub.since = time.Now()
+	}
+
+	// blocks added and removed within the buffer never need to hit the disk.
+	// Removals are still recorded as stale in case an older shard has a copy.
+	for c := range rmcids {
+		if blk, ok := ub.blks[c]; ok {
+			ub.size -= len(blk.RawData())
+			delete(ub.blks, c)
+		}
+		ub.rmcids[c] = true
+	}
+	for c, blk := range blks {
+		if _, ok := ub.blks[c]; !ok {
+			ub.size += len(blk.RawData())
+		}
+		ub.blks[c] = blk
+		delete(ub.rmcids, c)
+	}
+
+	ub.commits++
+	ub.root = root
+	ub.rev = rev
+	ub.seq = seq
+
+	bufferedCommits.Inc()
+	span.SetAttributes(attribute.Int("commits", ub.commits), attribute.Int("size", ub.size))
+
+	if ub.commits >= cs.opts.BufferCommits || ub.size >= cs.opts.BufferBytes {
+		if err := cs.flushLocked(ctx, ub, user, "limit"); err != nil {
+			// the commit is safely buffered, we'll try writing it out again later
+			log.Errorw("failed to flush write buffer", "uid", user, "commits", ub.commits, "err", err)
+		}
+	}
+
+	return nil
+}
+
+// flushLocked writes the user's buffered commits out as a single shard. Must
+// be called with ub.lk held.
+func (cs *FileCarStore) flushLocked(ctx context.Context, ub *userBuffer, user models.Uid, reason string) error {
+	if ub.commits == 0 {
+		return nil
+	}
+
+	ctx, span := otel.Tracer("carstore").Start(ctx, "flushWriteBuffer")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.Int64("user", int64(user)),
+		attribute.Int("commits", ub.commits),
+		attribute.Int("blocks", len(ub.blks)),
+	)
+
+	shard, _, err := cs.writeShard(ctx, ub.root, ub.rev, user, ub.seq, ub.blks, ub.rmcids)
+	if err != nil {
+		if errors.Is(err, ErrUserLeaseLost) {
+			// whoever took the user over will resync the commits we lose here
+			log.Warnw("dropping write buffer for user whose lease expired", "uid", user, "commits", ub.commits)
+			bufferedCommits.Sub(float64(ub.commits))
+			ub.shard = nil
+			ub.commits = 0
+			ub.blks = nil
+			ub.rmcids = nil
+			ub.size = 0
+		}
+		return err
+	}
+
+	bufferFlushes.WithLabelValues(reason).Inc()
+	bufferFlushCommits.Observe(float64(ub.commits))
+	bufferedCommits.Sub(float64(ub.commits))
+
+	ub.shard = shard
+	ub.commits = 0
+	ub.blks = nil
+	ub.rmcids = nil
+	ub.size = 0
+
+	return nil
+}
+
+// flushUser writes out any buffered commits for the user, so that operations
+// working directly on shard files see them
+func (cs *FileCarStore) flushUser(ctx context.Context, user models.Uid, reason string) error {
+	if !cs.opts.buffering() {
+		return nil
+	}
+
+	ub := cs.getUserBuffer(user)
+	ub.lk.Lock()
+	defer ub.lk.Unlock()
+
+	return cs.flushLocked(ctx, ub, user, reason)
+}
+
+// dropUserBuffer discards the user's head and any buffered commits
+func (cs *FileCarStore) dropUserBuffer(user models.Uid) {
+	cs.bufLk.Lock()
+	ub, ok := cs.buffers[user]
+	delete(cs.buffers, user)
+	cs.bufLk.Unlock()
+
+	if !ok {
+		return
+	}
+
+	ub.lk.Lock()
+	defer ub.lk.Unlock()
+	if ub.commits > 0 {
+		bufferedCommits.Sub(float64(ub.commits))
+	}
+	ub.commits = 0
+	ub.blks = nil
+	ub.rmcids = nil
+}
+
+// flushOlderThan writes out buffers holding commits older than the cutoff. A
+// zero cutoff flushes everything.
+func (cs *FileCarStore) flushOlderThan(ctx context.Context, cutoff time.Time, reason string) error {
+	cs.bufLk.Lock()
+	users := make(map[models.Uid]*userBuffer, len(cs.buffers))
+	for u, ub := range cs.buffers {
+		users[u] = ub
+	}
+	cs.bufLk.Unlock()
+
+	var errs int
+	var lastErr error
+	for u, ub := range users {
+		ub.lk.Lock()
+		if ub.commits > 0 && (cutoff.IsZero() || ub.since.Before(cutoff)) {
+			if err := cs.flushLocked(ctx, ub, u, reason); err != nil {
+				log.Errorw("failed to flush write buffer", "uid", u, "err", err)
+				errs++
+				lastErr = err
+			}
+		}
+		ub.lk.Unlock()
+	}
+
+	if errs > 0 {
+		return fmt.Errorf("failed to flush %d write buffers: %w", errs, lastErr)
+	}
+	return nil
+}
+
+func (cs *FileCarStore) runFlusher() {
+	defer cs.wg.Done()
+
+	interval := max(cs.opts.BufferMaxAge/4, 100*time.Millisecond)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-cs.exit:
+			return
+		case <-t.C:
+			_ = cs.flushOlderThan(context.Background(), time.Now().Add(-cs.opts.BufferMaxAge), "age")
+		}
+	}
+}
+
+// Flush writes out all buffered commits
+func (cs *FileCarStore) Flush(ctx context.Context) error {
+	if !cs.opts.buffering() {
+		return nil
+	}
+	return cs.flushOlderThan(ctx, time.Time{}, "flush")
+}
+
+// Shutdown stops the background flusher, writes out all buffered commits and
+// closes the metadata store
+func (cs *FileCarStore) Shutdown(ctx context.Context) error {
+	close(cs.exit)
+	cs.wg.Wait()
+
+	if cs.opts.buffering() {
+		if err := cs.flushOlderThan(ctx, time.Time{}, "shutdown"); err != nil {
+			return err
+		}
+	}
+
+	if cs.opts.multiWriter() {
+		if err := cs.releaseLeases(ctx); err != nil {
+			log.Errorw("failed to release user leases", "node", cs.opts.NodeID, "err", err)
+		}
+	}
+
+	return cs.meta.Close()
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/bgsclient"
+	"github.com/bluesky-social/indigo/repo"
+
+	"github.com/urfave/cli/v2"
+)
+
+var importCarsCmd = &cli.Command{
+	Name:  "import-cars",
+	Usage: "import repo CAR archives into the relay, replacing what it has for each repo",
+	Description: `Each .car file in --dir, which may also be a .tar, .tar.gz or .tgz
+archive of them, is a full repo export such as com.atproto.sync.getRepo returns.
+The relay checks the commit signature, stores the repo and emits a #sync event
+for it. Repos the relay has a newer rev of are skipped unless --force is set.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "dir",
+			Usage:    "directory or tarball of repo CAR files",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:    "relay-host",
+			Usage:   "URL of the relay to import into",
+			Value:   "http://localhost:2470",
+			EnvVars: []string{"RELAY_HOST"},
+		},
+		&cli.StringFlag{
+			Name:     "admin-key",
+			Usage:    "relay admin key",
+			Required: true,
+			EnvVars:  []string{"RELAY_ADMIN_KEY", "BGS_ADMIN_KEY"},
+		},
+		&cli.IntFlag{
+			Name:  "concurrency",
+			Usage: "repos imported at once",
+			Value: 4,
+		},
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "replace repos even where the relay has the same or a newer rev",
+		},
+	},
+	Action: runImportCars,
+}
+
+// carArchive is a repo CAR file read from the import directory
+type carArchive struct {
+	name string
+	data []byte
+}
+
+type carImportResult struct {
+	name   string
+	did    string
+	rev    string
+	status string
+	err    error
+}
+
+func runImportCars(cctx *cli.Context) error {
+	ctx := cctx.Context
+
+	relay := strings.TrimSuffix(cctx.String("relay-host"), "/")
+	if !strings.HasPrefix(relay, "http://") && !strings.HasPrefix(relay, "https://") {
+		relay = "https://" + relay
+	}
+	client := bgsclient.New(relay, cctx.String("admin-key"))
+	client.HTTP = &http.Client{Timeout: 10 * time.Minute}
+
+	concurrency := max(cctx.Int("concurrency"), 1)
+	force := cctx.Bool("force")
+
+	archives := make(chan carArchive)
+	results := make(chan carImportResult)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range archives {
+				results <- importCar(ctx, client, a, force)
+			}
+		}()
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(archives)
+		readErr <- readCarArchives(cctx.String("dir"), func(a carArchive) {
+			archives <- a
+		})
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	counts := make(map[string]int)
+	for r := range results {
+		msg := ""
+		if r.err != nil {
+			msg = r.err.Error()
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\n", r.name, r.did, r.rev, r.status, msg)
+		counts[r.status]++
+	}
+
+	statuses := make([]string, 0, len(counts))
+	for s := range counts {
+		statuses = append(statuses, s)
+	}
+	sort.Strings(statuses)
+	for _, s := range statuses {
+		fmt.Fprintf(os.Stderr, "%s: %d\n", s, counts[s])
+	}
+
+	if err := <-readErr; err != nil {
+		return err
+	}
+	if counts["failed"] > 0 {
+		return fmt.Errorf("%d repos failed to import", counts["failed"])
+	}
+	return nil
+}
+
+func importCar(ctx context.Context, client *bgsclient.Client, a carArchive, force bool) carImportResult {
+	res := carImportResult{name: a.name}
+
+	r, err := repo.ReadRepoFromCar(ctx, bytes.NewReader(a.data))
+	if err != nil {
+		res.status = "failed"
+		res.err = fmt.Errorf("reading repo: %w", err)
+		return res
+	}
+	res.did = r.RepoDid()
+
+	out, err := client.PostRepoImport(ctx, res.did, &force, bytes.NewReader(a.data))
+	if err != nil {
+		var rerr *bgsclient.Error
+		if errors.As(err, &rerr) && rerr.StatusCode == http.StatusConflict {
+			res.status = "skipped"
+		} else {
+			res.status = "failed"
+		}
+		res.err = err
+		return res
+	}
+
+	res.rev = out.Rev
+	res.status = "imported"
+	return res
+}
+
+// readCarArchives calls cb with each .car file in a directory tree, or in a
+// tar archive, optionally gzipped
+func readCarArchives(path string, cb func(carArchive)) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || !isCarName(p) {
+				return nil
+			}
+			b, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			cb(carArchive{name: p, data: b})
+			return nil
+		})
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var in io.Reader = f
+	if strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".tgz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		in = gz
+	}
+
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+		if hdr.Typeflag != tar.TypeReg || !isCarName(hdr.Name) {
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("reading %s from %s: %w", hdr.Name, path, err)
+		}
+		cb(carArchive{name: hdr.Name, data: b})
+	}
+}
+
+func isCarName(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), ".car")
+}
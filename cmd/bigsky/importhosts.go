@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	libbgs "github.com/bluesky-social/indigo/bgs"
+
+	"github.com/urfave/cli/v2"
+)
+
+var importHostsCmd = &cli.Command{
+	Name:      "import-hosts",
+	Usage:     "request crawls of PDS hostnames listed in a file, one per line ('-' for stdin)",
+	ArgsUsage: "<file>",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "relay-host",
+			Usage:   "URL of the relay to import into",
+			Value:   "http://localhost:2470",
+			EnvVars: []string{"RELAY_HOST"},
+		},
+		&cli.StringFlag{
+			Name:     "admin-key",
+			Usage:    "relay admin key",
+			Required: true,
+			EnvVars:  []string{"RELAY_ADMIN_KEY", "BGS_ADMIN_KEY"},
+		},
+		&cli.IntFlag{
+			Name:  "batch-size",
+			Usage: "hostnames sent per request",
+			Value: 1000,
+		},
+		&cli.IntFlag{
+			Name:  "concurrency",
+			Usage: "hosts the relay validates at once",
+			Value: 20,
+		},
+		&cli.BoolFlag{
+			Name:  "skip-validation",
+			Usage: "subscribe without checking that each host answers describeServer",
+		},
+	},
+	Action: runImportHosts,
+}
+
+func runImportHosts(cctx *cli.Context) error {
+	if cctx.Args().Len() != 1 {
+		return fmt.Errorf("expected a file of hostnames")
+	}
+
+	var in io.Reader = os.Stdin
+	if fname := cctx.Args().First(); fname != "-" {
+		f, err := os.Open(fname)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var hosts []string
+	scan := bufio.NewScanner(in)
+	for scan.Scan() {
+		line, _, _ := strings.Cut(scan.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			hosts = append(hosts, line)
+		}
+	}
+	if err := scan.Err(); err != nil {
+		return err
+	}
+
+	relay := strings.TrimSuffix(cctx.String("relay-host"), "/")
+	if !strings.HasPrefix(relay, "http://") && !strings.HasPrefix(relay, "https://") {
+		relay = "https://" + relay
+	}
+
+	// validation can take a while for a batch of slow hosts
+	client := &http.Client{Timeout: 10 * time.Minute}
+
+	batchSize := cctx.Int("batch-size")
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < len(hosts); i += batchSize {
+		batch := hosts[i:min(i+batchSize, len(hosts))]
+
+		out, err := postImportHosts(cctx, client, relay, &libbgs.AdminImportHostsRequest{
+			Hostnames:      batch,
+			Concurrency:    cctx.Int("concurrency"),
+			SkipValidation: cctx.Bool("skip-validation"),
+		})
+		if err != nil {
+			return fmt.Errorf("importing hosts %d-%d: %w", i+1, i+len(batch), err)
+		}
+
+		for _, r := range out.Results {
+			fmt.Printf("%s\t%s\t%s\n", r.Hostname, r.Status, r.Error)
+			counts[r.Status]++
+		}
+	}
+
+	statuses := make([]string, 0, len(counts))
+	for s := range counts {
+		statuses = append(statuses, s)
+	}
+	sort.Strings(statuses)
+	for _, s := range statuses {
+		fmt.Fprintf(os.Stderr, "%s: %d\n", s, counts[s])
+	}
+
+	return nil
+}
+
+func postImportHosts(cctx *cli.Context, client *http.Client, relay string, body *libbgs.AdminImportHostsRequest) (*libbgs.AdminImportHostsResponse, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(cctx.Context, "POST", relay+"/admin/pds/import", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+cctx.String("admin-key"))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("relay returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var out libbgs.AdminImportHostsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
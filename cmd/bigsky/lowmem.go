@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+// lowMemoryDefaults are the flag values --low-memory switches to, sized for
+// a small relay on a 1-2 GB machine. Flags given on the command line or in
+// the environment keep the value given.
+var lowMemoryDefaults = map[string]string{
+	// caches
+	"did-cache-size":          "50000",
+	"event-frame-cache-size":  "1024",
+	"ingest-dedup-cache-size": "20000",
+	"mst-node-cache-repos":    "100",
+	// queues and concurrency
+	"concurrency-per-pds":          "10",
+	"max-queue-per-pds":            "100",
+	"max-fetch-concurrency":        "10",
+	"sync-compression-concurrency": "1",
+	"read-budget":                  fmt.Sprint(64 << 20),
+	// fan-out to consumers
+	"event-fanout-shards":     "1",
+	"event-subscriber-buffer": "1024",
+	// write each event out as it's persisted rather than batching them
+	"disk-persister-sync-writes": "true",
+	"spidering":                  "false",
+}
+
+// sizes of caches that have no flags of their own, under --low-memory
+const (
+	lowMemoryPersisterCacheSize       = 20_000
+	lowMemoryCollectionIndexCacheSize = 50_000
+)
+
+// applyLowMemoryProfile sets the low memory defaults of the flags that
+// weren't set explicitly
+func applyLowMemoryProfile(cctx *cli.Context) error {
+	names := make([]string, 0, len(lowMemoryDefaults))
+	for name := range lowMemoryDefaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var applied []string
+	for _, name := range names {
+		if cctx.IsSet(name) {
+			continue
+		}
+		if err := cctx.Set(name, lowMemoryDefaults[name]); err != nil {
+			return fmt.Errorf("applying low memory default for %s: %w", name, err)
+		}
+		applied = append(applied, name+"="+lowMemoryDefaults[name])
+	}
+
+	log.Infow("using low memory profile", "defaults", applied)
+	return nil
+}
@@ -2,9 +2,10 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -13,13 +14,12 @@ import (
 	"time"
 
 	"github.com/bluesky-social/indigo/api"
+	"github.com/bluesky-social/indigo/atproto/lexicon"
 	libbgs "github.com/bluesky-social/indigo/bgs"
 	"github.com/bluesky-social/indigo/carstore"
-	"github.com/bluesky-social/indigo/did"
 	"github.com/bluesky-social/indigo/events"
 	"github.com/bluesky-social/indigo/indexer"
 	"github.com/bluesky-social/indigo/notifs"
-	"github.com/bluesky-social/indigo/plc"
 	"github.com/bluesky-social/indigo/repomgr"
 	"github.com/bluesky-social/indigo/util"
 	"github.com/bluesky-social/indigo/util/cliutil"
@@ -30,6 +30,8 @@ import (
 
 	"github.com/carlmjohnson/versioninfo"
 	logging "github.com/ipfs/go-log"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 	"github.com/urfave/cli/v2"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
@@ -38,6 +40,7 @@ import (
 	"go.opentelemetry.io/otel/sdk/resource"
 	tracesdk "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"gorm.io/gorm"
 	"gorm.io/plugin/opentelemetry/tracing"
 )
 
@@ -93,22 +96,128 @@ func run(args []string) error {
 			Value:   "https://plc.directory",
 			EnvVars: []string{"ATP_PLC_HOST"},
 		},
+		&cli.StringFlag{
+			Name:    "plc-batch-path",
+			Usage:   "path of a batch DID lookup endpoint on plc-host, for PLC mirrors that have one",
+			EnvVars: []string{"RELAY_PLC_BATCH_PATH"},
+		},
 		&cli.BoolFlag{
 			Name:  "crawl-insecure-ws",
 			Usage: "when connecting to PDS instances, use ws:// instead of wss://",
 		},
+		&cli.StringFlag{
+			Name:    "outbound-proxy",
+			Usage:   "http://, https://, socks5:// or socks5h:// URL of a proxy to send requests and firehose connections to PDS instances and the PLC directory through",
+			EnvVars: []string{"RELAY_OUTBOUND_PROXY"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "outbound-proxy-bypass",
+			Usage:   "hosts to connect to directly rather than through outbound-proxy, as in NO_PROXY: a hostname (also matching its subdomains), IP, CIDR range, any of those with a port, or \"*\" (may be repeated)",
+			EnvVars: []string{"RELAY_OUTBOUND_PROXY_BYPASS"},
+		},
+		&cli.StringFlag{
+			Name:    "pds-tls-min-version",
+			Usage:   "lowest TLS version accepted from PDS instances, 1.2 or 1.3",
+			EnvVars: []string{"RELAY_PDS_TLS_MIN_VERSION"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "pds-tls-pin",
+			Usage:   "host=pin, requiring the host's certificate chain to include a key with this base64 SHA-256 SubjectPublicKeyInfo hash (may be repeated, to pin several keys)",
+			EnvVars: []string{"RELAY_PDS_TLS_PINS"},
+		},
+		&cli.BoolFlag{
+			Name:    "pds-http2",
+			Usage:   "use HTTP/2 for requests to PDS instances that offer it",
+			Value:   true,
+			EnvVars: []string{"RELAY_PDS_HTTP2"},
+		},
+		&cli.IntFlag{
+			Name:    "pds-max-idle-conns-per-host",
+			Usage:   "idle connections kept open to each PDS for repo fetches",
+			Value:   16,
+			EnvVars: []string{"RELAY_PDS_MAX_IDLE_CONNS_PER_HOST"},
+		},
+		&cli.IntFlag{
+			Name:    "pds-max-conns-per-host",
+			Usage:   "most connections open to each PDS at once for repo fetches (0 for no limit)",
+			EnvVars: []string{"RELAY_PDS_MAX_CONNS_PER_HOST"},
+		},
+		&cli.IntFlag{
+			Name:    "pds-tls-session-cache",
+			Usage:   "how many PDS TLS sessions to keep for resumption (0 to not resume sessions)",
+			Value:   1024,
+			EnvVars: []string{"RELAY_PDS_TLS_SESSION_CACHE"},
+		},
+		&cli.DurationFlag{
+			Name:    "pds-dns-cache-ttl",
+			Usage:   "how long to cache PDS hostname lookups for repo fetches (0 to not cache)",
+			EnvVars: []string{"RELAY_PDS_DNS_CACHE_TTL"},
+		},
+		&cli.StringFlag{
+			Name:    "signing-key-kms",
+			Usage:   "ID, ARN or alias of an AWS KMS key to sign with; credentials are read from the standard AWS_* environment variables",
+			EnvVars: []string{"RELAY_SIGNING_KEY_KMS"},
+		},
+		&cli.StringFlag{
+			Name:    "signing-key-kms-region",
+			Usage:   "AWS region of signing-key-kms, if not given in its ARN or AWS_REGION",
+			EnvVars: []string{"RELAY_SIGNING_KEY_KMS_REGION"},
+		},
+		&cli.StringFlag{
+			Name:    "signing-key-pkcs11-module",
+			Usage:   "path to a PKCS#11 module to sign with a key in an HSM through (needs a build with -tags pkcs11)",
+			EnvVars: []string{"RELAY_SIGNING_KEY_PKCS11_MODULE"},
+		},
+		&cli.StringFlag{
+			Name:    "signing-key-pkcs11-token",
+			Usage:   "label of the PKCS#11 token the signing key is on",
+			EnvVars: []string{"RELAY_SIGNING_KEY_PKCS11_TOKEN"},
+		},
+		&cli.StringFlag{
+			Name:    "signing-key-pkcs11-label",
+			Usage:   "label of the PKCS#11 signing key pair",
+			EnvVars: []string{"RELAY_SIGNING_KEY_PKCS11_LABEL"},
+		},
+		&cli.StringFlag{
+			Name:    "signing-key-pkcs11-pin",
+			Usage:   "user PIN of the PKCS#11 token; best given by environment variable",
+			EnvVars: []string{"RELAY_SIGNING_KEY_PKCS11_PIN"},
+		},
 		&cli.BoolFlag{
 			Name:    "spidering",
 			Value:   false,
 			EnvVars: []string{"RELAY_SPIDERING", "BGS_SPIDERING"},
 		},
+		&cli.IntFlag{
+			Name:    "spidering-max-new-hosts-per-hour",
+			Usage:   "most hosts found by spidering admitted per hour, 0 for no limit",
+			EnvVars: []string{"RELAY_SPIDERING_MAX_NEW_HOSTS_PER_HOUR"},
+		},
+		&cli.BoolFlag{
+			Name:    "spidering-require-describe-server",
+			Usage:   "only admit hosts found by spidering that answer describeServer with a valid DID",
+			Value:   true,
+			EnvVars: []string{"RELAY_SPIDERING_REQUIRE_DESCRIBE_SERVER"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "spidering-allowed-domains",
+			Usage:   "if set, only hosts found by spidering under these domains are admitted; hostnames, or *.example.com for subdomains",
+			EnvVars: []string{"RELAY_SPIDERING_ALLOWED_DOMAINS"},
+		},
+		&cli.DurationFlag{
+			Name:    "spidering-auto-trust",
+			Usage:   "how long hosts admitted by spidering start out in the trusted tier, 0 to start them in the new tier",
+			EnvVars: []string{"RELAY_SPIDERING_AUTO_TRUST"},
+		},
 		&cli.StringFlag{
 			Name:  "api-listen",
 			Value: ":2470",
+			Usage: "TCP address, 'unix:///path/to.sock', or 'systemd[:<name>]' for a socket-activated listener",
 		},
 		&cli.StringFlag{
 			Name:    "metrics-listen",
 			Value:   ":2471",
+			Usage:   "TCP address, 'unix:///path/to.sock', or 'systemd[:<name>]' for a socket-activated listener",
 			EnvVars: []string{"RELAY_METRICS_LISTEN", "BGS_METRICS_LISTEN"},
 		},
 		&cli.StringFlag{
@@ -116,6 +225,21 @@ func run(args []string) error {
 			Usage:   "set directory for disk persister (implicitly enables disk persister)",
 			EnvVars: []string{"RELAY_PERSISTER_DIR"},
 		},
+		&cli.BoolFlag{
+			Name:    "disk-persister-sync-writes",
+			Usage:   "write each event to the disk persister's log as it's sequenced rather than in batches, using less memory but more writes",
+			EnvVars: []string{"RELAY_PERSISTER_SYNC_WRITES"},
+		},
+		&cli.BoolFlag{
+			Name:    "event-repo-index",
+			Usage:   "index the disk persister's events by repo, for looking up a repo's recent events",
+			EnvVars: []string{"RELAY_EVENT_REPO_INDEX"},
+		},
+		&cli.BoolFlag{
+			Name:    "public-repo-history",
+			Usage:   "serve repos' recent events at /xrpc/_relay/getRepoHistory without authentication (needs event-repo-index)",
+			EnvVars: []string{"RELAY_PUBLIC_REPO_HISTORY"},
+		},
 		&cli.StringFlag{
 			Name:    "admin-key",
 			EnvVars: []string{"RELAY_ADMIN_KEY", "BGS_ADMIN_KEY"},
@@ -145,59 +269,857 @@ func run(args []string) error {
 			EnvVars: []string{"RESOLVE_ADDRESS"},
 			Value:   "1.1.1.1:53",
 		},
-		&cli.BoolFlag{
-			Name:    "force-dns-udp",
-			EnvVars: []string{"FORCE_DNS_UDP"},
+		&cli.BoolFlag{
+			Name:    "force-dns-udp",
+			EnvVars: []string{"FORCE_DNS_UDP"},
+		},
+		&cli.IntFlag{
+			Name:    "max-fetch-concurrency",
+			Value:   100,
+			EnvVars: []string{"MAX_FETCH_CONCURRENCY"},
+		},
+		&cli.StringFlag{
+			Name:    "env",
+			Value:   "dev",
+			EnvVars: []string{"ENVIRONMENT"},
+			Usage:   "declared hosting environment (prod, qa, etc); used in metrics",
+		},
+		&cli.StringFlag{
+			Name:    "otel-exporter-otlp-endpoint",
+			EnvVars: []string{"OTEL_EXPORTER_OTLP_ENDPOINT"},
+		},
+		&cli.StringFlag{
+			Name:    "bsky-social-rate-limit-skip",
+			EnvVars: []string{"BSKY_SOCIAL_RATE_LIMIT_SKIP"},
+			Usage:   "ratelimit bypass secret token for *.bsky.social domains",
+		},
+		&cli.IntFlag{
+			Name:    "repo-limit-new",
+			Aliases: []string{"default-repo-limit"},
+			Usage:   "repo limit for hosts in the new tier, where newly added hosts start",
+			Value:   100,
+			EnvVars: []string{"RELAY_REPO_LIMIT_NEW", "RELAY_DEFAULT_REPO_LIMIT"},
+		},
+		&cli.IntFlag{
+			Name:    "repo-limit-trusted",
+			Usage:   "repo limit for hosts in the trusted tier: promoted hosts, and new hosts under a trusted domain",
+			Value:   10_000,
+			EnvVars: []string{"RELAY_REPO_LIMIT_TRUSTED"},
+		},
+		&cli.IntFlag{
+			Name:    "repo-limit-partner",
+			Usage:   "repo limit for hosts an admin has put in the partner tier",
+			Value:   1_000_000,
+			EnvVars: []string{"RELAY_REPO_LIMIT_PARTNER"},
+		},
+		&cli.DurationFlag{
+			Name:    "tier-promote-min-age",
+			Usage:   "how long a host must have been known before it is promoted from the new tier to trusted",
+			Value:   30 * 24 * time.Hour,
+			EnvVars: []string{"RELAY_TIER_PROMOTE_MIN_AGE"},
+		},
+		&cli.DurationFlag{
+			Name:    "tier-promote-clean-for",
+			Usage:   "how long a host must go without being blocked, paused, or having events rejected before it is promoted",
+			Value:   30 * 24 * time.Hour,
+			EnvVars: []string{"RELAY_TIER_PROMOTE_CLEAN_FOR"},
+		},
+		&cli.DurationFlag{
+			Name:    "tier-promote-interval",
+			Usage:   "how often hosts are checked for promotion, 0 to disable automatic promotion",
+			Value:   time.Hour,
+			EnvVars: []string{"RELAY_TIER_PROMOTE_INTERVAL"},
+		},
+		&cli.DurationFlag{
+			Name:    "growth-check-interval",
+			Usage:   "how often each host's repo count is sampled by the growth monitor, 0 to disable it",
+			Value:   time.Minute,
+			EnvVars: []string{"RELAY_GROWTH_CHECK_INTERVAL"},
+		},
+		&cli.DurationFlag{
+			Name:    "growth-window",
+			Usage:   "period over which hosts' repo count growth is measured",
+			Value:   time.Hour,
+			EnvVars: []string{"RELAY_GROWTH_WINDOW"},
+		},
+		&cli.Int64Flag{
+			Name:    "growth-max-new-repos",
+			Usage:   "alert when a host gains more than this many repos within the growth window, 0 to disable",
+			EnvVars: []string{"RELAY_GROWTH_MAX_NEW_REPOS"},
+		},
+		&cli.Float64Flag{
+			Name:    "growth-max-factor",
+			Usage:   "alert when a host's repo count grows by more than this factor within the growth window (eg 2 for doubling), 0 to disable",
+			EnvVars: []string{"RELAY_GROWTH_MAX_FACTOR"},
+		},
+		&cli.Int64Flag{
+			Name:    "growth-min-new-repos",
+			Usage:   "minimum repos gained within the growth window before growth-max-factor applies",
+			Value:   100,
+			EnvVars: []string{"RELAY_GROWTH_MIN_NEW_REPOS"},
+		},
+		&cli.BoolFlag{
+			Name:    "growth-pause",
+			Usage:   "block and disconnect hosts that trip a growth threshold, until an admin unblocks them",
+			EnvVars: []string{"RELAY_GROWTH_PAUSE"},
+		},
+		&cli.StringFlag{
+			Name:    "growth-alert-webhook",
+			Usage:   "URL growth alerts are POSTed to as JSON",
+			EnvVars: []string{"RELAY_GROWTH_ALERT_WEBHOOK"},
+		},
+		&cli.DurationFlag{
+			Name:    "host-stats-interval",
+			Usage:   "how often each host's event and error counts are saved to the host stats history, 0 to disable it",
+			Value:   time.Minute,
+			EnvVars: []string{"RELAY_HOST_STATS_INTERVAL"},
+		},
+		&cli.DurationFlag{
+			Name:    "host-stats-retention",
+			Usage:   "how long host stats samples are kept, at least an hour",
+			Value:   48 * time.Hour,
+			EnvVars: []string{"RELAY_HOST_STATS_RETENTION"},
+		},
+		&cli.DurationFlag{
+			Name:    "host-stats-hourly-retention",
+			Usage:   "how long hourly rollups of host stats samples are kept",
+			Value:   90 * 24 * time.Hour,
+			EnvVars: []string{"RELAY_HOST_STATS_HOURLY_RETENTION"},
+		},
+		&cli.BoolFlag{
+			Name:    "public-stats",
+			Usage:   "serve aggregate relay stats at /xrpc/_relay/stats without authentication",
+			Value:   true,
+			EnvVars: []string{"RELAY_PUBLIC_STATS"},
+		},
+		&cli.DurationFlag{
+			Name:    "public-stats-cache-ttl",
+			Usage:   "how long the public stats are cached for before they're computed again",
+			Value:   libbgs.DefaultPublicStatsOptions().CacheTTL,
+			EnvVars: []string{"RELAY_PUBLIC_STATS_CACHE_TTL"},
+		},
+		&cli.DurationFlag{
+			Name:    "deactivated-repo-retention",
+			Usage:   "how long the repos of deactivated accounts are kept before being moved to the carstore trash (0 to keep them until the account is reactivated)",
+			EnvVars: []string{"RELAY_DEACTIVATED_REPO_RETENTION"},
+		},
+		&cli.DurationFlag{
+			Name:    "carstore-scrub-interval",
+			Usage:   "how often a batch of carstore shards is checked for corruption (0 to not scrub)",
+			EnvVars: []string{"RELAY_CARSTORE_SCRUB_INTERVAL"},
+		},
+		&cli.IntFlag{
+			Name:    "carstore-scrub-batch",
+			Usage:   "how many carstore shards each scrub batch checks",
+			Value:   libbgs.DefaultScrubOptions().BatchSize,
+			EnvVars: []string{"RELAY_CARSTORE_SCRUB_BATCH"},
+		},
+		&cli.BoolFlag{
+			Name:    "carstore-scrub-refetch",
+			Usage:   "fetch repos with corrupt shards again from their PDS",
+			EnvVars: []string{"RELAY_CARSTORE_SCRUB_REFETCH"},
+		},
+		&cli.BoolFlag{
+			Name:    "collection-registry",
+			Usage:   "keep a registry of the collections records are seen in, with first-seen details, counts and a sample record",
+			EnvVars: []string{"RELAY_COLLECTION_REGISTRY"},
+		},
+		&cli.BoolFlag{
+			Name:    "quarantine-unknown-collections",
+			Usage:   "hold commits in collections that aren't approved back from the firehose until an admin approves them; implies --collection-registry",
+			EnvVars: []string{"RELAY_QUARANTINE_UNKNOWN_COLLECTIONS"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "approved-collections",
+			Usage:   "collections approved without review, as NSIDs or prefixes like app.bsky.*",
+			Value:   cli.NewStringSlice(libbgs.DefaultCollectionRegistryOptions().Approved...),
+			EnvVars: []string{"RELAY_APPROVED_COLLECTIONS"},
+		},
+		&cli.StringFlag{
+			Name:    "defederation-policy",
+			Usage:   "path to a JSON file of rules for automatically pausing or blocking misbehaving hosts",
+			EnvVars: []string{"RELAY_DEFEDERATION_POLICY"},
+		},
+		&cli.StringFlag{
+			Name:    "alerting-config",
+			Usage:   "path to a JSON file of conditions to alert operators on, and the Slack, PagerDuty and email notifiers to send alerts through",
+			EnvVars: []string{"RELAY_ALERTING_CONFIG"},
+		},
+		&cli.BoolFlag{
+			Name:    "gossip-serve",
+			Usage:   "serve the hosts this relay is consuming from at /xrpc/_relay/listHosts, for other relays to gossip with",
+			EnvVars: []string{"RELAY_GOSSIP_SERVE"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "gossip-peers",
+			Usage:   "base URLs of other relays to fetch host lists from, requesting crawls of the hosts new to this relay (may be repeated)",
+			EnvVars: []string{"RELAY_GOSSIP_PEERS"},
+		},
+		&cli.DurationFlag{
+			Name:    "gossip-interval",
+			Usage:   "how often host lists are fetched from gossip peers",
+			EnvVars: []string{"RELAY_GOSSIP_INTERVAL"},
+			Value:   time.Hour,
+		},
+		&cli.Int64Flag{
+			Name:    "read-budget",
+			Usage:   "bytes of memory getRepo and getBlocks responses may use at once; requests past it wait, then get a 503. 0 for no limit",
+			EnvVars: []string{"RELAY_READ_BUDGET"},
+			Value:   512 << 20,
+		},
+		&cli.Int64Flag{
+			Name:    "read-budget-per-request",
+			Usage:   "most bytes of one getRepo response held in memory; larger repos are streamed",
+			EnvVars: []string{"RELAY_READ_BUDGET_PER_REQUEST"},
+			Value:   4 << 20,
+		},
+		&cli.DurationFlag{
+			Name:    "read-budget-queue-timeout",
+			Usage:   "how long sync read requests wait for memory budget before being turned away",
+			EnvVars: []string{"RELAY_READ_BUDGET_QUEUE_TIMEOUT"},
+			Value:   5 * time.Second,
+		},
+		&cli.IntFlag{
+			Name:    "sync-compression-concurrency",
+			Usage:   "most getRepo, getBlocks and getRecord responses compressed at once, each using up to a core; the rest are sent uncompressed (0 to disable compression)",
+			EnvVars: []string{"RELAY_SYNC_COMPRESSION_CONCURRENCY"},
+			Value:   libbgs.DefaultSyncCompressionOptions().MaxConcurrent,
+		},
+		&cli.StringFlag{
+			Name:    "sync-compression-level",
+			Usage:   "how hard to compress sync responses: fastest, default, better or best",
+			EnvVars: []string{"RELAY_SYNC_COMPRESSION_LEVEL"},
+			Value:   "fastest",
+		},
+		&cli.BoolFlag{
+			Name:    "api-rate-limit",
+			Usage:   "rate limit API requests per client IP, and admin requests per admin token, with the default limits",
+			EnvVars: []string{"RELAY_API_RATE_LIMIT"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "api-rate-limits",
+			Usage:   "class=requests/window entries overriding the default API rate limits, eg. sync=600/1m, or class=0 for no limit; classes are subscribe, sync, crawl, xrpc and admin. Turns on rate limiting",
+			EnvVars: []string{"RELAY_API_RATE_LIMITS"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "api-rate-limit-exempt",
+			Usage:   "client IPs or CIDR ranges that aren't rate limited",
+			EnvVars: []string{"RELAY_API_RATE_LIMIT_EXEMPT"},
+		},
+		&cli.BoolFlag{
+			Name:    "api-rate-limit-trust-proxy",
+			Usage:   "rate limit by the client address in X-Forwarded-For, when behind a proxy on the private network",
+			EnvVars: []string{"RELAY_API_RATE_LIMIT_TRUST_PROXY"},
+		},
+		&cli.BoolFlag{
+			Name:    "low-memory",
+			Usage:   "use smaller caches, queues and buffers suited to a relay on a 1-2 GB machine; flags set explicitly keep their values",
+			EnvVars: []string{"RELAY_LOW_MEMORY"},
+		},
+		&cli.IntFlag{
+			Name:    "concurrency-per-pds",
+			EnvVars: []string{"RELAY_CONCURRENCY_PER_PDS"},
+			Value:   100,
+		},
+		&cli.IntFlag{
+			Name:    "max-queue-per-pds",
+			EnvVars: []string{"RELAY_MAX_QUEUE_PER_PDS"},
+			Value:   1_000,
+		},
+		&cli.IntFlag{
+			Name:    "did-cache-size",
+			EnvVars: []string{"RELAY_DID_CACHE_SIZE"},
+			Value:   5_000_000,
+		},
+		&cli.DurationFlag{
+			Name:    "event-playback-ttl",
+			Usage:   "time to live for event playback buffering (only applies to disk persister)",
+			EnvVars: []string{"RELAY_EVENT_PLAYBACK_TTL"},
+			Value:   72 * time.Hour,
+		},
+		&cli.StringFlag{
+			Name:    "event-compaction",
+			Usage:   "compact disk persister log files older than event-compaction-after to keep longer playback cheaply: \"latest-per-hour\" keeps each repo's latest commit per hour, \"headers-only\" drops every commit body",
+			EnvVars: []string{"RELAY_EVENT_COMPACTION"},
+		},
+		&cli.DurationFlag{
+			Name:    "event-compaction-after",
+			Usage:   "age past which disk persister log files are compacted",
+			EnvVars: []string{"RELAY_EVENT_COMPACTION_AFTER"},
+			Value:   24 * time.Hour,
+		},
+		&cli.BoolFlag{
+			Name:    "blob-proxy",
+			Usage:   "serve com.atproto.sync.getBlob by proxying to the account's PDS",
+			EnvVars: []string{"RELAY_BLOB_PROXY"},
+		},
+		&cli.StringFlag{
+			Name:    "blob-cache-dir",
+			Usage:   "directory for cached proxied blobs, defaults to a 'blobcache' directory in data-dir; set to empty to disable caching",
+			EnvVars: []string{"RELAY_BLOB_CACHE_DIR"},
+		},
+		&cli.Int64Flag{
+			Name:    "blob-cache-max-bytes",
+			Usage:   "maximum total size of the blob cache",
+			EnvVars: []string{"RELAY_BLOB_CACHE_MAX_BYTES"},
+			Value:   10 << 30,
+		},
+		&cli.Int64Flag{
+			Name:    "blob-max-size",
+			Usage:   "largest blob the proxy will serve, 0 for no limit",
+			EnvVars: []string{"RELAY_BLOB_MAX_SIZE"},
+			Value:   100 << 20,
+		},
+		&cli.BoolFlag{
+			Name:    "blob-ref-index",
+			Usage:   "index the blobs referenced by records, by repo and collection, for /admin/blobs/refs",
+			EnvVars: []string{"RELAY_BLOB_REF_INDEX"},
+		},
+		&cli.StringFlag{
+			Name:    "admin-audit-log-file",
+			Usage:   "file admin actions are appended to as JSON lines, as well as the database",
+			EnvVars: []string{"RELAY_ADMIN_AUDIT_LOG_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "admin-audit-webhook",
+			Usage:   "URL admin actions are POSTed to as JSON",
+			EnvVars: []string{"RELAY_ADMIN_AUDIT_WEBHOOK"},
+		},
+		&cli.DurationFlag{
+			Name:    "handle-reverify-interval",
+			Usage:   "interval between passes re-verifying all account handles, set to 0 to disable scheduled passes",
+			EnvVars: []string{"RELAY_HANDLE_REVERIFY_INTERVAL"},
+			Value:   0,
+		},
+		&cli.Float64Flag{
+			Name:    "handle-reverify-rate",
+			Usage:   "maximum handle resolutions per second during re-verification passes",
+			EnvVars: []string{"RELAY_HANDLE_REVERIFY_RATE"},
+			Value:   10,
+		},
+		&cli.IntFlag{
+			Name:    "indexer-op-workers",
+			Usage:   "number of workers handling record ops by collection priority, 0 to handle ops inline",
+			EnvVars: []string{"RELAY_INDEXER_OP_WORKERS"},
+			Value:   0,
+		},
+		&cli.StringSliceFlag{
+			Name:    "indexer-collection-priority",
+			Usage:   "override op priority for a collection, as nsid=high|normal|low (may be repeated)",
+			EnvVars: []string{"RELAY_INDEXER_COLLECTION_PRIORITY"},
+		},
+		&cli.IntFlag{
+			Name:    "indexer-group-commit-size",
+			Usage:   "most indexer database writes committed in one transaction, 0 to commit each on its own",
+			EnvVars: []string{"RELAY_INDEXER_GROUP_COMMIT_SIZE"},
+			Value:   500,
+		},
+		&cli.DurationFlag{
+			Name:    "indexer-group-commit-delay",
+			Usage:   "how long indexer database writes wait for others to commit with",
+			EnvVars: []string{"RELAY_INDEXER_GROUP_COMMIT_DELAY"},
+			Value:   2 * time.Millisecond,
+		},
+		&cli.StringFlag{
+			Name:    "admission-grpc-addr",
+			Usage:   "address of an external gRPC admission policy service consulted for new hosts and repos",
+			EnvVars: []string{"RELAY_ADMISSION_GRPC_ADDR"},
+		},
+		&cli.BoolFlag{
+			Name:    "admission-grpc-plaintext",
+			Usage:   "connect to the admission policy service without TLS",
+			EnvVars: []string{"RELAY_ADMISSION_GRPC_PLAINTEXT"},
+		},
+		&cli.DurationFlag{
+			Name:    "admission-cache-ttl",
+			Usage:   "how long admission decisions are cached, unless the service says otherwise",
+			EnvVars: []string{"RELAY_ADMISSION_CACHE_TTL"},
+			Value:   10 * time.Minute,
+		},
+		&cli.DurationFlag{
+			Name:    "admission-timeout",
+			Usage:   "deadline for each admission policy check",
+			EnvVars: []string{"RELAY_ADMISSION_TIMEOUT"},
+			Value:   2 * time.Second,
+		},
+		&cli.BoolFlag{
+			Name:    "admission-fail-closed",
+			Usage:   "reject new hosts and repos when the admission policy service is unavailable",
+			EnvVars: []string{"RELAY_ADMISSION_FAIL_CLOSED"},
+		},
+		&cli.IntFlag{
+			Name:    "carstore-buffer-commits",
+			Usage:   "number of consecutive commits per repo to consolidate into one shard, 1 to write a shard per commit",
+			EnvVars: []string{"RELAY_CARSTORE_BUFFER_COMMITS"},
+			Value:   1,
+		},
+		&cli.IntFlag{
+			Name:    "carstore-buffer-bytes",
+			Usage:   "write out a repo's buffered commits once they reach this size",
+			EnvVars: []string{"RELAY_CARSTORE_BUFFER_BYTES"},
+			Value:   512 << 10,
+		},
+		&cli.DurationFlag{
+			Name:    "carstore-buffer-max-age",
+			Usage:   "write out a repo's buffered commits once the oldest has been held this long",
+			EnvVars: []string{"RELAY_CARSTORE_BUFFER_MAX_AGE"},
+			Value:   5 * time.Second,
+		},
+		&cli.DurationFlag{
+			Name:    "carstore-trash-retention",
+			Usage:   "how long repo data removed by takedowns and account deletions is kept for restoring before being deleted (0 to delete immediately)",
+			EnvVars: []string{"RELAY_CARSTORE_TRASH_RETENTION"},
+			Value:   7 * 24 * time.Hour,
+		},
+		&cli.StringFlag{
+			Name:    "carstore-node-id",
+			Usage:   "unique, stable name for this relay when several share one carstore database and data directory; each repo is then written by one node at a time",
+			EnvVars: []string{"RELAY_CARSTORE_NODE_ID"},
+		},
+		&cli.DurationFlag{
+			Name:    "carstore-lease-ttl",
+			Usage:   "how long a node sharing the carstore keeps writing a repo to itself after its last write to it",
+			EnvVars: []string{"RELAY_CARSTORE_LEASE_TTL"},
+			Value:   30 * time.Second,
+		},
+		&cli.StringFlag{
+			Name:    "carstore-meta",
+			Usage:   "where to keep carstore shard and block metadata: 'sql' (carstore-db-url) or 'pebble' (local key-value store)",
+			EnvVars: []string{"RELAY_CARSTORE_META"},
+			Value:   "sql",
+		},
+		&cli.StringFlag{
+			Name:    "carstore-meta-dir",
+			Usage:   "directory for the pebble carstore metadata, defaults to carstore-meta under data-dir",
+			EnvVars: []string{"RELAY_CARSTORE_META_DIR"},
+		},
+		&cli.BoolFlag{
+			Name:    "index-only",
+			Usage:   "validate and forward commits without keeping repo data, only each repo's latest commit; sync endpoints serving repo data are disabled (requires disk-persister-dir)",
+			EnvVars: []string{"RELAY_INDEX_ONLY"},
+		},
+		&cli.BoolFlag{
+			Name:    "pds-adaptive-ratelimit",
+			Usage:   "pace requests to each PDS according to its RateLimit headers, and retry requests rejected with 429",
+			EnvVars: []string{"RELAY_PDS_ADAPTIVE_RATELIMIT"},
+			Value:   true,
+		},
+		&cli.IntFlag{
+			Name:    "max-fetch-attempts",
+			Usage:   "number of failed crawls of a repo, retried with exponential backoff, before it is dead-lettered for manual retry",
+			EnvVars: []string{"RELAY_MAX_FETCH_ATTEMPTS"},
+			Value:   8,
+		},
+		&cli.StringFlag{
+			Name:    "h3-listen",
+			Usage:   "experimental: UDP address to also serve the event stream on over HTTP/3 (QUIC), eg ':2471'. Disabled if empty",
+			EnvVars: []string{"RELAY_H3_LISTEN"},
+		},
+		&cli.StringFlag{
+			Name:    "h3-cert-file",
+			Usage:   "TLS certificate for the HTTP/3 listener, if not using the API's (api-tls-cert or ACME)",
+			EnvVars: []string{"RELAY_H3_CERT_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "h3-key-file",
+			Usage:   "TLS private key for the HTTP/3 listener",
+			EnvVars: []string{"RELAY_H3_KEY_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "api-tls-cert",
+			Usage:   "TLS certificate file; if set (with api-tls-key) the API and metrics listeners serve HTTPS. Reloaded when it changes on disk",
+			EnvVars: []string{"RELAY_API_TLS_CERT"},
+		},
+		&cli.StringFlag{
+			Name:    "api-tls-key",
+			Usage:   "TLS private key file for api-tls-cert",
+			EnvVars: []string{"RELAY_API_TLS_KEY"},
+		},
+		&cli.StringFlag{
+			Name:    "api-tls-acme-domain",
+			Usage:   "domain(s), comma-separated, to get certificates for from Let's Encrypt (ACME) for the API and metrics listeners, instead of api-tls-cert",
+			EnvVars: []string{"RELAY_API_TLS_ACME_DOMAIN"},
+		},
+		&cli.StringFlag{
+			Name:    "api-tls-acme-email",
+			Usage:   "contact email for the ACME account",
+			EnvVars: []string{"RELAY_API_TLS_ACME_EMAIL"},
+		},
+		&cli.StringFlag{
+			Name:    "api-tls-acme-cache-dir",
+			Usage:   "directory to store ACME certificates in, defaults to 'autocert' under data-dir",
+			EnvVars: []string{"RELAY_API_TLS_ACME_CACHE_DIR"},
+		},
+		&cli.StringFlag{
+			Name:    "api-tls-acme-http-listen",
+			Usage:   "address for an HTTP listener answering ACME HTTP-01 challenges, eg ':80'; not needed if api-listen is on port 443",
+			EnvVars: []string{"RELAY_API_TLS_ACME_HTTP_LISTEN"},
+		},
+		&cli.IntFlag{
+			Name:    "event-fanout-shards",
+			Usage:   "number of goroutines delivering live events to firehose consumers; defaults to GOMAXPROCS",
+			EnvVars: []string{"RELAY_EVENT_FANOUT_SHARDS"},
+		},
+		&cli.IntFlag{
+			Name:    "event-frame-cache-size",
+			Usage:   "number of recently broadcast serialized frames kept for consumers replaying from a recent cursor; 0 disables",
+			Value:   events.DefaultFrameCacheSize,
+			EnvVars: []string{"RELAY_EVENT_FRAME_CACHE_SIZE"},
+		},
+		&cli.IntFlag{
+			Name:    "event-subscriber-buffer",
+			Usage:   "number of live events queued for each firehose consumer before it's disconnected as too slow",
+			Value:   events.DefaultSubscriberBufferSize,
+			EnvVars: []string{"RELAY_EVENT_SUBSCRIBER_BUFFER"},
+		},
+		&cli.DurationFlag{
+			Name:    "chronological-order-delay",
+			Usage:   "if set, hold events for up to this long and emit them in the order they were received across hosts, rather than the order they finished being handled in",
+			EnvVars: []string{"RELAY_CHRONOLOGICAL_ORDER_DELAY"},
+		},
+		&cli.IntFlag{
+			Name:    "mst-node-cache-repos",
+			Usage:   "number of recently updated repos to keep decoded MST nodes of between commits (0 to disable)",
+			Value:   repomgr.DefaultNodeCacheOptions().Repos,
+			EnvVars: []string{"RELAY_MST_NODE_CACHE_REPOS"},
+		},
+		&cli.IntFlag{
+			Name:    "mst-node-cache-nodes",
+			Usage:   "number of decoded MST nodes to keep per repo",
+			Value:   repomgr.DefaultNodeCacheOptions().NodesPerRepo,
+			EnvVars: []string{"RELAY_MST_NODE_CACHE_NODES"},
+		},
+		&cli.StringFlag{
+			Name:    "relay-hostname",
+			Usage:   "the relay's public hostname (eg, relay.example.com), sent in the User-Agent of requests to the hosts it crawls",
+			EnvVars: []string{"RELAY_HOSTNAME"},
+		},
+		&cli.StringFlag{
+			Name:    "relay-contact",
+			Usage:   "how host operators can reach the relay's operator, an email address or URL; sent with requests to the hosts it crawls",
+			EnvVars: []string{"RELAY_CONTACT"},
+		},
+		&cli.StringFlag{
+			Name:    "service-did",
+			Usage:   "the relay's own DID (eg, did:web:relay.example.com); service-auth tokens must be addressed to it",
+			EnvVars: []string{"RELAY_SERVICE_DID"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "admin-service-auth-dids",
+			Usage:   "accounts whose service-auth JWTs are accepted on admin routes, as an alternative to the admin key",
+			EnvVars: []string{"RELAY_ADMIN_SERVICE_AUTH_DIDS"},
+		},
+		&cli.DurationFlag{
+			Name:    "admin-service-auth-max-lifetime",
+			Usage:   "reject admin service-auth tokens valid for longer than this",
+			Value:   time.Hour,
+			EnvVars: []string{"RELAY_ADMIN_SERVICE_AUTH_MAX_LIFETIME"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "subscriber-auth-token",
+			Usage:   "name=token, requiring firehose subscribers to present this or another bearer token; they're attributed in metrics by name (may be repeated)",
+			EnvVars: []string{"RELAY_SUBSCRIBER_AUTH_TOKENS"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "subscriber-auth-dids",
+			Usage:   "accounts whose service-auth JWTs, addressed to service-did, are accepted from firehose subscribers; turns on subscriber auth",
+			EnvVars: []string{"RELAY_SUBSCRIBER_AUTH_DIDS"},
+		},
+		&cli.IntFlag{
+			Name:    "subscriber-max-conns",
+			Usage:   "most firehose connections one authenticated subscriber may hold open, 0 for no limit",
+			EnvVars: []string{"RELAY_SUBSCRIBER_MAX_CONNS"},
+			Value:   10,
+		},
+		&cli.Float64Flag{
+			Name:    "subscriber-connect-rate",
+			Usage:   "new firehose connections per second one authenticated subscriber may make, with bursts of 10, 0 for no limit",
+			EnvVars: []string{"RELAY_SUBSCRIBER_CONNECT_RATE"},
+			Value:   1,
+		},
+		&cli.DurationFlag{
+			Name:    "repo-audit-interval",
+			Usage:   "how often to audit a random sample of repos against their PDS; 0 disables",
+			EnvVars: []string{"RELAY_REPO_AUDIT_INTERVAL"},
+		},
+		&cli.IntFlag{
+			Name:    "repo-audit-sample-size",
+			Usage:   "number of repos audited by each scheduled audit",
+			Value:   100,
+			EnvVars: []string{"RELAY_REPO_AUDIT_SAMPLE_SIZE"},
+		},
+		&cli.BoolFlag{
+			Name:    "repo-audit-repair",
+			Usage:   "re-import repos that scheduled audits find out of sync",
+			EnvVars: []string{"RELAY_REPO_AUDIT_REPAIR"},
+		},
+		&cli.Int64Flag{
+			Name:    "default-pds-storage-quota",
+			Usage:   "bytes of carstore data newly added PDSs may use before the relay disconnects from them; 0 for no limit",
+			EnvVars: []string{"RELAY_DEFAULT_PDS_STORAGE_QUOTA"},
+		},
+		&cli.DurationFlag{
+			Name:    "disk-persister-migration-history",
+			Usage:   "migrate from the database event persister to the disk persister: write events to both, and switch over once the disk persister has this much history",
+			EnvVars: []string{"RELAY_DISK_PERSISTER_MIGRATION_HISTORY"},
+		},
+		&cli.DurationFlag{
+			Name:    "shutdown-phase-timeout",
+			Usage:   "how long each step of shutdown (disconnecting PDSs, draining queues, flushing events, ...) may take before moving on; 0 waits indefinitely",
+			Value:   30 * time.Second,
+			EnvVars: []string{"RELAY_SHUTDOWN_PHASE_TIMEOUT"},
+		},
+		&cli.StringFlag{
+			Name:    "analytics-dir",
+			Usage:   "write record operations from the firehose to parquet files under this directory, for analytics",
+			EnvVars: []string{"RELAY_ANALYTICS_DIR"},
+		},
+		&cli.StringFlag{
+			Name:    "analytics-s3-bucket",
+			Usage:   "write record operations from the firehose to parquet files in this S3 bucket, for analytics; credentials come from the AWS_* environment variables or the instance role",
+			EnvVars: []string{"RELAY_ANALYTICS_S3_BUCKET"},
+		},
+		&cli.StringFlag{
+			Name:    "analytics-s3-prefix",
+			Usage:   "key prefix for analytics files in the S3 bucket",
+			EnvVars: []string{"RELAY_ANALYTICS_S3_PREFIX"},
+		},
+		&cli.StringFlag{
+			Name:    "analytics-s3-endpoint",
+			Usage:   "S3 API endpoint for analytics files",
+			Value:   "s3.amazonaws.com",
+			EnvVars: []string{"RELAY_ANALYTICS_S3_ENDPOINT"},
+		},
+		&cli.StringFlag{
+			Name:    "analytics-s3-region",
+			Usage:   "S3 region for analytics files",
+			EnvVars: []string{"RELAY_ANALYTICS_S3_REGION"},
+		},
+		&cli.BoolFlag{
+			Name:    "analytics-include-records",
+			Usage:   "include created and updated records, as JSON, in analytics files",
+			EnvVars: []string{"RELAY_ANALYTICS_INCLUDE_RECORDS"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "kafka-brokers",
+			Usage:   "publish every sequenced event to kafka, through these brokers (host:port, may be repeated)",
+			EnvVars: []string{"RELAY_KAFKA_BROKERS"},
+		},
+		&cli.StringFlag{
+			Name:    "kafka-topic",
+			Usage:   "kafka topic to publish events to",
+			Value:   "relay-events",
+			EnvVars: []string{"RELAY_KAFKA_TOPIC"},
+		},
+		&cli.StringFlag{
+			Name:    "kafka-encoding",
+			Usage:   "encoding of events published to kafka: cbor (the firehose frame) or json",
+			Value:   events.KafkaEncodingCBOR,
+			EnvVars: []string{"RELAY_KAFKA_ENCODING"},
+		},
+		&cli.StringFlag{
+			Name:    "nats-url",
+			Usage:   "publish every sequenced event to nats jetstream at this url, on subjects by event type and collection",
+			EnvVars: []string{"RELAY_NATS_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "nats-stream",
+			Usage:   "jetstream stream to create or update for published events; empty to manage the stream elsewhere",
+			Value:   "ATPROTO",
+			EnvVars: []string{"RELAY_NATS_STREAM"},
+		},
+		&cli.StringFlag{
+			Name:    "nats-subject-prefix",
+			Usage:   "first token of the subjects events are published on",
+			Value:   "atproto",
+			EnvVars: []string{"RELAY_NATS_SUBJECT_PREFIX"},
+		},
+		&cli.DurationFlag{
+			Name:    "nats-stream-max-age",
+			Usage:   "how long the jetstream stream keeps events",
+			Value:   72 * time.Hour,
+			EnvVars: []string{"RELAY_NATS_STREAM_MAX_AGE"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "dns-upstreams",
+			Usage:   "where handle DNS lookups go, tried in order: \"dns\" for the server at resolve-address, or a DNS-over-HTTPS URL (may be repeated)",
+			Value:   cli.NewStringSlice("dns"),
+			EnvVars: []string{"RELAY_DNS_UPSTREAMS"},
+		},
+		&cli.StringFlag{
+			Name:    "handle-resolver-url",
+			Usage:   "URL of a handle resolution service to resolve handles with, falling back to resolving them directly when it's unavailable",
+			EnvVars: []string{"RELAY_HANDLE_RESOLVER_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "handle-resolver-token",
+			Usage:   "bearer token sent to the handle resolution service",
+			EnvVars: []string{"RELAY_HANDLE_RESOLVER_TOKEN"},
+		},
+		&cli.DurationFlag{
+			Name:    "handle-resolver-timeout",
+			Usage:   "how long to wait for the handle resolution service before falling back",
+			Value:   5 * time.Second,
+			EnvVars: []string{"RELAY_HANDLE_RESOLVER_TIMEOUT"},
+		},
+		&cli.IntFlag{
+			Name:    "handle-resolver-failure-threshold",
+			Usage:   "failed handle resolution service requests in a row before it is skipped for handle-resolver-cooldown",
+			Value:   5,
+			EnvVars: []string{"RELAY_HANDLE_RESOLVER_FAILURE_THRESHOLD"},
+		},
+		&cli.DurationFlag{
+			Name:    "handle-resolver-cooldown",
+			Usage:   "how long to skip the handle resolution service once it keeps failing",
+			Value:   30 * time.Second,
+			EnvVars: []string{"RELAY_HANDLE_RESOLVER_COOLDOWN"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "ingest-disable-stages",
+			Usage:   "ingest stages to start out disabled: dedup, size, lexicon, signature, rev, or a plugin stage (may be repeated)",
+			EnvVars: []string{"RELAY_INGEST_DISABLE_STAGES"},
+		},
+		&cli.IntFlag{
+			Name:    "ingest-max-commit-bytes",
+			Usage:   "largest commit blocks field the size stage accepts",
+			Value:   2_000_000,
+			EnvVars: []string{"RELAY_INGEST_MAX_COMMIT_BYTES"},
+		},
+		&cli.IntFlag{
+			Name:    "ingest-max-commit-ops",
+			Usage:   "most ops in a commit the size stage accepts",
+			Value:   200,
+			EnvVars: []string{"RELAY_INGEST_MAX_COMMIT_OPS"},
+		},
+		&cli.IntFlag{
+			Name:    "ingest-max-commit-blocks",
+			Usage:   "most blocks in a commit the size stage accepts (0 for no limit)",
+			Value:   10_000,
+			EnvVars: []string{"RELAY_INGEST_MAX_COMMIT_BLOCKS"},
+		},
+		&cli.IntFlag{
+			Name:    "ingest-max-block-bytes",
+			Usage:   "largest single block in a commit the size stage accepts (0 for no limit)",
+			Value:   1 << 20,
+			EnvVars: []string{"RELAY_INGEST_MAX_BLOCK_BYTES"},
+		},
+		&cli.Int64Flag{
+			Name:    "ingest-max-repo-bytes",
+			Usage:   "reject commits to repos already using more than this much carstore space (0 for no limit)",
+			EnvVars: []string{"RELAY_INGEST_MAX_REPO_BYTES"},
 		},
 		&cli.IntFlag{
-			Name:    "max-fetch-concurrency",
-			Value:   100,
-			EnvVars: []string{"MAX_FETCH_CONCURRENCY"},
+			Name:    "ingest-size-violations-to-block",
+			Usage:   "block hosts that break a size limit this many times within the violation window (0 to never block)",
+			EnvVars: []string{"RELAY_INGEST_SIZE_VIOLATIONS_TO_BLOCK"},
 		},
-		&cli.StringFlag{
-			Name:    "env",
-			Value:   "dev",
-			EnvVars: []string{"ENVIRONMENT"},
-			Usage:   "declared hosting environment (prod, qa, etc); used in metrics",
+		&cli.DurationFlag{
+			Name:    "ingest-size-violation-window",
+			Usage:   "window size limit violations are counted over for blocking hosts",
+			Value:   time.Hour,
+			EnvVars: []string{"RELAY_INGEST_SIZE_VIOLATION_WINDOW"},
+		},
+		&cli.IntFlag{
+			Name:    "ingest-dedup-cache-size",
+			Usage:   "number of recently received events the dedup stage remembers",
+			Value:   500_000,
+			EnvVars: []string{"RELAY_INGEST_DEDUP_CACHE_SIZE"},
+		},
+		&cli.DurationFlag{
+			Name:    "ingest-dedup-ttl",
+			Usage:   "how long the dedup stage remembers a received event",
+			Value:   time.Hour,
+			EnvVars: []string{"RELAY_INGEST_DEDUP_TTL"},
 		},
 		&cli.StringFlag{
-			Name:    "otel-exporter-otlp-endpoint",
-			EnvVars: []string{"OTEL_EXPORTER_OTLP_ENDPOINT"},
+			Name:    "ingest-lexicon-dir",
+			Usage:   "directory of lexicon schemas the lexicon stage validates records against; if unset only op syntax is checked",
+			EnvVars: []string{"RELAY_INGEST_LEXICON_DIR"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "ingest-plugins",
+			Usage:   "Go plugins exporting IngestStages, whose stages run after the built in ones (may be repeated)",
+			EnvVars: []string{"RELAY_INGEST_PLUGINS"},
 		},
 		&cli.StringFlag{
-			Name:    "bsky-social-rate-limit-skip",
-			EnvVars: []string{"BSKY_SOCIAL_RATE_LIMIT_SKIP"},
-			Usage:   "ratelimit bypass secret token for *.bsky.social domains",
+			Name:    "ingest-scoring-url",
+			Usage:   "URL of a service scoring records for spam; if set, commits scoring above the thresholds are tagged, delayed or dropped from the firehose",
+			EnvVars: []string{"RELAY_INGEST_SCORING_URL"},
 		},
-		&cli.IntFlag{
-			Name:    "default-repo-limit",
-			Value:   100,
-			EnvVars: []string{"RELAY_DEFAULT_REPO_LIMIT"},
+		&cli.StringSliceFlag{
+			Name:    "ingest-scoring-collections",
+			Usage:   "collections whose records are scored (may be repeated; all if unset)",
+			EnvVars: []string{"RELAY_INGEST_SCORING_COLLECTIONS"},
 		},
-		&cli.IntFlag{
-			Name:    "concurrency-per-pds",
-			EnvVars: []string{"RELAY_CONCURRENCY_PER_PDS"},
-			Value:   100,
+		&cli.Float64Flag{
+			Name:    "ingest-scoring-tag-above",
+			Usage:   "list commits scoring above this as flagged (0 to not)",
+			EnvVars: []string{"RELAY_INGEST_SCORING_TAG_ABOVE"},
 		},
-		&cli.IntFlag{
-			Name:    "max-queue-per-pds",
-			EnvVars: []string{"RELAY_MAX_QUEUE_PER_PDS"},
-			Value:   1_000,
+		&cli.Float64Flag{
+			Name:    "ingest-scoring-delay-above",
+			Usage:   "hold commits scoring above this for the scoring delay before processing them (0 to not)",
+			EnvVars: []string{"RELAY_INGEST_SCORING_DELAY_ABOVE"},
 		},
-		&cli.IntFlag{
-			Name:    "did-cache-size",
-			EnvVars: []string{"RELAY_DID_CACHE_SIZE"},
-			Value:   5_000_000,
+		&cli.Float64Flag{
+			Name:    "ingest-scoring-drop-above",
+			Usage:   "keep commits scoring above this off the firehose (0 to not)",
+			EnvVars: []string{"RELAY_INGEST_SCORING_DROP_ABOVE"},
 		},
 		&cli.DurationFlag{
-			Name:    "event-playback-ttl",
-			Usage:   "time to live for event playback buffering (only applies to disk persister)",
-			EnvVars: []string{"RELAY_EVENT_PLAYBACK_TTL"},
-			Value:   72 * time.Hour,
+			Name:    "ingest-scoring-delay",
+			Usage:   "how long commits scoring above the delay threshold are held",
+			Value:   libbgs.DefaultScoringOptions().Delay,
+			EnvVars: []string{"RELAY_INGEST_SCORING_DELAY"},
+		},
+		&cli.DurationFlag{
+			Name:    "ingest-scoring-timeout",
+			Usage:   "how long the scoring service has to score a record before it's let through",
+			Value:   libbgs.DefaultScoringOptions().Timeout,
+			EnvVars: []string{"RELAY_INGEST_SCORING_TIMEOUT"},
+		},
+		&cli.BoolFlag{
+			Name:    "sample-firehose",
+			Usage:   "serve /xrpc/_dev/sampleFirehose, a sample of the firehose by repo for load testing consumers",
+			EnvVars: []string{"RELAY_SAMPLE_FIREHOSE"},
+		},
+		&cli.BoolFlag{
+			Name:    "jetstream",
+			Usage:   "serve /subscribe, the firehose in Jetstream's JSON format",
+			EnvVars: []string{"RELAY_JETSTREAM"},
+		},
+		&cli.BoolFlag{
+			Name:    "fault-injection",
+			Usage:   "allow injecting faults through /admin/faults; for staging only",
+			EnvVars: []string{"RELAY_FAULT_INJECTION"},
+		},
+		&cli.BoolFlag{
+			Name:    "event-strip-blobs",
+			Usage:   "empty the blobs list of commits sent out",
+			EnvVars: []string{"RELAY_EVENT_STRIP_BLOBS"},
+		},
+		&cli.BoolFlag{
+			Name:    "event-relay-time",
+			Usage:   "set the time on events sent out to when the relay sent them, rather than when their PDS did",
+			EnvVars: []string{"RELAY_EVENT_RELAY_TIME"},
+		},
+		&cli.StringFlag{
+			Name:    "redaction-rules",
+			Usage:   "path to a JSON file of fields to remove from records, by collection, before they're sent out or served by getRecord",
+			EnvVars: []string{"RELAY_REDACTION_RULES"},
+		},
+		&cli.StringFlag{
+			Name:    "carstore-replica-db-url",
+			Usage:   "read-only replica of the carstore database, for the metadata lookups behind getRepo and getBlocks; ingest always uses carstore-db-url",
+			EnvVars: []string{"RELAY_CARSTORE_REPLICA_DATABASE_URL"},
 		},
 	}
 
 	app.Action = runBigsky
+	app.Commands = []*cli.Command{
+		importHostsCmd,
+		importCarsCmd,
+	}
 	return app.Run(os.Args)
 }
 
@@ -268,6 +1190,12 @@ func setupOTEL(cctx *cli.Context) error {
 }
 
 func runBigsky(cctx *cli.Context) error {
+	if cctx.Bool("low-memory") {
+		if err := applyLowMemoryProfile(cctx); err != nil {
+			return err
+		}
+	}
+
 	// Trap SIGINT to trigger a shutdown.
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
@@ -298,6 +1226,15 @@ func runBigsky(cctx *cli.Context) error {
 		return err
 	}
 
+	var csReplica *gorm.DB
+	if url := cctx.String("carstore-replica-db-url"); url != "" {
+		log.Infow("setting up carstore read replica database")
+		csReplica, err = cliutil.SetupDatabase(url, cctx.Int("max-carstore-connections"))
+		if err != nil {
+			return err
+		}
+	}
+
 	if cctx.Bool("db-tracing") {
 		if err := db.Use(tracing.NewPlugin()); err != nil {
 			return err
@@ -305,30 +1242,100 @@ func runBigsky(cctx *cli.Context) error {
 		if err := csdb.Use(tracing.NewPlugin()); err != nil {
 			return err
 		}
+		if csReplica != nil {
+			if err := csReplica.Use(tracing.NewPlugin()); err != nil {
+				return err
+			}
+		}
 	}
 
-	os.MkdirAll(filepath.Dir(csdir), os.ModePerm)
-	cstore, err := carstore.NewCarStore(csdb, csdir)
-	if err != nil {
-		return err
+	var cstore carstore.CarStore
+	if cctx.Bool("index-only") {
+		// the db persister reads commits back out of the carstore for playback
+		if cctx.String("disk-persister-dir") == "" || cctx.Duration("disk-persister-migration-history") > 0 {
+			return fmt.Errorf("index-only mode requires the disk persister (disk-persister-dir), without migration from the db persister")
+		}
+		log.Infow("running in index-only mode, repo data will not be kept")
+		cstore, err = carstore.NewIndexOnlyCarStore(csdb)
+		if err != nil {
+			return err
+		}
+	} else {
+		cstore, err = setupFileCarStore(cctx, csdb, csReplica, csdir, datadir)
+		if err != nil {
+			return err
+		}
 	}
 
-	mr := did.NewMultiResolver()
+	var outboundProxy util.ProxyFunc
+	if u := cctx.String("outbound-proxy"); u != "" {
+		outboundProxy, err = util.NewProxyFunc(u, cctx.StringSlice("outbound-proxy-bypass"))
+		if err != nil {
+			return err
+		}
+		log.Infow("sending outbound requests through proxy", "bypass", cctx.StringSlice("outbound-proxy-bypass"))
+	}
 
-	didr := &api.PLCServer{Host: cctx.String("plc-host")}
-	mr.AddHandler("plc", didr)
+	pdsTLS := &util.TLSPolicy{}
+	pdsTLS.MinVersion, err = util.ParseTLSVersion(cctx.String("pds-tls-min-version"))
+	if err != nil {
+		return err
+	}
+	pdsTLS.Pins, err = util.ParseTLSPins(cctx.StringSlice("pds-tls-pin"))
+	if err != nil {
+		return err
+	}
+	pdsTLSConfig := pdsTLS.Config()
+	if pdsTLSConfig != nil {
+		log.Infow("enforcing TLS policy for PDS connections", "minVersion", cctx.String("pds-tls-min-version"), "pinnedHosts", len(pdsTLS.Pins))
+	}
 
-	webr := did.WebResolver{}
-	if cctx.Bool("crawl-insecure-ws") {
-		webr.Insecure = true
+	pdsClientOpts := util.DefaultHTTPClientOptions()
+	pdsClientOpts.Proxy = outboundProxy
+	pdsClientOpts.TLSConfig = pdsTLSConfig
+	pdsClientOpts.HTTP2 = cctx.Bool("pds-http2")
+	pdsClientOpts.MaxIdleConnsPerHost = cctx.Int("pds-max-idle-conns-per-host")
+	pdsClientOpts.MaxConnsPerHost = cctx.Int("pds-max-conns-per-host")
+	pdsClientOpts.TLSSessionCacheSize = cctx.Int("pds-tls-session-cache")
+	if ttl := cctx.Duration("pds-dns-cache-ttl"); ttl > 0 {
+		pdsClientOpts.DNSCache = util.NewDNSCache(10_000, ttl)
+	}
+	if pdsClientOpts.MaxIdleConns < pdsClientOpts.MaxIdleConnsPerHost {
+		pdsClientOpts.MaxIdleConns = pdsClientOpts.MaxIdleConnsPerHost
+	}
+	// copied for each PDS client, which all share its connection pool
+	pdsClient, err := util.RobustHTTPClientWithOptions(pdsClientOpts)
+	if err != nil {
+		return fmt.Errorf("configuring PDS client: %w", err)
 	}
-	mr.AddHandler("web", &webr)
 
-	cachedidr := plc.NewCachingDidResolver(mr, time.Hour*24, cctx.Int("did-cache-size"))
+	signer, err := loadSigner(cctx)
+	if err != nil {
+		return err
+	}
+	if c, ok := signer.(io.Closer); ok {
+		defer c.Close()
+	}
 
-	kmgr := indexer.NewKeyManager(cachedidr, nil)
+	cachedidr := indexer.NewResolver(&indexer.ResolverOptions{
+		PLCHost:      cctx.String("plc-host"),
+		PLCBatchPath: cctx.String("plc-batch-path"),
+		InsecureWeb:  cctx.Bool("crawl-insecure-ws"),
+		Proxy:        outboundProxy,
+		CacheSize:    cctx.Int("did-cache-size"),
+		CacheTTL:     24 * time.Hour,
+		Signer:       signer,
+	})
 
-	repoman := repomgr.NewRepoManager(cstore, kmgr)
+	repoman := repomgr.NewRepoManager(cstore, cachedidr)
+	if n := cctx.Int("mst-node-cache-repos"); n > 0 {
+		if err := repoman.SetNodeCache(repomgr.NodeCacheOptions{
+			Repos:        n,
+			NodesPerRepo: cctx.Int("mst-node-cache-nodes"),
+		}); err != nil {
+			return fmt.Errorf("setting up mst node cache: %w", err)
+		}
+	}
 
 	var persister events.EventPersistence
 
@@ -337,11 +1344,37 @@ func runBigsky(cctx *cli.Context) error {
 
 		pOpts := events.DefaultDiskPersistOptions()
 		pOpts.Retention = cctx.Duration("event-playback-ttl")
+		pOpts.Compaction, err = events.ParseCompactionMode(cctx.String("event-compaction"))
+		if err != nil {
+			return err
+		}
+		pOpts.CompactAfter = cctx.Duration("event-compaction-after")
+		pOpts.SyncWrites = cctx.Bool("disk-persister-sync-writes")
+		pOpts.RepoIndex = cctx.Bool("event-repo-index")
+		if cctx.Bool("low-memory") {
+			pOpts.UIDCacheSize = lowMemoryPersisterCacheSize
+			pOpts.DIDCacheSize = lowMemoryPersisterCacheSize
+		}
 		dp, err := events.NewDiskPersistence(dpd, "", db, pOpts)
 		if err != nil {
 			return fmt.Errorf("setting up disk persister: %w", err)
 		}
 		persister = dp
+
+		if hist := cctx.Duration("disk-persister-migration-history"); hist > 0 {
+			dbp, err := events.NewDbPersistence(db, cstore, nil)
+			if err != nil {
+				return fmt.Errorf("setting up db event persistence: %w", err)
+			}
+			mOpts := events.DefaultMigrationOptions()
+			mOpts.Name = "db-to-disk"
+			mOpts.MinHistory = hist
+			mp, err := events.NewMigratingPersistence(db, dbp, dp, mOpts)
+			if err != nil {
+				return fmt.Errorf("setting up persister migration: %w", err)
+			}
+			persister = mp
+		}
 	} else {
 		dbp, err := events.NewDbPersistence(db, cstore, nil)
 		if err != nil {
@@ -351,10 +1384,93 @@ func runBigsky(cctx *cli.Context) error {
 	}
 
 	evtman := events.NewEventManager(persister)
+	if n := cctx.Int("event-fanout-shards"); n > 0 {
+		evtman.SetFanoutShards(n)
+	}
+	evtman.SetFrameCacheSize(cctx.Int("event-frame-cache-size"))
+	evtman.SetSubscriberBufferSize(cctx.Int("event-subscriber-buffer"))
+	if d := cctx.Duration("chronological-order-delay"); d > 0 {
+		log.Infow("emitting events in the order received", "max_delay", d)
+		evtman.SetChronologicalOrder(d)
+	}
+
+	epochs, err := events.NewCursorEpochs(db)
+	if err != nil {
+		return fmt.Errorf("setting up cursor epochs: %w", err)
+	}
+	evtman.SetCursorEpochs(epochs)
+
+	var astore events.AnalyticsStore
+	if dir := cctx.String("analytics-dir"); dir != "" {
+		astore, err = events.NewLocalAnalyticsStore(dir)
+		if err != nil {
+			return fmt.Errorf("setting up analytics dir: %w", err)
+		}
+	} else if bucket := cctx.String("analytics-s3-bucket"); bucket != "" {
+		astore, err = events.NewS3AnalyticsStore(&events.S3AnalyticsStoreOptions{
+			Endpoint: cctx.String("analytics-s3-endpoint"),
+			Bucket:   bucket,
+			Prefix:   cctx.String("analytics-s3-prefix"),
+			Region:   cctx.String("analytics-s3-region"),
+		})
+		if err != nil {
+			return fmt.Errorf("setting up analytics bucket: %w", err)
+		}
+	}
+	if astore != nil {
+		aopts := events.DefaultAnalyticsSinkOptions()
+		aopts.IncludeRecords = cctx.Bool("analytics-include-records")
+		sink := events.NewAnalyticsSink(astore, aopts)
+		sink.Start()
+		evtman.AddSink(sink)
+	}
+
+	if brokers := cctx.StringSlice("kafka-brokers"); len(brokers) > 0 {
+		kw := events.NewKafkaWriter(&events.KafkaWriterOptions{
+			Brokers:      brokers,
+			Topic:        cctx.String("kafka-topic"),
+			BatchTimeout: 50 * time.Millisecond,
+		})
+		kopts := events.DefaultKafkaSinkOptions()
+		kopts.Encoding = cctx.String("kafka-encoding")
+		sink, err := events.NewKafkaSink(kw, kopts)
+		if err != nil {
+			return fmt.Errorf("setting up kafka sink: %w", err)
+		}
+		sink.Start()
+		evtman.AddSink(sink)
+	}
+
+	if natsURL := cctx.String("nats-url"); natsURL != "" {
+		nc, err := nats.Connect(natsURL, nats.Name("bigsky"), nats.MaxReconnects(-1))
+		if err != nil {
+			return fmt.Errorf("connecting to nats: %w", err)
+		}
+		js, err := jetstream.New(nc)
+		if err != nil {
+			return fmt.Errorf("setting up jetstream: %w", err)
+		}
+
+		nopts := events.DefaultNatsSinkOptions()
+		nopts.SubjectPrefix = cctx.String("nats-subject-prefix")
+		if stream := cctx.String("nats-stream"); stream != "" {
+			if err := events.EnsureNatsStream(context.Background(), js, stream, nopts.SubjectPrefix, cctx.Duration("nats-stream-max-age")); err != nil {
+				return fmt.Errorf("setting up jetstream stream: %w", err)
+			}
+		}
+
+		sink := events.NewNatsSink(js, nopts)
+		sink.Start()
+		evtman.AddSink(sink)
+	}
 
 	notifman := &notifs.NullNotifs{}
 
 	rf := indexer.NewRepoFetcher(db, repoman, cctx.Int("max-fetch-concurrency"))
+	rf.Retry.MaxAttempts = cctx.Int("max-fetch-attempts")
+	rf.Audit.Interval = cctx.Duration("repo-audit-interval")
+	rf.Audit.SampleSize = cctx.Int("repo-audit-sample-size")
+	rf.Audit.Repair = cctx.Bool("repo-audit-repair")
 
 	ix, err := indexer.NewIndexer(db, notifman, evtman, cachedidr, rf, true, cctx.Bool("spidering"), false)
 	if err != nil {
@@ -362,16 +1478,23 @@ func runBigsky(cctx *cli.Context) error {
 	}
 
 	rlskip := cctx.String("bsky-social-rate-limit-skip")
+	var pdsLimiter *xrpc.HostLimiter
+	if cctx.Bool("pds-adaptive-ratelimit") {
+		pdsLimiter = xrpc.NewHostLimiter(xrpc.DefaultHostLimiterOptions())
+	}
 	ix.ApplyPDSClientSettings = func(c *xrpc.Client) {
 		if c.Client == nil {
-			c.Client = util.RobustHTTPClient()
+			cl := *pdsClient
+			c.Client = &cl
 		}
+		c.Limiter = pdsLimiter
 		if strings.HasSuffix(c.Host, ".bsky.network") {
 			c.Client.Timeout = time.Minute * 30
 			if rlskip != "" {
 				c.Headers = map[string]string{
 					"x-ratelimit-bypass": rlskip,
 				}
+				c.Limiter = nil
 			}
 		} else {
 			// Generic PDS timeout
@@ -380,13 +1503,37 @@ func runBigsky(cctx *cli.Context) error {
 	}
 	rf.ApplyPDSClientSettings = ix.ApplyPDSClientSettings
 
+	if n := cctx.Int("indexer-group-commit-size"); n > 0 {
+		gcOpts := indexer.DefaultGroupCommitOptions()
+		gcOpts.MaxBatch = n
+		gcOpts.MaxDelay = cctx.Duration("indexer-group-commit-delay")
+		ix.StartGroupCommit(gcOpts)
+	}
+
+	if n := cctx.Int("indexer-op-workers"); n > 0 {
+		opOpts := indexer.DefaultOpWorkerOptions()
+		opOpts.Workers = n
+		for _, kv := range cctx.StringSlice("indexer-collection-priority") {
+			nsid, p, ok := strings.Cut(kv, "=")
+			if !ok {
+				return fmt.Errorf("invalid collection priority %q, expected nsid=priority", kv)
+			}
+			prio, err := indexer.ParseOpPriority(p)
+			if err != nil {
+				return err
+			}
+			opOpts.Collections[nsid] = prio
+		}
+		ix.StartOpWorkers(opOpts)
+	}
+
 	repoman.SetEventHandler(func(ctx context.Context, evt *repomgr.RepoEvent) {
 		if err := ix.HandleRepoEvent(ctx, evt); err != nil {
 			log.Errorw("failed to handle repo event", "err", err)
 		}
 	}, false)
 
-	prodHR, err := api.NewProdHandleResolver(100_000, cctx.String("resolve-address"), cctx.Bool("force-dns-udp"))
+	prodHR, err := api.NewProdHandleResolver(100_000, cctx.String("resolve-address"), cctx.Bool("force-dns-udp"), cctx.StringSlice("dns-upstreams")...)
 	if err != nil {
 		return fmt.Errorf("failed to set up handle resolver: %w", err)
 	}
@@ -405,14 +1552,187 @@ func runBigsky(cctx *cli.Context) error {
 			TrialHosts: cctx.StringSlice("handle-resolver-hosts"),
 		}
 	}
+	if u := cctx.String("handle-resolver-url"); u != "" {
+		hrOpts := api.DefaultDelegatedHandleResolverOptions()
+		hrOpts.Token = cctx.String("handle-resolver-token")
+		hrOpts.Timeout = cctx.Duration("handle-resolver-timeout")
+		hrOpts.FailureThreshold = cctx.Int("handle-resolver-failure-threshold")
+		hrOpts.Cooldown = cctx.Duration("handle-resolver-cooldown")
+		hr, err = api.NewDelegatedHandleResolver(u, hr, hrOpts)
+		if err != nil {
+			return fmt.Errorf("failed to set up handle resolver: %w", err)
+		}
+		log.Infow("resolving handles through handle resolution service", "url", u)
+	}
 
 	log.Infow("constructing bgs")
 	bgsConfig := libbgs.DefaultBGSConfig()
+	if cctx.Bool("low-memory") {
+		bgsConfig.CollectionIndexCacheSize = lowMemoryCollectionIndexCacheSize
+	}
 	bgsConfig.SSL = !cctx.Bool("crawl-insecure-ws")
 	bgsConfig.CompactInterval = cctx.Duration("compact-interval")
 	bgsConfig.ConcurrencyPerPDS = cctx.Int64("concurrency-per-pds")
 	bgsConfig.MaxQueuePerPDS = cctx.Int64("max-queue-per-pds")
-	bgsConfig.DefaultRepoLimit = cctx.Int64("default-repo-limit")
+	tierOpts := libbgs.DefaultRepoLimitTiersOptions()
+	tierOpts.Limits[libbgs.TierNew] = cctx.Int64("repo-limit-new")
+	tierOpts.Limits[libbgs.TierTrusted] = cctx.Int64("repo-limit-trusted")
+	tierOpts.Limits[libbgs.TierPartner] = cctx.Int64("repo-limit-partner")
+	tierOpts.Promotions[0].MinAge = cctx.Duration("tier-promote-min-age")
+	tierOpts.Promotions[0].CleanFor = cctx.Duration("tier-promote-clean-for")
+	tierOpts.PromoteInterval = cctx.Duration("tier-promote-interval")
+	bgsConfig.RepoLimitTiers = tierOpts
+	spiderOpts := libbgs.DefaultSpideringOptions()
+	spiderOpts.MaxNewHostsPerHour = cctx.Int("spidering-max-new-hosts-per-hour")
+	spiderOpts.RequireDescribeServer = cctx.Bool("spidering-require-describe-server")
+	spiderOpts.AllowedDomains = cctx.StringSlice("spidering-allowed-domains")
+	spiderOpts.AutoTrustFor = cctx.Duration("spidering-auto-trust")
+	bgsConfig.Spidering = spiderOpts
+	growthOpts := libbgs.DefaultGrowthMonitorOptions()
+	growthOpts.Interval = cctx.Duration("growth-check-interval")
+	growthOpts.Window = cctx.Duration("growth-window")
+	growthOpts.MaxNewRepos = cctx.Int64("growth-max-new-repos")
+	growthOpts.MaxGrowthFactor = cctx.Float64("growth-max-factor")
+	growthOpts.MinNewRepos = cctx.Int64("growth-min-new-repos")
+	growthOpts.Pause = cctx.Bool("growth-pause")
+	growthOpts.WebhookURL = cctx.String("growth-alert-webhook")
+	bgsConfig.Growth = growthOpts
+	bgsConfig.HostStats = &libbgs.HostStatsOptions{
+		Interval:        cctx.Duration("host-stats-interval"),
+		Retention:       cctx.Duration("host-stats-retention"),
+		HourlyRetention: cctx.Duration("host-stats-hourly-retention"),
+	}
+	if cctx.Bool("public-stats") {
+		statsOpts := libbgs.DefaultPublicStatsOptions()
+		statsOpts.CacheTTL = cctx.Duration("public-stats-cache-ttl")
+		bgsConfig.PublicStats = statsOpts
+	}
+	if retention := cctx.Duration("deactivated-repo-retention"); retention > 0 {
+		deactOpts := libbgs.DefaultDeactivationOptions()
+		deactOpts.Retention = retention
+		bgsConfig.Deactivation = deactOpts
+	}
+	if interval := cctx.Duration("carstore-scrub-interval"); interval > 0 {
+		if cctx.Bool("index-only") {
+			return fmt.Errorf("index-only mode keeps no carstore shards to scrub")
+		}
+		scrubOpts := libbgs.DefaultScrubOptions()
+		scrubOpts.Interval = interval
+		scrubOpts.BatchSize = cctx.Int("carstore-scrub-batch")
+		scrubOpts.Refetch = cctx.Bool("carstore-scrub-refetch")
+		bgsConfig.Scrub = scrubOpts
+	}
+	if cctx.Bool("collection-registry") || cctx.Bool("quarantine-unknown-collections") {
+		registryOpts := libbgs.DefaultCollectionRegistryOptions()
+		registryOpts.Quarantine = cctx.Bool("quarantine-unknown-collections")
+		registryOpts.Approved = cctx.StringSlice("approved-collections")
+		bgsConfig.CollectionRegistry = registryOpts
+	}
+	if path := cctx.String("defederation-policy"); path != "" {
+		policyOpts, err := libbgs.LoadDefederationPolicy(path)
+		if err != nil {
+			return err
+		}
+		bgsConfig.Policy = policyOpts
+	}
+	if path := cctx.String("alerting-config"); path != "" {
+		alertingOpts, err := libbgs.LoadAlertingConfig(path)
+		if err != nil {
+			return err
+		}
+		bgsConfig.Alerting = alertingOpts
+	}
+	gossipOpts := libbgs.DefaultGossipOptions()
+	gossipOpts.Serve = cctx.Bool("gossip-serve")
+	gossipOpts.Peers = cctx.StringSlice("gossip-peers")
+	gossipOpts.Interval = cctx.Duration("gossip-interval")
+	bgsConfig.Gossip = gossipOpts
+	readOpts := libbgs.DefaultReadBudgetOptions()
+	readOpts.Budget = cctx.Int64("read-budget")
+	readOpts.PerRequest = cctx.Int64("read-budget-per-request")
+	readOpts.QueueTimeout = cctx.Duration("read-budget-queue-timeout")
+	bgsConfig.ReadBudget = readOpts
+	bgsConfig.SyncCompression = &libbgs.SyncCompressionOptions{
+		MaxConcurrent: cctx.Int("sync-compression-concurrency"),
+		Level:         cctx.String("sync-compression-level"),
+	}
+	bgsConfig.APIRateLimit, err = apiRateLimitOptions(cctx)
+	if err != nil {
+		return err
+	}
+	bgsConfig.SampleFirehose = cctx.Bool("sample-firehose")
+	bgsConfig.Jetstream = cctx.Bool("jetstream")
+	bgsConfig.FaultInjection = cctx.Bool("fault-injection")
+	bgsConfig.PublicRepoHistory = cctx.Bool("public-repo-history")
+	bgsConfig.OutboundProxy = outboundProxy
+	bgsConfig.PDSTLSConfig = pdsTLSConfig
+	if cctx.Bool("event-strip-blobs") {
+		bgsConfig.EventMiddleware = append(bgsConfig.EventMiddleware, events.StripCommitBlobs)
+	}
+	if cctx.Bool("event-relay-time") {
+		bgsConfig.EventMiddleware = append(bgsConfig.EventMiddleware, events.StampRelayTime)
+	}
+	if path := cctx.String("redaction-rules"); path != "" {
+		redactionOpts, err := libbgs.LoadRedactionRules(path)
+		if err != nil {
+			return err
+		}
+		bgsConfig.Redaction = redactionOpts
+	}
+	bgsConfig.DefaultStorageQuota = cctx.Int64("default-pds-storage-quota")
+	bgsConfig.BlobProxy = cctx.Bool("blob-proxy")
+	bgsConfig.BlobCacheDir = filepath.Join(datadir, "blobcache")
+	if cctx.IsSet("blob-cache-dir") {
+		bgsConfig.BlobCacheDir = cctx.String("blob-cache-dir")
+	}
+	bgsConfig.BlobCacheMaxBytes = cctx.Int64("blob-cache-max-bytes")
+	bgsConfig.BlobMaxSize = cctx.Int64("blob-max-size")
+	bgsConfig.BlobRefIndex = cctx.Bool("blob-ref-index")
+	if cctx.String("relay-hostname") != "" || cctx.String("relay-contact") != "" {
+		bgsConfig.Identity = &libbgs.RelayIdentity{
+			Hostname: cctx.String("relay-hostname"),
+			Contact:  cctx.String("relay-contact"),
+		}
+	}
+	auditOpts := libbgs.DefaultAdminAuditLogOptions()
+	auditOpts.File = cctx.String("admin-audit-log-file")
+	auditOpts.WebhookURL = cctx.String("admin-audit-webhook")
+	bgsConfig.AdminAuditLog = auditOpts
+	bgsConfig.HandleReverifyInterval = cctx.Duration("handle-reverify-interval")
+	bgsConfig.HandleReverifyRate = cctx.Float64("handle-reverify-rate")
+	bgsConfig.TLSConfig, err = apiTLSConfig(cctx)
+	if err != nil {
+		return fmt.Errorf("failed to set up api TLS: %w", err)
+	}
+	if addr := cctx.String("admission-grpc-addr"); addr != "" {
+		policy, err := libbgs.NewGRPCAdmissionPolicy(addr, cctx.Bool("admission-grpc-plaintext"))
+		if err != nil {
+			return err
+		}
+		defer policy.Close()
+
+		admOpts := libbgs.DefaultAdmissionOptions()
+		admOpts.CacheTTL = cctx.Duration("admission-cache-ttl")
+		admOpts.Timeout = cctx.Duration("admission-timeout")
+		admOpts.FailOpen = !cctx.Bool("admission-fail-closed")
+		bgsConfig.Admission = policy
+		bgsConfig.AdmissionOptions = admOpts
+	}
+	if admins := cctx.StringSlice("admin-service-auth-dids"); len(admins) > 0 {
+		bgsConfig.ServiceAuth = &libbgs.ServiceAuthConfig{
+			Audience:    cctx.String("service-did"),
+			AdminDIDs:   admins,
+			MaxLifetime: cctx.Duration("admin-service-auth-max-lifetime"),
+		}
+	}
+	bgsConfig.SubscriberAuth, err = subscriberAuthOptions(cctx)
+	if err != nil {
+		return err
+	}
+	bgsConfig.Ingest, err = ingestOptions(cctx)
+	if err != nil {
+		return err
+	}
 	bgs, err := libbgs.NewBGS(db, ix, repoman, evtman, cachedidr, rf, hr, bgsConfig)
 	if err != nil {
 		return err
@@ -424,17 +1744,47 @@ func runBigsky(cctx *cli.Context) error {
 		}
 	}
 
+	// open both listeners up front, so a bad address or missing activated
+	// socket fails startup rather than a background goroutine
+	apiListener, err := cliutil.Listen(cctx.Context, cctx.String("api-listen"))
+	if err != nil {
+		return fmt.Errorf("api listener: %w", err)
+	}
+	metricsListener, err := cliutil.Listen(cctx.Context, cctx.String("metrics-listen"))
+	if err != nil {
+		return fmt.Errorf("metrics listener: %w", err)
+	}
+
 	// set up metrics endpoint
 	go func() {
-		if err := bgs.StartMetrics(cctx.String("metrics-listen")); err != nil {
+		if err := bgs.StartMetricsWithListener(metricsListener); err != nil {
 			log.Fatalf("failed to start metrics endpoint: %s", err)
 		}
 	}()
 
+	if addr := cctx.String("h3-listen"); addr != "" {
+		// QUIC requires TLS; share the API's configuration unless the http3
+		// listener has its own certificate
+		h3tls := bgsConfig.TLSConfig
+		if cctx.String("h3-cert-file") != "" {
+			cert, err := tls.LoadX509KeyPair(cctx.String("h3-cert-file"), cctx.String("h3-key-file"))
+			if err != nil {
+				return fmt.Errorf("loading http3 certificate: %w", err)
+			}
+			h3tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+		if h3tls == nil {
+			return fmt.Errorf("h3-listen requires either h3-cert-file/h3-key-file or api TLS to be configured")
+		}
+		if err := bgs.StartHTTP3(addr, h3tls); err != nil {
+			return fmt.Errorf("failed to start http3 listener: %w", err)
+		}
+	}
+
 	bgsErr := make(chan error, 1)
 
 	go func() {
-		err := bgs.Start(cctx.String("api-listen"))
+		err := bgs.StartWithListener(apiListener)
 		bgsErr <- err
 	}()
 
@@ -442,22 +1792,204 @@ func runBigsky(cctx *cli.Context) error {
 	select {
 	case <-signals:
 		log.Info("received shutdown signal")
-		errs := bgs.Shutdown()
-		for err := range errs {
-			log.Errorw("error during BGS shutdown", "err", err)
-		}
 	case err := <-bgsErr:
 		if err != nil {
 			log.Errorw("error during BGS startup", "err", err)
 		}
 		log.Info("shutting down")
-		errs := bgs.Shutdown()
-		for err := range errs {
-			log.Errorw("error during BGS shutdown", "err", err)
+	}
+
+	report := bgs.Shutdown(cctx.Duration("shutdown-phase-timeout"))
+	for _, phase := range report.Phases {
+		if phase.TimedOut || len(phase.Errors) > 0 {
+			log.Warnw("shutdown phase did not complete cleanly", "phase", phase.Name, "timedOut", phase.TimedOut, "errors", len(phase.Errors))
 		}
 	}
+	if report.UnflushedEvents > 0 {
+		log.Errorw("events were lost at shutdown", "unflushed", report.UnflushedEvents)
+	}
 
 	log.Info("shutdown complete")
 
 	return nil
 }
+
+func ingestOptions(cctx *cli.Context) (*libbgs.IngestOptions, error) {
+	opts := libbgs.DefaultIngestOptions()
+	opts.Disabled = cctx.StringSlice("ingest-disable-stages")
+	opts.MaxCommitBytes = cctx.Int("ingest-max-commit-bytes")
+	opts.MaxCommitOps = cctx.Int("ingest-max-commit-ops")
+	opts.MaxCommitBlocks = cctx.Int("ingest-max-commit-blocks")
+	opts.MaxBlockBytes = cctx.Int("ingest-max-block-bytes")
+	opts.MaxRepoBytes = cctx.Int64("ingest-max-repo-bytes")
+	opts.SizeViolationsToBlock = cctx.Int("ingest-size-violations-to-block")
+	opts.SizeViolationWindow = cctx.Duration("ingest-size-violation-window")
+	opts.DedupCacheSize = cctx.Int("ingest-dedup-cache-size")
+	opts.DedupTTL = cctx.Duration("ingest-dedup-ttl")
+
+	if dir := cctx.String("ingest-lexicon-dir"); dir != "" {
+		cat := lexicon.NewBaseCatalog()
+		if err := cat.LoadDirectory(dir); err != nil {
+			return nil, fmt.Errorf("loading ingest lexicons: %w", err)
+		}
+		opts.LexiconCatalog = &cat
+	}
+
+	for _, path := range cctx.StringSlice("ingest-plugins") {
+		stages, err := libbgs.LoadIngestPlugin(path)
+		if err != nil {
+			return nil, err
+		}
+		opts.Hooks = append(opts.Hooks, stages...)
+	}
+
+	if url := cctx.String("ingest-scoring-url"); url != "" {
+		scorer, err := libbgs.NewHTTPScorer(url)
+		if err != nil {
+			return nil, err
+		}
+		scoring := libbgs.DefaultScoringOptions()
+		scoring.Scorer = scorer
+		scoring.Collections = cctx.StringSlice("ingest-scoring-collections")
+		scoring.TagAbove = cctx.Float64("ingest-scoring-tag-above")
+		scoring.DelayAbove = cctx.Float64("ingest-scoring-delay-above")
+		scoring.DropAbove = cctx.Float64("ingest-scoring-drop-above")
+		scoring.Delay = cctx.Duration("ingest-scoring-delay")
+		scoring.Timeout = cctx.Duration("ingest-scoring-timeout")
+		opts.Scoring = scoring
+	}
+
+	return opts, nil
+}
+
+// setupFileCarStore opens the carstore keeping repo data under csdir
+func setupFileCarStore(cctx *cli.Context, csdb, csReplica *gorm.DB, csdir, datadir string) (carstore.CarStore, error) {
+	os.MkdirAll(filepath.Dir(csdir), os.ModePerm)
+	csOpts := carstore.DefaultCarStoreOptions()
+	csOpts.BufferCommits = cctx.Int("carstore-buffer-commits")
+	csOpts.BufferBytes = cctx.Int("carstore-buffer-bytes")
+	csOpts.BufferMaxAge = cctx.Duration("carstore-buffer-max-age")
+	csOpts.TrashRetention = cctx.Duration("carstore-trash-retention")
+	csOpts.NodeID = cctx.String("carstore-node-id")
+	csOpts.LeaseTTL = cctx.Duration("carstore-lease-ttl")
+	csOpts.ReadReplica = csReplica
+	switch cctx.String("carstore-meta") {
+	case "sql":
+	case "pebble":
+		metadir := cctx.String("carstore-meta-dir")
+		if metadir == "" {
+			metadir = filepath.Join(datadir, "carstore-meta")
+		}
+		log.Infow("using pebble carstore metadata", "dir", metadir)
+		csmeta, err := carstore.NewCarStorePebbleMeta(metadir)
+		if err != nil {
+			return nil, err
+		}
+		csOpts.Meta = csmeta
+	default:
+		return nil, fmt.Errorf("unknown carstore-meta %q, must be 'sql' or 'pebble'", cctx.String("carstore-meta"))
+	}
+	return carstore.NewCarStoreWithOptions(csdb, csdir, csOpts)
+}
+
+// loadSigner sets up the signing key held in a KMS or HSM, if one is
+// configured. The key itself never passes through the relay.
+func loadSigner(cctx *cli.Context) (indexer.Signer, error) {
+	var signer indexer.Signer
+	switch kmsKey, module := cctx.String("signing-key-kms"), cctx.String("signing-key-pkcs11-module"); {
+	case kmsKey != "" && module != "":
+		return nil, fmt.Errorf("only one of signing-key-kms and signing-key-pkcs11-module may be set")
+	case kmsKey != "":
+		s, err := indexer.NewKMSSigner(cctx.Context, &indexer.KMSSignerOptions{
+			KeyID:  kmsKey,
+			Region: cctx.String("signing-key-kms-region"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		signer = s
+	case module != "":
+		s, err := indexer.NewPKCS11Signer(&indexer.PKCS11SignerOptions{
+			Module:     module,
+			TokenLabel: cctx.String("signing-key-pkcs11-token"),
+			KeyLabel:   cctx.String("signing-key-pkcs11-label"),
+			PIN:        cctx.String("signing-key-pkcs11-pin"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		signer = s
+	default:
+		return nil, nil
+	}
+
+	pub, err := signer.PublicKey(cctx.Context)
+	if err != nil {
+		return nil, err
+	}
+	log.Infow("signing with external key", "key", pub.DID())
+	return signer, nil
+}
+
+// subscriberAuthOptions configures subscriber auth, which is off unless
+// tokens or DIDs are given
+func subscriberAuthOptions(cctx *cli.Context) (*libbgs.SubscriberAuthOptions, error) {
+	tokens := cctx.StringSlice("subscriber-auth-token")
+	dids := cctx.StringSlice("subscriber-auth-dids")
+	if len(tokens) == 0 && len(dids) == 0 {
+		return nil, nil
+	}
+
+	opts := libbgs.DefaultSubscriberAuthOptions()
+	opts.Tokens = make(map[string]string)
+	for _, t := range tokens {
+		name, tok, ok := strings.Cut(t, "=")
+		if !ok || name == "" || tok == "" {
+			return nil, fmt.Errorf("invalid subscriber token, must be name=token")
+		}
+		if _, ok := opts.Tokens[name]; ok {
+			return nil, fmt.Errorf("subscriber token %q given twice", name)
+		}
+		opts.Tokens[name] = tok
+	}
+	opts.DIDs = dids
+	opts.Audience = cctx.String("service-did")
+	opts.MaxConnsPerIdentity = cctx.Int("subscriber-max-conns")
+	opts.ConnectRate = cctx.Float64("subscriber-connect-rate")
+	return opts, nil
+}
+
+func apiRateLimitOptions(cctx *cli.Context) (*libbgs.APIRateLimitOptions, error) {
+	overrides := cctx.StringSlice("api-rate-limits")
+	if !cctx.Bool("api-rate-limit") && len(overrides) == 0 {
+		return nil, nil
+	}
+
+	opts := libbgs.DefaultAPIRateLimitOptions()
+	for _, o := range overrides {
+		class, limit, ok := strings.Cut(o, "=")
+		if !ok || class == "" {
+			return nil, fmt.Errorf("invalid API rate limit %q, must be class=requests/window", o)
+		}
+		if _, ok := opts.Limits[class]; !ok {
+			return nil, fmt.Errorf("unknown API rate limit class %q", class)
+		}
+		if limit == "0" {
+			delete(opts.Limits, class)
+			continue
+		}
+		l, err := libbgs.ParseRateLimit(limit)
+		if err != nil {
+			return nil, err
+		}
+		opts.Limits[class] = l
+	}
+
+	exempt, err := libbgs.ParseExemptAddrs(cctx.StringSlice("api-rate-limit-exempt"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid API rate limit exemption: %w", err)
+	}
+	opts.Exempt = exempt
+	opts.TrustProxyHeaders = cctx.Bool("api-rate-limit-trust-proxy")
+	return opts, nil
+}
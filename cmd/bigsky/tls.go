@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	cli "github.com/urfave/cli/v2"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// apiTLSConfig builds the TLS config for the API and metrics listeners from
+// either a certificate and key on disk or ACME, or returns nil if neither is
+// configured
+func apiTLSConfig(cctx *cli.Context) (*tls.Config, error) {
+	certFile := cctx.String("api-tls-cert")
+	keyFile := cctx.String("api-tls-key")
+	acmeDomains := cctx.String("api-tls-acme-domain")
+
+	switch {
+	case acmeDomains != "" && (certFile != "" || keyFile != ""):
+		return nil, fmt.Errorf("api-tls-acme-domain can't be combined with api-tls-cert/api-tls-key")
+	case acmeDomains != "":
+		cacheDir := cctx.String("api-tls-acme-cache-dir")
+		if cacheDir == "" {
+			cacheDir = filepath.Join(cctx.String("data-dir"), "autocert")
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(strings.Split(acmeDomains, ",")...),
+			Cache:      autocert.DirCache(cacheDir),
+			Email:      cctx.String("api-tls-acme-email"),
+		}
+
+		// the TLS-ALPN challenge is answered by the API listener itself if it
+		// is on port 443; otherwise an HTTP listener is needed for HTTP-01
+		if addr := cctx.String("api-tls-acme-http-listen"); addr != "" {
+			go func() {
+				if err := http.ListenAndServe(addr, m.HTTPHandler(nil)); err != nil {
+					log.Errorw("acme http challenge listener failed", "err", err)
+				}
+			}()
+		}
+		return m.TLSConfig(), nil
+	case certFile != "" || keyFile != "":
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("api-tls-cert and api-tls-key must be set together")
+		}
+		r, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: r.GetCertificate,
+		}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// certReloader serves a certificate from disk, picking up renewals (eg, by
+// certbot) without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	lk        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) load() error {
+	fi, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	r.cert = &cert
+	r.modTime = fi.ModTime()
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if time.Since(r.lastCheck) > time.Minute {
+		r.lastCheck = time.Now()
+		if fi, err := os.Stat(r.certFile); err == nil && fi.ModTime() != r.modTime {
+			if err := r.load(); err != nil {
+				// keep serving the old certificate
+				log.Errorw("failed to reload TLS certificate", "err", err)
+			} else {
+				log.Infow("reloaded TLS certificate", "file", r.certFile)
+			}
+		}
+	}
+	return r.cert, nil
+}
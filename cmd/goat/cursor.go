@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/events"
+
+	"github.com/adrg/xdg"
+	"github.com/carlmjohnson/versioninfo"
+	"github.com/gorilla/websocket"
+	"github.com/urfave/cli/v2"
+)
+
+var cursorDirFlag = &cli.StringFlag{
+	Name:    "cursor-dir",
+	Usage:   "directory holding named cursor files (default: XDG state dir)",
+	EnvVars: []string{"GOAT_CURSOR_DIR"},
+}
+
+var cursorRelayHostFlag = &cli.StringFlag{
+	Name:    "relay-host",
+	Usage:   "method, hostname, and port of Relay instance (websocket)",
+	Value:   "wss://bsky.network",
+	EnvVars: []string{"ATP_RELAY_HOST"},
+}
+
+var cmdCursor = &cli.Command{
+	Name:  "cursor",
+	Usage: "sub-commands for managing named firehose cursors",
+	Flags: []cli.Flag{
+		cursorDirFlag,
+	},
+	Subcommands: []*cli.Command{
+		&cli.Command{
+			Name:   "list",
+			Usage:  "lists saved cursors",
+			Action: runCursorList,
+		},
+		&cli.Command{
+			Name:      "save",
+			Usage:     "saves a sequence number under a name",
+			ArgsUsage: `<name> <seq>`,
+			Flags: []cli.Flag{
+				cursorRelayHostFlag,
+			},
+			Action: runCursorSave,
+		},
+		&cli.Command{
+			Name:      "load",
+			Usage:     "prints the sequence number of a saved cursor",
+			ArgsUsage: `<name>`,
+			Action:    runCursorLoad,
+		},
+		&cli.Command{
+			Name:      "delete",
+			Usage:     "removes a saved cursor",
+			ArgsUsage: `<name>`,
+			Action:    runCursorDelete,
+		},
+		&cli.Command{
+			Name:      "inspect",
+			Usage:     "looks up the event timestamp for a saved cursor or sequence number",
+			ArgsUsage: `<name-or-seq>`,
+			Flags: []cli.Flag{
+				cursorRelayHostFlag,
+			},
+			Action: runCursorInspect,
+		},
+		&cli.Command{
+			Name:      "rewind",
+			Usage:     "moves a saved cursor back in time by a duration",
+			ArgsUsage: `<name> <duration>`,
+			Flags: []cli.Flag{
+				cursorRelayHostFlag,
+				&cli.BoolFlag{
+					Name:  "from-now",
+					Usage: "rewind relative to the current time instead of the cursor's own timestamp",
+				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "print the new sequence number without saving it",
+				},
+			},
+			Action: runCursorRewind,
+		},
+	},
+}
+
+// CursorFile is the on-disk format for a named cursor. Seq is the last event
+// processed, matching the semantics of the subscribeRepos cursor parameter.
+type CursorFile struct {
+	Seq       int64  `json:"seq"`
+	RelayHost string `json:"relay_host,omitempty"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+var ErrNoCursor = errors.New("no saved cursor")
+
+var cursorNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,63}$`)
+
+func cursorDir(cctx *cli.Context) string {
+	if dir := cctx.String("cursor-dir"); dir != "" {
+		return dir
+	}
+	return filepath.Join(xdg.StateHome, "goat", "cursors")
+}
+
+func cursorPath(cctx *cli.Context, name string) (string, error) {
+	if !cursorNameRegex.MatchString(name) {
+		return "", fmt.Errorf("invalid cursor name: %q", name)
+	}
+	return filepath.Join(cursorDir(cctx), name+".json"), nil
+}
+
+func loadCursor(cctx *cli.Context, name string) (*CursorFile, error) {
+	fPath, err := cursorPath(cctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := os.ReadFile(fPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w named %q", ErrNoCursor, name)
+		}
+		return nil, err
+	}
+
+	var cf CursorFile
+	if err := json.Unmarshal(b, &cf); err != nil {
+		return nil, fmt.Errorf("parsing cursor file %s: %w", fPath, err)
+	}
+	return &cf, nil
+}
+
+// persistCursor writes the cursor file atomically, so a consumer killed
+// mid-write never leaves a truncated file behind
+func persistCursor(cctx *cli.Context, name string, cf *CursorFile) error {
+	fPath, err := cursorPath(cctx, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fPath), 0755); err != nil {
+		return err
+	}
+
+	cf.UpdatedAt = syntax.DatetimeNow().String()
+	b, err := json.MarshalIndent(cf, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := fPath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fPath)
+}
+
+func runCursorList(cctx *cli.Context) error {
+	entries, err := os.ReadDir(cursorDir(cctx))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	for _, ent := range entries {
+		name, ok := strings.CutSuffix(ent.Name(), ".json")
+		if !ok || ent.IsDir() {
+			continue
+		}
+		cf, err := loadCursor(cctx, name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			continue
+		}
+		fmt.Printf("%s\t%d\t%s\t%s\n", name, cf.Seq, cf.RelayHost, cf.UpdatedAt)
+	}
+	return nil
+}
+
+func runCursorSave(cctx *cli.Context) error {
+	name := cctx.Args().Get(0)
+	if name == "" || cctx.Args().Len() != 2 {
+		return fmt.Errorf("need to provide cursor name and sequence number as arguments")
+	}
+	seq, err := strconv.ParseInt(cctx.Args().Get(1), 10, 64)
+	if err != nil || seq < 0 {
+		return fmt.Errorf("invalid sequence number: %s", cctx.Args().Get(1))
+	}
+
+	return persistCursor(cctx, name, &CursorFile{
+		Seq:       seq,
+		RelayHost: cctx.String("relay-host"),
+	})
+}
+
+func runCursorLoad(cctx *cli.Context) error {
+	name := cctx.Args().First()
+	if name == "" {
+		return fmt.Errorf("need to provide cursor name as argument")
+	}
+	cf, err := loadCursor(cctx, name)
+	if err != nil {
+		return err
+	}
+	fmt.Println(cf.Seq)
+	return nil
+}
+
+func runCursorDelete(cctx *cli.Context) error {
+	name := cctx.Args().First()
+	if name == "" {
+		return fmt.Errorf("need to provide cursor name as argument")
+	}
+	fPath, err := cursorPath(cctx, name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(fPath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w named %q", ErrNoCursor, name)
+		}
+		return err
+	}
+	return nil
+}
+
+// resolves a cursor argument which is either a sequence number or the name of
+// a saved cursor. The relay host recorded with a saved cursor is used unless
+// one was given explicitly.
+func cursorArg(cctx *cli.Context, arg string) (int64, string, error) {
+	relayHost := cctx.String("relay-host")
+	if seq, err := strconv.ParseInt(arg, 10, 64); err == nil {
+		return seq, relayHost, nil
+	}
+
+	cf, err := loadCursor(cctx, arg)
+	if err != nil {
+		return 0, "", err
+	}
+	if cf.RelayHost != "" && !cctx.IsSet("relay-host") {
+		relayHost = cf.RelayHost
+	}
+	return cf.Seq, relayHost, nil
+}
+
+func runCursorInspect(cctx *cli.Context) error {
+	ctx := context.Background()
+	arg := cctx.Args().First()
+	if arg == "" {
+		return fmt.Errorf("need to provide cursor name or sequence number as argument")
+	}
+
+	seq, relayHost, err := cursorArg(cctx, arg)
+	if err != nil {
+		return err
+	}
+
+	ev, err := probeFirehoseSeq(ctx, relayHost, seq)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Relay: %s\n", relayHost)
+	fmt.Printf("Seq: %d\n", seq)
+	if ev.Seq != seq {
+		fmt.Printf("Nearest Event Seq: %d\n", ev.Seq)
+	}
+	if ev.Outdated {
+		fmt.Println("Note: cursor is older than the relay's retained history")
+	}
+	fmt.Printf("Timestamp (UTC): %s\n", ev.Time.UTC().Format(syntax.AtprotoDatetimeLayout))
+	fmt.Printf("Timestamp (Local): %s\n", ev.Time.Local().Format(time.RFC3339))
+	fmt.Printf("Age: %s\n", time.Since(ev.Time).Truncate(time.Second))
+	return nil
+}
+
+// upper bound on relay round-trips when searching for a sequence number
+const maxCursorProbes = 64
+
+func runCursorRewind(cctx *cli.Context) error {
+	ctx := context.Background()
+	name := cctx.Args().Get(0)
+	if name == "" || cctx.Args().Len() != 2 {
+		return fmt.Errorf("need to provide cursor name and duration as arguments")
+	}
+	dur, err := time.ParseDuration(cctx.Args().Get(1))
+	if err != nil || dur <= 0 {
+		return fmt.Errorf("invalid duration: %s", cctx.Args().Get(1))
+	}
+
+	cf, err := loadCursor(cctx, name)
+	if err != nil {
+		return err
+	}
+	relayHost := cctx.String("relay-host")
+	if cf.RelayHost != "" && !cctx.IsSet("relay-host") {
+		relayHost = cf.RelayHost
+	}
+
+	var target time.Time
+	if cctx.Bool("from-now") {
+		target = time.Now().Add(-dur)
+	} else {
+		ev, err := probeFirehoseSeq(ctx, relayHost, cf.Seq)
+		if err != nil {
+			return err
+		}
+		target = ev.Time.Add(-dur)
+	}
+
+	// binary search for the first event at or after the target time. Event
+	// timestamps are assigned by the relay as it sequences, so they are
+	// monotonic enough for this to land within a few events.
+	lo, hi := int64(1), cf.Seq
+	outdated := false
+	for probes := 0; lo < hi; probes++ {
+		if probes >= maxCursorProbes {
+			return fmt.Errorf("gave up searching for sequence number after %d probes", probes)
+		}
+		mid := lo + (hi-lo)/2
+		ev, err := probeFirehoseSeq(ctx, relayHost, mid)
+		if err != nil {
+			return err
+		}
+		if ev.Outdated {
+			outdated = true
+		}
+		if ev.Time.Before(target) {
+			lo = max(ev.Seq, mid) + 1
+		} else {
+			hi = mid
+		}
+	}
+	if outdated {
+		fmt.Fprintln(os.Stderr, "warning: target is near or beyond the start of the relay's retained history")
+	}
+
+	// the saved cursor is the last event processed, so resume just before
+	// the one we found
+	newSeq := max(lo-1, 0)
+	fmt.Printf("%s: %d -> %d (target %s)\n", name, cf.Seq, newSeq, target.UTC().Format(syntax.AtprotoDatetimeLayout))
+	if cctx.Bool("dry-run") {
+		return nil
+	}
+
+	cf.Seq = newSeq
+	cf.RelayHost = relayHost
+	return persistCursor(cctx, name, cf)
+}
+
+// how often a consuming firehose writes its progress to a named cursor
+const cursorSaveInterval = 5 * time.Second
+
+// cursorSaver periodically persists the most recent sequence number handled
+// by a firehose consumer. A nil saver ignores all calls.
+type cursorSaver struct {
+	cctx      *cli.Context
+	name      string
+	relayHost string
+
+	last  atomic.Int64
+	saved int64
+
+	exit chan struct{}
+	done chan struct{}
+}
+
+func newCursorSaver(cctx *cli.Context, name, relayHost string) *cursorSaver {
+	cs := &cursorSaver{
+		cctx:      cctx,
+		name:      name,
+		relayHost: relayHost,
+		exit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	go func() {
+		defer close(cs.done)
+		t := time.NewTicker(cursorSaveInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-cs.exit:
+				cs.flush()
+				return
+			case <-t.C:
+				cs.flush()
+			}
+		}
+	}()
+
+	return cs
+}
+
+func (cs *cursorSaver) Mark(seq int64) {
+	if cs == nil {
+		return
+	}
+	// events may be handled out of order by the scheduler; only move forward
+	for {
+		cur := cs.last.Load()
+		if seq <= cur || cs.last.CompareAndSwap(cur, seq) {
+			return
+		}
+	}
+}
+
+func (cs *cursorSaver) flush() {
+	seq := cs.last.Load()
+	if seq == 0 || seq == cs.saved {
+		return
+	}
+	if err := persistCursor(cs.cctx, cs.name, &CursorFile{Seq: seq, RelayHost: cs.relayHost}); err != nil {
+		slog.Warn("failed to save cursor", "name", cs.name, "seq", seq, "err", err)
+		return
+	}
+	cs.saved = seq
+}
+
+// Close writes out the final position and stops the background saver
+func (cs *cursorSaver) Close() {
+	if cs == nil {
+		return
+	}
+	close(cs.exit)
+	<-cs.done
+}
+
+type firehoseProbe struct {
+	Seq  int64
+	Time time.Time
+	// relay indicated the requested cursor was older than its retained history
+	Outdated bool
+}
+
+// probeFirehoseSeq subscribes to the relay just before the given sequence
+// number and returns the first event received, which will be seq itself
+// unless that event was not retained.
+func probeFirehoseSeq(ctx context.Context, relayHost string, seq int64) (*firehoseProbe, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	u, err := url.Parse(relayHost)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relayHost URI: %w", err)
+	}
+	u.Path = "xrpc/com.atproto.sync.subscribeRepos"
+	u.RawQuery = fmt.Sprintf("cursor=%d", max(seq-1, 0))
+
+	con, _, err := websocket.DefaultDialer.DialContext(ctx, u.String(), http.Header{
+		"User-Agent": []string{fmt.Sprintf("goat/%s", versioninfo.Short())},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("subscribing to firehose failed (dialing): %w", err)
+	}
+	defer con.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		con.SetReadDeadline(deadline)
+	}
+
+	out := &firehoseProbe{}
+	for {
+		mt, r, err := con.NextReader()
+		if err != nil {
+			return nil, fmt.Errorf("reading from firehose: %w", err)
+		}
+		if mt != websocket.BinaryMessage {
+			return nil, fmt.Errorf("expected binary message from subscription endpoint")
+		}
+
+		var header events.EventHeader
+		if err := header.UnmarshalCBOR(r); err != nil {
+			return nil, fmt.Errorf("reading header: %w", err)
+		}
+
+		if header.Op == events.EvtKindErrorFrame {
+			var errframe events.ErrorFrame
+			if err := errframe.UnmarshalCBOR(r); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("relay returned error: %s: %s", errframe.Error, errframe.Message)
+		}
+
+		var evtSeq int64
+		var evtTime string
+		switch header.MsgType {
+		case "#commit":
+			var evt comatproto.SyncSubscribeRepos_Commit
+			if err := evt.UnmarshalCBOR(r); err != nil {
+				return nil, err
+			}
+			evtSeq, evtTime = evt.Seq, evt.Time
+		case "#identity":
+			var evt comatproto.SyncSubscribeRepos_Identity
+			if err := evt.UnmarshalCBOR(r); err != nil {
+				return nil, err
+			}
+			evtSeq, evtTime = evt.Seq, evt.Time
+		case "#account":
+			var evt comatproto.SyncSubscribeRepos_Account
+			if err := evt.UnmarshalCBOR(r); err != nil {
+				return nil, err
+			}
+			evtSeq, evtTime = evt.Seq, evt.Time
+		case "#handle":
+			var evt comatproto.SyncSubscribeRepos_Handle
+			if err := evt.UnmarshalCBOR(r); err != nil {
+				return nil, err
+			}
+			evtSeq, evtTime = evt.Seq, evt.Time
+		case "#tombstone":
+			var evt comatproto.SyncSubscribeRepos_Tombstone
+			if err := evt.UnmarshalCBOR(r); err != nil {
+				return nil, err
+			}
+			evtSeq, evtTime = evt.Seq, evt.Time
+		case "#migrate":
+			var evt comatproto.SyncSubscribeRepos_Migrate
+			if err := evt.UnmarshalCBOR(r); err != nil {
+				return nil, err
+			}
+			evtSeq, evtTime = evt.Seq, evt.Time
+		case "#info":
+			var evt comatproto.SyncSubscribeRepos_Info
+			if err := evt.UnmarshalCBOR(r); err != nil {
+				return nil, err
+			}
+			if evt.Name == "OutdatedCursor" {
+				out.Outdated = true
+			}
+			continue
+		default:
+			// unknown event types don't carry a seq we know how to read
+			continue
+		}
+
+		t, err := syntax.ParseDatetimeLenient(evtTime)
+		if err != nil {
+			return nil, fmt.Errorf("event %d has invalid timestamp %q: %w", evtSeq, evtTime, err)
+		}
+		out.Seq = evtSeq
+		out.Time = t.Time()
+		return out, nil
+	}
+}
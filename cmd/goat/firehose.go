@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -39,6 +40,11 @@ var cmdFirehose = &cli.Command{
 			Name:  "cursor",
 			Usage: "cursor to consume at",
 		},
+		&cli.StringFlag{
+			Name:  "cursor-name",
+			Usage: "resume from, and periodically save progress to, a named cursor (see 'goat cursor')",
+		},
+		cursorDirFlag,
 		&cli.StringSliceFlag{
 			Name:    "collection",
 			Aliases: []string{"c"},
@@ -81,6 +87,22 @@ func runFirehose(cctx *cli.Context) error {
 	relayHost := cctx.String("relay-host")
 	cursor := cctx.Int("cursor")
 
+	var saver *cursorSaver
+	if name := cctx.String("cursor-name"); name != "" {
+		if !cctx.IsSet("cursor") {
+			cf, err := loadCursor(cctx, name)
+			if err != nil && !errors.Is(err, ErrNoCursor) {
+				return err
+			}
+			if cf != nil {
+				cursor = int(cf.Seq)
+				slog.Info("resuming from saved cursor", "name", name, "seq", cursor)
+			}
+		}
+		saver = newCursorSaver(cctx, name, relayHost)
+		defer saver.Close()
+	}
+
 	dialer := websocket.DefaultDialer
 	u, err := url.Parse(relayHost)
 	if err != nil {
@@ -100,6 +122,7 @@ func runFirehose(cctx *cli.Context) error {
 	rsc := &events.RepoStreamCallbacks{
 		RepoCommit: func(evt *comatproto.SyncSubscribeRepos_Commit) error {
 			slog.Debug("commit event", "did", evt.Repo, "seq", evt.Seq)
+			defer saver.Mark(evt.Seq)
 			if !gfc.AccountsOnly && !gfc.OpsMode {
 				return gfc.handleCommitEvent(ctx, evt)
 			} else if !gfc.AccountsOnly && gfc.OpsMode {
@@ -109,6 +132,7 @@ func runFirehose(cctx *cli.Context) error {
 		},
 		RepoIdentity: func(evt *comatproto.SyncSubscribeRepos_Identity) error {
 			slog.Debug("identity event", "did", evt.Did, "seq", evt.Seq)
+			defer saver.Mark(evt.Seq)
 			if !gfc.OpsMode {
 				return gfc.handleIdentityEvent(ctx, evt)
 			}
@@ -116,6 +140,7 @@ func runFirehose(cctx *cli.Context) error {
 		},
 		RepoAccount: func(evt *comatproto.SyncSubscribeRepos_Account) error {
 			slog.Debug("account event", "did", evt.Did, "seq", evt.Seq)
+			defer saver.Mark(evt.Seq)
 			if !gfc.OpsMode {
 				return gfc.handleAccountEvent(ctx, evt)
 			}
@@ -28,6 +28,7 @@ func run(args []string) error {
 		cmdRecordGet,
 		cmdRecordList,
 		cmdFirehose,
+		cmdCursor,
 		cmdResolve,
 		cmdRepo,
 		cmdBlob,
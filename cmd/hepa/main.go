@@ -149,6 +149,17 @@ func run(args []string) error {
 			Usage:   "secret token for prescreen server",
 			EnvVars: []string{"HEPA_PRESCREEN_TOKEN"},
 		},
+		&cli.StringFlag{
+			Name:    "graph-host",
+			Usage:   "base URL of follow-graph service, for graph-based rule signals",
+			EnvVars: []string{"HEPA_GRAPH_HOST"},
+		},
+		&cli.IntFlag{
+			Name:    "graph-query-budget",
+			Usage:   "maximum graph service queries per event (not counting cache hits)",
+			EnvVars: []string{"HEPA_GRAPH_QUERY_BUDGET"},
+			Value:   10,
+		},
 	}
 
 	app.Commands = []*cli.Command{
@@ -255,6 +266,8 @@ var runCmd = &cli.Command{
 				FirehoseParallelism: cctx.Int("firehose-parallelism"), // DEPRECATED
 				PreScreenHost:       cctx.String("prescreen-host"),
 				PreScreenToken:      cctx.String("prescreen-token"),
+				GraphHost:           cctx.String("graph-host"),
+				GraphQueryBudget:    cctx.Int("graph-query-budget"),
 			},
 		)
 		if err != nil {
@@ -350,6 +363,8 @@ func configEphemeralServer(cctx *cli.Context) (*Server, error) {
 			FirehoseParallelism: cctx.Int("firehose-parallelism"),
 			PreScreenHost:       cctx.String("prescreen-host"),
 			PreScreenToken:      cctx.String("prescreen-token"),
+			GraphHost:           cctx.String("graph-host"),
+			GraphQueryBudget:    cctx.Int("graph-query-budget"),
 		},
 	)
 }
@@ -15,6 +15,7 @@ import (
 	"github.com/bluesky-social/indigo/automod/cachestore"
 	"github.com/bluesky-social/indigo/automod/countstore"
 	"github.com/bluesky-social/indigo/automod/flagstore"
+	"github.com/bluesky-social/indigo/automod/graphstore"
 	"github.com/bluesky-social/indigo/automod/rules"
 	"github.com/bluesky-social/indigo/automod/setstore"
 	"github.com/bluesky-social/indigo/automod/visual"
@@ -54,6 +55,8 @@ type Config struct {
 	FirehoseParallelism int // DEPRECATED
 	PreScreenHost       string
 	PreScreenToken      string
+	GraphHost           string
+	GraphQueryBudget    int
 }
 
 func NewServer(dir identity.Directory, config Config) (*Server, error) {
@@ -206,6 +209,13 @@ func NewServer(dir identity.Directory, config Config) (*Server, error) {
 		bskyClient.Headers["x-ratelimit-bypass"] = config.RatelimitBypass
 	}
 	blobClient := util.RobustHTTPClient()
+
+	var graph graphstore.GraphStore
+	if config.GraphHost != "" {
+		logger.Info("configuring follow-graph service", "graphHost", config.GraphHost)
+		graph = graphstore.NewHTTPGraphStore(config.GraphHost)
+	}
+
 	engine := automod.Engine{
 		Logger:      logger,
 		Directory:   dir,
@@ -219,6 +229,10 @@ func NewServer(dir identity.Directory, config Config) (*Server, error) {
 		OzoneClient: ozoneClient,
 		AdminClient: adminClient,
 		BlobClient:  blobClient,
+		Graph:       graph,
+		Config: automod.EngineConfig{
+			GraphQueryBudget: config.GraphQueryBudget,
+		},
 	}
 
 	s := &Server{
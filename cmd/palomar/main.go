@@ -28,6 +28,7 @@ import (
 	"github.com/carlmjohnson/versioninfo"
 	es "github.com/opensearch-project/opensearch-go/v2"
 	cli "github.com/urfave/cli/v2"
+	"gorm.io/gorm"
 )
 
 func main() {
@@ -116,6 +117,7 @@ func run(args []string) error {
 		elasticCheckCmd,
 		searchPostCmd,
 		searchProfileCmd,
+		snapshotCmd,
 	}
 
 	return app.Run(args)
@@ -464,6 +466,143 @@ var searchProfileCmd = &cli.Command{
 	},
 }
 
+var snapshotCmd = &cli.Command{
+	Name:  "snapshot",
+	Usage: "backup and restore search indices using ES/OS snapshots",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "repository",
+			Usage:    "name of the (already registered) snapshot repository",
+			EnvVars:  []string{"PALOMAR_SNAPSHOT_REPOSITORY"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:    "database-url",
+			Value:   "sqlite://data/palomar/search.db",
+			EnvVars: []string{"DATABASE_URL"},
+		},
+	},
+	Subcommands: []*cli.Command{
+		snapshotCreateCmd,
+		snapshotStatusCmd,
+		snapshotRestoreCmd,
+	},
+}
+
+var snapshotCreateCmd = &cli.Command{
+	Name:      "create",
+	Usage:     "snapshot the post and profile indices, along with the current firehose cursor",
+	ArgsUsage: "<snapshot-name>",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "wait",
+			Usage: "wait for the snapshot to complete, and verify it",
+			Value: true,
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ctx := context.Background()
+		name := cctx.Args().First()
+		if name == "" {
+			name = "palomar-" + time.Now().UTC().Format("20060102-150405")
+		}
+
+		escli, err := createEsClient(cctx)
+		if err != nil {
+			return err
+		}
+		db, err := cliutil.SetupDatabase(cctx.String("database-url"), cctx.Int("max-metadb-connections"))
+		if err != nil {
+			return fmt.Errorf("failed to set up database: %w", err)
+		}
+
+		indices := []string{cctx.String("es-post-index"), cctx.String("es-profile-index")}
+		if err := search.CreateSnapshot(ctx, escli, db, cctx.String("repository"), name, indices); err != nil {
+			return fmt.Errorf("failed to create snapshot: %w", err)
+		}
+		slog.Info("snapshot started", "snapshot", name)
+
+		if !cctx.Bool("wait") {
+			return nil
+		}
+		info, err := search.WaitForSnapshot(ctx, escli, cctx.String("repository"), name, 10*time.Second)
+		if err != nil {
+			return err
+		}
+		slog.Info("snapshot complete", "snapshot", info.Name, "indices", info.Indices, "cursor", info.Cursor)
+		return nil
+	},
+}
+
+var snapshotStatusCmd = &cli.Command{
+	Name:      "status",
+	Usage:     "show the state of a snapshot and the firehose cursor stored with it",
+	ArgsUsage: "<snapshot-name>",
+	Action: func(cctx *cli.Context) error {
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("expected a single snapshot name")
+		}
+		escli, err := createEsClient(cctx)
+		if err != nil {
+			return err
+		}
+		info, err := search.GetSnapshot(context.Background(), escli, cctx.String("repository"), cctx.Args().First())
+		if err != nil {
+			return err
+		}
+		b, _ := json.MarshalIndent(info, "", "  ")
+		fmt.Println(string(b))
+		return nil
+	},
+}
+
+var snapshotRestoreCmd = &cli.Command{
+	Name:      "restore",
+	Usage:     "restore a snapshot under new index names, point the configured index names at them as aliases, and reset the firehose cursor",
+	ArgsUsage: "<snapshot-name>",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "suffix",
+			Usage: "appended to the snapshotted index names to name the restored indices (defaults to -<snapshot-name>)",
+		},
+		&cli.BoolFlag{
+			Name:  "skip-cursor",
+			Usage: "don't overwrite the firehose cursor in the database",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("expected a single snapshot name")
+		}
+		name := cctx.Args().First()
+		suffix := cctx.String("suffix")
+		if suffix == "" {
+			suffix = "-" + name
+		}
+
+		escli, err := createEsClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		var db *gorm.DB
+		if !cctx.Bool("skip-cursor") {
+			db, err = cliutil.SetupDatabase(cctx.String("database-url"), cctx.Int("max-metadb-connections"))
+			if err != nil {
+				return fmt.Errorf("failed to set up database: %w", err)
+			}
+			db.AutoMigrate(&search.LastSeq{})
+		}
+
+		info, err := search.RestoreSnapshot(context.Background(), escli, db, cctx.String("repository"), name, suffix)
+		if err != nil {
+			return fmt.Errorf("failed to restore snapshot: %w", err)
+		}
+		slog.Info("snapshot restored", "snapshot", info.Name, "aliases", info.IndexNames, "suffix", suffix, "cursor", info.Cursor)
+		return nil
+	},
+}
+
 func createEsClient(cctx *cli.Context) (*es.Client, error) {
 
 	addrs := []string{}
@@ -22,11 +22,9 @@ import (
 	comatproto "github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/api/bsky"
 	"github.com/bluesky-social/indigo/carstore"
-	"github.com/bluesky-social/indigo/did"
 	"github.com/bluesky-social/indigo/events"
 	"github.com/bluesky-social/indigo/indexer"
 	"github.com/bluesky-social/indigo/models"
-	"github.com/bluesky-social/indigo/plc"
 	petname "github.com/dustinkirkland/golang-petname"
 	"github.com/icrowley/fake"
 	"github.com/labstack/echo-contrib/pprof"
@@ -570,15 +568,13 @@ func initSpeedyRepoMan(key *godid.PrivKey) (*repomgr.RepoManager, *godid.PrivKey
 		return nil, nil, err
 	}
 
-	mr := did.NewMultiResolver()
-	mr.AddHandler("web", &did.WebResolver{
-		Insecure: true,
+	kmgr := indexer.NewResolver(&indexer.ResolverOptions{
+		InsecureWeb: true,
+		CacheSize:   1000,
+		CacheTTL:    time.Minute * 5,
+		SigningKey:  key,
 	})
 
-	cachedidr := plc.NewCachingDidResolver(mr, time.Minute*5, 1000)
-
-	kmgr := indexer.NewKeyManager(cachedidr, key)
-
 	repoman := repomgr.NewRepoManager(cs, kmgr)
 
 	return repoman, key, nil
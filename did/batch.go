@@ -0,0 +1,74 @@
+package did
+
+import (
+	"context"
+	"sync"
+)
+
+// DIDResult is what resolving one of a batch of DIDs found
+type DIDResult struct {
+	Doc *Document
+	Err error
+}
+
+// BatchResolver is a Resolver that can resolve many DIDs at once, for callers
+// with a lot of DIDs to look up together
+type BatchResolver interface {
+	Resolver
+	// ResolveDIDs resolves each of dids, which may repeat. The result has an
+	// entry for each distinct DID.
+	ResolveDIDs(ctx context.Context, dids []string) map[string]DIDResult
+}
+
+// how many DIDs are looked up at once from resolvers that can't batch
+const resolveConcurrency = 16
+
+// ResolveDIDs resolves dids with res: with one call if it's a BatchResolver,
+// and otherwise a few at a time.
+func ResolveDIDs(ctx context.Context, res Resolver, dids []string) map[string]DIDResult {
+	if br, ok := res.(BatchResolver); ok {
+		return br.ResolveDIDs(ctx, dids)
+	}
+	return ResolveEach(ctx, res, dids)
+}
+
+// ResolveEach resolves dids with res's GetDocument, a few at a time. It's for
+// BatchResolvers to fall back on for DIDs they can't batch.
+func ResolveEach(ctx context.Context, res Resolver, dids []string) map[string]DIDResult {
+	uniq := Dedupe(dids)
+	out := make(map[string]DIDResult, len(uniq))
+
+	var lk sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, resolveConcurrency)
+	for _, d := range uniq {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(d string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			doc, err := res.GetDocument(ctx, d)
+			lk.Lock()
+			out[d] = DIDResult{Doc: doc, Err: err}
+			lk.Unlock()
+		}(d)
+	}
+	wg.Wait()
+	return out
+}
+
+// Dedupe returns dids without repeats, in the order they first appear
+func Dedupe(dids []string) []string {
+	seen := make(map[string]bool, len(dids))
+	out := make([]string, 0, len(dids))
+	for _, d := range dids {
+		if !seen[d] {
+			seen[d] = true
+			out = append(out, d)
+		}
+	}
+	return out
+}
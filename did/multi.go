@@ -3,6 +3,7 @@ package did
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	"github.com/whyrusleeping/go-did"
 )
@@ -59,3 +60,43 @@ func (mr *MultiResolver) GetDocument(ctx context.Context, didstr string) (*did.D
 
 	return res.GetDocument(ctx, didstr)
 }
+
+// ResolveDIDs resolves dids with the handler for each one's method, passing
+// each handler all of its DIDs at once
+func (mr *MultiResolver) ResolveDIDs(ctx context.Context, dids []string) map[string]DIDResult {
+	out := make(map[string]DIDResult, len(dids))
+	byMethod := make(map[string][]string)
+	for _, d := range Dedupe(dids) {
+		pdid, err := did.ParseDID(d)
+		if err != nil {
+			out[d] = DIDResult{Err: err}
+			continue
+		}
+		method := pdid.Protocol()
+		if _, ok := mr.handlers[method]; !ok {
+			out[d] = DIDResult{Err: fmt.Errorf("unknown did method: %q", method)}
+			continue
+		}
+		byMethod[method] = append(byMethod[method], d)
+	}
+
+	// methods are resolved side by side, so slow did:web hosts don't hold up
+	// did:plc lookups
+	var lk sync.Mutex
+	var wg sync.WaitGroup
+	for method, group := range byMethod {
+		mrResolvedDidsTotal.WithLabelValues(method).Add(float64(len(group)))
+		wg.Add(1)
+		go func(res Resolver, group []string) {
+			defer wg.Done()
+			found := ResolveDIDs(ctx, res, group)
+			lk.Lock()
+			defer lk.Unlock()
+			for d, r := range found {
+				out[d] = r
+			}
+		}(mr.handlers[method], group)
+	}
+	wg.Wait()
+	return out
+}
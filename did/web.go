@@ -14,6 +14,8 @@ import (
 
 type WebResolver struct {
 	Insecure bool
+	// Client to fetch documents with; http.DefaultClient if nil
+	Client *http.Client
 	// TODO: cache? maybe at a different layer
 }
 
@@ -36,7 +38,12 @@ func (wr *WebResolver) GetDocument(ctx context.Context, didstr string) (*Documen
 		proto = "http"
 	}
 
-	resp, err := http.Get(proto + "://" + val + "/.well-known/did.json")
+	client := wr.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Get(proto + "://" + val + "/.well-known/did.json")
 	if err != nil {
 		return nil, err
 	}
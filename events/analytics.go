@@ -0,0 +1,323 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/data"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	"github.com/parquet-go/parquet-go"
+)
+
+// AnalyticsOp is one row of the analytics export: a single record operation
+// from a commit
+type AnalyticsOp struct {
+	Seq int64 `parquet:"seq"`
+	// When the relay broadcast the commit
+	Received time.Time `parquet:"received,timestamp(millisecond)"`
+	// The commit's own timestamp, as reported by the PDS
+	CommitTime string `parquet:"commit_time"`
+	Repo       string `parquet:"repo,dict"`
+	Rev        string `parquet:"rev"`
+	Action     string `parquet:"action,dict"`
+	Collection string `parquet:"collection,dict"`
+	Rkey       string `parquet:"rkey"`
+	// Unset for deletes
+	Cid string `parquet:"cid,optional"`
+	// The record as JSON, for creates and updates when records are included
+	Record string `parquet:"record,optional"`
+}
+
+type AnalyticsSinkOptions struct {
+	// Rows buffered for a partition before it is written out as a file
+	MaxRowsPerFile int
+	// How often buffered rows are written out regardless of how many there are
+	FlushInterval time.Duration
+	// Events waiting to be decoded; events that arrive while it is full are
+	// dropped rather than holding up the firehose
+	QueueSize int
+	// Include created and updated records as JSON. Makes files considerably
+	// larger.
+	IncludeRecords bool
+}
+
+func DefaultAnalyticsSinkOptions() *AnalyticsSinkOptions {
+	return &AnalyticsSinkOptions{
+		MaxRowsPerFile: 100_000,
+		FlushInterval:  5 * time.Minute,
+		QueueSize:      10_000,
+	}
+}
+
+// AnalyticsSink batches the record operations from broadcast commits into
+// Parquet files, partitioned by the hour they were broadcast and by
+// collection, with hive-style keys:
+//
+//	date=2024-05-01/hour=13/collection=app.bsky.feed.post/<first seq>-<last seq>.parquet
+//
+// so that query engines like DuckDB, Athena or Spark can prune partitions.
+// Commits marked tooBig carry no ops and are skipped. The export is best
+// effort: events are dropped if decoding falls behind, and rows are dropped
+// if a file can't be written.
+type AnalyticsSink struct {
+	store AnalyticsStore
+	opts  AnalyticsSinkOptions
+
+	events chan *XRPCStreamEvent
+
+	// only touched by the run loop
+	parts map[analyticsPartition][]AnalyticsOp
+
+	exit chan struct{}
+	wg   sync.WaitGroup
+}
+
+type analyticsPartition struct {
+	Hour       time.Time
+	Collection string
+}
+
+func (p analyticsPartition) key(first, last int64) string {
+	return fmt.Sprintf("date=%s/hour=%02d/collection=%s/%d-%d.parquet",
+		p.Hour.Format("2006-01-02"), p.Hour.Hour(), p.Collection, first, last)
+}
+
+func NewAnalyticsSink(store AnalyticsStore, opts *AnalyticsSinkOptions) *AnalyticsSink {
+	if opts == nil {
+		opts = DefaultAnalyticsSinkOptions()
+	}
+
+	return &AnalyticsSink{
+		store:  store,
+		opts:   *opts,
+		events: make(chan *XRPCStreamEvent, opts.QueueSize),
+		parts:  make(map[analyticsPartition][]AnalyticsOp),
+		exit:   make(chan struct{}),
+	}
+}
+
+// Start starts decoding queued events and writing files
+func (as *AnalyticsSink) Start() {
+	as.wg.Add(1)
+	go as.run()
+}
+
+// Enqueue queues a broadcast event for export, without blocking
+func (as *AnalyticsSink) Enqueue(evt *XRPCStreamEvent) {
+	if evt.RepoCommit == nil {
+		return
+	}
+
+	select {
+	case as.events <- evt:
+	default:
+		analyticsDropped.WithLabelValues("queue_full").Inc()
+	}
+}
+
+// Shutdown stops accepting events, and writes out everything queued or
+// buffered
+func (as *AnalyticsSink) Shutdown(ctx context.Context) error {
+	close(as.exit)
+
+	done := make(chan struct{})
+	go func() {
+		as.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("analytics sink did not finish writing: %w", ctx.Err())
+	}
+}
+
+func (as *AnalyticsSink) run() {
+	defer as.wg.Done()
+
+	ctx := context.Background()
+
+	t := time.NewTicker(as.opts.FlushInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case evt := <-as.events:
+			as.add(ctx, evt)
+		case <-t.C:
+			as.flushAll(ctx)
+		case <-as.exit:
+			for {
+				select {
+				case evt := <-as.events:
+					as.add(ctx, evt)
+				default:
+					as.flushAll(ctx)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (as *AnalyticsSink) add(ctx context.Context, evt *XRPCStreamEvent) {
+	rows, err := as.decode(evt)
+	if err != nil {
+		log.Warnw("failed to decode commit for analytics", "seq", evt.RepoCommit.Seq, "repo", evt.RepoCommit.Repo, "err", err)
+		analyticsDropped.WithLabelValues("decode").Inc()
+		return
+	}
+
+	hour := time.Now().UTC().Truncate(time.Hour)
+	for _, row := range rows {
+		p := analyticsPartition{Hour: hour, Collection: row.Collection}
+		as.parts[p] = append(as.parts[p], row)
+		if len(as.parts[p]) >= as.opts.MaxRowsPerFile {
+			as.flush(ctx, p)
+		}
+	}
+}
+
+// decode turns a commit into one row per op
+func (as *AnalyticsSink) decode(evt *XRPCStreamEvent) ([]AnalyticsOp, error) {
+	commit := evt.RepoCommit
+
+	var blocks map[cid.Cid][]byte
+	if as.opts.IncludeRecords && len(commit.Blocks) > 0 {
+		var err error
+		blocks, err = readCarBlocks(commit.Blocks)
+		if err != nil {
+			return nil, fmt.Errorf("reading blocks: %w", err)
+		}
+	}
+
+	now := time.Now()
+	rows := make([]AnalyticsOp, 0, len(commit.Ops))
+	for _, op := range commit.Ops {
+		collection, rkey, ok := strings.Cut(op.Path, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid op path %q", op.Path)
+		}
+
+		row := AnalyticsOp{
+			Seq:        commit.Seq,
+			Received:   now,
+			CommitTime: commit.Time,
+			Repo:       commit.Repo,
+			Rev:        commit.Rev,
+			Action:     op.Action,
+			Collection: collection,
+			Rkey:       rkey,
+		}
+
+		if op.Cid != nil {
+			c := cid.Cid(*op.Cid)
+			row.Cid = c.String()
+
+			if blk, ok := blocks[c]; ok {
+				rec, err := recordJSON(blk)
+				if err != nil {
+					return nil, fmt.Errorf("decoding record %s: %w", op.Path, err)
+				}
+				row.Record = rec
+			}
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+func readCarBlocks(b []byte) (map[cid.Cid][]byte, error) {
+	cr, err := car.NewCarReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make(map[cid.Cid][]byte)
+	for {
+		blk, err := cr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return blocks, nil
+			}
+			return nil, err
+		}
+		blocks[blk.Cid()] = blk.RawData()
+	}
+}
+
+func recordJSON(blk []byte) (string, error) {
+	rec, err := data.UnmarshalCBOR(blk)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (as *AnalyticsSink) flushAll(ctx context.Context) {
+	parts := make([]analyticsPartition, 0, len(as.parts))
+	for p := range as.parts {
+		parts = append(parts, p)
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		if !parts[i].Hour.Equal(parts[j].Hour) {
+			return parts[i].Hour.Before(parts[j].Hour)
+		}
+		return parts[i].Collection < parts[j].Collection
+	})
+
+	for _, p := range parts {
+		as.flush(ctx, p)
+	}
+}
+
+// flush writes out a partition's buffered rows as one file. Rows that can't
+// be written are dropped.
+func (as *AnalyticsSink) flush(ctx context.Context, p analyticsPartition) {
+	rows := as.parts[p]
+	delete(as.parts, p)
+	if len(rows) == 0 {
+		return
+	}
+
+	key := p.key(rows[0].Seq, rows[len(rows)-1].Seq)
+	if err := as.write(ctx, key, rows); err != nil {
+		log.Errorw("failed to write analytics file", "key", key, "rows", len(rows), "err", err)
+		analyticsDropped.WithLabelValues("write").Add(float64(len(rows)))
+		return
+	}
+
+	analyticsRows.Add(float64(len(rows)))
+	analyticsFiles.Inc()
+}
+
+func (as *AnalyticsSink) write(ctx context.Context, key string, rows []AnalyticsOp) error {
+	buf := new(bytes.Buffer)
+	w := parquet.NewGenericWriter[AnalyticsOp](buf, parquet.Compression(&parquet.Zstd))
+	if _, err := w.Write(rows); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return as.store.Put(ctx, key, buf.Bytes())
+}
@@ -0,0 +1,96 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// AnalyticsStore is where the analytics sink writes its files
+type AnalyticsStore interface {
+	// Put writes a complete file under a slash-separated key
+	Put(ctx context.Context, key string, data []byte) error
+}
+
+// LocalAnalyticsStore writes files under a directory on local disk
+type LocalAnalyticsStore struct {
+	dir string
+}
+
+func NewLocalAnalyticsStore(dir string) (*LocalAnalyticsStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalAnalyticsStore{dir: dir}, nil
+}
+
+func (ls *LocalAnalyticsStore) Put(ctx context.Context, key string, data []byte) error {
+	fname := filepath.Join(ls.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		return err
+	}
+
+	// write to a temporary name first, so readers never see a partial file
+	tmp := fname + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fname)
+}
+
+// S3AnalyticsStore writes files to an S3 (or S3 compatible) bucket.
+// Credentials are taken from the standard AWS environment variables, or the
+// instance's IAM role.
+type S3AnalyticsStore struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+type S3AnalyticsStoreOptions struct {
+	// Host (and port) of the S3 API, eg s3.us-east-1.amazonaws.com
+	Endpoint string
+	Bucket   string
+	// Prepended to every key
+	Prefix string
+	Region string
+	// Connect over plain HTTP, for local testing
+	Insecure bool
+}
+
+func NewS3AnalyticsStore(opts *S3AnalyticsStoreOptions) (*S3AnalyticsStore, error) {
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("s3 analytics store requires a bucket")
+	}
+
+	client, err := minio.New(opts.Endpoint, &minio.Options{
+		Creds: credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.IAM{},
+		}),
+		Secure: !opts.Insecure,
+		Region: opts.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("setting up s3 client: %w", err)
+	}
+
+	return &S3AnalyticsStore{
+		client: client,
+		bucket: opts.Bucket,
+		prefix: opts.Prefix,
+	}, nil
+}
+
+func (ss *S3AnalyticsStore) Put(ctx context.Context, key string, data []byte) error {
+	_, err := ss.client.PutObject(ctx, ss.bucket, path.Join(ss.prefix, key), bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType: "application/vnd.apache.parquet",
+	})
+	return err
+}
@@ -0,0 +1,148 @@
+package events_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/carstore"
+	"github.com/bluesky-social/indigo/events"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/ipld/go-car"
+	"github.com/multiformats/go-multihash"
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestAnalyticsSink(t *testing.T) {
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	store, err := events.NewLocalAnalyticsStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := events.DefaultAnalyticsSinkOptions()
+	opts.IncludeRecords = true
+	sink := events.NewAnalyticsSink(store, opts)
+	sink.Start()
+
+	evtman := events.NewEventManager(events.NewMemPersister())
+	evtman.AddSink(sink)
+
+	post := &bsky.FeedPost{
+		LexiconTypeID: "app.bsky.feed.post",
+		Text:          "hello world",
+		CreatedAt:     "2024-05-01T00:00:00Z",
+	}
+	recBuf := new(bytes.Buffer)
+	if err := post.MarshalCBOR(recBuf); err != nil {
+		t.Fatal(err)
+	}
+	recCid, err := cid.NewPrefixV1(cid.DagCBOR, multihash.SHA2_256).Sum(recBuf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	carBuf := new(bytes.Buffer)
+	hb, err := cbor.DumpObject(&car.CarHeader{Roots: []cid.Cid{recCid}, Version: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := carstore.LdWrite(carBuf, hb); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := carstore.LdWrite(carBuf, recCid.Bytes(), recBuf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	link := lexutil.LexLink(recCid)
+	for i := 0; i < 3; i++ {
+		if err := evtman.AddEvent(ctx, &events.XRPCStreamEvent{
+			RepoCommit: &atproto.SyncSubscribeRepos_Commit{
+				Repo:   "did:example:123",
+				Rev:    "rev",
+				Commit: link,
+				Blocks: carBuf.Bytes(),
+				Ops: []*atproto.SyncSubscribeRepos_RepoOp{
+					{Action: "create", Path: "app.bsky.feed.post/abc", Cid: &link},
+					{Action: "delete", Path: "app.bsky.feed.like/def"},
+				},
+				Time: time.Now().Format(time.RFC3339),
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := evtman.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var files []string
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+
+	if len(files) != 2 {
+		t.Fatalf("expected a file for each collection, got %v", files)
+	}
+
+	rowsByCollection := make(map[string][]events.AnalyticsOp)
+	for _, f := range files {
+		rel, _ := filepath.Rel(dir, f)
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) != 4 || !strings.HasPrefix(parts[0], "date=") || !strings.HasPrefix(parts[1], "hour=") || !strings.HasPrefix(parts[2], "collection=") {
+			t.Fatalf("unexpected file layout: %s", rel)
+		}
+		if parts[3] != "1-3.parquet" {
+			t.Fatalf("expected file to be named for its seq range, got %s", parts[3])
+		}
+
+		rows, err := parquet.ReadFile[events.AnalyticsOp](f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rowsByCollection[strings.TrimPrefix(parts[2], "collection=")] = rows
+	}
+
+	posts := rowsByCollection["app.bsky.feed.post"]
+	if len(posts) != 3 {
+		t.Fatalf("expected 3 post rows, got %d", len(posts))
+	}
+	for i, row := range posts {
+		if row.Seq != int64(i+1) || row.Action != "create" || row.Rkey != "abc" || row.Repo != "did:example:123" {
+			t.Fatalf("unexpected row: %+v", row)
+		}
+		if row.Cid != recCid.String() {
+			t.Fatalf("expected cid %s, got %s", recCid, row.Cid)
+		}
+		if !strings.Contains(row.Record, `"text":"hello world"`) {
+			t.Fatalf("expected record json, got %q", row.Record)
+		}
+	}
+
+	likes := rowsByCollection["app.bsky.feed.like"]
+	if len(likes) != 3 {
+		t.Fatalf("expected 3 like rows, got %d", len(likes))
+	}
+	if likes[0].Action != "delete" || likes[0].Cid != "" || likes[0].Record != "" {
+		t.Fatalf("unexpected delete row: %+v", likes[0])
+	}
+}
@@ -25,8 +25,13 @@ func (t *EventHeader) MarshalCBOR(w io.Writer) error {
 	}
 
 	cw := cbg.NewCborWriter(w)
+	fieldCount := 3
 
-	if _, err := cw.Write([]byte{162}); err != nil {
+	if t.Chain == nil {
+		fieldCount--
+	}
+
+	if _, err := cw.Write(cbg.CborEncodeMajorType(cbg.MajMap, uint64(fieldCount))); err != nil {
 		return err
 	}
 
@@ -75,6 +80,33 @@ func (t *EventHeader) MarshalCBOR(w io.Writer) error {
 		}
 	}
 
+	// t.Chain ([]uint8) (slice)
+	if t.Chain != nil {
+
+		if len("chain") > 1000000 {
+			return xerrors.Errorf("Value in field \"chain\" was too long")
+		}
+
+		if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("chain"))); err != nil {
+			return err
+		}
+		if _, err := cw.WriteString(string("chain")); err != nil {
+			return err
+		}
+
+		if len(t.Chain) > 2097152 {
+			return xerrors.Errorf("Byte array in field t.Chain was too long")
+		}
+
+		if err := cw.WriteMajorTypeHeader(cbg.MajByteString, uint64(len(t.Chain))); err != nil {
+			return err
+		}
+
+		if _, err := cw.Write(t.Chain); err != nil {
+			return err
+		}
+
+	}
 	return nil
 }
 
@@ -153,6 +185,28 @@ func (t *EventHeader) UnmarshalCBOR(r io.Reader) (err error) {
 
 				t.Op = int64(extraI)
 			}
+			// t.Chain ([]uint8) (slice)
+		case "chain":
+
+			maj, extra, err = cr.ReadHeader()
+			if err != nil {
+				return err
+			}
+
+			if extra > 2097152 {
+				return fmt.Errorf("t.Chain: byte array too large (%d)", extra)
+			}
+			if maj != cbg.MajByteString {
+				return fmt.Errorf("expected byte array")
+			}
+
+			if extra > 0 {
+				t.Chain = make([]uint8, extra)
+			}
+
+			if _, err := io.ReadFull(cr, t.Chain); err != nil {
+				return err
+			}
 
 		default:
 			// Field doesn't exist on this type, so ignore it
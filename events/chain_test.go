@@ -0,0 +1,82 @@
+package events_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+)
+
+func chainedFrames(t *testing.T, n int) [][]byte {
+	fw := events.NewFrameWriter(events.StreamVersion2)
+	var frames [][]byte
+	for i := 1; i <= n; i++ {
+		evt := &events.XRPCStreamEvent{RepoIdentity: &comatproto.SyncSubscribeRepos_Identity{
+			Did:  "did:plc:abc",
+			Seq:  int64(i),
+			Time: "2024-01-01T00:00:00Z",
+		}}
+		// alternate between preserialized and not, which must chain the same
+		if i%2 == 0 {
+			if err := evt.Preserialize(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var buf bytes.Buffer
+		if err := fw.WriteFrame(&buf, evt); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, buf.Bytes())
+	}
+	return frames
+}
+
+func TestChainVerifier(t *testing.T) {
+	frames := chainedFrames(t, 5)
+
+	v := events.NewChainVerifier()
+	for i, frame := range frames {
+		if err := v.Verify(frame); err != nil {
+			t.Fatalf("frame %d: %s", i, err)
+		}
+	}
+	if v.Frames() != 5 || len(v.Chain()) != 32 {
+		t.Fatalf("unexpected verifier state: %d frames, chain %x", v.Frames(), v.Chain())
+	}
+
+	// frames still decode as v1 frames, with the chain in the header
+	var header events.EventHeader
+	if err := header.UnmarshalCBOR(bytes.NewReader(frames[0])); err != nil {
+		t.Fatal(err)
+	}
+	if header.MsgType != "#identity" || len(header.Chain) != 32 {
+		t.Fatalf("unexpected header: %+v", header)
+	}
+
+	// a dropped frame
+	v = events.NewChainVerifier()
+	if err := v.Verify(frames[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Verify(frames[2]); !errors.Is(err, events.ErrChainBroken) {
+		t.Fatalf("expected a broken chain for a dropped frame, got %v", err)
+	}
+
+	// a modified frame
+	tampered := bytes.Clone(frames[0])
+	tampered[len(tampered)-3] ^= 1
+	if err := events.NewChainVerifier().Verify(tampered); !errors.Is(err, events.ErrChainBroken) {
+		t.Fatalf("expected a broken chain for a modified frame, got %v", err)
+	}
+
+	// a v1 frame
+	var v1 bytes.Buffer
+	if err := (&events.XRPCStreamEvent{Error: &events.ErrorFrame{Error: "x"}}).WriteFrame(&v1, events.StreamVersion1); err != nil {
+		t.Fatal(err)
+	}
+	if err := events.NewChainVerifier().Verify(v1.Bytes()); !errors.Is(err, events.ErrChainBroken) {
+		t.Fatalf("expected a frame without a chain to fail, got %v", err)
+	}
+}
@@ -1,10 +1,15 @@
 package events
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/RussellLuo/slidingwindow"
@@ -19,6 +24,7 @@ type RepoStreamCallbacks struct {
 	RepoHandle    func(evt *comatproto.SyncSubscribeRepos_Handle) error
 	RepoIdentity  func(evt *comatproto.SyncSubscribeRepos_Identity) error
 	RepoAccount   func(evt *comatproto.SyncSubscribeRepos_Account) error
+	RepoSync      func(evt *comatproto.SyncSubscribeRepos_Sync) error
 	RepoInfo      func(evt *comatproto.SyncSubscribeRepos_Info) error
 	RepoMigrate   func(evt *comatproto.SyncSubscribeRepos_Migrate) error
 	RepoTombstone func(evt *comatproto.SyncSubscribeRepos_Tombstone) error
@@ -41,6 +47,8 @@ func (rsc *RepoStreamCallbacks) EventHandler(ctx context.Context, xev *XRPCStrea
 		return rsc.RepoIdentity(xev.RepoIdentity)
 	case xev.RepoAccount != nil && rsc.RepoAccount != nil:
 		return rsc.RepoAccount(xev.RepoAccount)
+	case xev.RepoSync != nil && rsc.RepoSync != nil:
+		return rsc.RepoSync(xev.RepoSync)
 	case xev.RepoTombstone != nil && rsc.RepoTombstone != nil:
 		return rsc.RepoTombstone(xev.RepoTombstone)
 	case xev.LabelLabels != nil && rsc.LabelLabels != nil:
@@ -100,15 +108,48 @@ type instrumentedReader struct {
 	r            io.Reader
 	addr         string
 	bytesCounter prometheus.Counter
+	bytesRead    *atomic.Int64
 }
 
 func (sr *instrumentedReader) Read(p []byte) (int, error) {
 	n, err := sr.r.Read(p)
 	sr.bytesCounter.Add(float64(n))
+	if sr.bytesRead != nil {
+		sr.bytesRead.Add(int64(n))
+	}
 	return n, err
 }
 
 func HandleRepoStream(ctx context.Context, con *websocket.Conn, sched Scheduler) error {
+	return HandleRepoStreamWithOptions(ctx, con, sched, nil)
+}
+
+// HandleVerifiedRepoStream is HandleRepoStream for a StreamVersion2 stream,
+// checking each frame's integrity chain with v before handling it. It returns
+// an error wrapping ErrChainBroken at the first frame that fails.
+func HandleVerifiedRepoStream(ctx context.Context, con *websocket.Conn, sched Scheduler, v *ChainVerifier) error {
+	return HandleRepoStreamWithOptions(ctx, con, sched, &RepoStreamOptions{Verifier: v})
+}
+
+type RepoStreamOptions struct {
+	// If set, each frame's integrity chain is checked as in
+	// HandleVerifiedRepoStream
+	Verifier *ChainVerifier
+	// Called with the round trip time of each ping the consumer sends
+	OnPong func(rtt time.Duration)
+	// If set, incremented by the size of each frame received
+	BytesRead *atomic.Int64
+}
+
+// HandleRepoStreamWithOptions is HandleRepoStream, with options for
+// verifying and monitoring the stream; nil opts is the same as
+// HandleRepoStream
+func HandleRepoStreamWithOptions(ctx context.Context, con *websocket.Conn, sched Scheduler, opts *RepoStreamOptions) error {
+	if opts == nil {
+		opts = &RepoStreamOptions{}
+	}
+	v := opts.Verifier
+
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	defer sched.Shutdown()
@@ -123,7 +164,10 @@ func HandleRepoStream(ctx context.Context, con *websocket.Conn, sched Scheduler)
 
 			select {
 			case <-t.C:
-				if err := con.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(time.Second*10)); err != nil {
+				// the server echoes the payload back in its pong, which is
+				// how the round trip is timed
+				payload := binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+				if err := con.WriteControl(websocket.PingMessage, payload, time.Now().Add(time.Second*10)); err != nil {
 					log.Warnf("failed to ping: %s", err)
 				}
 			case <-ctx.Done():
@@ -143,11 +187,18 @@ func HandleRepoStream(ctx context.Context, con *websocket.Conn, sched Scheduler)
 		return err
 	})
 
-	con.SetPongHandler(func(_ string) error {
+	con.SetPongHandler(func(message string) error {
 		if err := con.SetReadDeadline(time.Now().Add(time.Minute)); err != nil {
 			log.Errorf("failed to set read deadline: %s", err)
 		}
 
+		if opts.OnPong != nil && len(message) == 8 {
+			sent := time.Unix(0, int64(binary.BigEndian.Uint64([]byte(message))))
+			if rtt := time.Since(sent); rtt >= 0 {
+				opts.OnPong(rtt)
+			}
+		}
+
 		return nil
 	})
 
@@ -171,165 +222,254 @@ func HandleRepoStream(ctx context.Context, con *websocket.Conn, sched Scheduler)
 			// ok
 		}
 
-		r := &instrumentedReader{
+		var r io.Reader = &instrumentedReader{
 			r:            rawReader,
 			addr:         remoteAddr,
 			bytesCounter: bytesFromStreamCounter.WithLabelValues(remoteAddr),
+			bytesRead:    opts.BytesRead,
 		}
 
-		var header EventHeader
-		if err := header.UnmarshalCBOR(r); err != nil {
-			return fmt.Errorf("reading header: %w", err)
+		if v != nil {
+			frame, err := io.ReadAll(io.LimitReader(r, maxStreamFrameSize))
+			if err != nil {
+				return err
+			}
+			if err := v.Verify(frame); err != nil {
+				return err
+			}
+			r = bytes.NewReader(frame)
 		}
 
-		eventsFromStreamCounter.WithLabelValues(remoteAddr).Inc()
+		if err := handleStreamFrame(ctx, r, remoteAddr, sched, &lastSeq); err != nil {
+			return err
+		}
+	}
+}
 
-		switch header.Op {
-		case EvtKindMessage:
-			switch header.MsgType {
-			case "#commit":
-				var evt comatproto.SyncSubscribeRepos_Commit
-				if err := evt.UnmarshalCBOR(r); err != nil {
-					return fmt.Errorf("reading repoCommit event: %w", err)
-				}
+// handleStreamFrame decodes a single event stream frame and hands it to the
+// scheduler. lastSeq tracks the sequence number of the previous event, to
+// detect out-of-order streams.
+func handleStreamFrame(ctx context.Context, r io.Reader, remoteAddr string, sched Scheduler, lastSeq *int64) error {
+	var header EventHeader
+	if err := header.UnmarshalCBOR(r); err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	}
 
-				if evt.Seq < lastSeq {
-					log.Errorf("Got events out of order from stream (seq = %d, prev = %d)", evt.Seq, lastSeq)
-				}
+	eventsFromStreamCounter.WithLabelValues(remoteAddr).Inc()
 
-				lastSeq = evt.Seq
+	switch header.Op {
+	case EvtKindMessage:
+		switch header.MsgType {
+		case "#commit":
+			var evt comatproto.SyncSubscribeRepos_Commit
+			if err := evt.UnmarshalCBOR(r); err != nil {
+				return fmt.Errorf("reading repoCommit event: %w", err)
+			}
 
-				if err := sched.AddWork(ctx, evt.Repo, &XRPCStreamEvent{
-					RepoCommit: &evt,
-				}); err != nil {
-					return err
-				}
-			case "#handle":
-				var evt comatproto.SyncSubscribeRepos_Handle
-				if err := evt.UnmarshalCBOR(r); err != nil {
-					return err
-				}
+			if evt.Seq < *lastSeq {
+				log.Errorf("Got events out of order from stream (seq = %d, prev = %d)", evt.Seq, *lastSeq)
+			}
 
-				if evt.Seq < lastSeq {
-					log.Errorf("Got events out of order from stream (seq = %d, prev = %d)", evt.Seq, lastSeq)
-				}
-				lastSeq = evt.Seq
+			*lastSeq = evt.Seq
 
-				if err := sched.AddWork(ctx, evt.Did, &XRPCStreamEvent{
-					RepoHandle: &evt,
-				}); err != nil {
-					return err
-				}
-			case "#identity":
-				var evt comatproto.SyncSubscribeRepos_Identity
-				if err := evt.UnmarshalCBOR(r); err != nil {
-					return err
-				}
+			if err := sched.AddWork(ctx, evt.Repo, &XRPCStreamEvent{
+				RepoCommit: &evt,
+			}); err != nil {
+				return err
+			}
+		case "#handle":
+			var evt comatproto.SyncSubscribeRepos_Handle
+			if err := evt.UnmarshalCBOR(r); err != nil {
+				return err
+			}
 
-				if evt.Seq < lastSeq {
-					log.Errorf("Got events out of order from stream (seq = %d, prev = %d)", evt.Seq, lastSeq)
-				}
-				lastSeq = evt.Seq
+			if evt.Seq < *lastSeq {
+				log.Errorf("Got events out of order from stream (seq = %d, prev = %d)", evt.Seq, *lastSeq)
+			}
+			*lastSeq = evt.Seq
 
-				if err := sched.AddWork(ctx, evt.Did, &XRPCStreamEvent{
-					RepoIdentity: &evt,
-				}); err != nil {
-					return err
-				}
-			case "#account":
-				var evt comatproto.SyncSubscribeRepos_Account
-				if err := evt.UnmarshalCBOR(r); err != nil {
-					return err
-				}
+			if err := sched.AddWork(ctx, evt.Did, &XRPCStreamEvent{
+				RepoHandle: &evt,
+			}); err != nil {
+				return err
+			}
+		case "#identity":
+			var evt comatproto.SyncSubscribeRepos_Identity
+			if err := evt.UnmarshalCBOR(r); err != nil {
+				return err
+			}
 
-				if evt.Seq < lastSeq {
-					log.Errorf("Got events out of order from stream (seq = %d, prev = %d)", evt.Seq, lastSeq)
-				}
-				lastSeq = evt.Seq
+			if evt.Seq < *lastSeq {
+				log.Errorf("Got events out of order from stream (seq = %d, prev = %d)", evt.Seq, *lastSeq)
+			}
+			*lastSeq = evt.Seq
 
-				if err := sched.AddWork(ctx, evt.Did, &XRPCStreamEvent{
-					RepoAccount: &evt,
-				}); err != nil {
-					return err
-				}
-			case "#info":
-				// TODO: this might also be a LabelInfo (as opposed to RepoInfo)
-				var evt comatproto.SyncSubscribeRepos_Info
-				if err := evt.UnmarshalCBOR(r); err != nil {
-					return err
-				}
+			if err := sched.AddWork(ctx, evt.Did, &XRPCStreamEvent{
+				RepoIdentity: &evt,
+			}); err != nil {
+				return err
+			}
+		case "#account":
+			var evt comatproto.SyncSubscribeRepos_Account
+			if err := evt.UnmarshalCBOR(r); err != nil {
+				return err
+			}
 
-				if err := sched.AddWork(ctx, "", &XRPCStreamEvent{
-					RepoInfo: &evt,
-				}); err != nil {
-					return err
-				}
-			case "#migrate":
-				var evt comatproto.SyncSubscribeRepos_Migrate
-				if err := evt.UnmarshalCBOR(r); err != nil {
-					return err
-				}
+			if evt.Seq < *lastSeq {
+				log.Errorf("Got events out of order from stream (seq = %d, prev = %d)", evt.Seq, *lastSeq)
+			}
+			*lastSeq = evt.Seq
 
-				if evt.Seq < lastSeq {
-					log.Errorf("Got events out of order from stream (seq = %d, prev = %d)", evt.Seq, lastSeq)
-				}
-				lastSeq = evt.Seq
+			if err := sched.AddWork(ctx, evt.Did, &XRPCStreamEvent{
+				RepoAccount: &evt,
+			}); err != nil {
+				return err
+			}
+		case "#sync":
+			var evt comatproto.SyncSubscribeRepos_Sync
+			if err := evt.UnmarshalCBOR(r); err != nil {
+				return err
+			}
 
-				if err := sched.AddWork(ctx, evt.Did, &XRPCStreamEvent{
-					RepoMigrate: &evt,
-				}); err != nil {
-					return err
-				}
-			case "#tombstone":
-				var evt comatproto.SyncSubscribeRepos_Tombstone
-				if err := evt.UnmarshalCBOR(r); err != nil {
-					return err
-				}
+			if evt.Seq < *lastSeq {
+				log.Errorf("Got events out of order from stream (seq = %d, prev = %d)", evt.Seq, *lastSeq)
+			}
+			*lastSeq = evt.Seq
 
-				if evt.Seq < lastSeq {
-					log.Errorf("Got events out of order from stream (seq = %d, prev = %d)", evt.Seq, lastSeq)
-				}
-				lastSeq = evt.Seq
+			if err := sched.AddWork(ctx, evt.Did, &XRPCStreamEvent{
+				RepoSync: &evt,
+			}); err != nil {
+				return err
+			}
+		case "#info":
+			// TODO: this might also be a LabelInfo (as opposed to RepoInfo)
+			var evt comatproto.SyncSubscribeRepos_Info
+			if err := evt.UnmarshalCBOR(r); err != nil {
+				return err
+			}
 
-				if err := sched.AddWork(ctx, evt.Did, &XRPCStreamEvent{
-					RepoTombstone: &evt,
-				}); err != nil {
-					return err
-				}
-			case "#labels":
-				var evt comatproto.LabelSubscribeLabels_Labels
-				if err := evt.UnmarshalCBOR(r); err != nil {
-					return fmt.Errorf("reading Labels event: %w", err)
-				}
+			if err := sched.AddWork(ctx, "", &XRPCStreamEvent{
+				RepoInfo: &evt,
+			}); err != nil {
+				return err
+			}
+		case "#migrate":
+			var evt comatproto.SyncSubscribeRepos_Migrate
+			if err := evt.UnmarshalCBOR(r); err != nil {
+				return err
+			}
 
-				if evt.Seq < lastSeq {
-					log.Errorf("Got events out of order from stream (seq = %d, prev = %d)", evt.Seq, lastSeq)
-				}
+			if evt.Seq < *lastSeq {
+				log.Errorf("Got events out of order from stream (seq = %d, prev = %d)", evt.Seq, *lastSeq)
+			}
+			*lastSeq = evt.Seq
 
-				lastSeq = evt.Seq
+			if err := sched.AddWork(ctx, evt.Did, &XRPCStreamEvent{
+				RepoMigrate: &evt,
+			}); err != nil {
+				return err
+			}
+		case "#tombstone":
+			var evt comatproto.SyncSubscribeRepos_Tombstone
+			if err := evt.UnmarshalCBOR(r); err != nil {
+				return err
+			}
 
-				if err := sched.AddWork(ctx, "", &XRPCStreamEvent{
-					LabelLabels: &evt,
-				}); err != nil {
-					return err
-				}
+			if evt.Seq < *lastSeq {
+				log.Errorf("Got events out of order from stream (seq = %d, prev = %d)", evt.Seq, *lastSeq)
 			}
+			*lastSeq = evt.Seq
 
-		case EvtKindErrorFrame:
-			var errframe ErrorFrame
-			if err := errframe.UnmarshalCBOR(r); err != nil {
+			if err := sched.AddWork(ctx, evt.Did, &XRPCStreamEvent{
+				RepoTombstone: &evt,
+			}); err != nil {
 				return err
 			}
+		case "#labels":
+			var evt comatproto.LabelSubscribeLabels_Labels
+			if err := evt.UnmarshalCBOR(r); err != nil {
+				return fmt.Errorf("reading Labels event: %w", err)
+			}
+
+			if evt.Seq < *lastSeq {
+				log.Errorf("Got events out of order from stream (seq = %d, prev = %d)", evt.Seq, *lastSeq)
+			}
+
+			*lastSeq = evt.Seq
 
 			if err := sched.AddWork(ctx, "", &XRPCStreamEvent{
-				Error: &errframe,
+				LabelLabels: &evt,
 			}); err != nil {
 				return err
 			}
+		}
+
+	case EvtKindErrorFrame:
+		var errframe ErrorFrame
+		if err := errframe.UnmarshalCBOR(r); err != nil {
+			return err
+		}
 
+		if err := sched.AddWork(ctx, "", &XRPCStreamEvent{
+			Error: &errframe,
+		}); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unrecognized event stream type: %d", header.Op)
+	}
+
+	return nil
+}
+
+// upper bound on a single length-prefixed frame, well above the largest
+// commit events relays emit
+const maxStreamFrameSize = 10 << 20
+
+// HandleFramedRepoStream consumes an event stream delivered as a sequence of
+// frames each prefixed with its length as a uvarint, as served by the relay's
+// experimental HTTP/3 endpoint. The frames themselves are the same as the
+// messages of the websocket stream. It returns when the stream ends or ctx is
+// cancelled.
+func HandleFramedRepoStream(ctx context.Context, body io.Reader, remoteAddr string, sched Scheduler) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer sched.Shutdown()
+
+	br := bufio.NewReader(&instrumentedReader{
+		r:            body,
+		addr:         remoteAddr,
+		bytesCounter: bytesFromStreamCounter.WithLabelValues(remoteAddr),
+	})
+
+	lastSeq := int64(-1)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
 		default:
-			return fmt.Errorf("unrecognized event stream type: %d", header.Op)
 		}
 
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("reading frame length: %w", err)
+		}
+		if n > maxStreamFrameSize {
+			return fmt.Errorf("frame too large (%d bytes)", n)
+		}
+
+		frame := io.LimitReader(br, int64(n))
+		if err := handleStreamFrame(ctx, frame, remoteAddr, sched, &lastSeq); err != nil {
+			return err
+		}
+
+		// skip anything in the frame the decoder didn't consume
+		if _, err := io.Copy(io.Discard, frame); err != nil {
+			return err
+		}
 	}
 }
@@ -0,0 +1,55 @@
+package events_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/events/schedulers/sequential"
+)
+
+func TestHandleFramedRepoStream(t *testing.T) {
+	var stream bytes.Buffer
+	writeFrame := func(evt *events.XRPCStreamEvent) {
+		var frame bytes.Buffer
+		if err := evt.Serialize(&frame); err != nil {
+			t.Fatal(err)
+		}
+		var lenbuf [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(lenbuf[:], uint64(frame.Len()))
+		stream.Write(lenbuf[:n])
+		stream.Write(frame.Bytes())
+	}
+
+	writeFrame(&events.XRPCStreamEvent{RepoIdentity: &comatproto.SyncSubscribeRepos_Identity{Did: "did:plc:one", Seq: 1, Time: "2024-01-01T00:00:00Z"}})
+	writeFrame(&events.XRPCStreamEvent{RepoIdentity: &comatproto.SyncSubscribeRepos_Identity{Did: "did:plc:two", Seq: 2, Time: "2024-01-01T00:00:00Z"}})
+	writeFrame(&events.XRPCStreamEvent{Error: &events.ErrorFrame{Error: "FutureCursor", Message: "too far"}})
+
+	var seqs []int64
+	var errFrames []string
+	rsc := &events.RepoStreamCallbacks{
+		RepoIdentity: func(evt *comatproto.SyncSubscribeRepos_Identity) error {
+			seqs = append(seqs, evt.Seq)
+			return nil
+		},
+		Error: func(evt *events.ErrorFrame) error {
+			errFrames = append(errFrames, evt.Error)
+			return nil
+		},
+	}
+
+	sched := sequential.NewScheduler("test", rsc.EventHandler)
+	if err := events.HandleFramedRepoStream(context.Background(), &stream, "test", sched); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(seqs) != 2 || seqs[0] != 1 || seqs[1] != 2 {
+		t.Fatalf("unexpected events: %v", seqs)
+	}
+	if len(errFrames) != 1 || errFrames[0] != "FutureCursor" {
+		t.Fatalf("unexpected error frames: %v", errFrames)
+	}
+}
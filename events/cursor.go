@@ -0,0 +1,260 @@
+package events
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Cursor is a position in the event stream. Epoch identifies the history that
+// Seq belongs to, and is zero for bare integer cursors, which are always taken
+// at face value.
+type Cursor struct {
+	Seq   int64
+	Epoch uint32
+}
+
+// cursor tokens are "t" followed by unpadded base64url of:
+//
+//	version byte | uvarint epoch | uvarint seq | crc32 (first two bytes)
+//
+// the prefix keeps tokens from ever parsing as a bare integer cursor
+const (
+	cursorTokenPrefix  = "t"
+	cursorTokenVersion = 1
+)
+
+// EncodeCursorToken returns a compact opaque token for the cursor
+func EncodeCursorToken(c Cursor) string {
+	buf := make([]byte, 0, 1+binary.MaxVarintLen32+binary.MaxVarintLen64+2)
+	buf = append(buf, cursorTokenVersion)
+	buf = binary.AppendUvarint(buf, uint64(c.Epoch))
+	buf = binary.AppendUvarint(buf, uint64(c.Seq))
+	sum := crc32.ChecksumIEEE(buf)
+	buf = append(buf, byte(sum>>24), byte(sum>>16))
+
+	return cursorTokenPrefix + base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// ParseCursor accepts either a bare integer sequence number or a token from
+// EncodeCursorToken. Failures are returned as a *CursorError.
+func ParseCursor(s string) (*Cursor, error) {
+	if !strings.HasPrefix(s, cursorTokenPrefix) {
+		seq, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || seq < 0 {
+			return nil, &CursorError{Name: CursorErrInvalid, Message: fmt.Sprintf("invalid cursor: %q", s)}
+		}
+		return &Cursor{Seq: seq}, nil
+	}
+
+	invalid := &CursorError{Name: CursorErrInvalid, Message: "malformed cursor token"}
+
+	buf, err := base64.RawURLEncoding.DecodeString(s[len(cursorTokenPrefix):])
+	if err != nil || len(buf) < 4 {
+		return nil, invalid
+	}
+
+	body, check := buf[:len(buf)-2], buf[len(buf)-2:]
+	sum := crc32.ChecksumIEEE(body)
+	if check[0] != byte(sum>>24) || check[1] != byte(sum>>16) {
+		return nil, invalid
+	}
+
+	if body[0] != cursorTokenVersion {
+		return nil, &CursorError{Name: CursorErrInvalid, Message: fmt.Sprintf("unsupported cursor token version %d", body[0])}
+	}
+	body = body[1:]
+
+	epoch, n := binary.Uvarint(body)
+	if n <= 0 || epoch > 0xffffffff {
+		return nil, invalid
+	}
+	body = body[n:]
+
+	seq, n := binary.Uvarint(body)
+	if n <= 0 || n != len(body) || seq > 1<<63-1 {
+		return nil, invalid
+	}
+
+	return &Cursor{Seq: int64(seq), Epoch: uint32(epoch)}, nil
+}
+
+const (
+	// the cursor could not be parsed
+	CursorErrInvalid = "InvalidCursor"
+	// the cursor's epoch is unknown: it was issued by a different instance,
+	// or by history that was lost when this one was restored from a backup
+	CursorErrForeign = "ForeignCursor"
+	// the cursor's epoch is known, but its sequence number is past the point
+	// where that epoch's history ends here
+	CursorErrStale = "StaleCursor"
+)
+
+// CursorError is returned for cursors that can't be served. Name is suitable
+// for use as the error in an error frame.
+type CursorError struct {
+	Name    string
+	Message string
+}
+
+func (e *CursorError) Error() string {
+	return e.Name + ": " + e.Message
+}
+
+func IsCursorError(err error) bool {
+	var ce *CursorError
+	return errors.As(err, &ce)
+}
+
+// EventEpoch is a span of event history with a continuous sequence. A new
+// epoch starts each time the event manager starts up, so epochs recorded
+// after a backup was taken disappear when it is restored, and cursors from
+// them can be told apart from cursors into the restored history.
+type EventEpoch struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	Epoch     uint32 `gorm:"uniqueIndex"`
+	// First sequence number seen in this epoch, zero until an event is persisted
+	StartSeq int64
+}
+
+// CursorEpochs tracks the epochs of the persisted event history
+type CursorEpochs struct {
+	db *gorm.DB
+
+	lk     sync.Mutex
+	epochs []*EventEpoch
+}
+
+// NewCursorEpochs loads the epoch history from the DB and starts a new
+// epoch. If db is nil, epochs are tracked in memory only.
+func NewCursorEpochs(db *gorm.DB) (*CursorEpochs, error) {
+	ce := &CursorEpochs{db: db}
+
+	if db != nil {
+		if err := db.AutoMigrate(&EventEpoch{}); err != nil {
+			return nil, err
+		}
+		if err := db.Order("id asc").Find(&ce.epochs).Error; err != nil {
+			return nil, fmt.Errorf("loading event epochs: %w", err)
+		}
+	}
+
+	ep := &EventEpoch{CreatedAt: time.Now()}
+	for {
+		ep.Epoch = rand.Uint32()
+		if ep.Epoch != 0 && ce.find(ep.Epoch) < 0 {
+			break
+		}
+	}
+
+	if db != nil {
+		if err := db.Create(ep).Error; err != nil {
+			return nil, fmt.Errorf("recording new event epoch: %w", err)
+		}
+	}
+	ce.epochs = append(ce.epochs, ep)
+
+	return ce, nil
+}
+
+func (ce *CursorEpochs) find(epoch uint32) int {
+	for i, ep := range ce.epochs {
+		if ep.Epoch == epoch {
+			return i
+		}
+	}
+	return -1
+}
+
+// Current returns the epoch of events being persisted now
+func (ce *CursorEpochs) Current() uint32 {
+	ce.lk.Lock()
+	defer ce.lk.Unlock()
+
+	return ce.epochs[len(ce.epochs)-1].Epoch
+}
+
+// CursorEpochHeader is set on subscription responses to the epoch, in hex,
+// of the events that follow. Consumers pair it with the sequence number of
+// the last event they handled to build a cursor token to resume from.
+const CursorEpochHeader = "Relay-Cursor-Epoch"
+
+// FormatCursorEpoch formats an epoch for CursorEpochHeader
+func FormatCursorEpoch(epoch uint32) string {
+	return fmt.Sprintf("%08x", epoch)
+}
+
+// ParseCursorEpoch parses the value of CursorEpochHeader
+func ParseCursorEpoch(s string) (uint32, error) {
+	epoch, err := strconv.ParseUint(s, 16, 32)
+	if err != nil || epoch == 0 {
+		return 0, fmt.Errorf("invalid cursor epoch %q", s)
+	}
+	return uint32(epoch), nil
+}
+
+// observe records the first sequence number of the current epoch
+func (ce *CursorEpochs) observe(seq int64) {
+	if seq <= 0 {
+		return
+	}
+
+	ce.lk.Lock()
+	defer ce.lk.Unlock()
+
+	cur := ce.epochs[len(ce.epochs)-1]
+	if cur.StartSeq != 0 {
+		return
+	}
+	cur.StartSeq = seq
+
+	if ce.db != nil {
+		if err := ce.db.Model(cur).Update("start_seq", seq).Error; err != nil {
+			log.Errorw("failed to record event epoch start", "epoch", cur.Epoch, "seq", seq, "err", err)
+		}
+	}
+}
+
+// Validate checks that the cursor refers to history this instance has
+func (ce *CursorEpochs) Validate(c *Cursor) error {
+	if c.Epoch == 0 {
+		return nil
+	}
+
+	ce.lk.Lock()
+	defer ce.lk.Unlock()
+
+	i := ce.find(c.Epoch)
+	if i < 0 {
+		return &CursorError{
+			Name:    CursorErrForeign,
+			Message: fmt.Sprintf("cursor epoch %08x is not part of this relay's history", c.Epoch),
+		}
+	}
+
+	// an older epoch's history ends where the next one to see events starts
+	for _, next := range ce.epochs[i+1:] {
+		if next.StartSeq == 0 {
+			continue
+		}
+		if c.Seq >= next.StartSeq {
+			return &CursorError{
+				Name:    CursorErrStale,
+				Message: fmt.Sprintf("cursor %d is past the end of epoch %08x at %d", c.Seq, c.Epoch, next.StartSeq-1),
+			}
+		}
+		break
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package events_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/bluesky-social/indigo/events"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestCursorTokenRoundTrip(t *testing.T) {
+	for _, c := range []events.Cursor{
+		{Seq: 0, Epoch: 1},
+		{Seq: 1, Epoch: 0xffffffff},
+		{Seq: 123456789, Epoch: 42},
+		{Seq: 1<<63 - 1, Epoch: 7},
+	} {
+		tok := events.EncodeCursorToken(c)
+		got, err := events.ParseCursor(tok)
+		if err != nil {
+			t.Fatalf("parsing %q: %s", tok, err)
+		}
+		if *got != c {
+			t.Fatalf("round trip mismatch: %+v != %+v", *got, c)
+		}
+	}
+
+	legacy, err := events.ParseCursor("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if legacy.Seq != 1234 || legacy.Epoch != 0 {
+		t.Fatalf("unexpected legacy cursor: %+v", *legacy)
+	}
+
+	tok := events.EncodeCursorToken(events.Cursor{Seq: 99, Epoch: 5})
+	corrupt := tok[:len(tok)-1] + "A"
+	if corrupt == tok {
+		corrupt = tok[:len(tok)-1] + "B"
+	}
+	for _, bad := range []string{"abc", "-5", "t", "t!!!", corrupt} {
+		if _, err := events.ParseCursor(bad); !events.IsCursorError(err) {
+			t.Fatalf("expected cursor error for %q, got %v", bad, err)
+		}
+	}
+}
+
+func TestCursorEpochValidation(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "epochs.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := events.NewCursorEpochs(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldEpoch := first.Current()
+
+	// the first run persisted events starting at 1, and the second started at 100
+	if err := db.Model(&events.EventEpoch{}).Where("epoch = ?", oldEpoch).Update("start_seq", 1).Error; err != nil {
+		t.Fatal(err)
+	}
+	second, err := events.NewCursorEpochs(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&events.EventEpoch{}).Where("epoch = ?", second.Current()).Update("start_seq", 100).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	ce, err := events.NewCursorEpochs(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ce.Current() == oldEpoch || ce.Current() == second.Current() {
+		t.Fatal("expected a fresh epoch on startup")
+	}
+
+	check := func(c events.Cursor, want string) {
+		t.Helper()
+		err := ce.Validate(&c)
+		if want == "" {
+			if err != nil {
+				t.Fatalf("expected %+v to be valid, got %s", c, err)
+			}
+			return
+		}
+		cerr, ok := err.(*events.CursorError)
+		if !ok || cerr.Name != want {
+			t.Fatalf("expected %s for %+v, got %v", want, c, err)
+		}
+	}
+
+	check(events.Cursor{Seq: 50}, "")
+	check(events.Cursor{Seq: 50, Epoch: oldEpoch}, "")
+	check(events.Cursor{Seq: 99, Epoch: oldEpoch}, "")
+	check(events.Cursor{Seq: 100, Epoch: oldEpoch}, events.CursorErrStale)
+	check(events.Cursor{Seq: 150, Epoch: second.Current()}, "")
+	check(events.Cursor{Seq: 150, Epoch: ce.Current()}, "")
+
+	foreign := uint32(1)
+	for foreign == oldEpoch || foreign == second.Current() || foreign == ce.Current() {
+		foreign++
+	}
+	check(events.Cursor{Seq: 50, Epoch: foreign}, events.CursorErrForeign)
+
+	// the epoch handed out in the header round trips
+	epoch, err := events.ParseCursorEpoch(events.FormatCursorEpoch(ce.Current()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if epoch != ce.Current() {
+		t.Fatalf("expected epoch %08x, got %08x", ce.Current(), epoch)
+	}
+	for _, bad := range []string{"", "0", "xyz", "100000000"} {
+		if _, err := events.ParseCursorEpoch(bad); err == nil {
+			t.Errorf("expected epoch %q rejected", bad)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	comatproto "github.com/bluesky-social/indigo/api/atproto"
@@ -33,6 +34,8 @@ type Options struct {
 	DIDCacheSize         int
 	PlaybackBatchSize    int
 	HydrationConcurrency int
+	// Time source for batching; defaults to the system clock
+	Clock util.Clock
 }
 
 func DefaultOptions() *Options {
@@ -58,8 +61,10 @@ type DbPersistence struct {
 	broadcast func(*XRPCStreamEvent)
 
 	batch        []*PersistenceBatchItem
+	unflushed    atomic.Int64
 	batchOptions Options
 	lastFlush    time.Time
+	clock        util.Clock
 
 	uidCache *arc.ARCCache[models.Uid, string]
 	didCache *arc.ARCCache[string, models.Uid]
@@ -83,6 +88,9 @@ type RepoEventRecord struct {
 	Active bool
 	Status *string
 
+	// Blocks is only set on RepoSync events, which carry just the commit
+	Blocks []byte
+
 	Ops []byte
 }
 
@@ -112,6 +120,7 @@ func NewDbPersistence(db *gorm.DB, cs carstore.CarStore, options *Options) (*DbP
 		batch:        []*PersistenceBatchItem{},
 		uidCache:     uidCache,
 		didCache:     didCache,
+		clock:        util.ClockOrSystem(options.Clock),
 	}
 
 	go p.batchFlusher()
@@ -121,17 +130,18 @@ func NewDbPersistence(db *gorm.DB, cs carstore.CarStore, options *Options) (*DbP
 
 func (p *DbPersistence) batchFlusher() {
 	for {
-		time.Sleep(p.batchOptions.CheckBatchInterval)
+		p.clock.Sleep(context.Background(), p.batchOptions.CheckBatchInterval)
 
 		p.lk.Lock()
 		needsFlush := len(p.batch) > 0 &&
 			(len(p.batch) >= p.batchOptions.MinBatchSize ||
-				time.Since(p.lastFlush) >= p.batchOptions.MaxTimeBetweenFlush)
+				p.clock.Since(p.lastFlush) >= p.batchOptions.MaxTimeBetweenFlush)
 		p.lk.Unlock()
 
 		if needsFlush {
 			if err := p.Flush(context.Background()); err != nil {
 				log.Errorf("failed to flush batch: %s", err)
+				recordPersistFailure("flush")
 			}
 		}
 	}
@@ -158,9 +168,12 @@ func (p *DbPersistence) flushBatchLocked(ctx context.Context) error {
 		records[i] = item.Record
 	}
 
+	start := time.Now()
 	if err := p.db.CreateInBatches(records, 50).Error; err != nil {
 		return fmt.Errorf("failed to create records: %w", err)
 	}
+	persisterWriteDuration.WithLabelValues("db").Observe(time.Since(start).Seconds())
+	persisterWriteEvents.WithLabelValues("db").Add(float64(len(records)))
 
 	for i, item := range records {
 		e := p.batch[i].Event
@@ -173,6 +186,8 @@ func (p *DbPersistence) flushBatchLocked(ctx context.Context) error {
 			e.RepoIdentity.Seq = int64(item.Seq)
 		case e.RepoAccount != nil:
 			e.RepoAccount.Seq = int64(item.Seq)
+		case e.RepoSync != nil:
+			e.RepoSync.Seq = int64(item.Seq)
 		case e.RepoTombstone != nil:
 			e.RepoTombstone.Seq = int64(item.Seq)
 		default:
@@ -182,7 +197,8 @@ func (p *DbPersistence) flushBatchLocked(ctx context.Context) error {
 	}
 
 	p.batch = []*PersistenceBatchItem{}
-	p.lastFlush = time.Now()
+	p.unflushed.Store(0)
+	p.lastFlush = p.clock.Now()
 
 	return nil
 }
@@ -194,6 +210,7 @@ func (p *DbPersistence) AddItemToBatch(ctx context.Context, rec *RepoEventRecord
 		Record: rec,
 		Event:  evt,
 	})
+	p.unflushed.Store(int64(len(p.batch)))
 
 	if len(p.batch) >= p.batchOptions.MaxBatchSize {
 		if err := p.flushBatchLocked(ctx); err != nil {
@@ -229,6 +246,11 @@ func (p *DbPersistence) Persist(ctx context.Context, e *XRPCStreamEvent) error {
 		if err != nil {
 			return err
 		}
+	case e.RepoSync != nil:
+		rer, err = p.RecordFromRepoSync(ctx, e.RepoSync)
+		if err != nil {
+			return err
+		}
 	case e.RepoTombstone != nil:
 		rer, err = p.RecordFromTombstone(ctx, e.RepoTombstone)
 		if err != nil {
@@ -302,6 +324,26 @@ func (p *DbPersistence) RecordFromRepoAccount(ctx context.Context, evt *comatpro
 	}, nil
 }
 
+func (p *DbPersistence) RecordFromRepoSync(ctx context.Context, evt *comatproto.SyncSubscribeRepos_Sync) (*RepoEventRecord, error) {
+	t, err := time.Parse(util.ISO8601, evt.Time)
+	if err != nil {
+		return nil, err
+	}
+
+	uid, err := p.uidForDid(ctx, evt.Did)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RepoEventRecord{
+		Repo:   uid,
+		Type:   "repo_sync",
+		Time:   t,
+		Rev:    evt.Rev,
+		Blocks: evt.Blocks,
+	}, nil
+}
+
 func (p *DbPersistence) RecordFromTombstone(ctx context.Context, evt *comatproto.SyncSubscribeRepos_Tombstone) (*RepoEventRecord, error) {
 	t, err := time.Parse(util.ISO8601, evt.Time)
 	if err != nil {
@@ -373,6 +415,7 @@ func (p *DbPersistence) RecordFromRepoCommit(ctx context.Context, evt *comatprot
 }
 
 func (p *DbPersistence) Playback(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error) error {
+	cb = observePlayback("db", cb)
 	pageSize := 1000
 
 	for {
@@ -421,6 +464,44 @@ func (p *DbPersistence) Playback(ctx context.Context, since int64, cb func(*XRPC
 	return nil
 }
 
+// SeqForTime binary searches the events by sequence number for the last one
+// before t, which saves indexing the time column. Event times come from the
+// events themselves, so where they're out of order the result is approximate.
+func (p *DbPersistence) SeqForTime(ctx context.Context, t time.Time) (int64, error) {
+	db := p.db.WithContext(ctx).Model(&RepoEventRecord{}).Select("seq", "time").Session(&gorm.Session{})
+
+	var first, last RepoEventRecord
+	if err := db.Order("seq asc").Limit(1).Find(&first).Error; err != nil {
+		return 0, err
+	}
+	if first.Seq == 0 || !first.Time.Before(t) {
+		return 0, nil
+	}
+	if err := db.Order("seq desc").Limit(1).Find(&last).Error; err != nil {
+		return 0, err
+	}
+	if last.Time.Before(t) {
+		return int64(last.Seq), nil
+	}
+
+	// lo is an event before t; everything from hi on is at or after t
+	lo, hi := first.Seq, last.Seq
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+
+		var rec RepoEventRecord
+		if err := db.Where("seq >= ?", mid).Order("seq asc").Limit(1).Find(&rec).Error; err != nil {
+			return 0, err
+		}
+		if rec.Seq != 0 && rec.Seq < hi && rec.Time.Before(t) {
+			lo = rec.Seq
+		} else {
+			hi = mid
+		}
+	}
+	return int64(lo), nil
+}
+
 func (p *DbPersistence) hydrateBatch(ctx context.Context, batch []*RepoEventRecord, cb func(*XRPCStreamEvent) error) error {
 	events := make([]*XRPCStreamEvent, len(batch))
 
@@ -456,6 +537,8 @@ func (p *DbPersistence) hydrateBatch(ctx context.Context, batch []*RepoEventReco
 				streamEvent, err = p.hydrateIdentityEvent(ctx, record)
 			case record.Type == "repo_account":
 				streamEvent, err = p.hydrateAccountEvent(ctx, record)
+			case record.Type == "repo_sync":
+				streamEvent, err = p.hydrateSyncEvent(ctx, record)
 			case record.Type == "repo_tombstone":
 				streamEvent, err = p.hydrateTombstone(ctx, record)
 			default:
@@ -569,6 +652,22 @@ func (p *DbPersistence) hydrateAccountEvent(ctx context.Context, rer *RepoEventR
 	}, nil
 }
 
+func (p *DbPersistence) hydrateSyncEvent(ctx context.Context, rer *RepoEventRecord) (*XRPCStreamEvent, error) {
+	did, err := p.didForUid(ctx, rer.Repo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &XRPCStreamEvent{
+		RepoSync: &comatproto.SyncSubscribeRepos_Sync{
+			Did:    did,
+			Time:   rer.Time.Format(util.ISO8601),
+			Rev:    rer.Rev,
+			Blocks: rer.Blocks,
+		},
+	}, nil
+}
+
 func (p *DbPersistence) hydrateTombstone(ctx context.Context, rer *RepoEventRecord) (*XRPCStreamEvent, error) {
 	did, err := p.didForUid(ctx, rer.Repo)
 	if err != nil {
@@ -669,6 +768,10 @@ func (p *DbPersistence) deleteAllEventsForUser(ctx context.Context, usr models.U
 	return nil
 }
 
+func (p *DbPersistence) Unflushed() int {
+	return int(p.unflushed.Load())
+}
+
 func (p *DbPersistence) Shutdown(context.Context) error {
 	return nil
 }
@@ -308,3 +308,59 @@ func setupDBs(t testing.TB) (*gorm.DB, *gorm.DB, carstore.CarStore, string, erro
 
 	return maindb, cardb, cs, dir, nil
 }
+
+func TestDBPersistSeqForTime(t *testing.T) {
+	ctx := context.Background()
+
+	db, _, cs, tempPath, err := setupDBs(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempPath)
+
+	db.AutoMigrate(&models.ActorInfo{})
+	db.Create(&models.ActorInfo{Uid: 1, Did: "did:example:123"})
+
+	dbp, err := events.NewDbPersistence(db, cs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evtman := events.NewEventManager(dbp)
+
+	// events 1-5 an hour before events 6-10
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		ts := base
+		if i >= 5 {
+			ts = base.Add(time.Hour)
+		}
+		if err := evtman.AddEvent(ctx, &events.XRPCStreamEvent{RepoIdentity: &atproto.SyncSubscribeRepos_Identity{
+			Did:  "did:example:123",
+			Time: ts.Format(util.ISO8601),
+		}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dbp.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		at   time.Time
+		want int64
+	}{
+		{base.Add(-time.Hour), 0},
+		{base, 0},
+		{base.Add(30 * time.Minute), 5},
+		{base.Add(time.Hour), 5},
+		{base.Add(2 * time.Hour), 10},
+	} {
+		seq, err := evtman.SeqForTime(ctx, tc.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != tc.want {
+			t.Errorf("SeqForTime(%s): expected %d, got %d", tc.at, tc.want, seq)
+		}
+	}
+}
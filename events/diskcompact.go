@@ -0,0 +1,221 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/models"
+)
+
+// CompactionMode is how the disk persister shrinks event log files once they
+// are older than CompactAfter, so that events can be retained for longer.
+// Compacted commits keep their header, and so their sequence number, but lose
+// their body and are skipped on playback. Other events are left alone.
+type CompactionMode string
+
+const (
+	CompactionOff CompactionMode = ""
+	// Keep only the latest commit of each repo in each hour, by commit
+	// time, within each log file
+	CompactionLatestPerHour CompactionMode = "latest-per-hour"
+	// Keep the headers of every commit, but none of their bodies
+	CompactionHeadersOnly CompactionMode = "headers-only"
+)
+
+func ParseCompactionMode(s string) (CompactionMode, error) {
+	switch m := CompactionMode(s); m {
+	case CompactionOff, CompactionLatestPerHour, CompactionHeadersOnly:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown event compaction mode %q, must be %q or %q", s, CompactionLatestPerHour, CompactionHeadersOnly)
+	}
+}
+
+// Compact compacts the log files whose events are all older than
+// CompactAfter, and that haven't been already
+func (dp *DiskPersistence) Compact(ctx context.Context) error {
+	if dp.compaction == CompactionOff || dp.compactAfter <= 0 {
+		return nil
+	}
+
+	// a log file is finished once the next one is created, so every event in
+	// it is older than the next one
+	var refs []LogFileRef
+	if err := dp.meta.WithContext(ctx).Order("seq_start asc").Find(&refs, "created_at < ? AND archived = false", dp.clock.Now().Add(-dp.compactAfter)).Error; err != nil {
+		return err
+	}
+	if len(refs) < 2 {
+		return nil
+	}
+
+	for _, r := range refs[:len(refs)-1] {
+		if r.Compacted {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		saved, err := dp.compactLogFile(filepath.Join(dp.primaryDir, r.Path))
+		if err != nil {
+			return fmt.Errorf("compacting log file %s: %w", r.Path, err)
+		}
+		if err := dp.meta.WithContext(ctx).Model(&LogFileRef{}).Where("id = ?", r.ID).UpdateColumn("compacted", true).Error; err != nil {
+			return err
+		}
+		diskPersisterCompactedFiles.Inc()
+		diskPersisterCompactedBytes.Add(float64(saved))
+		log.Infow("compacted event log file", "path", r.Path, "mode", dp.compaction, "bytesSaved", saved)
+	}
+	return nil
+}
+
+// compactEntry is an event in a log file being compacted
+type compactEntry struct {
+	h    *evtHeader
+	drop bool
+}
+
+// compactLogFile rewrites a log file with superseded commits reduced to
+// their headers, returning how many bytes smaller it got
+func (dp *DiskPersistence) compactLogFile(fn string) (int64, error) {
+	// takedowns rewrite log files in place, which mustn't interleave with
+	// replacing the file
+	dp.rewriteLk.Lock()
+	defer dp.rewriteLk.Unlock()
+
+	fi, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+	defer fi.Close()
+
+	entries, err := dp.planCompaction(fi)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := fi.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	tmp := fn + ".compacting"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+
+	r := bufio.NewReader(fi)
+	w := bufio.NewWriter(out)
+	scratch := make([]byte, headerSize)
+	var saved int64
+	for _, e := range entries {
+		if _, err := io.ReadFull(r, scratch); err != nil {
+			return 0, err
+		}
+		if !e.drop {
+			if _, err := w.Write(scratch); err != nil {
+				return 0, err
+			}
+			if _, err := io.CopyN(w, r, e.h.Len64()); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		binary.LittleEndian.PutUint32(scratch[:4], e.h.Flags|EvtFlagCompacted)
+		binary.LittleEndian.PutUint32(scratch[8:12], 0)
+		if _, err := w.Write(scratch); err != nil {
+			return 0, err
+		}
+		if _, err := r.Discard(int(e.h.Len)); err != nil {
+			return 0, err
+		}
+		saved += e.h.Len64()
+	}
+
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	if err := syncLogFile(out); err != nil {
+		return 0, err
+	}
+	if err := out.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, fn); err != nil {
+		return 0, err
+	}
+	return saved, nil
+}
+
+// planCompaction reads the events in a log file, deciding which commits to
+// drop the bodies of
+func (dp *DiskPersistence) planCompaction(fi *os.File) ([]*compactEntry, error) {
+	type hourKey struct {
+		usr  models.Uid
+		hour int64
+	}
+	latest := make(map[hourKey]*compactEntry)
+
+	r := bufio.NewReader(fi)
+	scratch := make([]byte, headerSize)
+	var entries []*compactEntry
+	for {
+		h, err := readHeader(r, scratch)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+		e := &compactEntry{h: h}
+		entries = append(entries, e)
+
+		// events already hidden from playback have nothing worth keeping,
+		// but are left as they are
+		if h.Kind != evtKindCommit || postDoNotEmit(h.Flags) {
+			if _, err := r.Discard(int(h.Len)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if dp.compaction == CompactionHeadersOnly {
+			e.drop = true
+			if _, err := r.Discard(int(h.Len)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var evt atproto.SyncSubscribeRepos_Commit
+		body := &io.LimitedReader{R: r, N: h.Len64()}
+		if err := evt.UnmarshalCBOR(body); err != nil {
+			return nil, fmt.Errorf("reading commit %d: %w", h.Seq, err)
+		}
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return nil, err
+		}
+		t, ok := eventTime(&XRPCStreamEvent{RepoCommit: &evt})
+		if !ok {
+			// without a time it can't be told apart from its neighbours
+			continue
+		}
+		k := hourKey{usr: h.Usr, hour: t.Unix() / 3600}
+		if prev, ok := latest[k]; ok {
+			prev.drop = true
+		}
+		latest[k] = e
+	}
+	return entries, nil
+}
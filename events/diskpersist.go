@@ -11,10 +11,12 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/util"
 	arc "github.com/hashicorp/golang-lru/arc/v2"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -27,13 +29,29 @@ type DiskPersistence struct {
 	archiveDir      string
 	eventsPerFile   int64
 	writeBufferSize int
+	syncWrites      bool
 	retention       time.Duration
 
+	timeIndexInterval time.Duration
+	lastTimeMark      time.Time
+
+	repoIndex bool
+
+	compaction   CompactionMode
+	compactAfter time.Duration
+
+	clock util.Clock
+
+	// held while a log file other than the current one is rewritten
+	rewriteLk sync.Mutex
+
 	meta *gorm.DB
 
 	broadcast func(*XRPCStreamEvent)
 
 	logfi *os.File
+	// ID of the LogFileRef for logfi
+	logRef uint
 
 	curSeq int64
 
@@ -46,6 +64,8 @@ type DiskPersistence struct {
 
 	outbuf *bytes.Buffer
 	evtbuf []persistJob
+	// len(evtbuf), readable without the lock
+	unflushed atomic.Int64
 
 	shutdown chan struct{}
 
@@ -56,6 +76,11 @@ type persistJob struct {
 	Bytes  []byte
 	Evt    *XRPCStreamEvent
 	Buffer *bytes.Buffer // so we can put it back in the pool when we're done
+	// if set, the event keeps this sequence number instead of being assigned
+	// the next one
+	Seq int64
+	// the repo the event is about
+	Usr models.Uid
 }
 
 type jobResult struct {
@@ -66,6 +91,8 @@ type jobResult struct {
 const (
 	EvtFlagTakedown = 1 << iota
 	EvtFlagRebased
+	// the event's body was dropped by compaction
+	EvtFlagCompacted
 )
 
 var _ (EventPersistence) = (*DiskPersistence)(nil)
@@ -76,15 +103,32 @@ type DiskPersistOptions struct {
 	EventsPerFile   int64
 	WriteBufferSize int
 	Retention       time.Duration
+	// How often to record the sequence number being written, for looking up
+	// events by time. Zero means lookups only use log file creation times.
+	TimeIndexInterval time.Duration
+	// How log files are compacted once they're older than CompactAfter;
+	// off by default
+	Compaction   CompactionMode
+	CompactAfter time.Duration
+	// If set, each event is written out as it's persisted rather than in
+	// batches, which uses less memory but more write calls
+	SyncWrites bool
+	// If set, events are also indexed by repo in the database, for looking
+	// up a repo's recent events with RepoHistory
+	RepoIndex bool
+	// Time source for flushing, retention, time marks and compaction;
+	// defaults to the system clock
+	Clock util.Clock
 }
 
 func DefaultDiskPersistOptions() *DiskPersistOptions {
 	return &DiskPersistOptions{
-		EventsPerFile:   10_000,
-		UIDCacheSize:    1_000_000,
-		DIDCacheSize:    1_000_000,
-		WriteBufferSize: 50,
-		Retention:       time.Hour * 24 * 3, // 3 days
+		EventsPerFile:     10_000,
+		UIDCacheSize:      1_000_000,
+		DIDCacheSize:      1_000_000,
+		WriteBufferSize:   50,
+		Retention:         time.Hour * 24 * 3, // 3 days
+		TimeIndexInterval: 10 * time.Second,
 	}
 }
 
@@ -103,7 +147,12 @@ func NewDiskPersistence(primaryDir, archiveDir string, db *gorm.DB, opts *DiskPe
 		return nil, fmt.Errorf("failed to create did cache: %w", err)
 	}
 
-	db.AutoMigrate(&LogFileRef{})
+	db.AutoMigrate(&LogFileRef{}, &LogFileTimeMark{})
+	if opts.RepoIndex {
+		if err := db.AutoMigrate(&RepoEventRef{}); err != nil {
+			return nil, fmt.Errorf("failed to migrate repo event index: %w", err)
+		}
+	}
 
 	bufpool := &sync.Pool{
 		New: func() any {
@@ -130,7 +179,14 @@ func NewDiskPersistence(primaryDir, archiveDir string, db *gorm.DB, opts *DiskPe
 		scratch:         make([]byte, headerSize),
 		outbuf:          new(bytes.Buffer),
 		writeBufferSize: opts.WriteBufferSize,
+		syncWrites:      opts.SyncWrites,
 		shutdown:        make(chan struct{}),
+
+		timeIndexInterval: opts.TimeIndexInterval,
+		repoIndex:         opts.RepoIndex,
+		compaction:        opts.Compaction,
+		compactAfter:      opts.CompactAfter,
+		clock:             util.ClockOrSystem(opts.Clock),
 	}
 
 	if err := dp.resumeLog(); err != nil {
@@ -146,9 +202,19 @@ func NewDiskPersistence(primaryDir, archiveDir string, db *gorm.DB, opts *DiskPe
 
 type LogFileRef struct {
 	gorm.Model
-	Path     string
-	Archived bool
-	SeqStart int64
+	Path      string
+	Archived  bool
+	SeqStart  int64
+	Compacted bool
+}
+
+// LogFileTimeMark records that the event with sequence number Seq, in the
+// given log file, was written out by Time
+type LogFileTimeMark struct {
+	ID      uint `gorm:"primarykey"`
+	LogFile uint `gorm:"index"`
+	Seq     int64
+	Time    time.Time `gorm:"index"`
 }
 
 func (dp *DiskPersistence) resumeLog() error {
@@ -175,6 +241,7 @@ func (dp *DiskPersistence) resumeLog() error {
 
 	dp.curSeq = seq
 	dp.logfi = fi
+	dp.logRef = lfr.ID
 
 	return nil
 }
@@ -190,14 +257,17 @@ func (dp *DiskPersistence) initLogFile() error {
 		return err
 	}
 
-	if err := dp.meta.Create(&LogFileRef{
+	ref := &LogFileRef{
+		Model:    gorm.Model{CreatedAt: dp.clock.Now()},
 		Path:     "evts-0",
 		SeqStart: 0,
-	}).Error; err != nil {
+	}
+	if err := dp.meta.Create(ref).Error; err != nil {
 		return err
 	}
 
 	dp.logfi = fi
+	dp.logRef = ref.ID
 	dp.curSeq = 1
 	return nil
 }
@@ -205,6 +275,10 @@ func (dp *DiskPersistence) initLogFile() error {
 // swapLog swaps the current log file out for a new empty one
 // must only be called while holding dp.lk
 func (dp *DiskPersistence) swapLog(ctx context.Context) error {
+	// the finished file won't be written again, so make sure it's on disk
+	if err := syncLogFile(dp.logfi); err != nil {
+		return fmt.Errorf("failed to sync current log file: %w", err)
+	}
 	if err := dp.logfi.Close(); err != nil {
 		return fmt.Errorf("failed to close current log file: %w", err)
 	}
@@ -217,17 +291,30 @@ func (dp *DiskPersistence) swapLog(ctx context.Context) error {
 		return err
 	}
 
-	if err := dp.meta.Create(&LogFileRef{
+	ref := &LogFileRef{
+		Model:    gorm.Model{CreatedAt: dp.clock.Now()},
 		Path:     fname,
 		SeqStart: dp.curSeq,
-	}).Error; err != nil {
+	}
+	if err := dp.meta.Create(ref).Error; err != nil {
 		return err
 	}
 
 	dp.logfi = fi
+	dp.logRef = ref.ID
+	diskPersisterRollovers.Inc()
 	return nil
 }
 
+// syncLogFile fsyncs a log file, recording how long it took
+func syncLogFile(fi *os.File) error {
+	start := time.Now()
+	defer func() {
+		diskPersisterFsyncDuration.Observe(time.Since(start).Seconds())
+	}()
+	return fi.Sync()
+}
+
 func scanForLastSeq(fi *os.File, end int64) (int64, error) {
 	scratch := make([]byte, headerSize)
 
@@ -278,6 +365,7 @@ const (
 	evtKindTombstone = 3
 	evtKindIdentity  = 4
 	evtKindAccount   = 5
+	evtKindSync      = 6
 )
 
 var emptyHeader = make([]byte, headerSize)
@@ -291,7 +379,7 @@ func (dp *DiskPersistence) addJobToQueue(ctx context.Context, job persistJob) er
 	}
 
 	// TODO: for some reason replacing this constant with p.writeBufferSize dramatically reduces perf...
-	if len(dp.evtbuf) > 400 {
+	if dp.syncWrites || len(dp.evtbuf) > 400 {
 		if err := dp.flushLog(ctx); err != nil {
 			return fmt.Errorf("failed to flush disk log: %w", err)
 		}
@@ -301,18 +389,20 @@ func (dp *DiskPersistence) addJobToQueue(ctx context.Context, job persistJob) er
 }
 
 func (dp *DiskPersistence) flushRoutine() {
-	t := time.NewTicker(time.Millisecond * 100)
+	t := dp.clock.NewTicker(time.Millisecond * 100)
+	defer t.Stop()
 
 	for {
 		ctx := context.Background()
 		select {
 		case <-dp.shutdown:
 			return
-		case <-t.C:
+		case <-t.C():
 			dp.lk.Lock()
 			if err := dp.flushLog(ctx); err != nil {
 				// TODO: this happening is quite bad. Need a recovery strategy
 				log.Errorf("failed to flush disk log: %s", err)
+				recordPersistFailure("flush")
 			}
 			dp.lk.Unlock()
 		}
@@ -324,13 +414,23 @@ func (dp *DiskPersistence) flushLog(ctx context.Context) error {
 		return nil
 	}
 
+	start := time.Now()
 	_, err := io.Copy(dp.logfi, dp.outbuf)
 	if err != nil {
 		return err
 	}
+	persisterWriteDuration.WithLabelValues("disk").Observe(time.Since(start).Seconds())
+	persisterWriteEvents.WithLabelValues("disk").Add(float64(len(dp.evtbuf)))
 
 	dp.outbuf.Truncate(0)
 
+	if dp.timeIndexInterval > 0 && dp.clock.Since(dp.lastTimeMark) >= dp.timeIndexInterval {
+		dp.markTime(ctx, sequenceForEvent(dp.evtbuf[0].Evt))
+	}
+	if dp.repoIndex {
+		dp.indexRepoEvents(ctx, dp.evtbuf)
+	}
+
 	for _, ej := range dp.evtbuf {
 		dp.broadcast(ej.Evt)
 		ej.Buffer.Truncate(0)
@@ -338,12 +438,52 @@ func (dp *DiskPersistence) flushLog(ctx context.Context) error {
 	}
 
 	dp.evtbuf = dp.evtbuf[:0]
+	dp.unflushed.Store(0)
 
 	return nil
 }
 
+// markTime records that the event with sequence number seq has been written
+// out. Failing to is logged rather than failing the flush, as it only makes
+// time lookups less precise.
+func (dp *DiskPersistence) markTime(ctx context.Context, seq int64) {
+	now := dp.clock.Now()
+	if err := dp.meta.WithContext(ctx).Create(&LogFileTimeMark{
+		LogFile: dp.logRef,
+		Seq:     seq,
+		Time:    now,
+	}).Error; err != nil {
+		log.Errorw("failed to record event log time mark", "seq", seq, "err", err)
+		return
+	}
+	dp.lastTimeMark = now
+}
+
+// SeqForTime uses the latest time mark and log file created no later than t:
+// every event before either was written out before t
+func (dp *DiskPersistence) SeqForTime(ctx context.Context, t time.Time) (int64, error) {
+	var mark LogFileTimeMark
+	if err := dp.meta.WithContext(ctx).Order("time desc").Limit(1).Find(&mark, "time <= ?", t).Error; err != nil {
+		return 0, err
+	}
+	var ref LogFileRef
+	if err := dp.meta.WithContext(ctx).Order("created_at desc").Limit(1).Find(&ref, "created_at <= ?", t).Error; err != nil {
+		return 0, err
+	}
+
+	var cur int64
+	if mark.ID != 0 {
+		cur = mark.Seq - 1
+	}
+	if ref.ID != 0 && ref.SeqStart-1 > cur {
+		cur = ref.SeqStart - 1
+	}
+	return max(cur, 0), nil
+}
+
 func (dp *DiskPersistence) garbageCollectRoutine() {
-	t := time.NewTicker(time.Hour)
+	t := dp.clock.NewTicker(time.Hour)
+	defer t.Stop()
 
 	for {
 		ctx := context.Background()
@@ -351,12 +491,15 @@ func (dp *DiskPersistence) garbageCollectRoutine() {
 		// Closing a channel can be listened to with multiple routines: https://goplay.tools/snippet/UcwbC0CeJAL
 		case <-dp.shutdown:
 			return
-		case <-t.C:
+		case <-t.C():
 			if errs := dp.garbageCollect(ctx); len(errs) > 0 {
 				for _, err := range errs {
 					log.Errorf("garbage collection error: %s", err)
 				}
 			}
+			if err := dp.Compact(ctx); err != nil {
+				log.Errorw("event log compaction failed", "err", err)
+			}
 		}
 	}
 }
@@ -383,6 +526,10 @@ var filesGarbageCollected = promauto.NewCounterVec(prometheus.CounterOpts{
 
 func (dp *DiskPersistence) garbageCollect(ctx context.Context) []error {
 	garbageCollectionsExecuted.WithLabelValues().Inc()
+	start := time.Now()
+	defer func() {
+		diskPersisterGCDuration.Observe(time.Since(start).Seconds())
+	}()
 
 	// Grab refs created before the retention period
 	var refs []LogFileRef
@@ -392,7 +539,7 @@ func (dp *DiskPersistence) garbageCollect(ctx context.Context) []error {
 		garbageCollectionErrors.WithLabelValues().Add(float64(len(errs)))
 	}()
 
-	if err := dp.meta.WithContext(ctx).Find(&refs, "created_at < ?", time.Now().Add(-dp.retention)).Error; err != nil {
+	if err := dp.meta.WithContext(ctx).Find(&refs, "created_at < ?", dp.clock.Now().Add(-dp.retention)).Error; err != nil {
 		return []error{err}
 	}
 
@@ -419,6 +566,15 @@ func (dp *DiskPersistence) garbageCollect(ctx context.Context) []error {
 		}
 		refsDeleted++
 
+		if err := dp.meta.WithContext(ctx).Where("log_file = ?", r.ID).Delete(&LogFileTimeMark{}).Error; err != nil {
+			errs = append(errs, err)
+		}
+		if dp.repoIndex {
+			if err := dp.meta.WithContext(ctx).Where("log_file = ?", r.ID).Delete(&RepoEventRef{}).Error; err != nil {
+				errs = append(errs, err)
+			}
+		}
+
 		// Delete the file from disk
 		if err := os.Remove(filepath.Join(dp.primaryDir, r.Path)); err != nil {
 			errs = append(errs, err)
@@ -443,7 +599,14 @@ func (dp *DiskPersistence) doPersist(ctx context.Context, j persistJob) error {
 	b := j.Bytes
 	e := j.Evt
 	seq := dp.curSeq
-	dp.curSeq++
+	if j.Seq != 0 {
+		if j.Seq < seq {
+			return fmt.Errorf("event seq %d is behind the log (next seq %d)", j.Seq, seq)
+		}
+		seq = j.Seq
+	}
+	prev := dp.curSeq - 1
+	dp.curSeq = seq + 1
 
 	// Set sequence number in event header
 	binary.LittleEndian.PutUint64(b[20:], uint64(seq))
@@ -457,6 +620,8 @@ func (dp *DiskPersistence) doPersist(ctx context.Context, j persistJob) error {
 		e.RepoIdentity.Seq = seq
 	case e.RepoAccount != nil:
 		e.RepoAccount.Seq = seq
+	case e.RepoSync != nil:
+		e.RepoSync.Seq = seq
 	case e.RepoTombstone != nil:
 		e.RepoTombstone.Seq = seq
 	default:
@@ -472,8 +637,11 @@ func (dp *DiskPersistence) doPersist(ctx context.Context, j persistJob) error {
 	}
 
 	dp.evtbuf = append(dp.evtbuf, j)
+	dp.unflushed.Store(int64(len(dp.evtbuf)))
 
-	if seq%dp.eventsPerFile == 0 {
+	// roll when crossing a multiple of eventsPerFile, which imported seqs
+	// may skip over
+	if seq/dp.eventsPerFile > prev/dp.eventsPerFile {
 		if err := dp.flushLog(ctx); err != nil {
 			return err
 		}
@@ -488,6 +656,21 @@ func (dp *DiskPersistence) doPersist(ctx context.Context, j persistJob) error {
 }
 
 func (dp *DiskPersistence) Persist(ctx context.Context, e *XRPCStreamEvent) error {
+	return dp.persist(ctx, e, 0)
+}
+
+// PersistWithSeq persists an event that another persister has already
+// sequenced, keeping its sequence number. Sequence numbers must increase, but
+// may have gaps. Used to build up history while migrating between persisters.
+func (dp *DiskPersistence) PersistWithSeq(ctx context.Context, e *XRPCStreamEvent) error {
+	seq := sequenceForEvent(e)
+	if seq <= 0 {
+		return fmt.Errorf("event has no sequence number")
+	}
+	return dp.persist(ctx, e, seq)
+}
+
+func (dp *DiskPersistence) persist(ctx context.Context, e *XRPCStreamEvent, seq int64) error {
 	buffer := dp.buffers.Get().(*bytes.Buffer)
 	cw := dp.writers.Get().(*cbg.CborWriter)
 	cw.SetWriter(buffer)
@@ -523,6 +706,12 @@ func (dp *DiskPersistence) Persist(ctx context.Context, e *XRPCStreamEvent) erro
 		if err := e.RepoAccount.MarshalCBOR(cw); err != nil {
 			return fmt.Errorf("failed to marshal: %w", err)
 		}
+	case e.RepoSync != nil:
+		evtKind = evtKindSync
+		did = e.RepoSync.Did
+		if err := e.RepoSync.MarshalCBOR(cw); err != nil {
+			return fmt.Errorf("failed to marshal: %w", err)
+		}
 	case e.RepoTombstone != nil:
 		evtKind = evtKindTombstone
 		did = e.RepoTombstone.Did
@@ -554,6 +743,8 @@ func (dp *DiskPersistence) Persist(ctx context.Context, e *XRPCStreamEvent) erro
 		Bytes:  b,
 		Evt:    e,
 		Buffer: buffer,
+		Seq:    seq,
+		Usr:    usr,
 	})
 }
 
@@ -632,6 +823,7 @@ func (dp *DiskPersistence) uidForDid(ctx context.Context, did string) (models.Ui
 }
 
 func (dp *DiskPersistence) Playback(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error) error {
+	cb = observePlayback("disk", cb)
 	base := since - (since % dp.eventsPerFile)
 	var logs []LogFileRef
 	if err := dp.meta.Debug().Order("seq_start asc").Find(&logs, "seq_start >= ?", base).Error; err != nil {
@@ -677,7 +869,7 @@ func (dp *DiskPersistence) PlaybackLogfiles(ctx context.Context, since int64, cb
 }
 
 func postDoNotEmit(flags uint32) bool {
-	if flags&(EvtFlagRebased|EvtFlagTakedown) != 0 {
+	if flags&(EvtFlagRebased|EvtFlagTakedown|EvtFlagCompacted) != 0 {
 		return true
 	}
 
@@ -768,6 +960,15 @@ func (dp *DiskPersistence) readEventsFrom(ctx context.Context, since int64, fn s
 			if err := cb(&XRPCStreamEvent{RepoAccount: &evt}); err != nil {
 				return nil, err
 			}
+		case evtKindSync:
+			var evt atproto.SyncSubscribeRepos_Sync
+			if err := evt.UnmarshalCBOR(io.LimitReader(bufr, h.Len64())); err != nil {
+				return nil, err
+			}
+			evt.Seq = h.Seq
+			if err := cb(&XRPCStreamEvent{RepoSync: &evt}); err != nil {
+				return nil, err
+			}
 		case evtKindTombstone:
 			var evt atproto.SyncSubscribeRepos_Tombstone
 			if err := evt.UnmarshalCBOR(io.LimitReader(bufr, h.Len64())); err != nil {
@@ -802,6 +1003,12 @@ func (dp *DiskPersistence) TakeDownRepo(ctx context.Context, usr models.Uid) err
 		}
 	*/
 
+	if dp.repoIndex {
+		if err := dp.meta.WithContext(ctx).Where("usr = ?", usr).Delete(&RepoEventRef{}).Error; err != nil {
+			return err
+		}
+	}
+
 	return dp.forEachShardWithUserEvents(ctx, usr, func(ctx context.Context, fn string) error {
 		if err := dp.deleteEventsForUser(ctx, usr, fn); err != nil {
 			return err
@@ -859,12 +1066,15 @@ func (dp *DiskPersistence) deleteEventsForUser(ctx context.Context, usr models.U
 }
 
 func (dp *DiskPersistence) mutateUserEventsInLog(ctx context.Context, usr models.Uid, fn string, flag uint32, zeroEvts bool) error {
+	dp.rewriteLk.Lock()
+	defer dp.rewriteLk.Unlock()
+
 	fi, err := os.OpenFile(fn, os.O_RDWR, 0)
 	if err != nil {
 		return fmt.Errorf("failed to open log file: %w", err)
 	}
 	defer fi.Close()
-	defer fi.Sync()
+	defer syncLogFile(fi)
 
 	scratch := make([]byte, headerSize)
 	var offset int64
@@ -889,7 +1099,7 @@ func (dp *DiskPersistence) mutateUserEventsInLog(ctx context.Context, usr models
 
 			if zeroEvts {
 				// sync that write before blanking the event data
-				if err := fi.Sync(); err != nil {
+				if err := syncLogFile(fi); err != nil {
 					return err
 				}
 
@@ -927,10 +1137,17 @@ func (dp *DiskPersistence) Shutdown(ctx context.Context) error {
 		return err
 	}
 
+	if err := syncLogFile(dp.logfi); err != nil {
+		log.Errorw("failed to sync event log file on shutdown", "err", err)
+	}
 	dp.logfi.Close()
 	return nil
 }
 
+func (dp *DiskPersistence) Unflushed() int {
+	return int(dp.unflushed.Load())
+}
+
 func (dp *DiskPersistence) SetEventBroadcaster(f func(*XRPCStreamEvent)) {
 	dp.broadcast = f
 }
@@ -3,6 +3,7 @@ package events_test
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -20,6 +21,9 @@ import (
 	"github.com/bluesky-social/indigo/pds"
 	"github.com/bluesky-social/indigo/repomgr"
 	"github.com/bluesky-social/indigo/util"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/prometheus/client_golang/prometheus"
 	"gorm.io/gorm"
 )
 
@@ -510,3 +514,500 @@ func runTakedownTest(t *testing.T, cs carstore.CarStore, db *gorm.DB, p events.E
 		t.Fatalf("wrong number of events out: %d != %d", evtsCount, exp)
 	}
 }
+
+func TestDiskPersistSeqForTime(t *testing.T) {
+	ctx := context.Background()
+
+	db, _, _, tempPath, err := setupDBs(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempPath)
+
+	db.AutoMigrate(&models.ActorInfo{})
+	db.Create(&models.ActorInfo{Uid: 1, Did: "did:example:123"})
+
+	dp, err := events.NewDiskPersistence(filepath.Join(tempPath, "diskPrimary"), filepath.Join(tempPath, "diskArchive"), db, &events.DiskPersistOptions{
+		EventsPerFile:     4,
+		UIDCacheSize:      100,
+		DIDCacheSize:      100,
+		TimeIndexInterval: time.Nanosecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	evtman := events.NewEventManager(dp)
+
+	add := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := evtman.AddEvent(ctx, &events.XRPCStreamEvent{RepoIdentity: &atproto.SyncSubscribeRepos_Identity{
+				Did:  "did:example:123",
+				Time: time.Now().Format(util.ISO8601),
+			}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := dp.Flush(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	before := time.Now().Add(-time.Second)
+	add(6)
+	time.Sleep(20 * time.Millisecond)
+	mid := time.Now()
+	time.Sleep(20 * time.Millisecond)
+	add(6)
+
+	if seq, err := evtman.SeqForTime(ctx, before); err != nil || seq != 0 {
+		t.Fatalf("expected cursor 0 before any events, got %d (%v)", seq, err)
+	}
+
+	seq, err := evtman.SeqForTime(ctx, mid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every event written after mid must be played back, and not much before
+	if seq > 6 || seq < 5 {
+		t.Fatalf("expected cursor 5 or 6, got %d", seq)
+	}
+	var played []int64
+	if err := dp.Playback(ctx, seq, func(evt *events.XRPCStreamEvent) error {
+		played = append(played, evt.Sequence())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(played) == 0 || played[0] != seq+1 || played[len(played)-1] != 12 {
+		t.Fatalf("expected playback from %d to 12, got %v", seq+1, played)
+	}
+}
+
+func TestEventManagerReplay(t *testing.T) {
+	ctx := context.Background()
+
+	db, _, _, tempPath, err := setupDBs(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempPath)
+
+	db.AutoMigrate(&models.ActorInfo{})
+	db.Create(&models.ActorInfo{Uid: 1, Did: "did:example:123"})
+
+	dp, err := events.NewDiskPersistence(filepath.Join(tempPath, "diskPrimary"), filepath.Join(tempPath, "diskArchive"), db, &events.DiskPersistOptions{
+		EventsPerFile: 4,
+		UIDCacheSize:  100,
+		DIDCacheSize:  100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	evtman := events.NewEventManager(dp)
+
+	for i := 0; i < 10; i++ {
+		if err := evtman.AddEvent(ctx, &events.XRPCStreamEvent{RepoIdentity: &atproto.SyncSubscribeRepos_Identity{
+			Did:  "did:example:123",
+			Time: time.Now().Format(util.ISO8601),
+		}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dp.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// a range spanning log files
+	var played []int64
+	if err := evtman.Replay(ctx, 2, 7, func(evt *events.XRPCStreamEvent) error {
+		played = append(played, evt.Sequence())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(played) != "[3 4 5 6 7]" {
+		t.Fatalf("expected events 3 to 7, got %v", played)
+	}
+
+	// errors from the callback stop the replay
+	stop := fmt.Errorf("stop")
+	played = nil
+	err = evtman.Replay(ctx, 0, 10, func(evt *events.XRPCStreamEvent) error {
+		played = append(played, evt.Sequence())
+		if len(played) == 2 {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) || len(played) != 2 {
+		t.Fatalf("expected replay to stop after 2 events with the callback's error, got %v after %v", err, played)
+	}
+}
+
+func TestDiskPersistSyncWrites(t *testing.T) {
+	ctx := context.Background()
+
+	db, _, _, tempPath, err := setupDBs(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempPath)
+
+	db.AutoMigrate(&models.ActorInfo{})
+	db.Create(&models.ActorInfo{Uid: 1, Did: "did:example:123"})
+
+	dp, err := events.NewDiskPersistence(filepath.Join(tempPath, "diskPrimary"), filepath.Join(tempPath, "diskArchive"), db, &events.DiskPersistOptions{
+		EventsPerFile: 4,
+		UIDCacheSize:  100,
+		DIDCacheSize:  100,
+		SyncWrites:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	evtman := events.NewEventManager(dp)
+	defer evtman.Shutdown(ctx)
+
+	for i := 0; i < 5; i++ {
+		if err := evtman.AddEvent(ctx, &events.XRPCStreamEvent{RepoIdentity: &atproto.SyncSubscribeRepos_Identity{
+			Did:  "did:example:123",
+			Time: time.Now().Format(util.ISO8601),
+		}}); err != nil {
+			t.Fatal(err)
+		}
+		// written out without waiting for a flush
+		if n := evtman.Unflushed(); n != 0 {
+			t.Fatalf("expected no unflushed events after event %d, got %d", i+1, n)
+		}
+	}
+
+	var played int
+	if err := dp.Playback(ctx, 0, func(evt *events.XRPCStreamEvent) error {
+		played++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if played != 5 {
+		t.Fatalf("expected 5 events played back, got %d", played)
+	}
+}
+
+func TestDiskPersistSyncEvents(t *testing.T) {
+	ctx := context.Background()
+
+	db, _, _, tempPath, err := setupDBs(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempPath)
+
+	db.AutoMigrate(&models.ActorInfo{})
+	db.Create(&models.ActorInfo{Uid: 1, Did: "did:example:123"})
+
+	dp, err := events.NewDiskPersistence(filepath.Join(tempPath, "diskPrimary"), filepath.Join(tempPath, "diskArchive"), db, &events.DiskPersistOptions{
+		EventsPerFile: 10,
+		UIDCacheSize:  100,
+		DIDCacheSize:  100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	evtman := events.NewEventManager(dp)
+
+	if err := evtman.AddEvent(ctx, &events.XRPCStreamEvent{RepoSync: &atproto.SyncSubscribeRepos_Sync{
+		Did:    "did:example:123",
+		Rev:    "3kabcdefghijk",
+		Blocks: []byte("commit"),
+		Time:   time.Now().Format(util.ISO8601),
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dp.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var played []*atproto.SyncSubscribeRepos_Sync
+	if err := dp.Playback(ctx, 0, func(evt *events.XRPCStreamEvent) error {
+		if evt.RepoSync != nil {
+			played = append(played, evt.RepoSync)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(played) != 1 || played[0].Seq != 1 || played[0].Rev != "3kabcdefghijk" || string(played[0].Blocks) != "commit" {
+		t.Fatalf("unexpected sync events played back: %+v", played)
+	}
+}
+
+func TestDiskPersistRepoHistory(t *testing.T) {
+	ctx := context.Background()
+
+	db, _, _, tempPath, err := setupDBs(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempPath)
+
+	db.AutoMigrate(&models.ActorInfo{})
+	db.Create(&models.ActorInfo{Uid: 1, Did: "did:example:123"})
+	db.Create(&models.ActorInfo{Uid: 2, Did: "did:example:456"})
+
+	dp, err := events.NewDiskPersistence(filepath.Join(tempPath, "diskPrimary"), filepath.Join(tempPath, "diskArchive"), db, &events.DiskPersistOptions{
+		EventsPerFile: 4,
+		UIDCacheSize:  100,
+		DIDCacheSize:  100,
+		RepoIndex:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	evtman := events.NewEventManager(dp)
+	defer evtman.Shutdown(ctx)
+
+	now := time.Now().Format(util.ISO8601)
+	for i := 0; i < 3; i++ {
+		for _, did := range []string{"did:example:123", "did:example:456"} {
+			if err := evtman.AddEvent(ctx, &events.XRPCStreamEvent{RepoSync: &atproto.SyncSubscribeRepos_Sync{
+				Did:    did,
+				Rev:    fmt.Sprintf("rev%d", i),
+				Blocks: []byte("commit"),
+				Time:   now,
+			}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := evtman.AddEvent(ctx, &events.XRPCStreamEvent{RepoIdentity: &atproto.SyncSubscribeRepos_Identity{
+		Did:  "did:example:123",
+		Time: now,
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dp.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the latest events, newest first, across log files
+	hist, err := evtman.RepoHistory(ctx, 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hist) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(hist))
+	}
+	if hist[0].Seq != 7 || hist[0].Type != "#identity" || hist[0].Rev != "" || hist[0].Time == nil {
+		t.Fatalf("unexpected latest event: %+v", hist[0])
+	}
+	if hist[1].Seq != 5 || hist[1].Type != "#sync" || hist[1].Rev != "rev2" || hist[2].Seq != 3 || hist[2].Rev != "rev1" {
+		t.Fatalf("unexpected sync events: %+v %+v", hist[1], hist[2])
+	}
+
+	// taken down repos' history goes with their events
+	if err := dp.TakeDownRepo(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	hist, err = evtman.RepoHistory(ctx, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hist) != 0 {
+		t.Fatalf("expected no history after takedown, got %d events", len(hist))
+	}
+	hist, err = evtman.RepoHistory(ctx, 2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hist) != 3 {
+		t.Fatalf("expected the other repo's 3 events, got %d", len(hist))
+	}
+
+	// persisters without the index say so
+	mem := events.NewEventManager(events.NewMemPersister())
+	if _, err := mem.RepoHistory(ctx, 1, 10); !errors.Is(err, events.ErrNoRepoHistory) {
+		t.Fatalf("expected ErrNoRepoHistory, got %v", err)
+	}
+}
+
+// metricCount sums the values of a counter, or the sample counts of a
+// histogram, across its labels
+func metricCount(t *testing.T, name string) float64 {
+	t.Helper()
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n float64
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if c := m.GetCounter(); c != nil {
+				n += c.GetValue()
+			}
+			if h := m.GetHistogram(); h != nil {
+				n += float64(h.GetSampleCount())
+			}
+		}
+	}
+	return n
+}
+
+func TestDiskPersistMetrics(t *testing.T) {
+	ctx := context.Background()
+
+	db, _, _, tempPath, err := setupDBs(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempPath)
+
+	db.AutoMigrate(&models.ActorInfo{})
+	db.Create(&models.ActorInfo{Uid: 1, Did: "did:example:123"})
+
+	dp, err := events.NewDiskPersistence(filepath.Join(tempPath, "diskPrimary"), filepath.Join(tempPath, "diskArchive"), db, &events.DiskPersistOptions{
+		EventsPerFile: 4,
+		UIDCacheSize:  100,
+		DIDCacheSize:  100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	evtman := events.NewEventManager(dp)
+
+	names := []string{
+		"indigo_events_persister_write_duration_seconds",
+		"indigo_events_persister_written_total",
+		"indigo_events_persister_playback_event_age_seconds",
+		"indigo_events_disk_persister_fsync_duration_seconds",
+		"indigo_events_disk_persister_segment_rollovers_total",
+	}
+	before := make(map[string]float64)
+	for _, name := range names {
+		before[name] = metricCount(t, name)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := evtman.AddEvent(ctx, &events.XRPCStreamEvent{RepoIdentity: &atproto.SyncSubscribeRepos_Identity{
+			Did:  "did:example:123",
+			Time: time.Now().Add(-time.Hour).Format(util.ISO8601),
+		}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := dp.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dp.Playback(ctx, 0, func(evt *events.XRPCStreamEvent) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]float64{
+		"indigo_events_persister_write_duration_seconds":       10,
+		"indigo_events_persister_written_total":                10,
+		"indigo_events_persister_playback_event_age_seconds":   10,
+		"indigo_events_disk_persister_fsync_duration_seconds":  2,
+		"indigo_events_disk_persister_segment_rollovers_total": 2,
+	}
+	for _, name := range names {
+		if got := metricCount(t, name) - before[name]; got != want[name] {
+			t.Errorf("expected %s to grow by %v, got %v", name, want[name], got)
+		}
+	}
+}
+
+func TestDiskPersistCompaction(t *testing.T) {
+	ctx := context.Background()
+
+	db, _, _, tempPath, err := setupDBs(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempPath)
+
+	db.AutoMigrate(&models.ActorInfo{})
+	db.Create(&models.ActorInfo{Uid: 1, Did: "did:example:one"})
+	db.Create(&models.ActorInfo{Uid: 2, Did: "did:example:two"})
+
+	dp, err := events.NewDiskPersistence(filepath.Join(tempPath, "diskPrimary"), filepath.Join(tempPath, "diskArchive"), db, &events.DiskPersistOptions{
+		EventsPerFile: 20,
+		UIDCacheSize:  100,
+		DIDCacheSize:  100,
+		Compaction:    events.CompactionLatestPerHour,
+		CompactAfter:  time.Nanosecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	evtman := events.NewEventManager(dp)
+
+	// commits from two repos over two hours fill the first log file, with a
+	// couple of other events at the end, and one more starts the next file
+	hour := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	head, err := cid.NewPrefixV1(cid.DagCBOR, multihash.SHA2_256).Sum([]byte("head"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 21; i++ {
+		var evt *events.XRPCStreamEvent
+		if i < 18 {
+			repo := "did:example:one"
+			if i%2 == 1 {
+				repo = "did:example:two"
+			}
+			ts := hour.Add(time.Duration(i) * time.Minute)
+			if i >= 10 {
+				ts = ts.Add(time.Hour)
+			}
+			evt = &events.XRPCStreamEvent{RepoCommit: &atproto.SyncSubscribeRepos_Commit{
+				Repo:   repo,
+				Commit: lexutil.LexLink(head),
+				Rev:    fmt.Sprintf("rev%d", i),
+				Time:   ts.Format(util.ISO8601),
+			}}
+		} else {
+			evt = &events.XRPCStreamEvent{RepoIdentity: &atproto.SyncSubscribeRepos_Identity{
+				Did:  "did:example:one",
+				Time: time.Now().Format(util.ISO8601),
+			}}
+		}
+		if err := evtman.AddEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dp.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dp.Compact(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var played []int64
+	if err := dp.Playback(ctx, 0, func(evt *events.XRPCStreamEvent) error {
+		played = append(played, evt.Sequence())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the latest commit of each repo in each hour, and everything else
+	want := []int64{9, 10, 17, 18, 19, 20, 21}
+	if !reflect.DeepEqual(played, want) {
+		t.Fatalf("expected playback of %v after compaction, got %v", want, played)
+	}
+
+	// compacting again leaves the file alone
+	if err := dp.Compact(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var refs []events.LogFileRef
+	if err := db.Order("seq_start asc").Find(&refs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 2 || !refs[0].Compacted || refs[1].Compacted {
+		t.Fatalf("expected only the finished log file to be compacted, got %+v", refs)
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	comatproto "github.com/bluesky-social/indigo/api/atproto"
@@ -27,20 +29,45 @@ type Scheduler interface {
 }
 
 type EventManager struct {
-	subs   []*Subscriber
-	subsLk sync.Mutex
+	// live subscribers are spread across fanout shards, each with its own
+	// goroutine delivering events, so that a broadcast doesn't walk every
+	// subscriber serially under one lock
+	shards       []*fanoutShard
+	numShards    int
+	shardsOnce   sync.Once
+	shardsClosed chan struct{}
 
 	bufferSize          int
 	crossoverBufferSize int
 
 	persister EventPersistence
+
+	epochs *CursorEpochs
+
+	frameCache *FrameCache
+
+	sinks []EventSink
+
+	middleware []EventMiddleware
+
+	// set in chronological order mode
+	reorder *reorderBuffer
+
+	lastSeq atomic.Int64
 }
 
+// DefaultFanoutShards is the number of fanout shards used unless
+// SetFanoutShards is called
+var DefaultFanoutShards = runtime.GOMAXPROCS(0)
+
 func NewEventManager(persister EventPersistence) *EventManager {
 	em := &EventManager{
-		bufferSize:          16 << 10,
+		bufferSize:          DefaultSubscriberBufferSize,
 		crossoverBufferSize: 512,
 		persister:           persister,
+		numShards:           DefaultFanoutShards,
+		shardsClosed:        make(chan struct{}),
+		frameCache:          NewFrameCache(DefaultFrameCacheSize),
 	}
 
 	persister.SetEventBroadcaster(em.broadcastEvent)
@@ -48,6 +75,92 @@ func NewEventManager(persister EventPersistence) *EventManager {
 	return em
 }
 
+// DefaultFrameCacheSize is how many recent serialized frames are kept for
+// reuse by subscribers playing back from a cursor
+const DefaultFrameCacheSize = 16 << 10
+
+// SetFrameCacheSize resizes the cache of recently broadcast frames; zero
+// disables it. Must be called before any events are broadcast.
+func (em *EventManager) SetFrameCacheSize(n int) {
+	if n <= 0 {
+		em.frameCache = nil
+		return
+	}
+	em.frameCache = NewFrameCache(n)
+}
+
+// DefaultSubscriberBufferSize is how many live events are queued for each
+// subscriber before it's dropped as too slow
+const DefaultSubscriberBufferSize = 16 << 10
+
+// SetSubscriberBufferSize sets how many live events are queued for each
+// subscriber before it's dropped as too slow. Must be called before anything
+// subscribes.
+func (em *EventManager) SetSubscriberBufferSize(n int) {
+	if n < 1 {
+		n = 1
+	}
+	em.bufferSize = n
+}
+
+// SetFanoutShards sets how many goroutines live events are delivered to
+// subscribers from. Must be called before anything subscribes.
+func (em *EventManager) SetFanoutShards(n int) {
+	if n < 1 {
+		n = 1
+	}
+	em.numShards = n
+}
+
+// SetCursorEpochs enables cursor tokens, and validation of the epoch they carry
+func (em *EventManager) SetCursorEpochs(ce *CursorEpochs) {
+	em.epochs = ce
+}
+
+// EventSink is handed every broadcast event, to export it elsewhere
+type EventSink interface {
+	// Enqueue must not block, or it holds up the firehose
+	Enqueue(evt *XRPCStreamEvent)
+	// Shutdown finishes exporting everything enqueued
+	Shutdown(ctx context.Context) error
+}
+
+// AddSink exports every broadcast event to the sink, which is shut down along
+// with the event manager. Must be called before any events are broadcast.
+func (em *EventManager) AddSink(sink EventSink) {
+	em.sinks = append(em.sinks, sink)
+}
+
+// LastSeq returns the sequence number of the most recently broadcast event, or
+// zero if none has been broadcast since startup
+func (em *EventManager) LastSeq() int64 {
+	return em.lastSeq.Load()
+}
+
+// SeqForTime returns a cursor which plays back the events persisted from t
+// on, for consumers that want to start from a point in time rather than a
+// sequence number
+func (em *EventManager) SeqForTime(ctx context.Context, t time.Time) (int64, error) {
+	return em.persister.SeqForTime(ctx, t)
+}
+
+// CursorEpochs returns the epoch tracker, or nil if cursor tokens are disabled
+func (em *EventManager) CursorEpochs() *CursorEpochs {
+	return em.epochs
+}
+
+// ValidateCursor checks that a cursor refers to history this event manager
+// can serve. Bare integer cursors are always accepted.
+func (em *EventManager) ValidateCursor(c *Cursor) error {
+	if c.Epoch == 0 {
+		return nil
+	}
+	if em.epochs == nil {
+		return &CursorError{Name: CursorErrInvalid, Message: "cursor tokens are not supported here"}
+	}
+	return em.epochs.Validate(c)
+}
+
 const (
 	opSubscribe = iota
 	opUnsubscribe
@@ -60,27 +173,76 @@ type Operation struct {
 	evt *XRPCStreamEvent
 }
 
+// Unflushed returns the number of events that have been added but not yet
+// written out, held for ordering or buffered by the persister
+func (em *EventManager) Unflushed() int {
+	var n int
+	if em.reorder != nil {
+		n = em.reorder.buffered()
+	}
+	if uc, ok := em.persister.(UnflushedCounter); ok {
+		n += uc.Unflushed()
+	}
+	return n
+}
+
 func (em *EventManager) Shutdown(ctx context.Context) error {
-	return em.persister.Shutdown(ctx)
+	// events held for ordering go to the persister before its final flush
+	if em.reorder != nil {
+		em.reorder.close()
+	}
+	err := em.persister.Shutdown(ctx)
+	close(em.shardsClosed)
+	// after the persister, whose final flush broadcasts its last events
+	for _, sink := range em.sinks {
+		err = errors.Join(err, sink.Shutdown(ctx))
+	}
+	return err
 }
 
-func (em *EventManager) broadcastEvent(evt *XRPCStreamEvent) {
-	// the main thing we do is send it out, so MarshalCBOR once
-	if err := evt.Preserialize(); err != nil {
-		log.Errorf("broadcast serialize failed, %s", err)
-		// serialize isn't going to go better later, this event is cursed
-		return
+// fanoutShard delivers live events to a subset of the subscribers. Each event
+// is serialized once before it reaches the shards; subscribers are handed the
+// same event, and write its preserialized bytes.
+type fanoutShard struct {
+	id     string
+	events chan *XRPCStreamEvent
+
+	lk   sync.Mutex
+	subs []*Subscriber
+}
+
+// how many events may queue up for a shard before broadcasts block on it
+const fanoutShardQueueSize = 1024
+
+func (em *EventManager) startShards() {
+	em.shardsOnce.Do(func() {
+		for i := 0; i < em.numShards; i++ {
+			sh := &fanoutShard{
+				id:     fmt.Sprint(i),
+				events: make(chan *XRPCStreamEvent, fanoutShardQueueSize),
+			}
+			em.shards = append(em.shards, sh)
+			go sh.run(em.shardsClosed)
+		}
+	})
+}
+
+func (sh *fanoutShard) run(closed <-chan struct{}) {
+	for {
+		select {
+		case evt := <-sh.events:
+			sh.deliver(evt)
+		case <-closed:
+			return
+		}
 	}
+}
 
-	em.subsLk.Lock()
-	defer em.subsLk.Unlock()
+func (sh *fanoutShard) deliver(evt *XRPCStreamEvent) {
+	sh.lk.Lock()
+	defer sh.lk.Unlock()
 
-	// TODO: for a larger fanout we should probably have dedicated goroutines
-	// for subsets of the subscriber set, and tiered channels to distribute
-	// events out to them, or some similar architecture
-	// Alternatively, we might just want to not allow too many subscribers
-	// directly to the bgs, and have rebroadcasting proxies instead
-	for _, s := range em.subs {
+	for _, s := range sh.subs {
 		if s.filter(evt) {
 			s.enqueuedCounter.Inc()
 			select {
@@ -116,12 +278,49 @@ func (em *EventManager) broadcastEvent(evt *XRPCStreamEvent) {
 	}
 }
 
+func (em *EventManager) broadcastEvent(evt *XRPCStreamEvent) {
+	// persisters broadcast events once they're written out
+	evt.releaseAck()
+
+	// the main thing we do is send it out, so MarshalCBOR once
+	if err := evt.Preserialize(); err != nil {
+		log.Errorf("broadcast serialize failed, %s", err)
+		// serialize isn't going to go better later, this event is cursed
+		return
+	}
+
+	seq := sequenceForEvent(evt)
+	if seq > 0 {
+		em.lastSeq.Store(seq)
+	}
+	if em.epochs != nil {
+		em.epochs.observe(seq)
+	}
+	if em.frameCache != nil {
+		em.frameCache.Put(seq, evt.Preserialized)
+	}
+	for _, sink := range em.sinks {
+		sink.Enqueue(evt)
+	}
+
+	em.startShards()
+	for _, sh := range em.shards {
+		select {
+		case sh.events <- evt:
+		case <-em.shardsClosed:
+			return
+		}
+	}
+}
+
 func (em *EventManager) persistAndSendEvent(ctx context.Context, evt *XRPCStreamEvent) {
 	// TODO: can cut 5-10% off of disk persister benchmarks by making this function
 	// accept a uid. The lookup inside the persister is notably expensive (despite
 	// being an lru cache?)
 	if err := em.persister.Persist(ctx, evt); err != nil {
 		log.Errorf("failed to persist outbound event: %s", err)
+		recordPersistFailure("persist")
+		evt.failAck()
 	}
 }
 
@@ -134,6 +333,8 @@ type Subscriber struct {
 
 	cleanup func()
 
+	shard *fanoutShard
+
 	lk        sync.Mutex
 	cleanedUp bool
 
@@ -150,6 +351,8 @@ const (
 type EventHeader struct {
 	Op      int64  `cborgen:"op"`
 	MsgType string `cborgen:"t"`
+	// Integrity chain value, only sent on StreamVersion2 streams
+	Chain []byte `cborgen:"chain,omitempty"`
 }
 
 var (
@@ -169,6 +372,7 @@ type XRPCStreamEvent struct {
 	RepoMigrate   *comatproto.SyncSubscribeRepos_Migrate
 	RepoTombstone *comatproto.SyncSubscribeRepos_Tombstone
 	RepoAccount   *comatproto.SyncSubscribeRepos_Account
+	RepoSync      *comatproto.SyncSubscribeRepos_Sync
 	LabelLabels   *comatproto.LabelSubscribeLabels_Labels
 	LabelInfo     *comatproto.LabelSubscribeLabels_Info
 
@@ -177,46 +381,85 @@ type XRPCStreamEvent struct {
 	PrivPdsId       uint       `json:"-" cborgen:"-"`
 	PrivRelevantPds []uint     `json:"-" cborgen:"-"`
 	Preserialized   []byte     `json:"-" cborgen:"-"`
+
+	// released once the event has been persisted
+	ack *PersistAck
 }
 
 func (evt *XRPCStreamEvent) Serialize(wc io.Writer) error {
 	header := EventHeader{Op: EvtKindMessage}
 	var obj lexutil.CBOR
 
-	switch {
-	case evt.Error != nil:
+	if evt.Error != nil {
 		header.Op = EvtKindErrorFrame
 		obj = evt.Error
+	} else {
+		header.MsgType, obj = evt.message()
+		if obj == nil {
+			return fmt.Errorf("unrecognized event kind")
+		}
+	}
+
+	cborWriter := cbg.NewCborWriter(wc)
+	if err := header.MarshalCBOR(cborWriter); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+	return obj.MarshalCBOR(cborWriter)
+}
+
+// RepoDID returns the DID of the repo an event is about, or an empty string
+// for events that aren't about a repo
+func (evt *XRPCStreamEvent) RepoDID() string {
+	switch {
 	case evt.RepoCommit != nil:
-		header.MsgType = "#commit"
-		obj = evt.RepoCommit
+		return evt.RepoCommit.Repo
 	case evt.RepoHandle != nil:
-		header.MsgType = "#handle"
-		obj = evt.RepoHandle
+		return evt.RepoHandle.Did
 	case evt.RepoIdentity != nil:
-		header.MsgType = "#identity"
-		obj = evt.RepoIdentity
+		return evt.RepoIdentity.Did
 	case evt.RepoAccount != nil:
-		header.MsgType = "#account"
-		obj = evt.RepoAccount
-	case evt.RepoInfo != nil:
-		header.MsgType = "#info"
-		obj = evt.RepoInfo
+		return evt.RepoAccount.Did
+	case evt.RepoSync != nil:
+		return evt.RepoSync.Did
 	case evt.RepoMigrate != nil:
-		header.MsgType = "#migrate"
-		obj = evt.RepoMigrate
+		return evt.RepoMigrate.Did
 	case evt.RepoTombstone != nil:
-		header.MsgType = "#tombstone"
-		obj = evt.RepoTombstone
+		return evt.RepoTombstone.Did
 	default:
-		return fmt.Errorf("unrecognized event kind")
+		return ""
 	}
+}
 
-	cborWriter := cbg.NewCborWriter(wc)
-	if err := header.MarshalCBOR(cborWriter); err != nil {
-		return fmt.Errorf("failed to write header: %w", err)
+// MessageType returns the event's message type, eg "#commit", or an empty
+// string if it isn't a repo event
+func (evt *XRPCStreamEvent) MessageType() string {
+	t, _ := evt.message()
+	return t
+}
+
+// message returns the event's message type and body, or a nil body if it
+// isn't a repo event
+func (evt *XRPCStreamEvent) message() (string, lexutil.CBOR) {
+	switch {
+	case evt.RepoCommit != nil:
+		return "#commit", evt.RepoCommit
+	case evt.RepoHandle != nil:
+		return "#handle", evt.RepoHandle
+	case evt.RepoIdentity != nil:
+		return "#identity", evt.RepoIdentity
+	case evt.RepoAccount != nil:
+		return "#account", evt.RepoAccount
+	case evt.RepoSync != nil:
+		return "#sync", evt.RepoSync
+	case evt.RepoInfo != nil:
+		return "#info", evt.RepoInfo
+	case evt.RepoMigrate != nil:
+		return "#migrate", evt.RepoMigrate
+	case evt.RepoTombstone != nil:
+		return "#tombstone", evt.RepoTombstone
+	default:
+		return "", nil
 	}
-	return obj.MarshalCBOR(cborWriter)
 }
 
 // serialize content into Preserialized cache
@@ -242,6 +485,19 @@ func (em *EventManager) AddEvent(ctx context.Context, ev *XRPCStreamEvent) error
 	ctx, span := otel.Tracer("events").Start(ctx, "AddEvent")
 	defer span.End()
 
+	if ev = em.applyMiddleware(ctx, ev); ev == nil {
+		return nil
+	}
+
+	if ack := persistAckFrom(ctx); ack != nil && ack.add() {
+		ev.ack = ack
+	}
+
+	if em.reorder != nil {
+		em.reorder.add(ev, receivedAtFrom(ctx))
+		return nil
+	}
+
 	em.persistAndSendEvent(ctx, ev)
 	return nil
 }
@@ -286,6 +542,10 @@ func (em *EventManager) Subscribe(ctx context.Context, ident string, filter func
 		lastSeq := *since
 		// run playback to get through *most* of the events, getting our current cursor close to realtime
 		if err := em.persister.Playback(ctx, *since, func(e *XRPCStreamEvent) error {
+			if !filter(e) {
+				return nil
+			}
+			em.fillFromCache(e)
 			select {
 			case <-done:
 				return ErrPlaybackShutdown
@@ -319,6 +579,10 @@ func (em *EventManager) Subscribe(ctx context.Context, ident string, filter func
 			if seq > sequenceForEvent(first) {
 				return ErrCaughtUp
 			}
+			if !filter(e) {
+				return nil
+			}
+			em.fillFromCache(e)
 
 			select {
 			case <-done:
@@ -351,6 +615,12 @@ func (em *EventManager) Subscribe(ctx context.Context, ident string, filter func
 	return out, sub.cleanup, nil
 }
 
+// Sequence returns the event's sequence number, or -1 for events that don't
+// have one
+func (evt *XRPCStreamEvent) Sequence() int64 {
+	return sequenceForEvent(evt)
+}
+
 func sequenceForEvent(evt *XRPCStreamEvent) int64 {
 	switch {
 	case evt == nil:
@@ -365,6 +635,10 @@ func sequenceForEvent(evt *XRPCStreamEvent) int64 {
 		return evt.RepoTombstone.Seq
 	case evt.RepoIdentity != nil:
 		return evt.RepoIdentity.Seq
+	case evt.RepoAccount != nil:
+		return evt.RepoAccount.Seq
+	case evt.RepoSync != nil:
+		return evt.RepoSync.Seq
 	case evt.RepoInfo != nil:
 		return -1
 	case evt.Error != nil:
@@ -374,24 +648,92 @@ func sequenceForEvent(evt *XRPCStreamEvent) int64 {
 	}
 }
 
+// eventTime returns the time set on an event, if it has one
+func eventTime(evt *XRPCStreamEvent) (time.Time, bool) {
+	var ts string
+	switch {
+	case evt.RepoCommit != nil:
+		ts = evt.RepoCommit.Time
+	case evt.RepoHandle != nil:
+		ts = evt.RepoHandle.Time
+	case evt.RepoMigrate != nil:
+		ts = evt.RepoMigrate.Time
+	case evt.RepoTombstone != nil:
+		ts = evt.RepoTombstone.Time
+	case evt.RepoIdentity != nil:
+		ts = evt.RepoIdentity.Time
+	case evt.RepoAccount != nil:
+		ts = evt.RepoAccount.Time
+	case evt.RepoSync != nil:
+		ts = evt.RepoSync.Time
+	default:
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// Replay plays back the persisted events after since, up to and including
+// until, to cb, without subscribing to the live stream. It stops early if cb
+// returns an error.
+func (em *EventManager) Replay(ctx context.Context, since, until int64, cb func(*XRPCStreamEvent) error) error {
+	err := em.persister.Playback(ctx, since, func(e *XRPCStreamEvent) error {
+		if sequenceForEvent(e) > until {
+			return ErrCaughtUp
+		}
+		em.fillFromCache(e)
+		return cb(e)
+	})
+	if errors.Is(err, ErrCaughtUp) {
+		return nil
+	}
+	return err
+}
+
 func (em *EventManager) rmSubscriber(sub *Subscriber) {
-	em.subsLk.Lock()
-	defer em.subsLk.Unlock()
+	sh := sub.shard
+	if sh == nil {
+		return
+	}
 
-	for i, s := range em.subs {
+	sh.lk.Lock()
+	defer sh.lk.Unlock()
+
+	for i, s := range sh.subs {
 		if s == sub {
-			em.subs[i] = em.subs[len(em.subs)-1]
-			em.subs = em.subs[:len(em.subs)-1]
+			sh.subs[i] = sh.subs[len(sh.subs)-1]
+			sh.subs[len(sh.subs)-1] = nil
+			sh.subs = sh.subs[:len(sh.subs)-1]
+			fanoutShardSubscribers.WithLabelValues(sh.id).Dec()
 			break
 		}
 	}
 }
 
+// addSubscriber puts the subscriber on the shard with the fewest subscribers
 func (em *EventManager) addSubscriber(sub *Subscriber) {
-	em.subsLk.Lock()
-	defer em.subsLk.Unlock()
+	em.startShards()
+
+	var best *fanoutShard
+	bestLen := -1
+	for _, sh := range em.shards {
+		sh.lk.Lock()
+		n := len(sh.subs)
+		sh.lk.Unlock()
+		if bestLen < 0 || n < bestLen {
+			best, bestLen = sh, n
+		}
+	}
+
+	best.lk.Lock()
+	defer best.lk.Unlock()
 
-	em.subs = append(em.subs, sub)
+	sub.shard = best
+	best.subs = append(best.subs, sub)
+	fanoutShardSubscribers.WithLabelValues(best.id).Inc()
 }
 
 func (em *EventManager) TakeDownRepo(ctx context.Context, user models.Uid) error {
@@ -0,0 +1,136 @@
+package events_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+)
+
+func identityEvent(did string) *events.XRPCStreamEvent {
+	return &events.XRPCStreamEvent{RepoIdentity: &comatproto.SyncSubscribeRepos_Identity{Did: did, Time: "2024-01-01T00:00:00Z"}}
+}
+
+func TestFanoutShards(t *testing.T) {
+	ctx := context.Background()
+	em := events.NewEventManager(events.NewMemPersister())
+	em.SetFanoutShards(4)
+	defer em.Shutdown(ctx)
+
+	const nsubs = 50
+	const nevts = 20
+
+	var chans []<-chan *events.XRPCStreamEvent
+	for i := 0; i < nsubs; i++ {
+		ch, cleanup, err := em.Subscribe(ctx, fmt.Sprintf("sub-%d", i), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cleanup()
+		chans = append(chans, ch)
+	}
+
+	// one subscriber leaving shouldn't affect the others
+	gone, goneCleanup, err := em.Subscribe(ctx, "gone", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	goneCleanup()
+	if _, ok := <-gone; ok {
+		t.Fatal("expected closed channel after cleanup")
+	}
+
+	for i := 0; i < nevts; i++ {
+		if err := em.AddEvent(ctx, identityEvent(fmt.Sprintf("did:plc:%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, ch := range chans {
+		for j := 1; j <= nevts; j++ {
+			select {
+			case evt := <-ch:
+				if evt.RepoIdentity.Seq != int64(j) {
+					t.Fatalf("subscriber %d: expected seq %d, got %d", i, j, evt.RepoIdentity.Seq)
+				}
+				if evt.Preserialized == nil {
+					t.Fatalf("subscriber %d: event was not preserialized", i)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("subscriber %d: timed out waiting for seq %d", i, j)
+			}
+		}
+	}
+}
+
+func BenchmarkFanout(b *testing.B) {
+	for _, nsubs := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprint(nsubs), func(b *testing.B) {
+			ctx := context.Background()
+			em := events.NewEventManager(events.NewMemPersister())
+			defer em.Shutdown(ctx)
+
+			for i := 0; i < nsubs; i++ {
+				ch, cleanup, err := em.Subscribe(ctx, fmt.Sprintf("sub-%d", i), nil, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer cleanup()
+				go func() {
+					for range ch {
+					}
+				}()
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := em.AddEvent(ctx, identityEvent("did:plc:bench")); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSubscribeFilterPlayback(t *testing.T) {
+	ctx := context.Background()
+	em := events.NewEventManager(events.NewMemPersister())
+	defer em.Shutdown(ctx)
+
+	// the filter applies to events played back from the cursor, as well as
+	// live ones
+	for i := 0; i < 4; i++ {
+		if err := em.AddEvent(ctx, identityEvent(fmt.Sprintf("did:plc:%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	since := int64(0)
+	ch, cleanup, err := em.Subscribe(ctx, "sub", func(evt *events.XRPCStreamEvent) bool {
+		return evt.RepoIdentity.Seq%2 == 0
+	}, &since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	for i := 4; i < 8; i++ {
+		if err := em.AddEvent(ctx, identityEvent(fmt.Sprintf("did:plc:%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range []int64{2, 4, 6, 8} {
+		select {
+		case evt := <-ch:
+			if evt.RepoIdentity.Seq != want {
+				t.Fatalf("expected seq %d, got %d", want, evt.RepoIdentity.Seq)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for seq %d", want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package firehose
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bluesky-social/indigo/events"
+
+	"gorm.io/gorm"
+)
+
+// CursorStore persists a consumer's position in the event stream, along with
+// the epoch of the host's history it belongs to, if the host told us
+type CursorStore interface {
+	// Load returns the saved cursor, or the zero Cursor if there isn't one
+	Load(ctx context.Context) (events.Cursor, error)
+	Save(ctx context.Context, cur events.Cursor) error
+}
+
+// FileCursorStore keeps the cursor in a file, replaced atomically on save. It
+// holds a cursor token, or a bare sequence number when there's no epoch.
+type FileCursorStore struct {
+	path string
+}
+
+func NewFileCursorStore(path string) *FileCursorStore {
+	return &FileCursorStore{path: path}
+}
+
+func (fs *FileCursorStore) Load(ctx context.Context) (events.Cursor, error) {
+	b, err := os.ReadFile(fs.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return events.Cursor{}, nil
+		}
+		return events.Cursor{}, err
+	}
+
+	cur, err := events.ParseCursor(strings.TrimSpace(string(b)))
+	if err != nil {
+		return events.Cursor{}, fmt.Errorf("invalid cursor file %s: %w", fs.path, err)
+	}
+	return *cur, nil
+}
+
+func (fs *FileCursorStore) Save(ctx context.Context, cur events.Cursor) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fs.path), filepath.Base(fs.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(formatCursor(cur) + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.path)
+}
+
+// formatCursor returns the cursor as sent to the host: a token if there's an
+// epoch, otherwise the bare sequence number
+func formatCursor(cur events.Cursor) string {
+	if cur.Epoch != 0 {
+		return events.EncodeCursorToken(cur)
+	}
+	return strconv.FormatInt(cur.Seq, 10)
+}
+
+// ConsumerCursor is the row a DBCursorStore keeps a consumer's cursor in
+type ConsumerCursor struct {
+	Name  string `gorm:"primarykey"`
+	Seq   int64
+	Epoch uint32
+}
+
+// DBCursorStore keeps cursors in a SQL table, one row per named consumer
+type DBCursorStore struct {
+	db   *gorm.DB
+	name string
+}
+
+func NewDBCursorStore(db *gorm.DB, name string) (*DBCursorStore, error) {
+	if err := db.AutoMigrate(&ConsumerCursor{}); err != nil {
+		return nil, err
+	}
+	return &DBCursorStore{db: db, name: name}, nil
+}
+
+func (ds *DBCursorStore) Load(ctx context.Context) (events.Cursor, error) {
+	var cur ConsumerCursor
+	if err := ds.db.WithContext(ctx).Where("name = ?", ds.name).Limit(1).Find(&cur).Error; err != nil {
+		return events.Cursor{}, err
+	}
+	return events.Cursor{Seq: cur.Seq, Epoch: cur.Epoch}, nil
+}
+
+func (ds *DBCursorStore) Save(ctx context.Context, cur events.Cursor) error {
+	return ds.db.WithContext(ctx).Save(&ConsumerCursor{Name: ds.name, Seq: cur.Seq, Epoch: cur.Epoch}).Error
+}
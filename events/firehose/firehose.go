@@ -0,0 +1,360 @@
+// Package firehose runs long-lived subscriptions to a repo event stream,
+// taking care of the parts every consumer otherwise writes for itself:
+// checkpointing the cursor, reconnecting and resuming where it left off,
+// with a cursor token if the host gives epochs (see events.CursorEpochHeader),
+// noticing gaps in the sequence, and running events in parallel while keeping
+// each repo's events in order.
+package firehose
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/events/schedulers/parallel"
+	"github.com/bluesky-social/indigo/events/schedulers/sequential"
+	"github.com/bluesky-social/indigo/util/retry"
+
+	"github.com/gorilla/websocket"
+	logging "github.com/ipfs/go-log"
+)
+
+var log = logging.Logger("firehose")
+
+const subscribeReposPath = "/xrpc/com.atproto.sync.subscribeRepos"
+
+type Options struct {
+	// Where to save the cursor. If nil, every run starts from the live stream.
+	Cursors CursorStore
+	// Interval between saving the cursor
+	CheckpointInterval time.Duration
+
+	// Number of events handled at once. Events for the same repo are always
+	// handled in order. 1 handles every event in order.
+	Parallelism int
+
+	// Names the consumer in metrics
+	Ident     string
+	UserAgent string
+
+	// Range of waits between reconnection attempts
+	Backoff retry.Backoff
+
+	// Called when sequence numbers are skipped, or go backwards, between
+	// consecutive events; prev is the last sequence number seen before seq
+	OnGap func(ctx context.Context, prev, seq int64)
+
+	// Ask for events.StreamVersion2 and check each frame's integrity chain.
+	// A broken chain drops the connection, resuming from the cursor; hosts
+	// which don't send chains are treated as failing to connect.
+	VerifyChain bool
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		CheckpointInterval: 5 * time.Second,
+		Parallelism:        1,
+		Ident:              "firehose",
+		UserAgent:          "indigo-firehose",
+		Backoff:            retry.Backoff{Initial: time.Second, Max: time.Minute},
+	}
+}
+
+// ErrCursorRejected is returned by Run when the host refuses the saved
+// cursor, eg because it's ahead of the host's sequence after the host was
+// restored from a backup. The caller has to decide where to resume from and
+// save that to the CursorStore.
+type ErrCursorRejected struct {
+	Cursor int64
+	Frame  *events.ErrorFrame
+}
+
+func (e *ErrCursorRejected) Error() string {
+	return fmt.Sprintf("host rejected cursor %d: %s: %s", e.Cursor, e.Frame.Error, e.Frame.Message)
+}
+
+// error frames sent for cursors the host won't serve
+var cursorErrorFrames = map[string]bool{
+	"FutureCursor":          true,
+	events.CursorErrInvalid: true,
+	events.CursorErrForeign: true,
+	events.CursorErrStale:   true,
+}
+
+// Consumer subscribes to a host's repo event stream and hands each event to
+// a handler
+type Consumer struct {
+	host    string
+	opts    Options
+	handler func(context.Context, *events.XRPCStreamEvent) error
+
+	lk sync.Mutex
+	// last sequence number dispatched to the handler
+	last int64
+	// epoch the host gave for the current connection's events, zero if it
+	// didn't give one
+	epoch uint32
+	// sequence numbers dispatched but not yet handled
+	inflight map[int64]struct{}
+	// the cursor the host rejected, if any
+	rejected *ErrCursorRejected
+}
+
+// NewConsumer creates a consumer of the stream at host, a ws:// or wss:// URL.
+// Handler errors are logged and otherwise ignored; an event counts as handled
+// for checkpointing once the handler returns.
+func NewConsumer(host string, opts *Options, handler func(context.Context, *events.XRPCStreamEvent) error) (*Consumer, error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	if !strings.HasPrefix(host, "ws://") && !strings.HasPrefix(host, "wss://") {
+		return nil, fmt.Errorf("host must be a ws:// or wss:// URL: %q", host)
+	}
+	if opts.Parallelism < 1 {
+		return nil, fmt.Errorf("parallelism must be at least 1")
+	}
+
+	return &Consumer{
+		host:     strings.TrimSuffix(host, "/"),
+		opts:     *opts,
+		handler:  handler,
+		inflight: make(map[int64]struct{}),
+	}, nil
+}
+
+// Cursor returns the cursor to resume from: the sequence number before the
+// oldest event still being handled, or of the last event if all are done
+func (c *Consumer) Cursor() int64 {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	return c.cursorLocked()
+}
+
+// resumeCursor returns the cursor along with the epoch it belongs to
+func (c *Consumer) resumeCursor() events.Cursor {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	return events.Cursor{Seq: c.cursorLocked(), Epoch: c.epoch}
+}
+
+func (c *Consumer) cursorLocked() int64 {
+	cur := c.last
+	for seq := range c.inflight {
+		if seq-1 < cur {
+			cur = seq - 1
+		}
+	}
+	return cur
+}
+
+// Run consumes the stream until ctx is cancelled, reconnecting whenever the
+// connection drops. The cursor is saved periodically and before returning.
+func (c *Consumer) Run(ctx context.Context) error {
+	if c.opts.Cursors != nil {
+		cur, err := c.opts.Cursors.Load(ctx)
+		if err != nil {
+			return fmt.Errorf("loading cursor: %w", err)
+		}
+		c.last = cur.Seq
+		c.epoch = cur.Epoch
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.runCheckpointer(ctx)
+	}()
+	defer func() {
+		wg.Wait()
+		c.checkpoint(context.Background())
+	}()
+
+	backoff := retry.NewDecorrelated(c.opts.Backoff)
+	for {
+		err := c.runOnce(ctx, backoff)
+		c.dropInflight()
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		c.lk.Lock()
+		rejected := c.rejected
+		c.lk.Unlock()
+		if rejected != nil {
+			return rejected
+		}
+
+		wait := backoff.Next()
+		log.Warnw("firehose connection lost, reconnecting", "host", c.host, "cursor", c.Cursor(), "wait", wait, "err", err)
+		consumerReconnects.WithLabelValues(c.opts.Ident).Inc()
+		if err := retry.Sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Consumer) runOnce(ctx context.Context, backoff *retry.Decorrelated) error {
+	u, err := url.Parse(c.host + subscribeReposPath)
+	if err != nil {
+		return err
+	}
+	cur := c.resumeCursor()
+	q := url.Values{}
+	if cur.Seq > 0 {
+		q.Set("cursor", formatCursor(cur))
+	}
+	if c.opts.VerifyChain {
+		q.Set(events.StreamVersionParam, strconv.Itoa(events.StreamVersion2))
+	}
+	u.RawQuery = q.Encode()
+
+	con, resp, err := websocket.DefaultDialer.DialContext(ctx, u.String(), http.Header{
+		"User-Agent": []string{c.opts.UserAgent},
+	})
+	if err != nil {
+		return fmt.Errorf("dialing %s: %w", u, err)
+	}
+	if c.opts.VerifyChain {
+		if v, err := events.ResponseStreamVersion(resp.Header); err != nil || v < events.StreamVersion2 {
+			con.Close()
+			return fmt.Errorf("host doesn't support integrity chains (stream version %q)", resp.Header.Get(events.StreamVersionHeader))
+		}
+	}
+	backoff.Reset()
+	log.Infow("connected to firehose", "host", c.host, "cursor", cur.Seq, "epoch", cur.Epoch)
+
+	// events from here on are in the host's current epoch. Hosts which don't
+	// give one are resumed with bare sequence numbers.
+	var epoch uint32
+	if h := resp.Header.Get(events.CursorEpochHeader); h != "" {
+		if epoch, err = events.ParseCursorEpoch(h); err != nil {
+			log.Warnw("ignoring invalid cursor epoch from host", "host", c.host, "err", err)
+		}
+	}
+	c.lk.Lock()
+	c.epoch = epoch
+	c.lk.Unlock()
+
+	var sched events.Scheduler
+	if c.opts.Parallelism > 1 {
+		sched = parallel.NewScheduler(c.opts.Parallelism, 0, c.opts.Ident, c.handle)
+	} else {
+		sched = sequential.NewScheduler(c.opts.Ident, c.handle)
+	}
+
+	ts := &trackingScheduler{c: c, cursor: cur.Seq, next: sched}
+	if c.opts.VerifyChain {
+		err := events.HandleVerifiedRepoStream(ctx, con, ts, events.NewChainVerifier())
+		if errors.Is(err, events.ErrChainBroken) {
+			consumerChainFailures.WithLabelValues(c.opts.Ident).Inc()
+		}
+		return err
+	}
+	return events.HandleRepoStream(ctx, con, ts)
+}
+
+// handle runs the handler for an event, then marks it done
+func (c *Consumer) handle(ctx context.Context, evt *events.XRPCStreamEvent) error {
+	if err := c.handler(ctx, evt); err != nil {
+		log.Errorw("firehose event handler failed", "seq", evt.Sequence(), "repo", evt.RepoDID(), "err", err)
+	}
+
+	if seq := evt.Sequence(); seq >= 0 {
+		c.lk.Lock()
+		delete(c.inflight, seq)
+		c.lk.Unlock()
+	}
+	return nil
+}
+
+// dispatch records an event as in flight, checking it follows on from the
+// last one
+func (c *Consumer) dispatch(ctx context.Context, seq int64) {
+	c.lk.Lock()
+	prev := c.last
+	c.last = seq
+	c.inflight[seq] = struct{}{}
+	c.lk.Unlock()
+
+	if prev > 0 && seq != prev+1 {
+		consumerGaps.WithLabelValues(c.opts.Ident).Inc()
+		log.Warnw("gap in firehose sequence", "host", c.host, "prev", prev, "seq", seq)
+		if c.opts.OnGap != nil {
+			c.opts.OnGap(ctx, prev, seq)
+		}
+	}
+}
+
+// dropInflight forgets events that were never handled because the
+// connection closed, moving the cursor back so they're received again
+func (c *Consumer) dropInflight() {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	c.last = c.cursorLocked()
+	clear(c.inflight)
+}
+
+func (c *Consumer) runCheckpointer(ctx context.Context) {
+	t := time.NewTicker(c.opts.CheckpointInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			c.checkpoint(ctx)
+		}
+	}
+}
+
+func (c *Consumer) checkpoint(ctx context.Context) {
+	cur := c.resumeCursor()
+	consumerCursor.WithLabelValues(c.opts.Ident).Set(float64(cur.Seq))
+
+	if c.opts.Cursors == nil || cur.Seq <= 0 {
+		return
+	}
+	if err := c.opts.Cursors.Save(ctx, cur); err != nil {
+		log.Errorw("failed to save firehose cursor", "cursor", cur.Seq, "epoch", cur.Epoch, "err", err)
+	}
+}
+
+// trackingScheduler sits in front of the real scheduler, recording events as
+// they're dispatched and watching for the host rejecting our cursor
+type trackingScheduler struct {
+	c      *Consumer
+	cursor int64
+	next   events.Scheduler
+}
+
+func (ts *trackingScheduler) AddWork(ctx context.Context, repo string, val *events.XRPCStreamEvent) error {
+	if val.Error != nil && cursorErrorFrames[val.Error.Error] {
+		rejected := &ErrCursorRejected{Cursor: ts.cursor, Frame: val.Error}
+		ts.c.lk.Lock()
+		ts.c.rejected = rejected
+		ts.c.lk.Unlock()
+		return rejected
+	}
+
+	if seq := val.Sequence(); seq >= 0 {
+		ts.c.dispatch(ctx, seq)
+	}
+	return ts.next.AddWork(ctx, repo, val)
+}
+
+func (ts *trackingScheduler) Shutdown() {
+	ts.next.Shutdown()
+}
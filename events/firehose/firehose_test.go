@@ -0,0 +1,313 @@
+package firehose_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/events/firehose"
+	"github.com/bluesky-social/indigo/util/retry"
+
+	"github.com/gorilla/websocket"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// testHost serves the given sequence numbers as identity events to each
+// connection, starting after its cursor, then hangs up. A non-zero epoch is
+// sent in the cursor epoch header.
+func testHost(t *testing.T, seqs []int64, epoch uint32) (*httptest.Server, func() []string) {
+	var lk sync.Mutex
+	var cursors []string
+
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cursor := r.URL.Query().Get("cursor")
+		lk.Lock()
+		cursors = append(cursors, cursor)
+		lk.Unlock()
+
+		version, err := events.NegotiateStreamVersion(r.URL.Query().Get(events.StreamVersionParam))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		hdr := http.Header{events.StreamVersionHeader: []string{strconv.Itoa(version)}}
+		if epoch != 0 {
+			hdr.Set(events.CursorEpochHeader, events.FormatCursorEpoch(epoch))
+		}
+		con, err := upgrader.Upgrade(w, r, hdr)
+		if err != nil {
+			return
+		}
+		defer con.Close()
+		fw := events.NewFrameWriter(version)
+
+		var since int64
+		if cursor != "" {
+			c, err := events.ParseCursor(cursor)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			since = c.Seq
+		}
+		for _, seq := range seqs {
+			if seq <= since {
+				continue
+			}
+			evt := &events.XRPCStreamEvent{RepoIdentity: &comatproto.SyncSubscribeRepos_Identity{
+				Did:  "did:plc:" + strconv.Itoa(int(seq%2)),
+				Seq:  seq,
+				Time: "2024-01-01T00:00:00Z",
+			}}
+			var buf bytes.Buffer
+			if err := fw.WriteFrame(&buf, evt); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := con.WriteMessage(websocket.BinaryMessage, buf.Bytes()); err != nil {
+				return
+			}
+		}
+		con.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, func() []string {
+		lk.Lock()
+		defer lk.Unlock()
+		return append([]string(nil), cursors...)
+	}
+}
+
+func TestConsumerResumesFromCursor(t *testing.T) {
+	srv, cursors := testHost(t, []int64{1, 2, 4, 5}, 0)
+
+	store := firehose.NewFileCursorStore(filepath.Join(t.TempDir(), "cursor"))
+
+	var lk sync.Mutex
+	var handled []int64
+	var gaps [][2]int64
+
+	opts := firehose.DefaultOptions()
+	opts.Cursors = store
+	opts.Parallelism = 2
+	opts.CheckpointInterval = 10 * time.Millisecond
+	opts.Backoff = retry.Backoff{Initial: time.Millisecond, Max: 10 * time.Millisecond}
+	opts.OnGap = func(ctx context.Context, prev, seq int64) {
+		lk.Lock()
+		gaps = append(gaps, [2]int64{prev, seq})
+		lk.Unlock()
+	}
+
+	c, err := firehose.NewConsumer("ws://"+strings.TrimPrefix(srv.URL, "http://"), opts, func(ctx context.Context, evt *events.XRPCStreamEvent) error {
+		lk.Lock()
+		handled = append(handled, evt.Sequence())
+		lk.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- c.Run(ctx) }()
+
+	// wait for a reconnection that resumes after the last event
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cs := cursors()
+		if len(cs) > 1 && cs[len(cs)-1] == "5" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("consumer never resumed from the last event, cursors: %v", cs)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if cs := cursors(); cs[0] != "" {
+		t.Fatalf("expected first connection without a cursor, got %q", cs[0])
+	}
+
+	// delivery is at least once: events in flight when a connection drops
+	// are received again
+	lk.Lock()
+	seen := make(map[int64]bool)
+	for _, seq := range handled {
+		seen[seq] = true
+	}
+	if len(seen) != 4 || !seen[1] || !seen[2] || !seen[4] || !seen[5] {
+		t.Fatalf("expected events 1, 2, 4 and 5 handled, got %v", handled)
+	}
+	if len(gaps) == 0 {
+		t.Fatal("expected the gap between 2 and 4 to be reported")
+	}
+	for _, g := range gaps {
+		if g != [2]int64{2, 4} {
+			t.Fatalf("unexpected gap reported: %v", g)
+		}
+	}
+	lk.Unlock()
+
+	saved, err := store.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != (events.Cursor{Seq: 5}) {
+		t.Fatalf("expected saved cursor 5, got %+v", saved)
+	}
+}
+
+func TestConsumerResumesWithCursorToken(t *testing.T) {
+	const epoch = 0xabcd
+	srv, cursors := testHost(t, []int64{1, 2, 3}, epoch)
+
+	path := filepath.Join(t.TempDir(), "cursor")
+	store := firehose.NewFileCursorStore(path)
+	// a cursor saved before the host handed out epochs is still read
+	if err := os.WriteFile(path, []byte("1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := firehose.DefaultOptions()
+	opts.Cursors = store
+	opts.CheckpointInterval = 10 * time.Millisecond
+	opts.Backoff = retry.Backoff{Initial: time.Millisecond, Max: 10 * time.Millisecond}
+
+	c, err := firehose.NewConsumer("ws://"+strings.TrimPrefix(srv.URL, "http://"), opts, func(ctx context.Context, evt *events.XRPCStreamEvent) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- c.Run(ctx) }()
+
+	token := events.EncodeCursorToken(events.Cursor{Seq: 3, Epoch: epoch})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cs := cursors()
+		if len(cs) > 1 && cs[len(cs)-1] == token {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("consumer never resumed with a cursor token, cursors: %v", cs)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if cs := cursors(); cs[0] != "1" {
+		t.Fatalf("expected the first connection to resume from the bare saved cursor, got %q", cs[0])
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(b)) != token {
+		t.Fatalf("expected the token saved, got %q", b)
+	}
+	saved, err := store.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != (events.Cursor{Seq: 3, Epoch: epoch}) {
+		t.Fatalf("unexpected saved cursor %+v", saved)
+	}
+}
+
+func TestConsumerVerifiesChain(t *testing.T) {
+	srv, _ := testHost(t, []int64{1, 2, 3}, 0)
+
+	opts := firehose.DefaultOptions()
+	opts.VerifyChain = true
+	opts.Backoff = retry.Backoff{Initial: time.Millisecond, Max: 10 * time.Millisecond}
+
+	var lk sync.Mutex
+	seen := make(map[int64]bool)
+	c, err := firehose.NewConsumer("ws://"+strings.TrimPrefix(srv.URL, "http://"), opts, func(ctx context.Context, evt *events.XRPCStreamEvent) error {
+		lk.Lock()
+		seen[evt.Sequence()] = true
+		lk.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- c.Run(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Cursor() != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("consumer never handled all events, cursor %d", c.Cursor())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	lk.Lock()
+	defer lk.Unlock()
+	if len(seen) != 3 {
+		t.Fatalf("expected events 1-3 handled, got %v", seen)
+	}
+}
+
+func TestDBCursorStore(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "cursors.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	a, err := firehose.NewDBCursorStore(db, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := firehose.NewDBCursorStore(db, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cur, err := a.Load(ctx); err != nil || cur != (events.Cursor{}) {
+		t.Fatalf("expected no cursor, got %+v (%v)", cur, err)
+	}
+	if err := a.Save(ctx, events.Cursor{Seq: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Save(ctx, events.Cursor{Seq: 20, Epoch: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Save(ctx, events.Cursor{Seq: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	if cur, err := a.Load(ctx); err != nil || cur != (events.Cursor{Seq: 20, Epoch: 7}) {
+		t.Fatalf("expected cursor 20 in epoch 7, got %+v (%v)", cur, err)
+	}
+	if cur, err := b.Load(ctx); err != nil || cur != (events.Cursor{Seq: 5}) {
+		t.Fatalf("expected cursor 5, got %+v (%v)", cur, err)
+	}
+}
@@ -0,0 +1,26 @@
+package firehose
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var consumerCursor = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "firehose_consumer_cursor",
+	Help: "Last cursor checkpointed by each consumer",
+}, []string{"ident"})
+
+var consumerGaps = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "firehose_consumer_gaps_total",
+	Help: "Number of times each consumer saw sequence numbers skipped or go backwards",
+}, []string{"ident"})
+
+var consumerReconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "firehose_consumer_reconnects_total",
+	Help: "Number of times each consumer reconnected to the stream",
+}, []string{"ident"})
+
+var consumerChainFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "firehose_consumer_chain_failures_total",
+	Help: "Number of times each consumer dropped a connection for a broken integrity chain",
+}, []string{"ident"})
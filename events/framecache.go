@@ -0,0 +1,63 @@
+package events
+
+import "sync"
+
+// FrameCache holds the serialized frames of the most recently broadcast
+// events, keyed by sequence number, in a fixed-size ring. Subscribers playing
+// back from a recent cursor get these bytes rather than having every event
+// they replay re-encoded for them.
+type FrameCache struct {
+	lk     sync.RWMutex
+	seqs   []int64
+	frames [][]byte
+}
+
+func NewFrameCache(size int) *FrameCache {
+	return &FrameCache{
+		seqs:   make([]int64, size),
+		frames: make([][]byte, size),
+	}
+}
+
+// Put stores the serialized frame for a sequence number, evicting whichever
+// frame previously occupied its slot
+func (fc *FrameCache) Put(seq int64, frame []byte) {
+	if seq <= 0 || len(fc.seqs) == 0 {
+		return
+	}
+	i := seq % int64(len(fc.seqs))
+
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	fc.seqs[i] = seq
+	fc.frames[i] = frame
+}
+
+// Get returns the serialized frame for a sequence number, if it is still cached
+func (fc *FrameCache) Get(seq int64) ([]byte, bool) {
+	if seq <= 0 || len(fc.seqs) == 0 {
+		return nil, false
+	}
+	i := seq % int64(len(fc.seqs))
+
+	fc.lk.RLock()
+	defer fc.lk.RUnlock()
+	if fc.seqs[i] != seq {
+		return nil, false
+	}
+	return fc.frames[i], true
+}
+
+// fillFromCache sets a played-back event's preserialized frame from the cache,
+// if the cache has it
+func (em *EventManager) fillFromCache(evt *XRPCStreamEvent) {
+	if em.frameCache == nil || evt.Preserialized != nil {
+		return
+	}
+	if frame, ok := em.frameCache.Get(sequenceForEvent(evt)); ok {
+		evt.Preserialized = frame
+		frameCacheHits.Inc()
+	} else {
+		frameCacheMisses.Inc()
+	}
+}
@@ -0,0 +1,37 @@
+package events_test
+
+import (
+	"testing"
+
+	"github.com/bluesky-social/indigo/events"
+)
+
+func TestFrameCache(t *testing.T) {
+	fc := events.NewFrameCache(4)
+
+	for seq := int64(1); seq <= 6; seq++ {
+		fc.Put(seq, []byte{byte(seq)})
+	}
+
+	// 1 and 2 were evicted by 5 and 6
+	for _, seq := range []int64{1, 2} {
+		if _, ok := fc.Get(seq); ok {
+			t.Fatalf("expected seq %d to have been evicted", seq)
+		}
+	}
+	for _, seq := range []int64{3, 4, 5, 6} {
+		frame, ok := fc.Get(seq)
+		if !ok || len(frame) != 1 || frame[0] != byte(seq) {
+			t.Fatalf("expected cached frame for seq %d, got %v %v", seq, frame, ok)
+		}
+	}
+
+	// events without a sequence number are never cached
+	fc.Put(-1, []byte{0xff})
+	if _, ok := fc.Get(-1); ok {
+		t.Fatal("unexpected cache hit for unsequenced event")
+	}
+	if _, ok := fc.Get(100); ok {
+		t.Fatal("unexpected cache hit for future seq")
+	}
+}
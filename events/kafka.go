@@ -0,0 +1,250 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Encodings for events published to Kafka
+const (
+	// The same frame (header and body) sent to firehose subscribers
+	KafkaEncodingCBOR = "cbor"
+	// A JSON object: {"type": "#commit", "event": {...}}
+	KafkaEncodingJSON = "json"
+)
+
+// KafkaWriter publishes messages to a topic; *kafka.Writer implements it
+type KafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+type KafkaWriterOptions struct {
+	Brokers []string
+	Topic   string
+	// Longest a message waits for its batch to fill before it is sent
+	BatchTimeout time.Duration
+}
+
+// NewKafkaWriter returns a writer that waits for every in-sync replica to
+// acknowledge each batch. Events from the same repo go to the same partition,
+// so consumers see each repo's events in order.
+func NewKafkaWriter(opts *KafkaWriterOptions) *kafka.Writer {
+	return &kafka.Writer{
+		Addr:         kafka.TCP(opts.Brokers...),
+		Topic:        opts.Topic,
+		Balancer:     kafka.BalancerFunc(balanceByRepo),
+		RequiredAcks: kafka.RequireAll,
+		BatchTimeout: opts.BatchTimeout,
+		Compression:  kafka.Zstd,
+	}
+}
+
+// balanceByRepo picks a partition from the repo header, as the message key is
+// the sequence number
+func balanceByRepo(msg kafka.Message, partitions ...int) int {
+	var repo []byte
+	for _, h := range msg.Headers {
+		if h.Key == "repo" {
+			repo = h.Value
+			break
+		}
+	}
+	return (&kafka.Hash{}).Balance(kafka.Message{Key: repo}, partitions...)
+}
+
+type KafkaSinkOptions struct {
+	// KafkaEncodingCBOR or KafkaEncodingJSON
+	Encoding string
+	// Most events sent to Kafka in one batch
+	BatchSize int
+	// Events waiting to be sent; events that arrive while it is full are
+	// dropped rather than holding up the firehose
+	QueueSize int
+}
+
+func DefaultKafkaSinkOptions() *KafkaSinkOptions {
+	return &KafkaSinkOptions{
+		Encoding:  KafkaEncodingCBOR,
+		BatchSize: 1000,
+		QueueSize: 100_000,
+	}
+}
+
+// KafkaSink publishes every sequenced event to Kafka (or anything speaking its
+// protocol, like Redpanda), keyed by sequence number. Each message carries
+// headers with the event type and repo DID. Events are sent in sequence order
+// by a single sender; one that can't be delivered after the writer's retries
+// is dropped and counted.
+type KafkaSink struct {
+	w    KafkaWriter
+	opts KafkaSinkOptions
+
+	events chan *XRPCStreamEvent
+
+	exit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewKafkaSink(w KafkaWriter, opts *KafkaSinkOptions) (*KafkaSink, error) {
+	if opts == nil {
+		opts = DefaultKafkaSinkOptions()
+	}
+	switch opts.Encoding {
+	case KafkaEncodingCBOR, KafkaEncodingJSON:
+	default:
+		return nil, fmt.Errorf("unknown kafka event encoding %q", opts.Encoding)
+	}
+
+	return &KafkaSink{
+		w:      w,
+		opts:   *opts,
+		events: make(chan *XRPCStreamEvent, opts.QueueSize),
+		exit:   make(chan struct{}),
+	}, nil
+}
+
+// Start starts sending queued events
+func (ks *KafkaSink) Start() {
+	ks.wg.Add(1)
+	go ks.run()
+}
+
+// Enqueue queues a sequenced event to be sent, without blocking
+func (ks *KafkaSink) Enqueue(evt *XRPCStreamEvent) {
+	if sequenceForEvent(evt) <= 0 {
+		return
+	}
+
+	select {
+	case ks.events <- evt:
+	default:
+		kafkaDropped.WithLabelValues("queue_full").Inc()
+	}
+}
+
+// Shutdown sends everything queued, then closes the writer
+func (ks *KafkaSink) Shutdown(ctx context.Context) error {
+	close(ks.exit)
+
+	done := make(chan struct{})
+	go func() {
+		ks.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return fmt.Errorf("kafka sink did not finish sending: %w", ctx.Err())
+	}
+
+	return ks.w.Close()
+}
+
+func (ks *KafkaSink) run() {
+	defer ks.wg.Done()
+
+	ctx := context.Background()
+	batch := make([]kafka.Message, 0, ks.opts.BatchSize)
+
+	add := func(evt *XRPCStreamEvent) {
+		msg, err := ks.message(evt)
+		if err != nil {
+			log.Errorw("failed to encode event for kafka", "seq", sequenceForEvent(evt), "err", err)
+			kafkaDropped.WithLabelValues("encode").Inc()
+			return
+		}
+		batch = append(batch, msg)
+	}
+
+	// fill takes whatever else is queued, up to the batch size
+	fill := func() {
+		for len(batch) < ks.opts.BatchSize {
+			select {
+			case evt := <-ks.events:
+				add(evt)
+			default:
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case evt := <-ks.events:
+			add(evt)
+			fill()
+			ks.send(ctx, batch)
+			batch = batch[:0]
+		case <-ks.exit:
+			for len(ks.events) > 0 {
+				fill()
+				ks.send(ctx, batch)
+				batch = batch[:0]
+			}
+			return
+		}
+	}
+}
+
+func (ks *KafkaSink) send(ctx context.Context, batch []kafka.Message) {
+	if len(batch) == 0 {
+		return
+	}
+
+	start := time.Now()
+	if err := ks.w.WriteMessages(ctx, batch...); err != nil {
+		log.Errorw("failed to publish events to kafka", "first", string(batch[0].Key), "count", len(batch), "err", err)
+		kafkaDropped.WithLabelValues("write").Add(float64(len(batch)))
+		return
+	}
+	kafkaSendDuration.Observe(time.Since(start).Seconds())
+	kafkaPublished.Add(float64(len(batch)))
+
+	if seq, err := strconv.ParseInt(string(batch[len(batch)-1].Key), 10, 64); err == nil {
+		kafkaLastSeq.Set(float64(seq))
+	}
+}
+
+type kafkaJSONEvent struct {
+	Type  string `json:"type"`
+	Event any    `json:"event"`
+}
+
+func (ks *KafkaSink) message(evt *XRPCStreamEvent) (kafka.Message, error) {
+	typ, body := evt.message()
+	if body == nil {
+		return kafka.Message{}, fmt.Errorf("unrecognized event kind")
+	}
+
+	var value []byte
+	switch ks.opts.Encoding {
+	case KafkaEncodingJSON:
+		b, err := json.Marshal(&kafkaJSONEvent{Type: typ, Event: body})
+		if err != nil {
+			return kafka.Message{}, err
+		}
+		value = b
+	default:
+		if err := evt.Preserialize(); err != nil {
+			return kafka.Message{}, err
+		}
+		value = evt.Preserialized
+	}
+
+	return kafka.Message{
+		Key:   []byte(strconv.FormatInt(sequenceForEvent(evt), 10)),
+		Value: value,
+		Headers: []kafka.Header{
+			{Key: "type", Value: []byte(typ)},
+			{Key: "repo", Value: []byte(evt.RepoDID())},
+		},
+	}, nil
+}
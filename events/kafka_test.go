@@ -0,0 +1,116 @@
+package events_test
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+
+	"github.com/segmentio/kafka-go"
+)
+
+type fakeKafkaWriter struct {
+	lk     sync.Mutex
+	msgs   []kafka.Message
+	closed bool
+}
+
+func (fw *fakeKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	fw.lk.Lock()
+	defer fw.lk.Unlock()
+	fw.msgs = append(fw.msgs, msgs...)
+	return nil
+}
+
+func (fw *fakeKafkaWriter) Close() error {
+	fw.closed = true
+	return nil
+}
+
+func header(msg kafka.Message, key string) string {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func TestKafkaSink(t *testing.T) {
+	for _, enc := range []string{events.KafkaEncodingCBOR, events.KafkaEncodingJSON} {
+		t.Run(enc, func(t *testing.T) {
+			ctx := context.Background()
+
+			fw := &fakeKafkaWriter{}
+			opts := events.DefaultKafkaSinkOptions()
+			opts.Encoding = enc
+			opts.BatchSize = 7
+			sink, err := events.NewKafkaSink(fw, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink.Start()
+
+			evtman := events.NewEventManager(events.NewMemPersister())
+			evtman.AddSink(sink)
+
+			n := 50
+			for i := 0; i < n; i++ {
+				if err := evtman.AddEvent(ctx, &events.XRPCStreamEvent{
+					RepoIdentity: &atproto.SyncSubscribeRepos_Identity{
+						Did:  "did:example:" + strconv.Itoa(i%3),
+						Time: "2024-05-01T00:00:00Z",
+					},
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := evtman.Shutdown(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if !fw.closed {
+				t.Fatal("expected writer to be closed on shutdown")
+			}
+
+			if len(fw.msgs) != n {
+				t.Fatalf("expected %d messages, got %d", n, len(fw.msgs))
+			}
+			for i, msg := range fw.msgs {
+				if string(msg.Key) != strconv.Itoa(i+1) {
+					t.Fatalf("message %d: expected key %d, got %s", i, i+1, msg.Key)
+				}
+				if header(msg, "type") != "#identity" {
+					t.Fatalf("unexpected type header %q", header(msg, "type"))
+				}
+				if want := "did:example:" + strconv.Itoa(i%3); header(msg, "repo") != want {
+					t.Fatalf("expected repo header %s, got %s", want, header(msg, "repo"))
+				}
+			}
+
+			if enc == events.KafkaEncodingJSON {
+				var out struct {
+					Type  string
+					Event atproto.SyncSubscribeRepos_Identity
+				}
+				if err := json.Unmarshal(fw.msgs[0].Value, &out); err != nil {
+					t.Fatal(err)
+				}
+				if out.Type != "#identity" || out.Event.Seq != 1 || out.Event.Did != "did:example:0" {
+					t.Fatalf("unexpected json event: %+v", out)
+				}
+			}
+		})
+	}
+}
+
+func TestKafkaSinkEncoding(t *testing.T) {
+	_, err := events.NewKafkaSink(&fakeKafkaWriter{}, &events.KafkaSinkOptions{Encoding: "xml"})
+	if err == nil {
+		t.Fatal("expected an error for an unknown encoding")
+	}
+}
@@ -1,6 +1,8 @@
 package events
 
 import (
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -24,3 +26,150 @@ var eventsBroadcast = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "indigo_events_broadcast_total",
 	Help: "Total number of events broadcast to subscribers",
 }, []string{"pool"})
+
+var fanoutShardSubscribers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "indigo_events_fanout_shard_subscribers",
+	Help: "Number of live subscribers on each event fanout shard",
+}, []string{"shard"})
+
+var frameCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "indigo_events_frame_cache_hits_total",
+	Help: "Number of played back events served from the serialized frame cache",
+})
+
+var frameCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "indigo_events_frame_cache_misses_total",
+	Help: "Number of played back events which had to be serialized again",
+})
+
+var persisterMigrationCompleted = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "indigo_events_persister_migration_completed",
+	Help: "Whether a persister migration has switched over to the new persister",
+})
+
+var persisterMigrationCopyErrors = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "indigo_events_persister_migration_copy_errors_total",
+	Help: "Number of events that could not be copied to the new persister during a migration",
+})
+
+var analyticsRows = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "indigo_events_analytics_rows_total",
+	Help: "Number of record operations written to the analytics sink",
+})
+
+var analyticsFiles = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "indigo_events_analytics_files_total",
+	Help: "Number of parquet files written by the analytics sink",
+})
+
+var analyticsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "indigo_events_analytics_dropped_total",
+	Help: "Number of events or rows the analytics sink dropped",
+}, []string{"reason"})
+
+var kafkaPublished = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "indigo_events_kafka_published_total",
+	Help: "Number of events published to kafka",
+})
+
+var kafkaDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "indigo_events_kafka_dropped_total",
+	Help: "Number of events the kafka sink dropped",
+}, []string{"reason"})
+
+var kafkaLastSeq = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "indigo_events_kafka_last_seq",
+	Help: "Sequence number of the last event published to kafka",
+})
+
+var kafkaSendDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "indigo_events_kafka_send_duration_seconds",
+	Help:    "Time taken to publish a batch of events to kafka",
+	Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+})
+
+var natsPublished = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "indigo_events_nats_published_total",
+	Help: "Number of messages published to nats jetstream",
+})
+
+var natsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "indigo_events_nats_dropped_total",
+	Help: "Number of events or messages the nats sink dropped",
+}, []string{"reason"})
+
+var middlewareDrops = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "indigo_events_middleware_dropped_total",
+	Help: "Number of events dropped by event middleware, because it returned no event or an error",
+}, []string{"reason"})
+
+var persisterWriteDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "indigo_events_persister_write_duration_seconds",
+	Help:    "Time taken to write out a batch of buffered events, by persister",
+	Buckets: prometheus.ExponentialBuckets(0.0005, 2, 16),
+}, []string{"persister"})
+
+var persisterWriteFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "indigo_events_persister_write_failures_total",
+	Help: "Number of failed event writes, by whether persisting an event or writing out buffered events in the background failed",
+}, []string{"stage"})
+
+var persisterWriteEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "indigo_events_persister_written_total",
+	Help: "Number of events written out, by persister",
+}, []string{"persister"})
+
+var persisterPlaybackAge = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "indigo_events_persister_playback_event_age_seconds",
+	Help:    "Age of the events read back for subscribers replaying from a cursor, by persister",
+	Buckets: []float64{60, 600, 3600, 6 * 3600, 24 * 3600, 3 * 24 * 3600, 7 * 24 * 3600, 30 * 24 * 3600},
+}, []string{"persister"})
+
+var diskPersisterFsyncDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "indigo_events_disk_persister_fsync_duration_seconds",
+	Help:    "Time taken to fsync an event log file",
+	Buckets: prometheus.ExponentialBuckets(0.0005, 2, 16),
+})
+
+var diskPersisterRollovers = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "indigo_events_disk_persister_segment_rollovers_total",
+	Help: "Number of times the disk persister started a new event log file",
+})
+
+var diskPersisterGCDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "indigo_events_disk_persister_gc_duration_seconds",
+	Help:    "Time taken to delete event log files past the retention period",
+	Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+})
+
+// observePlayback wraps a playback callback to record the age of the events
+// it's given
+func observePlayback(persister string, cb func(*XRPCStreamEvent) error) func(*XRPCStreamEvent) error {
+	hist := persisterPlaybackAge.WithLabelValues(persister)
+	return func(evt *XRPCStreamEvent) error {
+		if t, ok := eventTime(evt); ok {
+			hist.Observe(time.Since(t).Seconds())
+		}
+		return cb(evt)
+	}
+}
+
+var diskPersisterCompactedFiles = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "indigo_events_disk_persister_compacted_files_total",
+	Help: "Number of event log files compacted",
+})
+
+var diskPersisterCompactedBytes = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "indigo_events_disk_persister_compacted_bytes_total",
+	Help: "Bytes of commit bodies dropped by event log compaction",
+})
+
+var reorderBuffered = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "indigo_events_reorder_buffered",
+	Help: "Number of events held to be emitted in the order they were received",
+})
+
+var reorderLateEvents = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "indigo_events_reorder_late_total",
+	Help: "Number of events emitted out of receive order because they were handled after events received later than them had already been emitted",
+})
@@ -0,0 +1,73 @@
+package events
+
+import (
+	"context"
+	"time"
+
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/util"
+)
+
+// EventMiddleware is run on each event added to the event manager, before it
+// is sequenced, persisted and sent to subscribers and sinks. It can modify
+// the event in place, return a different event to send instead, or return nil
+// to drop it. Returning an error also drops the event, so that a redaction
+// that fails doesn't send out what it should have removed.
+type EventMiddleware func(ctx context.Context, evt *XRPCStreamEvent) (*XRPCStreamEvent, error)
+
+// Use adds middleware that events go through, in the order added. Must be
+// called before any events are added.
+func (em *EventManager) Use(mw ...EventMiddleware) {
+	em.middleware = append(em.middleware, mw...)
+}
+
+// applyMiddleware runs evt through the middleware chain, returning nil if it
+// was dropped
+func (em *EventManager) applyMiddleware(ctx context.Context, evt *XRPCStreamEvent) *XRPCStreamEvent {
+	for _, mw := range em.middleware {
+		out, err := mw(ctx, evt)
+		if err != nil {
+			log.Errorw("event middleware failed, dropping event", "err", err, "repo", evt.RepoDID())
+			middlewareDrops.WithLabelValues("error").Inc()
+			return nil
+		}
+		if out == nil {
+			middlewareDrops.WithLabelValues("dropped").Inc()
+			return nil
+		}
+		evt = out
+	}
+	return evt
+}
+
+// StripCommitBlobs is middleware emptying the deprecated blobs list of
+// commits, for relays that don't want to advertise blob references
+func StripCommitBlobs(ctx context.Context, evt *XRPCStreamEvent) (*XRPCStreamEvent, error) {
+	if evt.RepoCommit != nil {
+		evt.RepoCommit.Blobs = []lexutil.LexLink{}
+	}
+	return evt, nil
+}
+
+// StampRelayTime is middleware replacing the time on events with when the
+// relay sent them out, rather than when their PDS did
+func StampRelayTime(ctx context.Context, evt *XRPCStreamEvent) (*XRPCStreamEvent, error) {
+	now := time.Now().UTC().Format(util.ISO8601)
+	switch {
+	case evt.RepoCommit != nil:
+		evt.RepoCommit.Time = now
+	case evt.RepoHandle != nil:
+		evt.RepoHandle.Time = now
+	case evt.RepoMigrate != nil:
+		evt.RepoMigrate.Time = now
+	case evt.RepoTombstone != nil:
+		evt.RepoTombstone.Time = now
+	case evt.RepoIdentity != nil:
+		evt.RepoIdentity.Time = now
+	case evt.RepoAccount != nil:
+		evt.RepoAccount.Time = now
+	case evt.RepoSync != nil:
+		evt.RepoSync.Time = now
+	}
+	return evt, nil
+}
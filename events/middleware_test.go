@@ -0,0 +1,87 @@
+package events_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+
+	"github.com/ipfs/go-cid"
+)
+
+func TestEventMiddleware(t *testing.T) {
+	ctx := context.Background()
+	em := events.NewEventManager(events.NewMemPersister())
+	defer em.Shutdown(ctx)
+
+	var seen []string
+	em.Use(
+		func(ctx context.Context, evt *events.XRPCStreamEvent) (*events.XRPCStreamEvent, error) {
+			seen = append(seen, evt.RepoDID())
+			switch evt.RepoDID() {
+			case "did:plc:drop":
+				return nil, nil
+			case "did:plc:fail":
+				return nil, errors.New("redaction failed")
+			}
+			return evt, nil
+		},
+		events.StripCommitBlobs,
+		events.StampRelayTime,
+	)
+
+	ch, cleanup, err := em.Subscribe(ctx, "sub", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	for _, did := range []string{"did:plc:drop", "did:plc:fail"} {
+		if err := em.AddEvent(ctx, identityEvent(did)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := cid.Decode("bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := &events.XRPCStreamEvent{RepoCommit: &comatproto.SyncSubscribeRepos_Commit{
+		Repo:   "did:plc:keep",
+		Commit: lexutil.LexLink(c),
+		Blobs:  []lexutil.LexLink{lexutil.LexLink(c)},
+		Ops:    []*comatproto.SyncSubscribeRepos_RepoOp{},
+		Time:   "2024-01-01T00:00:00Z",
+	}}
+	before := time.Now().Add(-time.Second)
+	if err := em.AddEvent(ctx, commit); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case evt := <-ch:
+		if evt.RepoCommit == nil || evt.RepoCommit.Repo != "did:plc:keep" {
+			t.Fatalf("expected only the kept commit to be sent, got %+v", evt)
+		}
+		if evt.RepoCommit.Seq != 1 {
+			t.Fatalf("expected dropped events not to be sequenced, got seq %d", evt.RepoCommit.Seq)
+		}
+		if len(evt.RepoCommit.Blobs) != 0 {
+			t.Fatal("expected commit blobs to be stripped")
+		}
+		ts, err := time.Parse(time.RFC3339, evt.RepoCommit.Time)
+		if err != nil || ts.Before(before) {
+			t.Fatalf("expected relay time on commit, got %q", evt.RepoCommit.Time)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	if len(seen) != 3 {
+		t.Fatalf("expected middleware to see 3 events, saw %v", seen)
+	}
+}
@@ -0,0 +1,277 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+	"gorm.io/gorm"
+)
+
+// SeqImporter is a persister that can take events sequenced elsewhere
+type SeqImporter interface {
+	EventPersistence
+	PersistWithSeq(ctx context.Context, e *XRPCStreamEvent) error
+}
+
+// PersisterMigration records the progress of a MigratingPersistence, so that
+// the history requirement survives restarts
+type PersisterMigration struct {
+	Name        string `gorm:"primarykey"`
+	StartedAt   time.Time
+	CompletedAt *time.Time
+}
+
+type MigrationOptions struct {
+	// Identifies the migration; a new name starts a new migration
+	Name string
+	// How much history the new persister must have before it takes over
+	MinHistory time.Duration
+	// How often to check whether it is time to switch over
+	CheckInterval time.Duration
+}
+
+func DefaultMigrationOptions() *MigrationOptions {
+	return &MigrationOptions{
+		Name:          "default",
+		MinHistory:    72 * time.Hour,
+		CheckInterval: time.Minute,
+	}
+}
+
+// MigratingPersistence moves event persistence from one persister to another
+// without downtime. Until the new persister has enough history, events are
+// sequenced and played back by the old one, and each event is copied into the
+// new one with the same sequence number as the old one broadcasts it. Then
+// it switches over: the new persister sequences events from there on, carrying
+// on from the last copied sequence number, so consumers' cursors stay valid.
+//
+// Events the old persister fails to hand over (eg on a crash between the two
+// writes) leave a gap in the new persister's history.
+type MigratingPersistence struct {
+	from EventPersistence
+	to   SeqImporter
+
+	db   *gorm.DB
+	opts MigrationOptions
+
+	// held for reading while persisting, and for writing while switching over
+	lk        sync.RWMutex
+	started   time.Time
+	completed atomic.Bool
+
+	broadcast func(*XRPCStreamEvent)
+
+	exit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewMigratingPersistence(db *gorm.DB, from EventPersistence, to SeqImporter, opts *MigrationOptions) (*MigratingPersistence, error) {
+	if opts == nil {
+		opts = DefaultMigrationOptions()
+	}
+	if err := db.AutoMigrate(&PersisterMigration{}); err != nil {
+		return nil, err
+	}
+
+	var mig PersisterMigration
+	if err := db.Where("name = ?", opts.Name).Limit(1).Find(&mig).Error; err != nil {
+		return nil, err
+	}
+	if mig.Name == "" {
+		mig = PersisterMigration{Name: opts.Name, StartedAt: time.Now()}
+		if err := db.Create(&mig).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	mp := &MigratingPersistence{
+		from:    from,
+		to:      to,
+		db:      db,
+		opts:    *opts,
+		started: mig.StartedAt,
+		exit:    make(chan struct{}),
+	}
+	mp.completed.Store(mig.CompletedAt != nil)
+	persisterMigrationCompleted.Set(boolGauge(mp.completed.Load()))
+
+	from.SetEventBroadcaster(mp.fromBroadcast)
+	to.SetEventBroadcaster(mp.toBroadcast)
+
+	if mp.completed.Load() {
+		log.Infow("persister migration already complete", "name", opts.Name)
+	} else {
+		log.Infow("migrating event persister", "name", opts.Name, "started", mig.StartedAt, "switchAt", mig.StartedAt.Add(opts.MinHistory))
+		mp.wg.Add(1)
+		go mp.checkRoutine()
+	}
+
+	return mp, nil
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// fromBroadcast receives events once the old persister has sequenced them
+func (mp *MigratingPersistence) fromBroadcast(evt *XRPCStreamEvent) {
+	if mp.completed.Load() {
+		// stragglers flushed by the old persister after switching over have
+		// already been copied and delivered
+		return
+	}
+
+	if err := mp.to.PersistWithSeq(context.Background(), evt); err != nil {
+		persisterMigrationCopyErrors.Inc()
+		log.Errorw("failed to copy event to new persister", "seq", sequenceForEvent(evt), "err", err)
+	}
+	mp.broadcast(evt)
+}
+
+func (mp *MigratingPersistence) toBroadcast(evt *XRPCStreamEvent) {
+	// before switching over, the new persister only holds copies of events
+	// that were already delivered
+	if mp.completed.Load() {
+		mp.broadcast(evt)
+	}
+}
+
+func (mp *MigratingPersistence) checkRoutine() {
+	defer mp.wg.Done()
+
+	t := time.NewTicker(mp.opts.CheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-mp.exit:
+			return
+		case <-t.C:
+			if time.Since(mp.started) < mp.opts.MinHistory {
+				continue
+			}
+			if err := mp.SwitchOver(context.Background()); err != nil {
+				log.Errorw("failed to switch over to new persister", "err", err)
+				continue
+			}
+			return
+		}
+	}
+}
+
+// SwitchOver makes the new persister the primary one, regardless of how much
+// history it has
+func (mp *MigratingPersistence) SwitchOver(ctx context.Context) error {
+	mp.lk.Lock()
+	defer mp.lk.Unlock()
+
+	if mp.completed.Load() {
+		return nil
+	}
+
+	// everything the old persister has accepted must be sequenced and copied
+	// before the new one sequences anything itself, and the copies must be
+	// written before its broadcasts start going out
+	if err := mp.from.Flush(ctx); err != nil {
+		return fmt.Errorf("flushing old persister: %w", err)
+	}
+	if err := mp.to.Flush(ctx); err != nil {
+		return fmt.Errorf("flushing new persister: %w", err)
+	}
+
+	now := time.Now()
+	if err := mp.db.Model(&PersisterMigration{}).Where("name = ?", mp.opts.Name).Update("completed_at", now).Error; err != nil {
+		return err
+	}
+	mp.completed.Store(true)
+	persisterMigrationCompleted.Set(1)
+
+	log.Infow("switched over to new event persister", "name", mp.opts.Name, "history", now.Sub(mp.started))
+	return nil
+}
+
+// Completed reports whether the new persister has taken over
+func (mp *MigratingPersistence) Completed() bool {
+	return mp.completed.Load()
+}
+
+func (mp *MigratingPersistence) current() EventPersistence {
+	if mp.completed.Load() {
+		return mp.to
+	}
+	return mp.from
+}
+
+func (mp *MigratingPersistence) Persist(ctx context.Context, e *XRPCStreamEvent) error {
+	mp.lk.RLock()
+	defer mp.lk.RUnlock()
+	return mp.current().Persist(ctx, e)
+}
+
+func (mp *MigratingPersistence) Playback(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error) error {
+	mp.lk.RLock()
+	p := mp.current()
+	mp.lk.RUnlock()
+	return p.Playback(ctx, since, cb)
+}
+
+func (mp *MigratingPersistence) SeqForTime(ctx context.Context, t time.Time) (int64, error) {
+	mp.lk.RLock()
+	p := mp.current()
+	mp.lk.RUnlock()
+	return p.SeqForTime(ctx, t)
+}
+
+// TakeDownRepo removes the repo's events from both persisters
+func (mp *MigratingPersistence) TakeDownRepo(ctx context.Context, usr models.Uid) error {
+	return errors.Join(mp.from.TakeDownRepo(ctx, usr), mp.to.TakeDownRepo(ctx, usr))
+}
+
+func (mp *MigratingPersistence) Flush(ctx context.Context) error {
+	// the old persister first, as flushing it writes to the new one
+	if err := mp.from.Flush(ctx); err != nil {
+		return err
+	}
+	return mp.to.Flush(ctx)
+}
+
+func (mp *MigratingPersistence) Shutdown(ctx context.Context) error {
+	close(mp.exit)
+	mp.wg.Wait()
+
+	if err := mp.from.Shutdown(ctx); err != nil {
+		return err
+	}
+	return mp.to.Shutdown(ctx)
+}
+
+func (mp *MigratingPersistence) Unflushed() int {
+	var n int
+	for _, p := range []EventPersistence{mp.from, mp.to} {
+		if uc, ok := p.(UnflushedCounter); ok {
+			n += uc.Unflushed()
+		}
+	}
+	return n
+}
+
+// RepoHistory reads from the persister being migrated to, which has every
+// event since the migration started
+func (mp *MigratingPersistence) RepoHistory(ctx context.Context, usr models.Uid, limit int) ([]RepoHistoryEntry, error) {
+	idx, ok := mp.to.(RepoHistoryIndex)
+	if !ok {
+		return nil, ErrNoRepoHistory
+	}
+	return idx.RepoHistory(ctx, usr, limit)
+}
+
+func (mp *MigratingPersistence) SetEventBroadcaster(brc func(*XRPCStreamEvent)) {
+	mp.broadcast = brc
+}
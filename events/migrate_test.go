@@ -0,0 +1,184 @@
+package events_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/events"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/pds"
+	"github.com/bluesky-social/indigo/repomgr"
+	"github.com/bluesky-social/indigo/util"
+)
+
+func TestMigratingPersistence(t *testing.T) {
+	ctx := context.Background()
+
+	db, _, cs, tempPath, err := setupDBs(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempPath)
+
+	db.AutoMigrate(&pds.User{})
+	db.AutoMigrate(&pds.Peering{})
+	db.AutoMigrate(&models.ActorInfo{})
+
+	db.Create(&models.ActorInfo{
+		Uid: 1,
+		Did: "did:example:123",
+	})
+
+	mgr := repomgr.NewRepoManager(cs, &util.FakeKeyManager{})
+
+	if err := mgr.InitNewActor(ctx, 1, "alice", "did:example:123", "Alice", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	_, cid, err := mgr.CreateRecord(ctx, 1, "app.bsky.feed.post", &bsky.FeedPost{
+		Text:      "hello world",
+		CreatedAt: time.Now().Format(util.ISO8601),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := mgr.GetRepoRoot(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbp, err := events.NewDbPersistence(db, cs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dp, err := events.NewDiskPersistence(filepath.Join(tempPath, "diskPrimary"), filepath.Join(tempPath, "diskArchive"), db, &events.DiskPersistOptions{
+		EventsPerFile: 10,
+		UIDCacheSize:  100000,
+		DIDCacheSize:  100000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mp, err := events.NewMigratingPersistence(db, dbp, dp, &events.MigrationOptions{
+		Name:          "test",
+		MinHistory:    time.Hour,
+		CheckInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evtman := events.NewEventManager(mp)
+
+	addEvents := func(n int) {
+		for i := 0; i < n; i++ {
+			cidLink := lexutil.LexLink(cid)
+			headLink := lexutil.LexLink(head)
+			err := evtman.AddEvent(ctx, &events.XRPCStreamEvent{
+				RepoCommit: &atproto.SyncSubscribeRepos_Commit{
+					Repo:   "did:example:123",
+					Commit: headLink,
+					Ops: []*atproto.SyncSubscribeRepos_RepoOp{
+						{
+							Action: "add",
+							Cid:    &cidLink,
+							Path:   "path1",
+						},
+					},
+					Time: time.Now().Format(util.ISO8601),
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	seqs := func(p events.EventPersistence) []int64 {
+		var out []int64
+		if err := p.Playback(ctx, 0, func(evt *events.XRPCStreamEvent) error {
+			out = append(out, evt.RepoCommit.Seq)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	addEvents(25)
+	if err := mp.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	fromSeqs := seqs(dbp)
+	toSeqs := seqs(dp)
+	if len(fromSeqs) != 25 {
+		t.Fatalf("expected 25 events in the old persister, got %d", len(fromSeqs))
+	}
+	if len(toSeqs) != len(fromSeqs) {
+		t.Fatalf("expected %d copied events, got %d", len(fromSeqs), len(toSeqs))
+	}
+	for i := range fromSeqs {
+		if fromSeqs[i] != toSeqs[i] {
+			t.Fatalf("event %d: copied with seq %d, expected %d", i, toSeqs[i], fromSeqs[i])
+		}
+	}
+
+	if mp.Completed() {
+		t.Fatal("migration completed before switching over")
+	}
+	if err := mp.SwitchOver(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !mp.Completed() {
+		t.Fatal("migration not completed after switching over")
+	}
+
+	addEvents(5)
+	if err := mp.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(seqs(dbp)); n != 25 {
+		t.Fatalf("old persister got events after switching over: has %d", n)
+	}
+
+	all := seqs(mp)
+	if len(all) != 30 {
+		t.Fatalf("expected 30 events after switching over, got %d", len(all))
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i] <= all[i-1] {
+			t.Fatalf("sequence went backwards after switching over: %d then %d", all[i-1], all[i])
+		}
+	}
+	if all[25] != fromSeqs[24]+1 {
+		t.Fatalf("expected the new persister to carry on from %d, got %d", fromSeqs[24]+1, all[25])
+	}
+
+	if err := mp.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the migration's completion persists across restarts
+	mp2, err := events.NewMigratingPersistence(db, dbp, dp, &events.MigrationOptions{
+		Name:          "test",
+		MinHistory:    time.Hour,
+		CheckInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mp2.Completed() {
+		t.Fatal("expected migration to still be complete")
+	}
+}
@@ -0,0 +1,268 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// NatsPublisher publishes to JetStream; jetstream.JetStream implements it
+type NatsPublisher interface {
+	PublishMsgAsync(msg *nats.Msg, opts ...jetstream.PublishOpt) (jetstream.PubAckFuture, error)
+}
+
+type NatsSinkOptions struct {
+	// First token of every subject
+	SubjectPrefix string
+	// Longest to wait for the server to acknowledge a batch
+	AckTimeout time.Duration
+	// Most events published before waiting for acknowledgements
+	BatchSize int
+	// Events waiting to be published; events that arrive while it is full
+	// are dropped rather than holding up the firehose
+	QueueSize int
+}
+
+func DefaultNatsSinkOptions() *NatsSinkOptions {
+	return &NatsSinkOptions{
+		SubjectPrefix: "atproto",
+		AckTimeout:    10 * time.Second,
+		BatchSize:     1000,
+		QueueSize:     100_000,
+	}
+}
+
+// NatsSink publishes every sequenced event to NATS JetStream, on subjects
+// named for the event type, and for commits, the collections they touch:
+//
+//	atproto.commit.app.bsky.feed.post
+//	atproto.identity
+//	atproto.account
+//
+// so that consumers can filter server-side, eg on atproto.commit.app.bsky.>
+// A commit touching several collections is published once on each of their
+// subjects; commits without ops are published on atproto.commit.none.
+//
+// Messages are the firehose frame, with headers giving the sequence number
+// and repo DID. Each carries a Nats-Msg-Id, so a stream with a duplicate
+// window discards any resent after a reconnect.
+type NatsSink struct {
+	js   NatsPublisher
+	opts NatsSinkOptions
+
+	events chan *XRPCStreamEvent
+
+	exit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Headers set on published messages
+const (
+	NatsSeqHeader  = "Atproto-Seq"
+	NatsRepoHeader = "Atproto-Repo"
+)
+
+func NewNatsSink(js NatsPublisher, opts *NatsSinkOptions) *NatsSink {
+	if opts == nil {
+		opts = DefaultNatsSinkOptions()
+	}
+
+	return &NatsSink{
+		js:     js,
+		opts:   *opts,
+		events: make(chan *XRPCStreamEvent, opts.QueueSize),
+		exit:   make(chan struct{}),
+	}
+}
+
+// EnsureNatsStream creates the stream that captures every subject under the
+// prefix, or updates its retention if it exists
+func EnsureNatsStream(ctx context.Context, js jetstream.JetStream, name, prefix string, maxAge time.Duration) error {
+	_, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:       name,
+		Subjects:   []string{prefix + ".>"},
+		MaxAge:     maxAge,
+		Duplicates: 10 * time.Minute,
+	})
+	return err
+}
+
+// Start starts publishing queued events
+func (ns *NatsSink) Start() {
+	ns.wg.Add(1)
+	go ns.run()
+}
+
+// Enqueue queues a sequenced event to be published, without blocking
+func (ns *NatsSink) Enqueue(evt *XRPCStreamEvent) {
+	if sequenceForEvent(evt) <= 0 {
+		return
+	}
+
+	select {
+	case ns.events <- evt:
+	default:
+		natsDropped.WithLabelValues("queue_full").Inc()
+	}
+}
+
+// Shutdown publishes everything queued
+func (ns *NatsSink) Shutdown(ctx context.Context) error {
+	close(ns.exit)
+
+	done := make(chan struct{})
+	go func() {
+		ns.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("nats sink did not finish publishing: %w", ctx.Err())
+	}
+}
+
+func (ns *NatsSink) run() {
+	defer ns.wg.Done()
+
+	batch := make([]*XRPCStreamEvent, 0, ns.opts.BatchSize)
+
+	// fill takes whatever else is queued, up to the batch size
+	fill := func() {
+		for len(batch) < ns.opts.BatchSize {
+			select {
+			case evt := <-ns.events:
+				batch = append(batch, evt)
+			default:
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case evt := <-ns.events:
+			batch = append(batch, evt)
+			fill()
+			ns.publish(batch)
+			batch = batch[:0]
+		case <-ns.exit:
+			for len(ns.events) > 0 {
+				fill()
+				ns.publish(batch)
+				batch = batch[:0]
+			}
+			return
+		}
+	}
+}
+
+// publish sends a batch asynchronously, then waits for the acknowledgements
+func (ns *NatsSink) publish(batch []*XRPCStreamEvent) {
+	var futures []jetstream.PubAckFuture
+	for _, evt := range batch {
+		msgs, err := ns.messages(evt)
+		if err != nil {
+			log.Errorw("failed to encode event for nats", "seq", sequenceForEvent(evt), "err", err)
+			natsDropped.WithLabelValues("encode").Inc()
+			continue
+		}
+
+		for _, msg := range msgs {
+			f, err := ns.js.PublishMsgAsync(msg)
+			if err != nil {
+				log.Errorw("failed to publish event to nats", "subject", msg.Subject, "seq", sequenceForEvent(evt), "err", err)
+				natsDropped.WithLabelValues("publish").Inc()
+				continue
+			}
+			futures = append(futures, f)
+		}
+	}
+
+	timeout := time.NewTimer(ns.opts.AckTimeout)
+	defer timeout.Stop()
+
+	for i, f := range futures {
+		select {
+		case <-f.Ok():
+			natsPublished.Inc()
+		case err := <-f.Err():
+			log.Errorw("nats rejected event", "subject", f.Msg().Subject, "seq", f.Msg().Header.Get(NatsSeqHeader), "err", err)
+			natsDropped.WithLabelValues("publish").Inc()
+		case <-timeout.C:
+			log.Errorw("timed out waiting for nats to acknowledge events", "unacked", len(futures)-i)
+			natsDropped.WithLabelValues("ack_timeout").Add(float64(len(futures) - i))
+			return
+		}
+	}
+}
+
+// messages returns the messages to publish for an event: one per subject
+func (ns *NatsSink) messages(evt *XRPCStreamEvent) ([]*nats.Msg, error) {
+	if err := evt.Preserialize(); err != nil {
+		return nil, err
+	}
+
+	typ, body := evt.message()
+	if body == nil {
+		return nil, fmt.Errorf("unrecognized event kind")
+	}
+
+	seq := strconv.FormatInt(sequenceForEvent(evt), 10)
+	subject := ns.opts.SubjectPrefix + "." + strings.TrimPrefix(typ, "#")
+
+	var subjects []string
+	if evt.RepoCommit != nil {
+		for _, col := range commitCollections(evt.RepoCommit.Ops) {
+			subjects = append(subjects, subject+"."+col)
+		}
+		if len(subjects) == 0 {
+			subjects = append(subjects, subject+".none")
+		}
+	} else {
+		subjects = append(subjects, subject)
+	}
+
+	msgs := make([]*nats.Msg, 0, len(subjects))
+	for _, subj := range subjects {
+		msg := nats.NewMsg(subj)
+		msg.Data = evt.Preserialized
+		msg.Header.Set(NatsSeqHeader, seq)
+		msg.Header.Set(NatsRepoHeader, evt.RepoDID())
+		msg.Header.Set(jetstream.MsgIDHeader, seq+":"+subj)
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// commitCollections returns the distinct collections a commit's ops touch,
+// sorted. Anything that isn't a valid NSID, and so might not be a valid
+// subject, is reported as "invalid".
+func commitCollections(ops []*comatproto.SyncSubscribeRepos_RepoOp) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, op := range ops {
+		col, _, _ := strings.Cut(op.Path, "/")
+		if _, err := syntax.ParseNSID(col); err != nil {
+			col = "invalid"
+		}
+		if !seen[col] {
+			seen[col] = true
+			out = append(out, col)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
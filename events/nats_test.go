@@ -0,0 +1,122 @@
+package events_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+
+	"github.com/ipfs/go-cid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+type fakePubAck struct {
+	msg *nats.Msg
+	ok  chan *jetstream.PubAck
+}
+
+func (f *fakePubAck) Ok() <-chan *jetstream.PubAck { return f.ok }
+func (f *fakePubAck) Err() <-chan error            { return nil }
+func (f *fakePubAck) Msg() *nats.Msg               { return f.msg }
+
+type fakeJetStream struct {
+	lk   sync.Mutex
+	msgs []*nats.Msg
+}
+
+func (fj *fakeJetStream) PublishMsgAsync(msg *nats.Msg, opts ...jetstream.PublishOpt) (jetstream.PubAckFuture, error) {
+	fj.lk.Lock()
+	defer fj.lk.Unlock()
+	fj.msgs = append(fj.msgs, msg)
+
+	f := &fakePubAck{msg: msg, ok: make(chan *jetstream.PubAck, 1)}
+	f.ok <- &jetstream.PubAck{}
+	return f, nil
+}
+
+func TestNatsSink(t *testing.T) {
+	ctx := context.Background()
+
+	fj := &fakeJetStream{}
+	sink := events.NewNatsSink(fj, nil)
+	sink.Start()
+
+	evtman := events.NewEventManager(events.NewMemPersister())
+	evtman.AddSink(sink)
+
+	c, err := cid.Decode("bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := lexutil.LexLink(c)
+
+	commit := func(paths ...string) *events.XRPCStreamEvent {
+		var ops []*atproto.SyncSubscribeRepos_RepoOp
+		for _, p := range paths {
+			ops = append(ops, &atproto.SyncSubscribeRepos_RepoOp{Action: "create", Path: p, Cid: &link})
+		}
+		return &events.XRPCStreamEvent{
+			RepoCommit: &atproto.SyncSubscribeRepos_Commit{
+				Repo:   "did:example:123",
+				Commit: link,
+				Ops:    ops,
+				Time:   "2024-05-01T00:00:00Z",
+			},
+		}
+	}
+
+	for _, evt := range []*events.XRPCStreamEvent{
+		commit("app.bsky.feed.post/a"),
+		commit("app.bsky.feed.post/b", "app.bsky.feed.like/c", "app.bsky.feed.post/d"),
+		commit(),
+		commit("not a collection/e"),
+		{RepoIdentity: &atproto.SyncSubscribeRepos_Identity{Did: "did:example:456", Time: "2024-05-01T00:00:00Z"}},
+	} {
+		if err := evtman.AddEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := evtman.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		subject string
+		seq     string
+		repo    string
+	}{
+		{"atproto.commit.app.bsky.feed.post", "1", "did:example:123"},
+		{"atproto.commit.app.bsky.feed.like", "2", "did:example:123"},
+		{"atproto.commit.app.bsky.feed.post", "2", "did:example:123"},
+		{"atproto.commit.none", "3", "did:example:123"},
+		{"atproto.commit.invalid", "4", "did:example:123"},
+		{"atproto.identity", "5", "did:example:456"},
+	}
+
+	if len(fj.msgs) != len(expected) {
+		t.Fatalf("expected %d messages, got %d", len(expected), len(fj.msgs))
+	}
+	for i, exp := range expected {
+		msg := fj.msgs[i]
+		if msg.Subject != exp.subject {
+			t.Fatalf("message %d: expected subject %s, got %s", i, exp.subject, msg.Subject)
+		}
+		if msg.Header.Get(events.NatsSeqHeader) != exp.seq {
+			t.Fatalf("message %d: expected seq %s, got %s", i, exp.seq, msg.Header.Get(events.NatsSeqHeader))
+		}
+		if msg.Header.Get(events.NatsRepoHeader) != exp.repo {
+			t.Fatalf("message %d: expected repo %s, got %s", i, exp.repo, msg.Header.Get(events.NatsRepoHeader))
+		}
+		if msg.Header.Get(jetstream.MsgIDHeader) != exp.seq+":"+exp.subject {
+			t.Fatalf("message %d: unexpected message id %s", i, msg.Header.Get(jetstream.MsgIDHeader))
+		}
+		if len(msg.Data) == 0 {
+			t.Fatalf("message %d: empty frame", i)
+		}
+	}
+}
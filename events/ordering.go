@@ -0,0 +1,189 @@
+package events
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+type receivedAtKey struct{}
+
+// WithReceivedAt returns a context that marks the events added to the event
+// manager with it as derived from an event received from upstream at t. In
+// chronological order mode, events are emitted in order of this time; events
+// added without one were received when they were added.
+func WithReceivedAt(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, receivedAtKey{}, t)
+}
+
+func receivedAtFrom(ctx context.Context) time.Time {
+	if t, ok := ctx.Value(receivedAtKey{}).(time.Time); ok {
+		return t
+	}
+	return time.Now()
+}
+
+// reorderBuffer holds events for up to maxDelay after they were received,
+// and releases them in order of when they were received, so that events
+// from different hosts come out in roughly the order they came in rather
+// than the order they finished being handled in. An event added after an
+// event received later than it has been released can't be put in order, and
+// is released straight away.
+type reorderBuffer struct {
+	maxDelay time.Duration
+	release  func(*XRPCStreamEvent)
+
+	lk sync.Mutex
+	// the receive time of the last event released
+	watermark time.Time
+	pending   reorderHeap
+	seq       uint64
+	wake      chan struct{}
+	closed    bool
+	done      chan struct{}
+}
+
+type reorderItem struct {
+	at  time.Time
+	seq uint64
+	evt *XRPCStreamEvent
+}
+
+type reorderHeap []reorderItem
+
+func (h reorderHeap) Len() int { return len(h) }
+func (h reorderHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+func (h reorderHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *reorderHeap) Push(x any)   { *h = append(*h, x.(reorderItem)) }
+func (h *reorderHeap) Pop() any {
+	old := *h
+	it := old[len(old)-1]
+	old[len(old)-1] = reorderItem{}
+	*h = old[:len(old)-1]
+	return it
+}
+
+func newReorderBuffer(maxDelay time.Duration, release func(*XRPCStreamEvent)) *reorderBuffer {
+	rb := &reorderBuffer{
+		maxDelay: maxDelay,
+		release:  release,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	go rb.run()
+	return rb
+}
+
+func (rb *reorderBuffer) add(evt *XRPCStreamEvent, at time.Time) {
+	rb.lk.Lock()
+	if rb.closed || at.Before(rb.watermark) {
+		rb.lk.Unlock()
+		if !rb.closed {
+			reorderLateEvents.Inc()
+		}
+		rb.release(evt)
+		return
+	}
+
+	rb.seq++
+	heap.Push(&rb.pending, reorderItem{at: at, seq: rb.seq, evt: evt})
+	first := rb.pending[0].seq == rb.seq
+	rb.lk.Unlock()
+	reorderBuffered.Inc()
+
+	// a new earliest event may be due sooner than the one being waited on
+	if first {
+		select {
+		case rb.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// due pops the events received at least maxDelay ago, returning them and
+// how long until the next one is due
+func (rb *reorderBuffer) due(now time.Time, all bool) ([]*XRPCStreamEvent, time.Duration) {
+	rb.lk.Lock()
+	defer rb.lk.Unlock()
+
+	var out []*XRPCStreamEvent
+	for len(rb.pending) > 0 {
+		next := rb.pending[0]
+		if wait := next.at.Add(rb.maxDelay).Sub(now); wait > 0 && !all {
+			return out, wait
+		}
+		heap.Pop(&rb.pending)
+		rb.watermark = next.at
+		out = append(out, next.evt)
+	}
+	return out, rb.maxDelay
+}
+
+func (rb *reorderBuffer) run() {
+	defer close(rb.done)
+
+	timer := time.NewTimer(rb.maxDelay)
+	defer timer.Stop()
+	for {
+		evts, wait := rb.due(time.Now(), false)
+		for _, evt := range evts {
+			reorderBuffered.Dec()
+			rb.release(evt)
+		}
+
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case _, ok := <-rb.wake:
+			if !ok {
+				evts, _ := rb.due(time.Now(), true)
+				for _, evt := range evts {
+					reorderBuffered.Dec()
+					rb.release(evt)
+				}
+				return
+			}
+		}
+	}
+}
+
+// close releases every buffered event, in order, and waits for them to be
+// released. Events added afterwards are released straight away.
+func (rb *reorderBuffer) close() {
+	rb.lk.Lock()
+	if rb.closed {
+		rb.lk.Unlock()
+		return
+	}
+	rb.closed = true
+	close(rb.wake)
+	rb.lk.Unlock()
+	<-rb.done
+}
+
+// buffered returns the number of events being held
+func (rb *reorderBuffer) buffered() int {
+	rb.lk.Lock()
+	defer rb.lk.Unlock()
+	return len(rb.pending)
+}
+
+// SetChronologicalOrder holds each event for up to maxDelay after it was
+// received (see WithReceivedAt) and emits events in the order they were
+// received, across hosts, instead of the order they finished being handled
+// in. Zero turns it off. Must be called before any events are added.
+func (em *EventManager) SetChronologicalOrder(maxDelay time.Duration) {
+	if maxDelay <= 0 {
+		em.reorder = nil
+		return
+	}
+	em.reorder = newReorderBuffer(maxDelay, func(evt *XRPCStreamEvent) {
+		em.persistAndSendEvent(context.Background(), evt)
+	})
+}
@@ -0,0 +1,100 @@
+package events_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/models"
+)
+
+// orderPersister records the repos of the events persisted, in order
+type orderPersister struct {
+	lk    sync.Mutex
+	repos []string
+}
+
+func (op *orderPersister) Persist(ctx context.Context, e *events.XRPCStreamEvent) error {
+	op.lk.Lock()
+	defer op.lk.Unlock()
+	op.repos = append(op.repos, e.RepoDID())
+	return nil
+}
+
+func (op *orderPersister) persisted() []string {
+	op.lk.Lock()
+	defer op.lk.Unlock()
+	return append([]string(nil), op.repos...)
+}
+
+func (op *orderPersister) Playback(ctx context.Context, since int64, cb func(*events.XRPCStreamEvent) error) error {
+	return nil
+}
+
+func (op *orderPersister) SeqForTime(ctx context.Context, t time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (op *orderPersister) TakeDownRepo(ctx context.Context, usr models.Uid) error { return nil }
+func (op *orderPersister) Flush(ctx context.Context) error                        { return nil }
+func (op *orderPersister) Shutdown(ctx context.Context) error                     { return nil }
+func (op *orderPersister) SetEventBroadcaster(func(*events.XRPCStreamEvent))      {}
+
+func TestChronologicalOrder(t *testing.T) {
+	ctx := context.Background()
+	op := &orderPersister{}
+	em := events.NewEventManager(op)
+	em.SetChronologicalOrder(100 * time.Millisecond)
+
+	add := func(repo string, at time.Time) {
+		evt := &events.XRPCStreamEvent{RepoIdentity: &comatproto.SyncSubscribeRepos_Identity{Did: repo}}
+		if err := em.AddEvent(events.WithReceivedAt(ctx, at), evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// b finishes being handled first, but a was received first
+	now := time.Now()
+	add("b", now)
+	add("a", now.Add(-10*time.Millisecond))
+	if got := op.persisted(); len(got) != 0 {
+		t.Fatalf("expected events to be held, got %v", got)
+	}
+	if n := em.Unflushed(); n != 2 {
+		t.Fatalf("expected 2 held events, got %d", n)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(op.persisted()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("held events weren't released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// received before events already released, so it can't be put in order
+	add("late", now.Add(-20*time.Millisecond))
+	if got := op.persisted(); len(got) != 3 {
+		t.Fatalf("expected a late event to be released straight away, got %v", got)
+	}
+
+	// held events are released on shutdown
+	add("c", time.Now())
+	if err := em.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	got := op.persisted()
+	want := []string{"a", "b", "late", "c"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
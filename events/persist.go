@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/bluesky-social/indigo/models"
 )
@@ -12,6 +14,10 @@ import (
 type EventPersistence interface {
 	Persist(ctx context.Context, e *XRPCStreamEvent) error
 	Playback(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error) error
+	// SeqForTime returns a cursor to play back from to get the events
+	// persisted from t on. It may be a little early, but never late; zero
+	// means everything retained is from t or later.
+	SeqForTime(ctx context.Context, t time.Time) (int64, error)
 	TakeDownRepo(ctx context.Context, usr models.Uid) error
 	Flush(context.Context) error
 	Shutdown(context.Context) error
@@ -19,6 +25,31 @@ type EventPersistence interface {
 	SetEventBroadcaster(func(*XRPCStreamEvent))
 }
 
+var persistFailures atomic.Int64
+
+// PersistFailures returns the number of times persisting an event, or writing
+// out buffered events, has failed since startup
+func PersistFailures() int64 {
+	return persistFailures.Load()
+}
+
+// recordPersistFailure counts a failed write; stage is "persist" for a
+// failed Persist, or "flush" for buffered events that failed to be written
+// out in the background
+func recordPersistFailure(stage string) {
+	persistFailures.Add(1)
+	persisterWriteFailures.WithLabelValues(stage).Inc()
+}
+
+// UnflushedCounter is implemented by persisters that buffer events before
+// writing them out, so that shutdown can report what was lost if the final
+// flush fails
+type UnflushedCounter interface {
+	// Unflushed returns the number of buffered events not yet written out.
+	// It must not block on a flush in progress.
+	Unflushed() int
+}
+
 // MemPersister is the most naive implementation of event persistence
 // This EventPersistence option works fine with all event types
 // ill do better later
@@ -47,6 +78,8 @@ func (mp *MemPersister) Persist(ctx context.Context, e *XRPCStreamEvent) error {
 		e.RepoIdentity.Seq = mp.seq
 	case e.RepoAccount != nil:
 		e.RepoAccount.Seq = mp.seq
+	case e.RepoSync != nil:
+		e.RepoSync.Seq = mp.seq
 	case e.RepoMigrate != nil:
 		e.RepoMigrate.Seq = mp.seq
 	case e.RepoTombstone != nil:
@@ -82,6 +115,18 @@ func (mp *MemPersister) Playback(ctx context.Context, since int64, cb func(*XRPC
 	return nil
 }
 
+func (mp *MemPersister) SeqForTime(ctx context.Context, t time.Time) (int64, error) {
+	mp.lk.Lock()
+	defer mp.lk.Unlock()
+
+	for _, e := range mp.buf {
+		if et, ok := eventTime(e); ok && !et.Before(t) {
+			return sequenceForEvent(e) - 1, nil
+		}
+	}
+	return mp.seq, nil
+}
+
 func (mp *MemPersister) TakeDownRepo(ctx context.Context, uid models.Uid) error {
 	return fmt.Errorf("repo takedowns not currently supported by memory persister, test usage only")
 }
@@ -0,0 +1,96 @@
+package events
+
+import (
+	"context"
+	"sync"
+)
+
+// PersistAck tracks the events added to the event manager on behalf of some
+// piece of work, such as handling an event from upstream, so that the work's
+// owner can tell once everything it produced is safely persisted. The ack
+// starts out held by the work itself; once the work calls Release and every
+// event added with the ack has been persisted (or dropped, or failed to
+// persist), done is called, with persisted false if any of them failed.
+type PersistAck struct {
+	lk       sync.Mutex
+	pending  int
+	released bool
+	failed   bool
+	done     func(persisted bool)
+}
+
+// NewPersistAck returns an ack held by the caller, who must Release it
+func NewPersistAck(done func(persisted bool)) *PersistAck {
+	return &PersistAck{pending: 1, done: done}
+}
+
+type persistAckKey struct{}
+
+// WithPersistAck returns a context that adds the events added to the event
+// manager with it to ack
+func WithPersistAck(ctx context.Context, ack *PersistAck) context.Context {
+	return context.WithValue(ctx, persistAckKey{}, ack)
+}
+
+func persistAckFrom(ctx context.Context) *PersistAck {
+	ack, _ := ctx.Value(persistAckKey{}).(*PersistAck)
+	return ack
+}
+
+// add counts another event against the ack, returning false if the ack is
+// already done, as it is for events added by work outliving the context
+func (a *PersistAck) add() bool {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	if a.released {
+		return false
+	}
+	a.pending++
+	return true
+}
+
+// Release gives up one hold on the ack
+func (a *PersistAck) Release() {
+	if a == nil {
+		return
+	}
+
+	a.lk.Lock()
+	a.pending--
+	done := a.pending == 0 && !a.released
+	if done {
+		a.released = true
+	}
+	persisted := !a.failed
+	a.lk.Unlock()
+
+	if done && a.done != nil {
+		a.done(persisted)
+	}
+}
+
+// fail gives up one hold on the ack for an event that couldn't be persisted
+func (a *PersistAck) fail() {
+	a.lk.Lock()
+	a.failed = true
+	a.lk.Unlock()
+	a.Release()
+}
+
+// releaseAck releases the ack of an event once it has been persisted, or
+// won't be
+func (evt *XRPCStreamEvent) releaseAck() {
+	if ack := evt.ack; ack != nil {
+		evt.ack = nil
+		ack.Release()
+	}
+}
+
+// failAck releases the ack of an event that failed to persist, so the ack's
+// owner knows not to count it as written out
+func (evt *XRPCStreamEvent) failAck() {
+	if ack := evt.ack; ack != nil {
+		evt.ack = nil
+		ack.fail()
+	}
+}
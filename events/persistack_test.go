@@ -0,0 +1,140 @@
+package events_test
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/models"
+)
+
+// bufferingPersister holds events until flushed, like the disk persister
+type bufferingPersister struct {
+	buf       []*events.XRPCStreamEvent
+	broadcast func(*events.XRPCStreamEvent)
+}
+
+func (bp *bufferingPersister) Persist(ctx context.Context, e *events.XRPCStreamEvent) error {
+	bp.buf = append(bp.buf, e)
+	return nil
+}
+
+func (bp *bufferingPersister) Flush(ctx context.Context) error {
+	for _, e := range bp.buf {
+		bp.broadcast(e)
+	}
+	bp.buf = nil
+	return nil
+}
+
+func (bp *bufferingPersister) Playback(ctx context.Context, since int64, cb func(*events.XRPCStreamEvent) error) error {
+	return nil
+}
+
+func (bp *bufferingPersister) SeqForTime(ctx context.Context, t time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (bp *bufferingPersister) TakeDownRepo(ctx context.Context, usr models.Uid) error { return nil }
+func (bp *bufferingPersister) Shutdown(ctx context.Context) error                     { return bp.Flush(ctx) }
+func (bp *bufferingPersister) SetEventBroadcaster(f func(*events.XRPCStreamEvent))    { bp.broadcast = f }
+
+func TestPersistAck(t *testing.T) {
+	ctx := context.Background()
+	bp := &bufferingPersister{}
+	em := events.NewEventManager(bp)
+	defer em.Shutdown(ctx)
+
+	em.Use(func(ctx context.Context, evt *events.XRPCStreamEvent) (*events.XRPCStreamEvent, error) {
+		if evt.RepoDID() == "did:plc:drop" {
+			return nil, nil
+		}
+		return evt, nil
+	})
+
+	var acked atomic.Int64
+	ack := events.NewPersistAck(func(bool) { acked.Add(1) })
+	actx := events.WithPersistAck(ctx, ack)
+
+	for _, did := range []string{"did:plc:one", "did:plc:drop", "did:plc:two"} {
+		if err := em.AddEvent(actx, identityEvent(did)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the work is done, but its events aren't persisted yet
+	ack.Release()
+	if acked.Load() != 0 {
+		t.Fatal("expected ack to wait for the events to be persisted")
+	}
+
+	if err := bp.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if acked.Load() != 1 {
+		t.Fatalf("expected ack once events were persisted, got %d", acked.Load())
+	}
+
+	// events added after the ack is done aren't counted against it
+	if err := em.AddEvent(actx, identityEvent("did:plc:late")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bp.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if acked.Load() != 1 {
+		t.Fatalf("expected ack to be done only once, got %d", acked.Load())
+	}
+
+	// work that sends nothing out is acknowledged as soon as it's done
+	empty := events.NewPersistAck(func(bool) { acked.Add(1) })
+	empty.Release()
+	if acked.Load() != 2 {
+		t.Fatal("expected ack with no events to be done on release")
+	}
+}
+
+// failingPersister can't persist anything
+type failingPersister struct {
+	bufferingPersister
+}
+
+func (fp *failingPersister) Persist(ctx context.Context, e *events.XRPCStreamEvent) error {
+	return fmt.Errorf("disk full")
+}
+
+func TestPersistFailure(t *testing.T) {
+	ctx := context.Background()
+	em := events.NewEventManager(&failingPersister{})
+	defer em.Shutdown(ctx)
+
+	var acked, persisted atomic.Int64
+	ack := events.NewPersistAck(func(ok bool) {
+		acked.Add(1)
+		if ok {
+			persisted.Add(1)
+		}
+	})
+	actx := events.WithPersistAck(ctx, ack)
+
+	before := events.PersistFailures()
+	if err := em.AddEvent(actx, identityEvent("did:plc:one")); err != nil {
+		t.Fatal(err)
+	}
+	if n := events.PersistFailures() - before; n != 1 {
+		t.Fatalf("expected one persist failure to be counted, got %d", n)
+	}
+
+	// the event will never be persisted, so doesn't hold up the ack, but the
+	// ack mustn't count it as written out
+	ack.Release()
+	if acked.Load() != 1 {
+		t.Fatal("expected ack once the failed event was given up on")
+	}
+	if persisted.Load() != 0 {
+		t.Fatal("expected ack to report the event wasn't persisted")
+	}
+}
@@ -0,0 +1,128 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+)
+
+// ErrNoRepoHistory is returned by RepoHistory when the persister doesn't
+// index events by repo
+var ErrNoRepoHistory = errors.New("persister doesn't index events by repo")
+
+// RepoHistoryEntry is an event about a repo, as recorded in a persister's
+// repo index
+type RepoHistoryEntry struct {
+	Seq  int64  `json:"seq"`
+	Type string `json:"type"`
+	// The rev of commit and sync events
+	Rev string `json:"rev,omitempty"`
+	// The CID of commit events' commit
+	Commit string `json:"commit,omitempty"`
+	// The time set on the event upstream, if any
+	Time *time.Time `json:"time,omitempty"`
+	// When the event was written out to the log
+	PersistedAt time.Time `json:"persistedAt"`
+}
+
+// RepoHistoryIndex is implemented by persisters that index the events they
+// persist by repo
+type RepoHistoryIndex interface {
+	// RepoHistory returns up to limit of the latest events persisted for
+	// the repo, newest first
+	RepoHistory(ctx context.Context, usr models.Uid, limit int) ([]RepoHistoryEntry, error)
+}
+
+// RepoHistory returns up to limit of the latest events persisted for the
+// repo, newest first, or ErrNoRepoHistory if the persister doesn't keep them
+func (em *EventManager) RepoHistory(ctx context.Context, usr models.Uid, limit int) ([]RepoHistoryEntry, error) {
+	idx, ok := em.persister.(RepoHistoryIndex)
+	if !ok {
+		return nil, ErrNoRepoHistory
+	}
+	return idx.RepoHistory(ctx, usr, limit)
+}
+
+// RepoEventRef indexes an event in the disk persister's log by the repo it's
+// about. Refs are deleted along with their log file.
+type RepoEventRef struct {
+	ID          uint       `gorm:"primarykey"`
+	Usr         models.Uid `gorm:"index:idx_repo_event_refs_usr_seq,priority:1"`
+	Seq         int64      `gorm:"index:idx_repo_event_refs_usr_seq,priority:2"`
+	LogFile     uint       `gorm:"index"`
+	Type        string
+	Rev         string
+	Commit      string
+	Time        *time.Time
+	PersistedAt time.Time
+}
+
+func newRepoEventRef(usr models.Uid, logFile uint, e *XRPCStreamEvent, now time.Time) RepoEventRef {
+	ref := RepoEventRef{
+		Usr:         usr,
+		Seq:         sequenceForEvent(e),
+		LogFile:     logFile,
+		Type:        e.MessageType(),
+		PersistedAt: now,
+	}
+	if t, ok := eventTime(e); ok {
+		ref.Time = &t
+	}
+	switch {
+	case e.RepoCommit != nil:
+		ref.Rev = e.RepoCommit.Rev
+		ref.Commit = e.RepoCommit.Commit.String()
+	case e.RepoSync != nil:
+		ref.Rev = e.RepoSync.Rev
+	}
+	return ref
+}
+
+// indexRepoEvents records the events about to be written out in the repo
+// index. Failing to is logged rather than failing the flush, as it only
+// leaves gaps in repo history.
+func (dp *DiskPersistence) indexRepoEvents(ctx context.Context, jobs []persistJob) {
+	now := dp.clock.Now()
+	refs := make([]RepoEventRef, 0, len(jobs))
+	for _, j := range jobs {
+		if j.Usr == 0 {
+			continue
+		}
+		refs = append(refs, newRepoEventRef(j.Usr, dp.logRef, j.Evt, now))
+	}
+	if len(refs) == 0 {
+		return
+	}
+
+	if err := dp.meta.WithContext(ctx).CreateInBatches(refs, 500).Error; err != nil {
+		log.Errorw("failed to index events by repo", "events", len(refs), "err", err)
+	}
+}
+
+// RepoHistory reads the repo's latest events from the repo index. Events
+// persisted while the index was off, or before the retention, aren't found.
+func (dp *DiskPersistence) RepoHistory(ctx context.Context, usr models.Uid, limit int) ([]RepoHistoryEntry, error) {
+	if !dp.repoIndex {
+		return nil, ErrNoRepoHistory
+	}
+
+	var refs []RepoEventRef
+	if err := dp.meta.WithContext(ctx).Where("usr = ?", usr).Order("seq desc").Limit(limit).Find(&refs).Error; err != nil {
+		return nil, err
+	}
+
+	out := make([]RepoHistoryEntry, len(refs))
+	for i, r := range refs {
+		out[i] = RepoHistoryEntry{
+			Seq:         r.Seq,
+			Type:        r.Type,
+			Rev:         r.Rev,
+			Commit:      r.Commit,
+			Time:        r.Time,
+			PersistedAt: r.PersistedAt,
+		}
+	}
+	return out, nil
+}
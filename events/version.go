@@ -0,0 +1,80 @@
+package events
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Event stream frame format versions. A consumer asks for the newest version
+// it understands with the StreamVersionParam query parameter when connecting,
+// and the server replies with the version it will actually send in the
+// StreamVersionHeader response header. Consumers which don't ask get
+// StreamVersion1, so existing consumers are unaffected by new versions.
+const (
+	// DAG-CBOR header and body per frame, as described in the atproto event
+	// stream spec
+	StreamVersion1 = 1
+	// StreamVersion1 frames, with an integrity chain in each header; see
+	// ChainVerifier
+	StreamVersion2 = 2
+
+	MinStreamVersion = StreamVersion1
+	MaxStreamVersion = StreamVersion2
+)
+
+const (
+	StreamVersionParam  = "version"
+	StreamVersionHeader = "Atproto-Stream-Version"
+)
+
+// NegotiateStreamVersion picks the frame format version to use for a
+// subscription, given the value of the consumer's version parameter. Consumers
+// asking for a version newer than the server supports get the newest one it
+// does; they are expected to check the response header.
+func NegotiateStreamVersion(requested string) (int, error) {
+	if requested == "" {
+		return StreamVersion1, nil
+	}
+
+	v, err := strconv.Atoi(strings.TrimSpace(requested))
+	if err != nil {
+		return 0, fmt.Errorf("invalid stream version %q", requested)
+	}
+	if v < MinStreamVersion {
+		return 0, fmt.Errorf("stream version %d is no longer supported (supported: %d-%d)", v, MinStreamVersion, MaxStreamVersion)
+	}
+	if v > MaxStreamVersion {
+		return MaxStreamVersion, nil
+	}
+	return v, nil
+}
+
+// ResponseStreamVersion returns the frame format version a server said it
+// would send, from the handshake response headers. Servers which predate
+// negotiation don't send the header and always send StreamVersion1.
+func ResponseStreamVersion(h http.Header) (int, error) {
+	s := h.Get(StreamVersionHeader)
+	if s == "" {
+		return StreamVersion1, nil
+	}
+	return strconv.Atoi(s)
+}
+
+// WriteFrame writes the event as a single frame in the given format version,
+// using the preserialized form where it matches. Versions which chain frames
+// together have to be written with a FrameWriter.
+func (evt *XRPCStreamEvent) WriteFrame(w io.Writer, version int) error {
+	switch version {
+	case StreamVersion1:
+		if evt.Preserialized != nil {
+			_, err := w.Write(evt.Preserialized)
+			return err
+		}
+		return evt.Serialize(w)
+	default:
+		return fmt.Errorf("unsupported stream version %d", version)
+	}
+}
@@ -0,0 +1,54 @@
+package events_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/bluesky-social/indigo/events"
+)
+
+func TestNegotiateStreamVersion(t *testing.T) {
+	testCases := []struct {
+		requested string
+		expected  int
+		err       bool
+	}{
+		{"", events.StreamVersion1, false},
+		{"1", events.StreamVersion1, false},
+		{"2", events.StreamVersion2, false},
+		{"99", events.MaxStreamVersion, false},
+		{"0", 0, true},
+		{"two", 0, true},
+	}
+
+	for _, tc := range testCases {
+		v, err := events.NegotiateStreamVersion(tc.requested)
+		if tc.err {
+			if err == nil {
+				t.Errorf("requested %q: expected error", tc.requested)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("requested %q: %s", tc.requested, err)
+			continue
+		}
+		if v != tc.expected {
+			t.Errorf("requested %q: got version %d, want %d", tc.requested, v, tc.expected)
+		}
+	}
+}
+
+func TestResponseStreamVersion(t *testing.T) {
+	v, err := events.ResponseStreamVersion(http.Header{})
+	if err != nil || v != events.StreamVersion1 {
+		t.Fatalf("expected legacy servers to imply version 1, got %d %v", v, err)
+	}
+
+	h := http.Header{}
+	h.Set(events.StreamVersionHeader, "1")
+	v, err = events.ResponseStreamVersion(h)
+	if err != nil || v != 1 {
+		t.Fatalf("expected version 1, got %d %v", v, err)
+	}
+}
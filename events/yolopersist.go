@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/bluesky-social/indigo/models"
 )
@@ -33,6 +34,8 @@ func (yp *YoloPersister) Persist(ctx context.Context, e *XRPCStreamEvent) error
 		e.RepoIdentity.Seq = yp.seq
 	case e.RepoAccount != nil:
 		e.RepoAccount.Seq = yp.seq
+	case e.RepoSync != nil:
+		e.RepoSync.Seq = yp.seq
 	case e.RepoMigrate != nil:
 		e.RepoMigrate.Seq = yp.seq
 	case e.RepoTombstone != nil:
@@ -52,6 +55,10 @@ func (mp *YoloPersister) Playback(ctx context.Context, since int64, cb func(*XRP
 	return fmt.Errorf("playback not supported by yolo persister, test usage only")
 }
 
+func (yp *YoloPersister) SeqForTime(ctx context.Context, t time.Time) (int64, error) {
+	return 0, fmt.Errorf("playback not supported by yolo persister, test usage only")
+}
+
 func (yp *YoloPersister) TakeDownRepo(ctx context.Context, uid models.Uid) error {
 	return fmt.Errorf("repo takedowns not currently supported by memory persister, test usage only")
 }
@@ -96,6 +96,7 @@ func main() {
 		atproto.SyncSubscribeRepos_Info{},
 		atproto.SyncSubscribeRepos_Migrate{},
 		atproto.SyncSubscribeRepos_RepoOp{},
+		atproto.SyncSubscribeRepos_Sync{},
 		atproto.SyncSubscribeRepos_Tombstone{},
 		atproto.LabelDefs_SelfLabels{},
 		atproto.LabelDefs_SelfLabel{},
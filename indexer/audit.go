@@ -0,0 +1,338 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/mst"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/bluesky-social/indigo/util"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Outcomes of a repo audit
+const (
+	// local state matches the PDS
+	AuditOK = "ok"
+	// local state is an older revision than the PDS; differences may just be
+	// events that haven't arrived yet
+	AuditBehind = "behind"
+	// local state differs from the PDS at the same or a newer revision
+	AuditMismatch = "mismatch"
+	// the PDS's repo doesn't check out: bad signature, or its MST doesn't
+	// rebuild to the root its commit claims
+	AuditInvalid = "invalid"
+	// the audit couldn't be completed, eg the PDS was unreachable
+	AuditError = "error"
+)
+
+// how many differing record paths are kept with an audit result
+const auditSamplePaths = 20
+
+// RepoAudit is the result of comparing a repo's locally stored state against a
+// fresh copy from its PDS
+type RepoAudit struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	Uid    models.Uid `gorm:"index" json:"uid"`
+	Did    string     `gorm:"index" json:"did"`
+	PDS    uint       `gorm:"index" json:"pds"`
+	Status string     `gorm:"index" json:"status"`
+	Error  string     `json:"error,omitempty"`
+
+	LocalRev   string `json:"local_rev"`
+	RemoteRev  string `json:"remote_rev"`
+	LocalData  string `json:"local_data"`
+	RemoteData string `json:"remote_data"`
+
+	// records on the PDS but not stored locally, stored locally but not on
+	// the PDS, and present in both with different CIDs
+	Missing   int `json:"missing"`
+	Extra     int `json:"extra"`
+	Differing int `json:"differing"`
+	// some of the affected record paths, space separated
+	SamplePaths string `json:"sample_paths,omitempty"`
+
+	Repaired bool `json:"repaired"`
+}
+
+type RepoAuditOptions struct {
+	// How often to audit a random sample of repos; zero disables scheduled
+	// audits (they can still be run by admins)
+	Interval time.Duration
+	// How many repos each scheduled run audits
+	SampleSize int
+	// Whether scheduled audits re-import repos found to be out of sync
+	Repair bool
+}
+
+func DefaultRepoAuditOptions() *RepoAuditOptions {
+	return &RepoAuditOptions{
+		SampleSize: 100,
+	}
+}
+
+// AuditRepo fetches the full repo from its PDS, checks its signature, rebuilds
+// its MST from the records to check the root its commit claims, and compares
+// the records with what is stored locally. The result is saved. If repair is
+// set and local state is out of sync, the fetched repo is imported.
+func (rf *RepoFetcher) AuditRepo(ctx context.Context, ai *models.ActorInfo, repair bool) (*RepoAudit, error) {
+	ctx, span := otel.Tracer("indexer").Start(ctx, "AuditRepo")
+	defer span.End()
+	span.SetAttributes(attribute.String("did", ai.Did), attribute.Bool("repair", repair))
+
+	audit := &RepoAudit{
+		Uid: ai.Uid,
+		Did: ai.Did,
+		PDS: ai.PDS,
+	}
+	car, err := rf.auditRepo(ctx, ai, audit)
+	if err != nil {
+		audit.Status = AuditError
+		audit.Error = err.Error()
+	}
+
+	if repair && (audit.Status == AuditBehind || audit.Status == AuditMismatch) {
+		if err := rf.repoman.ImportNewRepo(ctx, ai.Uid, ai.Did, bytes.NewReader(car), nil); err != nil {
+			audit.Error = fmt.Sprintf("repair failed: %s", err)
+		} else {
+			audit.Repaired = true
+		}
+	}
+
+	repoAudits.WithLabelValues(audit.Status).Inc()
+	if audit.Status != AuditOK {
+		log.Warnw("repo audit found a problem", "did", ai.Did, "status", audit.Status, "missing", audit.Missing, "extra", audit.Extra, "differing", audit.Differing, "err", audit.Error, "repaired", audit.Repaired)
+	}
+
+	if err := rf.db.WithContext(ctx).Create(audit).Error; err != nil {
+		return nil, err
+	}
+	return audit, nil
+}
+
+func (rf *RepoFetcher) auditRepo(ctx context.Context, ai *models.ActorInfo, audit *RepoAudit) ([]byte, error) {
+	var pds models.PDS
+	if err := rf.db.WithContext(ctx).First(&pds, "id = ?", ai.PDS).Error; err != nil {
+		return nil, fmt.Errorf("looking up pds: %w", err)
+	}
+
+	c := models.ClientForPds(&pds)
+	rf.ApplyPDSClientSettings(c)
+
+	car, err := rf.fetchRepo(ctx, c, &pds, ai.Did, "")
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := repo.ReadRepoFromCar(ctx, bytes.NewReader(car))
+	if err != nil {
+		audit.Status = AuditInvalid
+		audit.Error = fmt.Sprintf("reading repo: %s", err)
+		return car, nil
+	}
+	audit.RemoteRev = remote.SignedCommit().Rev
+	audit.RemoteData = remote.DataCid().String()
+
+	if err := rf.repoman.CheckRepoSig(ctx, remote, ai.Did); err != nil {
+		audit.Status = AuditInvalid
+		audit.Error = err.Error()
+		return car, nil
+	}
+
+	remoteRecords, err := repoRecords(ctx, remote)
+	if err != nil {
+		audit.Status = AuditInvalid
+		audit.Error = fmt.Sprintf("walking repo: %s", err)
+		return car, nil
+	}
+	rebuilt, err := rebuildMSTRoot(ctx, remoteRecords)
+	if err != nil {
+		return nil, fmt.Errorf("rebuilding mst: %w", err)
+	}
+	if rebuilt != remote.DataCid() {
+		audit.Status = AuditInvalid
+		audit.Error = fmt.Sprintf("mst rebuilt from records has root %s, commit claims %s", rebuilt, remote.DataCid())
+		return car, nil
+	}
+
+	var localRecords map[string]cid.Cid
+	root, err := rf.repoman.GetRepoRoot(ctx, ai.Uid)
+	if err != nil && !isNotFound(err) {
+		return nil, fmt.Errorf("getting local repo root: %w", err)
+	}
+	if err == nil && root.Defined() {
+		ses, err := rf.repoman.CarStore().ReadOnlySession(ai.Uid)
+		if err != nil {
+			return nil, err
+		}
+		local, err := repo.OpenRepo(ctx, ses, root)
+		if err != nil {
+			return nil, fmt.Errorf("opening local repo: %w", err)
+		}
+		audit.LocalRev = local.SignedCommit().Rev
+		audit.LocalData = local.DataCid().String()
+
+		if local.DataCid() == remote.DataCid() {
+			audit.Status = AuditOK
+			return car, nil
+		}
+
+		localRecords, err = repoRecords(ctx, local)
+		if err != nil {
+			return nil, fmt.Errorf("walking local repo: %w", err)
+		}
+	}
+
+	missing, extra, differing := compareRecords(localRecords, remoteRecords)
+	audit.Missing = len(missing)
+	audit.Extra = len(extra)
+	audit.Differing = len(differing)
+
+	sample := append(append(missing, extra...), differing...)
+	if len(sample) > auditSamplePaths {
+		sample = sample[:auditSamplePaths]
+	}
+	audit.SamplePaths = strings.Join(sample, " ")
+
+	// revs are TIDs, which sort lexically
+	if audit.LocalRev < audit.RemoteRev {
+		audit.Status = AuditBehind
+	} else {
+		audit.Status = AuditMismatch
+	}
+	return car, nil
+}
+
+func repoRecords(ctx context.Context, r *repo.Repo) (map[string]cid.Cid, error) {
+	out := make(map[string]cid.Cid)
+	if err := r.ForEach(ctx, "", func(k string, v cid.Cid) error {
+		out[k] = v
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// rebuildMSTRoot builds a fresh MST from a set of records and returns its root
+func rebuildMSTRoot(ctx context.Context, records map[string]cid.Cid) (cid.Cid, error) {
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	t := mst.NewEmptyMST(util.CborStore(bs))
+	for k, v := range records {
+		nt, err := t.Add(ctx, k, v, -1)
+		if err != nil {
+			return cid.Undef, err
+		}
+		t = nt
+	}
+	return t.GetPointer(ctx)
+}
+
+// compareRecords returns the sorted paths only in remote, only in local, and in
+// both with different CIDs
+func compareRecords(local, remote map[string]cid.Cid) (missing, extra, differing []string) {
+	for k, rc := range remote {
+		lc, ok := local[k]
+		switch {
+		case !ok:
+			missing = append(missing, k)
+		case lc != rc:
+			differing = append(differing, k)
+		}
+	}
+	for k := range local {
+		if _, ok := remote[k]; !ok {
+			extra = append(extra, k)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(extra)
+	sort.Strings(differing)
+	return missing, extra, differing
+}
+
+// AuditPDSRepos audits every repo hosted on a PDS, up to limit (zero for no
+// limit), one at a time under the PDS's crawl rate limit. It returns how many
+// repos were audited and how many were out of sync.
+func (rf *RepoFetcher) AuditPDSRepos(ctx context.Context, pdsID uint, limit int, repair bool) (int, int, error) {
+	var users []models.ActorInfo
+	q := rf.db.WithContext(ctx).Where("pds = ?", pdsID).Order("uid")
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	if err := q.Find(&users).Error; err != nil {
+		return 0, 0, err
+	}
+	return rf.auditAll(ctx, users, repair)
+}
+
+func (rf *RepoFetcher) auditAll(ctx context.Context, users []models.ActorInfo, repair bool) (int, int, error) {
+	var audited, bad int
+	for i := range users {
+		if ctx.Err() != nil {
+			return audited, bad, ctx.Err()
+		}
+		audit, err := rf.AuditRepo(ctx, &users[i], repair)
+		if err != nil {
+			return audited, bad, err
+		}
+		audited++
+		if audit.Status != AuditOK {
+			bad++
+		}
+	}
+	return audited, bad, nil
+}
+
+// runAudits periodically audits a random sample of repos
+func (rf *RepoFetcher) runAudits() {
+	t := time.NewTicker(rf.Audit.Interval)
+	defer t.Stop()
+
+	for range t.C {
+		ctx := context.Background()
+		var users []models.ActorInfo
+		if err := rf.db.WithContext(ctx).Order("random()").Limit(rf.Audit.SampleSize).Find(&users).Error; err != nil {
+			log.Errorw("failed to pick repos to audit", "err", err)
+			continue
+		}
+		audited, bad, err := rf.auditAll(ctx, users, rf.Audit.Repair)
+		if err != nil {
+			log.Errorw("scheduled repo audit failed", "err", err)
+		}
+		log.Infow("scheduled repo audit complete", "audited", audited, "out_of_sync", bad)
+	}
+}
+
+// ListRepoAudits returns audit results, newest first, starting before the
+// given cursor (zero to start at the newest). Either filter may be empty.
+func (rf *RepoFetcher) ListRepoAudits(ctx context.Context, did, status string, cursor uint, limit int) ([]RepoAudit, error) {
+	q := rf.db.WithContext(ctx).Order("id desc").Limit(limit)
+	if cursor > 0 {
+		q = q.Where("id < ?", cursor)
+	}
+	if did != "" {
+		q = q.Where("did = ?", did)
+	}
+	if status != "" {
+		q = q.Where("status = ?", status)
+	}
+
+	var out []RepoAudit
+	if err := q.Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,91 @@
+package indexer
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/repo"
+
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/multiformats/go-multihash"
+)
+
+func testCid(t *testing.T, s string) cid.Cid {
+	h, err := multihash.Sum([]byte(s), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cid.NewCidV1(cid.DagCBOR, h)
+}
+
+func TestCompareRecords(t *testing.T) {
+	local := map[string]cid.Cid{
+		"app.bsky.feed.post/a": testCid(t, "a"),
+		"app.bsky.feed.post/b": testCid(t, "b"),
+		"app.bsky.feed.post/c": testCid(t, "c"),
+	}
+	remote := map[string]cid.Cid{
+		"app.bsky.feed.post/a": testCid(t, "a"),
+		"app.bsky.feed.post/b": testCid(t, "b2"),
+		"app.bsky.feed.post/d": testCid(t, "d"),
+	}
+
+	missing, extra, differing := compareRecords(local, remote)
+	if !reflect.DeepEqual(missing, []string{"app.bsky.feed.post/d"}) {
+		t.Fatalf("unexpected missing: %v", missing)
+	}
+	if !reflect.DeepEqual(extra, []string{"app.bsky.feed.post/c"}) {
+		t.Fatalf("unexpected extra: %v", extra)
+	}
+	if !reflect.DeepEqual(differing, []string{"app.bsky.feed.post/b"}) {
+		t.Fatalf("unexpected differing: %v", differing)
+	}
+}
+
+func TestRebuildMSTRoot(t *testing.T) {
+	ctx := context.Background()
+
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	r := repo.NewRepo(ctx, "did:plc:test", bs)
+	for _, text := range []string{"one", "two", "three"} {
+		if _, _, err := r.CreateRecord(ctx, "app.bsky.feed.post", &bsky.FeedPost{Text: text, CreatedAt: "2024-01-01T00:00:00Z"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := r.Commit(ctx, func(context.Context, string, []byte) ([]byte, error) { return []byte("sig"), nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := repoRecords(ctx, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got %d", len(records))
+	}
+
+	root, err := rebuildMSTRoot(ctx, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != r.DataCid() {
+		t.Fatalf("rebuilt root %s doesn't match repo data %s", root, r.DataCid())
+	}
+
+	// dropping a record must change the root
+	for k := range records {
+		delete(records, k)
+		break
+	}
+	other, err := rebuildMSTRoot(ctx, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == r.DataCid() {
+		t.Fatal("expected different root after removing a record")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	comatproto "github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/models"
@@ -18,7 +19,10 @@ type CrawlDispatcher struct {
 
 	catchup chan *crawlWork
 
-	complete chan models.Uid
+	complete chan crawlResult
+
+	// jobs awaiting dispatch, by priority class
+	queue *crawlQueue
 
 	maplk      sync.Mutex
 	todo       map[models.Uid]*crawlWork
@@ -37,7 +41,8 @@ func NewCrawlDispatcher(repoFn func(context.Context, *crawlWork) error, concurre
 	return &CrawlDispatcher{
 		ingest:      make(chan *models.ActorInfo),
 		repoSync:    make(chan *crawlWork),
-		complete:    make(chan models.Uid),
+		complete:    make(chan crawlResult),
+		queue:       newCrawlQueue(),
 		catchup:     make(chan *crawlWork),
 		doRepoCrawl: repoFn,
 		concurrency: concurrency,
@@ -71,16 +76,41 @@ type crawlWork struct {
 	// for events that come in while this actor is being processed
 	// next items are processed after the crawl
 	next []*catchupJob
+
+	// set if the last crawl attempt for this actor failed
+	failed bool
+
+	// the host the job was dispatched for, and the worker time charged to
+	// it up front
+	host    uint
+	charged time.Duration
+}
+
+type crawlResult struct {
+	uid    models.Uid
+	failed bool
+	dur    time.Duration
 }
 
 func (c *CrawlDispatcher) mainLoop() {
 	var nextDispatchedJob *crawlWork
-	var jobsAwaitingDispatch []*crawlWork
 
 	// dispatchQueue represents the repoSync worker channel to which we dispatch crawl work
 	var dispatchQueue chan *crawlWork
 
 	for {
+		// pick the next job to hand to a worker from the priority queue. Only
+		// one job is held ready at a time, so a newly queued high priority job
+		// waits behind at most one other.
+		if nextDispatchedJob == nil {
+			nextDispatchedJob = c.queue.pop()
+			if nextDispatchedJob != nil {
+				dispatchQueue = c.repoSync
+			} else {
+				dispatchQueue = nil
+			}
+		}
+
 		select {
 		case actorToCrawl := <-c.ingest:
 			// TODO: max buffer size
@@ -89,32 +119,15 @@ func (c *CrawlDispatcher) mainLoop() {
 				break
 			}
 
-			if nextDispatchedJob == nil {
-				nextDispatchedJob = crawlJob
-				dispatchQueue = c.repoSync
-			} else {
-				jobsAwaitingDispatch = append(jobsAwaitingDispatch, crawlJob)
-			}
+			c.queue.push(crawlJob)
 		case dispatchQueue <- nextDispatchedJob:
 			c.dequeueJob(nextDispatchedJob)
-
-			if len(jobsAwaitingDispatch) > 0 {
-				nextDispatchedJob = jobsAwaitingDispatch[0]
-				jobsAwaitingDispatch = jobsAwaitingDispatch[1:]
-			} else {
-				nextDispatchedJob = nil
-				dispatchQueue = nil
-			}
+			nextDispatchedJob = nil
 		case catchupJob := <-c.catchup:
 			// CatchupJobs are for processing events that come in while a crawl is in progress
-			// They are lower priority than new crawls so we only add them to the queue if there isn't already a job in progress
-			if nextDispatchedJob == nil {
-				nextDispatchedJob = catchupJob
-				dispatchQueue = c.repoSync
-			} else {
-				jobsAwaitingDispatch = append(jobsAwaitingDispatch, catchupJob)
-			}
-		case uid := <-c.complete:
+			c.queue.push(catchupJob)
+		case res := <-c.complete:
+			uid := res.uid
 			c.maplk.Lock()
 
 			job, ok := c.inProgress[uid]
@@ -122,6 +135,7 @@ func (c *CrawlDispatcher) mainLoop() {
 				panic("should not be possible to not have a job in progress we receive a completion signal for")
 			}
 			delete(c.inProgress, uid)
+			c.queue.finished(job, res.dur)
 
 			// If there are any subsequent jobs for this UID, add it back to the todo list or buffer.
 			// We're basically pumping the `next` queue into the `catchup` queue and will do this over and over until the `next` queue is empty.
@@ -130,12 +144,8 @@ func (c *CrawlDispatcher) mainLoop() {
 				job.initScrape = false
 				job.catchup = job.next
 				job.next = nil
-				if nextDispatchedJob == nil {
-					nextDispatchedJob = job
-					dispatchQueue = c.repoSync
-				} else {
-					jobsAwaitingDispatch = append(jobsAwaitingDispatch, job)
-				}
+				job.failed = res.failed
+				c.queue.push(job)
 			}
 			c.maplk.Unlock()
 		}
@@ -204,12 +214,14 @@ func (c *CrawlDispatcher) fetchWorker() {
 	for {
 		select {
 		case job := <-c.repoSync:
-			if err := c.doRepoCrawl(context.TODO(), job); err != nil {
+			start := time.Now()
+			err := c.doRepoCrawl(context.TODO(), job)
+			if err != nil {
 				log.Errorf("failed to perform repo crawl of %q: %s", job.act.Did, err)
 			}
 
 			// TODO: do we still just do this if it errors?
-			c.complete <- job.act.Uid
+			c.complete <- crawlResult{uid: job.act.Uid, failed: err != nil, dur: time.Since(start)}
 		}
 	}
 }
@@ -269,3 +281,40 @@ func (c *CrawlDispatcher) RepoInSlowPath(ctx context.Context, uid models.Uid) bo
 
 	return false
 }
+
+// SetPriorityWeights changes the relative share of dispatches each priority
+// class gets while more than one has jobs waiting
+func (c *CrawlDispatcher) SetPriorityWeights(weights map[CrawlPriority]int) {
+	c.queue.setWeights(weights)
+}
+
+// SetHostPriority forces all crawl jobs for repos on the given PDS into a
+// priority class, or clears the override if p is nil. Overrides apply to jobs
+// queued after the change.
+func (c *CrawlDispatcher) SetHostPriority(pds uint, p *CrawlPriority) {
+	c.queue.setHostPriority(pds, p)
+}
+
+// SetRepoPriority forces crawl jobs for the given user into a priority class,
+// or clears the override if p is nil. Repo overrides take precedence over
+// host overrides.
+func (c *CrawlDispatcher) SetRepoPriority(uid models.Uid, p *CrawlPriority) {
+	c.queue.setRepoPriority(uid, p)
+}
+
+// SetHostWeight sets the share of the fetch workers crawls for repos on the
+// given PDS get, relative to other hosts with crawls waiting in the same
+// priority class. A weight below 1 restores DefaultHostCrawlWeight.
+func (c *CrawlDispatcher) SetHostWeight(pds uint, weight int) {
+	c.queue.setHostWeight(pds, weight)
+}
+
+// HostBudgets reports the hosts with crawls queued or in flight, or a weight
+// set, busiest first
+func (c *CrawlDispatcher) HostBudgets() []HostCrawlBudget {
+	return c.queue.hostBudgets()
+}
+
+func (c *CrawlDispatcher) PriorityConfig() *CrawlPriorityConfig {
+	return c.queue.config()
+}
@@ -0,0 +1,161 @@
+package indexer
+
+import (
+	"sort"
+	"time"
+)
+
+// DefaultHostCrawlWeight is the weight of hosts that haven't been given one
+// with SetHostWeight
+const DefaultHostCrawlWeight = 1
+
+// cost charged for a host's first crawl, before its crawls have been timed
+const initialCrawlCost = time.Second
+
+// hostBudget accounts for the crawl worker time a host has used. Within a
+// priority class, jobs are taken from the host with the lowest virtual time,
+// which advances by the worker time its crawls take divided by its weight,
+// so every host with jobs waiting gets a share of the fetch workers in
+// proportion to its weight, however many jobs it has queued. A crawl is
+// charged the host's average crawl time when it's dispatched, and the
+// difference when it completes.
+type hostBudget struct {
+	weight int
+	// seconds of worker time used, divided by weight
+	vtime float64
+
+	queued   int
+	inFlight int
+
+	// moving average of the time a crawl of the host takes
+	avgCost time.Duration
+
+	dispatched int64
+	used       time.Duration
+}
+
+// HostCrawlBudget is a snapshot of a host's share of the crawl workers
+type HostCrawlBudget struct {
+	PDS uint `json:"pds"`
+	// filled in by callers that know the host's name
+	Host       string  `json:"host,omitempty"`
+	Weight     int     `json:"weight"`
+	Queued     int     `json:"queued"`
+	InFlight   int     `json:"in_flight"`
+	Dispatched int64   `json:"dispatched"`
+	WorkerSecs float64 `json:"worker_seconds"`
+	AvgCrawlMs int64   `json:"avg_crawl_ms"`
+}
+
+// budget returns the host's account, creating it if needed. Must be called
+// with lk held.
+func (q *crawlQueue) budget(pds uint) *hostBudget {
+	b, ok := q.budgets[pds]
+	if !ok {
+		weight := DefaultHostCrawlWeight
+		if w, ok := q.hostWeights[pds]; ok {
+			weight = w
+		}
+		b = &hostBudget{weight: weight, avgCost: initialCrawlCost, vtime: q.vclock}
+		q.budgets[pds] = b
+	}
+	return b
+}
+
+// pickHost returns the host in class p to take the next job from: the one
+// with the least virtual time, ties going to the lowest ID. Must be called
+// with lk held.
+func (q *crawlQueue) pickHost(p CrawlPriority) uint {
+	var pick uint
+	found := false
+	for pds, jobs := range q.queues[p] {
+		if len(jobs) == 0 {
+			continue
+		}
+		b := q.budgets[pds]
+		if !found || b.vtime < q.budgets[pick].vtime || (b.vtime == q.budgets[pick].vtime && pds < pick) {
+			pick = pds
+			found = true
+		}
+	}
+	return pick
+}
+
+// charge records a job being dispatched. Must be called with lk held.
+func (q *crawlQueue) charge(job *crawlWork, b *hostBudget) {
+	// the virtual clock is where the host being served is at, so that hosts
+	// going idle and coming back don't get credit for the time they were away
+	q.vclock = b.vtime
+
+	job.charged = b.avgCost
+	b.vtime += job.charged.Seconds() / float64(b.weight)
+	b.queued--
+	b.inFlight++
+	b.dispatched++
+}
+
+// finished settles the account for a dispatched job that took dur
+func (q *crawlQueue) finished(job *crawlWork, dur time.Duration) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	b, ok := q.budgets[job.host]
+	if !ok {
+		return
+	}
+
+	b.inFlight--
+	b.used += dur
+	b.vtime += (dur - job.charged).Seconds() / float64(b.weight)
+	b.avgCost = (4*b.avgCost + dur) / 5
+	job.charged = 0
+
+	// an idle host that hasn't overspent restarts from the virtual clock
+	// anyway, so only its weight needs keeping
+	_, weighted := q.hostWeights[job.host]
+	if b.queued == 0 && b.inFlight == 0 && b.vtime <= q.vclock && !weighted {
+		delete(q.budgets, job.host)
+	}
+}
+
+func (q *crawlQueue) setHostWeight(pds uint, weight int) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	if weight < 1 {
+		delete(q.hostWeights, pds)
+		weight = DefaultHostCrawlWeight
+	} else {
+		q.hostWeights[pds] = weight
+	}
+	if b, ok := q.budgets[pds]; ok {
+		b.weight = weight
+	}
+}
+
+func (q *crawlQueue) hostBudgets() []HostCrawlBudget {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	out := make([]HostCrawlBudget, 0, len(q.budgets))
+	for pds, b := range q.budgets {
+		out = append(out, HostCrawlBudget{
+			PDS:        pds,
+			Weight:     b.weight,
+			Queued:     b.queued,
+			InFlight:   b.inFlight,
+			Dispatched: b.dispatched,
+			WorkerSecs: b.used.Seconds(),
+			AvgCrawlMs: b.avgCost.Milliseconds(),
+		})
+	}
+	for pds, w := range q.hostWeights {
+		if _, ok := q.budgets[pds]; !ok {
+			out = append(out, HostCrawlBudget{PDS: pds, Weight: w})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].WorkerSecs > out[j].WorkerSecs || (out[i].WorkerSecs == out[j].WorkerSecs && out[i].PDS < out[j].PDS)
+	})
+	return out
+}
@@ -0,0 +1,229 @@
+package indexer
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/bluesky-social/indigo/models"
+)
+
+// CrawlPriority is the scheduling class of a crawl job
+type CrawlPriority int
+
+const (
+	// CrawlPriorityLive is for repos with buffered live events waiting on them
+	CrawlPriorityLive CrawlPriority = iota
+	// CrawlPriorityBackfill is for initial scrapes of newly discovered repos
+	CrawlPriorityBackfill
+	// CrawlPriorityRetry is for jobs requeued after a failed crawl
+	CrawlPriorityRetry
+
+	numCrawlPriorities
+)
+
+func (p CrawlPriority) String() string {
+	switch p {
+	case CrawlPriorityLive:
+		return "live"
+	case CrawlPriorityBackfill:
+		return "backfill"
+	case CrawlPriorityRetry:
+		return "retry"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseCrawlPriority(s string) (CrawlPriority, error) {
+	switch strings.ToLower(s) {
+	case "live":
+		return CrawlPriorityLive, nil
+	case "backfill":
+		return CrawlPriorityBackfill, nil
+	case "retry":
+		return CrawlPriorityRetry, nil
+	default:
+		return 0, fmt.Errorf("unknown crawl priority %q", s)
+	}
+}
+
+var DefaultCrawlWeights = map[CrawlPriority]int{
+	CrawlPriorityLive:     16,
+	CrawlPriorityBackfill: 4,
+	CrawlPriorityRetry:    1,
+}
+
+// CrawlPriorityConfig is a snapshot of the dispatcher's scheduling settings
+type CrawlPriorityConfig struct {
+	Weights map[string]int `json:"weights"`
+	// PDS ID to priority class
+	Hosts map[uint]string `json:"hosts"`
+	// User ID to priority class
+	Repos map[models.Uid]string `json:"repos"`
+	// Number of jobs waiting in each class
+	Queued map[string]int `json:"queued"`
+}
+
+// crawlQueue holds jobs awaiting dispatch, by priority class and then by
+// host, each host's jobs in FIFO order. Host and repo overrides take
+// precedence over the class a job would otherwise get, so operators can push
+// a large backfill down or pull a specific repo up at runtime. Within a
+// class, hosts share the fetch workers by weight (see hostBudget).
+type crawlQueue struct {
+	lk     sync.Mutex
+	queues [numCrawlPriorities]map[uint][]*crawlWork
+	counts [numCrawlPriorities]int
+	sched  *weightedRoundRobin
+
+	hosts map[uint]CrawlPriority
+	repos map[models.Uid]CrawlPriority
+
+	// accounts of hosts with jobs queued or in flight, or a weight set
+	budgets     map[uint]*hostBudget
+	hostWeights map[uint]int
+	vclock      float64
+}
+
+func newCrawlQueue() *crawlQueue {
+	weights := make([]int, numCrawlPriorities)
+	for p, w := range DefaultCrawlWeights {
+		weights[p] = w
+	}
+
+	q := &crawlQueue{
+		sched:       newWeightedRoundRobin(weights),
+		hosts:       make(map[uint]CrawlPriority),
+		repos:       make(map[models.Uid]CrawlPriority),
+		budgets:     make(map[uint]*hostBudget),
+		hostWeights: make(map[uint]int),
+	}
+	for p := range q.queues {
+		q.queues[p] = make(map[uint][]*crawlWork)
+	}
+	return q
+}
+
+// classify must be called with lk held
+func (q *crawlQueue) classify(job *crawlWork) CrawlPriority {
+	if p, ok := q.repos[job.act.Uid]; ok {
+		return p
+	}
+	if p, ok := q.hosts[job.act.PDS]; ok {
+		return p
+	}
+
+	switch {
+	case job.failed:
+		return CrawlPriorityRetry
+	case job.initScrape:
+		return CrawlPriorityBackfill
+	default:
+		return CrawlPriorityLive
+	}
+}
+
+func (q *crawlQueue) push(job *crawlWork) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	p := q.classify(job)
+	pds := job.act.PDS
+	b := q.budget(pds)
+	if b.queued == 0 && b.inFlight == 0 {
+		b.vtime = max(b.vtime, q.vclock)
+	}
+	b.queued++
+
+	q.queues[p][pds] = append(q.queues[p][pds], job)
+	q.counts[p]++
+	crawlQueueDepth.WithLabelValues(p.String()).Inc()
+}
+
+// pop returns the next job to dispatch, or nil if the queue is empty
+func (q *crawlQueue) pop() *crawlWork {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	p := q.sched.pick(func(i int) bool {
+		return q.counts[i] > 0
+	})
+	if p < 0 {
+		return nil
+	}
+
+	pds := q.pickHost(CrawlPriority(p))
+	jobs := q.queues[p][pds]
+	job := jobs[0]
+	jobs[0] = nil
+	if len(jobs) == 1 {
+		delete(q.queues[p], pds)
+	} else {
+		q.queues[p][pds] = jobs[1:]
+	}
+	q.counts[p]--
+	crawlQueueDepth.WithLabelValues(CrawlPriority(p).String()).Dec()
+
+	job.host = pds
+	q.charge(job, q.budgets[pds])
+
+	return job
+}
+
+func (q *crawlQueue) setWeights(weights map[CrawlPriority]int) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	cur := make([]int, numCrawlPriorities)
+	copy(cur, q.sched.weights)
+	for p, w := range weights {
+		cur[p] = w
+	}
+	q.sched.setWeights(cur)
+}
+
+func (q *crawlQueue) setHostPriority(pds uint, p *CrawlPriority) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	if p == nil {
+		delete(q.hosts, pds)
+	} else {
+		q.hosts[pds] = *p
+	}
+}
+
+func (q *crawlQueue) setRepoPriority(uid models.Uid, p *CrawlPriority) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	if p == nil {
+		delete(q.repos, uid)
+	} else {
+		q.repos[uid] = *p
+	}
+}
+
+func (q *crawlQueue) config() *CrawlPriorityConfig {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	out := &CrawlPriorityConfig{
+		Weights: make(map[string]int),
+		Hosts:   make(map[uint]string),
+		Repos:   make(map[models.Uid]string),
+		Queued:  make(map[string]int),
+	}
+	for p := CrawlPriority(0); p < numCrawlPriorities; p++ {
+		out.Weights[p.String()] = q.sched.weights[p]
+		out.Queued[p.String()] = q.counts[p]
+	}
+	for h, p := range q.hosts {
+		out.Hosts[h] = p.String()
+	}
+	for u, p := range q.repos {
+		out.Repos[u] = p.String()
+	}
+
+	return out
+}
@@ -0,0 +1,108 @@
+package indexer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+)
+
+func TestCrawlQueuePriorities(t *testing.T) {
+	q := newCrawlQueue()
+
+	backfill := func(uid models.Uid, pds uint) *crawlWork {
+		return &crawlWork{act: &models.ActorInfo{Uid: uid, PDS: pds}, initScrape: true}
+	}
+
+	// a large backfill from one host
+	for i := 1; i <= 10; i++ {
+		q.push(backfill(models.Uid(i), 1))
+	}
+
+	// live catchup for a repo shouldn't wait behind it
+	q.push(&crawlWork{act: &models.ActorInfo{Uid: 100, PDS: 2}})
+	if job := q.pop(); job.act.Uid != 100 {
+		t.Fatalf("expected live job first, got uid %d", job.act.Uid)
+	}
+
+	// push a whole host down to the retry class
+	retry := CrawlPriorityRetry
+	q.setHostPriority(3, &retry)
+	q.push(backfill(200, 3))
+
+	// but a repo override wins over the host override
+	live := CrawlPriorityLive
+	q.setRepoPriority(201, &live)
+	q.push(backfill(201, 3))
+
+	if job := q.pop(); job.act.Uid != 201 {
+		t.Fatalf("expected repo override to be dispatched first, got uid %d", job.act.Uid)
+	}
+
+	cfg := q.config()
+	if cfg.Queued["backfill"] != 10 || cfg.Queued["retry"] != 1 {
+		t.Fatalf("unexpected queue depths: %v", cfg.Queued)
+	}
+
+	var seen int
+	for q.pop() != nil {
+		seen++
+	}
+	if seen != 11 {
+		t.Fatalf("expected 11 remaining jobs, got %d", seen)
+	}
+}
+
+func TestCrawlQueueHostFairness(t *testing.T) {
+	q := newCrawlQueue()
+
+	uid := models.Uid(0)
+	queue := func(pds uint, n int) {
+		for i := 0; i < n; i++ {
+			uid++
+			q.push(&crawlWork{act: &models.ActorInfo{Uid: uid, PDS: pds}, initScrape: true})
+		}
+	}
+
+	// a giant backfill queued ahead of two smaller hosts, one of them
+	// weighted double
+	queue(1, 1000)
+	queue(2, 100)
+	queue(3, 100)
+	q.setHostWeight(3, 2)
+
+	run := func(n int, cost map[uint]time.Duration) map[uint]int {
+		counts := make(map[uint]int)
+		for i := 0; i < n; i++ {
+			job := q.pop()
+			counts[job.act.PDS]++
+			q.finished(job, cost[job.act.PDS])
+		}
+		return counts
+	}
+
+	sec := time.Second
+	counts := run(40, map[uint]time.Duration{1: sec, 2: sec, 3: sec})
+	if counts[1] != 10 || counts[2] != 10 || counts[3] != 20 {
+		t.Fatalf("expected dispatches in proportion to host weights, got %v", counts)
+	}
+
+	// slow crawls use up a host's share sooner
+	q.setHostWeight(3, 0)
+	counts = run(40, map[uint]time.Duration{1: 3 * sec, 2: sec, 3: sec})
+	if counts[1] > 8 || counts[2] < 14 || counts[3] < 14 {
+		t.Fatalf("expected the slow host to get fewer dispatches, got %v", counts)
+	}
+
+	for _, b := range q.hostBudgets() {
+		if b.Weight != DefaultHostCrawlWeight {
+			t.Fatalf("expected host %d to be back to the default weight, got %d", b.PDS, b.Weight)
+		}
+		if slow := b.AvgCrawlMs > 1000; slow != (b.PDS == 1) {
+			t.Fatalf("unexpected average crawl time for host %d: %dms", b.PDS, b.AvgCrawlMs)
+		}
+	}
+	if cfg := q.config(); cfg.Queued["backfill"] != 1200-80 {
+		t.Fatalf("unexpected queue depth: %v", cfg.Queued)
+	}
+}
@@ -0,0 +1,173 @@
+package indexer
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+	"gorm.io/gorm"
+)
+
+// RepoFetchFailure tracks a repo whose crawl has failed. Failed repos are
+// re-crawled on an exponential backoff schedule until they either succeed (and
+// the record is removed) or run out of attempts, at which point they are
+// marked dead and left alone until an admin retries them.
+type RepoFetchFailure struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	Uid         models.Uid `gorm:"uniqueIndex"`
+	Did         string
+	PDS         uint
+	Attempts    int
+	LastError   string
+	NextAttempt time.Time `gorm:"index"`
+	Dead        bool      `gorm:"index"`
+}
+
+type FetchRetryOptions struct {
+	// Number of failed crawls after which a repo is dead-lettered
+	MaxAttempts int
+	// Delay before the first retry, doubling with each further failure
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Fraction of the backoff to randomly add or subtract, so that repos which
+	// failed together (eg, because their PDS was down) don't retry together
+	Jitter float64
+	// How often to look for failed repos that are due a retry
+	PollInterval time.Duration
+}
+
+func DefaultFetchRetryOptions() *FetchRetryOptions {
+	return &FetchRetryOptions{
+		MaxAttempts:    8,
+		InitialBackoff: time.Minute,
+		MaxBackoff:     12 * time.Hour,
+		Jitter:         0.25,
+		PollInterval:   30 * time.Second,
+	}
+}
+
+func (o *FetchRetryOptions) backoff(attempts int) time.Duration {
+	d := o.InitialBackoff
+	for i := 1; i < attempts && d < o.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > o.MaxBackoff {
+		d = o.MaxBackoff
+	}
+	if o.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * o.Jitter * float64(d))
+	}
+	return d
+}
+
+// recordFetchFailure notes a failed crawl and schedules the next retry, or
+// dead-letters the repo if it has failed too many times
+func (rf *RepoFetcher) recordFetchFailure(ctx context.Context, ai *models.ActorInfo, ferr error) error {
+	// the crawl dispatcher only runs one crawl per repo at a time, so there
+	// are no concurrent updates to a repo's record
+	return rf.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var rec RepoFetchFailure
+		if err := tx.Where("uid = ?", ai.Uid).Limit(1).Find(&rec).Error; err != nil {
+			return err
+		}
+
+		rec.Uid = ai.Uid
+		rec.Did = ai.Did
+		rec.PDS = ai.PDS
+		rec.Attempts++
+		rec.LastError = ferr.Error()
+		if rec.Attempts >= rf.Retry.MaxAttempts {
+			rec.Dead = true
+			repoFetchFailures.WithLabelValues("dead").Inc()
+			log.Warnw("repo crawl dead-lettered", "did", ai.Did, "attempts", rec.Attempts, "err", ferr)
+		} else {
+			rec.NextAttempt = time.Now().Add(rf.Retry.backoff(rec.Attempts))
+			repoFetchFailures.WithLabelValues("retry").Inc()
+		}
+
+		return tx.Save(&rec).Error
+	})
+}
+
+func (rf *RepoFetcher) clearFetchFailure(ctx context.Context, uid models.Uid) error {
+	return rf.db.WithContext(ctx).Where("uid = ?", uid).Delete(&RepoFetchFailure{}).Error
+}
+
+// runRetries periodically re-crawls failed repos that are due a retry
+func (rf *RepoFetcher) runRetries(crawl func(context.Context, *models.ActorInfo) error) {
+	t := time.NewTicker(rf.Retry.PollInterval)
+	defer t.Stop()
+
+	for range t.C {
+		if err := rf.retryDue(context.Background(), crawl); err != nil {
+			log.Errorw("failed to retry failed repo crawls", "err", err)
+		}
+	}
+}
+
+func (rf *RepoFetcher) retryDue(ctx context.Context, crawl func(context.Context, *models.ActorInfo) error) error {
+	var due []RepoFetchFailure
+	if err := rf.db.WithContext(ctx).Where("dead = ? AND next_attempt <= ?", false, time.Now()).Order("next_attempt").Limit(1000).Find(&due).Error; err != nil {
+		return err
+	}
+
+	for _, rec := range due {
+		var ai models.ActorInfo
+		if err := rf.db.WithContext(ctx).Where("uid = ?", rec.Uid).First(&ai).Error; err != nil {
+			log.Warnw("dropping fetch failure for unknown user", "uid", rec.Uid, "did", rec.Did, "err", err)
+			if err := rf.clearFetchFailure(ctx, rec.Uid); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// push the next attempt out while this one is in flight, so the repo
+		// isn't enqueued again on the next poll
+		lease := time.Now().Add(rf.Retry.backoff(rec.Attempts + 1))
+		if err := rf.db.WithContext(ctx).Model(&RepoFetchFailure{}).Where("id = ?", rec.ID).Update("next_attempt", lease).Error; err != nil {
+			return err
+		}
+
+		if err := crawl(ctx, &ai); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListFetchFailures returns repos with failed crawls, ordered by ID, starting
+// after the given cursor. If dead is set only dead-lettered repos are
+// returned, otherwise only those still awaiting a retry.
+func (rf *RepoFetcher) ListFetchFailures(ctx context.Context, dead bool, cursor uint, limit int) ([]RepoFetchFailure, error) {
+	var out []RepoFetchFailure
+	if err := rf.db.WithContext(ctx).Where("dead = ? AND id > ?", dead, cursor).Order("id").Limit(limit).Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RetryFetchFailure resets the attempt count for a failed repo and schedules
+// it to be crawled again on the next poll, whether or not it was dead-lettered
+func (rf *RepoFetcher) RetryFetchFailure(ctx context.Context, uid models.Uid) (bool, error) {
+	res := rf.db.WithContext(ctx).Model(&RepoFetchFailure{}).Where("uid = ?", uid).Updates(map[string]any{
+		"dead":         false,
+		"attempts":     0,
+		"next_attempt": time.Now(),
+	})
+	return res.RowsAffected > 0, res.Error
+}
+
+// RetryAllDeadFetches does RetryFetchFailure for every dead-lettered repo,
+// returning how many there were
+func (rf *RepoFetcher) RetryAllDeadFetches(ctx context.Context) (int64, error) {
+	res := rf.db.WithContext(ctx).Model(&RepoFetchFailure{}).Where("dead = ?", true).Updates(map[string]any{
+		"dead":         false,
+		"attempts":     0,
+		"next_attempt": time.Now(),
+	})
+	return res.RowsAffected, res.Error
+}
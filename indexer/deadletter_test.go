@@ -0,0 +1,129 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestFetchFailureBackoff(t *testing.T) {
+	opts := &FetchRetryOptions{
+		InitialBackoff: time.Minute,
+		MaxBackoff:     10 * time.Minute,
+	}
+
+	expected := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute}
+	for i, exp := range expected {
+		if d := opts.backoff(i + 1); d != exp {
+			t.Fatalf("attempt %d: expected backoff %s, got %s", i+1, exp, d)
+		}
+	}
+
+	opts.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := opts.backoff(2)
+		if d < time.Minute || d > 3*time.Minute {
+			t.Fatalf("jittered backoff out of range: %s", d)
+		}
+	}
+}
+
+func TestFetchFailureDeadLetter(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.AutoMigrate(&models.ActorInfo{})
+
+	rf := NewRepoFetcher(db, nil, 1)
+	rf.Retry = &FetchRetryOptions{
+		MaxAttempts:    3,
+		InitialBackoff: time.Hour,
+		MaxBackoff:     time.Hour,
+	}
+
+	ai := &models.ActorInfo{Uid: 7, Did: "did:plc:failing", PDS: 1}
+	if err := db.Create(ai).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var crawled []models.Uid
+	crawl := func(ctx context.Context, ai *models.ActorInfo) error {
+		crawled = append(crawled, ai.Uid)
+		return nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := rf.recordFetchFailure(ctx, ai, errors.New("pds unreachable")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// not due yet
+	if err := rf.retryDue(ctx, crawl); err != nil {
+		t.Fatal(err)
+	}
+	if len(crawled) != 0 {
+		t.Fatalf("expected no retries before backoff elapsed, got %v", crawled)
+	}
+
+	pending, err := rf.ListFetchFailures(ctx, false, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Attempts != 2 {
+		t.Fatalf("expected one pending failure with 2 attempts, got %+v", pending)
+	}
+
+	// third failure dead-letters it
+	if err := rf.recordFetchFailure(ctx, ai, errors.New("pds unreachable")); err != nil {
+		t.Fatal(err)
+	}
+	dead, err := rf.ListFetchFailures(ctx, true, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].LastError != "pds unreachable" {
+		t.Fatalf("expected one dead-lettered repo, got %+v", dead)
+	}
+
+	// manual retry makes it due immediately
+	ok, err := rf.RetryFetchFailure(ctx, ai.Uid)
+	if err != nil || !ok {
+		t.Fatalf("retry failed: %v %v", ok, err)
+	}
+	if err := rf.retryDue(ctx, crawl); err != nil {
+		t.Fatal(err)
+	}
+	if len(crawled) != 1 || crawled[0] != ai.Uid {
+		t.Fatalf("expected repo to be re-crawled, got %v", crawled)
+	}
+
+	// and isn't enqueued again while that crawl is in flight
+	if err := rf.retryDue(ctx, crawl); err != nil {
+		t.Fatal(err)
+	}
+	if len(crawled) != 1 {
+		t.Fatalf("expected a single re-crawl, got %v", crawled)
+	}
+
+	// success clears the record
+	if err := rf.clearFetchFailure(ctx, ai.Uid); err != nil {
+		t.Fatal(err)
+	}
+	pending, err = rf.ListFetchFailures(ctx, false, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("expected no failures after success, got %+v", pending)
+	}
+}
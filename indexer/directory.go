@@ -0,0 +1,91 @@
+package indexer
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/bluesky-social/indigo/api"
+	didres "github.com/bluesky-social/indigo/did"
+	"github.com/bluesky-social/indigo/plc"
+	"github.com/bluesky-social/indigo/util"
+
+	did "github.com/whyrusleeping/go-did"
+)
+
+// Directory resolves DIDs and verifies signatures made with their keys. It's
+// what the relay and indexer need from identity lookups, and is satisfied by
+// the Resolver built by NewResolver.
+type Directory interface {
+	didres.Resolver
+	VerifyUserSignature(ctx context.Context, did string, sig []byte, msg []byte) error
+}
+
+type ResolverOptions struct {
+	// PLC directory to resolve did:plc from. If empty, did:plc isn't resolved.
+	PLCHost string
+	// Path of a batch lookup endpoint on PLCHost, for mirrors that have one;
+	// see api.PLCServer
+	PLCBatchPath string
+	// Fetch did:web documents over plain http, for testing
+	InsecureWeb bool
+	// If set, PLC and did:web requests go through this proxy
+	Proxy util.ProxyFunc
+
+	// Number of DID documents to cache, and how long to keep them
+	CacheSize int
+	CacheTTL  time.Duration
+
+	// Key to sign with; see KeyManager. Signer takes precedence, for keys
+	// held in a KMS or HSM.
+	SigningKey *did.PrivKey
+	Signer     Signer
+}
+
+func DefaultResolverOptions() *ResolverOptions {
+	return &ResolverOptions{
+		PLCHost:   "https://plc.directory",
+		CacheSize: 5_000_000,
+		CacheTTL:  24 * time.Hour,
+	}
+}
+
+// Resolver is the DID resolver stack bigsky runs with: did:plc and did:web
+// resolvers behind a cache, with a KeyManager on top. Concurrent lookups of a
+// DID share one request, and ResolveDIDs looks up many DIDs at once. Programs
+// embedding indigo packages can build one with NewResolver instead of wiring
+// the pieces up themselves. It can be passed as both the did.Resolver and the
+// repomgr.KeyManager.
+type Resolver struct {
+	*plc.CachingDidResolver
+	*KeyManager
+}
+
+func NewResolver(opts *ResolverOptions) *Resolver {
+	if opts == nil {
+		opts = DefaultResolverOptions()
+	}
+
+	var client *http.Client
+	if opts.Proxy != nil {
+		client = util.ProxiedHTTPClient(opts.Proxy)
+	}
+
+	mr := didres.NewMultiResolver()
+	if opts.PLCHost != "" {
+		mr.AddHandler("plc", &api.PLCServer{Host: opts.PLCHost, C: client, BatchPath: opts.PLCBatchPath})
+	}
+	mr.AddHandler("web", &didres.WebResolver{Insecure: opts.InsecureWeb, Client: client})
+
+	cached := plc.NewCachingDidResolver(mr, opts.CacheTTL, opts.CacheSize)
+
+	km := NewKeyManager(cached, opts.SigningKey)
+	if opts.Signer != nil {
+		km = NewKeyManagerWithSigner(cached, opts.Signer)
+	}
+
+	return &Resolver{
+		CachingDidResolver: cached,
+		KeyManager:         km,
+	}
+}
@@ -0,0 +1,199 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrGroupCommitClosed is returned for writes made after the group committer
+// has been shut down
+var ErrGroupCommitClosed = errors.New("group commit is shut down")
+
+// GroupCommitter batches database writes from concurrent callers into shared
+// transactions, so that at high event rates the cost of a commit is spread
+// over many writes. Each caller still waits for its own write to commit and
+// gets its own error: a batch that fails is retried one write at a time, so a
+// bad write doesn't take the rest of its batch down with it.
+type GroupCommitter struct {
+	db       *gorm.DB
+	maxBatch int
+	maxDelay time.Duration
+
+	reqs chan *writeReq
+
+	// held for reading while queueing writes, so none are queued once
+	// shutdown has started
+	lk       sync.RWMutex
+	shutdown bool
+	closed   chan struct{}
+	wg       sync.WaitGroup
+}
+
+type GroupCommitOptions struct {
+	// Most writes committed in one transaction
+	MaxBatch int
+	// How long to wait for more writes to join a batch once it has one.
+	// Zero commits whatever was queued while the last batch was committing.
+	MaxDelay time.Duration
+}
+
+func DefaultGroupCommitOptions() *GroupCommitOptions {
+	return &GroupCommitOptions{
+		MaxBatch: 500,
+		MaxDelay: 2 * time.Millisecond,
+	}
+}
+
+type writeReq struct {
+	ctx  context.Context
+	fn   func(tx *gorm.DB) error
+	done chan error
+}
+
+func NewGroupCommitter(db *gorm.DB, opts *GroupCommitOptions) *GroupCommitter {
+	if opts == nil {
+		opts = DefaultGroupCommitOptions()
+	}
+
+	gc := &GroupCommitter{
+		db:       db,
+		maxBatch: max(opts.MaxBatch, 1),
+		maxDelay: opts.MaxDelay,
+		reqs:     make(chan *writeReq, max(opts.MaxBatch, 1)),
+		closed:   make(chan struct{}),
+	}
+
+	gc.wg.Add(1)
+	go gc.run()
+
+	return gc
+}
+
+// Write runs fn in a transaction shared with other writes, returning once it
+// has committed. fn may be run again if its batch fails, so it mustn't have
+// side effects outside tx, and should reset any rows it creates.
+func (gc *GroupCommitter) Write(ctx context.Context, fn func(tx *gorm.DB) error) error {
+	// once queued, the write is committed or failed even if ctx ends
+	req := &writeReq{ctx: context.WithoutCancel(ctx), fn: fn, done: make(chan error, 1)}
+
+	gc.lk.RLock()
+	if gc.shutdown {
+		gc.lk.RUnlock()
+		return ErrGroupCommitClosed
+	}
+	select {
+	case gc.reqs <- req:
+	case <-ctx.Done():
+		gc.lk.RUnlock()
+		return ctx.Err()
+	}
+	gc.lk.RUnlock()
+
+	return <-req.done
+}
+
+// Shutdown commits any queued writes and stops the committer
+func (gc *GroupCommitter) Shutdown() {
+	gc.lk.Lock()
+	if !gc.shutdown {
+		gc.shutdown = true
+		close(gc.closed)
+	}
+	gc.lk.Unlock()
+
+	gc.wg.Wait()
+}
+
+func (gc *GroupCommitter) run() {
+	defer gc.wg.Done()
+
+	for {
+		var first *writeReq
+		select {
+		case first = <-gc.reqs:
+		case <-gc.closed:
+			// commit whatever was queued before shutdown
+			for {
+				select {
+				case req := <-gc.reqs:
+					gc.commit([]*writeReq{req})
+				default:
+					return
+				}
+			}
+		}
+
+		batch := gc.collect(first)
+		gc.commit(batch)
+	}
+}
+
+// collect gathers writes to commit along with first
+func (gc *GroupCommitter) collect(first *writeReq) []*writeReq {
+	batch := []*writeReq{first}
+
+	var timeout <-chan time.Time
+	if gc.maxDelay > 0 {
+		t := time.NewTimer(gc.maxDelay)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	for len(batch) < gc.maxBatch {
+		if timeout == nil {
+			select {
+			case req := <-gc.reqs:
+				batch = append(batch, req)
+				continue
+			default:
+				return batch
+			}
+		}
+
+		select {
+		case req := <-gc.reqs:
+			batch = append(batch, req)
+		case <-timeout:
+			return batch
+		case <-gc.closed:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (gc *GroupCommitter) commit(batch []*writeReq) {
+	start := time.Now()
+	defer func() {
+		groupCommitDuration.Observe(time.Since(start).Seconds())
+	}()
+	groupCommitBatchSize.Observe(float64(len(batch)))
+
+	if len(batch) > 1 {
+		err := gc.db.Transaction(func(tx *gorm.DB) error {
+			for _, req := range batch {
+				if err := req.fn(tx.WithContext(req.ctx)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err == nil {
+			for _, req := range batch {
+				req.done <- nil
+			}
+			return
+		}
+
+		// find out whose write failed by trying each on its own
+		groupCommitRetries.Inc()
+	}
+
+	for _, req := range batch {
+		req.done <- gc.db.WithContext(req.ctx).Transaction(req.fn)
+	}
+}
@@ -0,0 +1,65 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestGroupCommit(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.AutoMigrate(&models.FollowRecord{})
+
+	gc := NewGroupCommitter(db, &GroupCommitOptions{MaxBatch: 50, MaxDelay: 20 * time.Millisecond})
+
+	const writers = 40
+	errs := make([]error, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = gc.Write(ctx, func(tx *gorm.DB) error {
+				// one bad write shouldn't fail the rest of its batch
+				if i == 7 {
+					return errors.New("bad write")
+				}
+				return tx.Create(&models.FollowRecord{Follower: models.Uid(i), Rkey: fmt.Sprint(i)}).Error
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if (err != nil) != (i == 7) {
+			t.Fatalf("writer %d: unexpected result %v", i, err)
+		}
+	}
+
+	var count int64
+	if err := db.Model(&models.FollowRecord{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != writers-1 {
+		t.Fatalf("expected %d rows, got %d", writers-1, count)
+	}
+
+	gc.Shutdown()
+	err = gc.Write(ctx, func(tx *gorm.DB) error { return nil })
+	if !errors.Is(err, ErrGroupCommitClosed) {
+		t.Fatalf("expected ErrGroupCommitClosed after shutdown, got %v", err)
+	}
+}
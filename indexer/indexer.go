@@ -42,9 +42,17 @@ type Indexer struct {
 	doAggregations bool
 	doSpider       bool
 
+	// if set, record ops are handled asynchronously by a worker pool
+	ops *opPool
+
+	// if set, writes are batched into shared transactions
+	writes *GroupCommitter
+
 	SendRemoteFollow       func(context.Context, string, uint) error
 	CreateExternalUser     func(context.Context, string) (*models.ActorInfo, error)
 	ApplyPDSClientSettings func(*xrpc.Client)
+	// if set, called with each repo event before it's emitted
+	ObserveRepoEvent func(context.Context, *repomgr.RepoEvent)
 }
 
 func NewIndexer(db *gorm.DB, notifman notifs.NotificationManager, evtman *events.EventManager, didr did.Resolver, fetcher *RepoFetcher, crawl, aggregate, spider bool) (*Indexer, error) {
@@ -75,17 +83,70 @@ func NewIndexer(db *gorm.DB, notifman notifs.NotificationManager, evtman *events
 
 		ix.Crawler = c
 		ix.Crawler.Run()
+
+		go fetcher.runRetries(c.Crawl)
+		if fetcher.Audit.Interval > 0 {
+			go fetcher.runAudits()
+		}
 	}
 
 	return ix, nil
 }
 
+// StartOpWorkers switches record op handling (aggregations and spidering) from
+// inline in HandleRepoEvent to a pool of workers that schedule ops by
+// collection priority. Firehose events are still emitted inline and in order.
+func (ix *Indexer) StartOpWorkers(opts *OpWorkerOptions) {
+	if ix.ops != nil {
+		return
+	}
+	ix.ops = newOpPool(opts, ix.handleRepoOp)
+}
+
+// StartGroupCommit batches the database writes made handling record ops
+// into shared transactions, flushed when a batch fills up or has waited long
+// enough. Each op still waits for its writes to commit.
+func (ix *Indexer) StartGroupCommit(opts *GroupCommitOptions) {
+	if ix.writes != nil {
+		return
+	}
+	ix.writes = NewGroupCommitter(ix.db, opts)
+}
+
+// GroupCommitter returns the committer started by StartGroupCommit, or nil
+func (ix *Indexer) GroupCommitter() *GroupCommitter {
+	return ix.writes
+}
+
+// Shutdown waits for any queued record ops to finish
+func (ix *Indexer) Shutdown() {
+	if ix.ops != nil {
+		ix.ops.Shutdown()
+	}
+	if ix.writes != nil {
+		ix.writes.Shutdown()
+	}
+}
+
+// write runs fn in a transaction, shared with other writes if group commit
+// is enabled
+func (ix *Indexer) write(ctx context.Context, fn func(tx *gorm.DB) error) error {
+	if ix.writes != nil {
+		return ix.writes.Write(ctx, fn)
+	}
+	return ix.db.WithContext(ctx).Transaction(fn)
+}
+
 func (ix *Indexer) HandleRepoEvent(ctx context.Context, evt *repomgr.RepoEvent) error {
 	ctx, span := otel.Tracer("indexer").Start(ctx, "HandleRepoEvent")
 	defer span.End()
 
 	log.Debugw("Handling Repo Event!", "uid", evt.User)
 
+	if ix.ObserveRepoEvent != nil {
+		ix.ObserveRepoEvent(ctx, evt)
+	}
+
 	outops := make([]*comatproto.SyncSubscribeRepos_RepoOp, 0, len(evt.Ops))
 	for _, op := range evt.Ops {
 		link := (*lexutil.LexLink)(op.RecCid)
@@ -95,19 +156,41 @@ func (ix *Indexer) HandleRepoEvent(ctx context.Context, evt *repomgr.RepoEvent)
 			Cid:    link,
 		})
 
-		if err := ix.handleRepoOp(ctx, evt, &op); err != nil {
-			log.Errorw("failed to handle repo op", "err", err)
+		if ix.ops == nil {
+			if err := ix.handleRepoOp(ctx, evt, &op); err != nil {
+				log.Errorw("failed to handle repo op", "err", err)
+			}
 		}
 	}
 
+	if ix.ops != nil {
+		ix.ops.Enqueue(ctx, evt)
+	}
+
 	did, err := ix.DidForUser(ctx, evt.User)
 	if err != nil {
 		return err
 	}
 
+	if evt.Sync {
+		log.Debugw("Sending sync event", "did", did)
+		if err := ix.events.AddEvent(ctx, &events.XRPCStreamEvent{
+			RepoSync: &comatproto.SyncSubscribeRepos_Sync{
+				Did:    did,
+				Blocks: evt.RepoSlice,
+				Rev:    evt.Rev,
+				Time:   time.Now().Format(util.ISO8601),
+			},
+			PrivUid: evt.User,
+		}); err != nil {
+			return fmt.Errorf("failed to push event: %s", err)
+		}
+		return nil
+	}
+
 	toobig := false
 	slice := evt.RepoSlice
-	if len(slice) > MaxEventSliceLength || len(outops) > MaxOpsSliceLength {
+	if evt.TooBig || len(slice) > MaxEventSliceLength || len(outops) > MaxOpsSliceLength {
 		slice = []byte{}
 		outops = nil
 		toobig = true
@@ -342,28 +425,26 @@ func (ix *Indexer) LookupUserByHandle(ctx context.Context, handle string) (*mode
 func (ix *Indexer) handleInitActor(ctx context.Context, evt *repomgr.RepoEvent, op *repomgr.RepoOp) error {
 	ai := op.ActorInfo
 
-	if err := ix.db.Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "uid"}},
-		UpdateAll: true,
-	}).Create(&models.ActorInfo{
-		Uid:         evt.User,
-		Handle:      sql.NullString{String: ai.Handle, Valid: true},
-		Did:         ai.Did,
-		DisplayName: ai.DisplayName,
-		Type:        ai.Type,
-		PDS:         evt.PDS,
-	}).Error; err != nil {
-		return fmt.Errorf("initializing new actor info: %w", err)
-	}
-
-	if err := ix.db.Create(&models.FollowRecord{
-		Follower: evt.User,
-		Target:   evt.User,
-	}).Error; err != nil {
-		return err
-	}
-
-	return nil
+	return ix.write(ctx, func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "uid"}},
+			UpdateAll: true,
+		}).Create(&models.ActorInfo{
+			Uid:         evt.User,
+			Handle:      sql.NullString{String: ai.Handle, Valid: true},
+			Did:         ai.Did,
+			DisplayName: ai.DisplayName,
+			Type:        ai.Type,
+			PDS:         evt.PDS,
+		}).Error; err != nil {
+			return fmt.Errorf("initializing new actor info: %w", err)
+		}
+
+		return tx.Create(&models.FollowRecord{
+			Follower: evt.User,
+			Target:   evt.User,
+		}).Error
+	})
 }
 
 func isNotFound(err error) bool {
@@ -411,11 +492,15 @@ func (ix *Indexer) handleRecordDelete(ctx context.Context, evt *repomgr.RepoEven
 			return err
 		}
 
-		if err := ix.db.Model(models.FeedPost{}).Where("id = ?", fp.ID).UpdateColumn("deleted", true).Error; err != nil {
+		if err := ix.write(ctx, func(tx *gorm.DB) error {
+			return tx.Model(models.FeedPost{}).Where("id = ?", fp.ID).UpdateColumn("deleted", true).Error
+		}); err != nil {
 			return err
 		}
 	case "app.bsky.feed.repost":
-		if err := ix.db.Where("reposter = ? AND rkey = ?", evt.User, op.Rkey).Delete(&models.RepostRecord{}).Error; err != nil {
+		if err := ix.write(ctx, func(tx *gorm.DB) error {
+			return tx.Where("reposter = ? AND rkey = ?", evt.User, op.Rkey).Delete(&models.RepostRecord{}).Error
+		}); err != nil {
 			return err
 		}
 
@@ -445,9 +530,8 @@ func (ix *Indexer) handleRecordDeleteFeedLike(ctx context.Context, evt *repomgr.
 		return err
 	}
 
-	if err := ix.db.Transaction(func(tx *gorm.DB) error {
-		tx.Statement.RaiseErrorOnNotFound = true
-		if err := tx.Model(models.VoteRecord{}).Where("id = ?", vr.ID).Delete(&vr).Error; err != nil {
+	if err := ix.write(ctx, func(tx *gorm.DB) error {
+		if err := tx.Model(models.VoteRecord{}).Where("id = ?", vr.ID).Delete(&models.VoteRecord{}).Error; err != nil {
 			return err
 		}
 
@@ -465,12 +549,16 @@ func (ix *Indexer) handleRecordDeleteFeedLike(ctx context.Context, evt *repomgr.
 }
 
 func (ix *Indexer) handleRecordDeleteGraphFollow(ctx context.Context, evt *repomgr.RepoEvent, op *repomgr.RepoOp) error {
-	q := ix.db.Where("follower = ? AND rkey = ?", evt.User, op.Rkey).Delete(&models.FollowRecord{})
-	if err := q.Error; err != nil {
+	var deleted int64
+	if err := ix.write(ctx, func(tx *gorm.DB) error {
+		q := tx.Where("follower = ? AND rkey = ?", evt.User, op.Rkey).Delete(&models.FollowRecord{})
+		deleted = q.RowsAffected
+		return q.Error
+	}); err != nil {
 		return err
 	}
 
-	if q.RowsAffected == 0 {
+	if deleted == 0 {
 		log.Warnw("attempted to delete follow we did not have a record for", "user", evt.User, "rkey", op.Rkey)
 		return nil
 	}
@@ -500,15 +588,18 @@ func (ix *Indexer) handleRecordCreate(ctx context.Context, evt *repomgr.RepoEven
 
 		out = append(out, author.PDS)
 
-		rr := models.RepostRecord{
-			RecCreated: rec.CreatedAt,
-			Post:       fp.ID,
-			Reposter:   evt.User,
-			Author:     fp.Author,
-			RecCid:     op.RecCid.String(),
-			Rkey:       op.Rkey,
-		}
-		if err := ix.db.Create(&rr).Error; err != nil {
+		var rr models.RepostRecord
+		if err := ix.write(ctx, func(tx *gorm.DB) error {
+			rr = models.RepostRecord{
+				RecCreated: rec.CreatedAt,
+				Post:       fp.ID,
+				Reposter:   evt.User,
+				Author:     fp.Author,
+				RecCid:     op.RecCid.String(),
+				Rkey:       op.Rkey,
+			}
+			return tx.Create(&rr).Error
+		}); err != nil {
 			return nil, err
 		}
 
@@ -548,18 +639,21 @@ func (ix *Indexer) handleRecordCreateFeedLike(ctx context.Context, rec *bsky.Fee
 		return err
 	}
 
-	vr := models.VoteRecord{
-		Voter:   evt.User,
-		Post:    post.ID,
-		Created: rec.CreatedAt,
-		Rkey:    op.Rkey,
-		Cid:     op.RecCid.String(),
-	}
-	if err := ix.db.Create(&vr).Error; err != nil {
-		return err
-	}
+	var vr models.VoteRecord
+	if err := ix.write(ctx, func(tx *gorm.DB) error {
+		vr = models.VoteRecord{
+			Voter:   evt.User,
+			Post:    post.ID,
+			Created: rec.CreatedAt,
+			Rkey:    op.Rkey,
+			Cid:     op.RecCid.String(),
+		}
+		if err := tx.Create(&vr).Error; err != nil {
+			return err
+		}
 
-	if err := ix.db.Model(models.FeedPost{}).Where("id = ?", post.ID).Update("up_count", gorm.Expr("up_count + 1")).Error; err != nil {
+		return tx.Model(models.FeedPost{}).Where("id = ?", post.ID).Update("up_count", gorm.Expr("up_count + 1")).Error
+	}); err != nil {
 		return err
 	}
 	if err := ix.addNewVoteNotification(ctx, act.Uid, &vr); err != nil {
@@ -585,13 +679,16 @@ func (ix *Indexer) handleRecordCreateGraphFollow(ctx context.Context, rec *bsky.
 	}
 
 	// 'follower' followed 'target'
-	fr := models.FollowRecord{
-		Follower: evt.User,
-		Target:   subj.Uid,
-		Rkey:     op.Rkey,
-		Cid:      op.RecCid.String(),
-	}
-	if err := ix.db.Create(&fr).Error; err != nil {
+	var fr models.FollowRecord
+	if err := ix.write(ctx, func(tx *gorm.DB) error {
+		fr = models.FollowRecord{
+			Follower: evt.User,
+			Target:   subj.Uid,
+			Rkey:     op.Rkey,
+			Cid:      op.RecCid.String(),
+		}
+		return tx.Create(&fr).Error
+	}); err != nil {
 		return err
 	}
 
@@ -639,7 +736,9 @@ func (ix *Indexer) handleRecordUpdate(ctx context.Context, evt *repomgr.RepoEven
 			}
 		}
 
-		if err := ix.db.Model(models.FeedPost{}).Where("id = ?", fp.ID).UpdateColumn("cid", op.RecCid.String()).Error; err != nil {
+		if err := ix.write(ctx, func(tx *gorm.DB) error {
+			return tx.Model(models.FeedPost{}).Where("id = ?", fp.ID).UpdateColumn("cid", op.RecCid.String()).Error
+		}); err != nil {
 			return err
 		}
 
@@ -655,7 +754,9 @@ func (ix *Indexer) handleRecordUpdate(ctx context.Context, evt *repomgr.RepoEven
 		rr.RecCreated = rec.CreatedAt
 		rr.RecCid = op.RecCid.String()
 
-		if err := ix.db.Save(&rr).Error; err != nil {
+		if err := ix.write(ctx, func(tx *gorm.DB) error {
+			return tx.Save(&rr).Error
+		}); err != nil {
 			return err
 		}
 
@@ -750,31 +851,30 @@ func (ix *Indexer) handleRecordCreateFeedPost(ctx context.Context, user models.U
 		return err
 	}
 
-	fp := models.FeedPost{
-		Rkey:    rkey,
-		Cid:     rcid.String(),
-		Author:  user,
-		ReplyTo: replyid,
+	if maybe.ID != 0 && !maybe.Missing {
+		// TODO: we've already processed this record creation
+		log.Warnw("potentially erroneous event, duplicate create", "rkey", rkey, "user", user)
 	}
 
-	if maybe.ID != 0 {
-		// we're likely filling in a missing reference
-		if !maybe.Missing {
-			// TODO: we've already processed this record creation
-			log.Warnw("potentially erroneous event, duplicate create", "rkey", rkey, "user", user)
-		}
-
-		if err := ix.db.Clauses(clause.OnConflict{
-			Columns:   []clause.Column{clause.Column{Name: "rkey"}, clause.Column{Name: "author"}},
-			UpdateAll: true,
-		}).Create(&fp).Error; err != nil {
-			return err
-		}
-
-	} else {
-		if err := ix.db.Create(&fp).Error; err != nil {
-			return err
-		}
+	var fp models.FeedPost
+	if err := ix.write(ctx, func(tx *gorm.DB) error {
+		fp = models.FeedPost{
+			Rkey:    rkey,
+			Cid:     rcid.String(),
+			Author:  user,
+			ReplyTo: replyid,
+		}
+
+		if maybe.ID != 0 {
+			// we're likely filling in a missing reference
+			return tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{clause.Column{Name: "rkey"}, clause.Column{Name: "author"}},
+				UpdateAll: true,
+			}).Create(&fp).Error
+		}
+		return tx.Create(&fp).Error
+	}); err != nil {
+		return err
 	}
 
 	if err := ix.addNewPostNotification(ctx, rec, &fp, mentions); err != nil {
@@ -11,7 +11,7 @@ import (
 type KeyManager struct {
 	didr DidResolver
 
-	signingKey *did.PrivKey
+	signer Signer
 }
 
 type DidResolver interface {
@@ -19,9 +19,19 @@ type DidResolver interface {
 }
 
 func NewKeyManager(didr DidResolver, k *did.PrivKey) *KeyManager {
+	var signer Signer
+	if k != nil {
+		signer = &LocalSigner{Key: k}
+	}
+	return NewKeyManagerWithSigner(didr, signer)
+}
+
+// NewKeyManagerWithSigner is NewKeyManager for a signing key that may not be
+// held in memory, such as one in a KMS or HSM. The signer may be nil.
+func NewKeyManagerWithSigner(didr DidResolver, signer Signer) *KeyManager {
 	return &KeyManager{
-		didr:       didr,
-		signingKey: k,
+		didr:   didr,
+		signer: signer,
 	}
 }
 
@@ -61,9 +71,20 @@ func (km *KeyManager) getKey(ctx context.Context, did string) (*did.PubKey, erro
 }
 
 func (km *KeyManager) SignForUser(ctx context.Context, did string, msg []byte) ([]byte, error) {
-	if km.signingKey == nil {
+	if km.signer == nil {
 		return nil, fmt.Errorf("key manager does not have a signing key, cannot sign")
 	}
 
-	return km.signingKey.Sign(msg)
+	ctx, span := otel.Tracer("keymgr").Start(ctx, "signForUser")
+	defer span.End()
+
+	return km.signer.Sign(ctx, msg)
+}
+
+// SigningKey is the public half of the key SignForUser signs with
+func (km *KeyManager) SigningKey(ctx context.Context) (*did.PubKey, error) {
+	if km.signer == nil {
+		return nil, fmt.Errorf("key manager does not have a signing key")
+	}
+	return km.signer.PublicKey(ctx)
 }
@@ -0,0 +1,267 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	did "github.com/whyrusleeping/go-did"
+)
+
+// AWSCredentials are the credentials requests to AWS are signed with
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// AWSCredentialsFromEnv reads credentials from the standard AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables
+func AWSCredentialsFromEnv() (*AWSCredentials, error) {
+	creds := &AWSCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return creds, nil
+}
+
+type KMSSignerOptions struct {
+	// ID, ARN or alias of an asymmetric ECC_NIST_P256 or ECC_SECG_P256K1 key
+	// with SIGN_VERIFY usage
+	KeyID string
+	// Region the key is in. If empty, it's taken from the key's ARN, or
+	// failing that from AWS_REGION or AWS_DEFAULT_REGION.
+	Region string
+	// Overrides the regional KMS endpoint, such as for a VPC endpoint
+	Endpoint string
+	// If nil, read from the environment; see AWSCredentialsFromEnv
+	Credentials *AWSCredentials
+	Client      *http.Client
+}
+
+// KMSSigner signs with a key held in AWS KMS, so the private key never leaves
+// it. The KMS API is called directly, rather than through the AWS SDK, since
+// only two of its operations are needed.
+type KMSSigner struct {
+	keyID    string
+	region   string
+	endpoint string
+	creds    AWSCredentials
+	client   *http.Client
+
+	pub *did.PubKey
+}
+
+// NewKMSSigner fetches the key's public half, checking that it can be used
+// for atproto signatures
+func NewKMSSigner(ctx context.Context, opts *KMSSignerOptions) (*KMSSigner, error) {
+	if opts.KeyID == "" {
+		return nil, fmt.Errorf("KMS key ID must be set")
+	}
+
+	s := &KMSSigner{
+		keyID:    opts.KeyID,
+		region:   opts.Region,
+		endpoint: opts.Endpoint,
+		client:   opts.Client,
+	}
+	if s.region == "" {
+		s.region = regionFromARN(opts.KeyID)
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_REGION")
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		return nil, fmt.Errorf("KMS region must be set, or given in the key's ARN")
+	}
+	if s.endpoint == "" {
+		s.endpoint = fmt.Sprintf("https://kms.%s.amazonaws.com/", s.region)
+	}
+	if s.client == nil {
+		s.client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if opts.Credentials != nil {
+		s.creds = *opts.Credentials
+	} else {
+		creds, err := AWSCredentialsFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		s.creds = *creds
+	}
+
+	var out struct {
+		PublicKey []byte
+		KeySpec   string
+		KeyUsage  string
+	}
+	if err := s.call(ctx, "GetPublicKey", map[string]any{"KeyId": s.keyID}, &out); err != nil {
+		return nil, fmt.Errorf("fetching KMS public key: %w", err)
+	}
+	if out.KeyUsage != "SIGN_VERIFY" {
+		return nil, fmt.Errorf("KMS key %s has usage %s, must be SIGN_VERIFY", s.keyID, out.KeyUsage)
+	}
+	pub, err := pubKeyFromSPKI(out.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("KMS key %s (%s): %w", s.keyID, out.KeySpec, err)
+	}
+	s.pub = pub
+
+	return s, nil
+}
+
+// regionFromARN returns the region of arn:aws:kms:<region>:<account>:key/...
+func regionFromARN(id string) string {
+	parts := strings.Split(id, ":")
+	if len(parts) < 6 || parts[0] != "arn" || parts[2] != "kms" {
+		return ""
+	}
+	return parts[3]
+}
+
+func (s *KMSSigner) Sign(ctx context.Context, msg []byte) ([]byte, error) {
+	h := sha256.Sum256(msg)
+
+	var out struct {
+		Signature []byte
+	}
+	err := s.call(ctx, "Sign", map[string]any{
+		"KeyId":            s.keyID,
+		"Message":          h[:],
+		"MessageType":      "DIGEST",
+		"SigningAlgorithm": "ECDSA_SHA_256",
+	}, &out)
+	if err != nil {
+		return nil, fmt.Errorf("signing with KMS: %w", err)
+	}
+
+	return compactSignatureFromDER(s.pub.Type, out.Signature)
+}
+
+func (s *KMSSigner) PublicKey(ctx context.Context) (*did.PubKey, error) {
+	return s.pub, nil
+}
+
+// call makes a KMS API call. []byte fields are base64 encoded by
+// encoding/json, as KMS expects blobs to be.
+func (s *KMSSigner) call(ctx context.Context, op string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+op)
+	signAWSRequest(req, body, &s.creds, s.region, "kms", time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var kerr struct {
+			Type     string `json:"__type"`
+			Message  string `json:"message"`
+			Message2 string `json:"Message"`
+		}
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(b, &kerr) != nil || kerr.Type == "" {
+			return fmt.Errorf("KMS %s failed with status %d", op, resp.StatusCode)
+		}
+		if kerr.Message == "" {
+			kerr.Message = kerr.Message2
+		}
+		return fmt.Errorf("KMS %s failed: %s: %s", op, kerr.Type, kerr.Message)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// signAWSRequest signs a request with AWS Signature Version 4, setting its
+// X-Amz-Date and Authorization headers. Every header already set is signed.
+func signAWSRequest(req *http.Request, body []byte, creds *AWSCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	query := strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20")
+
+	bodyHash := sha256.Sum256(body)
+	canonReq := strings.Join([]string{
+		req.Method,
+		path,
+		query,
+		canonHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	reqHash := sha256.Sum256([]byte(canonReq))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(reqHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", creds.AccessKeyID, scope, signedHeaders, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
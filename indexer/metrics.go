@@ -25,6 +25,16 @@ var reposFetched = promauto.NewCounterVec(prometheus.CounterOpts{
 	Help: "Number of repos fetched",
 }, []string{"status"})
 
+var repoFetchFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "indexer_repo_fetch_failures",
+	Help: "Number of failed repo crawls, by whether the repo will be retried or was dead-lettered",
+}, []string{"outcome"})
+
+var repoAudits = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "indexer_repo_audits",
+	Help: "Number of repo audits, by outcome",
+}, []string{"status"})
+
 var catchupEventsEnqueued = promauto.NewCounter(prometheus.CounterOpts{
 	Name: "indexer_catchup_events_enqueued",
 	Help: "Number of catchup events enqueued",
@@ -34,3 +44,41 @@ var catchupEventsProcessed = promauto.NewCounter(prometheus.CounterOpts{
 	Name: "indexer_catchup_events_processed",
 	Help: "Number of catchup events processed",
 })
+
+var opQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "indexer_op_queue_depth",
+	Help: "Number of record ops waiting for a worker, by priority",
+}, []string{"priority"})
+
+var opQueueLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "indexer_op_queue_latency_seconds",
+	Help:    "Time record ops spend queued before being handled, by priority",
+	Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
+}, []string{"priority"})
+
+var crawlQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "indexer_crawl_queue_depth",
+	Help: "Number of crawl jobs awaiting dispatch, by priority class",
+}, []string{"priority"})
+
+var repoResets = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "indexer_repo_resets",
+	Help: "Number of repos discarded and refetched because the upstream copy was older than ours",
+})
+
+var groupCommitBatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "indexer_group_commit_batch_size",
+	Help:    "Number of database writes committed together by the indexer",
+	Buckets: prometheus.ExponentialBuckets(1, 2, 11),
+})
+
+var groupCommitDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "indexer_group_commit_duration_seconds",
+	Help:    "Time taken to commit a batch of indexer database writes",
+	Buckets: prometheus.ExponentialBuckets(0.0005, 2, 15),
+})
+
+var groupCommitRetries = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "indexer_group_commit_retries_total",
+	Help: "Number of batches of indexer database writes that failed and were retried one write at a time",
+})
@@ -0,0 +1,240 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/repomgr"
+)
+
+// OpPriority is the scheduling class for record ops in a collection
+type OpPriority int
+
+const (
+	OpPriorityHigh OpPriority = iota
+	OpPriorityNormal
+	OpPriorityLow
+
+	numOpPriorities
+)
+
+func (p OpPriority) String() string {
+	switch p {
+	case OpPriorityHigh:
+		return "high"
+	case OpPriorityNormal:
+		return "normal"
+	case OpPriorityLow:
+		return "low"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseOpPriority(s string) (OpPriority, error) {
+	switch strings.ToLower(s) {
+	case "high":
+		return OpPriorityHigh, nil
+	case "normal":
+		return OpPriorityNormal, nil
+	case "low":
+		return OpPriorityLow, nil
+	default:
+		return 0, fmt.Errorf("unknown op priority %q", s)
+	}
+}
+
+type OpWorkerOptions struct {
+	// Number of workers. Ops for a given user are always handled by the same
+	// worker so they are applied in order within each priority class.
+	Workers int
+	// Maximum number of queued ops per worker before HandleRepoEvent blocks
+	MaxQueue int
+	// Relative share of worker time given to each class when all are backed up
+	Weights [numOpPriorities]int
+	// Collection NSID to priority. Unlisted collections are OpPriorityNormal.
+	Collections map[string]OpPriority
+}
+
+func DefaultOpWorkerOptions() *OpWorkerOptions {
+	return &OpWorkerOptions{
+		Workers:  16,
+		MaxQueue: 10_000,
+		Weights:  [numOpPriorities]int{8, 4, 1},
+		Collections: map[string]OpPriority{
+			"app.bsky.actor.profile": OpPriorityHigh,
+			"app.bsky.feed.post":     OpPriorityNormal,
+			"app.bsky.graph.follow":  OpPriorityNormal,
+			"app.bsky.feed.repost":   OpPriorityLow,
+			"app.bsky.feed.like":     OpPriorityLow,
+		},
+	}
+}
+
+type opJob struct {
+	ctx      context.Context
+	evt      *repomgr.RepoEvent
+	op       repomgr.RepoOp
+	prio     OpPriority
+	enqueued time.Time
+}
+
+// opPool runs record op handling on a fixed set of workers. Each worker has
+// one FIFO queue per priority class and picks between them with smooth
+// weighted round robin, so high priority collections stay fresh when the
+// pipeline is saturated without starving the rest.
+type opPool struct {
+	handle      func(ctx context.Context, evt *repomgr.RepoEvent, op *repomgr.RepoOp) error
+	collections map[string]OpPriority
+	workers     []*opWorker
+	wg          sync.WaitGroup
+}
+
+type opWorker struct {
+	lk       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+
+	queues   [numOpPriorities][]*opJob
+	queued   int
+	maxQueue int
+	sched    *weightedRoundRobin
+	closed   bool
+}
+
+func newOpPool(opts *OpWorkerOptions, handle func(context.Context, *repomgr.RepoEvent, *repomgr.RepoOp) error) *opPool {
+	if opts == nil {
+		opts = DefaultOpWorkerOptions()
+	}
+
+	p := &opPool{
+		handle:      handle,
+		collections: opts.Collections,
+	}
+
+	for i := 0; i < max(opts.Workers, 1); i++ {
+		w := &opWorker{
+			maxQueue: max(opts.MaxQueue, 1),
+			sched:    newWeightedRoundRobin(opts.Weights[:]),
+		}
+		w.notEmpty = sync.NewCond(&w.lk)
+		w.notFull = sync.NewCond(&w.lk)
+		p.workers = append(p.workers, w)
+	}
+
+	p.wg.Add(len(p.workers))
+	for _, w := range p.workers {
+		go p.run(w)
+	}
+
+	return p
+}
+
+func (p *opPool) priorityFor(collection string) OpPriority {
+	if prio, ok := p.collections[collection]; ok {
+		return prio
+	}
+	return OpPriorityNormal
+}
+
+func (p *opPool) workerFor(user models.Uid) *opWorker {
+	h := fnv.New32a()
+	fmt.Fprint(h, user)
+	return p.workers[h.Sum32()%uint32(len(p.workers))]
+}
+
+// Enqueue queues all of the event's ops, blocking while the worker
+// responsible for the event's user is full
+func (p *opPool) Enqueue(ctx context.Context, evt *repomgr.RepoEvent) {
+	// handling outlives the caller, keep trace info but not cancellation
+	ctx = context.WithoutCancel(ctx)
+
+	w := p.workerFor(evt.User)
+	now := time.Now()
+
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	for _, op := range evt.Ops {
+		for w.queued >= w.maxQueue && !w.closed {
+			w.notFull.Wait()
+		}
+		if w.closed {
+			return
+		}
+
+		prio := p.priorityFor(op.Collection)
+		w.queues[prio] = append(w.queues[prio], &opJob{
+			ctx:      ctx,
+			evt:      evt,
+			op:       op,
+			prio:     prio,
+			enqueued: now,
+		})
+		w.queued++
+		opQueueDepth.WithLabelValues(prio.String()).Inc()
+		w.notEmpty.Signal()
+	}
+}
+
+// next blocks until a job is available, returning nil once the worker is
+// closed and drained
+func (w *opWorker) next() *opJob {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	for w.queued == 0 {
+		if w.closed {
+			return nil
+		}
+		w.notEmpty.Wait()
+	}
+
+	pick := w.sched.pick(func(c int) bool {
+		return len(w.queues[c]) > 0
+	})
+
+	job := w.queues[pick][0]
+	w.queues[pick][0] = nil
+	w.queues[pick] = w.queues[pick][1:]
+	w.queued--
+	w.notFull.Signal()
+
+	return job
+}
+
+func (p *opPool) run(w *opWorker) {
+	defer p.wg.Done()
+
+	for {
+		job := w.next()
+		if job == nil {
+			return
+		}
+
+		prio := job.prio.String()
+		opQueueDepth.WithLabelValues(prio).Dec()
+		opQueueLatency.WithLabelValues(prio).Observe(time.Since(job.enqueued).Seconds())
+
+		if err := p.handle(job.ctx, job.evt, &job.op); err != nil {
+			log.Errorw("failed to handle repo op", "err", err, "uid", job.evt.User, "collection", job.op.Collection, "rkey", job.op.Rkey)
+		}
+	}
+}
+
+// Shutdown stops accepting new ops and waits for queued ops to be handled
+func (p *opPool) Shutdown() {
+	for _, w := range p.workers {
+		w.lk.Lock()
+		w.closed = true
+		w.notEmpty.Broadcast()
+		w.notFull.Broadcast()
+		w.lk.Unlock()
+	}
+	p.wg.Wait()
+}
@@ -0,0 +1,115 @@
+package indexer
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/bluesky-social/indigo/repomgr"
+)
+
+func TestOpPoolPriorities(t *testing.T) {
+	gate := make(chan struct{})
+	started := make(chan struct{})
+
+	var lk sync.Mutex
+	var handled []string
+
+	opts := DefaultOpWorkerOptions()
+	opts.Workers = 1
+	opts.Collections["test.blocker"] = OpPriorityNormal
+
+	p := newOpPool(opts, func(ctx context.Context, evt *repomgr.RepoEvent, op *repomgr.RepoOp) error {
+		if op.Collection == "test.blocker" {
+			close(started)
+			<-gate
+			return nil
+		}
+		lk.Lock()
+		handled = append(handled, op.Collection+"/"+op.Rkey)
+		lk.Unlock()
+		return nil
+	})
+
+	ctx := context.Background()
+
+	// hold the only worker so everything else queues up behind it
+	p.Enqueue(ctx, &repomgr.RepoEvent{User: 1, Ops: []repomgr.RepoOp{{Collection: "test.blocker"}}})
+	<-started
+
+	var likes []repomgr.RepoOp
+	for _, rkey := range []string{"a", "b", "c"} {
+		likes = append(likes, repomgr.RepoOp{Collection: "app.bsky.feed.like", Rkey: rkey})
+	}
+	p.Enqueue(ctx, &repomgr.RepoEvent{User: 1, Ops: likes})
+	p.Enqueue(ctx, &repomgr.RepoEvent{User: 1, Ops: []repomgr.RepoOp{{Collection: "app.bsky.actor.profile", Rkey: "self"}}})
+
+	close(gate)
+	p.Shutdown()
+
+	exp := []string{
+		"app.bsky.actor.profile/self",
+		"app.bsky.feed.like/a",
+		"app.bsky.feed.like/b",
+		"app.bsky.feed.like/c",
+	}
+	if len(handled) != len(exp) {
+		t.Fatalf("expected %d ops handled, got %d: %v", len(exp), len(handled), handled)
+	}
+	for i := range exp {
+		if handled[i] != exp[i] {
+			t.Fatalf("unexpected handling order: %v", handled)
+		}
+	}
+}
+
+func TestOpPoolNoStarvation(t *testing.T) {
+	gate := make(chan struct{})
+	started := make(chan struct{})
+
+	var lk sync.Mutex
+	var handled []OpPriority
+
+	opts := DefaultOpWorkerOptions()
+	opts.Workers = 1
+	opts.Weights = [numOpPriorities]int{3, 1, 1}
+	opts.Collections["test.blocker"] = OpPriorityNormal
+
+	p := newOpPool(opts, func(ctx context.Context, evt *repomgr.RepoEvent, op *repomgr.RepoOp) error {
+		if op.Collection == "test.blocker" {
+			close(started)
+			<-gate
+			return nil
+		}
+		lk.Lock()
+		handled = append(handled, opts.Collections[op.Collection])
+		lk.Unlock()
+		return nil
+	})
+
+	ctx := context.Background()
+	p.Enqueue(ctx, &repomgr.RepoEvent{User: 1, Ops: []repomgr.RepoOp{{Collection: "test.blocker"}}})
+	<-started
+
+	var ops []repomgr.RepoOp
+	for i := 0; i < 20; i++ {
+		ops = append(ops, repomgr.RepoOp{Collection: "app.bsky.actor.profile"})
+		ops = append(ops, repomgr.RepoOp{Collection: "app.bsky.feed.like"})
+	}
+	p.Enqueue(ctx, &repomgr.RepoEvent{User: 1, Ops: ops})
+
+	close(gate)
+	p.Shutdown()
+
+	// with a 3:1 weighting, the low priority queue should get one of every
+	// four slots while both are backed up
+	var low int
+	for _, prio := range handled[:8] {
+		if prio == OpPriorityLow {
+			low++
+		}
+	}
+	if low != 2 {
+		t.Fatalf("expected 2 low priority ops in the first 8, got %d: %v", low, handled[:8])
+	}
+}
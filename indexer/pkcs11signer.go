@@ -0,0 +1,176 @@
+//go:build pkcs11
+
+package indexer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/asn1"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+	did "github.com/whyrusleeping/go-did"
+)
+
+// PKCS11Signer signs with a key held in an HSM, or anything else reachable
+// through a PKCS#11 module, so the private key never leaves it. It needs cgo
+// and a build with the pkcs11 tag.
+type PKCS11Signer struct {
+	ctx *pkcs11.Ctx
+
+	// sessions aren't safe for concurrent use
+	lk      sync.Mutex
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+
+	pub *did.PubKey
+}
+
+// NewPKCS11Signer loads the module, logs in to the token and finds the key
+// pair, checking that it can be used for atproto signatures
+func NewPKCS11Signer(opts *PKCS11SignerOptions) (*PKCS11Signer, error) {
+	if opts.Module == "" || opts.TokenLabel == "" || opts.KeyLabel == "" {
+		return nil, fmt.Errorf("PKCS#11 module, token label and key label must be set")
+	}
+
+	p := pkcs11.New(opts.Module)
+	if p == nil {
+		return nil, fmt.Errorf("failed to load PKCS#11 module %s", opts.Module)
+	}
+	if err := p.Initialize(); err != nil {
+		p.Destroy()
+		return nil, fmt.Errorf("initializing PKCS#11 module: %w", err)
+	}
+
+	s := &PKCS11Signer{ctx: p}
+	if err := s.open(opts); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *PKCS11Signer) open(opts *PKCS11SignerOptions) error {
+	slots, err := s.ctx.GetSlotList(true)
+	if err != nil {
+		return fmt.Errorf("listing PKCS#11 slots: %w", err)
+	}
+	slot, found := uint(0), false
+	for _, sl := range slots {
+		ti, err := s.ctx.GetTokenInfo(sl)
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(ti.Label) == opts.TokenLabel {
+			slot, found = sl, true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("no PKCS#11 token labelled %q", opts.TokenLabel)
+	}
+
+	s.session, err = s.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return fmt.Errorf("opening PKCS#11 session: %w", err)
+	}
+	if err := s.ctx.Login(s.session, pkcs11.CKU_USER, opts.PIN); err != nil {
+		return fmt.Errorf("logging in to PKCS#11 token: %w", err)
+	}
+
+	s.key, err = s.findObject(pkcs11.CKO_PRIVATE_KEY, opts.KeyLabel)
+	if err != nil {
+		return err
+	}
+	pubObj, err := s.findObject(pkcs11.CKO_PUBLIC_KEY, opts.KeyLabel)
+	if err != nil {
+		return err
+	}
+
+	attrs, err := s.ctx.GetAttributeValue(s.session, pubObj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return fmt.Errorf("reading PKCS#11 public key: %w", err)
+	}
+
+	var curve asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(attrs[0].Value, &curve); err != nil {
+		return fmt.Errorf("PKCS#11 key %q isn't on a named curve: %w", opts.KeyLabel, err)
+	}
+	kt, err := keyTypeForCurve(curve)
+	if err != nil {
+		return fmt.Errorf("PKCS#11 key %q: %w", opts.KeyLabel, err)
+	}
+	// the point is DER encoded as an OCTET STRING
+	var point []byte
+	if _, err := asn1.Unmarshal(attrs[1].Value, &point); err != nil {
+		return fmt.Errorf("parsing PKCS#11 public key: %w", err)
+	}
+	s.pub, err = pubKeyFromPoint(kt, point)
+	return err
+}
+
+func (s *PKCS11Signer) findObject(class uint, label string) (pkcs11.ObjectHandle, error) {
+	if err := s.ctx.FindObjectsInit(s.session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}); err != nil {
+		return 0, err
+	}
+	objs, _, err := s.ctx.FindObjects(s.session, 2)
+	if ferr := s.ctx.FindObjectsFinal(s.session); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("finding PKCS#11 key %q: %w", label, err)
+	}
+	switch len(objs) {
+	case 0:
+		return 0, fmt.Errorf("no PKCS#11 EC key labelled %q", label)
+	case 1:
+		return objs[0], nil
+	default:
+		return 0, fmt.Errorf("more than one PKCS#11 EC key labelled %q", label)
+	}
+}
+
+func (s *PKCS11Signer) Sign(ctx context.Context, msg []byte) ([]byte, error) {
+	h := sha256.Sum256(msg)
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}, s.key); err != nil {
+		return nil, fmt.Errorf("signing with PKCS#11: %w", err)
+	}
+	sig, err := s.ctx.Sign(s.session, h[:])
+	if err != nil {
+		return nil, fmt.Errorf("signing with PKCS#11: %w", err)
+	}
+
+	return compactSignatureFromRaw(s.pub.Type, sig)
+}
+
+func (s *PKCS11Signer) PublicKey(ctx context.Context) (*did.PubKey, error) {
+	return s.pub, nil
+}
+
+// Close logs out and unloads the module
+func (s *PKCS11Signer) Close() error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if s.session != 0 {
+		_ = s.ctx.Logout(s.session)
+		_ = s.ctx.CloseSession(s.session)
+		s.session = 0
+	}
+	err := s.ctx.Finalize()
+	s.ctx.Destroy()
+	return err
+}
@@ -0,0 +1,31 @@
+//go:build !pkcs11
+
+package indexer
+
+import (
+	"context"
+	"fmt"
+
+	did "github.com/whyrusleeping/go-did"
+)
+
+// PKCS11Signer signs with a key held in an HSM through a PKCS#11 module. This
+// build doesn't include PKCS#11 support, which needs cgo; build with the
+// pkcs11 tag for it.
+type PKCS11Signer struct{}
+
+func NewPKCS11Signer(opts *PKCS11SignerOptions) (*PKCS11Signer, error) {
+	return nil, fmt.Errorf("PKCS#11 signing is not supported by this build, rebuild with -tags pkcs11")
+}
+
+func (s *PKCS11Signer) Sign(ctx context.Context, msg []byte) ([]byte, error) {
+	return nil, fmt.Errorf("PKCS#11 signing is not supported by this build")
+}
+
+func (s *PKCS11Signer) PublicKey(ctx context.Context) (*did.PubKey, error) {
+	return nil, fmt.Errorf("PKCS#11 signing is not supported by this build")
+}
+
+func (s *PKCS11Signer) Close() error {
+	return nil
+}
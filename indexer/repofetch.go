@@ -8,25 +8,33 @@ import (
 	"io"
 	"io/fs"
 	"sync"
+	"time"
 
 	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/models"
 	"github.com/bluesky-social/indigo/repomgr"
+	"github.com/bluesky-social/indigo/util/retry"
 	"github.com/bluesky-social/indigo/xrpc"
 	ipld "github.com/ipfs/go-ipld-format"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/time/rate"
 	"gorm.io/gorm"
 )
 
 func NewRepoFetcher(db *gorm.DB, rm *repomgr.RepoManager, maxConcurrency int) *RepoFetcher {
+	db.AutoMigrate(&RepoFetchFailure{})
+	db.AutoMigrate(&RepoAudit{})
+
 	return &RepoFetcher{
 		repoman:                rm,
 		db:                     db,
 		Limiters:               make(map[uint]*rate.Limiter),
 		ApplyPDSClientSettings: func(*xrpc.Client) {},
 		MaxConcurrency:         maxConcurrency,
+		Retry:                  DefaultFetchRetryOptions(),
+		Audit:                  DefaultRepoAuditOptions(),
 	}
 }
 
@@ -39,6 +47,12 @@ type RepoFetcher struct {
 
 	MaxConcurrency int
 
+	// backoff schedule for re-crawling repos that failed to fetch or import
+	Retry *FetchRetryOptions
+
+	// scheduled comparison of local repos against their PDS
+	Audit *RepoAuditOptions
+
 	ApplyPDSClientSettings func(*xrpc.Client)
 }
 
@@ -69,6 +83,13 @@ func (rf *RepoFetcher) SetLimiter(pdsID uint, lim *rate.Limiter) {
 	rf.Limiters[pdsID] = lim
 }
 
+var fetchRetryPolicy = retry.Policy{
+	Backoff:     retry.Backoff{Initial: time.Second, Max: time.Second * 10},
+	Throttle:    &retry.Backoff{Initial: time.Second * 10, Max: time.Minute},
+	MaxAttempts: 3,
+	Classify:    xrpc.RetryClass,
+}
+
 func (rf *RepoFetcher) fetchRepo(ctx context.Context, c *xrpc.Client, pds *models.PDS, did string, rev string) ([]byte, error) {
 	ctx, span := otel.Tracer("indexer").Start(ctx, "fetchRepo")
 	defer span.End()
@@ -86,7 +107,9 @@ func (rf *RepoFetcher) fetchRepo(ctx context.Context, c *xrpc.Client, pds *model
 
 	log.Debugw("SyncGetRepo", "did", did, "since", rev)
 	// TODO: max size on these? A malicious PDS could just send us a petabyte sized repo here and kill us
-	repo, err := atproto.SyncGetRepo(ctx, c, did, rev)
+	repo, err := retry.DoValue(ctx, fetchRetryPolicy, func(ctx context.Context) ([]byte, error) {
+		return atproto.SyncGetRepo(ctx, c, did, rev)
+	})
 	if err != nil {
 		reposFetched.WithLabelValues("fail").Inc()
 		return nil, fmt.Errorf("failed to fetch repo (did=%s,rev=%s,host=%s): %w", did, rev, pds.Host, err)
@@ -96,11 +119,29 @@ func (rf *RepoFetcher) fetchRepo(ctx context.Context, c *xrpc.Client, pds *model
 	return repo, nil
 }
 
-// TODO: since this function is the only place we depend on the repomanager, i wonder if this should be wired some other way?
+// FetchAndIndexRepo performs a crawl job, recording failures so the repo is
+// retried later (see RepoFetchFailure)
 func (rf *RepoFetcher) FetchAndIndexRepo(ctx context.Context, job *crawlWork) error {
 	ctx, span := otel.Tracer("indexer").Start(ctx, "FetchAndIndexRepo")
 	defer span.End()
 
+	if err := rf.fetchAndIndexRepo(ctx, job); err != nil {
+		if rerr := rf.recordFetchFailure(ctx, job.act, err); rerr != nil {
+			log.Errorw("failed to record repo fetch failure", "did", job.act.Did, "err", rerr)
+		}
+		return err
+	}
+
+	if err := rf.clearFetchFailure(ctx, job.act.Uid); err != nil {
+		log.Errorw("failed to clear repo fetch failure", "did", job.act.Did, "err", err)
+	}
+	return nil
+}
+
+// TODO: since this function is the only place we depend on the repomanager, i wonder if this should be wired some other way?
+func (rf *RepoFetcher) fetchAndIndexRepo(ctx context.Context, job *crawlWork) error {
+	span := trace.SpanFromContext(ctx)
+
 	span.SetAttributes(attribute.Int("catchup", len(job.catchup)))
 
 	ai := job.act
@@ -164,8 +205,34 @@ func (rf *RepoFetcher) FetchAndIndexRepo(ctx context.Context, job *crawlWork) er
 
 			return nil
 		}
+
+		if errors.Is(err, repomgr.ErrRevRegressed) {
+			log.Warnw("upstream repo is behind our copy, resetting", "did", ai.Did, "pds", pds.Host, "rev", rev, "err", err)
+			return rf.resetAndImport(ctx, c, &pds, ai)
+		}
 		return fmt.Errorf("importing fetched repo (curRev: %s): %w", rev, err)
 	}
 
 	return nil
 }
+
+// resetAndImport throws away our copy of a repo whose upstream history was
+// rewritten and imports a full fresh copy in its place
+func (rf *RepoFetcher) resetAndImport(ctx context.Context, c *xrpc.Client, pds *models.PDS, ai *models.ActorInfo) error {
+	repoResets.Inc()
+
+	if err := rf.repoman.ResetRepo(ctx, ai.Uid); err != nil {
+		return fmt.Errorf("resetting repo (%s): %w", ai.Did, err)
+	}
+
+	repo, err := rf.fetchRepo(ctx, c, pds, ai.Did, "")
+	if err != nil {
+		return err
+	}
+
+	rev := ""
+	if err := rf.repoman.ImportNewRepo(ctx, ai.Uid, ai.Did, bytes.NewReader(repo), &rev); err != nil {
+		return fmt.Errorf("failed to import reset repo (%s): %w", ai.Did, err)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package indexer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+
+	did "github.com/whyrusleeping/go-did"
+	"gitlab.com/yawning/secp256k1-voi/secec"
+)
+
+// Signer is a signing key the KeyManager signs with. Implementations may keep
+// the key out of process, in a KMS or HSM, so that it never has to be written
+// to disk.
+type Signer interface {
+	// Sign signs msg, returning the signature as atproto expects it: for the
+	// ECDSA key types, 64 bytes of r||s with a low S
+	Sign(ctx context.Context, msg []byte) ([]byte, error)
+	// PublicKey is the key signatures verify against
+	PublicKey(ctx context.Context) (*did.PubKey, error)
+}
+
+// LocalSigner signs with a private key held in memory
+type LocalSigner struct {
+	Key *did.PrivKey
+}
+
+func (s *LocalSigner) Sign(ctx context.Context, msg []byte) ([]byte, error) {
+	return s.Key.Sign(msg)
+}
+
+func (s *LocalSigner) PublicKey(ctx context.Context) (*did.PubKey, error) {
+	return s.Key.Public(), nil
+}
+
+type PKCS11SignerOptions struct {
+	// Path to the PKCS#11 module, such as the HSM vendor's shared library
+	Module string
+	// Label of the token the key is on, and the user PIN to log in to it
+	TokenLabel string
+	PIN        string
+	// Label of the key pair; both halves must have it
+	KeyLabel string
+}
+
+// curve orders, for normalizing signatures made elsewhere
+var (
+	p256Order    = elliptic.P256().Params().N
+	k256Order, _ = new(big.Int).SetString("fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141", 16)
+)
+
+func curveOrder(keyType string) (*big.Int, error) {
+	switch keyType {
+	case did.KeyTypeP256:
+		return p256Order, nil
+	case did.KeyTypeSecp256k1:
+		return k256Order, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type for ECDSA signing: %s", keyType)
+	}
+}
+
+// compactSignature converts an ECDSA signature given as r and s into 64 bytes
+// of r||s, replacing a high S with n-S. HSMs and KMSes sign without regard
+// for malleability, but atproto only accepts low S signatures.
+func compactSignature(keyType string, r, s *big.Int) ([]byte, error) {
+	n, err := curveOrder(keyType)
+	if err != nil {
+		return nil, err
+	}
+	if r.Sign() <= 0 || s.Sign() <= 0 || r.Cmp(n) >= 0 || s.Cmp(n) >= 0 {
+		return nil, fmt.Errorf("invalid ECDSA signature: scalar out of range")
+	}
+
+	half := new(big.Int).Rsh(n, 1)
+	if s.Cmp(half) > 0 {
+		s = new(big.Int).Sub(n, s)
+	}
+
+	out := make([]byte, 64)
+	r.FillBytes(out[:32])
+	s.FillBytes(out[32:])
+	return out, nil
+}
+
+// compactSignatureFromDER is compactSignature for a signature in ASN.1 DER,
+// as KMSes return them
+func compactSignatureFromDER(keyType string, der []byte) ([]byte, error) {
+	var sig struct {
+		R, S *big.Int
+	}
+	rest, err := asn1.Unmarshal(der, &sig)
+	if err != nil {
+		return nil, fmt.Errorf("parsing DER signature: %w", err)
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("parsing DER signature: trailing data")
+	}
+	return compactSignature(keyType, sig.R, sig.S)
+}
+
+// compactSignatureFromRaw is compactSignature for a signature given as r||s,
+// as PKCS#11 tokens return them
+func compactSignatureFromRaw(keyType string, raw []byte) ([]byte, error) {
+	if len(raw) != 64 {
+		return nil, fmt.Errorf("invalid ECDSA signature: expected 64 bytes, got %d", len(raw))
+	}
+	r := new(big.Int).SetBytes(raw[:32])
+	s := new(big.Int).SetBytes(raw[32:])
+	return compactSignature(keyType, r, s)
+}
+
+var (
+	oidNamedCurveP256      = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidNamedCurveSecp256k1 = asn1.ObjectIdentifier{1, 3, 132, 0, 10}
+)
+
+// keyTypeForCurve is the key type of keys on the named curve with the OID
+func keyTypeForCurve(oid asn1.ObjectIdentifier) (string, error) {
+	switch {
+	case oid.Equal(oidNamedCurveP256):
+		return did.KeyTypeP256, nil
+	case oid.Equal(oidNamedCurveSecp256k1):
+		return did.KeyTypeSecp256k1, nil
+	default:
+		return "", fmt.Errorf("unsupported curve %s, must be P-256 or secp256k1", oid)
+	}
+}
+
+// pubKeyFromPoint builds a public key from a SEC1 encoded curve point
+func pubKeyFromPoint(keyType string, point []byte) (*did.PubKey, error) {
+	switch keyType {
+	case did.KeyTypeP256:
+		x, y := elliptic.Unmarshal(elliptic.P256(), point)
+		if x == nil {
+			return nil, fmt.Errorf("invalid P-256 public key")
+		}
+		return did.PubKeyFromCrypto(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y})
+	case did.KeyTypeSecp256k1:
+		pk, err := secec.NewPublicKey(point)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secp256k1 public key: %w", err)
+		}
+		return did.PubKeyFromCrypto(pk)
+	default:
+		return nil, fmt.Errorf("unsupported key type for ECDSA signing: %s", keyType)
+	}
+}
+
+// pubKeyFromSPKI parses an EC public key from a DER SubjectPublicKeyInfo.
+// x509 doesn't know secp256k1, so this does it by hand.
+func pubKeyFromSPKI(der []byte) (*did.PubKey, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if rest, err := asn1.Unmarshal(der, &spki); err != nil {
+		return nil, fmt.Errorf("parsing public key: %w", err)
+	} else if len(rest) > 0 {
+		return nil, fmt.Errorf("parsing public key: trailing data")
+	}
+
+	var curve asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(spki.Algorithm.Parameters.FullBytes, &curve); err != nil {
+		return nil, fmt.Errorf("public key isn't on a named curve: %w", err)
+	}
+	kt, err := keyTypeForCurve(curve)
+	if err != nil {
+		return nil, err
+	}
+	return pubKeyFromPoint(kt, spki.PublicKey.RightAlign())
+}
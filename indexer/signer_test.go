@@ -0,0 +1,233 @@
+package indexer
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	did "github.com/whyrusleeping/go-did"
+	"gitlab.com/yawning/secp256k1-voi/secec"
+)
+
+func TestSignAWSRequest(t *testing.T) {
+	// the get-vanilla case from the AWS Signature Version 4 test suite
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := &AWSCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	signAWSRequest(req, nil, creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Fatalf("wrong Authorization header:\n got %s\nwant %s", got, want)
+	}
+}
+
+// highS re-encodes a DER signature with its S replaced by n-S if it's low,
+// as a KMS is free to return
+func highS(t *testing.T, der []byte, n *big.Int) []byte {
+	var sig struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		t.Fatal(err)
+	}
+	if sig.S.Cmp(new(big.Int).Rsh(n, 1)) <= 0 {
+		sig.S = new(big.Int).Sub(n, sig.S)
+	}
+	out, err := asn1.Marshal(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// fakeKMS serves GetPublicKey and Sign for a single key
+func fakeKMS(t *testing.T, spki []byte, sign func(digest []byte) []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"MissingAuthenticationTokenException","message":"unsigned"}`))
+			return
+		}
+
+		var in struct {
+			KeyId       string
+			Message     []byte
+			MessageType string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			t.Error(err)
+		}
+		if in.KeyId != "test-key" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"NotFoundException","message":"no such key"}`))
+			return
+		}
+
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.GetPublicKey":
+			json.NewEncoder(w).Encode(map[string]any{"PublicKey": spki, "KeyUsage": "SIGN_VERIFY"})
+		case "TrentService.Sign":
+			if in.MessageType != "DIGEST" || len(in.Message) != 32 {
+				t.Errorf("unexpected sign request: %s, %d bytes", in.MessageType, len(in.Message))
+			}
+			json.NewEncoder(w).Encode(map[string]any{"Signature": sign(in.Message)})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+}
+
+func testKMSSigner(t *testing.T, srv *httptest.Server, keyType string, n *big.Int) {
+	ctx := context.Background()
+	s, err := NewKMSSigner(ctx, &KMSSignerOptions{
+		KeyID:       "test-key",
+		Region:      "us-east-1",
+		Endpoint:    srv.URL,
+		Credentials: &AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := s.PublicKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub.Type != keyType {
+		t.Fatalf("expected a %s key, got %s", keyType, pub.Type)
+	}
+
+	msg := []byte("hello relay")
+	sig, err := s.Sign(ctx, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sig) != 64 {
+		t.Fatalf("expected a 64 byte signature, got %d", len(sig))
+	}
+	if new(big.Int).SetBytes(sig[32:]).Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+		t.Fatal("signature has a high S")
+	}
+	if err := pub.Verify(msg, sig); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKMSSignerP256(t *testing.T) {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spki, err := x509.MarshalPKIXPublicKey(&sk.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := fakeKMS(t, spki, func(digest []byte) []byte {
+		der, err := ecdsa.SignASN1(rand.Reader, sk, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return highS(t, der, p256Order)
+	})
+	defer srv.Close()
+
+	testKMSSigner(t, srv, did.KeyTypeP256, p256Order)
+}
+
+func TestKMSSignerSecp256k1(t *testing.T) {
+	sk, err := secec.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	curve, err := asn1.Marshal(oidNamedCurveSecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	point := sk.PublicKey().Bytes()
+	spki, err := asn1.Marshal(struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1},
+			Parameters: asn1.RawValue{FullBytes: curve},
+		},
+		PublicKey: asn1.BitString{Bytes: point, BitLength: 8 * len(point)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := fakeKMS(t, spki, func(digest []byte) []byte {
+		der, err := sk.Sign(rand.Reader, digest, crypto.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return highS(t, der, k256Order)
+	})
+	defer srv.Close()
+
+	testKMSSigner(t, srv, did.KeyTypeSecp256k1, k256Order)
+}
+
+func TestKMSSignerErrors(t *testing.T) {
+	srv := fakeKMS(t, nil, nil)
+	defer srv.Close()
+
+	_, err := NewKMSSigner(context.Background(), &KMSSignerOptions{
+		KeyID:       "other-key",
+		Region:      "us-east-1",
+		Endpoint:    srv.URL,
+		Credentials: &AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "NotFoundException: no such key") {
+		t.Fatalf("expected the KMS error to be passed on, got %v", err)
+	}
+
+	if r := regionFromARN("arn:aws:kms:eu-west-1:111122223333:key/1234abcd"); r != "eu-west-1" {
+		t.Fatalf("wrong region from ARN: %q", r)
+	}
+}
+
+func TestKeyManagerLocalSigner(t *testing.T) {
+	ctx := context.Background()
+	k, err := did.GeneratePrivKey(rand.Reader, did.KeyTypeSecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	km := NewKeyManager(nil, k)
+	sig, err := km.SignForUser(ctx, "did:plc:test", []byte("msg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := km.SigningKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Verify([]byte("msg"), sig); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewKeyManager(nil, nil).SignForUser(ctx, "did:plc:test", []byte("msg")); err == nil {
+		t.Fatal("expected signing without a key to fail")
+	}
+}
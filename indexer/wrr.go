@@ -0,0 +1,47 @@
+package indexer
+
+// weightedRoundRobin picks between a fixed set of queues in proportion to
+// their weights using smooth weighted round robin, skipping empty queues.
+// It is not safe for concurrent use.
+type weightedRoundRobin struct {
+	weights []int
+	current []int
+}
+
+func newWeightedRoundRobin(weights []int) *weightedRoundRobin {
+	w := &weightedRoundRobin{
+		weights: make([]int, len(weights)),
+		current: make([]int, len(weights)),
+	}
+	w.setWeights(weights)
+	return w
+}
+
+// setWeights replaces the weights, clamping each to at least 1
+func (w *weightedRoundRobin) setWeights(weights []int) {
+	for i := range w.weights {
+		w.weights[i] = max(weights[i], 1)
+		w.current[i] = 0
+	}
+}
+
+// pick returns the index of the next queue to take from, or -1 if every
+// queue is empty
+func (w *weightedRoundRobin) pick(nonEmpty func(i int) bool) int {
+	total := 0
+	pick := -1
+	for i := range w.weights {
+		if !nonEmpty(i) {
+			continue
+		}
+		w.current[i] += w.weights[i]
+		total += w.weights[i]
+		if pick < 0 || w.current[i] > w.current[pick] {
+			pick = i
+		}
+	}
+	if pick >= 0 {
+		w.current[pick] -= total
+	}
+	return pick
+}
@@ -119,6 +119,38 @@ type PDS struct {
 
 	HourlyEventLimit int64
 	DailyEventLimit  int64
+
+	// Bytes of carstore data attributed to this host, and the limit past
+	// which the relay stops consuming its events; zero means no limit
+	StorageBytes int64
+	StorageQuota int64
+
+	// Repo limit tier; empty for hosts added before tiers existed, which
+	// are treated as new. Pinned tiers were set by an admin and aren't
+	// changed by automatic promotion.
+	Tier       string
+	TierPinned bool
+	// When the host was last blocked, paused, or had events rejected
+	LastIncidentAt *time.Time
+
+	// Set while the defederation policy has paused the host, which isn't
+	// consumed from until then. The policy leaves exempt hosts alone.
+	PausedUntil  *time.Time
+	PolicyExempt bool
+
+	// Set while a host admitted by spidering is trusted on probation; it
+	// drops back to the new tier once this passes
+	AutoTrustedUntil *time.Time
+}
+
+// OverStorageQuota reports whether the host has used up its storage quota
+func (p *PDS) OverStorageQuota() bool {
+	return p.StorageQuota > 0 && p.StorageBytes >= p.StorageQuota
+}
+
+// Paused reports whether the defederation policy has paused the host
+func (p *PDS) Paused() bool {
+	return p.PausedUntil != nil && time.Now().Before(*p.PausedUntil)
 }
 
 func ClientForPds(pds *PDS) *xrpc.Client {
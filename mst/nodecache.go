@@ -0,0 +1,124 @@
+package mst
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	blockformat "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+)
+
+// NodeCache holds decoded MST nodes by CID, so that trees read over and over
+// (consecutive commits to the same repo) don't fetch and decode the same
+// interior nodes each time. Nodes are content addressed, so cached nodes are
+// never stale. A NodeCache is safe for concurrent use.
+type NodeCache struct {
+	nodes *lru.Cache[cid.Cid, *nodeData]
+
+	hits, misses atomic.Int64
+}
+
+// NewNodeCache returns a cache holding up to size nodes
+func NewNodeCache(size int) *NodeCache {
+	nodes, err := lru.New[cid.Cid, *nodeData](size)
+	if err != nil {
+		panic(err) // only for a size < 1
+	}
+	return &NodeCache{nodes: nodes}
+}
+
+// Len reports the number of nodes in the cache
+func (nc *NodeCache) Len() int {
+	return nc.nodes.Len()
+}
+
+// Stats reports the lookups that found a node and those that didn't
+func (nc *NodeCache) Stats() (hits, misses int64) {
+	return nc.hits.Load(), nc.misses.Load()
+}
+
+func (nc *NodeCache) get(c cid.Cid) (*nodeData, bool) {
+	nd, ok := nc.nodes.Get(c)
+	if ok {
+		nc.hits.Add(1)
+	} else {
+		nc.misses.Add(1)
+	}
+	return nd, ok
+}
+
+// AddBlock caches blk if it is an MST node, reporting whether it was
+func (nc *NodeCache) AddBlock(blk blockformat.Block) bool {
+	if blk.Cid().Prefix().Codec != cid.DagCBOR {
+		return false
+	}
+
+	// the generated decoder skips fields it doesn't know, so records can
+	// decode as nodes; only take blocks that encode back to the same bytes
+	var nd nodeData
+	if err := nd.UnmarshalCBOR(bytes.NewReader(blk.RawData())); err != nil {
+		return false
+	}
+	buf := new(bytes.Buffer)
+	if err := nd.MarshalCBOR(buf); err != nil || !bytes.Equal(buf.Bytes(), blk.RawData()) {
+		return false
+	}
+
+	nc.nodes.Add(blk.Cid(), &nd)
+	return true
+}
+
+// Links returns the CIDs a cached node points to: its left subtree, and the
+// value and right subtree of each entry
+func (nc *NodeCache) Links(c cid.Cid) ([]cid.Cid, bool) {
+	nd, ok := nc.get(c)
+	if !ok {
+		return nil, false
+	}
+
+	links := make([]cid.Cid, 0, 2*len(nd.Entries)+1)
+	if nd.Left != nil {
+		links = append(links, *nd.Left)
+	}
+	for _, e := range nd.Entries {
+		links = append(links, e.Val)
+		if e.Tree != nil {
+			links = append(links, *e.Tree)
+		}
+	}
+	return links, true
+}
+
+// Store wraps cst so that MSTs loaded from it read their nodes through the
+// cache
+func (nc *NodeCache) Store(cst cbor.IpldStore) cbor.IpldStore {
+	return &cachedNodeStore{IpldStore: cst, nc: nc}
+}
+
+type cachedNodeStore struct {
+	cbor.IpldStore
+	nc *NodeCache
+}
+
+func (s *cachedNodeStore) Get(ctx context.Context, c cid.Cid, out interface{}) error {
+	nd, ok := out.(*nodeData)
+	if !ok {
+		return s.IpldStore.Get(ctx, c, out)
+	}
+
+	if cached, ok := s.nc.get(c); ok {
+		// decoded nodes are only read from, so sharing the entries is fine
+		*nd = *cached
+		return nil
+	}
+
+	if err := s.IpldStore.Get(ctx, c, nd); err != nil {
+		return err
+	}
+	cp := *nd
+	s.nc.nodes.Add(c, &cp)
+	return nil
+}
@@ -0,0 +1,82 @@
+package mst
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/bluesky-social/indigo/util"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	mh "github.com/multiformats/go-multihash"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+func TestNodeCache(t *testing.T) {
+	ctx := context.TODO()
+
+	vals := make(map[string]cid.Cid)
+	for i := int64(0); i < 500; i++ {
+		vals[randKey(i)] = randCid()
+	}
+	bs := memBs()
+	root := mustCidTree(t, cidMapToMst(t, bs, vals))
+
+	nc := NewNodeCache(10_000)
+
+	// a record isn't a node, even though it decodes as one
+	rec, err := cbor.WrapObject(map[string]any{"$type": "app.bsky.feed.post", "text": "hello"}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nc.AddBlock(rec) {
+		t.Fatal("record was cached as a node")
+	}
+
+	keys, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := range keys {
+		// the blockstore lists keys as raw blocks
+		k = cid.NewCidV1(cid.DagCBOR, k.Hash())
+		raw, err := bs.Get(ctx, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blk, err := blocks.NewBlockWithCid(raw.RawData(), k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !nc.AddBlock(blk) {
+			t.Fatalf("node %s wasn't cached", k)
+		}
+
+		var scanned []cid.Cid
+		if err := cbg.ScanForLinks(bytes.NewReader(blk.RawData()), func(c cid.Cid) {
+			scanned = append(scanned, c)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		links, ok := nc.Links(k)
+		if !ok {
+			t.Fatalf("no links for %s", k)
+		}
+		if len(links) != len(scanned) {
+			t.Fatalf("node %s has %d links, scanning found %d", k, len(links), len(scanned))
+		}
+	}
+
+	// every node is cached, so the tree reads without its blockstore
+	cst := nc.Store(util.CborStore(memBs()))
+	assertValues(t, LoadMST(cst, root), vals)
+
+	hits, misses := nc.Stats()
+	if hits == 0 {
+		t.Fatal("no cache hits")
+	}
+	if misses != 0 {
+		t.Fatalf("expected no misses walking the tree, got %d", misses)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"database/sql"
 	"fmt"
 	"io"
+	"net"
+	"net/url"
 
 	comatprototypes "github.com/bluesky-social/indigo/api/atproto"
 	lexutil "github.com/bluesky-social/indigo/lex/util"
@@ -219,8 +221,18 @@ func (s *Server) handleComAtprotoRepoPutRecord(ctx context.Context, input *comat
 }
 
 func (s *Server) handleComAtprotoServerDescribeServer(ctx context.Context) (*comatprototypes.ServerDescribeServer_Output, error) {
+	// the service url may or may not have a scheme
+	host := s.serviceUrl
+	if u, err := url.Parse(host); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
 	invcode := false
 	return &comatprototypes.ServerDescribeServer_Output{
+		Did:                "did:web:" + host,
 		InviteCodeRequired: &invcode,
 		AvailableUserDomains: []string{
 			s.handleSuffix,
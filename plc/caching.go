@@ -2,6 +2,8 @@ package plc
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/bluesky-social/indigo/did"
@@ -14,6 +16,20 @@ type CachingDidResolver struct {
 	res    did.Resolver
 	maxAge time.Duration
 	cache  *arc.ARCCache[string, *cachedDoc]
+
+	// lookups underway, which callers wanting the same DID wait on rather
+	// than looking it up again
+	lk       sync.Mutex
+	inflight map[string]*inflightLookup
+}
+
+type inflightLookup struct {
+	done chan struct{}
+	doc  *did.Document
+	err  error
+	// set if the DID's cache entry was flushed during the lookup, which
+	// might then have got the document from before whatever prompted that
+	flushed bool
 }
 
 type cachedDoc struct {
@@ -28,14 +44,23 @@ func NewCachingDidResolver(res did.Resolver, maxAge time.Duration, size int) *Ca
 	}
 
 	return &CachingDidResolver{
-		res:    res,
-		cache:  c,
-		maxAge: maxAge,
+		res:      res,
+		cache:    c,
+		maxAge:   maxAge,
+		inflight: make(map[string]*inflightLookup),
 	}
 }
 
 func (r *CachingDidResolver) FlushCacheFor(didstr string) {
 	r.cache.Remove(didstr)
+
+	// later callers shouldn't get what a lookup already underway finds
+	r.lk.Lock()
+	if call, ok := r.inflight[didstr]; ok {
+		call.flushed = true
+		delete(r.inflight, didstr)
+	}
+	r.lk.Unlock()
 }
 
 func (r *CachingDidResolver) tryCache(did string) (*did.Document, bool) {
@@ -71,11 +96,104 @@ func (r *CachingDidResolver) GetDocument(ctx context.Context, didstr string) (*d
 	cacheMissesTotal.Inc()
 	span.SetAttributes(attribute.Bool("cache", false))
 
+	call, owner := r.startLookup(didstr)
+	if !owner {
+		span.SetAttributes(attribute.Bool("deduped", true))
+		return r.wait(ctx, call)
+	}
+
 	doc, err := r.res.GetDocument(ctx, didstr)
-	if err != nil {
-		return nil, err
+	r.finishLookup(didstr, call, doc, err)
+	return doc, err
+}
+
+// ResolveDIDs resolves dids from the cache where it can, and the rest with
+// one batch from the underlying resolver. DIDs already being looked up wait
+// for those lookups instead.
+func (r *CachingDidResolver) ResolveDIDs(ctx context.Context, dids []string) map[string]did.DIDResult {
+	ctx, span := otel.Tracer("cacheResolver").Start(ctx, "resolveDids")
+	defer span.End()
+
+	out := make(map[string]did.DIDResult, len(dids))
+	owned := make(map[string]*inflightLookup)
+	waiting := make(map[string]*inflightLookup)
+	var toFetch []string
+	for _, d := range did.Dedupe(dids) {
+		if doc, ok := r.tryCache(d); ok {
+			cacheHitsTotal.Inc()
+			out[d] = did.DIDResult{Doc: doc}
+			continue
+		}
+		cacheMissesTotal.Inc()
+
+		call, owner := r.startLookup(d)
+		if owner {
+			owned[d] = call
+			toFetch = append(toFetch, d)
+		} else {
+			waiting[d] = call
+		}
+	}
+	span.SetAttributes(
+		attribute.Int("dids", len(dids)),
+		attribute.Int("fetched", len(toFetch)),
+		attribute.Int("deduped", len(waiting)),
+	)
+
+	if len(toFetch) > 0 {
+		found := did.ResolveDIDs(ctx, r.res, toFetch)
+		for _, d := range toFetch {
+			res, ok := found[d]
+			if !ok {
+				res.Err = fmt.Errorf("resolver returned nothing for %s", d)
+			}
+			r.finishLookup(d, owned[d], res.Doc, res.Err)
+			out[d] = res
+		}
+	}
+
+	for d, call := range waiting {
+		doc, err := r.wait(ctx, call)
+		out[d] = did.DIDResult{Doc: doc, Err: err}
+	}
+	return out
+}
+
+// startLookup returns the lookup underway for didstr, or starts one, in which
+// case the caller owns it and must finish it
+func (r *CachingDidResolver) startLookup(didstr string) (*inflightLookup, bool) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if call, ok := r.inflight[didstr]; ok {
+		dedupedLookupsTotal.Inc()
+		return call, false
 	}
+	call := &inflightLookup{done: make(chan struct{})}
+	r.inflight[didstr] = call
+	return call, true
+}
+
+func (r *CachingDidResolver) finishLookup(didstr string, call *inflightLookup, doc *did.Document, err error) {
+	r.lk.Lock()
+	call.doc, call.err = doc, err
+	if r.inflight[didstr] == call {
+		delete(r.inflight, didstr)
+	}
+	flushed := call.flushed
+	r.lk.Unlock()
+	close(call.done)
 
-	r.putCache(didstr, doc)
-	return doc, nil
+	if err == nil && !flushed {
+		r.putCache(didstr, doc)
+	}
+}
+
+func (r *CachingDidResolver) wait(ctx context.Context, call *inflightLookup) (*did.Document, error) {
+	select {
+	case <-call.done:
+		return call.doc, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
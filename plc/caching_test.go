@@ -0,0 +1,63 @@
+package plc
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/did"
+)
+
+type slowResolver struct {
+	calls   atomic.Int64
+	release chan struct{}
+}
+
+func (r *slowResolver) GetDocument(ctx context.Context, didstr string) (*did.Document, error) {
+	r.calls.Add(1)
+	<-r.release
+	return &did.Document{}, nil
+}
+
+func (r *slowResolver) FlushCacheFor(didstr string) {}
+
+func TestCachingResolverDedupesLookups(t *testing.T) {
+	res := &slowResolver{release: make(chan struct{})}
+	cr := NewCachingDidResolver(res, time.Hour, 100)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cr.GetDocument(ctx, "did:plc:abc"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	// let the goroutines find the lookup underway before it finishes
+	time.Sleep(50 * time.Millisecond)
+	close(res.release)
+	wg.Wait()
+
+	if n := res.calls.Load(); n != 1 {
+		t.Fatalf("expected one lookup, got %d", n)
+	}
+
+	out := cr.ResolveDIDs(ctx, []string{"did:plc:abc", "did:plc:def", "did:plc:def"})
+	if len(out) != 2 {
+		t.Fatalf("expected two results, got %d", len(out))
+	}
+	for d, r := range out {
+		if r.Err != nil || r.Doc == nil {
+			t.Fatalf("bad result for %s: %v", d, r.Err)
+		}
+	}
+	if n := res.calls.Load(); n != 2 {
+		t.Fatalf("expected only did:plc:def to be looked up, got %d lookups", n)
+	}
+}
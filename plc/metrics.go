@@ -14,3 +14,8 @@ var cacheMissesTotal = promauto.NewCounter(prometheus.CounterOpts{
 	Name: "plc_cache_misses_total",
 	Help: "Total number of cache misses",
 })
+
+var dedupedLookupsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "plc_deduped_lookups_total",
+	Help: "Total number of DID lookups that waited on the same lookup already underway",
+})
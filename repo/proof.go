@@ -0,0 +1,81 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bluesky-social/indigo/mst"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipld/go-car/v2"
+)
+
+// ErrIncompleteProof is returned by VerifyRecordProof when the proof doesn't
+// have every block on the record's path
+var ErrIncompleteProof = errors.New("proof is missing blocks")
+
+// VerifyRecordProof checks a record proof, as served by
+// com.atproto.sync.getRecord, against the commit it's rooted at. It returns
+// the commit and the CID of the record at rpath ("collection/rkey"), or
+// cid.Undef if the proof shows there's no such record.
+//
+// Every block is checked against its CID, so the record and its absence are
+// only as trustworthy as the commit: callers must check the commit is signed
+// by the repo's key, and is for the repo they asked about.
+func VerifyRecordProof(ctx context.Context, r io.Reader, rpath string) (*SignedCommit, cid.Cid, error) {
+	br, err := car.NewBlockReader(r)
+	if err != nil {
+		return nil, cid.Undef, fmt.Errorf("reading proof: %w", err)
+	}
+	if len(br.Roots) != 1 {
+		return nil, cid.Undef, fmt.Errorf("proof must have one root, has %d", len(br.Roots))
+	}
+
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	for {
+		blk, err := br.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, cid.Undef, fmt.Errorf("reading proof: %w", err)
+		}
+
+		// the block reader trusts the CIDs it's given
+		check, err := blk.Cid().Prefix().Sum(blk.RawData())
+		if err != nil {
+			return nil, cid.Undef, err
+		}
+		if !check.Equals(blk.Cid()) {
+			return nil, cid.Undef, fmt.Errorf("proof block %s doesn't match its CID", blk.Cid())
+		}
+
+		if err := bs.Put(ctx, blk); err != nil {
+			return nil, cid.Undef, err
+		}
+	}
+
+	rp, err := OpenRepo(ctx, bs, br.Roots[0])
+	if err != nil {
+		if ipld.IsNotFound(err) {
+			return nil, cid.Undef, ErrIncompleteProof
+		}
+		return nil, cid.Undef, err
+	}
+	sc := rp.SignedCommit()
+
+	rc, _, err := rp.GetRecordBytes(ctx, rpath)
+	switch {
+	case errors.Is(err, mst.ErrNotFound):
+		return &sc, cid.Undef, nil
+	case ipld.IsNotFound(err):
+		return nil, cid.Undef, ErrIncompleteProof
+	case err != nil:
+		return nil, cid.Undef, err
+	}
+	return &sc, rc, nil
+}
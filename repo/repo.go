@@ -148,6 +148,13 @@ func OpenRepo(ctx context.Context, bs blockstore.Blockstore, root cid.Cid) (*Rep
 	}, nil
 }
 
+// UseNodeCache reads the repo's MST nodes through nc. Call it before
+// reading from or writing to the repo.
+func (r *Repo) UseNodeCache(nc *mst.NodeCache) {
+	r.cst = nc.Store(r.cst)
+	r.mst = nil
+}
+
 type CborMarshaler interface {
 	MarshalCBOR(w io.Writer) error
 }
@@ -1,12 +1,23 @@
 package repo
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"testing"
 
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/mst"
+	"github.com/bluesky-social/indigo/util"
+	blocks "github.com/ipfs/go-block-format"
 	cid "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	car "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
 )
 
 func TestRepo(t *testing.T) {
@@ -30,3 +41,83 @@ func TestRepo(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestVerifyRecordProof(t *testing.T) {
+	ctx := context.Background()
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+
+	r := NewRepo(ctx, "did:plc:proofs", bs)
+	var rpaths []string
+	for i := 0; i < 50; i++ {
+		_, rkey, err := r.CreateRecord(ctx, "app.bsky.feed.post", &bsky.FeedPost{Text: fmt.Sprintf("post %d", i), CreatedAt: "2024-01-01T00:00:00Z"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rpaths = append(rpaths, "app.bsky.feed.post/"+rkey)
+	}
+	head, _, err := r.Commit(ctx, func(context.Context, string, []byte) ([]byte, error) { return []byte("sig"), nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// proofs are the blocks read looking the record up, as the relay
+	// builds them
+	prove := func(rpath string) []blocks.Block {
+		lbs := util.NewLoggingBstore(bs)
+		pr, err := OpenRepo(ctx, lbs, head)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := pr.GetRecordBytes(ctx, rpath); err != nil && !errors.Is(err, mst.ErrNotFound) {
+			t.Fatal(err)
+		}
+		return lbs.GetLoggedBlocks()
+	}
+	writeCar := func(blks []blocks.Block) *bytes.Buffer {
+		buf := new(bytes.Buffer)
+		hb, err := cbor.DumpObject(&car.CarHeader{Roots: []cid.Cid{head}, Version: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := carutil.LdWrite(buf, hb); err != nil {
+			t.Fatal(err)
+		}
+		for _, blk := range blks {
+			if err := carutil.LdWrite(buf, blk.Cid().Bytes(), blk.RawData()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return buf
+	}
+
+	want, _, err := r.GetRecordBytes(ctx, rpaths[17])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, got, err := VerifyRecordProof(ctx, writeCar(prove(rpaths[17])), rpaths[17])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want || sc.Did != "did:plc:proofs" {
+		t.Fatalf("proof gave record %s in %s, expected %s", got, sc.Did, want)
+	}
+
+	// sorts between two records that exist
+	absent := rpaths[17] + "a"
+	if _, got, err := VerifyRecordProof(ctx, writeCar(prove(absent)), absent); err != nil || got.Defined() {
+		t.Fatalf("expected proof of absence, got %s, %v", got, err)
+	}
+
+	// the record is the last block read; without it the proof shows the
+	// record's CID but not its contents
+	blks := prove(rpaths[17])
+	if _, _, err := VerifyRecordProof(ctx, writeCar(blks[:len(blks)-1]), rpaths[17]); !errors.Is(err, ErrIncompleteProof) {
+		t.Fatalf("expected incomplete proof without the record, got %v", err)
+	}
+
+	forged, _ := blocks.NewBlockWithCid([]byte("not the record"), want)
+	blks = append(blks[:len(blks)-1], forged)
+	if _, _, err := VerifyRecordProof(ctx, writeCar(blks), rpaths[17]); err == nil {
+		t.Fatal("accepted a proof with a forged record")
+	}
+}
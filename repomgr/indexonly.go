@@ -0,0 +1,280 @@
+package repomgr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/carstore"
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/repo"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	car "github.com/ipld/go-car"
+	"go.opentelemetry.io/otel"
+)
+
+// IndexOnly reports whether the repo manager is backed by an
+// carstore.IndexOnlyCarStore, so validates commits without keeping repo data
+func (rm *RepoManager) IndexOnly() bool {
+	return rm.heads != nil
+}
+
+// loadCar reads a CAR file into memory, returning its root
+func loadCar(ctx context.Context, r io.Reader) (cid.Cid, blockstore.Blockstore, error) {
+	carr, err := car.NewCarReader(r)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+
+	if len(carr.Header.Roots) != 1 {
+		return cid.Undef, nil, fmt.Errorf("invalid car file, header must have a single root (has %d)", len(carr.Header.Roots))
+	}
+
+	membs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	for {
+		blk, err := carr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return cid.Undef, nil, err
+		}
+
+		if err := membs.Put(ctx, blk); err != nil {
+			return cid.Undef, nil, err
+		}
+	}
+
+	return carr.Header.Roots[0], membs, nil
+}
+
+// handleExternalUserEventIndexOnly checks a commit follows on from the repo's
+// last one, is signed by the repo's key and carries the blocks of the records
+// it writes, then records it as the repo's head and passes on the slice as
+// received. Without the previous tree the ops can't be checked against the
+// MST diff.
+func (rm *RepoManager) handleExternalUserEventIndexOnly(ctx context.Context, pdsid uint, uid models.Uid, did string, since *string, nrev string, carslice []byte, ops []*atproto.SyncSubscribeRepos_RepoOp) error {
+	pt := newPhaseTimer("external")
+
+	currev, err := rm.heads.GetUserRepoRev(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if since != nil && *since != currev {
+		return fmt.Errorf("revision mismatch: %s != %s: %w", *since, currev, carstore.ErrRepoBaseMismatch)
+	}
+
+	root, bs, err := loadCar(ctx, bytes.NewReader(carslice))
+	if err != nil {
+		return fmt.Errorf("reading external carslice: %w", err)
+	}
+
+	r, err := repo.OpenRepo(ctx, bs, root)
+	if err != nil {
+		return fmt.Errorf("opening external user repo (%d, root=%s): %w", uid, root, err)
+	}
+	pt.Mark(phaseCarDecode)
+
+	if r.SignedCommit().Rev != nrev {
+		return fmt.Errorf("commit rev %s does not match event rev %s", r.SignedCommit().Rev, nrev)
+	}
+
+	if !rm.skipExternalSigCheck {
+		if err := rm.CheckRepoSig(ctx, r, did); err != nil {
+			return err
+		}
+		pt.Mark(phaseSigCheck)
+	}
+
+	evtops := make([]RepoOp, 0, len(ops))
+	for _, op := range ops {
+		parts := strings.SplitN(op.Path, "/", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid rpath in mst diff, must have collection and rkey")
+		}
+
+		switch kind := EventKind(op.Action); kind {
+		case EvtKindCreateRecord, EvtKindUpdateRecord:
+			if op.Cid == nil {
+				return fmt.Errorf("%s op for %s has no cid", kind, op.Path)
+			}
+			rc := cid.Cid(*op.Cid)
+			has, err := bs.Has(ctx, rc)
+			if err != nil {
+				return err
+			}
+			if !has {
+				return fmt.Errorf("record %s missing from car slice: %w", op.Path, ipld.ErrNotFound{Cid: rc})
+			}
+
+			rop := RepoOp{
+				Kind:       kind,
+				Collection: parts[0],
+				Rkey:       parts[1],
+				RecCid:     &rc,
+			}
+
+			if rm.hydrateRecords {
+				_, rec, err := r.GetRecord(ctx, op.Path)
+				if err != nil {
+					return fmt.Errorf("reading changed record from car slice: %w", err)
+				}
+				rop.Record = rec
+			}
+
+			evtops = append(evtops, rop)
+		case EvtKindDeleteRecord:
+			evtops = append(evtops, RepoOp{
+				Kind:       EvtKindDeleteRecord,
+				Collection: parts[0],
+				Rkey:       parts[1],
+			})
+		default:
+			return fmt.Errorf("unrecognized external user event kind: %q", op.Action)
+		}
+	}
+	pt.Mark(phaseMstWalk)
+
+	if err := rm.heads.PutUserHead(ctx, uid, root, nrev); err != nil {
+		return fmt.Errorf("recording repo head: %w", err)
+	}
+	pt.Mark(phaseBlockWrite)
+
+	if rm.events != nil {
+		rm.events(ctx, &RepoEvent{
+			User:      uid,
+			NewRoot:   root,
+			Rev:       nrev,
+			Since:     since,
+			Ops:       evtops,
+			RepoSlice: carslice,
+			PDS:       pdsid,
+		})
+		pt.Mark(phaseEventEmit)
+	}
+
+	return nil
+}
+
+// importRepoIndexOnly checks and records the head of a fetched repo. With no
+// previous copy to diff against, the event emitted is flagged TooBig; the ops
+// list every record in the repo when it's a full fetch, and are empty for a
+// partial one. Archives are imported as for ImportRepoArchive, emitting a
+// Sync event.
+func (rm *RepoManager) importRepoIndexOnly(ctx context.Context, user models.Uid, repoDid string, r io.Reader, rev *string, archive, force bool) (string, error) {
+	ctx, span := otel.Tracer("repoman").Start(ctx, "importRepoIndexOnly")
+	defer span.End()
+
+	currev, err := rm.heads.GetUserRepoRev(ctx, user)
+	if err != nil {
+		return "", err
+	}
+	if rev != nil && *rev != currev {
+		return "", fmt.Errorf("ImportNewRepo called with incorrect base")
+	}
+
+	pt := newPhaseTimer("import")
+
+	root, bs, err := loadCar(ctx, r)
+	if err != nil {
+		return "", err
+	}
+	nr, err := repo.OpenRepo(ctx, bs, root)
+	if err != nil {
+		return "", fmt.Errorf("opening new repo: %w", err)
+	}
+	pt.Mark(phaseCarDecode)
+
+	scom := nr.SignedCommit()
+	if scom.Did != repoDid {
+		return "", fmt.Errorf("repo is for %s, not %s", scom.Did, repoDid)
+	}
+	if rev != nil && currev != "" && scom.Rev < currev {
+		return "", fmt.Errorf("%w: fetched %s, have %s", ErrRevRegressed, scom.Rev, currev)
+	}
+	if archive && currev != "" && scom.Rev <= currev && !force {
+		return "", fmt.Errorf("%w: archive has %s, have %s", ErrRepoNotNewer, scom.Rev, currev)
+	}
+
+	usc := scom.Unsigned()
+	sb, err := usc.BytesForSigning()
+	if err != nil {
+		return "", fmt.Errorf("commit serialization failed: %w", err)
+	}
+	if err := rm.kmgr.VerifyUserSignature(ctx, repoDid, scom.Sig, sb); err != nil {
+		return "", fmt.Errorf("new user signature check failed: %w", err)
+	}
+	pt.Mark(phaseSigCheck)
+
+	var ops []RepoOp
+	if rev == nil || currev == "" {
+		diffops, err := nr.DiffSince(ctx, cid.Undef)
+		if err != nil {
+			return "", fmt.Errorf("walking repo: %w", err)
+		}
+		ops = make([]RepoOp, 0, len(diffops))
+		for _, op := range diffops {
+			repoOpsImported.Inc()
+			out, err := processOp(ctx, bs, op, rm.hydrateRecords)
+			if err != nil {
+				log.Errorw("failed to process repo op", "err", err, "path", op.Rpath, "repo", repoDid)
+			}
+			if out != nil {
+				ops = append(ops, *out)
+			}
+		}
+	}
+	pt.Mark(phaseMstWalk)
+
+	if err := rm.heads.PutUserHead(ctx, user, root, scom.Rev); err != nil {
+		return "", fmt.Errorf("recording repo head: %w", err)
+	}
+	pt.Mark(phaseBlockWrite)
+
+	if rm.events != nil {
+		evt := &RepoEvent{
+			User:    user,
+			NewRoot: root,
+			Rev:     scom.Rev,
+			Since:   &currev,
+			Ops:     ops,
+			TooBig:  true,
+		}
+		if archive {
+			evt.Since = nil
+			evt.TooBig = false
+			evt.Sync = true
+			evt.RepoSlice, err = commitCar(ctx, bs, root)
+			if err != nil {
+				return "", err
+			}
+		}
+		rm.events(ctx, evt)
+		pt.Mark(phaseEventEmit)
+	}
+
+	return scom.Rev, nil
+}
+
+// commitCar returns a CAR holding just the commit block
+func commitCar(ctx context.Context, bs blockstore.Blockstore, root cid.Cid) ([]byte, error) {
+	commit, err := bs.Get(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if _, err := carstore.WriteCarHeader(buf, root); err != nil {
+		return nil, err
+	}
+	if _, err := carstore.LdWrite(buf, root.Bytes(), commit.RawData()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
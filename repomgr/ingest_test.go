@@ -3,7 +3,10 @@ package repomgr
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"os"
 	"path/filepath"
 	"strings"
@@ -12,10 +15,12 @@ import (
 	atproto "github.com/bluesky-social/indigo/api/atproto"
 	bsky "github.com/bluesky-social/indigo/api/bsky"
 	"github.com/bluesky-social/indigo/carstore"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
 	"github.com/bluesky-social/indigo/models"
 	"github.com/bluesky-social/indigo/repo"
 	"github.com/bluesky-social/indigo/util"
 	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -235,3 +240,383 @@ func TestDuplicateRecord(t *testing.T) {
 	_ = c
 	_ = rec
 }
+
+func TestResetRepo(t *testing.T) {
+	dir, err := os.MkdirTemp("", "integtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	did := "did:plc:beepboop"
+	cs := testCarstore(t, dir)
+	repoman := NewRepoManager(cs, &util.FakeKeyManager{})
+
+	var evts []*RepoEvent
+	repoman.SetEventHandler(func(ctx context.Context, evt *RepoEvent) {
+		evts = append(evts, evt)
+	}, false)
+
+	dir2, err := os.MkdirTemp("", "integtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs2 := testCarstore(t, dir2)
+
+	ctx := context.TODO()
+	readCar := func() []byte {
+		buf := new(bytes.Buffer)
+		if err := cs2.ReadUserCar(ctx, 1, "", true, buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	var since *string
+	for i := 0; i < 2; i++ {
+		_, _, nrev, _ := doPost(t, cs2, did, since, i)
+		since = &nrev
+	}
+	oldCar := readCar()
+
+	for i := 2; i < 4; i++ {
+		_, _, nrev, _ := doPost(t, cs2, did, since, i)
+		since = &nrev
+	}
+
+	if err := repoman.ImportNewRepo(ctx, 1, did, bytes.NewReader(readCar()), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// upstream goes back to its older state
+	rev, err := cs.GetUserRepoRev(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repoman.ImportNewRepo(ctx, 1, did, bytes.NewReader(oldCar), &rev)
+	if !errors.Is(err, ErrRevRegressed) {
+		t.Fatalf("expected ErrRevRegressed, got %v", err)
+	}
+
+	if err := repoman.ResetRepo(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	empty := ""
+	if err := repoman.ImportNewRepo(ctx, 1, did, bytes.NewReader(oldCar), &empty); err != nil {
+		t.Fatal(err)
+	}
+	if last := evts[len(evts)-1]; !last.TooBig {
+		t.Fatal("expected import after reset to be flagged TooBig")
+	}
+
+	// only the first import after a reset is flagged
+	rev, err = cs.GetUserRepoRev(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, _ = doPost(t, cs2, did, since, 4)
+	if err := repoman.ImportNewRepo(ctx, 1, did, bytes.NewReader(readCar()), &rev); err != nil {
+		t.Fatal(err)
+	}
+	if last := evts[len(evts)-1]; last.TooBig {
+		t.Fatal("expected later imports not to be flagged TooBig")
+	}
+}
+
+func TestImportRepoArchive(t *testing.T) {
+	dir, err := os.MkdirTemp("", "integtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	did := "did:plc:beepboop"
+	cs := testCarstore(t, dir)
+	repoman := NewRepoManager(cs, &util.FakeKeyManager{})
+
+	var evts []*RepoEvent
+	repoman.SetEventHandler(func(ctx context.Context, evt *RepoEvent) {
+		evts = append(evts, evt)
+	}, false)
+
+	dir2, err := os.MkdirTemp("", "integtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs2 := testCarstore(t, dir2)
+
+	ctx := context.TODO()
+	readCar := func() []byte {
+		buf := new(bytes.Buffer)
+		if err := cs2.ReadUserCar(ctx, 1, "", true, buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	_, _, oldrev, oldtid := doPost(t, cs2, did, nil, 0)
+	oldCar := readCar()
+	_, _, newrev, newtid := doPost(t, cs2, did, &oldrev, 1)
+	newCar := readCar()
+
+	if _, err := repoman.ImportRepoArchive(ctx, 1, "did:plc:someoneelse", bytes.NewReader(newCar), false); err == nil {
+		t.Fatal("expected archive for another did to be refused")
+	}
+
+	rev, err := repoman.ImportRepoArchive(ctx, 1, did, bytes.NewReader(newCar), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev != newrev {
+		t.Fatalf("expected rev %s, got %s", newrev, rev)
+	}
+
+	last := evts[len(evts)-1]
+	if !last.Sync || len(last.Ops) != 1 || last.Ops[0].Rkey != newtid {
+		t.Fatalf("expected sync event listing the repo's record, got sync=%v ops=%v", last.Sync, last.Ops)
+	}
+	cr, err := car.NewCarReader(bytes.NewReader(last.RepoSlice))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk, err := cr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blk.Cid() != last.NewRoot || cr.Header.Roots[0] != last.NewRoot {
+		t.Fatal("expected sync event to carry the commit block")
+	}
+	if _, err := cr.Next(); err != io.EOF {
+		t.Fatalf("expected sync event to carry only the commit block, got %v", err)
+	}
+
+	_, err = repoman.ImportRepoArchive(ctx, 1, did, bytes.NewReader(oldCar), false)
+	if !errors.Is(err, ErrRepoNotNewer) {
+		t.Fatalf("expected ErrRepoNotNewer, got %v", err)
+	}
+
+	// forcing an older archive replaces the repo, dropping the newer record
+	if _, err := repoman.ImportRepoArchive(ctx, 1, did, bytes.NewReader(oldCar), true); err != nil {
+		t.Fatal(err)
+	}
+	head, err := cs.GetUserRepoHead(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ses, err := cs.ReadOnlySession(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := repo.OpenRepo(ctx, ses, head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	if err := r.ForEach(ctx, "", func(k string, _ cid.Cid) error {
+		keys = append(keys, k)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "app.bsky.feed.post/"+oldtid {
+		t.Fatalf("expected only the old record after forced import, got %v", keys)
+	}
+}
+
+func TestIndexOnlyIngest(t *testing.T) {
+	dir, err := os.MkdirTemp("", "integtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headdb, err := gorm.Open(sqlite.Open(filepath.Join(dir, "heads.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := carstore.NewIndexOnlyCarStore(headdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	did := "did:plc:beepboop"
+	repoman := NewRepoManager(cs, &util.FakeKeyManager{})
+	if !repoman.IndexOnly() {
+		t.Fatal("expected repo manager to be index-only")
+	}
+
+	var evts []*RepoEvent
+	repoman.SetEventHandler(func(ctx context.Context, evt *RepoEvent) {
+		evts = append(evts, evt)
+	}, false)
+
+	dir2, err := os.MkdirTemp("", "integtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs2 := testCarstore(t, dir2)
+
+	ctx := context.TODO()
+	createOp := func(slice []byte, tid string) *atproto.SyncSubscribeRepos_RepoOp {
+		r, err := repo.ReadRepoFromCar(ctx, bytes.NewReader(slice))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, _, err := r.GetRecord(ctx, "app.bsky.feed.post/"+tid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lc := lexutil.LexLink(rc)
+		return &atproto.SyncSubscribeRepos_RepoOp{
+			Action: "create",
+			Path:   "app.bsky.feed.post/" + tid,
+			Cid:    &lc,
+		}
+	}
+
+	var since *string
+	for i := 0; i < 3; i++ {
+		slice, root, nrev, tid := doPost(t, cs2, did, since, i)
+		ops := []*atproto.SyncSubscribeRepos_RepoOp{createOp(slice, tid)}
+
+		if err := repoman.HandleExternalUserEvent(ctx, 1, 1, did, since, nrev, slice, ops); err != nil {
+			t.Fatal(err)
+		}
+
+		last := evts[len(evts)-1]
+		if last.NewRoot != root || last.Rev != nrev || !bytes.Equal(last.RepoSlice, slice) || len(last.Ops) != 1 {
+			t.Fatalf("expected event passing on commit %s, got %+v", nrev, last)
+		}
+		since = &nrev
+	}
+
+	rev, err := repoman.GetRepoRev(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev != *since {
+		t.Fatalf("expected head rev %s, got %s", *since, rev)
+	}
+
+	// a commit that doesn't follow on from the head is refused
+	stale := "2222222222222"
+	slice, _, nrev, tid := doPost(t, cs2, did, since, 3)
+	err = repoman.HandleExternalUserEvent(ctx, 1, 1, did, &stale, nrev, slice, []*atproto.SyncSubscribeRepos_RepoOp{createOp(slice, tid)})
+	if !errors.Is(err, carstore.ErrRepoBaseMismatch) {
+		t.Fatalf("expected ErrRepoBaseMismatch, got %v", err)
+	}
+
+	// as is one missing the blocks of the records it writes
+	missing := createOp(slice, tid)
+	other, _, _, othertid := doPost(t, cs2, did, &nrev, 4)
+	missing.Cid = createOp(other, othertid).Cid
+	err = repoman.HandleExternalUserEvent(ctx, 1, 1, did, since, nrev, slice, []*atproto.SyncSubscribeRepos_RepoOp{missing})
+	if err == nil {
+		t.Fatal("expected commit missing record blocks to be refused")
+	}
+
+	buf := new(bytes.Buffer)
+	if err := cs2.ReadUserCar(ctx, 1, "", true, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := repoman.ImportNewRepo(ctx, 1, did, buf, since); err != nil {
+		t.Fatal(err)
+	}
+	last := evts[len(evts)-1]
+	if !last.TooBig || last.RepoSlice != nil {
+		t.Fatalf("expected import to emit a tooBig event, got %+v", last)
+	}
+
+	if err := repoman.ReadRepo(ctx, 1, "", io.Discard); !errors.Is(err, carstore.ErrIndexOnly) {
+		t.Fatalf("expected ErrIndexOnly reading repo, got %v", err)
+	}
+}
+
+func TestNodeCacheAcrossCommits(t *testing.T) {
+	ctx := context.TODO()
+	did := "did:plc:beepboop"
+
+	upstream := testCarstore(t, t.TempDir())
+
+	// the same commits go to a repo manager with node caches and one without
+	newRepoman := func(cache bool) (*RepoManager, carstore.CarStore, *[]*RepoEvent) {
+		cs := testCarstore(t, t.TempDir())
+		rm := NewRepoManager(cs, &util.FakeKeyManager{})
+		if cache {
+			if err := rm.SetNodeCache(DefaultNodeCacheOptions()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var evts []*RepoEvent
+		rm.SetEventHandler(func(ctx context.Context, evt *RepoEvent) {
+			evts = append(evts, evt)
+		}, true)
+		return rm, cs, &evts
+	}
+	cached, cachedCs, cachedEvts := newRepoman(true)
+	plain, plainCs, plainEvts := newRepoman(false)
+
+	var since *string
+	for i := 0; i < 20; i++ {
+		slice, _, nrev, tid := doPost(t, upstream, did, since, i)
+		ops := []*atproto.SyncSubscribeRepos_RepoOp{{
+			Action: "create",
+			Path:   "app.bsky.feed.post/" + tid,
+		}}
+		for _, rm := range []*RepoManager{cached, plain} {
+			if err := rm.HandleExternalUserEvent(ctx, 1, 1, did, since, nrev, slice, ops); err != nil {
+				t.Fatal(err)
+			}
+		}
+		since = &nrev
+	}
+
+	hits, _ := cached.nodeCache(1).Stats()
+	if hits == 0 {
+		t.Fatal("expected commits to find the previous commits' nodes cached")
+	}
+
+	// slices list their blocks in no particular order
+	carBlocks := func(b []byte) map[cid.Cid]bool {
+		cr, err := car.NewCarReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := make(map[cid.Cid]bool)
+		for {
+			blk, err := cr.Next()
+			if err == io.EOF {
+				return out
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			out[blk.Cid()] = true
+		}
+	}
+
+	for i, evt := range *cachedEvts {
+		other := (*plainEvts)[i]
+		if evt.NewRoot != other.NewRoot || evt.Ops[0].Record == nil {
+			t.Fatalf("event %d differs with the node cache", i)
+		}
+		if !maps.Equal(carBlocks(evt.RepoSlice), carBlocks(other.RepoSlice)) {
+			t.Fatalf("event %d slice differs with the node cache", i)
+		}
+	}
+
+	readCar := func(cs carstore.CarStore) map[cid.Cid]bool {
+		buf := new(bytes.Buffer)
+		if err := cs.ReadUserCar(ctx, 1, "", true, buf); err != nil {
+			t.Fatal(err)
+		}
+		return carBlocks(buf.Bytes())
+	}
+	if !maps.Equal(readCar(cachedCs), readCar(plainCs)) {
+		t.Fatal("stored repo differs with the node cache")
+	}
+
+	if err := cached.ResetRepo(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cached.nodeCaches.Get(1); ok {
+		t.Fatal("node cache kept after reset")
+	}
+}
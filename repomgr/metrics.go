@@ -1,6 +1,8 @@
 package repomgr
 
 import (
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -9,3 +11,40 @@ var repoOpsImported = promauto.NewCounter(prometheus.CounterOpts{
 	Name: "repomgr_repo_ops_imported",
 	Help: "Number of repo ops imported",
 })
+
+var externalEventPhaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "repomgr_external_event_phase_duration_seconds",
+	Help:    "Time spent in each phase of applying an externally produced repo commit",
+	Buckets: prometheus.ExponentialBuckets(0.0001, 2, 18),
+}, []string{"path", "phase"})
+
+var nodeCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "repomgr_mst_node_cache_lookups_total",
+	Help: "Lookups of MST nodes in the per-repo node caches, by whether the node was cached",
+}, []string{"result"})
+
+// phase labels for externalEventPhaseDuration
+const (
+	phaseCarDecode  = "car_decode"
+	phaseSigCheck   = "sig_check"
+	phaseMstWalk    = "mst_walk"
+	phaseBlockWrite = "block_write"
+	phaseEventEmit  = "event_emit"
+)
+
+// phaseTimer records consecutive phase durations for a single event. Each call
+// to Mark observes the time elapsed since the previous mark.
+type phaseTimer struct {
+	path string
+	last time.Time
+}
+
+func newPhaseTimer(path string) *phaseTimer {
+	return &phaseTimer{path: path, last: time.Now()}
+}
+
+func (pt *phaseTimer) Mark(phase string) {
+	now := time.Now()
+	externalEventPhaseDuration.WithLabelValues(pt.path, phase).Observe(now.Sub(pt.last).Seconds())
+	pt.last = now
+}
@@ -0,0 +1,77 @@
+package repomgr
+
+import (
+	"fmt"
+
+	"github.com/bluesky-social/indigo/models"
+	"github.com/bluesky-social/indigo/mst"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// NodeCacheOptions size the per-repo caches of decoded MST nodes kept
+// between commits. Consecutive commits to a repo (common while backfilling)
+// walk mostly the same interior nodes, which would otherwise be read back
+// from the carstore and decoded for every commit.
+type NodeCacheOptions struct {
+	// repos to keep a cache for; the least recently updated are dropped
+	Repos int
+	// nodes to keep per repo
+	NodesPerRepo int
+}
+
+func DefaultNodeCacheOptions() NodeCacheOptions {
+	return NodeCacheOptions{
+		Repos:        500,
+		NodesPerRepo: 128,
+	}
+}
+
+// SetNodeCache keeps decoded MST nodes of recently updated repos between
+// external commits
+func (rm *RepoManager) SetNodeCache(opts NodeCacheOptions) error {
+	caches, err := lru.New[models.Uid, *mst.NodeCache](opts.Repos)
+	if err != nil {
+		return err
+	}
+	if opts.NodesPerRepo < 1 {
+		return fmt.Errorf("node cache must hold at least one node per repo")
+	}
+
+	rm.nodeCaches = caches
+	rm.nodesPerRepo = opts.NodesPerRepo
+	return nil
+}
+
+// nodeCache returns the repo's node cache, or nil if they're off. Callers
+// hold the user lock.
+func (rm *RepoManager) nodeCache(uid models.Uid) *mst.NodeCache {
+	if rm.nodeCaches == nil {
+		return nil
+	}
+
+	nc, ok := rm.nodeCaches.Get(uid)
+	if !ok {
+		nc = mst.NewNodeCache(rm.nodesPerRepo)
+		rm.nodeCaches.Add(uid, nc)
+	}
+	return nc
+}
+
+// dropNodeCache forgets the repo's cached nodes, once its data is gone
+func (rm *RepoManager) dropNodeCache(uid models.Uid) {
+	if rm.nodeCaches != nil {
+		rm.nodeCaches.Remove(uid)
+	}
+}
+
+// observeNodeCache returns a func that records the lookups made in nc since
+// observeNodeCache was called
+func observeNodeCache(nc *mst.NodeCache) func() {
+	hits, misses := nc.Stats()
+	return func() {
+		h, m := nc.Stats()
+		nodeCacheLookups.WithLabelValues("hit").Add(float64(h - hits))
+		nodeCacheLookups.WithLabelValues("miss").Add(float64(m - misses))
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/bluesky-social/indigo/repo"
 	"github.com/bluesky-social/indigo/util"
 
+	lru "github.com/hashicorp/golang-lru/v2"
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
@@ -33,11 +34,30 @@ import (
 
 var log = logging.Logger("repomgr")
 
+// ErrRevRegressed is returned by ImportNewRepo when the fetched repo is older
+// than the copy we have, meaning the upstream history was rewritten
+var ErrRevRegressed = errors.New("fetched repo rev is older than the current rev")
+
+// ErrRepoNotNewer is returned by ImportRepoArchive when the archive's commit is
+// no newer than the stored repo
+var ErrRepoNotNewer = errors.New("archive is not newer than the stored repo")
+
+// ErrRepoHasNoCommits is returned by reads of a repo nothing has been stored
+// for yet
+var ErrRepoHasNoCommits = errors.New("repo has no commits")
+
+// NewRepoManager returns a repo manager storing repos in cs. Given a
+// carstore.IndexOnlyCarStore, it validates and passes on external commits and
+// imports without keeping their blocks, and can't serve repo data or write
+// repos of its own.
 func NewRepoManager(cs carstore.CarStore, kmgr KeyManager) *RepoManager {
+	heads, _ := cs.(*carstore.IndexOnlyCarStore)
 
 	return &RepoManager{
 		cs:        cs,
+		heads:     heads,
 		userLocks: make(map[models.Uid]*userLock),
+		resets:    make(map[models.Uid]bool),
 		kmgr:      kmgr,
 	}
 }
@@ -52,6 +72,13 @@ func (rm *RepoManager) SetEventHandler(cb func(context.Context, *RepoEvent), hyd
 	rm.hydrateRecords = hydrateRecords
 }
 
+// SetExternalSigCheck controls whether HandleExternalUserEvent verifies commit
+// signatures. Callers that verify them before handing events over (with
+// CheckCommitSig) can turn it off to avoid checking twice.
+func (rm *RepoManager) SetExternalSigCheck(enabled bool) {
+	rm.skipExternalSigCheck = !enabled
+}
+
 type RepoManager struct {
 	cs   carstore.CarStore
 	kmgr KeyManager
@@ -61,6 +88,20 @@ type RepoManager struct {
 
 	events         func(context.Context, *RepoEvent)
 	hydrateRecords bool
+
+	// set by callers that verify commit signatures before handing over events
+	skipExternalSigCheck bool
+
+	// set when cs only keeps each repo's latest commit
+	heads *carstore.IndexOnlyCarStore
+
+	// repos wiped by ResetRepo whose next import hasn't been emitted yet
+	resetsLk sync.Mutex
+	resets   map[models.Uid]bool
+
+	// decoded MST nodes of recently updated repos, off if nil
+	nodeCaches   *lru.Cache[models.Uid, *mst.NodeCache]
+	nodesPerRepo int
 }
 
 type ActorInfo struct {
@@ -79,6 +120,16 @@ type RepoEvent struct {
 	RepoSlice []byte
 	PDS       uint
 	Ops       []RepoOp
+
+	// set when Ops don't describe every change since the previous event, as
+	// when a repo is reimported after a reset. Consumers should refetch the
+	// whole repo rather than apply the ops.
+	TooBig bool
+
+	// set when the repo was replaced wholesale by ImportRepoArchive. Ops list
+	// every record in the new repo, and RepoSlice holds just the commit block,
+	// for a #sync event telling consumers the repo has a new state.
+	Sync bool
 }
 
 type RepoOp struct {
@@ -365,7 +416,7 @@ func (rm *RepoManager) InitNewActor(ctx context.Context, user models.Uid, handle
 		DisplayName: &displayname,
 	}
 
-	_, err = r.PutRecord(ctx, "app.bsky.actor.profile/self", profile)
+	pcid, err := r.PutRecord(ctx, "app.bsky.actor.profile/self", profile)
 	if err != nil {
 		return fmt.Errorf("setting initial actor profile: %w", err)
 	}
@@ -385,6 +436,7 @@ func (rm *RepoManager) InitNewActor(ctx context.Context, user models.Uid, handle
 			Kind:       EvtKindCreateRecord,
 			Collection: "app.bsky.actor.profile",
 			Rkey:       "self",
+			RecCid:     &pcid,
 		}
 
 		if rm.hydrateRecords {
@@ -421,6 +473,10 @@ func (rm *RepoManager) ReadRepo(ctx context.Context, user models.Uid, since stri
 	return rm.cs.ReadUserCar(ctx, user, since, true, w)
 }
 
+func (rm *RepoManager) GetBlocks(ctx context.Context, user models.Uid, cids []cid.Cid) ([]blocks.Block, error) {
+	return rm.cs.ReadUserBlocks(ctx, user, cids)
+}
+
 func (rm *RepoManager) GetRecord(ctx context.Context, user models.Uid, collection string, rkey string, maybeCid cid.Cid) (cid.Cid, cbg.CBORMarshaler, error) {
 	bs, err := rm.cs.ReadOnlySession(user)
 	if err != nil {
@@ -449,30 +505,62 @@ func (rm *RepoManager) GetRecord(ctx context.Context, user models.Uid, collectio
 	return ocid, val, nil
 }
 
-func (rm *RepoManager) GetRecordProof(ctx context.Context, user models.Uid, collection string, rkey string) (cid.Cid, []blocks.Block, error) {
+// GetRecordProof returns the repo's head, the record's CID and the blocks
+// proving the record is or isn't in it: the commit, the MST nodes on the
+// record's path and, if it exists, the record. A missing record isn't an
+// error; rec is undefined and the blocks prove there's nothing at its path.
+func (rm *RepoManager) GetRecordProof(ctx context.Context, user models.Uid, collection string, rkey string) (head cid.Cid, rec cid.Cid, proof []blocks.Block, err error) {
 	robs, err := rm.cs.ReadOnlySession(user)
 	if err != nil {
-		return cid.Undef, nil, err
+		return cid.Undef, cid.Undef, nil, err
 	}
 
 	bs := util.NewLoggingBstore(robs)
 
-	head, err := rm.cs.GetUserRepoHead(ctx, user)
+	head, err = rm.cs.GetUserRepoHead(ctx, user)
 	if err != nil {
-		return cid.Undef, nil, err
+		return cid.Undef, cid.Undef, nil, err
+	}
+	if !head.Defined() {
+		return cid.Undef, cid.Undef, nil, ErrRepoHasNoCommits
 	}
 
 	r, err := repo.OpenRepo(ctx, bs, head)
 	if err != nil {
-		return cid.Undef, nil, err
+		return cid.Undef, cid.Undef, nil, err
 	}
 
-	_, _, err = r.GetRecord(ctx, collection+"/"+rkey)
+	// read the raw record rather than decoding it, so proofs work for
+	// records of any type
+	rec, _, err = r.GetRecordBytes(ctx, collection+"/"+rkey)
 	if err != nil {
-		return cid.Undef, nil, err
+		if !errors.Is(err, mst.ErrNotFound) {
+			return cid.Undef, cid.Undef, nil, err
+		}
+		rec = cid.Undef
 	}
 
-	return head, bs.GetLoggedBlocks(), nil
+	return head, rec, bs.GetLoggedBlocks(), nil
+}
+
+// GetLatestCommit returns the CID and rev of the repo's latest commit
+func (rm *RepoManager) GetLatestCommit(ctx context.Context, user models.Uid) (cid.Cid, string, error) {
+	unlock := rm.lockUser(ctx, user)
+	defer unlock()
+
+	root, err := rm.cs.GetUserRepoHead(ctx, user)
+	if err != nil {
+		return cid.Undef, "", err
+	}
+	if !root.Defined() {
+		return cid.Undef, "", ErrRepoHasNoCommits
+	}
+
+	rev, err := rm.cs.GetUserRepoRev(ctx, user)
+	if err != nil {
+		return cid.Undef, "", err
+	}
+	return root, rev, nil
 }
 
 func (rm *RepoManager) GetProfile(ctx context.Context, uid models.Uid) (*bsky.ActorProfile, error) {
@@ -514,13 +602,18 @@ func (rm *RepoManager) CheckRepoSig(ctx context.Context, r *repo.Repo, expdid st
 	}
 
 	scom := r.SignedCommit()
+	return rm.CheckCommitSig(ctx, repoDid, &scom)
+}
 
+// CheckCommitSig verifies a commit's signature against the account's current
+// signing key
+func (rm *RepoManager) CheckCommitSig(ctx context.Context, did string, scom *repo.SignedCommit) error {
 	usc := scom.Unsigned()
 	sb, err := usc.BytesForSigning()
 	if err != nil {
 		return fmt.Errorf("commit serialization failed: %w", err)
 	}
-	if err := rm.kmgr.VerifyUserSignature(ctx, repoDid, scom.Sig, sb); err != nil {
+	if err := rm.kmgr.VerifyUserSignature(ctx, did, scom.Sig, sb); err != nil {
 		return fmt.Errorf("signature check failed (sig: %x) (sb: %x) : %w", scom.Sig, sb, err)
 	}
 
@@ -538,6 +631,12 @@ func (rm *RepoManager) HandleExternalUserEvent(ctx context.Context, pdsid uint,
 	unlock := rm.lockUser(ctx, uid)
 	defer unlock()
 
+	if rm.heads != nil {
+		return rm.handleExternalUserEventIndexOnly(ctx, pdsid, uid, did, since, nrev, carslice, ops)
+	}
+
+	pt := newPhaseTimer("external")
+
 	root, ds, err := rm.cs.ImportSlice(ctx, uid, since, carslice)
 	if err != nil {
 		return fmt.Errorf("importing external carslice: %w", err)
@@ -547,9 +646,18 @@ func (rm *RepoManager) HandleExternalUserEvent(ctx context.Context, pdsid uint,
 	if err != nil {
 		return fmt.Errorf("opening external user repo (%d, root=%s): %w", uid, root, err)
 	}
+	if nc := rm.nodeCache(uid); nc != nil {
+		ds.SetNodeCache(nc)
+		r.UseNodeCache(nc)
+		defer observeNodeCache(nc)()
+	}
+	pt.Mark(phaseCarDecode)
 
-	if err := rm.CheckRepoSig(ctx, r, did); err != nil {
-		return err
+	if !rm.skipExternalSigCheck {
+		if err := rm.CheckRepoSig(ctx, r, did); err != nil {
+			return err
+		}
+		pt.Mark(phaseSigCheck)
 	}
 
 	var skipcids map[cid.Cid]bool
@@ -630,11 +738,13 @@ func (rm *RepoManager) HandleExternalUserEvent(ctx context.Context, pdsid uint,
 			return fmt.Errorf("unrecognized external user event kind: %q", op.Action)
 		}
 	}
+	pt.Mark(phaseMstWalk)
 
 	rslice, err := ds.CloseWithRoot(ctx, root, nrev)
 	if err != nil {
 		return fmt.Errorf("close with root: %w", err)
 	}
+	pt.Mark(phaseBlockWrite)
 
 	if rm.events != nil {
 		rm.events(ctx, &RepoEvent{
@@ -647,6 +757,7 @@ func (rm *RepoManager) HandleExternalUserEvent(ctx context.Context, pdsid uint,
 			RepoSlice: rslice,
 			PDS:       pdsid,
 		})
+		pt.Mark(phaseEventEmit)
 	}
 
 	return nil
@@ -783,6 +894,14 @@ func (rm *RepoManager) ImportNewRepo(ctx context.Context, user models.Uid, repoD
 	unlock := rm.lockUser(ctx, user)
 	defer unlock()
 
+	if rm.heads != nil {
+		if _, err := rm.importRepoIndexOnly(ctx, user, repoDid, r, rev, false, false); err != nil {
+			return err
+		}
+		rm.clearReset(user)
+		return nil
+	}
+
 	currev, err := rm.cs.GetUserRepoRev(ctx, user)
 	if err != nil {
 		return err
@@ -804,14 +923,23 @@ func (rm *RepoManager) ImportNewRepo(ctx context.Context, user models.Uid, repoD
 		return fmt.Errorf("ImportNewRepo called with incorrect base")
 	}
 
+	reset := rm.pendingReset(user)
+
+	pt := newPhaseTimer("import")
+
 	err = rm.processNewRepo(ctx, user, r, rev, func(ctx context.Context, root cid.Cid, finish func(context.Context, string) ([]byte, error), bs blockstore.Blockstore) error {
 		r, err := repo.OpenRepo(ctx, bs, root)
 		if err != nil {
 			return fmt.Errorf("opening new repo: %w", err)
 		}
+		pt.Mark(phaseCarDecode)
 
 		scom := r.SignedCommit()
 
+		if rev != nil && currev != "" && scom.Rev < currev {
+			return fmt.Errorf("%w: fetched %s, have %s", ErrRevRegressed, scom.Rev, currev)
+		}
+
 		usc := scom.Unsigned()
 		sb, err := usc.BytesForSigning()
 		if err != nil {
@@ -820,6 +948,7 @@ func (rm *RepoManager) ImportNewRepo(ctx context.Context, user models.Uid, repoD
 		if err := rm.kmgr.VerifyUserSignature(ctx, repoDid, scom.Sig, sb); err != nil {
 			return fmt.Errorf("new user signature check failed: %w", err)
 		}
+		pt.Mark(phaseSigCheck)
 
 		diffops, err := r.DiffSince(ctx, curhead)
 		if err != nil {
@@ -838,11 +967,13 @@ func (rm *RepoManager) ImportNewRepo(ctx context.Context, user models.Uid, repoD
 				ops = append(ops, *out)
 			}
 		}
+		pt.Mark(phaseMstWalk)
 
 		slice, err := finish(ctx, scom.Rev)
 		if err != nil {
 			return err
 		}
+		pt.Mark(phaseBlockWrite)
 
 		if rm.events != nil {
 			rm.events(ctx, &RepoEvent{
@@ -853,7 +984,9 @@ func (rm *RepoManager) ImportNewRepo(ctx context.Context, user models.Uid, repoD
 				Since:     &currev,
 				RepoSlice: slice,
 				Ops:       ops,
+				TooBig:    reset,
 			})
+			pt.Mark(phaseEventEmit)
 		}
 
 		return nil
@@ -862,9 +995,120 @@ func (rm *RepoManager) ImportNewRepo(ctx context.Context, user models.Uid, repoD
 		return fmt.Errorf("process new repo (current rev: %s): %w:", currev, err)
 	}
 
+	if reset {
+		rm.clearReset(user)
+	}
+
 	return nil
 }
 
+// ImportRepoArchive replaces a repo's data with the full repo in a CAR
+// archive, such as one exported by com.atproto.sync.getRepo, for migrations
+// and recovering from data loss. The archive's commit must be signed by the
+// DID's key, and must be newer than the stored repo unless force is set. The
+// data replaced goes to the carstore's trash. Returns the rev imported.
+func (rm *RepoManager) ImportRepoArchive(ctx context.Context, user models.Uid, repoDid string, r io.Reader, force bool) (string, error) {
+	ctx, span := otel.Tracer("repoman").Start(ctx, "ImportRepoArchive")
+	defer span.End()
+
+	unlock := rm.lockUser(ctx, user)
+	defer unlock()
+
+	if rm.heads != nil {
+		rev, err := rm.importRepoIndexOnly(ctx, user, repoDid, r, nil, true, force)
+		if err != nil {
+			return "", err
+		}
+		rm.clearReset(user)
+		return rev, nil
+	}
+
+	currev, err := rm.cs.GetUserRepoRev(ctx, user)
+	if err != nil {
+		return "", err
+	}
+
+	var rev string
+	err = rm.processNewRepo(ctx, user, r, nil, func(ctx context.Context, root cid.Cid, finish func(context.Context, string) ([]byte, error), bs blockstore.Blockstore) error {
+		r, err := repo.OpenRepo(ctx, bs, root)
+		if err != nil {
+			return fmt.Errorf("opening archived repo: %w", err)
+		}
+
+		scom := r.SignedCommit()
+		if scom.Did != repoDid {
+			return fmt.Errorf("archive is for %s, not %s", scom.Did, repoDid)
+		}
+		if currev != "" && scom.Rev <= currev && !force {
+			return fmt.Errorf("%w: archive has %s, have %s", ErrRepoNotNewer, scom.Rev, currev)
+		}
+
+		usc := scom.Unsigned()
+		sb, err := usc.BytesForSigning()
+		if err != nil {
+			return fmt.Errorf("commit serialization failed: %w", err)
+		}
+		if err := rm.kmgr.VerifyUserSignature(ctx, repoDid, scom.Sig, sb); err != nil {
+			return fmt.Errorf("archive signature check failed: %w", err)
+		}
+
+		diffops, err := r.DiffSince(ctx, cid.Undef)
+		if err != nil {
+			return fmt.Errorf("walking archived repo: %w", err)
+		}
+
+		ops := make([]RepoOp, 0, len(diffops))
+		for _, op := range diffops {
+			out, err := processOp(ctx, bs, op, rm.hydrateRecords)
+			if err != nil {
+				log.Errorw("failed to process repo op", "err", err, "path", op.Rpath, "repo", repoDid)
+			}
+
+			if out != nil {
+				ops = append(ops, *out)
+			}
+		}
+
+		slice, err := commitCar(ctx, bs, root)
+		if err != nil {
+			return err
+		}
+
+		// the archive is complete, so nothing of the current repo is kept
+		if currev != "" {
+			if _, err := rm.cs.TrashUserData(ctx, user, "replaced"); err != nil {
+				return fmt.Errorf("removing current repo: %w", err)
+			}
+		}
+
+		if _, err := finish(ctx, scom.Rev); err != nil {
+			return err
+		}
+		rev = scom.Rev
+
+		if rm.events != nil {
+			rm.events(ctx, &RepoEvent{
+				User:      user,
+				NewRoot:   root,
+				Rev:       scom.Rev,
+				RepoSlice: slice,
+				Ops:       ops,
+				Sync:      true,
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("import repo archive (current rev: %s): %w", currev, err)
+	}
+
+	// consumers refetch on the sync event, same as after a reset
+	rm.clearReset(user)
+
+	return rev, nil
+}
+
 func processOp(ctx context.Context, bs blockstore.Blockstore, op *mst.DiffOp, hydrateRecords bool) (*RepoOp, error) {
 	parts := strings.SplitN(op.Rpath, "/", 2)
 	if len(parts) != 2 {
@@ -1042,19 +1286,87 @@ func walkTree(ctx context.Context, skip map[cid.Cid]bool, root cid.Cid, bs block
 	return out, nil
 }
 
+// TakeDownRepo removes a repo's data, keeping it in the carstore's trash
+// until its retention window passes in case the takedown is reversed
 func (rm *RepoManager) TakeDownRepo(ctx context.Context, uid models.Uid) error {
+	return rm.trashRepo(ctx, uid, "takedown")
+}
+
+// DeleteRepo removes the data of a deleted account, keeping it in the
+// carstore's trash like TakeDownRepo
+func (rm *RepoManager) DeleteRepo(ctx context.Context, uid models.Uid) error {
+	return rm.trashRepo(ctx, uid, "deleted")
+}
+
+// TrashReasonDeactivated is the reason given to the trash entries made by
+// DeactivateRepo
+const TrashReasonDeactivated = "deactivated"
+
+// DeactivateRepo moves the data of an account that has been deactivated for a
+// long time to the carstore's trash, from where it can be restored if the
+// account comes back
+func (rm *RepoManager) DeactivateRepo(ctx context.Context, uid models.Uid) error {
+	return rm.trashRepo(ctx, uid, TrashReasonDeactivated)
+}
+
+func (rm *RepoManager) trashRepo(ctx context.Context, uid models.Uid, reason string) error {
 	unlock := rm.lockUser(ctx, uid)
 	defer unlock()
 
-	return rm.cs.WipeUserData(ctx, uid)
+	entry, err := rm.cs.TrashUserData(ctx, uid, reason)
+	if err != nil {
+		return err
+	}
+	rm.dropNodeCache(uid)
+	if entry != nil {
+		log.Infow("moved repo data to trash", "uid", uid, "reason", reason, "id", entry.ID, "shards", len(entry.Shards))
+	}
+	return nil
+}
+
+// RestoreRepo brings back a repo's data from a carstore trash entry. The repo
+// must not have been written to since it was trashed.
+func (rm *RepoManager) RestoreRepo(ctx context.Context, uid models.Uid, id string) error {
+	unlock := rm.lockUser(ctx, uid)
+	defer unlock()
+
+	return rm.cs.RestoreUserData(ctx, uid, id)
+}
+
+// ListTrash returns the carstore trash entries for a repo, or every repo if
+// uid is zero
+func (rm *RepoManager) ListTrash(ctx context.Context, uid models.Uid) ([]carstore.TrashEntry, error) {
+	return rm.cs.ListTrash(ctx, uid)
 }
 
-// technically identical to TakeDownRepo, for now
+// ResetRepo discards all of a repo's data. Since downstream consumers still
+// hold the old state, the event for the repo's next import is flagged TooBig
+// to tell them to refetch it, rather than presenting it as a diff.
 func (rm *RepoManager) ResetRepo(ctx context.Context, uid models.Uid) error {
 	unlock := rm.lockUser(ctx, uid)
 	defer unlock()
 
-	return rm.cs.WipeUserData(ctx, uid)
+	if err := rm.cs.WipeUserData(ctx, uid); err != nil {
+		return err
+	}
+	rm.dropNodeCache(uid)
+
+	rm.resetsLk.Lock()
+	rm.resets[uid] = true
+	rm.resetsLk.Unlock()
+	return nil
+}
+
+func (rm *RepoManager) pendingReset(uid models.Uid) bool {
+	rm.resetsLk.Lock()
+	defer rm.resetsLk.Unlock()
+	return rm.resets[uid]
+}
+
+func (rm *RepoManager) clearReset(uid models.Uid) {
+	rm.resetsLk.Lock()
+	defer rm.resetsLk.Unlock()
+	delete(rm.resets, uid)
 }
 
 func (rm *RepoManager) VerifyRepo(ctx context.Context, uid models.Uid) error {
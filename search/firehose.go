@@ -17,6 +17,7 @@ import (
 	"github.com/bluesky-social/indigo/events/schedulers/autoscaling"
 	lexutil "github.com/bluesky-social/indigo/lex/util"
 	"github.com/bluesky-social/indigo/repo"
+	"github.com/bluesky-social/indigo/util/retry"
 	typegen "github.com/whyrusleeping/cbor-gen"
 
 	"github.com/carlmjohnson/versioninfo"
@@ -154,7 +155,16 @@ func (idx *Indexer) discoverRepos() {
 	totalErrored := 0
 
 	for {
-		resp, err := comatproto.SyncListRepos(ctx, idx.relayXRPC, cursor, limit)
+		resp, err := retry.DoValue(ctx, retry.Policy{
+			Backoff:     retry.Backoff{Initial: time.Second, Max: time.Second * 30},
+			MaxAttempts: 5,
+			Classify:    retry.DefaultClassify,
+			OnRetry: func(attempt int, err error, wait time.Duration) {
+				log.Error("failed to list repos", "err", err, "attempt", attempt, "wait", wait)
+			},
+		}, func(ctx context.Context) (*comatproto.SyncListRepos_Output, error) {
+			return comatproto.SyncListRepos(ctx, idx.relayXRPC, cursor, limit)
+		})
 		if err != nil {
 			log.Error("failed to list repos", "err", err)
 			time.Sleep(5 * time.Second)
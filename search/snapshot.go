@@ -0,0 +1,320 @@
+package search
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	es "github.com/opensearch-project/opensearch-go/v2"
+	"github.com/opensearch-project/opensearch-go/v2/opensearchapi"
+	"gorm.io/gorm"
+)
+
+// Summary of an ES/OS snapshot taken by palomar
+type SnapshotInfo struct {
+	Name  string
+	State string
+	// concrete indices contained in the snapshot
+	Indices []string
+	// maps the configured index names (which may be aliases) to the concrete
+	// index which was snapshotted for each
+	IndexNames map[string]string
+	// firehose sequence number which indexing had reached when the snapshot
+	// was started. Indexing should resume from here after a restore.
+	Cursor       int64
+	FailedShards int
+}
+
+type esSnapshot struct {
+	Snapshot string          `json:"snapshot"`
+	State    string          `json:"state"`
+	Indices  []string        `json:"indices"`
+	Metadata json.RawMessage `json:"metadata"`
+	Shards   struct {
+		Total  int `json:"total"`
+		Failed int `json:"failed"`
+	} `json:"shards"`
+}
+
+// stored in the "metadata" field of snapshots created by palomar
+type snapshotMetadata struct {
+	Cursor  int64             `json:"palomar_firehose_cursor"`
+	Indices map[string]string `json:"palomar_indices"`
+}
+
+func readESError(resp *opensearchapi.Response) error {
+	b, _ := io.ReadAll(resp.Body)
+	return fmt.Errorf("opensearch request failed (status %d): %s", resp.StatusCode, string(b))
+}
+
+// resolveIndex returns the concrete index behind name, if it is an alias, or
+// name itself otherwise
+func resolveIndex(ctx context.Context, escli *es.Client, name string) (string, error) {
+	resp, err := escli.Indices.GetAlias(
+		escli.Indices.GetAlias.WithContext(ctx),
+		escli.Indices.GetAlias.WithName(name),
+	)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return name, nil
+	}
+	if resp.IsError() {
+		return "", readESError(resp)
+	}
+
+	var out map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("decoding alias response: %w", err)
+	}
+	if len(out) != 1 {
+		return "", fmt.Errorf("alias %q points at %d indices, expected exactly one", name, len(out))
+	}
+	for idx := range out {
+		return idx, nil
+	}
+	return name, nil
+}
+
+// CreateSnapshot starts a snapshot of the given indices (or aliases) into an
+// already-registered snapshot repository. The current firehose cursor is read
+// from db first and stored in the snapshot metadata; since it is read before
+// the snapshot starts, resuming from it after a restore may re-process a few
+// events, which is harmless.
+func CreateSnapshot(ctx context.Context, escli *es.Client, db *gorm.DB, repo, name string, indices []string) error {
+	var lastSeq LastSeq
+	if err := db.Find(&lastSeq).Error; err != nil {
+		return fmt.Errorf("reading firehose cursor: %w", err)
+	}
+
+	names := make(map[string]string)
+	concrete := make([]string, 0, len(indices))
+	for _, idx := range indices {
+		c, err := resolveIndex(ctx, escli, idx)
+		if err != nil {
+			return fmt.Errorf("resolving index %q: %w", idx, err)
+		}
+		names[idx] = c
+		concrete = append(concrete, c)
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"indices":              concrete,
+		"include_global_state": false,
+		"metadata": snapshotMetadata{
+			Cursor:  lastSeq.Seq,
+			Indices: names,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := escli.Snapshot.Create(repo, name,
+		escli.Snapshot.Create.WithContext(ctx),
+		escli.Snapshot.Create.WithBody(bytes.NewReader(body)),
+	)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.IsError() {
+		return readESError(resp)
+	}
+	io.ReadAll(resp.Body)
+
+	return nil
+}
+
+// GetSnapshot fetches the current state of a snapshot
+func GetSnapshot(ctx context.Context, escli *es.Client, repo, name string) (*SnapshotInfo, error) {
+	resp, err := escli.Snapshot.Get(repo, []string{name},
+		escli.Snapshot.Get.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.IsError() {
+		return nil, readESError(resp)
+	}
+
+	var out struct {
+		Snapshots []esSnapshot `json:"snapshots"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decoding snapshot response: %w", err)
+	}
+	if len(out.Snapshots) != 1 {
+		return nil, fmt.Errorf("snapshot %q not found in repository %q", name, repo)
+	}
+	snap := out.Snapshots[0]
+
+	info := SnapshotInfo{
+		Name:         snap.Snapshot,
+		State:        snap.State,
+		Indices:      snap.Indices,
+		FailedShards: snap.Shards.Failed,
+	}
+	if len(snap.Metadata) > 0 && string(snap.Metadata) != "null" {
+		var md snapshotMetadata
+		if err := json.Unmarshal(snap.Metadata, &md); err != nil {
+			return nil, fmt.Errorf("decoding snapshot metadata: %w", err)
+		}
+		info.Cursor = md.Cursor
+		info.IndexNames = md.Indices
+	}
+	return &info, nil
+}
+
+// WaitForSnapshot polls until the snapshot is no longer in progress, then
+// verifies that it completed successfully and contains every index it was
+// meant to
+func WaitForSnapshot(ctx context.Context, escli *es.Client, repo, name string, interval time.Duration) (*SnapshotInfo, error) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		info, err := GetSnapshot(ctx, escli, repo, name)
+		if err != nil {
+			return nil, err
+		}
+		if info.State != "IN_PROGRESS" && info.State != "STARTED" {
+			return info, verifySnapshot(info)
+		}
+		slog.Info("waiting for snapshot", "snapshot", name, "state", info.State)
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func verifySnapshot(info *SnapshotInfo) error {
+	if info.State != "SUCCESS" {
+		return fmt.Errorf("snapshot %q finished in state %s", info.Name, info.State)
+	}
+	if info.FailedShards > 0 {
+		return fmt.Errorf("snapshot %q has %d failed shards", info.Name, info.FailedShards)
+	}
+	if info.IndexNames == nil {
+		return fmt.Errorf("snapshot %q was not created by palomar (missing metadata)", info.Name)
+	}
+
+	have := make(map[string]bool, len(info.Indices))
+	for _, idx := range info.Indices {
+		have[idx] = true
+	}
+	for _, c := range info.IndexNames {
+		if !have[c] {
+			return fmt.Errorf("snapshot %q is missing index %q", info.Name, c)
+		}
+	}
+	return nil
+}
+
+// RestoreSnapshot restores the indices in a palomar snapshot under new names
+// (the original concrete index name plus suffix), waits for the restore to
+// finish, then points each of the originally configured index names at the
+// restored indices as aliases. Any existing alias with that name is moved.
+//
+// If db is not nil, the firehose cursor stored with the snapshot is written to
+// it, so that indexing resumes from where the snapshot was taken.
+func RestoreSnapshot(ctx context.Context, escli *es.Client, db *gorm.DB, repo, name, suffix string) (*SnapshotInfo, error) {
+	info, err := GetSnapshot(ctx, escli, repo, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySnapshot(info); err != nil {
+		return nil, err
+	}
+
+	concrete := make([]string, 0, len(info.IndexNames))
+	for _, c := range info.IndexNames {
+		concrete = append(concrete, c)
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"indices":              concrete,
+		"include_global_state": false,
+		"include_aliases":      false,
+		"rename_pattern":       "(.+)",
+		"rename_replacement":   "$1" + suffix,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := escli.Snapshot.Restore(repo, name,
+		escli.Snapshot.Restore.WithContext(ctx),
+		escli.Snapshot.Restore.WithBody(bytes.NewReader(body)),
+		escli.Snapshot.Restore.WithWaitForCompletion(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.IsError() {
+		return nil, readESError(resp)
+	}
+	io.ReadAll(resp.Body)
+
+	if err := rewireAliases(ctx, escli, info.IndexNames, suffix); err != nil {
+		return nil, err
+	}
+
+	if db != nil {
+		if err := db.Save(&LastSeq{ID: 1, Seq: info.Cursor}).Error; err != nil {
+			return nil, fmt.Errorf("writing firehose cursor: %w", err)
+		}
+	}
+
+	return info, nil
+}
+
+// rewireAliases atomically points each alias at its restored index, removing
+// the alias from wherever it pointed before
+func rewireAliases(ctx context.Context, escli *es.Client, names map[string]string, suffix string) error {
+	var actions []map[string]any
+	for alias, c := range names {
+		prev, err := resolveIndex(ctx, escli, alias)
+		if err != nil {
+			return fmt.Errorf("resolving alias %q: %w", alias, err)
+		}
+		if prev != alias {
+			actions = append(actions, map[string]any{
+				"remove": map[string]string{"index": prev, "alias": alias},
+			})
+		}
+		actions = append(actions, map[string]any{
+			"add": map[string]string{"index": c + suffix, "alias": alias},
+		})
+	}
+
+	body, err := json.Marshal(map[string]any{"actions": actions})
+	if err != nil {
+		return err
+	}
+
+	resp, err := escli.Indices.UpdateAliases(bytes.NewReader(body),
+		escli.Indices.UpdateAliases.WithContext(ctx),
+	)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.IsError() {
+		return fmt.Errorf("rewiring aliases (an index with the alias name may already exist): %w", readESError(resp))
+	}
+	io.ReadAll(resp.Body)
+	return nil
+}
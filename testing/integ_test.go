@@ -552,3 +552,69 @@ func TestRelayHandleEmptyEvent(t *testing.T) {
 	assert.Equal(len(e2.RepoCommit.Ops), 0)
 	assert.Equal(e2.RepoCommit.Repo, bob.DID())
 }
+
+func TestRelayListReposByCollection(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping Relay test in 'short' test mode")
+	}
+	assert := assert.New(t)
+	didr := TestPLC(t)
+	p1 := MustSetupPDS(t, ".tpds", didr)
+	p1.Run(t)
+
+	b1 := MustSetupRelay(t, didr)
+	b1.Run(t)
+
+	b1.tr.TrialHosts = []string{p1.RawHost()}
+
+	p1.RequestScraping(t, b1)
+	p1.BumpLimits(t, b1)
+
+	time.Sleep(time.Millisecond * 50)
+
+	evts := b1.Events(t, -1)
+	defer evts.Cancel()
+
+	bob := p1.MustNewUser(t, "bob.tpds")
+	evts.Next()
+	alice := p1.MustNewUser(t, "alice.tpds")
+	evts.Next()
+	bob.Post(t, "hello")
+	evts.Next()
+
+	ctx := context.TODO()
+	c := &xrpc.Client{Host: "http://" + b1.Host()}
+
+	out, err := atproto.SyncListReposByCollection(ctx, c, "app.bsky.feed.post", "", 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(out.Repos, 1)
+	assert.Equal(bob.DID(), out.Repos[0].Did)
+
+	// both accounts have a profile, one page at a time
+	out, err = atproto.SyncListReposByCollection(ctx, c, "app.bsky.actor.profile", "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(out.Repos, 1)
+	assert.NotNil(out.Cursor)
+	first := out.Repos[0].Did
+
+	out, err = atproto.SyncListReposByCollection(ctx, c, "app.bsky.actor.profile", *out.Cursor, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(out.Repos, 1)
+	assert.ElementsMatch([]string{bob.DID(), alice.DID()}, []string{first, out.Repos[0].Did})
+
+	out, err = atproto.SyncListReposByCollection(ctx, c, "app.bsky.feed.like", "", 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(out.Repos)
+
+	if _, err := atproto.SyncListReposByCollection(ctx, c, "not-an-nsid", "", 500); err == nil {
+		t.Fatal("invalid collection should be rejected")
+	}
+}
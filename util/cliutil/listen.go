@@ -0,0 +1,146 @@
+package cliutil
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Listen opens a stream listener for a command-line listen address. As well as
+// regular TCP addresses (eg, ":2470"), this accepts:
+//
+//   - "unix:///path/to/file.sock" (or "unix:/path/to/file.sock"): a unix
+//     domain socket. A stale socket file left by a previous run is removed.
+//   - "systemd", "systemd:<name>" or "systemd:<index>": a socket passed in by
+//     systemd socket activation (LISTEN_FDS). A name matches the socket unit's
+//     FileDescriptorName=; an index counts from zero in the order systemd
+//     passed the sockets. Plain "systemd" is the first socket.
+//
+// Socket activation lets the service restart without refusing connections in
+// the meantime, since systemd holds the listening socket open.
+func Listen(ctx context.Context, addr string) (net.Listener, error) {
+	var lc net.ListenConfig
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		path := strings.TrimPrefix(strings.TrimPrefix(addr, "unix:"), "//")
+		if path == "" {
+			return nil, fmt.Errorf("missing socket path in listen address %q", addr)
+		}
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+		return lc.Listen(ctx, "unix", path)
+	case addr == "systemd" || strings.HasPrefix(addr, "systemd:"):
+		return systemdListener(strings.TrimPrefix(strings.TrimPrefix(addr, "systemd"), ":"))
+	default:
+		return lc.Listen(ctx, "tcp", addr)
+	}
+}
+
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("refusing to replace %s: exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+// first file descriptor passed by systemd, after stdin/stdout/stderr
+const listenFdsStart = 3
+
+type activatedSocket struct {
+	name string
+	file *os.File
+	used bool
+}
+
+var (
+	activatedOnce    sync.Once
+	activatedLk      sync.Mutex
+	activatedSockets []*activatedSocket
+	activatedErr     error
+)
+
+// readActivatedSockets picks up the sockets passed by systemd, following
+// sd_listen_fds(3). The environment variables are cleared so child processes
+// don't also try to use them.
+func readActivatedSockets() {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		activatedErr = fmt.Errorf("no sockets passed by systemd (LISTEN_PID not set to this process)")
+		return
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		activatedErr = fmt.Errorf("no sockets passed by systemd (LISTEN_FDS=%q)", os.Getenv("LISTEN_FDS"))
+		return
+	}
+
+	var names []string
+	if s := os.Getenv("LISTEN_FDNAMES"); s != "" {
+		names = strings.Split(s, ":")
+	}
+	for i := 0; i < nfds; i++ {
+		sock := &activatedSocket{
+			file: os.NewFile(uintptr(listenFdsStart+i), fmt.Sprintf("systemd-fd-%d", listenFdsStart+i)),
+		}
+		if i < len(names) {
+			sock.name = names[i]
+		}
+		activatedSockets = append(activatedSockets, sock)
+	}
+}
+
+func systemdListener(sel string) (net.Listener, error) {
+	activatedOnce.Do(readActivatedSockets)
+	if activatedErr != nil {
+		return nil, activatedErr
+	}
+
+	activatedLk.Lock()
+	defer activatedLk.Unlock()
+
+	var sock *activatedSocket
+	if idx, err := strconv.Atoi(sel); err == nil || sel == "" {
+		if idx < 0 || idx >= len(activatedSockets) {
+			return nil, fmt.Errorf("systemd passed %d sockets, no socket at index %d", len(activatedSockets), idx)
+		}
+		sock = activatedSockets[idx]
+	} else {
+		for _, s := range activatedSockets {
+			if s.name == sel {
+				sock = s
+				break
+			}
+		}
+		if sock == nil {
+			return nil, fmt.Errorf("no socket named %q passed by systemd", sel)
+		}
+	}
+	if sock.used {
+		return nil, fmt.Errorf("systemd socket %q is already in use by another listener", sel)
+	}
+
+	// FileListener dups the descriptor, so the original can be closed
+	li, err := net.FileListener(sock.file)
+	if err != nil {
+		return nil, fmt.Errorf("systemd socket %q: %w", sel, err)
+	}
+	sock.file.Close()
+	sock.used = true
+	return li, nil
+}
@@ -0,0 +1,59 @@
+package cliutil
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "api.sock")
+
+	// leave a stale socket behind, as after a crash
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	li, err := Listen(context.Background(), "unix://"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer li.Close()
+
+	go func() {
+		c, err := li.Accept()
+		if err == nil {
+			c.Write([]byte("ok"))
+			c.Close()
+		}
+	}()
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	buf := make([]byte, 2)
+	if _, err := c.Read(buf); err != nil || string(buf) != "ok" {
+		t.Fatalf("unexpected read: %q %v", buf, err)
+	}
+}
+
+func TestListenUnixRefusesRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "not-a-socket")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen(context.Background(), "unix:"+path); err == nil {
+		t.Fatal("expected error listening over a regular file")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal("regular file was removed")
+	}
+}
@@ -0,0 +1,73 @@
+package util
+
+import (
+	"context"
+	"time"
+)
+
+// Clock is the time source for components that schedule work or make
+// decisions based on the time, so that tests can control it. Durations
+// measured for metrics and logs use the real time regardless.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	NewTicker(d time.Duration) Ticker
+	// Sleep waits for d to pass, returning early with the context's error
+	// if it's cancelled first
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// Ticker is a time.Ticker from a Clock
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// SystemClock is the real time
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+func (systemClock) Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type systemTicker struct {
+	t *time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t systemTicker) Stop() {
+	t.t.Stop()
+}
+
+// ClockOrSystem returns c, or SystemClock if c is nil, for options structs
+// whose Clock defaults to the real time
+func ClockOrSystem(c Clock) Clock {
+	if c == nil {
+		return SystemClock
+	}
+	return c
+}
@@ -2,11 +2,11 @@ package util
 
 import (
 	"context"
+	"crypto/tls"
 	"log/slog"
 	"net/http"
 	"time"
 
-	"github.com/hashicorp/go-cleanhttp"
 	"github.com/hashicorp/go-retryablehttp"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
@@ -44,17 +44,27 @@ func (l LeveledSlog) Debug(msg string, keysAndValues ...interface{}) {
 // client needs. CLI tools might want shorter timeouts and fewer retries by
 // default.
 func RobustHTTPClient() *http.Client {
+	return newRobustHTTPClient(http.ProxyFromEnvironment, nil)
+}
+
+func newRobustHTTPClient(proxy ProxyFunc, tlsConfig *tls.Config) *http.Client {
+	opts := DefaultHTTPClientOptions()
+	opts.Proxy = proxy
+	opts.TLSConfig = tlsConfig
+	return newRobustHTTPClientWithOptions(opts)
+}
 
+func newRobustHTTPClientWithOptions(opts *HTTPClientOptions) *http.Client {
 	logger := LeveledSlog{inner: slog.Default().With("subsystem", "RobustHTTPClient")}
 	retryClient := retryablehttp.NewClient()
-	retryClient.HTTPClient.Transport = otelhttp.NewTransport(cleanhttp.DefaultPooledTransport())
+	retryClient.HTTPClient.Transport = otelhttp.NewTransport(newHTTPTransport(opts))
 	retryClient.RetryMax = 3
 	retryClient.RetryWaitMin = 1 * time.Second
 	retryClient.RetryWaitMax = 10 * time.Second
 	retryClient.Logger = retryablehttp.LeveledLogger(logger)
 	retryClient.CheckRetry = XRPCRetryPolicy
 	client := retryClient.StandardClient()
-	client.Timeout = 30 * time.Second
+	client.Timeout = opts.Timeout
 	return client
 }
 
@@ -0,0 +1,147 @@
+package util
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/hashicorp/go-cleanhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// ProxyFunc is the type of http.Transport.Proxy and websocket.Dialer.Proxy
+type ProxyFunc func(*http.Request) (*url.URL, error)
+
+// NewProxyFunc returns a ProxyFunc sending requests through the proxy at
+// proxyURL, which may be an http, https, socks5 or socks5h URL. Destinations
+// matching one of the bypass rules are connected to directly. Rules are as in
+// NO_PROXY: a hostname, which also matches its subdomains, an IP address or
+// CIDR range, any of those with a port, or "*" to match everything. Requests
+// to localhost and loopback addresses are never proxied.
+func NewProxyFunc(proxyURL string, bypass []string) (ProxyFunc, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, must be http, https, socks5 or socks5h", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy URL %q has no host", proxyURL)
+	}
+
+	for _, rule := range bypass {
+		if strings.ContainsAny(rule, ", ") {
+			return nil, fmt.Errorf("invalid proxy bypass rule %q", rule)
+		}
+	}
+
+	cfg := httpproxy.Config{
+		HTTPProxy:  u.String(),
+		HTTPSProxy: u.String(),
+		NoProxy:    strings.Join(bypass, ","),
+	}
+	fn := cfg.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return fn(req.URL)
+	}, nil
+}
+
+// RobustHTTPClientWithProxy is RobustHTTPClient, making its requests through
+// the given proxy. A nil proxy behaves as RobustHTTPClient.
+func RobustHTTPClientWithProxy(proxy ProxyFunc) *http.Client {
+	return RobustHTTPClientWithTLS(proxy, nil)
+}
+
+// RobustHTTPClientWithTLS is RobustHTTPClientWithProxy, making its TLS
+// connections with the given config. A nil config uses the defaults.
+func RobustHTTPClientWithTLS(proxy ProxyFunc, tlsConfig *tls.Config) *http.Client {
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	return newRobustHTTPClient(proxy, tlsConfig)
+}
+
+// ProxiedHTTPClient returns a plain client making its requests through the
+// given proxy. A nil proxy uses the environment's proxy settings, as
+// http.DefaultClient does.
+func ProxiedHTTPClient(proxy ProxyFunc) *http.Client {
+	return ProxiedHTTPClientWithTLS(proxy, nil)
+}
+
+// ProxiedHTTPClientWithTLS is ProxiedHTTPClient, making its TLS connections
+// with the given config. A nil config uses the defaults.
+func ProxiedHTTPClientWithTLS(proxy ProxyFunc, tlsConfig *tls.Config) *http.Client {
+	transport := cleanhttp.DefaultPooledTransport()
+	if proxy != nil {
+		transport.Proxy = proxy
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig.Clone()
+	}
+	return &http.Client{Transport: otelhttp.NewTransport(transport)}
+}
+
+// The websocket library dials http and socks5 proxies itself, but not https
+// ones; tunnel through those with TLS to the proxy and a CONNECT request.
+func init() {
+	proxy.RegisterDialerType("https", func(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+		return &httpsProxyDialer{proxyURL: u, forward: forward}, nil
+	})
+}
+
+type httpsProxyDialer struct {
+	proxyURL *url.URL
+	forward  proxy.Dialer
+}
+
+func (d *httpsProxyDialer) Dial(network, addr string) (net.Conn, error) {
+	host := d.proxyURL.Host
+	if d.proxyURL.Port() == "" {
+		host = net.JoinHostPort(host, "443")
+	}
+
+	raw, err := d.forward.Dial(network, host)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, &tls.Config{ServerName: d.proxyURL.Hostname()})
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := d.proxyURL.User; user != nil {
+		pass, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+pass)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// the server doesn't speak until spoken to, so nothing past the response
+	// is buffered
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// the body of a successful response is the tunnel, so it's left unread
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused connection to %s: %s", addr, resp.Status)
+	}
+	return conn, nil
+}
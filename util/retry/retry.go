@@ -0,0 +1,266 @@
+// Package retry implements context-aware retry loops with decorrelated jitter
+// backoff, an overall time budget, and hooks for classifying errors so that
+// different failure modes (permanent, throttled, transient) can be handled
+// with different policies.
+package retry
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Class describes how a failed attempt should be treated
+type Class int
+
+const (
+	// Retryable errors are retried using the policy's default backoff
+	Retryable Class = iota
+	// Permanent errors are returned to the caller immediately
+	Permanent
+	// Throttled errors are retried using the policy's throttle backoff, which
+	// is typically much slower than the default
+	Throttled
+)
+
+func (c Class) String() string {
+	switch c {
+	case Retryable:
+		return "retryable"
+	case Permanent:
+		return "permanent"
+	case Throttled:
+		return "throttled"
+	default:
+		return "unknown"
+	}
+}
+
+// Backoff is the range of wait durations used between attempts
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+// Policy configures a retry loop. The zero value retries forever with the
+// default backoff and treats every error as retryable.
+type Policy struct {
+	// Backoff used for Retryable errors
+	Backoff Backoff
+	// Backoff used for Throttled errors. If unset, Backoff.Max is used as a
+	// fixed wait.
+	Throttle *Backoff
+
+	// MaxAttempts is the total number of attempts (including the first). Zero
+	// means unlimited.
+	MaxAttempts int
+	// MaxElapsed bounds the wall-clock time spent in the loop, including
+	// waits. Zero means unlimited.
+	MaxElapsed time.Duration
+
+	// Classify decides how each error is handled. If nil, errors wrapped with
+	// MarkPermanent are permanent and everything else is retryable.
+	Classify func(error) Class
+
+	// OnRetry, if set, is called before each wait
+	OnRetry func(attempt int, err error, wait time.Duration)
+}
+
+var DefaultBackoff = Backoff{
+	Initial: 100 * time.Millisecond,
+	Max:     30 * time.Second,
+}
+
+type permanentError struct {
+	err error
+}
+
+func (pe *permanentError) Error() string { return pe.err.Error() }
+func (pe *permanentError) Unwrap() error { return pe.err }
+
+// MarkPermanent wraps err so the default classifier will not retry it
+func MarkPermanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err was wrapped with MarkPermanent
+func IsPermanent(err error) bool {
+	var pe *permanentError
+	return errors.As(err, &pe)
+}
+
+// DefaultClassify treats context errors and errors marked with MarkPermanent
+// as permanent, and everything else as retryable
+func DefaultClassify(err error) Class {
+	if IsPermanent(err) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return Permanent
+	}
+	return Retryable
+}
+
+// ClassifyHTTPStatus maps an HTTP response status to a Class: 429 is
+// throttled, other 4xx (except 408) are permanent, and the rest are retryable
+func ClassifyHTTPStatus(code int) Class {
+	switch {
+	case code == http.StatusTooManyRequests:
+		return Throttled
+	case code == http.StatusRequestTimeout:
+		return Retryable
+	case code >= 400 && code < 500:
+		return Permanent
+	default:
+		return Retryable
+	}
+}
+
+// ErrAttemptsExhausted is wrapped into the error returned when a loop gives
+// up because it ran out of attempts or time
+var ErrAttemptsExhausted = errors.New("retry attempts exhausted")
+
+type exhaustedError struct {
+	last error
+}
+
+func (ee *exhaustedError) Error() string {
+	return ErrAttemptsExhausted.Error() + ": " + ee.last.Error()
+}
+
+func (ee *exhaustedError) Unwrap() []error {
+	return []error{ErrAttemptsExhausted, ee.last}
+}
+
+// Do calls fn until it succeeds, returns a permanent error, the policy's
+// budget is exhausted, or ctx is done
+func Do(ctx context.Context, p Policy, fn func(ctx context.Context) error) error {
+	_, err := DoValue(ctx, p, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, fn(ctx)
+	})
+	return err
+}
+
+// DoValue is like Do but for functions that return a value
+func DoValue[T any](ctx context.Context, p Policy, fn func(ctx context.Context) (T, error)) (T, error) {
+	classify := p.Classify
+	if classify == nil {
+		classify = DefaultClassify
+	}
+
+	start := time.Now()
+	def := NewDecorrelated(p.Backoff)
+
+	var throttle *Decorrelated
+	if p.Throttle != nil {
+		throttle = NewDecorrelated(*p.Throttle)
+	}
+
+	var zero T
+	for attempt := 1; ; attempt++ {
+		v, err := fn(ctx)
+		if err == nil {
+			return v, nil
+		}
+
+		class := classify(err)
+		if class == Permanent {
+			return zero, err
+		}
+
+		if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+			return zero, &exhaustedError{last: err}
+		}
+
+		var wait time.Duration
+		switch {
+		case class == Throttled && throttle != nil:
+			wait = throttle.Next()
+		case class == Throttled:
+			wait = def.b.Max
+		default:
+			wait = def.Next()
+		}
+
+		if p.MaxElapsed > 0 && time.Since(start)+wait > p.MaxElapsed {
+			return zero, &exhaustedError{last: err}
+		}
+
+		if p.OnRetry != nil {
+			p.OnRetry(attempt, err, wait)
+		}
+
+		if err := Sleep(ctx, wait); err != nil {
+			return zero, err
+		}
+	}
+}
+
+// Sleep waits for d or until ctx is done, whichever comes first
+func Sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Decorrelated produces "decorrelated jitter" backoff durations: each wait is
+// drawn uniformly from [Initial, 3*previous], capped at Max. It is useful on
+// its own for loops that don't fit the shape of Do, like long-lived
+// reconnecting subscriptions.
+type Decorrelated struct {
+	b    Backoff
+	prev time.Duration
+	rng  *rand.Rand
+}
+
+func NewDecorrelated(b Backoff) *Decorrelated {
+	if b.Initial <= 0 {
+		b.Initial = DefaultBackoff.Initial
+	}
+	if b.Max <= 0 {
+		b.Max = DefaultBackoff.Max
+	}
+	if b.Max < b.Initial {
+		b.Max = b.Initial
+	}
+
+	return &Decorrelated{
+		b:    b,
+		prev: b.Initial,
+		rng:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Next returns the next wait duration
+func (d *Decorrelated) Next() time.Duration {
+	hi := d.prev * 3
+	if hi > d.b.Max || hi <= 0 {
+		hi = d.b.Max
+	}
+
+	wait := d.b.Initial
+	if span := int64(hi - d.b.Initial); span > 0 {
+		wait += time.Duration(d.rng.Int63n(span + 1))
+	}
+
+	d.prev = wait
+	return wait
+}
+
+// Reset returns the backoff to its initial state, eg after a successful
+// attempt
+func (d *Decorrelated) Reset() {
+	d.prev = d.b.Initial
+}
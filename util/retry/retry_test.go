@@ -0,0 +1,86 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var fastPolicy = Policy{
+	Backoff:     Backoff{Initial: time.Millisecond, Max: time.Millisecond * 5},
+	MaxAttempts: 4,
+}
+
+func TestDoRetriesUntilSuccess(t *testing.T) {
+	var calls int
+	err := Do(context.Background(), fastPolicy, func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", calls)
+	}
+}
+
+func TestDoPermanent(t *testing.T) {
+	base := errors.New("bad request")
+
+	var calls int
+	err := Do(context.Background(), fastPolicy, func(ctx context.Context) error {
+		calls++
+		return MarkPermanent(base)
+	})
+	if !errors.Is(err, base) {
+		t.Fatalf("expected wrapped base error, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("permanent error should not be retried, got %d calls", calls)
+	}
+}
+
+func TestDoExhausted(t *testing.T) {
+	base := errors.New("transient")
+
+	var calls int
+	err := Do(context.Background(), fastPolicy, func(ctx context.Context) error {
+		calls++
+		return base
+	})
+	if !errors.Is(err, ErrAttemptsExhausted) || !errors.Is(err, base) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls != fastPolicy.MaxAttempts {
+		t.Fatalf("expected %d calls, got %d", fastPolicy.MaxAttempts, calls)
+	}
+}
+
+func TestDoContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	p := Policy{Backoff: Backoff{Initial: time.Hour, Max: time.Hour}}
+	err := Do(ctx, p, func(ctx context.Context) error {
+		cancel()
+		return errors.New("transient")
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestDecorrelatedBounds(t *testing.T) {
+	b := Backoff{Initial: time.Millisecond * 10, Max: time.Second}
+	d := NewDecorrelated(b)
+	for i := 0; i < 1000; i++ {
+		w := d.Next()
+		if w < b.Initial || w > b.Max {
+			t.Fatalf("wait %s out of bounds [%s, %s]", w, b.Initial, b.Max)
+		}
+	}
+}
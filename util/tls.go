@@ -0,0 +1,99 @@
+package util
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// TLSPolicy is what's required of the TLS connections made to upstream hosts
+type TLSPolicy struct {
+	// Lowest TLS version accepted, one of the tls.VersionTLS* constants. Zero
+	// leaves it to crypto/tls, which currently defaults to TLS 1.2.
+	MinVersion uint16
+
+	// Pins by hostname: base64 SHA-256 hashes of the SubjectPublicKeyInfo of
+	// keys the host's certificate chain must include one of. The chain is
+	// still verified as usual; pinning only narrows which chains are accepted.
+	Pins map[string][]string
+}
+
+// ParseTLSVersion parses a TLS version as "1.2" or "1.3". The empty string
+// parses as zero, the crypto/tls default.
+func ParseTLSVersion(s string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "tls") {
+	case "":
+		return 0, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version %q, must be 1.2 or 1.3", s)
+	}
+}
+
+// ParseTLSPins parses pins given as "host=pin", where pin is a base64
+// SHA-256 hash of a SubjectPublicKeyInfo, optionally prefixed with "sha256/"
+// as curl's --pinnedpubkey takes them. A host may be given several times to
+// pin several keys, such as a backup key.
+func ParseTLSPins(specs []string) (map[string][]string, error) {
+	pins := make(map[string][]string)
+	for _, spec := range specs {
+		host, pin, ok := strings.Cut(strings.TrimSpace(spec), "=")
+		host = strings.ToLower(strings.TrimSpace(host))
+		pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+		if !ok || host == "" || pin == "" {
+			return nil, fmt.Errorf("invalid TLS pin %q, must be host=base64 SHA-256 of the key", spec)
+		}
+		if strings.Contains(host, ":") {
+			return nil, fmt.Errorf("invalid TLS pin %q, pins are per hostname, without a port", spec)
+		}
+		raw, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("invalid TLS pin %q, must be a base64 SHA-256 hash", spec)
+		}
+		pins[host] = append(pins[host], pin)
+	}
+	return pins, nil
+}
+
+// SPKIPin returns the pin of a certificate's key, as ParseTLSPins takes it
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Config returns a tls.Config enforcing the policy, or nil for a nil or
+// empty policy, leaving the crypto/tls defaults in place
+func (p *TLSPolicy) Config() *tls.Config {
+	if p == nil || (p.MinVersion == 0 && len(p.Pins) == 0) {
+		return nil
+	}
+
+	cfg := &tls.Config{MinVersion: p.MinVersion}
+	if len(p.Pins) > 0 {
+		pins := p.Pins
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			want, ok := pins[strings.ToLower(cs.ServerName)]
+			if !ok {
+				return nil
+			}
+			for _, chain := range cs.VerifiedChains {
+				for _, cert := range chain {
+					pin := SPKIPin(cert)
+					for _, w := range want {
+						if pin == w {
+							return nil
+						}
+					}
+				}
+			}
+			return fmt.Errorf("certificate chain for %s doesn't include a pinned key", cs.ServerName)
+		}
+	}
+	return cfg
+}
@@ -0,0 +1,176 @@
+package util
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+)
+
+// HTTPClientOptions tunes the transport of a RobustHTTPClient. Clients
+// fetching lots of repos from a few large PDSs want more idle connections
+// per host than the defaults keep, so they aren't constantly redialing.
+type HTTPClientOptions struct {
+	// Proxy for requests; nil for the environment's proxy settings
+	Proxy ProxyFunc
+	// TLS settings for connections; nil for the defaults
+	TLSConfig *tls.Config
+	// Whether to use HTTP/2 with servers that offer it
+	HTTP2 bool
+	// How many idle connections are kept open, in all and to each host
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	// The most connections open to each host at once; zero for no limit
+	MaxConnsPerHost int
+	// How long idle connections are kept open
+	IdleConnTimeout time.Duration
+	// How many TLS sessions are kept to resume, so reconnecting to a host
+	// skips most of the handshake; zero to not resume sessions
+	TLSSessionCacheSize int
+	// Caches host lookups for new connections; nil to look hosts up each time
+	DNSCache *DNSCache
+	// Timeout for each request, including its retries
+	Timeout time.Duration
+}
+
+// DefaultHTTPClientOptions returns the options RobustHTTPClient uses
+func DefaultHTTPClientOptions() *HTTPClientOptions {
+	return &HTTPClientOptions{
+		Proxy:               http.ProxyFromEnvironment,
+		HTTP2:               true,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: runtime.GOMAXPROCS(0) + 1,
+		IdleConnTimeout:     90 * time.Second,
+		Timeout:             30 * time.Second,
+	}
+}
+
+// RobustHTTPClientWithOptions is RobustHTTPClient with its transport set up
+// by opts. Copies of the returned client share its connection pool, so one
+// client can be made and copied for each use that sets its own Timeout.
+func RobustHTTPClientWithOptions(opts *HTTPClientOptions) (*http.Client, error) {
+	if opts.MaxIdleConns < 0 || opts.MaxIdleConnsPerHost < 0 || opts.MaxConnsPerHost < 0 || opts.TLSSessionCacheSize < 0 {
+		return nil, fmt.Errorf("connection and session limits can't be negative")
+	}
+	if opts.MaxConnsPerHost > 0 && opts.MaxIdleConnsPerHost > opts.MaxConnsPerHost {
+		return nil, fmt.Errorf("max idle connections per host (%d) can't be more than max connections per host (%d)", opts.MaxIdleConnsPerHost, opts.MaxConnsPerHost)
+	}
+	return newRobustHTTPClientWithOptions(opts), nil
+}
+
+func newHTTPTransport(opts *HTTPClientOptions) *http.Transport {
+	transport := cleanhttp.DefaultPooledTransport()
+	transport.Proxy = opts.Proxy
+	if transport.Proxy == nil {
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+	transport.MaxIdleConns = opts.MaxIdleConns
+	transport.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	transport.MaxConnsPerHost = opts.MaxConnsPerHost
+	transport.IdleConnTimeout = opts.IdleConnTimeout
+
+	if opts.TLSConfig != nil {
+		transport.TLSClientConfig = opts.TLSConfig.Clone()
+	}
+	if opts.TLSSessionCacheSize > 0 {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		if transport.TLSClientConfig.ClientSessionCache == nil {
+			transport.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(opts.TLSSessionCacheSize)
+		}
+	}
+
+	if opts.HTTP2 {
+		// set up by cleanhttp already, but needed with our own TLS config
+		// and dialer
+		transport.ForceAttemptHTTP2 = true
+	} else {
+		transport.ForceAttemptHTTP2 = false
+		// a non-nil empty map turns HTTP/2 off
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	if opts.DNSCache != nil {
+		transport.DialContext = opts.DNSCache.DialContext
+	}
+	return transport
+}
+
+// DNSCache caches the addresses hosts resolve to, for a fixed time rather
+// than the records' TTLs, so that clients connecting to the same hosts over
+// and over don't look them up for every connection. A host whose addresses
+// all fail to connect is looked up again on the next dial.
+type DNSCache struct {
+	resolver *net.Resolver
+	dialer   *net.Dialer
+	addrs    *expirable.LRU[string, []string]
+}
+
+// NewDNSCache returns a DNSCache keeping up to size hosts' addresses for ttl
+func NewDNSCache(size int, ttl time.Duration) *DNSCache {
+	return &DNSCache{
+		resolver: net.DefaultResolver,
+		// as cleanhttp's transports dial
+		dialer: &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+		addrs: expirable.NewLRU[string, []string](size, nil, ttl),
+	}
+}
+
+// LookupHost returns host's addresses, looking them up if they aren't cached
+func (dc *DNSCache) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := dc.addrs.Get(host); ok {
+		return addrs, nil
+	}
+	addrs, err := dc.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	dc.addrs.Add(host, addrs)
+	return addrs, nil
+}
+
+// DialContext dials addr, trying each of its host's cached addresses in turn.
+// It can be used as an http.Transport's DialContext.
+func (dc *DNSCache) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return dc.dialer.DialContext(ctx, network, addr)
+	}
+
+	addrs, err := dc.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var firstErr error
+	for _, a := range addrs {
+		conn, err := dc.dialer.DialContext(ctx, network, net.JoinHostPort(a, port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	// the host may have moved
+	dc.addrs.Remove(host)
+	if firstErr == nil {
+		firstErr = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	return nil, firstErr
+}
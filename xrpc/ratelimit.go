@@ -0,0 +1,193 @@
+package xrpc
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type HostLimiterOptions struct {
+	// Requests per second allowed to a host before it has advertised a rate
+	// limit policy. Zero means no limit.
+	DefaultRate float64
+	// Fraction of a host's advertised rate to actually use, leaving room for
+	// other clients sharing the same limit
+	Headroom float64
+	// Number of times a request rejected with 429 is retried, after waiting
+	// for the host's rate limit window to reset
+	MaxRetries int
+	// Longest a request will wait for a host's window to reset. Hosts that ask
+	// for longer waits get their requests failed instead.
+	MaxWait time.Duration
+}
+
+func DefaultHostLimiterOptions() *HostLimiterOptions {
+	return &HostLimiterOptions{
+		Headroom:   0.9,
+		MaxRetries: 3,
+		MaxWait:    5 * time.Minute,
+	}
+}
+
+// HostLimiter paces requests to each host with a token bucket, adjusted to
+// match the RateLimit-* headers returned by the host. It is safe to share
+// between clients.
+type HostLimiter struct {
+	opts *HostLimiterOptions
+
+	lk    sync.Mutex
+	hosts map[string]*hostBucket
+}
+
+type hostBucket struct {
+	lim *rate.Limiter
+
+	lk           sync.Mutex
+	blockedUntil time.Time
+}
+
+func NewHostLimiter(opts *HostLimiterOptions) *HostLimiter {
+	if opts == nil {
+		opts = DefaultHostLimiterOptions()
+	}
+	return &HostLimiter{
+		opts:  opts,
+		hosts: make(map[string]*hostBucket),
+	}
+}
+
+func (hl *HostLimiter) bucket(host string) *hostBucket {
+	hl.lk.Lock()
+	defer hl.lk.Unlock()
+
+	b, ok := hl.hosts[host]
+	if !ok {
+		limit := rate.Inf
+		if hl.opts.DefaultRate > 0 {
+			limit = rate.Limit(hl.opts.DefaultRate)
+		}
+		b = &hostBucket{lim: rate.NewLimiter(limit, 1)}
+		hl.hosts[host] = b
+	}
+	return b
+}
+
+// Wait blocks until a request may be sent to the host
+func (hl *HostLimiter) Wait(ctx context.Context, host string) error {
+	b := hl.bucket(host)
+
+	b.lk.Lock()
+	until := b.blockedUntil
+	b.lk.Unlock()
+
+	if d := time.Until(until); d > 0 {
+		if d > hl.opts.MaxWait {
+			return &Error{
+				StatusCode: http.StatusTooManyRequests,
+				Ratelimit:  &RatelimitInfo{Reset: until},
+			}
+		}
+
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+
+	return b.lim.Wait(ctx)
+}
+
+// Observe updates the host's bucket from the rate limit headers on a
+// response. A 429 (or exhausted quota) blocks the host until its window
+// resets.
+func (hl *HostLimiter) Observe(host string, status int, h http.Header) {
+	rl := parseRatelimitHeaders(h)
+	if rl == nil && status != http.StatusTooManyRequests {
+		return
+	}
+
+	b := hl.bucket(host)
+
+	if rl != nil {
+		if r := policyRate(rl); r > 0 {
+			r *= hl.opts.Headroom
+			if b.lim.Limit() != rate.Limit(r) {
+				b.lim.SetLimit(rate.Limit(r))
+			}
+		}
+	}
+
+	exhausted := status == http.StatusTooManyRequests || (rl != nil && h.Get("ratelimit-remaining") != "" && rl.Remaining <= 0)
+	if !exhausted {
+		return
+	}
+
+	var until time.Time
+	if rl != nil && !rl.Reset.IsZero() {
+		until = rl.Reset
+	}
+	if ra := h.Get("Retry-After"); ra != "" {
+		if secs, err := strconv.Atoi(ra); err == nil {
+			until = time.Now().Add(time.Duration(secs) * time.Second)
+		}
+	}
+	if until.IsZero() {
+		// no hint from the host, back off briefly
+		until = time.Now().Add(time.Second)
+	}
+
+	b.lk.Lock()
+	if until.After(b.blockedUntil) {
+		b.blockedUntil = until
+	}
+	b.lk.Unlock()
+}
+
+// policyRate returns the rate in requests per second described by a
+// RateLimit-Policy header (eg, "3000;w=300"), or zero if there isn't one
+func policyRate(rl *RatelimitInfo) float64 {
+	if rl.Policy != "" {
+		parts := strings.Split(rl.Policy, ";")
+		limit, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err == nil && limit > 0 {
+			for _, p := range parts[1:] {
+				k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+				if !ok || k != "w" {
+					continue
+				}
+				if w, err := strconv.Atoi(v); err == nil && w > 0 {
+					return float64(limit) / float64(w)
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func parseRatelimitHeaders(h http.Header) *RatelimitInfo {
+	if h.Get("ratelimit-limit") == "" {
+		return nil
+	}
+
+	rl := &RatelimitInfo{
+		Policy: h.Get("ratelimit-policy"),
+	}
+	if n, err := strconv.ParseInt(h.Get("ratelimit-reset"), 10, 64); err == nil {
+		rl.Reset = time.Unix(n, 0)
+	}
+	if n, err := strconv.ParseInt(h.Get("ratelimit-limit"), 10, 64); err == nil {
+		rl.Limit = int(n)
+	}
+	if n, err := strconv.ParseInt(h.Get("ratelimit-remaining"), 10, 64); err == nil {
+		rl.Remaining = int(n)
+	}
+	return rl
+}
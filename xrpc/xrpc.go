@@ -5,15 +5,16 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/util/retry"
 	"github.com/carlmjohnson/versioninfo"
 )
 
@@ -25,6 +26,9 @@ type Client struct {
 	Host       string
 	UserAgent  *string
 	Headers    map[string]string
+	// Limiter, if set, paces requests to Host according to the rate limits
+	// it advertises, and retries requests rejected with 429
+	Limiter *HostLimiter
 }
 
 func (c *Client) getClient() *http.Client {
@@ -81,26 +85,22 @@ func (e *Error) IsThrottled() bool {
 	return e.StatusCode == http.StatusTooManyRequests
 }
 
+// RetryClass classifies errors returned by Client.Do for use with the
+// util/retry package, based on the response status code if there was one
+func RetryClass(err error) retry.Class {
+	var xe *Error
+	if errors.As(err, &xe) {
+		return retry.ClassifyHTTPStatus(xe.StatusCode)
+	}
+	return retry.DefaultClassify(err)
+}
+
 func errorFromHTTPResponse(resp *http.Response, err error) error {
-	r := &Error{
+	return &Error{
 		StatusCode: resp.StatusCode,
 		Wrapped:    err,
+		Ratelimit:  parseRatelimitHeaders(resp.Header),
 	}
-	if resp.Header.Get("ratelimit-limit") != "" {
-		r.Ratelimit = &RatelimitInfo{
-			Policy: resp.Header.Get("ratelimit-policy"),
-		}
-		if n, err := strconv.ParseInt(resp.Header.Get("ratelimit-reset"), 10, 64); err == nil {
-			r.Ratelimit.Reset = time.Unix(n, 0)
-		}
-		if n, err := strconv.ParseInt(resp.Header.Get("ratelimit-limit"), 10, 64); err == nil {
-			r.Ratelimit.Limit = int(n)
-		}
-		if n, err := strconv.ParseInt(resp.Header.Get("ratelimit-remaining"), 10, 64); err == nil {
-			r.Ratelimit.Remaining = int(n)
-		}
-	}
-	return r
 }
 
 type RatelimitInfo struct {
@@ -190,9 +190,9 @@ func (c *Client) Do(ctx context.Context, kind XRPCRequestType, inpenc string, me
 		req.Header.Set("Authorization", "Bearer "+c.Auth.AccessJwt)
 	}
 
-	resp, err := c.getClient().Do(req.WithContext(ctx))
+	resp, err := c.send(ctx, req)
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
+		return err
 	}
 
 	defer resp.Body.Close()
@@ -227,3 +227,44 @@ func (c *Client) Do(ctx context.Context, kind XRPCRequestType, inpenc string, me
 
 	return nil
 }
+
+// send performs the request, going through the rate limiter if one is set
+func (c *Client) send(ctx context.Context, req *http.Request) (*http.Response, error) {
+	req = req.WithContext(ctx)
+	if c.Limiter == nil {
+		resp, err := c.getClient().Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("request failed: %w", err)
+		}
+		return resp, nil
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := c.Limiter.Wait(ctx, c.Host); err != nil {
+			return nil, err
+		}
+
+		resp, err := c.getClient().Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("request failed: %w", err)
+		}
+		c.Limiter.Observe(c.Host, resp.StatusCode, resp.Header)
+
+		// bodies are only replayable if the request knows how to recreate them
+		replayable := req.Body == nil || req.GetBody != nil
+		if resp.StatusCode != http.StatusTooManyRequests || attempt >= c.Limiter.opts.MaxRetries || !replayable {
+			return resp, nil
+		}
+
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+	}
+}
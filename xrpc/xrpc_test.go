@@ -1,7 +1,14 @@
 package xrpc
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // TestMakeParams tests the makeParams function.
@@ -57,3 +64,83 @@ func TestMakeParams(t *testing.T) {
 		})
 	}
 }
+
+func TestPolicyRate(t *testing.T) {
+	testCases := []struct {
+		policy   string
+		expected float64
+	}{
+		{"", 0},
+		{"3000;w=300", 10},
+		{"100; w=10", 10},
+		{"100", 0},
+		{"bogus;w=10", 0},
+	}
+
+	for _, tc := range testCases {
+		got := policyRate(&RatelimitInfo{Policy: tc.policy})
+		if got != tc.expected {
+			t.Errorf("policy %q: got %v, want %v", tc.policy, got, tc.expected)
+		}
+	}
+}
+
+func TestLimiterRetries429(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("RateLimit-Limit", "100")
+		w.Header().Set("RateLimit-Policy", "100;w=10")
+		if calls.Add(1) == 1 {
+			w.Header().Set("RateLimit-Remaining", "0")
+			w.Header().Set("RateLimit-Reset", strconv.FormatInt(time.Now().Unix(), 10))
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("RateLimit-Remaining", "99")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	c := &Client{
+		Host:    srv.URL,
+		Limiter: NewHostLimiter(nil),
+	}
+
+	var out struct {
+		Ok bool `json:"ok"`
+	}
+	start := time.Now()
+	if err := c.Do(context.Background(), Query, "", "com.example.test", nil, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !out.Ok {
+		t.Fatal("expected successful response after retry")
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("expected 2 calls, got %d", calls.Load())
+	}
+	if time.Since(start) < 900*time.Millisecond {
+		t.Fatal("expected retry to wait for Retry-After")
+	}
+}
+
+func TestLimiterMaxWait(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	c := &Client{
+		Host:    srv.URL,
+		Limiter: NewHostLimiter(nil),
+	}
+
+	err := c.Do(context.Background(), Query, "", "com.example.test", nil, nil, nil)
+	var xerr *Error
+	if !errors.As(err, &xerr) || !xerr.IsThrottled() {
+		t.Fatalf("expected throttled error, got %v", err)
+	}
+}